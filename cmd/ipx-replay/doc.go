@@ -0,0 +1,10 @@
+// Package main provides ipx-replay, which replays recorded ipxpress requests
+// against one or two servers and reports how the responses differ.
+//
+// Usage:
+//
+//	ipx-replay -targets http://old:8080/ipx,http://new:8080/ipx -json report.json requests.txt
+//
+// The input holds one request URI, absolute URL or access log line per line
+// (stdin if no file is given). The exit status is 1 if any response differs.
+package main
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/vladislavsavi/ipxpress/pkg/replay"
+)
+
+func main() {
+	targets := flag.String("targets", "", "comma-separated base URLs (one or two)")
+	concurrency := flag.Int("c", 8, "maximum concurrent requests")
+	threshold := flag.Float64("threshold", replay.DefaultThreshold, "mean per-channel pixel difference reported as a change")
+	jsonOut := flag.String("json", "", "write the full report as JSON to this file (- for stdout)")
+	flag.Parse()
+
+	if *targets == "" {
+		log.Fatal("-targets is required")
+	}
+
+	var input io.Reader = os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	requests, err := replay.ReadRequests(input)
+	if err != nil {
+		log.Fatalf("reading requests: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := replay.Run(ctx, requests, replay.Options{
+		Targets:     strings.Split(*targets, ","),
+		Concurrency: *concurrency,
+		Threshold:   *threshold,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *jsonOut != "" {
+		out := os.Stdout
+		if *jsonOut != "-" {
+			if out, err = os.Create(*jsonOut); err != nil {
+				log.Fatal(err)
+			}
+			defer out.Close()
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("writing report: %v", err)
+		}
+	}
+
+	summary := os.Stdout
+	if *jsonOut == "-" {
+		summary = os.Stderr
+	}
+	report.WriteSummary(summary)
+
+	if report.Summary.Differing > 0 {
+		stop()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// Exit codes of convert.
+const (
+	exitOK     = 0
+	exitFailed = 1 // some inputs or variants failed
+	exitUsage  = 2
+)
+
+// stdio is the path of stdin as input and stdout as output.
+const stdio = "-"
+
+// imageExts are the extensions of the files -dir converts; others are skipped.
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".avif": true,
+	".heic": true, ".heif": true, ".tif": true, ".tiff": true, ".jxl": true, ".svg": true,
+}
+
+// convertInput is a source file and its path relative to where it was found,
+// which names its outputs.
+type convertInput struct {
+	path string // "-" for stdin
+	rel  string
+}
+
+// runConvert runs "ipxpress convert" with args (without the subcommand) and
+// returns the exit code.
+func runConvert(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fset := flag.NewFlagSet("convert", flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	fset.Usage = func() {
+		fmt.Fprintln(stderr, "usage: ipxpress convert [flags] input... (-o file | -out dir)")
+		fmt.Fprintln(stderr, "       ipxpress convert [flags] -dir photos -out dist [-sizes 400,800]")
+		fset.PrintDefaults()
+	}
+	width := fset.Int("w", 0, "width to resize to")
+	height := fset.Int("h", 0, "height to resize to")
+	format := fset.String("f", "", "output format, e.g. webp; defaults to the source's")
+	quality := fset.Int("q", 0, "encoding quality, 1-100")
+	fit := fset.String("fit", "", "how to fit -w and -h: cover, contain, fill, inside or outside")
+	query := fset.String("query", "", "further parameters in the query syntax of the /ipx/ endpoint, e.g. \"blur=2&strip=true\"")
+	output := fset.String("o", "", "output file of a single input, - for stdout")
+	dir := fset.String("dir", "", "convert the images in this directory and below")
+	outDir := fset.String("out", "", "directory to write outputs to, keeping the layout of -dir")
+	sizes := fset.String("sizes", "", "comma-separated widths; each input gets one output per width, named name-WIDTH.ext")
+	concurrency := fset.Int("concurrency", runtime.GOMAXPROCS(0), "inputs converted at once")
+	configPath := fset.String("config", "", "JSON configuration file, as for the server")
+	// Flags may follow inputs, as in "convert in.jpg -o out.webp"
+	var positional []string
+	for rest := args; ; {
+		if err := fset.Parse(rest); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return exitOK
+			}
+			return exitUsage
+		}
+		parsed := len(rest) - fset.NArg()
+		rest = fset.Args()
+		if parsed > 0 && args[len(args)-len(rest)-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		rest = rest[1:]
+	}
+	usage := func(format string, args ...any) int {
+		fmt.Fprintf(stderr, "ipxpress convert: "+format+"\n", args...)
+		return exitUsage
+	}
+
+	params, err := convertParams(*width, *height, *format, *quality, *fit, *query)
+	if err != nil {
+		return usage("%v", err)
+	}
+	widths, err := parseSizes(*sizes)
+	if err != nil {
+		return usage("%v", err)
+	}
+	variants := []*ipxpress.ProcessingParams{params}
+	if len(widths) > 0 {
+		variants = variants[:0]
+		for _, w := range widths {
+			p := *params
+			p.Width = w
+			variants = append(variants, &p)
+		}
+	}
+
+	inputs, err := collectInputs(positional, *dir)
+	if err != nil {
+		return usage("%v", err)
+	}
+	if len(inputs) == 0 {
+		return usage("no inputs")
+	}
+	switch {
+	case *output != "" && *outDir != "":
+		return usage("-o and -out can't be combined")
+	case *output != "" && (len(inputs) > 1 || len(variants) > 1):
+		return usage("-o takes a single input and size; use -out")
+	case *output == "" && *outDir == "":
+		if len(inputs) > 1 || len(variants) > 1 || inputs[0].path != stdio {
+			return usage("set -o or -out")
+		}
+		*output = stdio
+	}
+	for _, in := range inputs[1:] {
+		if in.path == stdio || inputs[0].path == stdio {
+			return usage("stdin must be the only input")
+		}
+	}
+
+	var stdinData []byte
+	if inputs[0].path == stdio {
+		if stdinData, err = io.ReadAll(stdin); err != nil {
+			fmt.Fprintf(stderr, "ipxpress convert: reading stdin: %v\n", err)
+			return exitFailed
+		}
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "ipxpress convert: %v\n", err)
+		return exitUsage
+	}
+	// Only problems are worth a line next to the summary
+	logger := slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	handler := ipxpress.NewHandler(config, ipxpress.WithLogger(logger))
+	defer handler.Close()
+
+	items := make(chan ipxpress.BatchItem)
+	go func() {
+		defer close(items)
+		for _, in := range inputs {
+			item := ipxpress.BatchItem{ID: in.rel, Path: in.path, Params: variants}
+			if in.path == stdio {
+				item.Path, item.Data = "", stdinData
+			}
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var converted, failed int
+	for res := range handler.BatchProcess(ctx, items, ipxpress.BatchOptions{Concurrency: *concurrency}) {
+		in := inputs[res.Index]
+		if res.Err != nil {
+			failed++
+			fmt.Fprintf(stderr, "%s: %v\n", in.path, res.Err)
+			continue
+		}
+		for i, v := range res.Variants {
+			if v.Err != nil {
+				failed++
+				fmt.Fprintf(stderr, "%s: %v\n", in.path, v.Err)
+				continue
+			}
+			size := 0
+			if len(widths) > 0 {
+				size = widths[i]
+			}
+			target := *output
+			if target == "" {
+				target = filepath.Join(*outDir, outputName(in.rel, size, v.Format))
+			}
+			if err := writeOutput(target, v.Data, stdout); err != nil {
+				failed++
+				fmt.Fprintf(stderr, "%s: %v\n", in.path, err)
+				continue
+			}
+			converted++
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		fmt.Fprintf(stderr, "ipxpress convert: %v\n", err)
+		return exitFailed
+	}
+	if *output != stdio {
+		fmt.Fprintf(stderr, "converted %d, failed %d\n", converted, failed)
+	}
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// convertParams builds the params of convert's flags through the query parser
+// of the HTTP endpoint, so both accept the same values.
+func convertParams(width, height int, format string, quality int, fit, query string) (*ipxpress.ProcessingParams, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -query: %w", err)
+	}
+	if _, err := ipxpress.LookupFormat(format); err != nil {
+		return nil, err
+	}
+	for key, value := range map[string]string{"w": strconv.Itoa(width), "h": strconv.Itoa(height), "q": strconv.Itoa(quality)} {
+		if value != "0" {
+			q.Set(key, value)
+		}
+	}
+	if format != "" {
+		q.Set("f", format)
+	}
+	if fit != "" {
+		q.Set("fit", fit)
+	}
+	if q.Has("url") || q.Has("overlay") {
+		return nil, errors.New("url and overlay are not supported by convert")
+	}
+	params := ipxpress.ParseProcessingParams(&http.Request{URL: &url.URL{RawQuery: q.Encode()}})
+	if err := params.Err(); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+// parseSizes parses the widths of -sizes.
+func parseSizes(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var widths []int
+	for _, field := range strings.Split(s, ",") {
+		w, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid -sizes width %q", field)
+		}
+		widths = append(widths, w)
+	}
+	return widths, nil
+}
+
+// collectInputs expands args, which may be glob patterns, and the images under
+// dir. Patterns matching nothing are an error, like files that don't exist.
+func collectInputs(args []string, dir string) ([]convertInput, error) {
+	var inputs []convertInput
+	for _, arg := range args {
+		if arg == stdio {
+			inputs = append(inputs, convertInput{path: stdio, rel: "stdin"})
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file", arg)
+		}
+		for _, path := range matches {
+			inputs = append(inputs, convertInput{path: path, rel: filepath.Base(path)})
+		}
+	}
+	if dir != "" {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !imageExts[strings.ToLower(filepath.Ext(path))] {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			inputs = append(inputs, convertInput{path: path, rel: rel})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inputs, nil
+}
+
+// outputName names the output of an input at rel: its extension replaced with
+// the format's, and the width appended if it's one of -sizes.
+func outputName(rel string, width int, format ipxpress.Format) string {
+	name := strings.TrimSuffix(rel, filepath.Ext(rel))
+	if width > 0 {
+		name += "-" + strconv.Itoa(width)
+	}
+	ext := "." + format.String()
+	if format == ipxpress.FormatJPEG {
+		ext = ".jpg"
+	}
+	return name + ext
+}
+
+// writeOutput writes data to path, creating its directory, or to stdout for "-".
+func writeOutput(path string, data []byte, stdout io.Writer) error {
+	if path == stdio {
+		_, err := stdout.Write(data)
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
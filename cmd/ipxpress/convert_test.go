@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+func createPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func writeFiles(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func convert(t *testing.T, stdin []byte, args ...string) (int, []byte, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := runConvert(context.Background(), args, bytes.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.Bytes(), stderr.String()
+}
+
+// TestConvertUsage verifies invalid invocations exit with 2 before converting anything
+func TestConvertUsage(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{"a.png": {1}, "b.png": {2}})
+	a, b := filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png")
+
+	for _, args := range [][]string{
+		{},
+		{a},
+		{"-o", "x.png", "-out", dir, a},
+		{"-o", "x.png", a, b},
+		{a, "-o", "x.png", b},
+		{"-o", "x.png", "-sizes", "10,20", a},
+		{"-sizes", "10,x", "-out", dir, a},
+		{"-f", "bmp", "-out", dir, a},
+		{"-query", "url=http://x/a.jpg", "-out", dir, a},
+		{"-out", dir, filepath.Join(dir, "missing.png")},
+		{"-out", dir, filepath.Join(dir, "*.jpg")},
+		{"-out", dir, "-", a},
+		{"-unknown"},
+	} {
+		if code, _, _ := convert(t, nil, args...); code != exitUsage {
+			t.Errorf("%q: expected exit code %d, got %d", args, exitUsage, code)
+		}
+	}
+	if code, _, stderr := convert(t, nil, "-out", dir, "--", "-w"); code != exitUsage || !strings.Contains(stderr, "-w: no such file") {
+		t.Errorf("expected arguments after -- to be inputs, got %d: %s", code, stderr)
+	}
+	if code, _, _ := convert(t, nil, "-help"); code != exitOK {
+		t.Errorf("-help: expected exit code 0, got %d", code)
+	}
+}
+
+// TestCollectInputs verifies globs and directories expand to images named relative to where they were found
+func TestCollectInputs(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string][]byte{
+		"a.jpg": nil, "b.PNG": nil, "notes.txt": nil, "sub/c.webp": nil, "sub/deeper/d.gif": nil,
+	})
+
+	inputs, err := collectInputs([]string{filepath.Join(dir, "*.jpg"), "-"}, filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, in := range inputs {
+		got = append(got, in.rel)
+	}
+	want := []string{"a.jpg", "stdin", "c.webp", filepath.Join("deeper", "d.gif")}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	inputs, _ = collectInputs(nil, dir)
+	if len(inputs) != 4 {
+		t.Errorf("expected the 4 images of the tree, got %d", len(inputs))
+	}
+}
+
+// TestOutputName verifies outputs get the format's extension and the width of -sizes
+func TestOutputName(t *testing.T) {
+	for _, tc := range []struct {
+		rel    string
+		width  int
+		format ipxpress.Format
+		want   string
+	}{
+		{"a.png", 0, ipxpress.FormatWebP, "a.webp"},
+		{"photo.tar.png", 0, ipxpress.FormatJPEG, "photo.tar.jpg"},
+		{filepath.Join("sub", "b.jpg"), 400, ipxpress.FormatAVIF, filepath.Join("sub", "b-400.avif")},
+		{"noext", 800, ipxpress.FormatPNG, "noext-800.png"},
+	} {
+		if got := outputName(tc.rel, tc.width, tc.format); got != tc.want {
+			t.Errorf("%s at %d as %s: expected %q, got %q", tc.rel, tc.width, tc.format, tc.want, got)
+		}
+	}
+}
+
+// TestConvertFiles verifies single files, directories with sizes and stdin are converted
+func TestConvertFiles(t *testing.T) {
+	src := createPNG(t, 300, 200)
+	in, out := t.TempDir(), t.TempDir()
+	writeFiles(t, in, map[string][]byte{"a.png": src, "sub/b.png": src})
+
+	target := filepath.Join(out, "single.webp")
+	if code, _, stderr := convert(t, nil, "-w", "100", "-f", "webp", "-q", "80", filepath.Join(in, "a.png"), "-o", target); code != exitOK {
+		t.Fatalf("single: exit code %d: %s", code, stderr)
+	}
+	if data, _ := os.ReadFile(target); ipxpress.DetectFormat(data) != ipxpress.FormatWebP {
+		t.Errorf("single: expected a WebP file, got %d bytes", len(data))
+	}
+
+	if code, _, stderr := convert(t, nil, "-f", "png", "-sizes", "50,100", "-concurrency", "2", "-dir", in, "-out", out); code != exitOK {
+		t.Fatalf("dir: exit code %d: %s", code, stderr)
+	}
+	for name, width := range map[string]int{
+		"a-50.png": 50, "a-100.png": 100, filepath.Join("sub", "b-50.png"): 50, filepath.Join("sub", "b-100.png"): 100,
+	} {
+		data, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Errorf("dir: %v", err)
+			continue
+		}
+		if img, err := png.DecodeConfig(bytes.NewReader(data)); err != nil || img.Width != width {
+			t.Errorf("dir: %s: expected width %d, got %d (%v)", name, width, img.Width, err)
+		}
+	}
+
+	code, stdout, stderr := convert(t, src, "-w", "60", "-f", "png", "-")
+	if code != exitOK {
+		t.Fatalf("stdin: exit code %d: %s", code, stderr)
+	}
+	if img, err := png.DecodeConfig(bytes.NewReader(stdout)); err != nil || img.Width != 60 {
+		t.Errorf("stdin: expected a 60 wide PNG on stdout, got %v (%v)", img.Width, err)
+	}
+}
+
+// TestConvertFailures verifies bad inputs are reported and fail the exit code while the others are converted
+func TestConvertFailures(t *testing.T) {
+	in, out := t.TempDir(), t.TempDir()
+	writeFiles(t, in, map[string][]byte{"good.png": createPNG(t, 40, 40), "bad.png": []byte("not an image")})
+
+	code, _, stderr := convert(t, nil, "-f", "png", "-dir", in, "-out", out)
+	if code != exitFailed {
+		t.Errorf("expected exit code %d, got %d", exitFailed, code)
+	}
+	if !strings.Contains(stderr, "bad.png") || !strings.Contains(stderr, "converted 1, failed 1") {
+		t.Errorf("expected the failure and a summary, got %q", stderr)
+	}
+	if _, err := os.Stat(filepath.Join(out, "good.png")); err != nil {
+		t.Errorf("expected the good input converted: %v", err)
+	}
+}
@@ -3,7 +3,31 @@
 // Usage:
 //
 //	ipxpress -addr :8080
+//	ipxpress -addr :8443 -tls-cert cert.pem -tls-key key.pem
+//	ipxpress -addr "" -listen-unix /run/ipxpress.sock -unix-mode 0660
+//	IPX_CACHE_TTL=1h ipxpress -config /etc/ipxpress.json
 //
-// The server exposes the /ipx/ endpoint for image processing and /health for
-// a simple health check. See the project README for API details.
+// With a certificate and key the server speaks HTTPS, negotiating HTTP/2.
+// -read-timeout, -write-timeout, -idle-timeout and -max-header-bytes bound
+// what a client can hold the server to; -drain-timeout bounds shutdown.
+// Handler settings come from the -config file (see ipxpress.LoadConfig) and
+// IPX_ environment variables, which take precedence (see ipxpress.ApplyEnv).
+// -warm-file lists variants to process into the cache once the server
+// listens (see ipxpress.LoadWarmSpecs).
+//
+// The convert subcommand runs the same pipeline on files, without a server:
+//
+//	ipxpress convert -w 800 -f webp -q 80 input.jpg -o out.webp
+//	ipxpress convert -f avif -sizes 400,800,1600 -dir ./photos -out ./dist
+//	ipxpress convert -w 200 -f png "shots/*.jpg" -out thumbs
+//	cat in.jpg | ipxpress convert -w 400 -f webp - > out.webp
+//
+// Inputs may be glob patterns, and "-" reads stdin or, with -o, writes stdout.
+// -concurrency bounds the inputs converted at once, -query takes any other
+// parameter of the /ipx/ endpoint. The exit status is 1 if any input failed,
+// 2 for invalid usage.
+//
+// The server exposes the /ipx/ endpoint for image processing, /health/live
+// and /health/ready for liveness and readiness probes (see Handler.Health),
+// and /health as an alias of /health/live. See the project README for API details.
 package main
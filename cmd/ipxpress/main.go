@@ -1,53 +1,203 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
 	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		code := runConvert(ctx, os.Args[2:], os.Stdin, os.Stdout, os.Stderr)
+		stop()
+		os.Exit(code)
+	}
+
 	// Structured JSON logging so fields (url, error, ...) are queryable in Loki
 	// instead of buried in plain text.
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 
-	addr := flag.String("addr", ":8080", "address to listen on")
+	configPath := flag.String("config", "", "JSON configuration file; IPX_ environment variables override it")
+	addr := flag.String("addr", ":8080", "address to listen on; empty to listen on -listen-unix only")
+	listenUnix := flag.String("listen-unix", "", "Unix socket to listen on, e.g. /run/ipxpress.sock, alongside -addr")
+	unixMode := flag.String("unix-mode", "0660", "permissions of the -listen-unix socket, in octal")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long to wait for in-flight requests on SIGINT/SIGTERM")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file; serves HTTPS (and HTTP/2) together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "PEM key file for -tls-cert")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "maximum time to read a request, headers included")
+	writeTimeout := flag.Duration("write-timeout", 2*time.Minute, "maximum time to fetch, process and write a response")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "maximum time a keep-alive connection waits for the next request")
+	maxHeaderBytes := flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "maximum size of request headers")
+	warmFile := flag.String("warm-file", "", "JSON list of variants to cache once listening, see ipxpress.LoadWarmSpecs")
 	flag.Parse()
 
-	// Create handler with custom config including vips settings
-	config := ipxpress.DefaultConfig()
-	config.VipsConfig = &ipxpress.VipsConfig{
-		MaxCacheMem:   0, // Disable libvips caching (we manage cache at application level)
-		MaxCacheSize:  0, // Disable libvips caching
-		MaxCacheFiles: 0, // No file cache
-		LogLevel:      vips.LogLevelWarning,
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	handler := ipxpress.NewHandler(config)
+	var warmSpecs []ipxpress.WarmSpec
+	if *warmFile != "" {
+		specs, err := ipxpress.LoadWarmSpecs(*warmFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		warmSpecs = specs
+	}
 
-	// Add custom processors (optional - examples)
-	handler.UseProcessor(ipxpress.AutoOrientProcessor())
-	handler.UseProcessor(ipxpress.StripMetadataProcessor())
+	handler := ipxpress.NewHandler(config)
 
 	// Add middlewares (optional - examples)
 	handler.UseMiddleware(ipxpress.CORSMiddleware([]string{"*"}))
 
 	mux := http.NewServeMux()
-	// Mount at /ipx/ to handle image processing requests
-	mux.Handle("/ipx/", http.StripPrefix("/ipx/", handler))
+	// Mount at /ipx to handle image processing requests
+	ipxpress.Mount(mux, "/ipx", handler)
 
-	// Health check endpoint
+	// One-shot upload endpoint, only exposed when tokens to authenticate it are set
+	if tokens := os.Getenv("IPX_TRANSFORM_TOKENS"); tokens != "" {
+		mux.Handle("POST /ipx/transform", ipxpress.AuthMiddleware(strings.Split(tokens, ","))(handler.Transform()))
+	}
+
+	// Admin endpoints (/admin/stats, /admin/memory, ...), likewise only with tokens set
+	if tokens := os.Getenv("IPX_ADMIN_TOKENS"); tokens != "" {
+		mux.Handle("/admin/", http.StripPrefix("/admin", ipxpress.AuthMiddleware(strings.Split(tokens, ","))(handler.Admin())))
+	}
+
+	// Probes: /health/live while the process runs, /health/ready while images can
+	// be served; /health stays for existing liveness checks
+	mux.Handle("/health/", http.StripPrefix("/health", handler.Health()))
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
 
-	fmt.Printf("starting ipxpress server on %s\n", *addr)
-	log.Fatal(http.ListenAndServe(*addr, mux))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	srv, err := ipxpress.NewServer(mux, ipxpress.ServerOptions{
+		Addr:           *addr,
+		TLSCertFile:    *tlsCert,
+		TLSKeyFile:     *tlsKey,
+		ReadTimeout:    *readTimeout,
+		WriteTimeout:   *writeTimeout,
+		IdleTimeout:    *idleTimeout,
+		MaxHeaderBytes: *maxHeaderBytes,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *addr == "" && *listenUnix == "" {
+		log.Fatal("nothing to listen on: set -addr or -listen-unix")
+	}
+	serve := func(ln net.Listener) error {
+		if srv.TLSConfig != nil {
+			return srv.ServeTLS(ln, "", "")
+		}
+		return srv.Serve(ln)
+	}
+	serveErr := make(chan error, 2)
+	if *addr != "" {
+		ln, err := net.Listen("tcp", *addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("starting ipxpress server on %s\n", *addr)
+		go func() { serveErr <- serve(ln) }()
+	}
+	if *listenUnix != "" {
+		mode, err := strconv.ParseUint(*unixMode, 8, 32)
+		if err != nil {
+			log.Fatalf("invalid -unix-mode %q: %v", *unixMode, err)
+		}
+		// Closed, and so removed, by srv.Shutdown
+		ln, err := ipxpress.ListenUnix(*listenUnix, os.FileMode(mode))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("starting ipxpress server on unix:%s\n", *listenUnix)
+		go func() { serveErr <- serve(ln) }()
+	}
+
+	// Warm the cache in the background; requests are served meanwhile
+	if len(warmSpecs) > 0 {
+		go func() {
+			failed := 0
+			for i, err := range handler.Warm(ctx, warmSpecs) {
+				if err != nil {
+					failed++
+					slog.Warn("warm-up failed", "url", warmSpecs[i].URL, "error", err)
+				}
+			}
+			slog.Info("cache warmed", "warmed", len(warmSpecs)-failed, "failed", failed)
+		}()
+	}
+
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process
+
+	// Stop accepting requests, let the ones in flight finish encoding, then
+	// release the handler and libvips
+	slog.Info("shutting down", "drain_timeout", drainTimeout.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server shutdown incomplete", "error", err)
+	}
+	drained := handler.Shutdown(drainCtx) == nil
+	handler.Close()
+	if !drained {
+		// Requests still hold libvips images; shutting it down under them would crash
+		slog.Error("drain timeout exceeded, exiting with requests in flight")
+		os.Exit(1)
+	}
+	vips.Shutdown()
+}
+
+// loadConfig returns the default configuration with libvips' own caching off,
+// overridden by the JSON file at path, if any, and IPX_ environment variables.
+func loadConfig(path string) (*ipxpress.Config, error) {
+	config := ipxpress.DefaultConfig()
+	config.VipsConfig = &ipxpress.VipsConfig{
+		MaxCacheMem:   0, // Disable libvips caching (we manage cache at application level)
+		MaxCacheSize:  0, // Disable libvips caching
+		MaxCacheFiles: 0, // No file cache
+		LogLevel:      vips.LogLevelWarning,
+	}
+	if path != "" {
+		loaded, err := ipxpress.LoadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		if loaded.VipsConfig == nil {
+			loaded.VipsConfig = config.VipsConfig
+		}
+		config = loaded
+	}
+	if err := ipxpress.ApplyEnv(config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
 }
@@ -19,7 +19,6 @@ func main() {
 	handler := ipxpress.NewHandler(config)
 
 	// Add processors
-	handler.UseProcessor(ipxpress.AutoOrientProcessor())
 	handler.UseProcessor(ipxpress.CompressionOptimizer())
 
 	// Add middleware
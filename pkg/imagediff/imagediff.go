@@ -0,0 +1,133 @@
+// Package imagediff measures how close two images are, e.g. an encoded output
+// and a lossless reference, so that changes to encoder settings or pipelines that
+// lose quality can be caught by tests. SSIM follows structure the way people
+// see it, PSNR the plain pixel error.
+package imagediff
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+// ErrSizeMismatch is returned for images of different sizes.
+var ErrSizeMismatch = errors.New("imagediff: images differ in size")
+
+// SSIM parameters: windows of ssimWindow pixels square every ssimStep pixels,
+// and the stabilizing constants of Wang et al. for 8-bit values.
+const (
+	ssimWindow = 8
+	ssimStep   = 4
+	ssimC1     = (0.01 * 255) * (0.01 * 255)
+	ssimC2     = (0.03 * 255) * (0.03 * 255)
+)
+
+// SSIM returns the mean structural similarity of a and b, from 1 for identical
+// images down to 0 (or slightly below) for unrelated ones. It's computed on luma
+// over 8x8 windows, every 4 pixels. Colors are taken premultiplied, so
+// transparent areas compare as black. Visually lossless encodes usually stay
+// above 0.95.
+func SSIM(a, b image.Image) (float64, error) {
+	ba, bb := a.Bounds(), b.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return 0, ErrSizeMismatch
+	}
+	if ba.Empty() {
+		return 1, nil
+	}
+	w, h := ba.Dx(), ba.Dy()
+	la, lb := luma(a), luma(b)
+	ww, wh := min(ssimWindow, w), min(ssimWindow, h)
+	n := float64(ww * wh)
+
+	var total float64
+	var windows int
+	for y := 0; ; y += ssimStep {
+		y = min(y, h-wh)
+		for x := 0; ; x += ssimStep {
+			x = min(x, w-ww)
+			var sa, sb, saa, sbb, sab float64
+			for wy := y; wy < y+wh; wy++ {
+				row := wy * w
+				for wx := x; wx < x+ww; wx++ {
+					pa, pb := la[row+wx], lb[row+wx]
+					sa += pa
+					sb += pb
+					saa += pa * pa
+					sbb += pb * pb
+					sab += pa * pb
+				}
+			}
+			ma, mb := sa/n, sb/n
+			va, vb := saa/n-ma*ma, sbb/n-mb*mb
+			cov := sab/n - ma*mb
+			total += (2*ma*mb + ssimC1) * (2*cov + ssimC2) / ((ma*ma + mb*mb + ssimC1) * (va + vb + ssimC2))
+			windows++
+			if x == w-ww {
+				break
+			}
+		}
+		if y == h-wh {
+			break
+		}
+	}
+	return total / float64(windows), nil
+}
+
+// PSNR returns the peak signal-to-noise ratio of a and b in dB over their 8-bit
+// red, green and blue channels, premultiplied like in SSIM: +Inf for identical
+// images, typically 30-50 for lossy encodes. Higher is closer.
+func PSNR(a, b image.Image) (float64, error) {
+	ba, bb := a.Bounds(), b.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return 0, ErrSizeMismatch
+	}
+	if ba.Empty() {
+		return math.Inf(1), nil
+	}
+	pa, pb := rgb(a), rgb(b)
+	var sum float64
+	for i := range pa {
+		d := float64(pa[i]) - float64(pb[i])
+		sum += d * d
+	}
+	mse := sum / float64(3*ba.Dx()*ba.Dy())
+	if mse == 0 {
+		return math.Inf(1), nil
+	}
+	return 10 * math.Log10(255*255/mse), nil
+}
+
+// luma returns the BT.601 luma of img, row by row, on a 0-255 scale.
+func luma(img image.Image) []float64 {
+	pix := rgb(img)
+	out := make([]float64, len(pix)/3)
+	for i := range out {
+		out[i] = 0.299*float64(pix[3*i]) + 0.587*float64(pix[3*i+1]) + 0.114*float64(pix[3*i+2])
+	}
+	return out
+}
+
+// rgb returns the premultiplied 8-bit red, green and blue values of img, pixel
+// by pixel, row by row.
+func rgb(img image.Image) []uint8 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := make([]uint8, 0, 3*w*h)
+	if rgba, ok := img.(*image.RGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := rgba.Pix[rgba.PixOffset(b.Min.X, y):]
+			for x := 0; x < w; x++ {
+				out = append(out, row[4*x], row[4*x+1], row[4*x+2])
+			}
+		}
+		return out
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			out = append(out, uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+		}
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+package ipxpress
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// maxEntriesPage caps the limit parameter of the entries listing.
+const maxEntriesPage = 1000
+
+// Admin returns a handler with operational endpoints. It has no authentication of
+// its own, so mount it behind auth on an internal address:
+//
+//	mux.Handle("/admin/", http.StripPrefix("/admin", AuthMiddleware(tokens)(handler.Admin())))
+//
+// Endpoints:
+//
+//	GET /entries?prefix=&limit=100&cursor=  paginated cache listing (metadata only)
+//	GET /refresh                            background refresher totals (see RefreshStats)
+//	GET /memory                             memory budget usage (see MemoryStats)
+//	GET /fetcher                            origin requests, retries and fetch slots (see FetcherStats)
+//	GET /stats                              uptime, requests in flight, libvips memory and cache (see Stats)
+//	DELETE /cache?url=...&w=...             purge one variant, given the image request's query
+//	DELETE /cache?source=...                purge every variant of a source URL (see PurgeSource)
+//	GET /cache/stats                        entry count, bytes and hit rate (see CacheStats)
+//	POST /cache/flush                       purge everything
+func (h *Handler) Admin() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /entries", h.serveEntries)
+	mux.HandleFunc("GET /refresh", h.serveRefreshStats)
+	mux.HandleFunc("GET /memory", h.serveMemoryStats)
+	mux.HandleFunc("GET /fetcher", h.serveFetcherStats)
+	mux.HandleFunc("GET /stats", h.serveStats)
+	mux.HandleFunc("DELETE /cache", h.servePurge)
+	mux.HandleFunc("GET /cache/stats", h.serveCacheStats)
+	mux.HandleFunc("POST /cache/flush", h.serveFlush)
+	return mux
+}
+
+// ErrPurgeUnsupported is returned when the cache can't remove entries the way asked.
+var ErrPurgeUnsupported = errors.New("cache does not support purging")
+
+// Purge removes the cached response for the image request r, as ServeHTTP would
+// look it up: the same query, and Accept header for negotiated formats. It
+// reports whether there was one, if the cache is Enumerable; otherwise true.
+func (h *Handler) Purge(r *http.Request) (bool, error) {
+	purger, ok := h.cache.(Purger)
+	if !ok {
+		return false, ErrPurgeUnsupported
+	}
+	key, err := h.requestKey(r)
+	if err != nil {
+		return false, err
+	}
+	found := true
+	if enum, ok := h.cache.(Enumerable); ok {
+		_, found = enum.Peek(key)
+	}
+	purger.Delete(key)
+	return found, nil
+}
+
+// PurgeSource removes every cached response made from sourceURL, whatever the
+// parameters, and returns how many there were. It scans the cache, so it needs
+// the built-in InMemoryCache.
+func (h *Handler) PurgeSource(sourceURL string) (int, error) {
+	mem, ok := h.cache.(*InMemoryCache)
+	if !ok {
+		return 0, ErrPurgeUnsupported
+	}
+	return mem.deleteWhere(func(entry *CacheEntry) bool {
+		return entry.params != nil && entry.params.URL == sourceURL
+	}), nil
+}
+
+// requestKey returns the cache key ServeHTTP uses for r.
+func (h *Handler) requestKey(r *http.Request) (string, error) {
+	params := ParseProcessingParams(r)
+	if params.URL == "" {
+		return "", errors.New("url parameter is required")
+	}
+	q := r.URL.Query()
+	if err := h.applyPreset(q, params); err != nil {
+		return "", err
+	}
+	if len(h.pathProfiles) > 0 {
+		applyPathProfile(h.pathProfiles, params, q.Get("q") != "" || q.Get("quality") != "")
+		params.ResolveConflicts()
+	}
+	return h.cacheKey(params), nil
+}
+
+// purgeResult is the JSON body of DELETE /cache and POST /cache/flush.
+type purgeResult struct {
+	Purged int `json:"purged"`
+}
+
+// servePurge purges one variant, or every variant of the source parameter.
+func (h *Handler) servePurge(w http.ResponseWriter, r *http.Request) {
+	var result purgeResult
+	if source := r.URL.Query().Get("source"); source != "" {
+		n, err := h.PurgeSource(source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		result.Purged = n
+	} else {
+		found, err := h.Purge(r)
+		if errors.Is(err, ErrPurgeUnsupported) {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if found {
+			result.Purged = 1
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveFlush empties the cache.
+func (h *Handler) serveFlush(w http.ResponseWriter, r *http.Request) {
+	purger, ok := h.cache.(Purger)
+	if !ok {
+		http.Error(w, ErrPurgeUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+	var result purgeResult
+	if reporter, ok := h.cache.(StatsReporter); ok {
+		result.Purged = reporter.Stats().Entries
+	}
+	purger.Clear()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveCacheStats reports the cache's size and hit rate.
+func (h *Handler) serveCacheStats(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := h.cache.(StatsReporter)
+	if !ok {
+		http.Error(w, "cache does not report stats", http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reporter.Stats())
+}
+
+// serveMemoryStats reports the memory accountant's state, 404 if there's no budget.
+func (h *Handler) serveMemoryStats(w http.ResponseWriter, r *http.Request) {
+	if h.memory == nil {
+		http.Error(w, "memory budget is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.MemoryStats())
+}
+
+// serveFetcherStats reports the fetch slots in use and the built-in fetcher's totals.
+func (h *Handler) serveFetcherStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.FetcherStats())
+}
+
+// serveRefreshStats reports the refresher's totals, 404 if it's disabled.
+func (h *Handler) serveRefreshStats(w http.ResponseWriter, r *http.Request) {
+	if h.refresher == nil {
+		http.Error(w, "refresher is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.RefreshStats())
+}
+
+// entriesPage is the JSON body of GET /entries.
+type entriesPage struct {
+	Entries    []EntryMeta `json:"entries"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// serveEntries lists cache entries page by page. Keys are cache keys (see GenerateCacheKey).
+func (h *Handler) serveEntries(w http.ResponseWriter, r *http.Request) {
+	enum, ok := h.cache.(Enumerable)
+	if !ok {
+		http.Error(w, "cache does not support enumeration", http.StatusNotImplemented)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxEntriesPage)
+	}
+
+	keys, next := enum.Keys(q.Get("prefix"), limit, q.Get("cursor"))
+	page := entriesPage{Entries: make([]EntryMeta, 0, len(keys)), NextCursor: next}
+	for _, key := range keys {
+		// Entries may be evicted between listing and peeking
+		if meta, ok := enum.Peek(key); ok {
+			page.Entries = append(page.Entries, meta)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
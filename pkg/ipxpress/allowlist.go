@@ -0,0 +1,63 @@
+package ipxpress
+
+import (
+	"log/slog"
+	"maps"
+	"net/url"
+	"slices"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// packedOperations lists the parameters that set several others at once. Allowing
+// one allows its parts, and allowing every part allows it.
+var packedOperations = map[string][]string{
+	core.ParamResize:   {core.ParamWidth, core.ParamHeight},
+	core.ParamModulate: {core.ParamBrightness, core.ParamSaturation, core.ParamHue},
+}
+
+// operationAllowlist holds the canonical names of the parameters permitted by
+// Config.AllowedOperations. A nil allowlist permits everything.
+type operationAllowlist map[string]bool
+
+// compileAllowedOperations resolves aliases and packed parameters. Unknown names
+// are logged and skipped, which only narrows what is allowed.
+func compileAllowedOperations(names []string) operationAllowlist {
+	if len(names) == 0 {
+		return nil
+	}
+	allowed := operationAllowlist{core.ParamURL: true, core.ParamPreset: true}
+	for _, name := range names {
+		spec, ok := core.LookupParam(name)
+		if !ok {
+			slog.Error("unknown parameter in allowed operations", "param", name)
+			continue
+		}
+		allowed[spec.Name] = true
+	}
+	for packed, parts := range packedOperations {
+		if allowed[packed] {
+			for _, part := range parts {
+				allowed[part] = true
+			}
+		} else if !slices.ContainsFunc(parts, func(part string) bool { return !allowed[part] }) {
+			allowed[packed] = true
+		}
+	}
+	return allowed
+}
+
+// check returns a ParamError naming the first parameter of q, as the client
+// spelled it, that isn't allowed. Unknown parameters don't run any operation and
+// pass.
+func (a operationAllowlist) check(q url.Values) *ParamError {
+	if a == nil {
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(q)) {
+		if spec, ok := core.LookupParam(name); ok && !a[spec.Name] {
+			return &ParamError{Param: name, Value: q.Get(name), Reason: "operation not allowed"}
+		}
+	}
+	return nil
+}
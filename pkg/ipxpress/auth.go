@@ -0,0 +1,224 @@
+package ipxpress
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Places a client can present its API key, checked in this order.
+const (
+	apiKeyHeader = "X-Api-Key"
+	apiKeyParam  = "apikey"
+)
+
+type apiKeyContextKey struct{}
+
+// APIKeys is a set of named API keys that guards handlers through Middleware.
+// Only SHA-256 hashes of the keys are kept. It is safe for concurrent use,
+// including while the keys are replaced.
+type APIKeys struct {
+	mu   sync.RWMutex
+	keys map[[sha256.Size]byte]apiKey
+	any  bool // "*" accepts any key, as AuthMiddleware always has
+
+	path      string
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type apiKey struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+// NewAPIKeys returns a set of keys, mapping each key's name to the key itself.
+// The name is what APIKeyName reports for requests presenting that key.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	k := &APIKeys{done: make(chan struct{})}
+	k.set(keys)
+	return k
+}
+
+// LoadAPIKeys reads keys from a file and reads it again whenever the process
+// receives SIGHUP, so keys can be rotated without a restart; a file that fails
+// to load then keeps the previous keys. Each line holds a key, or a name and a
+// key separated by whitespace; empty lines and lines starting with # are
+// skipped. Unnamed keys are named by their line, e.g. "line 3". Call Close to
+// stop watching for SIGHUP.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	keys, err := readAPIKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	k := NewAPIKeys(keys)
+	k.path = path
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-k.done:
+				return
+			case <-hup:
+				if err := k.Reload(); err != nil {
+					slog.Error("failed to reload API keys, keeping the previous ones", "path", path, "error", err)
+				}
+			}
+		}
+	}()
+	return k, nil
+}
+
+// Reload reads the file the keys were loaded from again. It does nothing for
+// keys not loaded from a file.
+func (k *APIKeys) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+	keys, err := readAPIKeys(k.path)
+	if err != nil {
+		return err
+	}
+	k.set(keys)
+	return nil
+}
+
+// Close stops reloading on SIGHUP. The keys keep working.
+func (k *APIKeys) Close() {
+	k.closeOnce.Do(func() { close(k.done) })
+}
+
+func (k *APIKeys) set(keys map[string]string) {
+	hashed := make(map[[sha256.Size]byte]apiKey, len(keys))
+	anyKey := false
+	for name, key := range keys {
+		if key == "*" {
+			anyKey = true
+			continue
+		}
+		h := sha256.Sum256([]byte(key))
+		hashed[h] = apiKey{name: name, hash: h}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys, k.any = hashed, anyKey
+}
+
+// Lookup returns the name of key, if it is one of the set.
+func (k *APIKeys) Lookup(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	h := sha256.Sum256([]byte(key))
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	// The map is indexed by hash, which a client can't steer towards a key, and
+	// the final comparison doesn't depend on where the hashes differ.
+	if found, ok := k.keys[h]; ok && subtle.ConstantTimeCompare(found.hash[:], h[:]) == 1 {
+		return found.name, true
+	}
+	if k.any {
+		return "*", true
+	}
+	return "", false
+}
+
+// Middleware rejects requests without a known key with 401. The key is read
+// from an "Authorization: Bearer" header, an X-Api-Key header or the apikey
+// query parameter. The parameter is removed from the query before the request
+// is passed on, so it doesn't reach processing, caching or logs further down.
+// The key's name is available to later handlers through APIKeyName.
+func (k *APIKeys) Middleware() MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if key == "" {
+				key = r.Header.Get(apiKeyHeader)
+			}
+			q := r.URL.Query()
+			if key == "" {
+				key = q.Get(apiKeyParam)
+			}
+
+			name, ok := k.Lookup(key)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, name))
+			if q.Has(apiKeyParam) {
+				q.Del(apiKeyParam)
+				u := *r.URL
+				u.RawQuery = q.Encode()
+				r.URL = &u
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// APIKeyName returns the name of the key a request was let through with by
+// APIKeys.Middleware or AuthMiddleware.
+func APIKeyName(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(apiKeyContextKey{}).(string)
+	return name, ok
+}
+
+// AuthMiddleware lets through requests presenting one of validTokens, the way
+// APIKeys.Middleware does; "*" accepts any token. Keys are named by their
+// position, e.g. "key 2"; use NewAPIKeys to name them.
+func AuthMiddleware(validTokens []string) MiddlewareFunc {
+	keys := make(map[string]string, len(validTokens))
+	for i, token := range validTokens {
+		keys[fmt.Sprintf("key %d", i+1)] = token
+	}
+	return NewAPIKeys(keys).Middleware()
+}
+
+// readAPIKeys parses a key file as described at LoadAPIKeys.
+func readAPIKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		switch fields := strings.Fields(text); len(fields) {
+		case 1:
+			keys[fmt.Sprintf("line %d", line)] = fields[0]
+		case 2:
+			if _, dup := keys[fields[0]]; dup {
+				return nil, fmt.Errorf("%s:%d: duplicate key name %q", path, line, fields[0])
+			}
+			keys[fields[0]] = fields[1]
+		default:
+			return nil, fmt.Errorf("%s:%d: expected a key, or a name and a key", path, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
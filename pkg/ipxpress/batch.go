@@ -0,0 +1,273 @@
+package ipxpress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// ErrBatchAborted is the error of the last result of a batch stopped after
+// BatchOptions.MaxErrors failures.
+var ErrBatchAborted = errors.New("batch aborted after too many errors")
+
+// BatchItem is a source image and the variants to make of it. The source is
+// Data, or else the file at Path, or else the image at URL.
+type BatchItem struct {
+	// ID identifies the item in its result, e.g. a file name or a database key.
+	ID string
+
+	Data []byte
+	Path string
+	URL  string
+
+	// Params are the variants, all rendered from one decode of the source. They
+	// may not ask for an overlay, info, a placeholder, a page or a density.
+	Params []*ProcessingParams
+}
+
+// BatchOptions configures BatchProcess.
+type BatchOptions struct {
+	// Concurrency is the number of items processed at once. Defaults to
+	// GOMAXPROCS.
+	Concurrency int
+
+	// MaxErrors stops the batch once this many sources or variants failed:
+	// no more items are read and items in progress are abandoned. 0 never stops.
+	MaxErrors int
+}
+
+// BatchResult is the outcome of a BatchItem.
+type BatchResult struct {
+	// Index is the position of the item in the inputs, from 0. Results arrive
+	// as items finish, so use it to restore the order.
+	Index int
+	ID    string
+
+	// Variants has one entry per BatchItem.Params, in order. It's nil if Err is set.
+	Variants []BatchVariant
+
+	// Err reports a source that couldn't be read, fetched or decoded.
+	Err error
+}
+
+// BatchVariant is a rendered variant of a BatchItem.
+type BatchVariant struct {
+	Data          []byte
+	Format        Format
+	Width, Height int
+
+	// Err is a *ProcessError, or wraps the context's error if the batch was
+	// canceled while the variant was rendered.
+	Err error
+}
+
+// failures counts the errors of r towards BatchOptions.MaxErrors.
+func (r *BatchResult) failures() int {
+	if r.Err != nil {
+		return 1
+	}
+	n := 0
+	for _, v := range r.Variants {
+		if v.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// BatchProcess processes the items received from inputs under the default
+// configuration, decoding each source once for all its variants, and sends a
+// result per item on the returned channel, which is closed once inputs is
+// closed and every item is done. Nothing is cached.
+//
+// When ctx is done no more items are read, items in progress are abandoned
+// and their results dropped. After BatchOptions.MaxErrors failures the same
+// happens, and the last result has Index -1 and ErrBatchAborted. Results must
+// be received until the channel is closed or ctx is done.
+//
+//	inputs := make(chan ipxpress.BatchItem)
+//	go func() {
+//		defer close(inputs)
+//		for _, path := range paths {
+//			inputs <- ipxpress.BatchItem{ID: path, Path: path, Params: sizes}
+//		}
+//	}()
+//	for res := range ipxpress.BatchProcess(ctx, inputs, ipxpress.BatchOptions{Concurrency: 4}) {
+//		// ...
+//	}
+func BatchProcess(ctx context.Context, inputs <-chan BatchItem, opts BatchOptions) <-chan BatchResult {
+	return defaultHandler().BatchProcess(ctx, inputs, opts)
+}
+
+// BatchProcess is like the top-level BatchProcess but under the handler's
+// configuration and custom processors, fetching URLs with its fetcher. It
+// neither reads nor fills the handler's cache.
+func (h *Handler) BatchProcess(ctx context.Context, inputs <-chan BatchItem, opts BatchOptions) <-chan BatchResult {
+	workers := opts.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	type job struct {
+		index int
+		item  BatchItem
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		for index := 0; ; index++ {
+			select {
+			case item, ok := <-inputs:
+				if !ok {
+					return
+				}
+				select {
+				case jobs <- job{index, item}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	results := make(chan BatchResult)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures int
+		aborted  bool
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				res := h.batchItem(ctx, j.index, j.item)
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				failures += res.failures()
+				abort := opts.MaxErrors > 0 && failures >= opts.MaxErrors && !aborted
+				aborted = aborted || abort
+				mu.Unlock()
+
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+				if abort {
+					h.log().Warn("batch aborted", "errors", failures)
+					cancel()
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(results)
+		defer cancel()
+		wg.Wait()
+		if aborted {
+			select {
+			case results <- BatchResult{Index: -1, Err: ErrBatchAborted}:
+			case <-parent.Done():
+			}
+		}
+	}()
+	return results
+}
+
+// batchItem renders the variants of one item. A panic fails the item rather
+// than the program, which couldn't recover it from a worker.
+func (h *Handler) batchItem(ctx context.Context, index int, item BatchItem) (res BatchResult) {
+	res = BatchResult{Index: index, ID: item.ID}
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic(h.log(), v, "id", item.ID)
+			res = BatchResult{Index: index, ID: item.ID, Err: &ProcessError{StatusCode: http.StatusInternalServerError, Message: errPanic}}
+		}
+	}()
+	variants := make([]BatchVariant, len(item.Params))
+	var valid []*ProcessingParams
+	var positions []int
+	for i, p := range item.Params {
+		if p == nil {
+			p = &ProcessingParams{}
+		}
+		if err := h.batchParams(p); err != nil {
+			variants[i].Err = err
+			continue
+		}
+		copied := *p
+		copied.defaultQuality()
+		valid = append(valid, &copied)
+		positions = append(positions, i)
+	}
+	if len(valid) == 0 {
+		res.Variants = variants
+		return res
+	}
+
+	data, release, err := h.batchSource(ctx, item)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer release()
+	err = h.renderFrom(ctx, data, valid, func(i int, entry *CacheEntry, width, height int) bool {
+		v := &variants[positions[i]]
+		switch {
+		case ctx.Err() != nil:
+			v.Err = fmt.Errorf("processing abandoned: %w", ctx.Err())
+		case entry.StatusCode != http.StatusOK:
+			v.Err = &ProcessError{StatusCode: entry.StatusCode, Message: entry.errorMessage()}
+		default:
+			v.Data, v.Format, v.Width, v.Height = entry.Data, DetectFormat(entry.Data), width, height
+		}
+		return true
+	})
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	res.Variants = variants
+	return res
+}
+
+// batchParams validates the params of a batch variant like NewPipeline, and
+// rejects those that can't share a decode with the other variants.
+func (h *Handler) batchParams(p *ProcessingParams) error {
+	if err := p.CheckDimensions(h.config.MaxDimension); err != nil {
+		return &ProcessError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err := p.Err(); err != nil && h.config.StrictParams {
+		return &ProcessError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if p.Overlay != "" || p.Info || p.Placeholder != "" || p.Page != 0 || p.Density != 0 {
+		return &ProcessError{StatusCode: http.StatusBadRequest, Message: "overlay, info, placeholder, page and density are not supported in batches"}
+	}
+	return nil
+}
+
+// batchSource returns the source image of item.
+func (h *Handler) batchSource(ctx context.Context, item BatchItem) ([]byte, func(), error) {
+	switch {
+	case item.Data != nil:
+		return item.Data, func() {}, nil
+	case item.Path != "":
+		data, err := os.ReadFile(item.Path)
+		return data, func() {}, err
+	case item.URL != "":
+		return h.fetcher.FetchReserved(ctx, item.URL)
+	}
+	return nil, func() {}, errors.New("batch item has no Data, Path or URL")
+}
@@ -0,0 +1,225 @@
+package ipxpress
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// blurHashSize is the longest side the image is shrunk to before hashing. A
+// placeholder has at most 9x9 components, so more pixels don't change it.
+const blurHashSize = 32
+
+// blurHashChars is BlurHash's base 83 alphabet.
+const blurHashChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash returns the BlurHash (https://blurha.sh) of the image with the given
+// number of horizontal and vertical components, each 1-9. It hashes a downscaled
+// copy of the first frame, flattened onto white, and leaves the image untouched.
+func (p *Processor) BlurHash(xComponents, yComponents int) (string, error) {
+	defer p.lock()()
+	if p.err != nil {
+		return "", p.err
+	}
+	if p.img == nil {
+		return "", p.noImage()
+	}
+
+	img, err := p.img.Copy()
+	if err != nil {
+		return "", fmt.Errorf("failed to copy image: %w", err)
+	}
+	defer img.Close()
+
+	if frameHeight, n := frames(img); n > 1 {
+		if err := img.ExtractArea(0, 0, img.Width(), frameHeight); err != nil {
+			return "", err
+		}
+	}
+	if longest := max(img.Width(), img.Height()); longest > blurHashSize {
+		if err := img.Resize(float64(blurHashSize)/float64(longest), vips.KernelLinear); err != nil {
+			return "", fmt.Errorf("failed to shrink image: %w", err)
+		}
+	}
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return "", err
+	}
+	if img.HasAlpha() {
+		if err := img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+			return "", err
+		}
+	}
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		return "", err
+	}
+
+	raw, err := img.ToBytes()
+	if err != nil {
+		return "", fmt.Errorf("failed to read pixels: %w", err)
+	}
+	w, h, bands := img.Width(), img.Height(), img.Bands()
+	if len(raw) < w*h*bands || bands < 3 {
+		return "", fmt.Errorf("unexpected pixel layout: %dx%d with %d bands", w, h, bands)
+	}
+	rgb := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < w*h; i++ {
+		rgb.Pix[4*i], rgb.Pix[4*i+1], rgb.Pix[4*i+2], rgb.Pix[4*i+3] = raw[bands*i], raw[bands*i+1], raw[bands*i+2], 0xff
+	}
+	return EncodeBlurHash(rgb, xComponents, yComponents)
+}
+
+// EncodeBlurHash returns the BlurHash of img with the given number of horizontal
+// and vertical components, each 1-9. Alpha is ignored. The hash is 4+2*x*y
+// characters long. Every pixel is visited once per component, so hash small images.
+func EncodeBlurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("blurhash components must be between 1 and 9, got %dx%d", xComponents, yComponents)
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return "", errors.New("empty image")
+	}
+
+	// Linear RGB of every pixel, converted once rather than once per component
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			linear[y*w+x] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := normalisation * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					px := linear[y*w+x]
+					f[0] += basis * px[0]
+					f[1] += basis * px[1]
+					f[2] += basis * px[2]
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encode83(&sb, (xComponents-1)+(yComponents-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = max(actualMax, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		encode83(&sb, quantisedMax, 1)
+	} else {
+		encode83(&sb, 0, 1)
+	}
+
+	encode83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		encode83(&sb, quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2)
+	}
+	return sb.String(), nil
+}
+
+// encode83 appends value as length base 83 digits.
+func encode83(sb *strings.Builder, value, length int) {
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; divisor > 0; divisor /= 83 {
+		sb.WriteByte(blurHashChars[(value/divisor)%83])
+	}
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// placeholder is the JSON body served for placeholder=blurhash: the hash and the
+// size of the processed image, so clients can reserve its aspect ratio.
+type placeholder struct {
+	BlurHash string `json:"blurhash"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// placeholderEntry hashes the transformed image into a JSON entry and closes proc.
+// Landscape images get 4x3 components and portrait ones 3x4.
+func (h *Handler) placeholderEntry(proc *Processor, params *ProcessingParams) *CacheEntry {
+	defer proc.Close()
+	if err := proc.Err(); err != nil {
+		h.log().Error("image processing failed", "url", params.URL, "error", err)
+		return &CacheEntry{
+			StatusCode: http.StatusInternalServerError,
+			ErrorMsg:   fmt.Sprintf("processing: %v", err),
+		}
+	}
+
+	width, height := proc.Width(), proc.Height()
+	x, y := 4, 3
+	if height > width {
+		x, y = 3, 4
+	}
+	hash, err := proc.BlurHash(x, y)
+	if err != nil {
+		return h.createErrorEntry(err)
+	}
+	data, err := json.Marshal(placeholder{BlurHash: hash, Width: width, Height: height})
+	if err != nil {
+		return h.createErrorEntry(err)
+	}
+
+	entry := &CacheEntry{
+		ContentType: "application/json",
+		Data:        data,
+		StatusCode:  http.StatusOK,
+	}
+	if h.config != nil && h.config.EnableETag {
+		sum := md5.Sum(entry.Data)
+		entry.ETag = fmt.Sprintf("\"%x\"", sum)
+	}
+	return entry
+}
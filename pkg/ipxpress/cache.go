@@ -1,11 +1,18 @@
 package ipxpress
 
 import (
-	"crypto/md5"
+	"container/heap"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/maypok86/otter"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
 )
 
 // CacheEntry represents a cached response.
@@ -16,12 +23,121 @@ type CacheEntry struct {
 	ErrorMsg    string
 	ETag        string
 	Timestamp   time.Time
+
+	// RetryAfter is sent as the Retry-After header of an error response,
+	// forwarded from an origin's 429.
+	RetryAfter string
+
+	// TTL is how long the entry is kept, and TTLRule the schedule rule that chose it (if any).
+	TTL     time.Duration
+	TTLRule string
+
+	// EffectiveParams echoes the resolved implicit parameters (see ProcessingParams.EffectiveQuery).
+	EffectiveParams string
+
+	// Quality is the quality chosen for q=auto, reported in X-IPX-Quality.
+	Quality int
+
+	// AliasOf is the cache key of the entry this one was copied from because its
+	// source had identical bytes (see Config.DedupOriginals).
+	AliasOf string
+
+	// Compressed means Data holds the gzip-compressed body (see
+	// InMemoryCache.CompressEntries). Size, Bytes and WriteData decompress it.
+	Compressed bool
+
+	// OriginalBytes and OriginalFormat describe the source image, and FetchTime
+	// and ProcessTime how long the request that produced the entry spent on it.
+	// They are reported in debug headers, also on cache hits.
+	OriginalBytes  int
+	OriginalFormat Format
+	FetchTime      time.Duration
+	ProcessTime    time.Duration
+
+	hits     atomic.Int64      // cache hits, maintained by InMemoryCache
+	rawSize  int               // size before compression, if Compressed
+	uncached bool              // not stored, reported as X-IPX-Cache: BYPASS
+	spill    *spillFile        // data moved out of the heap; Data is nil when set
+	params   *ProcessingParams // params that produced the entry, for the refresher
+	expires  time.Time         // by the handler's clock
+
+	originExpires time.Time // end of the source's freshness lifetime, capping TTL
+	noStore       bool      // the origin forbade caching the source
+	unsupported   bool      // answers an UnsupportedError, kept for UnsupportedCacheTTL
+}
+
+// Cache stores processed responses. InMemoryCache is the built-in implementation.
+type Cache interface {
+	Get(key string) (*CacheEntry, bool)
+	Set(key string, entry *CacheEntry)
+	SetWithTTL(key string, entry *CacheEntry, ttl time.Duration)
+	Close()
+}
+
+// Enumerable is implemented by caches that can list their contents for operational
+// tooling. It's separate from Cache so custom implementations don't have to support it.
+type Enumerable interface {
+	// Keys returns up to limit keys starting with prefix, in ascending order after
+	// cursor (exclusive; "" starts from the beginning), and the cursor for the next
+	// page ("" when there are no more keys). Keys added or removed while paging may
+	// or may not be seen, but no key present throughout is skipped or repeated.
+	Keys(prefix string, limit int, cursor string) (keys []string, next string)
+
+	// Peek returns metadata for a key without counting as a hit or copying the data.
+	Peek(key string) (EntryMeta, bool)
+}
+
+// Purger is implemented by caches that can remove entries, for the admin purge
+// endpoints. Like Enumerable it's optional.
+type Purger interface {
+	// Delete removes the entry for key, if any.
+	Delete(key string)
+
+	// Clear removes every entry.
+	Clear()
+}
+
+// StatsReporter is implemented by caches that can report their size and hit rate.
+type StatsReporter interface {
+	Stats() CacheStats
+}
+
+// CacheStats describes a cache's contents and effectiveness.
+type CacheStats struct {
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes"` // data as stored, i.e. after compression
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	HitRate   float64 `json:"hit_rate"`
+	Evictions int64   `json:"evictions"`
+}
+
+// EntryMeta describes a cached entry without its data.
+type EntryMeta struct {
+	Key         string        `json:"key"`
+	Size        int           `json:"size"`
+	ContentType string        `json:"content_type,omitempty"`
+	StatusCode  int           `json:"status"`
+	Age         time.Duration `json:"age"`
+	TTL         time.Duration `json:"ttl"` // remaining time to live
+	Hits        int64         `json:"hits"`
 }
 
 // InMemoryCache is an in-memory cache implementation backed by otter (W-TinyLFU algorithm).
 // It supports cost-based eviction (by data size) and high-concurrency access.
 type InMemoryCache struct {
-	cache otter.Cache[string, *CacheEntry]
+	cache otter.CacheWithVariableTTL[string, *CacheEntry]
+	ttl   time.Duration
+
+	// Entries of at least spillThreshold bytes are stored in files in spillDir
+	spillDir       string
+	spillThreshold int
+
+	// Entries selected by compression of at least compressMin bytes are stored gzipped
+	compression CacheCompression
+	compressMin int
+
+	heapBytes atomic.Int64 // see MemoryUsage
 }
 
 // NewInMemoryCache creates a new in-memory cache with the given TTL and capacity.
@@ -32,19 +148,22 @@ func NewInMemoryCache(ttl time.Duration, capacity int) *InMemoryCache {
 		capacity = 10000
 	}
 
+	c := &InMemoryCache{ttl: ttl}
+
 	// Build the cache with W-TinyLFU and cost-based eviction
 	cache, err := otter.MustBuilder[string, *CacheEntry](capacity).
 		CollectStats().
 		Cost(func(key string, entry *CacheEntry) uint32 {
 			// Cost is based on the data size plus metadata strings and overhead
 			// This allows the cache to evict based on actual memory usage
-			cost := uint32(len(entry.Data) + len(entry.ContentType) + len(entry.ErrorMsg) + len(entry.ETag)) + 256 // 256 bytes struct/node overhead estimate
+			cost := uint32(entry.storedSize() + len(entry.ContentType) + len(entry.ErrorMsg) + len(entry.ETag)) + 256 // 256 bytes struct/node overhead estimate
 			if cost == 0 {
 				return 1 // Minimum cost must be 1
 			}
 			return cost
 		}).
-		WithTTL(ttl).
+		WithVariableTTL().
+		DeletionListener(c.onDelete).
 		Build()
 
 	if err != nil {
@@ -52,40 +171,217 @@ func NewInMemoryCache(ttl time.Duration, capacity int) *InMemoryCache {
 		panic(fmt.Sprintf("failed to build otter cache: %v", err))
 	}
 
-	return &InMemoryCache{
-		cache: cache,
+	c.cache = cache
+	return c
+}
+
+// onDelete releases the file of a spilled entry once otter drops it.
+func (c *InMemoryCache) onDelete(key string, entry *CacheEntry, cause otter.DeletionCause) {
+	c.heapBytes.Add(-heapCost(entry))
+	if entry.spill == nil {
+		return
+	}
+	// Setting the same entry again replaces it with itself; its file is still in use
+	if cause == otter.Replaced {
+		if current, ok := c.cache.Extension().GetQuietly(key); ok && current == entry {
+			return
+		}
+	}
+	entry.spill.evict()
+}
+
+// SpillLargeEntries makes the cache store the data of entries of at least threshold
+// bytes in files in dir instead of the Go heap, so many multi-megabyte entries don't
+// weigh on the garbage collector. Such entries have a nil Data; use CacheEntry.Bytes
+// or WriteData. Files left in dir by a previous process are removed, so dir must not
+// be shared with another running cache. It must be called before the cache is used.
+func (c *InMemoryCache) SpillLargeEntries(dir string, threshold int) error {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "ipxpress-cache")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	if err := removeSpillFiles(dir); err != nil {
+		return fmt.Errorf("failed to remove orphaned entries: %w", err)
 	}
+	c.spillDir = dir
+	c.spillThreshold = threshold
+	return nil
 }
 
 // Get retrieves a cache entry by key. Returns the entry and true if found and not expired.
 func (c *InMemoryCache) Get(key string) (*CacheEntry, bool) {
-	return c.cache.Get(key)
+	entry, ok := c.cache.Get(key)
+	if ok {
+		entry.hits.Add(1)
+	}
+	return entry, ok
 }
 
 // Set stores a cache entry with the given key.
 // The entry will be automatically removed after the TTL expires.
 func (c *InMemoryCache) Set(key string, entry *CacheEntry) {
+	c.SetWithTTL(key, entry, c.ttl)
+}
+
+// SetWithTTL stores a cache entry that expires after the given TTL instead of the default one.
+func (c *InMemoryCache) SetWithTTL(key string, entry *CacheEntry, ttl time.Duration) {
 	// Stamp the entry time for reference
 	entry.Timestamp = time.Now()
-	c.cache.Set(key, entry)
+
+	c.compress(entry)
+	data := entry.Data
+	if c.spillThreshold > 0 && entry.spill == nil && len(data) >= c.spillThreshold {
+		spill, err := newSpillFile(c.spillDir, data)
+		if err != nil {
+			slog.Warn("failed to spill cache entry, keeping it in memory", "error", err)
+		} else {
+			entry.spill, entry.Data = spill, nil
+		}
+	}
+
+	stored := c.cache.Set(key, entry, ttl)
+	if stored {
+		c.heapBytes.Add(heapCost(entry))
+	} else if entry.spill != nil {
+		// Rejected as too large; the caller still holds the entry, so restore its data
+		entry.spill.evict()
+		entry.spill, entry.Data = nil, data
+	}
+	if !stored {
+		entry.decompress()
+	}
+}
+
+// MemoryUsage returns the approximate bytes the cached entries hold on the Go heap,
+// excluding the data of spilled entries. It's what Config.MemoryBudget charges to
+// the cache, and may lag evictions slightly.
+func (c *InMemoryCache) MemoryUsage() int64 {
+	return max(c.heapBytes.Load(), 0)
+}
+
+// heapCost estimates the heap bytes held by a cached entry.
+func heapCost(entry *CacheEntry) int64 {
+	return int64(len(entry.Data)+len(entry.ContentType)+len(entry.ErrorMsg)+len(entry.ETag)) + 256
 }
 
-// Close closes the cache and releases resources.
+// Close closes the cache and releases resources, including spilled entries.
 func (c *InMemoryCache) Close() {
+	if c.spillThreshold > 0 {
+		c.cache.Range(func(_ string, entry *CacheEntry) bool {
+			if entry.spill != nil {
+				entry.spill.evict()
+			}
+			return true
+		})
+	}
 	c.cache.Close()
+	if c.spillThreshold > 0 {
+		removeSpillFiles(c.spillDir)
+	}
+}
+
+// Keys implements Enumerable. It iterates otter's hash table in place (no copy of the
+// cache is taken) and keeps only the limit smallest matching keys after cursor.
+func (c *InMemoryCache) Keys(prefix string, limit int, cursor string) ([]string, string) {
+	if limit <= 0 {
+		return nil, ""
+	}
+
+	// Max-heap of the limit smallest keys seen so far, plus one to detect a next page
+	page := &keyHeap{}
+	c.cache.Range(func(key string, _ *CacheEntry) bool {
+		if key <= cursor || !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		if page.Len() <= limit {
+			heap.Push(page, key)
+		} else if key < (*page)[0] {
+			(*page)[0] = key
+			heap.Fix(page, 0)
+		}
+		return true
+	})
+
+	keys := []string(*page)
+	sort.Strings(keys)
+	if len(keys) > limit {
+		return keys[:limit], keys[limit-1]
+	}
+	return keys, ""
+}
+
+// Peek implements Enumerable.
+func (c *InMemoryCache) Peek(key string) (EntryMeta, bool) {
+	e, ok := c.cache.Extension().GetEntryQuietly(key)
+	if !ok {
+		return EntryMeta{}, false
+	}
+	entry := e.Value()
+	return EntryMeta{
+		Key:         key,
+		Size:        entry.Size(),
+		ContentType: entry.ContentType,
+		StatusCode:  entry.StatusCode,
+		Age:         time.Since(entry.Timestamp),
+		TTL:         e.TTL(),
+		Hits:        entry.hits.Load(),
+	}, true
+}
+
+// Delete implements Purger.
+func (c *InMemoryCache) Delete(key string) {
+	c.cache.Delete(key)
+}
+
+// Clear implements Purger. Unlike otter's Clear it reports every deletion, so
+// spilled entries release their files.
+func (c *InMemoryCache) Clear() {
+	c.cache.DeleteByFunc(func(string, *CacheEntry) bool { return true })
+}
+
+// deleteWhere removes the entries matching fn and returns how many there were.
+func (c *InMemoryCache) deleteWhere(fn func(entry *CacheEntry) bool) int {
+	n := 0
+	c.cache.DeleteByFunc(func(_ string, entry *CacheEntry) bool {
+		if fn(entry) {
+			n++
+			return true
+		}
+		return false
+	})
+	return n
+}
+
+// Stats implements StatsReporter. Hits and misses count every lookup, including
+// the handler's second look inside a request that missed.
+func (c *InMemoryCache) Stats() CacheStats {
+	stats := CacheStats{Entries: c.cache.Size()}
+	c.cache.Range(func(_ string, entry *CacheEntry) bool {
+		stats.Bytes += int64(entry.storedSize())
+		return true
+	})
+	s := c.cache.Stats()
+	stats.Hits, stats.Misses, stats.HitRate, stats.Evictions = s.Hits(), s.Misses(), s.Ratio(), s.EvictedCount()
+	return stats
+}
+
+// keyHeap is a max-heap of strings used to select the smallest keys for a page.
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(string)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
 }
 
 // GenerateCacheKey generates a cache key from all request parameters to avoid collisions.
 func GenerateCacheKey(p *ProcessingParams) string {
-	// Include all parameters that affect the output image to ensure correct caching.
-	// We use | as separator to avoid ambiguity between parameter values.
-	key := fmt.Sprintf("%s|%d|%d|%d|%s|%s|%s|%s|%t|%f|%s|%d|%t|%t|%t|%s|%d|%s|%s|%t|%t|%d|%s|%f|%d|%s|%t",
-		p.URL, p.Width, p.Height, p.Quality, p.Format,
-		p.Fit, p.Position, p.Kernel, p.Enlarge,
-		p.Blur, p.Sharpen, p.Rotate, p.Flip, p.Flop, p.Grayscale,
-		p.Extract, p.Trim, p.Extend,
-		p.Background, p.Negate, p.Normalize, p.Threshold, p.Tint, p.Gamma, p.Median, p.Modulate, p.Flatten)
-
-	h := md5.Sum([]byte(key))
-	return fmt.Sprintf("%x", h)
+	return core.GenerateCacheKey((*core.ProcessingParams)(p))
 }
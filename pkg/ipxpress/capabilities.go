@@ -0,0 +1,150 @@
+package ipxpress
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Capabilities describes which image formats the linked libvips build can
+// decode (Load) and encode (Save). Keys are lowercase libvips format names
+// such as "jpeg", "heif" or "avif".
+type Capabilities struct {
+	Load map[string]bool
+	Save map[string]bool
+}
+
+// CanLoad reports whether the build can decode the named format.
+func (c *Capabilities) CanLoad(name string) bool {
+	return c != nil && c.Load[name]
+}
+
+// CanSave reports whether the build can encode the given output format.
+func (c *Capabilities) CanSave(f Format) bool {
+	return c != nil && c.Save[string(f)]
+}
+
+// LoadFormats returns the sorted list of decodable format names.
+func (c *Capabilities) LoadFormats() []string {
+	return sortedKeys(c.Load)
+}
+
+// SaveFormats returns the sorted list of encodable format names.
+func (c *Capabilities) SaveFormats() []string {
+	return sortedKeys(c.Save)
+}
+
+// saveFormats lists the output formats in the order they're probed and reported.
+var saveFormats = []Format{FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatAVIF, FormatHEIF, FormatTIFF, FormatJXL}
+
+var (
+	capsOnce     sync.Once
+	detectedCaps *Capabilities
+)
+
+// DetectCapabilities probes the linked libvips build and returns the formats it can
+// load and save. The probe runs once; subsequent calls return the cached result.
+// Handlers use Config.Capabilities instead if set, e.g. for tests to act as a
+// build without AVIF; Handler.Capabilities returns what a handler uses.
+func DetectCapabilities() *Capabilities {
+	capsOnce.Do(func() {
+		initVips()
+
+		caps := &Capabilities{
+			Load: make(map[string]bool),
+			Save: make(map[string]bool),
+		}
+		for imageType, name := range vips.ImageTypes {
+			if vips.IsTypeSupported(imageType) {
+				caps.Load[name] = true
+			}
+		}
+		// govips doesn't expose saver lookup, so probe each output format with a tiny encode
+		for _, f := range saveFormats {
+			if probeSave(f) {
+				caps.Save[string(f)] = true
+			}
+		}
+		detectedCaps = caps
+	})
+	return detectedCaps
+}
+
+// SupportedSaveFormats returns the output formats the linked libvips build can
+// encode, probed once by DetectCapabilities. Optional encoders such as JPEG XL,
+// HEIF and AVIF depend on how libvips was built.
+func SupportedSaveFormats() []Format {
+	caps := DetectCapabilities()
+	var formats []Format
+	for _, f := range saveFormats {
+		if caps.CanSave(f) {
+			formats = append(formats, f)
+		}
+	}
+	return formats
+}
+
+// probeSave reports whether a small sRGB image can be encoded to the given format.
+func probeSave(f Format) bool {
+	img, err := vips.Black(8, 8)
+	if err != nil {
+		return false
+	}
+	proc := &Processor{img: img}
+	defer proc.Close()
+
+	if err := img.BandJoinConst([]float64{0, 0}); err != nil {
+		return false
+	}
+	_, err = proc.ToBytes(f, 85)
+	return err == nil
+}
+
+// loaderName returns the libvips loader name for the image data, or "" if unknown.
+func loaderName(data []byte) string {
+	return vips.ImageTypes[vips.DetermineImageType(data)]
+}
+
+// UnsupportedError reports an operation or format the current libvips build can't handle.
+// Unlike transient failures it won't resolve itself until the server is redeployed.
+type UnsupportedError struct {
+	Capability string
+
+	// Supported lists what the build can do instead, e.g. the output formats
+	// it can encode, for the client to pick from.
+	Supported []string
+
+	// Status is the HTTP status for the error; 0 means 501 Not Implemented.
+	Status int
+}
+
+// Error implements the error interface.
+func (e *UnsupportedError) Error() string {
+	if len(e.Supported) > 0 {
+		return fmt.Sprintf("%s is not supported by this build, use one of %s (see /ipx/capabilities)", e.Capability, strings.Join(e.Supported, ", "))
+	}
+	return fmt.Sprintf("%s is not supported by this build (see /ipx/capabilities)", e.Capability)
+}
+
+// StatusCode returns the HTTP status for the error.
+func (e *UnsupportedError) StatusCode() int {
+	if e.Status != 0 {
+		return e.Status
+	}
+	return http.StatusNotImplemented
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k, ok := range m {
+		if ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
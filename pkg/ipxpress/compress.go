@@ -0,0 +1,104 @@
+package ipxpress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// CacheCompression selects which cached entries InMemoryCache stores compressed.
+type CacheCompression string
+
+const (
+	// CompressOff stores every entry as is (the default).
+	CompressOff CacheCompression = "off"
+
+	// CompressText compresses text-like entries (SVG, JSON, text/*), which
+	// shrink well, unlike already compressed image formats.
+	CompressText CacheCompression = "text"
+
+	// CompressAll compresses every entry, keeping the compressed data only if
+	// it's smaller. Useful for large uncompressed formats such as TIFF or BMP.
+	CompressAll CacheCompression = "all"
+)
+
+// textLike reports whether contentType is worth compressing under CompressText.
+func textLike(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch mediaType {
+	case "image/svg+xml", "application/json", "application/xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// CompressEntries makes the cache store the data of entries of at least minBytes
+// gzip-compressed, as selected by mode. Such entries have Compressed set and Data
+// holds the compressed bytes; Size, Bytes and WriteData return the original data.
+// It must be called before the cache is used.
+func (c *InMemoryCache) CompressEntries(mode CacheCompression, minBytes int) {
+	c.compression = mode
+	c.compressMin = minBytes
+}
+
+// compress replaces the entry's data with its gzip compression if the cache's
+// policy selects it and that saves space.
+func (c *InMemoryCache) compress(entry *CacheEntry) {
+	if entry.Compressed || entry.spill != nil || len(entry.Data) == 0 || len(entry.Data) < c.compressMin {
+		return
+	}
+	switch c.compression {
+	case CompressAll:
+	case CompressText:
+		if !textLike(entry.ContentType) {
+			return
+		}
+	default:
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(entry.Data)
+	zw.Close()
+	if buf.Len() >= len(entry.Data) {
+		return
+	}
+	entry.rawSize = len(entry.Data)
+	entry.Data = bytes.Clone(buf.Bytes())
+	entry.Compressed = true
+}
+
+// decompress undoes compress, e.g. when the cache rejected the entry.
+func (e *CacheEntry) decompress() {
+	if !e.Compressed || e.spill != nil {
+		return
+	}
+	if data, err := e.Bytes(); err == nil {
+		e.Data, e.Compressed, e.rawSize = data, false, 0
+	}
+}
+
+// uncompressedSize returns the original size of compressed data, from the gzip
+// trailer if the entry wasn't compressed by InMemoryCache.
+func (e *CacheEntry) uncompressedSize() int {
+	if e.rawSize > 0 || len(e.Data) < 4 {
+		return e.rawSize
+	}
+	return int(binary.LittleEndian.Uint32(e.Data[len(e.Data)-4:]))
+}
+
+// gunzip returns a reader decompressing r, which done closes.
+func gunzip(r io.Reader, done func()) (io.Reader, func(), error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return zr, func() {
+		zr.Close()
+		done()
+	}, nil
+}
@@ -1,13 +1,22 @@
 package ipxpress
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
 )
 
-// VipsConfig holds vips-specific configuration.
+// VipsConfig holds vips-specific configuration. libvips is process-wide, so it
+// is started with the first VipsConfig used; see ReconfigureVips.
 type VipsConfig struct {
+	// Concurrency is the number of threads libvips uses per operation, 0 for
+	// its default (the number of CPUs)
+	Concurrency int
+
 	// MaxCacheMem is the maximum memory to use for caching (in MB)
 	MaxCacheMem int
 
@@ -31,18 +40,86 @@ func DefaultVipsConfig() *VipsConfig {
 	}
 }
 
+// differences names the fields of other that differ from c.
+func (c *VipsConfig) differences(other *VipsConfig) []string {
+	var fields []string
+	if c.Concurrency != other.Concurrency {
+		fields = append(fields, "Concurrency")
+	}
+	if c.MaxCacheMem != other.MaxCacheMem {
+		fields = append(fields, "MaxCacheMem")
+	}
+	if c.MaxCacheSize != other.MaxCacheSize {
+		fields = append(fields, "MaxCacheSize")
+	}
+	if c.MaxCacheFiles != other.MaxCacheFiles {
+		fields = append(fields, "MaxCacheFiles")
+	}
+	if c.LogLevel != other.LogLevel {
+		fields = append(fields, "LogLevel")
+	}
+	return fields
+}
+
 // Config holds the server configuration.
 type Config struct {
 	// CacheTTL is the duration to keep cached responses
 	CacheTTL time.Duration
 
+	// StaleGrace keeps entries this long past their TTL. A request for such a
+	// stale entry is served it right away while a background refresh replaces
+	// it, so clients don't wait on the origin when popular entries expire.
+	// 0 disables stale serving.
+	StaleGrace time.Duration
+
+	// HonorOriginCacheControl lets origins shorten the cache TTL: an entry is
+	// kept for the source's Cache-Control max-age (s-maxage first) or Expires
+	// if that's below the TTL, and clients are told no more. Sources the origin
+	// marks no-store, private or no-cache aren't cached at all.
+	HonorOriginCacheControl bool
+
 	// CacheMaxCost is the maximum total cost of the cache (usually in bytes).
 	// Otter uses this to perform cost-based eviction.
 	CacheMaxCost int
 
+	// CacheMaxEntryBytes keeps responses larger than this out of the cache, so a
+	// few huge images don't evict many small hot ones. They are still served,
+	// with X-IPX-Cache: BYPASS among the debug headers. 0 caches every size.
+	CacheMaxEntryBytes int
+
+	// CacheCompression stores selected entries of at least CacheCompressMinBytes
+	// gzip-compressed (see InMemoryCache.CompressEntries), trading CPU on hits
+	// for memory. Only applies to the default cache.
+	CacheCompression      CacheCompression
+	CacheCompressMinBytes int
+
 	// ProcessingLimit is the maximum number of concurrent image processing operations
 	ProcessingLimit int
 
+	// CheapCostThreshold is the EstimateCost up to which a request is cheap,
+	// such as a thumbnail, as opposed to a large or AVIF encode. Cheap requests
+	// get a processing slot before expensive ones waiting for it, and may take
+	// the CheapReservedSlots that expensive ones can't, so they don't queue
+	// behind a burst of large encodes. 0 queues every request alike. Defaults
+	// to 1, about a megapixel JPEG.
+	CheapCostThreshold float64
+
+	// CheapReservedSlots are the slots of ProcessingLimit only cheap requests may
+	// take. Defaults to a quarter of ProcessingLimit; at least one slot is left
+	// for expensive requests.
+	CheapReservedSlots int
+
+	// FetchLimit is the maximum number of concurrent origin fetches. Requests
+	// hold a fetch slot only while fetching and a processing slot only while
+	// processing, so a burst of misses neither opens unbounded upstream
+	// connections nor keeps processing slots idle. Defaults to twice
+	// ProcessingLimit.
+	FetchLimit int
+
+	// FetchQueueTimeout is how long a request waits for a fetch slot before
+	// getting 503. Defaults to 10 seconds.
+	FetchQueueTimeout time.Duration
+
 	// CleanupInterval is the interval for cache cleanup (maintained for compatibility,
 	// though Otter manages cleanup internally).
 	CleanupInterval time.Duration
@@ -51,6 +128,10 @@ type Config struct {
 	// If nil, default vips settings will be used
 	VipsConfig *VipsConfig
 
+	// Fetcher tunes the HTTP client used for origins. If nil,
+	// DefaultFetcherConfig is used.
+	Fetcher *FetcherConfig
+
 	// ClientMaxAge controls Cache-Control max-age for clients (in seconds)
 	ClientMaxAge int
 
@@ -59,6 +140,222 @@ type Config struct {
 
 	// EnableETag enables ETag generation and If-None-Match handling
 	EnableETag bool
+
+	// StreamThreshold is the origin Content-Length (in bytes) above which passthrough
+	// requests (no transformations) are streamed to the client instead of being
+	// buffered and cached. 0 disables streaming.
+	StreamThreshold int64
+
+	// EarlyHeadersAfter sends the status and headers of a cache miss still being
+	// fetched or processed after this long, and flushes them, so proxies with
+	// idle timeouts see the response start during long encodes. Only responses
+	// known to be a 200 in the requested format qualify: an explicit format, no
+	// If-None-Match or Range, no pre-processors or encoder hooks. Should the
+	// image then fail, the connection is aborted. 0 disables it.
+	EarlyHeadersAfter time.Duration
+
+	// ResponseHeaderDeadline answers a cache miss with 504 if no headers were
+	// sent after this long, rather than letting a proxy time out the connection.
+	// The image is still processed and cached for later requests. 0 disables it.
+	ResponseHeaderDeadline time.Duration
+
+	// EarlyHints are Link header values, e.g. "</fonts/a.woff2>; rel=preload;
+	// as=font", sent in a 103 Early Hints response before a cache miss is fetched.
+	EarlyHints []string
+
+	// UnsupportedCacheTTL is how long to cache the 501 and 415 responses for formats
+	// or operations the libvips build doesn't support. These won't change until redeploy.
+	UnsupportedCacheTTL time.Duration
+
+	// ErrorCacheTTL is how long to cache failures of the origin that may recover:
+	// its 429 and 5xx responses, timeouts, DNS and connection failures. A short
+	// TTL spares a struggling origin every client's retries. 0, the default,
+	// doesn't cache them; other 4xx responses are cached like images.
+	ErrorCacheTTL time.Duration
+
+	// TTLSchedule varies the cache TTL by the time entries are stored
+	// (e.g. short TTLs during business hours). If nil, CacheTTL is always used.
+	// It can be replaced at runtime with Handler.SetTTLSchedule.
+	TTLSchedule *TTLSchedule
+
+	// DebugHeaders adds X-IPX-* response headers describing cache decisions
+	// and the effective parameters used, and lists the registered presets when
+	// an unknown one is requested.
+	DebugHeaders bool
+
+	// DebugRequests adds the DebugHeaders to the response of any request sending
+	// an X-IPX-Debug: 1 header, so quality settings can be tuned per request
+	// without enabling them for everyone.
+	DebugRequests bool
+
+	// StrictParams rejects requests with invalid parameter values with 400 before
+	// fetching anything. When false, invalid values are ignored and reported in an
+	// X-IPX-Warning response header.
+	StrictParams bool
+
+	// MaxDimension is the largest width or height a request may ask for. Larger
+	// and negative values are rejected with 400 even without StrictParams.
+	// Defaults to 16384; 0 disables the limit.
+	MaxDimension int
+
+	// MaxZoom caps the zoom parameter; larger values are treated as MaxZoom.
+	// Defaults to 4; 0 or 1 turns zooming off.
+	MaxZoom float64
+
+	// MaxInputPixels rejects source images whose width*height*frames exceeds it
+	// with 413, checked from the image header before decoding, so a small file
+	// can't expand into a huge canvas. Defaults to 50 megapixels; 0 disables it.
+	MaxInputPixels int
+
+	// MaxUploadSize limits the request body of Handler.Transform, in bytes; larger
+	// uploads get 413. Defaults to 32 MB; 0 disables the limit.
+	MaxUploadSize int64
+
+	// TransformQuota, if set, is called for each Handler.Transform request with the
+	// number of variants requested, before any decoding. Returning an error rejects
+	// the request with 429. Identifying the tenant (e.g. from a header set by the
+	// auth middleware) and accounting are up to the function.
+	TransformQuota func(r *http.Request, variants int) error
+
+	// JPEGOptions, WebPOptions, AVIFOptions and PNGOptions set the encoder defaults
+	// for every response in that format, trading CPU for size. Nil uses the built-in
+	// defaults (progressive JPEG, WebP effort 4, AVIF speed 6, PNG compression 6).
+	// Request parameters such as effort, png_compression, progressive and subsample
+	// override them. Setting any of them changes every cache key, so variants
+	// encoded with other settings aren't served.
+	JPEGOptions *JPEGOptions
+	WebPOptions *WebPOptions
+	AVIFOptions *AVIFOptions
+	PNGOptions  *PNGOptions
+
+	// Processed images are converted to sRGB using their embedded ICC profile
+	// before any other operation (see Processor.ToSRGB), so CMYK and wide-gamut
+	// sources keep their colors. DisableColorManagement turns this off, which
+	// changes every cache key.
+	DisableColorManagement bool
+
+	// Processed images are turned upright according to their EXIF orientation
+	// before any other operation, so portrait photos are cropped and resized in
+	// the orientation they're viewed in. Requests can opt out with orient=false;
+	// DisableAutoOrient turns it off for all, which changes every cache key.
+	DisableAutoOrient bool
+
+	// KeepMetadata is the metadata processed images keep when the request has no
+	// keep= parameter: KeepEXIF, KeepICC, KeepAll or KeepNone. Empty strips
+	// everything. Like the encoder defaults, setting it changes every cache key.
+	KeepMetadata string
+
+	// Refresh enables the background refresher, which re-processes popular entries
+	// about to expire while the server is idle. Nil disables it. It only works with
+	// the default cache and stops with Handler.Shutdown or Close.
+	Refresh *RefreshConfig
+
+	// VipsWatchdog enables the watchdog that checks libvips' memory for leaks,
+	// alerting when it exceeds limits or keeps growing. Nil disables it. It
+	// stops with Handler.Shutdown or Close.
+	VipsWatchdog *VipsWatchdogConfig
+
+	// DedupOriginals hashes fetched source images so that byte-identical sources
+	// behind different URLs are processed once per set of params: later URLs get a
+	// copy of the first one's cached result. Custom processors must not depend on
+	// params.URL when it's enabled.
+	DedupOriginals bool
+
+	// MemoryBudget enables strict memory mode: origin bodies, the estimated working
+	// set of images being decoded (see Processor.ReserveDecode) and the default
+	// cache's heap bytes together never exceed this many bytes. A request that would
+	// exceed it waits up to MemoryQueueTimeout and then gets 503. Keep CacheMaxCost
+	// well below it, since a full cache leaves nothing for requests. 0 disables it.
+	MemoryBudget int64
+
+	// MemoryQueueTimeout is how long a request waits for room in MemoryBudget
+	// or MaxConcurrentBytes. Defaults to 5 seconds.
+	MemoryQueueTimeout time.Duration
+
+	// MaxConcurrentBytes caps the origin bodies buffered at once, without the
+	// rest of strict memory mode: a fetch reserves its Content-Length before
+	// reading and waits up to MemoryQueueTimeout for room, then gets 503. Bodies
+	// of unknown length are charged once read. It applies to the built-in
+	// fetcher, alongside MemoryBudget if both are set. 0 disables it.
+	MaxConcurrentBytes int64
+
+	// AllowSVG accepts SVG sources, which are rasterized (to PNG unless another
+	// format is requested) at the requested size. It's off by default because SVG
+	// files can reference external resources and are costly to render; when off
+	// they're rejected with 415.
+	AllowSVG bool
+
+	// Now returns the current time. Defaults to time.Now; override in tests.
+	Now func() time.Time
+
+	// OnWarning receives the settings Validate replaced with a default, such as
+	// a ProcessingLimit of 0. Defaults to logging them with slog.Warn.
+	OnWarning func(msg string)
+
+	// AllowedHosts restricts the hosts images (and overlays) may be fetched from.
+	// Entries match exactly, or any subdomain when written as "*.example.com".
+	// Empty allows every host.
+	AllowedHosts []string
+
+	// DefaultImage is a URL or local file path used when the url parameter is
+	// structurally invalid (unparseable or not http/https), see DefaultImageMode.
+	DefaultImage string
+
+	// DefaultImageMode selects how DefaultImage is used: off (400, the default),
+	// redirect (302) or serve (processed with the requested parameters).
+	// It never applies to origin failures such as 404s.
+	DefaultImageMode DefaultImageMode
+
+	// ReadinessCanaryURL is a source Handler.Ready fetches to check the origin
+	// is reachable, e.g. a small image on the main image host. Empty skips the
+	// check.
+	ReadinessCanaryURL string
+
+	// PathProfiles enforce parameters for source URLs matching a pattern, e.g. every
+	// avatar as a 256x256 WebP. They're applied after the query is parsed and
+	// validated, and the first matching profile wins. See PathProfile and ProfileMode.
+	PathProfiles []PathProfile
+
+	// Presets are registered with Handler.RegisterPreset when the handler is
+	// created, by name.
+	Presets map[string]ProcessingParams
+
+	// PresetsOnly rejects with 400 any request carrying parameters other than url
+	// and preset, so clients can only ask for presets registered with
+	// Handler.RegisterPreset (or the unmodified source).
+	PresetsOnly bool
+
+	// AllowedOperations, if not empty, lists the only query parameters clients may
+	// use, by name or alias, e.g. {"w", "h", "f", "q"} for resizing and format
+	// conversion alone. Others are rejected with 400 naming the parameter. url and
+	// preset are always allowed. Listing a packed parameter (resize, modulate)
+	// allows the ones it sets, and listing all of those allows it.
+	AllowedOperations []string
+
+	// SignatureSecrets, if not empty, makes every image request carry a sig
+	// parameter signed with one of them (see SignURL), or be refused with 403
+	// before anything is fetched. List the new secret next to the old one while
+	// rotating. Signed URLs may also carry an expires unix timestamp.
+	SignatureSecrets []string
+
+	// Cache stores processed responses. If nil, an InMemoryCache sized by
+	// CacheTTL and CacheMaxCost is used.
+	Cache Cache
+
+	// LargeEntryThreshold moves cached responses of at least this many bytes out of
+	// the Go heap into files in LargeEntryDir (see InMemoryCache.SpillLargeEntries),
+	// reducing GC work with many multi-megabyte entries. 0 keeps everything in memory.
+	// Only applies to the default cache.
+	LargeEntryThreshold int
+
+	// LargeEntryDir holds spilled entries. Defaults to "ipxpress-cache" in the
+	// system temp directory. Files left by a crash are removed on startup, so
+	// don't share it between processes.
+	LargeEntryDir string
+
+	// Capabilities overrides the detected libvips capabilities (mainly for tests).
+	// If nil, capabilities are probed from libvips on handler creation.
+	Capabilities *Capabilities
 }
 
 // DefaultConfig returns the default configuration.
@@ -72,9 +369,121 @@ func DefaultConfig() *Config {
 		ClientMaxAge:    604800, // 7 days
 		SMaxAge:         0,
 		EnableETag:      true,
+
+		StreamThreshold:     16 * 1024 * 1024, // 16 MB
+		UnsupportedCacheTTL: 24 * time.Hour,
+		MaxDimension:        16384,
+		MaxZoom:             4,
+		MaxInputPixels:      50_000_000,
+		DedupOriginals:      true,
+		MaxUploadSize:       32 * 1024 * 1024, // 32 MB
+		CheapCostThreshold:  1,
 	}
 }
 
 // NewDefaultConfig is an alias for DefaultConfig to improve discoverability
 // for library clients who look for a constructor-style helper.
 func NewDefaultConfig() *Config { return DefaultConfig() }
+
+// Validate rejects settings the handler can't work with, such as negative
+// durations or sizes, path profiles that don't compile or a TTL schedule rule
+// that can never match, and replaces zero values that would stop it from serving
+// with their DefaultConfig values, reporting each to OnWarning: ProcessingLimit
+// (every request would wait forever), CacheTTL and CacheMaxCost. A Config
+// literal that leaves those out therefore behaves like DefaultConfig for them.
+// NewHandler calls it and panics on an error, so call it first to handle one.
+func (c *Config) Validate() error {
+	defaults := DefaultConfig()
+	warn := c.OnWarning
+	if warn == nil {
+		warn = func(msg string) { slog.Warn(msg) }
+	}
+	if c.ProcessingLimit <= 0 {
+		warn(fmt.Sprintf("ProcessingLimit %d would block every request, using %d", c.ProcessingLimit, defaults.ProcessingLimit))
+		c.ProcessingLimit = defaults.ProcessingLimit
+	}
+	if c.CacheTTL == 0 {
+		warn(fmt.Sprintf("CacheTTL is not set, using %s", defaults.CacheTTL))
+		c.CacheTTL = defaults.CacheTTL
+	}
+	if c.CacheMaxCost == 0 && c.Cache == nil {
+		warn(fmt.Sprintf("CacheMaxCost is not set, using %d", defaults.CacheMaxCost))
+		c.CacheMaxCost = defaults.CacheMaxCost
+	}
+
+	var errs []error
+	check := func(ok bool, field string, value any, want string) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s must %s, got %v", field, want, value))
+		}
+	}
+	for _, d := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"CacheTTL", c.CacheTTL},
+		{"StaleGrace", c.StaleGrace},
+		{"CleanupInterval", c.CleanupInterval},
+		{"UnsupportedCacheTTL", c.UnsupportedCacheTTL},
+		{"ErrorCacheTTL", c.ErrorCacheTTL},
+		{"MemoryQueueTimeout", c.MemoryQueueTimeout},
+		{"FetchQueueTimeout", c.FetchQueueTimeout},
+		{"EarlyHeadersAfter", c.EarlyHeadersAfter},
+		{"ResponseHeaderDeadline", c.ResponseHeaderDeadline},
+	} {
+		check(d.value >= 0, d.field, d.value, "not be negative")
+	}
+	for _, n := range []struct {
+		field string
+		value int64
+	}{
+		{"CacheMaxCost", int64(c.CacheMaxCost)},
+		{"FetchLimit", int64(c.FetchLimit)},
+		{"CheapReservedSlots", int64(c.CheapReservedSlots)},
+		{"CacheMaxEntryBytes", int64(c.CacheMaxEntryBytes)},
+		{"CacheCompressMinBytes", int64(c.CacheCompressMinBytes)},
+		{"ClientMaxAge", int64(c.ClientMaxAge)},
+		{"SMaxAge", int64(c.SMaxAge)},
+		{"StreamThreshold", c.StreamThreshold},
+		{"MaxDimension", int64(c.MaxDimension)},
+		{"MaxInputPixels", int64(c.MaxInputPixels)},
+		{"MaxUploadSize", c.MaxUploadSize},
+		{"MemoryBudget", c.MemoryBudget},
+		{"MaxConcurrentBytes", c.MaxConcurrentBytes},
+		{"LargeEntryThreshold", int64(c.LargeEntryThreshold)},
+	} {
+		check(n.value >= 0, n.field, n.value, "not be negative")
+	}
+	if v := c.VipsConfig; v != nil {
+		check(v.Concurrency >= 0, "VipsConfig.Concurrency", v.Concurrency, "not be negative")
+		check(v.MaxCacheMem >= 0, "VipsConfig.MaxCacheMem", v.MaxCacheMem, "not be negative")
+		check(v.MaxCacheSize >= 0, "VipsConfig.MaxCacheSize", v.MaxCacheSize, "not be negative")
+		check(v.MaxCacheFiles >= 0, "VipsConfig.MaxCacheFiles", v.MaxCacheFiles, "not be negative")
+	}
+	check(c.MaxZoom >= 0, "MaxZoom", c.MaxZoom, "not be negative")
+	check(c.CheapCostThreshold >= 0, "CheapCostThreshold", c.CheapCostThreshold, "not be negative")
+	switch c.KeepMetadata {
+	case "", KeepNone, KeepEXIF, KeepICC, KeepAll:
+	default:
+		check(false, "KeepMetadata", fmt.Sprintf("%q", c.KeepMetadata), "be one of "+KeepNone+", "+KeepEXIF+", "+KeepICC+" or "+KeepAll)
+	}
+	switch c.CacheCompression {
+	case "", CompressOff, CompressText, CompressAll:
+	default:
+		check(false, "CacheCompression", fmt.Sprintf("%q", c.CacheCompression), "be off, text or all")
+	}
+	if _, err := compilePathProfiles(c.PathProfiles); err != nil {
+		errs = append(errs, fmt.Errorf("PathProfiles: %w", err))
+	}
+	if err := c.TTLSchedule.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("TTLSchedule: %w", err))
+	}
+	switch c.DefaultImageMode {
+	case "", DefaultImageOff:
+	case DefaultImageRedirect, DefaultImageServe:
+		check(c.DefaultImage != "", "DefaultImage", `""`, "be set for DefaultImageMode "+string(c.DefaultImageMode))
+	default:
+		check(false, "DefaultImageMode", fmt.Sprintf("%q", c.DefaultImageMode), "be off, redirect or serve")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,656 @@
+package ipxpress
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// envPrefix starts the environment variables ApplyEnv reads.
+const envPrefix = "IPX_"
+
+// fileConfig is the form of Config read from files and the environment. Fields
+// are pointers (or nil slices) so that only the settings given replace the
+// defaults. Settings that only make sense in Go (Cache, TransformQuota, Now,
+// ...) aren't part of it.
+type fileConfig struct {
+	CacheTTL            *duration `json:"cache_ttl"`
+	CacheMaxCost        *int      `json:"cache_max_cost"`
+	ProcessingLimit     *int      `json:"processing_limit"`
+	CheapCostThreshold  *float64  `json:"cheap_cost_threshold"`
+	CheapReservedSlots  *int      `json:"cheap_reserved_slots"`
+	FetchLimit          *int      `json:"fetch_limit"`
+	FetchQueueTimeout   *duration `json:"fetch_queue_timeout"`
+	ClientMaxAge        *int      `json:"client_max_age"`
+	SMaxAge             *int      `json:"s_maxage"`
+	EnableETag          *bool     `json:"enable_etag"`
+	StreamThreshold     *int64    `json:"stream_threshold"`
+	EarlyHeadersAfter   *duration `json:"early_headers_after"`
+	ResponseDeadline    *duration `json:"response_header_deadline"`
+	EarlyHints          []string  `json:"early_hints"`
+	UnsupportedCacheTTL *duration `json:"unsupported_cache_ttl"`
+	ErrorCacheTTL       *duration `json:"error_cache_ttl"`
+	StaleGrace          *duration `json:"stale_grace"`
+	HonorOriginCache    *bool     `json:"honor_origin_cache_control"`
+	DebugHeaders        *bool     `json:"debug_headers"`
+	DebugRequests       *bool     `json:"debug_requests"`
+	StrictParams        *bool     `json:"strict_params"`
+	MaxDimension        *int      `json:"max_dimension"`
+	MaxInputPixels      *int      `json:"max_input_pixels"`
+	MaxUploadSize       *int64    `json:"max_upload_size"`
+	MaxZoom             *float64  `json:"max_zoom"`
+	ColorManagement     *bool     `json:"color_management"`
+	AutoOrient          *bool     `json:"auto_orient"`
+	KeepMetadata        *string   `json:"keep_metadata"`
+	DedupOriginals      *bool     `json:"dedup_originals"`
+	MemoryBudget        *int64    `json:"memory_budget"`
+	MemoryQueueTimeout  *duration `json:"memory_queue_timeout"`
+	MaxConcurrentBytes  *int64    `json:"max_concurrent_bytes"`
+	AllowSVG            *bool     `json:"allow_svg"`
+	AllowedHosts        []string  `json:"allowed_hosts"`
+	DefaultImage        *string   `json:"default_image"`
+	ReadinessCanaryURL  *string   `json:"readiness_canary_url"`
+	DefaultImageMode    *string   `json:"default_image_mode"`
+	CacheMaxEntryBytes  *int      `json:"cache_max_entry_bytes"`
+	CacheCompression    *string   `json:"cache_compression"`
+	CacheCompressMin    *int      `json:"cache_compress_min_bytes"`
+	PresetsOnly         *bool     `json:"presets_only"`
+	AllowedOperations   []string  `json:"allowed_operations"`
+	SignatureSecrets    []string  `json:"signature_secrets"`
+	LargeEntryThreshold *int      `json:"large_entry_threshold"`
+	LargeEntryDir       *string   `json:"large_entry_dir"`
+
+	Vips    *vipsFileConfig    `json:"vips"`
+	Fetcher *fetcherFileConfig `json:"fetcher"`
+
+	// Presets and profiles give their params as a query, e.g. "w=200&f=webp".
+	// They can't be set from the environment.
+	Presets      map[string]string       `json:"presets"`
+	PathProfiles []pathProfileFileConfig `json:"path_profiles"`
+}
+
+type vipsFileConfig struct {
+	Concurrency   *int    `json:"concurrency"`
+	MaxCacheMem   *int    `json:"max_cache_mem"`
+	MaxCacheSize  *int    `json:"max_cache_size"`
+	MaxCacheFiles *int    `json:"max_cache_files"`
+	LogLevel      *string `json:"log_level"`
+}
+
+type fetcherFileConfig struct {
+	Timeout               *duration `json:"timeout"`
+	ConnectTimeout        *duration `json:"connect_timeout"`
+	TLSHandshakeTimeout   *duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout *duration `json:"response_header_timeout"`
+	MaxConnsPerHost       *int      `json:"max_conns_per_host"`
+	MaxIdleConns          *int      `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   *int      `json:"max_idle_conns_per_host"`
+	UserAgent             *string   `json:"user_agent"`
+	MaxAttempts           *int      `json:"max_attempts"`
+	RetryBaseDelay        *duration `json:"retry_base_delay"`
+	RetryMaxDelay         *duration `json:"retry_max_delay"`
+	RetryStatuses         []int     `json:"retry_statuses"`
+	MaxConcurrentPerHost  *int      `json:"max_concurrent_per_host"`
+	RateLimitPerHost      *float64  `json:"rate_limit_per_host"`
+	HostQueueTimeout      *duration `json:"host_queue_timeout"`
+	ProxyURL              *string   `json:"proxy_url"`
+	ProxyFromEnvironment  *bool     `json:"proxy_from_environment"`
+	RootCAFile            *string   `json:"root_ca_file"`
+	InsecureSkipVerify    *bool     `json:"insecure_skip_verify"`
+	MinTLSVersion         *string   `json:"min_tls_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type pathProfileFileConfig struct {
+	Name   string `json:"name"`
+	Match  string `json:"match"`
+	Regexp string `json:"regexp"`
+	Params string `json:"params"`
+	Mode   string `json:"mode"`
+}
+
+// duration is a time.Duration written as a string such as "10m" or "1h30m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("expected a duration such as \"10m\"")
+	}
+	return d.set(s)
+}
+
+func (d *duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("expected a duration such as \"10m\"")
+	}
+	*d = duration(v)
+	return nil
+}
+
+var vipsLogLevels = map[string]vips.LogLevel{
+	"error":    vips.LogLevelError,
+	"critical": vips.LogLevelCritical,
+	"warning":  vips.LogLevelWarning,
+	"message":  vips.LogLevelMessage,
+	"info":     vips.LogLevelInfo,
+	"debug":    vips.LogLevelDebug,
+}
+
+// LoadConfig reads a JSON configuration file over DefaultConfig. Keys are the
+// snake_case names of the Config fields, durations are strings such as "10m":
+//
+//	{
+//	  "cache_ttl": "1h",
+//	  "processing_limit": 64,
+//	  "allowed_hosts": ["*.example.com"],
+//	  "fetcher": {"timeout": "20s"},
+//	  "presets": {"thumbnail": "w=200&h=200&fit=cover&f=webp"}
+//	}
+//
+// Unknown keys and invalid values are errors naming the setting. Call ApplyEnv
+// on the result to let the environment override the file.
+func LoadConfig(path string) (*Config, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json", "":
+	case ".yaml", ".yml":
+		return nil, fmt.Errorf("%s: YAML isn't supported, write the configuration as JSON", path)
+	default:
+		return nil, fmt.Errorf("%s: unknown configuration format %q", path, ext)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	if err := decodeFields(data, &fc, ""); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	config := DefaultConfig()
+	if err := fc.apply(config, func(name string) string { return name }); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// LoadConfigFromEnv returns DefaultConfig with the environment applied, see
+// ApplyEnv.
+func LoadConfigFromEnv() (*Config, error) {
+	config := DefaultConfig()
+	if err := ApplyEnv(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ApplyEnv overrides settings of config with IPX_ environment variables named
+// after the configuration file keys: IPX_CACHE_TTL=1h, IPX_ALLOWED_HOSTS with a
+// comma-separated list, IPX_FETCHER_TIMEOUT=20s for nested settings. Presets
+// and path profiles can't be set this way.
+func ApplyEnv(config *Config) error {
+	var fc fileConfig
+	if err := decodeEnv(reflect.ValueOf(&fc).Elem(), envPrefix); err != nil {
+		return err
+	}
+	return fc.apply(config, envName)
+}
+
+// envName returns the environment variable of a file key such as "fetcher.timeout".
+func envName(key string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// decodeFields decodes the JSON object data into the struct dst points to one
+// key at a time, so an error names the key, e.g. "fetcher.timeout".
+func decodeFields(data []byte, dst any, path string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		if !json.Valid(data) {
+			return err
+		}
+		if path == "" {
+			return fmt.Errorf("expected a JSON object")
+		}
+		return fmt.Errorf("%s: expected an object, got %s", path, data)
+	}
+	v := reflect.ValueOf(dst).Elem()
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		name := key
+		if path != "" {
+			name = path + "." + key
+		}
+		f, ok := fieldByTag(v, key)
+		if !ok {
+			return fmt.Errorf("%s: unknown setting", name)
+		}
+		if f.Kind() == reflect.Pointer && f.Type().Elem().Kind() == reflect.Struct {
+			f.Set(reflect.New(f.Type().Elem()))
+			if err := decodeFields(fields[key], f.Interface(), name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := json.Unmarshal(fields[key], f.Addr().Interface()); err != nil {
+			return fmt.Errorf("%s: invalid value %s: %s", name, fields[key], strings.TrimPrefix(err.Error(), "json: "))
+		}
+	}
+	return nil
+}
+
+// decodeEnv sets the fields of v from environment variables prefix+KEY.
+func decodeEnv(v reflect.Value, prefix string) error {
+	for i := range v.NumField() {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		name := prefix + strings.ToUpper(key)
+		f := v.Field(i)
+
+		switch {
+		case f.Kind() == reflect.Pointer && f.Type().Elem().Kind() == reflect.Struct:
+			nested := reflect.New(f.Type().Elem())
+			if err := decodeEnv(nested.Elem(), name+"_"); err != nil {
+				return err
+			}
+			if !nested.Elem().IsZero() {
+				f.Set(nested)
+			}
+			continue
+		case f.Kind() == reflect.Map, f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct:
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromString(f, raw); err != nil {
+			return fmt.Errorf("%s: invalid value %q: %v", name, raw, err)
+		}
+	}
+	return nil
+}
+
+// setFromString parses s into a pointer, []string or []int field.
+func setFromString(f reflect.Value, s string) error {
+	if f.Kind() == reflect.Slice {
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		if f.Type().Elem().Kind() == reflect.Int {
+			ints := []int{}
+			for _, item := range list {
+				n, err := strconv.Atoi(item)
+				if err != nil {
+					return fmt.Errorf("expected a comma-separated list of integers")
+				}
+				ints = append(ints, n)
+			}
+			f.Set(reflect.ValueOf(ints))
+			return nil
+		}
+		f.Set(reflect.ValueOf(append([]string{}, list...)))
+		return nil
+	}
+
+	p := reflect.New(f.Type().Elem())
+	switch dst := p.Interface().(type) {
+	case *duration:
+		if err := dst.set(s); err != nil {
+			return err
+		}
+	case *string:
+		*dst = s
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		*dst = b
+	case *int, *int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer")
+		}
+		p.Elem().SetInt(n)
+	case *float64:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number")
+		}
+		*dst = v
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.Type())
+	}
+	f.Set(p)
+	return nil
+}
+
+// fieldByTag returns the field of struct v with the given json key.
+func fieldByTag(v reflect.Value, key string) (reflect.Value, bool) {
+	for i := range v.NumField() {
+		if tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ","); tag == key {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// apply validates the settings present and copies them into config. name turns
+// a file key into what errors call it.
+func (fc *fileConfig) apply(config *Config, name func(key string) string) error {
+	var err error
+	fail := func(key, format string, args ...any) {
+		if err == nil {
+			err = fmt.Errorf("%s: %s", name(key), fmt.Sprintf(format, args...))
+		}
+	}
+	setDuration := func(key string, src *duration, dst *time.Duration) {
+		if src == nil {
+			return
+		}
+		if *src < 0 {
+			fail(key, "must not be negative, got %s", time.Duration(*src))
+			return
+		}
+		*dst = time.Duration(*src)
+	}
+	setInt := func(key string, src *int, dst *int, least int) {
+		if src == nil {
+			return
+		}
+		if *src < least {
+			fail(key, "must be at least %d, got %d", least, *src)
+			return
+		}
+		*dst = *src
+	}
+	setInt64 := func(key string, src *int64, dst *int64) {
+		if src == nil {
+			return
+		}
+		if *src < 0 {
+			fail(key, "must not be negative, got %d", *src)
+			return
+		}
+		*dst = *src
+	}
+	setBool := func(src *bool, dst *bool) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setString := func(src *string, dst *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+
+	setDuration("cache_ttl", fc.CacheTTL, &config.CacheTTL)
+	setDuration("stale_grace", fc.StaleGrace, &config.StaleGrace)
+	setBool(fc.HonorOriginCache, &config.HonorOriginCacheControl)
+	setInt("cache_max_cost", fc.CacheMaxCost, &config.CacheMaxCost, 0)
+	setInt("processing_limit", fc.ProcessingLimit, &config.ProcessingLimit, 1)
+	if fc.CheapCostThreshold != nil {
+		if *fc.CheapCostThreshold < 0 {
+			fail("cheap_cost_threshold", "must not be negative, got %g", *fc.CheapCostThreshold)
+		} else {
+			config.CheapCostThreshold = *fc.CheapCostThreshold
+		}
+	}
+	setInt("cheap_reserved_slots", fc.CheapReservedSlots, &config.CheapReservedSlots, 0)
+	setInt("fetch_limit", fc.FetchLimit, &config.FetchLimit, 0)
+	setDuration("fetch_queue_timeout", fc.FetchQueueTimeout, &config.FetchQueueTimeout)
+	setInt("client_max_age", fc.ClientMaxAge, &config.ClientMaxAge, 0)
+	setInt("s_maxage", fc.SMaxAge, &config.SMaxAge, 0)
+	setBool(fc.EnableETag, &config.EnableETag)
+	setInt64("stream_threshold", fc.StreamThreshold, &config.StreamThreshold)
+	setDuration("early_headers_after", fc.EarlyHeadersAfter, &config.EarlyHeadersAfter)
+	setDuration("response_header_deadline", fc.ResponseDeadline, &config.ResponseHeaderDeadline)
+	if fc.EarlyHints != nil {
+		config.EarlyHints = fc.EarlyHints
+	}
+	setDuration("unsupported_cache_ttl", fc.UnsupportedCacheTTL, &config.UnsupportedCacheTTL)
+	setDuration("error_cache_ttl", fc.ErrorCacheTTL, &config.ErrorCacheTTL)
+	setBool(fc.DebugHeaders, &config.DebugHeaders)
+	setBool(fc.DebugRequests, &config.DebugRequests)
+	setBool(fc.StrictParams, &config.StrictParams)
+	setInt("max_dimension", fc.MaxDimension, &config.MaxDimension, 0)
+	setInt("max_input_pixels", fc.MaxInputPixels, &config.MaxInputPixels, 0)
+	setInt64("max_upload_size", fc.MaxUploadSize, &config.MaxUploadSize)
+	if fc.MaxZoom != nil {
+		if *fc.MaxZoom < 0 {
+			fail("max_zoom", "must not be negative, got %g", *fc.MaxZoom)
+		} else {
+			config.MaxZoom = *fc.MaxZoom
+		}
+	}
+	// Both are on unless disabled, so the file keys keep their positive sense
+	if fc.ColorManagement != nil {
+		config.DisableColorManagement = !*fc.ColorManagement
+	}
+	if fc.AutoOrient != nil {
+		config.DisableAutoOrient = !*fc.AutoOrient
+	}
+	if fc.KeepMetadata != nil {
+		switch *fc.KeepMetadata {
+		case "", KeepNone, KeepEXIF, KeepICC, KeepAll:
+			config.KeepMetadata = *fc.KeepMetadata
+		default:
+			fail("keep_metadata", "expected one of %s, %s, %s or %s, got %q", KeepNone, KeepEXIF, KeepICC, KeepAll, *fc.KeepMetadata)
+		}
+	}
+	setBool(fc.DedupOriginals, &config.DedupOriginals)
+	setInt64("memory_budget", fc.MemoryBudget, &config.MemoryBudget)
+	setDuration("memory_queue_timeout", fc.MemoryQueueTimeout, &config.MemoryQueueTimeout)
+	setInt64("max_concurrent_bytes", fc.MaxConcurrentBytes, &config.MaxConcurrentBytes)
+	setBool(fc.AllowSVG, &config.AllowSVG)
+	if fc.AllowedHosts != nil {
+		config.AllowedHosts = fc.AllowedHosts
+	}
+	setString(fc.DefaultImage, &config.DefaultImage)
+	setString(fc.ReadinessCanaryURL, &config.ReadinessCanaryURL)
+	if fc.DefaultImageMode != nil {
+		switch mode := DefaultImageMode(*fc.DefaultImageMode); mode {
+		case DefaultImageOff, DefaultImageRedirect, DefaultImageServe:
+			config.DefaultImageMode = mode
+		default:
+			fail("default_image_mode", "expected off, redirect or serve, got %q", *fc.DefaultImageMode)
+		}
+	}
+	setBool(fc.PresetsOnly, &config.PresetsOnly)
+	if fc.AllowedOperations != nil {
+		for _, op := range fc.AllowedOperations {
+			if _, ok := core.LookupParam(op); !ok {
+				fail("allowed_operations", "unknown parameter %q", op)
+			}
+		}
+		config.AllowedOperations = fc.AllowedOperations
+	}
+	if fc.SignatureSecrets != nil {
+		config.SignatureSecrets = fc.SignatureSecrets
+	}
+	setInt("large_entry_threshold", fc.LargeEntryThreshold, &config.LargeEntryThreshold, 0)
+	setString(fc.LargeEntryDir, &config.LargeEntryDir)
+	setInt("cache_max_entry_bytes", fc.CacheMaxEntryBytes, &config.CacheMaxEntryBytes, 0)
+	setInt("cache_compress_min_bytes", fc.CacheCompressMin, &config.CacheCompressMinBytes, 0)
+	if fc.CacheCompression != nil {
+		switch mode := CacheCompression(*fc.CacheCompression); mode {
+		case CompressOff, CompressText, CompressAll:
+			config.CacheCompression = mode
+		default:
+			fail("cache_compression", "expected off, text or all, got %q", *fc.CacheCompression)
+		}
+	}
+
+	if v := fc.Vips; v != nil {
+		if config.VipsConfig == nil {
+			config.VipsConfig = DefaultVipsConfig()
+		}
+		setInt("vips.concurrency", v.Concurrency, &config.VipsConfig.Concurrency, 0)
+		setInt("vips.max_cache_mem", v.MaxCacheMem, &config.VipsConfig.MaxCacheMem, 0)
+		setInt("vips.max_cache_size", v.MaxCacheSize, &config.VipsConfig.MaxCacheSize, 0)
+		setInt("vips.max_cache_files", v.MaxCacheFiles, &config.VipsConfig.MaxCacheFiles, 0)
+		if v.LogLevel != nil {
+			if level, ok := vipsLogLevels[strings.ToLower(*v.LogLevel)]; ok {
+				config.VipsConfig.LogLevel = level
+			} else {
+				fail("vips.log_level", "expected one of %s, got %q", strings.Join(slices.Sorted(maps.Keys(vipsLogLevels)), ", "), *v.LogLevel)
+			}
+		}
+	}
+
+	if f := fc.Fetcher; f != nil {
+		if config.Fetcher == nil {
+			config.Fetcher = DefaultFetcherConfig()
+		}
+		setDuration("fetcher.timeout", f.Timeout, &config.Fetcher.Timeout)
+		setDuration("fetcher.connect_timeout", f.ConnectTimeout, &config.Fetcher.ConnectTimeout)
+		setDuration("fetcher.tls_handshake_timeout", f.TLSHandshakeTimeout, &config.Fetcher.TLSHandshakeTimeout)
+		setDuration("fetcher.response_header_timeout", f.ResponseHeaderTimeout, &config.Fetcher.ResponseHeaderTimeout)
+		setInt("fetcher.max_conns_per_host", f.MaxConnsPerHost, &config.Fetcher.MaxConnsPerHost, 0)
+		setInt("fetcher.max_idle_conns", f.MaxIdleConns, &config.Fetcher.MaxIdleConns, 0)
+		setInt("fetcher.max_idle_conns_per_host", f.MaxIdleConnsPerHost, &config.Fetcher.MaxIdleConnsPerHost, 0)
+		setString(f.UserAgent, &config.Fetcher.UserAgent)
+		setInt("fetcher.max_attempts", f.MaxAttempts, &config.Fetcher.MaxAttempts, 1)
+		setDuration("fetcher.retry_base_delay", f.RetryBaseDelay, &config.Fetcher.RetryBaseDelay)
+		setDuration("fetcher.retry_max_delay", f.RetryMaxDelay, &config.Fetcher.RetryMaxDelay)
+		if f.RetryStatuses != nil {
+			for _, status := range f.RetryStatuses {
+				if status < 100 || status > 599 {
+					fail("fetcher.retry_statuses", "expected HTTP status codes, got %d", status)
+				}
+			}
+			config.Fetcher.RetryStatuses = f.RetryStatuses
+		}
+		setInt("fetcher.max_concurrent_per_host", f.MaxConcurrentPerHost, &config.Fetcher.MaxConcurrentPerHost, 0)
+		if f.RateLimitPerHost != nil {
+			if *f.RateLimitPerHost < 0 {
+				fail("fetcher.rate_limit_per_host", "must not be negative, got %g", *f.RateLimitPerHost)
+			} else {
+				config.Fetcher.RateLimitPerHost = *f.RateLimitPerHost
+			}
+		}
+		setDuration("fetcher.host_queue_timeout", f.HostQueueTimeout, &config.Fetcher.HostQueueTimeout)
+		if f.ProxyURL != nil {
+			if u, perr := url.Parse(*f.ProxyURL); *f.ProxyURL != "" && (perr != nil || u.Host == "") {
+				fail("fetcher.proxy_url", "expected a URL such as http://proxy:3128, got %q", *f.ProxyURL)
+			}
+			config.Fetcher.ProxyURL = *f.ProxyURL
+		}
+		setBool(f.ProxyFromEnvironment, &config.Fetcher.ProxyFromEnvironment)
+		if f.RootCAFile != nil && *f.RootCAFile != "" {
+			pem, rerr := os.ReadFile(*f.RootCAFile)
+			pool := x509.NewCertPool()
+			if rerr != nil {
+				fail("fetcher.root_ca_file", "%v", rerr)
+			} else if !pool.AppendCertsFromPEM(pem) {
+				fail("fetcher.root_ca_file", "no PEM certificates in %s", *f.RootCAFile)
+			}
+			config.Fetcher.RootCAs = pool
+		}
+		setBool(f.InsecureSkipVerify, &config.Fetcher.InsecureSkipVerify)
+		if f.MinTLSVersion != nil {
+			if version, ok := tlsVersions[*f.MinTLSVersion]; ok {
+				config.Fetcher.MinTLSVersion = version
+			} else {
+				fail("fetcher.min_tls_version", "expected one of %s, got %q", strings.Join(slices.Sorted(maps.Keys(tlsVersions)), ", "), *f.MinTLSVersion)
+			}
+		}
+	}
+
+	if fc.Presets != nil {
+		presets := make(map[string]ProcessingParams, len(fc.Presets))
+		for _, preset := range slices.Sorted(maps.Keys(fc.Presets)) {
+			params, perr := parseParamsQuery(fc.Presets[preset])
+			if perr != nil {
+				fail("presets."+preset, "%v", perr)
+				continue
+			}
+			presets[preset] = *params
+		}
+		config.Presets = presets
+	}
+
+	if fc.PathProfiles != nil {
+		profiles := make([]PathProfile, 0, len(fc.PathProfiles))
+		for i, p := range fc.PathProfiles {
+			key := fmt.Sprintf("path_profiles[%d]", i)
+			params, perr := parseParamsQuery(p.Params)
+			if perr != nil {
+				fail(key+".params", "%v", perr)
+				continue
+			}
+			// A profile only sets what it names; parsing fills in a default quality
+			if !queryHasParam(p.Params, core.ParamQuality) {
+				params.Quality = 0
+			}
+			mode := ProfileMode(p.Mode)
+			switch mode {
+			case "", ProfileDefault, ProfileForce, ProfileClamp:
+			default:
+				fail(key+".mode", "expected default, force or clamp, got %q", p.Mode)
+			}
+			profiles = append(profiles, PathProfile{Name: p.Name, Match: p.Match, Regexp: p.Regexp, Params: *params, Mode: mode})
+		}
+		if _, perr := compilePathProfiles(profiles); perr != nil {
+			fail("path_profiles", "%v", perr)
+		}
+		config.PathProfiles = profiles
+	}
+
+	return err
+}
+
+// parseParamsQuery parses processing params written as a query, rejecting
+// unknown parameters and invalid values.
+func parseParamsQuery(query string) (*ProcessingParams, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query %q: %v", query, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(q)) {
+		if _, ok := core.LookupParam(name); !ok {
+			return nil, fmt.Errorf("unknown parameter %q in %q", name, query)
+		}
+	}
+	params := ParseProcessingParams(&http.Request{URL: &url.URL{RawQuery: query}})
+	if err := params.Err(); err != nil {
+		return nil, fmt.Errorf("%v in %q", err, query)
+	}
+	return params, nil
+}
+
+// queryHasParam reports whether query sets the parameter param under any alias.
+func queryHasParam(query, param string) bool {
+	q, _ := url.ParseQuery(query)
+	for name := range q {
+		if spec, ok := core.LookupParam(name); ok && spec.Name == param {
+			return true
+		}
+	}
+	return false
+}
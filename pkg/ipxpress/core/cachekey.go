@@ -0,0 +1,32 @@
+package core
+
+import (
+	"crypto/md5"
+	"fmt"
+)
+
+// GenerateCacheKey generates a cache key from all request parameters to avoid collisions.
+func GenerateCacheKey(p *ProcessingParams) string {
+	// Info only depends on the source
+	if p.Info {
+		return fmt.Sprintf("%x", md5.Sum([]byte("info|"+p.URL)))
+	}
+
+	// Include all parameters that affect the output image to ensure correct caching.
+	// We use | as separator to avoid ambiguity between parameter values.
+	key := fmt.Sprintf("%s|%d|%d|%d|%s|%s|%s|%s|%t|%t|%d|%f|%s|%d|%t|%t|%t|%s|%d|%s|%s|%t|%t|%d|%s|%f|%d|%s|%t|%s|%d|%f|%f|%f|%f|%s|%d|%s|%t|%s|%s|%d|%t|%d|%t|%t|%d|%d|%d|%s|%t|%t|%d|%d|%s|%s|%s|%t|%s|%s|%t|%d|%d|%d|%f|%d|%s",
+		p.URL, p.Width, p.Height, p.Quality, p.Format,
+		p.Fit, p.Position, p.Kernel, p.Enlarge, p.Pad, p.Padding,
+		p.Blur, p.Sharpen, p.Rotate, p.Flip, p.Flop, p.Grayscale,
+		p.Extract, p.Trim, p.Extend,
+		p.Background, p.Negate, p.Normalize, p.Threshold, p.Tint, p.Gamma, p.Median, p.Modulate, p.Flatten,
+		p.Duotone, p.Posterize, p.Brightness, p.Saturation, p.Hue, p.Contrast,
+		p.Radius, p.Pixelate, p.PixelateRegion, p.DisableWatermark, p.Overlay, p.OverlayPos, p.OverlayWidth,
+		p.QualityAuto, p.MaxBytes,
+		p.Lossless, p.NearLossless, p.Effort, p.PNGCompression, p.PNGColors,
+		p.Keep, p.Strip, p.FirstFrame, p.Page, p.Density, p.TIFFCompression, p.Placeholder, p.Preset, p.Enforce,
+		p.Progressive, p.Subsample, p.DisableOrient, p.Frame, p.CropWidth, p.CropHeight, p.Zoom, p.BorderWidth, p.BorderColor)
+
+	h := md5.Sum([]byte(key))
+	return fmt.Sprintf("%x", h)
+}
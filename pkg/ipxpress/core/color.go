@@ -0,0 +1,71 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RGBA is a color with 8-bit channels; A is 255 for opaque and 0 for transparent.
+type RGBA struct {
+	R, G, B, A uint8
+}
+
+// errColorSyntax is the reason reported for invalid color parameters.
+var errColorSyntax = errors.New("expected hex rgb, rrggbb or rrggbbaa, transparent or a color name")
+
+// namedColors are the CSS basic colors, orange and transparent.
+var namedColors = map[string]RGBA{
+	"transparent": {0, 0, 0, 0},
+	"black":       {0, 0, 0, 255},
+	"silver":      {192, 192, 192, 255},
+	"gray":        {128, 128, 128, 255},
+	"grey":        {128, 128, 128, 255},
+	"white":       {255, 255, 255, 255},
+	"maroon":      {128, 0, 0, 255},
+	"red":         {255, 0, 0, 255},
+	"purple":      {128, 0, 128, 255},
+	"fuchsia":     {255, 0, 255, 255},
+	"magenta":     {255, 0, 255, 255},
+	"green":       {0, 128, 0, 255},
+	"lime":        {0, 255, 0, 255},
+	"olive":       {128, 128, 0, 255},
+	"yellow":      {255, 255, 0, 255},
+	"navy":        {0, 0, 128, 255},
+	"blue":        {0, 0, 255, 255},
+	"teal":        {0, 128, 128, 255},
+	"aqua":        {0, 255, 255, 255},
+	"cyan":        {0, 255, 255, 255},
+	"orange":      {255, 165, 0, 255},
+}
+
+// ParseColor parses a color parameter: hex rgb, rrggbb or rrggbbaa with or
+// without #, transparent, or a CSS basic color name such as navy.
+func ParseColor(s string) (RGBA, error) {
+	if c, ok := namedColors[strings.ToLower(s)]; ok {
+		return c, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) == 8 {
+		if v, err := strconv.ParseUint(hex, 16, 32); err == nil {
+			return RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+		}
+	}
+	if len(s) > maxColorLength {
+		s = s[:maxColorLength] + "..."
+	}
+	return RGBA{}, fmt.Errorf("invalid color %q: %w", s, errColorSyntax)
+}
+
+// isColor reports whether ParseColor accepts s.
+func isColor(s string) bool {
+	_, err := ParseColor(s)
+	return err == nil
+}
@@ -0,0 +1,220 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConflictRule describes parameters that contradict each other and how the
+// contradiction is resolved: Param is dropped, keeping the rest of the request.
+type ConflictRule struct {
+	// Param is the query parameter dropped by Resolve, as reported in errors.
+	Param string
+
+	// Reason explains the conflict, e.g. "needs both width and height".
+	Reason string
+
+	// Check returns the offending value of Param, or "" if the rule doesn't apply.
+	Check func(p *ProcessingParams) string
+
+	// Resolve clears Param so the remaining parameters no longer conflict.
+	Resolve func(p *ProcessingParams)
+}
+
+var (
+	conflictsMu sync.RWMutex
+	conflicts   = []ConflictRule{
+		{
+			Param:  ParamFit,
+			Reason: "needs both width and height",
+			Check: func(p *ProcessingParams) string {
+				switch strings.ToLower(p.Fit) {
+				case "fill", "cover", "contain":
+					if p.Width == 0 || p.Height == 0 {
+						return p.Fit
+					}
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.Fit = "" },
+		},
+		{
+			Param:   ParamPad,
+			Reason:  "needs both width and height",
+			Check:   func(p *ProcessingParams) string { return flag(p.Pad && (p.Width == 0 || p.Height == 0)) },
+			Resolve: func(p *ProcessingParams) { p.Pad = false },
+		},
+		{
+			Param:   ParamTrim,
+			Reason:  "conflicts with extract and crop",
+			Check:   func(p *ProcessingParams) string { return number(p.Trim, p.Extract != "" || p.CropWidth > 0) },
+			Resolve: func(p *ProcessingParams) { p.Trim = 0 },
+		},
+		{
+			Param:  ParamBackground,
+			Reason: "flatten removes transparency",
+			Check: func(p *ProcessingParams) string {
+				return keyword(p.Background, "transparent", p.Flatten)
+			},
+			Resolve: func(p *ProcessingParams) { p.Background = "" },
+		},
+		{
+			Param:  ParamBackground,
+			Reason: "output format has no alpha channel",
+			Check: func(p *ProcessingParams) string {
+				return keyword(p.Background, "transparent", p.Format != "" && !p.Format.SupportsAlpha())
+			},
+			Resolve: func(p *ProcessingParams) { p.Background = "" },
+		},
+		{
+			Param:  ParamTint,
+			Reason: "conflicts with duotone",
+			Check: func(p *ProcessingParams) string {
+				if p.Duotone != "" {
+					return p.Tint
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.Tint = "" },
+		},
+		{
+			Param:   ParamGrayscale,
+			Reason:  "conflicts with duotone",
+			Check:   func(p *ProcessingParams) string { return flag(p.Grayscale && p.Duotone != "") },
+			Resolve: func(p *ProcessingParams) { p.Grayscale = false },
+		},
+		{
+			Param:  ParamSaturation,
+			Reason: "conflicts with grayscale",
+			Check: func(p *ProcessingParams) string {
+				if p.Grayscale && p.Saturation > 0 {
+					return strconv.FormatFloat(p.Saturation, 'g', -1, 64)
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.Saturation = 0 },
+		},
+		{
+			Param:  ParamQuality,
+			Reason: "auto has no effect with lossless",
+			Check: func(p *ProcessingParams) string {
+				if p.QualityAuto && p.Lossless && !p.NearLossless {
+					return "auto"
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.QualityAuto = false },
+		},
+		{
+			Param:  ParamQuality,
+			Reason: "auto needs maxbytes",
+			Check: func(p *ProcessingParams) string {
+				if p.QualityAuto && p.MaxBytes == 0 {
+					return "auto"
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.QualityAuto = false },
+		},
+		{
+			Param:   ParamMaxBytes,
+			Reason:  "needs q=auto",
+			Check:   func(p *ProcessingParams) string { return number(p.MaxBytes, !p.QualityAuto) },
+			Resolve: func(p *ProcessingParams) { p.MaxBytes = 0 },
+		},
+		{
+			Param:  ParamKeep,
+			Reason: "conflicts with strip",
+			Check: func(p *ProcessingParams) string {
+				if p.Strip {
+					return p.Keep
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.Keep = "" },
+		},
+		{
+			Param:  ParamPixelateRegion,
+			Reason: "needs pixelate",
+			Check: func(p *ProcessingParams) string {
+				if p.Pixelate <= 1 {
+					return p.PixelateRegion
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.PixelateRegion = "" },
+		},
+		{
+			Param:  ParamOverlayPos,
+			Reason: "needs overlay",
+			Check: func(p *ProcessingParams) string {
+				if p.Overlay == "" {
+					return p.OverlayPos
+				}
+				return ""
+			},
+			Resolve: func(p *ProcessingParams) { p.OverlayPos = "" },
+		},
+		{
+			Param:   ParamOverlayWidth,
+			Reason:  "needs overlay",
+			Check:   func(p *ProcessingParams) string { return number(p.OverlayWidth, p.Overlay == "") },
+			Resolve: func(p *ProcessingParams) { p.OverlayWidth = 0 },
+		},
+	}
+)
+
+// RegisterConflict adds a rule checked after the built-in ones, so parameters
+// added by extensions can declare their own conflicts. Rules are applied in
+// registration order.
+func RegisterConflict(rule ConflictRule) {
+	conflictsMu.Lock()
+	defer conflictsMu.Unlock()
+	conflicts = append(conflicts, rule)
+}
+
+// ConflictRules returns the registered rules in the order they're applied.
+func ConflictRules() []ConflictRule {
+	conflictsMu.RLock()
+	defer conflictsMu.RUnlock()
+	return append([]ConflictRule(nil), conflicts...)
+}
+
+// ResolveConflicts applies every conflict rule to p in order, dropping the
+// conflicting parameters, and returns an error for each one dropped. The result
+// only depends on p, so equivalent requests share a cache key.
+func (p *ProcessingParams) ResolveConflicts() []*ParamError {
+	var errs []*ParamError
+	for _, rule := range ConflictRules() {
+		if value := rule.Check(p); value != "" {
+			errs = append(errs, newParamError(rule.Param, value, rule.Reason))
+			rule.Resolve(p)
+		}
+	}
+	return errs
+}
+
+// flag returns "1" for a boolean parameter involved in a conflict.
+func flag(conflict bool) string {
+	if conflict {
+		return "1"
+	}
+	return ""
+}
+
+// number returns a non-zero integer parameter involved in a conflict.
+func number(v int, conflict bool) string {
+	if conflict && v != 0 {
+		return strconv.Itoa(v)
+	}
+	return ""
+}
+
+// keyword returns value if it equals kw (ignoring case) and conflicts.
+func keyword(value, kw string, conflict bool) string {
+	if conflict && strings.EqualFold(value, kw) {
+		return value
+	}
+	return ""
+}
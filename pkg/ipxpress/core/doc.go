@@ -0,0 +1,6 @@
+// Package core contains the parts of ipxpress that don't need libvips: image
+// formats, request parameter parsing and cache key computation.
+//
+// It must not import govips or use cgo, so it builds for targets such as
+// GOOS=js GOARCH=wasm. The ipxpress package re-exports these types.
+package core
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Format represents an image format.
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatGIF  Format = "gif"
+	FormatWebP Format = "webp"
+	FormatAVIF Format = "avif"
+	FormatHEIF Format = "heif"
+	FormatTIFF Format = "tiff"
+	FormatJXL  Format = "jxl"
+
+	// FormatSVG is an input-only format: SVG sources are rasterized, and never
+	// written (see Config.AllowSVG).
+	FormatSVG Format = "svg"
+)
+
+// SniffLen is how many leading bytes DetectFormat needs to recognize every
+// format; an SVG root element may follow an XML prolog, comments and a doctype.
+const SniffLen = 1024
+
+// String returns the string representation of the format.
+func (f Format) String() string {
+	return string(f)
+}
+
+// ContentType returns the MIME content type for the format.
+func (f Format) ContentType() string {
+	switch f {
+	case FormatPNG:
+		return "image/png"
+	case FormatWebP:
+		return "image/webp"
+	case FormatGIF:
+		return "image/gif"
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatAVIF:
+		return "image/avif"
+	case FormatHEIF:
+		return "image/heif"
+	case FormatTIFF:
+		return "image/tiff"
+	case FormatJXL:
+		return "image/jxl"
+	case FormatSVG:
+		return "image/svg+xml"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// IsValid checks if the format is supported as output.
+func (f Format) IsValid() bool {
+	switch f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatAVIF, FormatHEIF, FormatTIFF, FormatJXL:
+		return true
+	default:
+		return false
+	}
+}
+
+// Displayable reports whether browsers can display the format, so that sources in
+// it may be served unconverted. HEIF (from iPhones), TIFF, SVG and JPEG XL (only
+// Safari displays it) aren't.
+func (f Format) Displayable() bool {
+	switch f {
+	case FormatJPEG, FormatPNG, FormatGIF, FormatWebP, FormatAVIF:
+		return true
+	default:
+		return false
+	}
+}
+
+// SupportsAlpha reports whether the format can carry transparency.
+func (f Format) SupportsAlpha() bool {
+	switch f {
+	case FormatPNG, FormatGIF, FormatWebP, FormatAVIF, FormatHEIF, FormatTIFF, FormatJXL:
+		return true
+	default:
+		return false
+	}
+}
+
+// SupportsAnimation reports whether the format can carry several frames.
+func (f Format) SupportsAnimation() bool {
+	return f == FormatGIF || f == FormatWebP
+}
+
+// HasQuality reports whether the format's encoder takes a quality setting.
+func (f Format) HasQuality() bool {
+	switch f {
+	case FormatJPEG, FormatWebP, FormatAVIF, FormatHEIF, FormatJXL:
+		return true
+	default:
+		return false
+	}
+}
+
+// ParseFormat parses a format string and returns a Format.
+// Returns empty format if not specified or invalid; use LookupFormat to tell them apart.
+func ParseFormat(s string) Format {
+	format, _ := LookupFormat(s)
+	return format
+}
+
+// LookupFormat parses a format string like ParseFormat but returns an error
+// for unknown values. An empty string yields an empty format and no error.
+func LookupFormat(s string) (Format, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", nil
+	}
+	switch s {
+	case "jpg":
+		s = "jpeg"
+	case "heic":
+		s = "heif"
+	case "tif":
+		s = "tiff"
+	}
+	if Format(s) == FormatSVG {
+		return "", fmt.Errorf("format %q is only accepted as input, choose a raster output format", s)
+	}
+
+	format := Format(s)
+	if !format.IsValid() {
+		return "", fmt.Errorf("unknown format %q", s)
+	}
+	return format, nil
+}
+
+// DetectFormat detects image format from the first bytes of the image data.
+func DetectFormat(data []byte) Format {
+	if len(data) < 12 {
+		return ""
+	}
+
+	// JPEG: FF D8 FF
+	if data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF {
+		return FormatJPEG
+	}
+
+	// PNG: 89 50 4E 47 0D 0A 1A 0A
+	if data[0] == 0x89 && data[1] == 0x50 && data[2] == 0x4E && data[3] == 0x47 {
+		return FormatPNG
+	}
+
+	// GIF: "GIF87a" or "GIF89a"
+	if data[0] == 0x47 && data[1] == 0x49 && data[2] == 0x46 {
+		return FormatGIF
+	}
+
+	// WebP: "RIFF....WEBP"
+	if len(data) >= 12 && data[0] == 0x52 && data[1] == 0x49 && data[2] == 0x46 && data[3] == 0x46 &&
+		data[8] == 0x57 && data[9] == 0x45 && data[10] == 0x42 && data[11] == 0x50 {
+		return FormatWebP
+	}
+
+	// TIFF: "II*\0" (little-endian) or "MM\0*" (big-endian)
+	if (data[0] == 0x49 && data[1] == 0x49 && data[2] == 0x2A && data[3] == 0x00) ||
+		(data[0] == 0x4D && data[1] == 0x4D && data[2] == 0x00 && data[3] == 0x2A) {
+		return FormatTIFF
+	}
+
+	// JPEG XL: a bare codestream (FF 0A) or the ISO-BMFF container's signature box
+	if (data[0] == 0xFF && data[1] == 0x0A) || bytes.HasPrefix(data, jxlContainer) {
+		return FormatJXL
+	}
+
+	// AVIF and HEIF: an ISO-BMFF "ftyp" box at bytes 4-7
+	if data[4] == 0x66 && data[5] == 0x74 && data[6] == 0x79 && data[7] == 0x70 {
+		return ftypFormat(data)
+	}
+
+	if isSVG(data) {
+		return FormatSVG
+	}
+
+	return ""
+}
+
+// jxlContainer is the signature box starting a JPEG XL container.
+var jxlContainer = []byte{0x00, 0x00, 0x00, 0x0C, 0x4A, 0x58, 0x4C, 0x20, 0x0D, 0x0A, 0x87, 0x0A}
+
+// ftypFormat returns the format of an ISO-BMFF file from the brands of its ftyp
+// box: AVIF, or HEIF for the HEVC brands iPhones write. The generic "mif1" and
+// "msf1" brands are used by both, so then the compatible brands decide.
+func ftypFormat(data []byte) Format {
+	switch string(data[8:12]) {
+	case "avif", "avis":
+		return FormatAVIF
+	case "heic", "heix", "hevc", "hevx", "heim", "heis":
+		return FormatHEIF
+	case "mif1", "msf1":
+		// Compatible brands follow the major brand and minor version
+		size := min(int(binary.BigEndian.Uint32(data[0:4])), len(data))
+		var heif bool
+		for i := 16; i+4 <= size; i += 4 {
+			switch string(data[i : i+4]) {
+			case "avif", "avis":
+				return FormatAVIF
+			case "heic", "heix", "hevc", "hevx", "heim", "heis":
+				heif = true
+			}
+		}
+		if heif {
+			return FormatHEIF
+		}
+	}
+	return ""
+}
+
+// isSVG reports whether data starts with an <svg> root element, after an optional
+// byte order mark, XML declaration, comments and doctype, within SniffLen bytes.
+func isSVG(data []byte) bool {
+	data = bytes.TrimPrefix(data[:min(len(data), SniffLen)], []byte("\xef\xbb\xbf"))
+	for {
+		data = bytes.TrimLeft(data, " \t\r\n")
+		var end []byte
+		switch {
+		case bytes.HasPrefix(data, []byte("<?")):
+			end = []byte("?>")
+		case bytes.HasPrefix(data, []byte("<!--")):
+			end = []byte("-->")
+		case bytes.HasPrefix(data, []byte("<!")):
+			end = []byte(">")
+			if i := bytes.IndexByte(data, '['); i >= 0 && i < bytes.IndexByte(data, '>') {
+				end = []byte("]>") // doctype with an internal subset
+			}
+		default:
+			rest, ok := bytes.CutPrefix(data, []byte("<svg"))
+			return ok && len(rest) > 0 && bytes.IndexByte([]byte(" \t\r\n/>"), rest[0]) >= 0
+		}
+		i := bytes.Index(data, end)
+		if i < 0 {
+			return false
+		}
+		data = data[i+len(end):]
+	}
+}
@@ -0,0 +1,613 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProcessingParams contains all parameters for image processing.
+type ProcessingParams struct {
+	URL     string
+	Width   int
+	Height  int
+	Quality int
+	Format  Format
+
+	// QualityAuto (q=auto) picks the highest quality whose output fits in MaxBytes
+	QualityAuto bool
+	MaxBytes    int // output size budget for QualityAuto
+
+	// Encoding options
+	Lossless        bool   // lossless WebP/AVIF
+	NearLossless    bool   // near-lossless WebP, preprocessing strength set by Quality
+	Effort          int    // WebP reduction effort 1-6, 0 for the default (4)
+	PNGCompression  int    // PNG zlib level 1-9, 0 for the default (6)
+	PNGColors       int    // quantize PNG to a palette of at most this many colors (2-256)
+	TIFFCompression string // lzw, deflate or none; empty for none
+	Progressive     string // "true" or "false" for progressive JPEG and interlaced PNG; empty for the server default
+	Subsample       string // JPEG chroma subsampling, 444 or 420; empty lets libvips decide
+	Enforce         bool   // re-encode even when the original could be served as is
+
+	// Metadata
+	Keep  string // metadata kept on output: exif, icc, all or none; empty uses the server default
+	Strip bool   // strip all metadata whatever the server default
+
+	// Resize options
+	Fit      string  // contain, cover, fill, inside, outside
+	Position string  // top, bottom, left, right, centre, etc.
+	Zoom     float64 // scale past the requested size, then crop back to it
+	Kernel   string  // nearest, cubic, mitchell, lanczos2, lanczos3
+	Enlarge  bool    // allow upscaling
+	Pad      bool    // letterbox onto an exact width x height canvas (also fit=contain)
+	Padding  int     // uniform margin in pixels around the result
+
+	// Operations
+	Blur      float64 // blur sigma
+	Sharpen   string  // sigma_flat_jagged (e.g., "1.5_1_2")
+	Rotate    int     // rotation angle
+	Flip      bool    // flip vertically
+	Flop      bool    // flip horizontally
+	Grayscale bool    // convert to grayscale
+
+	// Cropping and extending
+	Extract    string // left_top_width_height, each in pixels or a percentage such as 10p
+	CropWidth  int    // crop=WIDTHxHEIGHT: a region of this size around the center
+	CropHeight int
+	Trim       int    // trim threshold
+	Extend     string // top_right_bottom_left, placed by Position when it names a side
+	// border=WIDTH or WIDTH_COLOR: a uniform border, Background colored by default
+	BorderWidth int
+	BorderColor string
+
+	// Color operations
+	Background string  // background color (hex)
+	Negate     bool    // invert colors
+	Normalize  bool    // normalize image
+	Threshold  int     // threshold value
+	Tint       string  // tint color (hex)
+	Gamma      float64 // gamma correction
+	Median     int     // median filter size
+	Modulate   string  // brightness_saturation_hue
+	Flatten    bool    // remove alpha channel
+	Duotone    string  // darkhex_lighthex (e.g., "1a2b3c_ffcc00")
+	Posterize  int     // number of levels per channel
+	Brightness float64 // brightness multiplier (0-3), combined with Modulate
+	Saturation float64 // saturation multiplier (0-3), combined with Modulate
+	Hue        float64 // hue rotation in degrees, added to Modulate's
+	Contrast   float64 // contrast multiplier around mid-grey (0-3)
+
+	// Masking
+	Radius         string // corner radius in pixels, or "max" for a circle crop
+	Pixelate       int    // pixelation block size in pixels
+	PixelateRegion string // left_top_width_height in source pixels; empty pixelates everything
+
+	// Orientation
+	DisableOrient bool // orient=false: keep the EXIF orientation instead of turning the image upright
+
+	// Animation
+	FirstFrame bool // animated=false: only the first frame of animated GIF/WebP sources
+	Frame      int  // frame=N: only frame N (from 0) of animated sources, clamped to the last
+
+	// Multi-page input
+	Page    int // page of multi-page sources (PDF, TIFF, ...), from 0
+	Density int // PDF and SVG rasterization resolution in DPI; 0 uses libvips' 72
+
+	// Overlays
+	DisableWatermark bool   // watermark=false, honoured if the watermark processor allows it
+	Overlay          string // URL of an image to draw over the result
+	OverlayPos       string // X_Y in pixels or a gravity (north, southeast, centre, ...)
+	OverlayWidth     int    // overlay width in pixels, height keeps the aspect ratio
+
+	// Info answers with the source's metadata as JSON instead of an image
+	// (info=true or the /info path); every other parameter is ignored.
+	Info bool
+
+	// Placeholder answers with a placeholder hash of the processed image as JSON
+	// instead of the image; only blurhash so far.
+	Placeholder string
+
+	// Preset names the server-side preset these params were replaced with
+	// (preset=...), see Handler.RegisterPreset.
+	Preset string
+
+	// Profile names the server-side path profile applied to these params, if any.
+	// It is never read from the query.
+	Profile string
+
+	// Errors lists parameters whose values were rejected and ignored while parsing,
+	// including those dropped by ResolveConflicts. The handler answers 400 in strict
+	// mode and reports them in lenient mode.
+	Errors []*ParamError
+}
+
+// ParamError describes a query parameter whose value was rejected.
+type ParamError struct {
+	Param  string
+	Value  string // truncated to a short prefix so errors and headers stay small
+	Reason string
+}
+
+// Limits applied while parsing, so no parser allocates in proportion to
+// attacker-controlled input. Longer values are rejected in strict mode and
+// truncated otherwise.
+const (
+	maxParamLength  = 256  // any parameter value
+	maxURLLength    = 8192 // url and overlay
+	maxColorLength  = 16   // "#rrggbbaa" or a keyword like "transparent"
+	maxErrorValue   = 32   // bytes of a bad value kept in ParamError
+	maxListedErrors = 5    // errors listed by ProcessingParams.Err
+)
+
+// maxZoom caps the zoom parameter; Config.MaxZoom usually caps it lower.
+const maxZoom = 16
+
+// maxColorFactor caps the brightness, saturation and contrast multipliers;
+// beyond it every pixel is already clipped.
+const maxColorFactor = 3
+
+// newParamError builds a ParamError, keeping only a prefix of long values.
+func newParamError(param, value, reason string) *ParamError {
+	if len(value) > maxErrorValue {
+		value = value[:maxErrorValue] + "..."
+	}
+	return &ParamError{Param: param, Value: value, Reason: reason}
+}
+
+// paramLimit returns the maximum value length for a query parameter.
+func paramLimit(name string) int {
+	spec, ok := paramsByName[name]
+	switch {
+	case ok && spec.Type == ParamTypeURL:
+		return maxURLLength
+	case ok && spec.Type == ParamTypeColor:
+		return maxColorLength
+	default:
+		return maxParamLength
+	}
+}
+
+// boundQuery truncates over-long values and packed values with too many parts in q,
+// returning an error for each one.
+func boundQuery(q url.Values) []*ParamError {
+	var errs []*ParamError
+
+	names := make([]string, 0, len(q))
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := q[name]
+		limit := paramLimit(name)
+		for i, v := range values {
+			if len(v) > limit {
+				errs = append(errs, newParamError(name, v, fmt.Sprintf("longer than %d characters", limit)))
+				values[i] = v[:limit]
+			}
+		}
+
+		if spec, ok := paramsByName[name]; ok && spec.Type == ParamTypePacked && len(values) > 0 {
+			n := spec.Parts
+			if parts := SplitPacked(values[0], n+1); len(parts) > n {
+				errs = append(errs, newParamError(name, values[0], fmt.Sprintf("more than %d parts", n)))
+				values[0] = strings.Join(parts[:n], "_")
+			}
+		}
+	}
+
+	return errs
+}
+
+// SplitPacked splits a "_"-separated value such as extract or modulate into at most
+// n parts, dropping anything after the n-th separator. Its allocation is bounded by n,
+// not by the input.
+func SplitPacked(s string, n int) []string {
+	parts := strings.SplitN(s, "_", n+1)
+	if len(parts) > n {
+		parts = parts[:n]
+	}
+	return parts
+}
+
+// Error implements the error interface.
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid %s=%q: %s", e.Param, e.Value, e.Reason)
+}
+
+// ParseProcessingParams extracts processing parameters from HTTP request, as
+// described by the ParamSpecs of ListParams. Supports both long and short parameter
+// names (compatible with ipx v2):
+// - w/width, h/height, f/format, q/quality, s/resize, b/background, pos/position
+//
+// When both names of a parameter are given the short one wins, and explicit
+// w/h override the corresponding dimension from s=WIDTHxHEIGHT.
+func ParseProcessingParams(r *http.Request) *ProcessingParams {
+	q := r.URL.Query()
+	pp := &paramParser{errs: boundQuery(q)}
+
+	params := &ProcessingParams{}
+	for i := range paramSpecs {
+		spec := &paramSpecs[i]
+		if raw := spec.value(q.Get); raw != "" {
+			spec.apply(pp, params, raw)
+		}
+	}
+	if params.Quality == 0 {
+		params.Quality = DefaultQuality
+	}
+
+	// Contradictory combinations are resolved the same way in both modes; values
+	// already rejected above aren't reported twice
+	for _, e := range params.ResolveConflicts() {
+		if !pp.rejected(e.Param) {
+			pp.errs = append(pp.errs, e)
+		}
+	}
+
+	params.Errors = pp.errs
+	return params
+}
+
+// NeedsProcessing returns true if any transformation is requested.
+func (p *ProcessingParams) NeedsProcessing(originalFormat Format) bool {
+	// Only process if there are actual transformations, or format or quality change requested.
+	// Sources browsers can't display are always converted.
+	return (originalFormat != "" && !originalFormat.Displayable() && p.Format != originalFormat) || p.HasTransformations() || (p.Format != "" && p.Format != originalFormat) ||
+		(p.QualityAuto && p.MaxBytes > 0) || p.HasQuality() || p.HasEncodeOptions() || p.Placeholder != "" || p.Enforce
+}
+
+// HasQuality returns true if a quality other than the default is requested. The
+// default alone never re-encodes, which would only lose detail to another generation.
+func (p *ProcessingParams) HasQuality() bool {
+	return !p.QualityAuto && p.Quality != 0 && p.Quality != DefaultQuality
+}
+
+// HasEncodeOptions returns true if any encoder setting besides quality is requested.
+// Keeping all metadata isn't one, since unprocessed originals keep theirs.
+func (p *ProcessingParams) HasEncodeOptions() bool {
+	return p.Lossless || p.NearLossless || p.Effort > 0 || p.PNGCompression > 0 || p.PNGColors > 0 || p.TIFFCompression != "" ||
+		p.Progressive != "" || p.Subsample != "" || p.Strip || (p.Keep != "" && p.Keep != KeepAll)
+}
+
+// PlaceholderBlurHash is the BlurHash placeholder, see ProcessingParams.Placeholder.
+const PlaceholderBlurHash = "blurhash"
+
+// TIFF compressions, see ProcessingParams.TIFFCompression.
+const (
+	TIFFCompressionLZW     = "lzw"
+	TIFFCompressionDeflate = "deflate"
+	TIFFCompressionNone    = "none"
+)
+
+// JPEG chroma subsampling, see ProcessingParams.Subsample.
+const (
+	Subsample444 = "444" // full chroma resolution, for sharp colored edges such as text
+	Subsample420 = "420" // chroma at half resolution both ways, smaller
+)
+
+// Metadata kept on output, see ProcessingParams.KeepMetadata.
+const (
+	KeepNone = "none"
+	KeepEXIF = "exif"
+	KeepICC  = "icc"
+	KeepAll  = "all"
+)
+
+// KeepMetadata returns the metadata to keep on output: strip=true wins, then keep=,
+// then serverDefault. An empty result means none.
+func (p *ProcessingParams) KeepMetadata(serverDefault string) string {
+	switch {
+	case p.Strip:
+		return KeepNone
+	case p.Keep != "":
+		return p.Keep
+	default:
+		return serverDefault
+	}
+}
+
+// HasTransformations returns true if any pixel operation is requested.
+// A format or quality change alone is not a transformation.
+func (p *ProcessingParams) HasTransformations() bool {
+	return p.Width > 0 || p.Height > 0 ||
+		p.Blur > 0 || p.Sharpen != "" || p.Rotate != 0 ||
+		p.Flip || p.Flop || p.Grayscale ||
+		p.Extract != "" || p.CropWidth > 0 || p.CropHeight > 0 || p.Trim > 0 || p.Extend != "" || p.BorderWidth > 0 ||
+		p.Background != "" || p.Negate || p.Normalize ||
+		p.Threshold > 0 || p.Tint != "" || p.Gamma > 0 ||
+		p.Median > 0 || p.Modulate != "" || p.Flatten ||
+		p.Duotone != "" || p.Posterize > 1 ||
+		p.Brightness > 0 || p.Saturation > 0 || p.Hue != 0 || p.Contrast > 0 ||
+		p.Fit != "" || p.Position != "" || p.Zoom > 1 || p.Kernel != "" || p.Enlarge ||
+		p.Pad || p.Padding > 0 ||
+		p.Radius != "" || p.Pixelate > 1 || p.Overlay != "" || p.FirstFrame || p.Frame > 0 ||
+		p.Page > 0 || p.Density > 0
+}
+
+// KeepsAnimation reports whether every frame of an animated source can be kept:
+// resizing, format changes and per-pixel color operations apply to all frames,
+// while operations that move pixels across frame boundaries (crops, zoom, borders,
+// rotation, flips, blurs, corners, the overlay) take the first frame, and
+// animated=false, frame= and page= take a single one.
+func (p *ProcessingParams) KeepsAnimation() bool {
+	return !p.FirstFrame && p.Frame == 0 && p.Page == 0 &&
+		p.Zoom <= 1 && p.Extract == "" && p.CropWidth == 0 && p.CropHeight == 0 && p.Trim == 0 && p.Extend == "" && p.BorderWidth == 0 && p.Padding == 0 &&
+		!p.Pad && !strings.EqualFold(p.Fit, "contain") &&
+		p.Rotate == 0 && !p.Flip &&
+		p.Blur == 0 && p.Sharpen == "" && p.Median == 0 &&
+		p.Radius == "" && p.Pixelate <= 1 && p.Overlay == ""
+}
+
+// Err returns the rejected parameters as a single error, or nil if there were none.
+// Only the first few are listed so the message stays small.
+func (p *ProcessingParams) Err() error {
+	if len(p.Errors) == 0 {
+		return nil
+	}
+	n := min(len(p.Errors), maxListedErrors)
+	msgs := make([]string, n, n+1)
+	for i, e := range p.Errors[:n] {
+		msgs[i] = e.Error()
+	}
+	if rest := len(p.Errors) - n; rest > 0 {
+		msgs = append(msgs, fmt.Sprintf("and %d more", rest))
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// CheckDimensions returns a ParamError if the requested width, height, border or
+// overlay width is negative or larger than maxDimension. A maxDimension of 0
+// disables the upper bound.
+func (p *ProcessingParams) CheckDimensions(maxDimension int) error {
+	for _, d := range []struct {
+		name  string
+		value int
+	}{{"width", p.Width}, {"height", p.Height}, {ParamBorder, p.BorderWidth}, {ParamOverlayWidth, p.OverlayWidth}} {
+		if d.value < 0 {
+			return newParamError(d.name, strconv.Itoa(d.value), "must not be negative")
+		}
+		if maxDimension > 0 && d.value > maxDimension {
+			return newParamError(d.name, strconv.Itoa(d.value), fmt.Sprintf("exceeds the maximum of %d", maxDimension))
+		}
+	}
+	return nil
+}
+
+// Output format sources reported by ResolveOutputFormat.
+const (
+	FormatSourceRequested = "requested" // format= was given
+	FormatSourceOriginal  = "original"  // same as the source image
+	FormatSourceDefault   = "default"   // JPEG, because neither was known
+	FormatSourceRaster    = "raster"    // PNG, because the source is a vector format
+	FormatSourceCompat    = "compat"    // JPEG, because browsers can't display the source format
+)
+
+// GetOutputFormat returns the output format, using original format if not specified.
+func (p *ProcessingParams) GetOutputFormat(originalFormat Format) Format {
+	format, _ := p.ResolveOutputFormat(originalFormat)
+	return format
+}
+
+// ResolveOutputFormat is like GetOutputFormat but also reports which rule chose the
+// format (one of the FormatSource constants), so the JPEG fallback is visible.
+func (p *ProcessingParams) ResolveOutputFormat(originalFormat Format) (Format, string) {
+	if p.Format != "" {
+		return p.Format, FormatSourceRequested
+	}
+	if originalFormat == FormatSVG {
+		return FormatPNG, FormatSourceRaster // keeps transparency
+	}
+	if originalFormat != "" && !originalFormat.Displayable() {
+		return FormatJPEG, FormatSourceCompat
+	}
+	if originalFormat != "" {
+		return originalFormat, FormatSourceOriginal
+	}
+	return FormatJPEG, FormatSourceDefault
+}
+
+// EffectiveQuery returns the values actually used for parameters that have implicit
+// defaults (output format and its source, quality) and the applied profile, encoded
+// as a query string.
+func (p *ProcessingParams) EffectiveQuery(originalFormat Format) string {
+	format, source := p.ResolveOutputFormat(originalFormat)
+	v := url.Values{}
+	v.Set("f", string(format))
+	v.Set("f_source", source)
+	if p.QualityAuto {
+		v.Set("q", "auto")
+		v.Set("maxbytes", strconv.Itoa(p.MaxBytes))
+	} else {
+		v.Set("q", strconv.Itoa(p.Quality))
+	}
+	if p.Width > 0 {
+		v.Set("w", strconv.Itoa(p.Width))
+	}
+	if p.Height > 0 {
+		v.Set("h", strconv.Itoa(p.Height))
+	}
+	if p.Preset != "" {
+		v.Set("preset", p.Preset)
+	}
+	if p.Profile != "" {
+		v.Set("profile", p.Profile)
+	}
+	return v.Encode()
+}
+
+// Query encodes p as the query parameters that parse back to it, under their full
+// names. Unset parameters are left out, as are Profile and Errors.
+func (p *ProcessingParams) Query() url.Values {
+	v := url.Values{}
+	for i := range paramSpecs {
+		if value := paramSpecs[i].format(p); value != "" {
+			v.Set(paramSpecs[i].Name, value)
+		}
+	}
+	return v
+}
+
+// paramParser converts query values, recording a ParamError for each one that
+// doesn't parse. Invalid values still convert to zero, so lenient mode ignores them.
+type paramParser struct {
+	errs []*ParamError
+}
+
+// add records an invalid value.
+func (pp *paramParser) add(name, value, reason string) {
+	pp.errs = append(pp.errs, newParamError(name, value, reason))
+}
+
+// rejected reports whether an error was already recorded for the parameter.
+func (pp *paramParser) rejected(name string) bool {
+	for _, e := range pp.errs {
+		if e.Param == name {
+			return true
+		}
+	}
+	return false
+}
+
+// toInt parses an integer parameter.
+func (pp *paramParser) toInt(name, s string) int {
+	if s == "" {
+		return 0
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		pp.add(name, s, "not an integer")
+		return 0
+	}
+	return v
+}
+
+// toIntInRange parses an integer parameter between lo and hi; others become 0.
+func (pp *paramParser) toIntInRange(name, s string, lo, hi int) int {
+	v := pp.toInt(name, s)
+	if s != "" && isInt(s) && (v < lo || v > hi) {
+		pp.add(name, s, fmt.Sprintf("must be between %d and %d", lo, hi))
+		return 0
+	}
+	return v
+}
+
+// toFloat parses a finite floating point parameter.
+func (pp *paramParser) toFloat(name, s string) float64 {
+	if s == "" {
+		return 0
+	}
+	if !isFloat(s) {
+		pp.add(name, s, "not a number")
+		return 0
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	return v
+}
+
+// toBool parses a boolean parameter.
+func (pp *paramParser) toBool(name, s string) bool {
+	if s == "" {
+		return false
+	}
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		if strings.EqualFold(s, "true") {
+			return true
+		}
+		pp.add(name, s, "not a boolean")
+		return false
+	}
+	return v
+}
+
+// checkPacked records an error and returns false if a packed value has fewer
+// parts than the spec requires or a part is invalid. Values with too many parts
+// were already cut by boundQuery.
+func (pp *paramParser) checkPacked(spec *ParamSpec, value string) bool {
+	if value == "" {
+		return true
+	}
+	parts := SplitPacked(value, spec.Parts)
+	if len(parts) < spec.minParts {
+		pp.add(spec.Name, value, fmt.Sprintf("expected at least %d parts", spec.minParts))
+		return false
+	}
+	for _, part := range parts {
+		if !spec.validPart(part) {
+			pp.add(spec.Name, value, fmt.Sprintf("invalid part %q", part))
+			return false
+		}
+	}
+	return true
+}
+
+// Length is a coordinate or size in pixels, or with Percent in percent of the
+// image's width or height, as in extract=10p_10p_50p_50p.
+type Length struct {
+	Value   float64
+	Percent bool
+}
+
+// ParseLength parses pixels ("120") or a percentage ("12.5p").
+func ParseLength(s string) (Length, bool) {
+	if v, ok := strings.CutSuffix(s, "p"); ok {
+		if !isFloat(v) {
+			return Length{}, false
+		}
+		f, _ := strconv.ParseFloat(v, 64)
+		return Length{Value: f, Percent: true}, true
+	}
+	v, err := strconv.Atoi(s)
+	return Length{Value: float64(v)}, err == nil
+}
+
+// Pixels returns l in pixels along a side of the image size pixels long.
+func (l Length) Pixels(size int) int {
+	if l.Percent {
+		return int(math.Round(l.Value * float64(size) / 100))
+	}
+	return int(l.Value)
+}
+
+func isLength(s string) bool {
+	_, ok := ParseLength(s)
+	return ok
+}
+
+func isInt(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func isFloat(s string) bool {
+	v, err := strconv.ParseFloat(s, 64)
+	return err == nil && !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// normalizeHue reduces a hue rotation to (-360, 360) degrees.
+func normalizeHue(deg float64) float64 {
+	if math.IsNaN(deg) || math.IsInf(deg, 0) {
+		return 0
+	}
+	return math.Mod(deg, 360)
+}
+
+// normalizeHexColor normalizes hex color string
+func normalizeHexColor(color string) string {
+	// Remove # if present
+	color = strings.TrimPrefix(color, "#")
+
+	// Validate hex format
+	if len(color) == 3 || len(color) == 6 || len(color) == 8 {
+		return "#" + color
+	}
+
+	return color
+}
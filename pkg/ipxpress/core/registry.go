@@ -0,0 +1,600 @@
+package core
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Query parameter names. Clients should build URLs from these rather than string
+// literals; aliases (short names) win over the full name when both are given.
+const (
+	ParamURL      = "url"
+	ParamResize   = "resize"
+	AliasResize   = "s"
+	ParamWidth    = "width"
+	AliasWidth    = "w"
+	ParamHeight   = "height"
+	AliasHeight   = "h"
+	ParamQuality  = "quality"
+	AliasQuality  = "q"
+	ParamMaxBytes = "maxbytes"
+	ParamFormat   = "format"
+	AliasFormat   = "f"
+
+	ParamInfo        = "info"
+	ParamPlaceholder = "placeholder"
+	ParamPreset      = "preset"
+
+	ParamLossless        = "lossless"
+	ParamNearLossless    = "near_lossless"
+	ParamEffort          = "effort"
+	ParamPNGCompression  = "png_compression"
+	ParamPNGColors       = "png_colors"
+	ParamTIFFCompression = "tiff_compression"
+	ParamProgressive     = "progressive"
+	ParamSubsample       = "subsample"
+
+	ParamKeep  = "keep"
+	ParamStrip = "strip"
+
+	ParamEnforce = "enforce"
+
+	ParamFit      = "fit"
+	ParamPosition = "position"
+	ParamZoom     = "zoom"
+	AliasPosition = "pos"
+	ParamKernel   = "kernel"
+	ParamEnlarge  = "enlarge"
+	ParamPad      = "pad"
+	ParamPadding  = "padding"
+
+	ParamBlur      = "blur"
+	ParamSharpen   = "sharpen"
+	ParamRotate    = "rotate"
+	ParamFlip      = "flip"
+	ParamFlop      = "flop"
+	ParamGrayscale = "grayscale"
+
+	ParamExtract = "extract"
+	ParamCrop    = "crop"
+	ParamTrim    = "trim"
+	ParamExtend  = "extend"
+	ParamBorder  = "border"
+
+	ParamBackground = "background"
+	AliasBackground = "b"
+	ParamNegate     = "negate"
+	ParamNormalize  = "normalize"
+	ParamThreshold  = "threshold"
+	ParamTint       = "tint"
+	ParamGamma      = "gamma"
+	ParamMedian     = "median"
+	ParamModulate   = "modulate"
+	ParamFlatten    = "flatten"
+	ParamDuotone    = "duotone"
+	ParamPosterize  = "posterize"
+	ParamBrightness = "brightness"
+	ParamSaturation = "saturation"
+	ParamHue        = "hue"
+	ParamContrast   = "contrast"
+
+	ParamRadius         = "radius"
+	ParamPixelate       = "pixelate"
+	ParamPixelateRegion = "pixelate_region"
+
+	ParamOrient = "orient"
+
+	ParamAnimated = "animated"
+	ParamFrame    = "frame"
+
+	ParamPage    = "page"
+	ParamDensity = "density"
+
+	ParamWatermark    = "watermark"
+	ParamOverlay      = "overlay"
+	ParamOverlayPos   = "overlay_pos"
+	ParamOverlayWidth = "overlay_w"
+)
+
+// ParamType is the value syntax of a query parameter.
+type ParamType string
+
+const (
+	ParamTypeInt    ParamType = "int"
+	ParamTypeFloat  ParamType = "float"
+	ParamTypeBool   ParamType = "bool"   // anything strconv.ParseBool accepts
+	ParamTypeString ParamType = "string" // a keyword or free-form value
+	ParamTypeColor  ParamType = "color"  // see ParseColor
+	ParamTypeURL    ParamType = "url"
+	ParamTypePacked ParamType = "packed" // Parts values joined by "_"
+	ParamTypeSize   ParamType = "size"   // WIDTHxHEIGHT
+	ParamTypeFormat ParamType = "format"
+)
+
+// DefaultQuality is used when no valid quality is given, by ParseProcessingParams
+// and for library-built params that leave Quality zero.
+const DefaultQuality = 85
+
+// ParamRange is the inclusive range of a numeric parameter. Integers outside it
+// are rejected; floats are clamped.
+type ParamRange struct {
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// ParamSpec describes a query parameter. The table of specs drives
+// ParseProcessingParams and is listed by ListParams for client introspection.
+type ParamSpec struct {
+	Name            string      `json:"name"`
+	Aliases         []string    `json:"aliases,omitempty"`
+	Type            ParamType   `json:"type"`
+	Range           *ParamRange `json:"range,omitempty"`
+	Parts           int         `json:"parts,omitempty"`  // maximum parts of a packed value
+	Values          []string    `json:"values,omitempty"` // accepted keywords, if limited
+	Default         string      `json:"default,omitempty"`
+	AffectsCacheKey bool        `json:"affects_cache_key"`
+	Description     string      `json:"description"`
+
+	// field returns a pointer to the ProcessingParams field set by the generic parser
+	field func(p *ProcessingParams) any
+
+	// parse replaces the generic parser for parameters with their own syntax, and
+	// encode formats the value back for ProcessingParams.Query ("" omits it)
+	parse  func(pp *paramParser, p *ProcessingParams, raw string)
+	encode func(p *ProcessingParams) string
+
+	// minParts and validPart check packed values
+	minParts  int
+	validPart func(string) bool
+}
+
+// between returns the range [lo, hi].
+func between(lo, hi float64) *ParamRange {
+	return &ParamRange{Min: lo, Max: hi}
+}
+
+// paramSpecs lists every query parameter in parsing order: resize comes before
+// width and height so those override it.
+var paramSpecs = []ParamSpec{
+	{Name: ParamURL, Type: ParamTypeURL, AffectsCacheKey: true, Description: "Source image URL (http or https)",
+		field: func(p *ProcessingParams) any { return &p.URL }},
+	{Name: ParamInfo, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Return the source's dimensions, format and metadata as JSON instead of an image",
+		field: func(p *ProcessingParams) any { return &p.Info }},
+	{Name: ParamPlaceholder, Type: ParamTypeString, Values: []string{PlaceholderBlurHash}, AffectsCacheKey: true, Description: "Return a placeholder hash of the processed image as JSON instead of the image",
+		parse: parsePlaceholder, encode: func(p *ProcessingParams) string { return p.Placeholder }},
+	{Name: ParamPreset, Type: ParamTypeString, AffectsCacheKey: true, Description: "Name of a server-side preset used instead of every other parameter",
+		field: func(p *ProcessingParams) any { return &p.Preset }},
+	{Name: ParamResize, Aliases: []string{AliasResize}, Type: ParamTypeSize, AffectsCacheKey: true, Description: "Width and height as WIDTHxHEIGHT",
+		parse: parseResize, encode: func(*ProcessingParams) string { return "" }}, // width and height say it all
+	{Name: ParamWidth, Aliases: []string{AliasWidth}, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Width in pixels",
+		field: func(p *ProcessingParams) any { return &p.Width }},
+	{Name: ParamHeight, Aliases: []string{AliasHeight}, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Height in pixels",
+		field: func(p *ProcessingParams) any { return &p.Height }},
+	{Name: ParamQuality, Aliases: []string{AliasQuality}, Type: ParamTypeInt, Range: between(1, 100), Values: []string{"auto"}, Default: "85", AffectsCacheKey: true, Description: "Lossy compression quality, or auto with maxbytes",
+		parse: parseQuality, encode: func(p *ProcessingParams) string {
+			if p.QualityAuto {
+				return "auto"
+			}
+			return formatInt(p.Quality)
+		}},
+	{Name: ParamMaxBytes, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Output size budget in bytes for quality=auto",
+		parse: parseMaxBytes, encode: func(p *ProcessingParams) string { return formatInt(p.MaxBytes) }},
+
+	{Name: ParamLossless, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Lossless WebP/AVIF",
+		field: func(p *ProcessingParams) any { return &p.Lossless }},
+	{Name: ParamNearLossless, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Near-lossless WebP, quality sets the preprocessing strength",
+		field: func(p *ProcessingParams) any { return &p.NearLossless }},
+	{Name: ParamEffort, Type: ParamTypeInt, Range: between(1, 6), Default: "4", AffectsCacheKey: true, Description: "WebP reduction effort",
+		field: func(p *ProcessingParams) any { return &p.Effort }},
+	{Name: ParamPNGCompression, Type: ParamTypeInt, Range: between(1, 9), Default: "6", AffectsCacheKey: true, Description: "PNG zlib level",
+		field: func(p *ProcessingParams) any { return &p.PNGCompression }},
+	{Name: ParamPNGColors, Type: ParamTypeInt, Range: between(2, 256), AffectsCacheKey: true, Description: "Quantize PNG output to a palette of at most this many colors",
+		field: func(p *ProcessingParams) any { return &p.PNGColors }},
+	{Name: ParamTIFFCompression, Type: ParamTypeString, Values: []string{TIFFCompressionLZW, TIFFCompressionDeflate, TIFFCompressionNone}, Default: TIFFCompressionNone, AffectsCacheKey: true, Description: "TIFF compression",
+		parse: parseTIFFCompression, encode: func(p *ProcessingParams) string { return p.TIFFCompression }},
+	{Name: ParamProgressive, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Progressive JPEG and interlaced PNG; defaults to the server setting (progressive JPEG, plain PNG unless configured)",
+		parse: parseProgressive, encode: func(p *ProcessingParams) string { return p.Progressive }},
+	{Name: ParamSubsample, Type: ParamTypeString, Values: []string{Subsample444, Subsample420}, AffectsCacheKey: true, Description: "JPEG chroma subsampling; 444 keeps colored text sharp. By default off from quality 90",
+		parse: parseSubsample, encode: func(p *ProcessingParams) string { return p.Subsample }},
+
+	{Name: ParamKeep, Type: ParamTypeString, Values: []string{KeepNone, KeepEXIF, KeepICC, KeepAll}, AffectsCacheKey: true, Description: "Metadata kept on output; defaults to the server setting (none unless configured)",
+		parse: parseKeep, encode: func(p *ProcessingParams) string { return p.Keep }},
+	{Name: ParamStrip, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Strip all metadata, overriding keep and the server setting",
+		field: func(p *ProcessingParams) any { return &p.Strip }},
+
+	{Name: ParamEnforce, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Re-encode even when no operation, format or quality change applies",
+		field: func(p *ProcessingParams) any { return &p.Enforce }},
+
+	{Name: ParamFit, Type: ParamTypeString, Values: []string{"contain", "cover", "fill", "inside", "outside"}, AffectsCacheKey: true, Description: "How the image fits width and height",
+		field: func(p *ProcessingParams) any { return &p.Fit }},
+	{Name: ParamPosition, Aliases: []string{AliasPosition}, Type: ParamTypeString, AffectsCacheKey: true, Description: "Crop position or gravity",
+		field: func(p *ProcessingParams) any { return &p.Position }},
+	{Name: ParamZoom, Type: ParamTypeFloat, Range: between(1, maxZoom), AffectsCacheKey: true, Description: "Scale past the requested size and crop back to it, anchored by position",
+		field: func(p *ProcessingParams) any { return &p.Zoom }},
+	{Name: ParamKernel, Type: ParamTypeString, Values: []string{"nearest", "cubic", "mitchell", "lanczos2", "lanczos3"}, Default: "lanczos3", AffectsCacheKey: true, Description: "Resampling kernel",
+		field: func(p *ProcessingParams) any { return &p.Kernel }},
+	{Name: ParamEnlarge, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Allow upscaling",
+		field: func(p *ProcessingParams) any { return &p.Enlarge }},
+	{Name: ParamPad, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Letterbox onto an exact width x height canvas",
+		field: func(p *ProcessingParams) any { return &p.Pad }},
+	{Name: ParamPadding, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Uniform margin in pixels",
+		field: func(p *ProcessingParams) any { return &p.Padding }},
+
+	{Name: ParamBlur, Type: ParamTypeFloat, AffectsCacheKey: true, Description: "Gaussian blur sigma",
+		field: func(p *ProcessingParams) any { return &p.Blur }},
+	{Name: ParamSharpen, Type: ParamTypePacked, Parts: 3, AffectsCacheKey: true, Description: "Sharpen as sigma_flat_jagged",
+		field: func(p *ProcessingParams) any { return &p.Sharpen }, minParts: 1, validPart: isFloat},
+	{Name: ParamRotate, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Rotation in degrees",
+		field: func(p *ProcessingParams) any { return &p.Rotate }},
+	{Name: ParamFlip, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Flip vertically",
+		field: func(p *ProcessingParams) any { return &p.Flip }},
+	{Name: ParamFlop, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Flip horizontally",
+		field: func(p *ProcessingParams) any { return &p.Flop }},
+	{Name: ParamGrayscale, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Convert to grayscale",
+		field: func(p *ProcessingParams) any { return &p.Grayscale }},
+
+	{Name: ParamExtract, Type: ParamTypePacked, Parts: 4, AffectsCacheKey: true, Description: "Crop region as left_top_width_height, each in pixels or a percentage of the image such as 10p",
+		field: func(p *ProcessingParams) any { return &p.Extract }, minParts: 4, validPart: isLength},
+	{Name: ParamCrop, Type: ParamTypeSize, AffectsCacheKey: true, Description: "Crop of WIDTHxHEIGHT pixels around the center",
+		parse: parseCrop, encode: func(p *ProcessingParams) string {
+			if p.CropWidth == 0 && p.CropHeight == 0 {
+				return ""
+			}
+			return strconv.Itoa(p.CropWidth) + "x" + strconv.Itoa(p.CropHeight)
+		}},
+	{Name: ParamTrim, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Trim edges similar to the corner pixel within this threshold",
+		field: func(p *ProcessingParams) any { return &p.Trim }},
+	{Name: ParamExtend, Type: ParamTypePacked, Parts: 4, AffectsCacheKey: true, Description: "Border as top_right_bottom_left",
+		field: func(p *ProcessingParams) any { return &p.Extend }, minParts: 4, validPart: isInt},
+	{Name: ParamBorder, Type: ParamTypePacked, Parts: 2, AffectsCacheKey: true, Description: "Uniform border as width or width_color",
+		parse: parseBorder, encode: func(p *ProcessingParams) string {
+			if p.BorderWidth == 0 {
+				return ""
+			}
+			if p.BorderColor == "" {
+				return strconv.Itoa(p.BorderWidth)
+			}
+			return strconv.Itoa(p.BorderWidth) + "_" + strings.TrimPrefix(p.BorderColor, "#")
+		}},
+
+	{Name: ParamBackground, Aliases: []string{AliasBackground}, Type: ParamTypeColor, AffectsCacheKey: true, Description: "Color of new canvas areas",
+		field: func(p *ProcessingParams) any { return &p.Background }},
+	{Name: ParamNegate, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Invert colors",
+		field: func(p *ProcessingParams) any { return &p.Negate }},
+	{Name: ParamNormalize, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Stretch contrast to the full range",
+		field: func(p *ProcessingParams) any { return &p.Normalize }},
+	{Name: ParamThreshold, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Binarize at this level",
+		field: func(p *ProcessingParams) any { return &p.Threshold }},
+	{Name: ParamTint, Type: ParamTypeColor, AffectsCacheKey: true, Description: "Tint color",
+		field: func(p *ProcessingParams) any { return &p.Tint }},
+	{Name: ParamGamma, Type: ParamTypeFloat, AffectsCacheKey: true, Description: "Gamma correction",
+		field: func(p *ProcessingParams) any { return &p.Gamma }},
+	{Name: ParamMedian, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Median filter size",
+		field: func(p *ProcessingParams) any { return &p.Median }},
+	{Name: ParamModulate, Type: ParamTypePacked, Parts: 3, AffectsCacheKey: true, Description: "Modulate as brightness_saturation_hue",
+		field: func(p *ProcessingParams) any { return &p.Modulate }, minParts: 1, validPart: isFloat},
+	{Name: ParamFlatten, Type: ParamTypeBool, AffectsCacheKey: true, Description: "Remove the alpha channel onto the background",
+		field: func(p *ProcessingParams) any { return &p.Flatten }},
+	{Name: ParamDuotone, Type: ParamTypePacked, Parts: 2, AffectsCacheKey: true, Description: "Duotone as darkhex_lighthex",
+		field: func(p *ProcessingParams) any { return &p.Duotone }, minParts: 2, validPart: isColor},
+	{Name: ParamPosterize, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Levels per channel",
+		field: func(p *ProcessingParams) any { return &p.Posterize }},
+	{Name: ParamBrightness, Type: ParamTypeFloat, Range: between(0, maxColorFactor), AffectsCacheKey: true, Description: "Brightness multiplier, combined with modulate",
+		field: func(p *ProcessingParams) any { return &p.Brightness }},
+	{Name: ParamSaturation, Type: ParamTypeFloat, Range: between(0, maxColorFactor), AffectsCacheKey: true, Description: "Saturation multiplier, combined with modulate",
+		field: func(p *ProcessingParams) any { return &p.Saturation }},
+	{Name: ParamHue, Type: ParamTypeFloat, AffectsCacheKey: true, Description: "Hue rotation in degrees, added to modulate",
+		parse: func(pp *paramParser, p *ProcessingParams, raw string) {
+			p.Hue = normalizeHue(pp.toFloat(ParamHue, raw))
+		},
+		encode: func(p *ProcessingParams) string { return formatFloat(p.Hue) }},
+	{Name: ParamContrast, Type: ParamTypeFloat, Range: between(0, maxColorFactor), AffectsCacheKey: true, Description: "Contrast multiplier around mid-grey",
+		field: func(p *ProcessingParams) any { return &p.Contrast }},
+
+	{Name: ParamRadius, Type: ParamTypeString, AffectsCacheKey: true, Description: "Corner radius in pixels, or max for a circle",
+		field: func(p *ProcessingParams) any { return &p.Radius }},
+	{Name: ParamPixelate, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Pixelation block size in pixels",
+		field: func(p *ProcessingParams) any { return &p.Pixelate }},
+	{Name: ParamPixelateRegion, Type: ParamTypePacked, Parts: 4, AffectsCacheKey: true, Description: "Region to pixelate as left_top_width_height",
+		field: func(p *ProcessingParams) any { return &p.PixelateRegion }, minParts: 4, validPart: isInt},
+
+	{Name: ParamOrient, Type: ParamTypeBool, Default: "true", AffectsCacheKey: true, Description: "false keeps the EXIF orientation instead of turning the image upright before other operations",
+		parse: func(pp *paramParser, p *ProcessingParams, raw string) {
+			p.DisableOrient = !pp.toBool(ParamOrient, raw)
+		},
+		encode: func(p *ProcessingParams) string {
+			if p.DisableOrient {
+				return "false"
+			}
+			return ""
+		}},
+
+	{Name: ParamAnimated, Type: ParamTypeBool, Default: "true", AffectsCacheKey: true, Description: "false takes only the first frame of animated GIF and WebP sources",
+		parse: func(pp *paramParser, p *ProcessingParams, raw string) {
+			p.FirstFrame = !pp.toBool(ParamAnimated, raw)
+		},
+		encode: func(p *ProcessingParams) string {
+			if p.FirstFrame {
+				return "false"
+			}
+			return ""
+		}},
+
+	{Name: ParamFrame, Type: ParamTypeInt, Range: between(0, 100000), AffectsCacheKey: true, Description: "Only this frame of animated sources, from 0; past the last frame means the last",
+		parse: parseFrame, encode: func(p *ProcessingParams) string { return formatInt(p.Frame) }},
+
+	{Name: ParamPage, Type: ParamTypeInt, Range: between(0, 100000), Default: "0", AffectsCacheKey: true, Description: "Page of multi-page sources such as PDF and TIFF, from 0",
+		field: func(p *ProcessingParams) any { return &p.Page }},
+	{Name: ParamDensity, Type: ParamTypeInt, Range: between(1, 1200), Default: "72", AffectsCacheKey: true, Description: "Resolution in DPI for rasterizing PDF and SVG sources",
+		field: func(p *ProcessingParams) any { return &p.Density }},
+
+	{Name: ParamWatermark, Type: ParamTypeBool, Default: "true", AffectsCacheKey: true, Description: "false skips the watermark if the server allows it",
+		parse: func(pp *paramParser, p *ProcessingParams, raw string) {
+			p.DisableWatermark = !pp.toBool(ParamWatermark, raw)
+		},
+		encode: func(p *ProcessingParams) string {
+			if p.DisableWatermark {
+				return "false"
+			}
+			return ""
+		}},
+	{Name: ParamOverlay, Type: ParamTypeURL, AffectsCacheKey: true, Description: "URL of an image drawn over the result",
+		field: func(p *ProcessingParams) any { return &p.Overlay }},
+	{Name: ParamOverlayPos, Type: ParamTypeString, AffectsCacheKey: true, Description: "Overlay position as X_Y or a gravity",
+		field: func(p *ProcessingParams) any { return &p.OverlayPos }},
+	{Name: ParamOverlayWidth, Type: ParamTypeInt, AffectsCacheKey: true, Description: "Overlay width in pixels, up to the server's maximum dimension",
+		field: func(p *ProcessingParams) any { return &p.OverlayWidth }},
+
+	{Name: ParamFormat, Aliases: []string{AliasFormat}, Type: ParamTypeFormat, Values: []string{"jpeg", "jpg", "png", "gif", "webp", "avif", "heif", "heic", "tiff", "tif", "jxl"}, Default: "original", AffectsCacheKey: true, Description: "Output format",
+		parse: parseFormat, encode: func(p *ProcessingParams) string { return string(p.Format) }},
+}
+
+// paramsByName indexes paramSpecs by name and alias.
+var paramsByName = func() map[string]*ParamSpec {
+	m := make(map[string]*ParamSpec, 2*len(paramSpecs))
+	for i := range paramSpecs {
+		spec := &paramSpecs[i]
+		m[spec.Name] = spec
+		for _, alias := range spec.Aliases {
+			m[alias] = spec
+		}
+	}
+	return m
+}()
+
+// ListParams returns the specs of every query parameter in parsing order.
+func ListParams() []ParamSpec {
+	specs := make([]ParamSpec, len(paramSpecs))
+	for i, spec := range paramSpecs {
+		spec.Aliases = slices.Clone(spec.Aliases)
+		spec.Values = slices.Clone(spec.Values)
+		specs[i] = spec
+	}
+	return specs
+}
+
+// LookupParam returns the spec of a parameter by name or alias.
+func LookupParam(name string) (ParamSpec, bool) {
+	spec, ok := paramsByName[name]
+	if !ok {
+		return ParamSpec{}, false
+	}
+	return *spec, true
+}
+
+// value returns the parameter's value in q, preferring aliases over the full name.
+func (spec *ParamSpec) value(get func(string) string) string {
+	for _, alias := range spec.Aliases {
+		if v := get(alias); v != "" {
+			return v
+		}
+	}
+	return get(spec.Name)
+}
+
+// apply parses raw into p, recording rejected values in pp.
+func (spec *ParamSpec) apply(pp *paramParser, p *ProcessingParams, raw string) {
+	if spec.parse != nil {
+		spec.parse(pp, p, raw)
+		return
+	}
+	switch field := spec.field(p).(type) {
+	case *int:
+		if spec.Range != nil {
+			*field = pp.toIntInRange(spec.Name, raw, int(spec.Range.Min), int(spec.Range.Max))
+		} else {
+			*field = pp.toInt(spec.Name, raw)
+		}
+	case *float64:
+		v := pp.toFloat(spec.Name, raw)
+		if spec.Range != nil {
+			v = max(spec.Range.Min, min(v, spec.Range.Max))
+		}
+		*field = v
+	case *bool:
+		*field = pp.toBool(spec.Name, raw)
+	case *string:
+		switch spec.Type {
+		case ParamTypeColor:
+			if !isColor(raw) {
+				if !slices.ContainsFunc(append([]string{spec.Name}, spec.Aliases...), pp.rejected) { // not again when cut short
+					pp.add(spec.Name, raw, errColorSyntax.Error())
+				}
+				return
+			}
+			raw = normalizeHexColor(raw)
+		case ParamTypePacked:
+			if !pp.checkPacked(spec, raw) {
+				return
+			}
+		}
+		*field = raw
+	}
+}
+
+// format returns the query value of the parameter in p, or "" if it is unset.
+func (spec *ParamSpec) format(p *ProcessingParams) string {
+	if spec.encode != nil {
+		return spec.encode(p)
+	}
+	switch field := spec.field(p).(type) {
+	case *int:
+		return formatInt(*field)
+	case *float64:
+		return formatFloat(*field)
+	case *bool:
+		if *field {
+			return "true"
+		}
+	case *string:
+		return *field
+	}
+	return ""
+}
+
+func formatInt(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+func formatFloat(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// parseResize sets both dimensions from s=WIDTHxHEIGHT.
+func parseResize(pp *paramParser, p *ProcessingParams, raw string) {
+	parts := strings.SplitN(raw, "x", 3)
+	if len(parts) != 2 || !isInt(parts[0]) || !isInt(parts[1]) {
+		pp.add(ParamResize, raw, "expected WIDTHxHEIGHT")
+		return
+	}
+	p.Width = pp.toInt(ParamWidth, parts[0])
+	p.Height = pp.toInt(ParamHeight, parts[1])
+}
+
+// parseBorder accepts WIDTH or WIDTH_COLOR with a non-negative width.
+func parseBorder(pp *paramParser, p *ProcessingParams, raw string) {
+	parts := SplitPacked(raw, 2)
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width < 0 || len(parts) == 2 && !isColor(parts[1]) {
+		pp.add(ParamBorder, raw, "expected WIDTH or WIDTH_COLOR")
+		return
+	}
+	p.BorderWidth = width
+	if len(parts) == 2 {
+		p.BorderColor = normalizeHexColor(parts[1])
+	}
+}
+
+// parseCrop accepts WIDTHxHEIGHT with both positive.
+func parseCrop(pp *paramParser, p *ProcessingParams, raw string) {
+	width, height, ok := strings.Cut(raw, "x")
+	w, errW := strconv.Atoi(width)
+	h, errH := strconv.Atoi(height)
+	if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+		pp.add(ParamCrop, raw, "expected WIDTHxHEIGHT")
+		return
+	}
+	p.CropWidth, p.CropHeight = w, h
+}
+
+// parseQuality accepts 1-100, or auto to search for a quality under maxbytes.
+func parseQuality(pp *paramParser, p *ProcessingParams, raw string) {
+	if strings.EqualFold(raw, "auto") {
+		p.QualityAuto = true
+		return
+	}
+	v := pp.toInt(ParamQuality, raw)
+	if isInt(raw) && (v < 1 || v > 100) {
+		pp.add(ParamQuality, raw, "must be between 1 and 100")
+		return
+	}
+	p.Quality = v
+}
+
+// parseMaxBytes accepts a non-negative byte count.
+func parseMaxBytes(pp *paramParser, p *ProcessingParams, raw string) {
+	v := pp.toInt(ParamMaxBytes, raw)
+	if v < 0 {
+		pp.add(ParamMaxBytes, raw, "must not be negative")
+		return
+	}
+	p.MaxBytes = v
+}
+
+// parseKeep accepts one of the Keep keywords.
+func parseKeep(pp *paramParser, p *ProcessingParams, raw string) {
+	keep := strings.ToLower(raw)
+	switch keep {
+	case KeepNone, KeepEXIF, KeepICC, KeepAll:
+		p.Keep = keep
+	default:
+		pp.add(ParamKeep, raw, "expected none, exif, icc or all")
+	}
+}
+
+// parseTIFFCompression accepts lzw, deflate or none.
+func parseTIFFCompression(pp *paramParser, p *ProcessingParams, raw string) {
+	compression := strings.ToLower(raw)
+	switch compression {
+	case TIFFCompressionLZW, TIFFCompressionDeflate, TIFFCompressionNone:
+		p.TIFFCompression = compression
+	default:
+		pp.add(ParamTIFFCompression, raw, "expected lzw, deflate or none")
+	}
+}
+
+// parseProgressive accepts a boolean, kept as "true" or "false" so that unset
+// stays distinguishable.
+func parseProgressive(pp *paramParser, p *ProcessingParams, raw string) {
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		pp.add(ParamProgressive, raw, "not a boolean")
+		return
+	}
+	p.Progressive = strconv.FormatBool(v)
+}
+
+// parseSubsample accepts 444 or 420.
+func parseSubsample(pp *paramParser, p *ProcessingParams, raw string) {
+	switch raw {
+	case Subsample444, Subsample420:
+		p.Subsample = raw
+	default:
+		pp.add(ParamSubsample, raw, "expected 444 or 420")
+	}
+}
+
+// parseFrame accepts a frame number; frame=0 is the first frame, as animated=false.
+func parseFrame(pp *paramParser, p *ProcessingParams, raw string) {
+	p.Frame = pp.toIntInRange(ParamFrame, raw, 0, 100000)
+	if n, err := strconv.Atoi(raw); err == nil && n == 0 {
+		p.FirstFrame = true
+	}
+}
+
+// parsePlaceholder accepts blurhash.
+func parsePlaceholder(pp *paramParser, p *ProcessingParams, raw string) {
+	switch placeholder := strings.ToLower(raw); placeholder {
+	case PlaceholderBlurHash:
+		p.Placeholder = placeholder
+	default:
+		pp.add(ParamPlaceholder, raw, "expected blurhash")
+	}
+}
+
+// parseFormat records unknown formats rather than treating them as "keep original".
+func parseFormat(pp *paramParser, p *ProcessingParams, raw string) {
+	format, err := LookupFormat(raw)
+	if err != nil {
+		pp.add(ParamFormat, raw, "unknown format")
+		return
+	}
+	p.Format = format
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signing parameters. They authenticate a URL rather than describe processing,
+// so they aren't ProcessingParams fields and don't change the cache key.
+const (
+	ParamSignature = "sig"
+	ParamExpires   = "expires" // unix seconds after which the signature is refused
+)
+
+var (
+	// ErrSignatureInvalid rejects a missing, malformed or wrong signature.
+	ErrSignatureInvalid = errors.New("invalid signature")
+	// ErrSignatureExpired rejects a correct signature past its expires time.
+	ErrSignatureExpired = errors.New("signature expired")
+)
+
+// SignURL returns baseURL (e.g. "https://cdn.example.com/ipx/") with the query
+// for params, including params.URL, signed with secret:
+//
+//	link := core.SignURL(secret, "https://cdn.example.com/ipx/", &core.ProcessingParams{
+//		URL: "https://example.com/photo.jpg", Width: 400, Format: core.FormatWebP,
+//	})
+func SignURL(secret, baseURL string, params *ProcessingParams) string {
+	return signURL(secret, baseURL, params.Query())
+}
+
+// SignURLUntil is like SignURL but the signature is refused after expires.
+func SignURLUntil(secret, baseURL string, params *ProcessingParams, expires time.Time) string {
+	q := params.Query()
+	q.Set(ParamExpires, strconv.FormatInt(expires.Unix(), 10))
+	return signURL(secret, baseURL, q)
+}
+
+func signURL(secret, baseURL string, q url.Values) string {
+	q.Del(ParamSignature)
+	q.Set(ParamSignature, Signature(secret, q))
+	sep := "?"
+	if strings.Contains(baseURL, "?") {
+		sep = "&"
+	}
+	return baseURL + sep + q.Encode()
+}
+
+// Signature returns the signature of a query: the unpadded base64url HMAC-SHA256,
+// keyed with secret, of the query without sig, canonicalized by url.Values.Encode
+// (sorted by name, values escaped). The source URL and expires are part of it.
+func Signature(secret string, q url.Values) string {
+	unsigned := make(url.Values, len(q))
+	for name, values := range q {
+		if name != ParamSignature {
+			unsigned[name] = values
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature checks the sig of a query against each secret, so secrets can
+// be rotated by accepting the old and the new one for a while. It returns
+// ErrSignatureInvalid or ErrSignatureExpired.
+func VerifySignature(q url.Values, secrets []string, now time.Time) error {
+	sig := q.Get(ParamSignature)
+	if sig == "" {
+		return ErrSignatureInvalid
+	}
+	valid := false
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(sig), []byte(Signature(secret, q))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrSignatureInvalid
+	}
+	if raw := q.Get(ParamExpires); raw != "" {
+		expires, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return ErrSignatureInvalid
+		}
+		if now.Unix() > expires {
+			return ErrSignatureExpired
+		}
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package ipxpress
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures CORSMiddlewareWithConfig.
+type CORSConfig struct {
+	// AllowedOrigins are the origins allowed to read responses: exact origins
+	// such as "https://app.example.com", patterns with a wildcard for the
+	// subdomains, such as "https://*.example.com" (not the apex itself), or "*"
+	// for any origin.
+	AllowedOrigins []string
+
+	// AllowedHeaders are the request headers a preflight may ask for. Defaults
+	// to Content-Type.
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers scripts may read. Defaults to
+	// ETag and the X-IPX-* debug headers.
+	ExposedHeaders []string
+
+	// MaxAge is how long browsers may cache a preflight response; 0 leaves it to
+	// the browser.
+	MaxAge time.Duration
+
+	// AllowCredentials lets requests with cookies or HTTP authentication read
+	// responses. It can't be combined with the "*" origin.
+	AllowCredentials bool
+}
+
+// corsExposedHeaders are the default CORSConfig.ExposedHeaders.
+var corsExposedHeaders = []string{
+	"ETag",
+	"X-IPX-Alias-Of",
+	"X-IPX-Cache",
+	"X-IPX-Cache-TTL",
+	"X-IPX-Fetch-Ms",
+	"X-IPX-Height",
+	"X-IPX-Original-Bytes",
+	"X-IPX-Original-Format",
+	"X-IPX-Output-Bytes",
+	"X-IPX-Params",
+	"X-IPX-Process-Ms",
+	"X-IPX-Profile",
+	"X-IPX-Quality",
+	"X-IPX-TTL-Rule",
+	"X-IPX-Warning",
+	"X-IPX-Width",
+}
+
+// CORSMiddleware adds CORS headers to responses for allowedOrigins, see
+// CORSConfig.AllowedOrigins.
+func CORSMiddleware(allowedOrigins []string) MiddlewareFunc {
+	return CORSMiddlewareWithConfig(CORSConfig{AllowedOrigins: allowedOrigins})
+}
+
+// CORSMiddlewareWithConfig adds CORS headers to the responses for allowed
+// origins and answers their preflight requests with 204; preflights from other
+// origins get 403. Responses vary by Origin. It panics if AllowCredentials is
+// set with the "*" origin, which browsers refuse.
+func CORSMiddlewareWithConfig(config CORSConfig) MiddlewareFunc {
+	for _, origin := range config.AllowedOrigins {
+		if origin == "*" && config.AllowCredentials {
+			panic(fmt.Sprintf("invalid ipxpress CORS config: AllowCredentials with origin %q", origin))
+		}
+	}
+	allowedHeaders := config.AllowedHeaders
+	if allowedHeaders == nil {
+		allowedHeaders = []string{"Content-Type"}
+	}
+	exposedHeaders := config.ExposedHeaders
+	if exposedHeaders == nil {
+		exposedHeaders = corsExposedHeaders
+	}
+	allowHeaders := strings.Join(allowedHeaders, ", ")
+	exposeHeaders := strings.Join(exposedHeaders, ", ")
+	maxAge := ""
+	if config.MaxAge > 0 {
+		maxAge = strconv.Itoa(int(config.MaxAge / time.Second))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := w.Header()
+			header.Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+			if origin == "" || !originAllowed(config.AllowedOrigins, origin) {
+				if preflight {
+					http.Error(w, fmt.Sprintf("origin %q is not allowed", origin), http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header.Set("Access-Control-Allow-Origin", origin)
+			if config.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				if exposeHeaders != "" {
+					header.Set("Access-Control-Expose-Headers", exposeHeaders)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header.Set("Access-Control-Allow-Methods", allowedMethods)
+			if allowHeaders != "" {
+				header.Set("Access-Control-Allow-Headers", allowHeaders)
+			}
+			if maxAge != "" {
+				header.Set("Access-Control-Max-Age", maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// originAllowed reports whether origin matches one of allowed, see
+// CORSConfig.AllowedOrigins.
+func originAllowed(allowed []string, origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if !ok || !strings.HasSuffix(prefix, "://") || !strings.HasPrefix(suffix, ".") {
+			continue
+		}
+		if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			if sub := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(sub, "/:@") {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package ipxpress
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/maypok86/otter"
+)
+
+// originIndexSize bounds the number of derivatives remembered by the origin index.
+const originIndexSize = 100_000
+
+// originIndex maps a derivative's content key (a hash of the original bytes plus the
+// resolved params) to the cache key of the entry holding it, so byte-identical sources
+// behind different URLs (CDN mirrors, copied assets) are processed only once.
+//
+// The index only points into the cache and never keeps data alive: aliases are
+// stored as independent entries, so purging or evicting either URL leaves the other
+// intact, and an index entry whose target is gone is simply a miss.
+type originIndex struct {
+	keys otter.Cache[string, string]
+}
+
+func newOriginIndex() *originIndex {
+	keys, err := otter.MustBuilder[string, string](originIndexSize).Build()
+	if err != nil {
+		panic(fmt.Sprintf("failed to build origin index: %v", err))
+	}
+	return &originIndex{keys: keys}
+}
+
+// contentKey returns the key of params applied to the given original, whatever its URL.
+func contentKey(imageData []byte, params *ProcessingParams) string {
+	sum := sha256.Sum256(imageData)
+	p := *params
+	p.URL = "sha256:" + hex.EncodeToString(sum[:])
+	return GenerateCacheKey(&p)
+}
+
+// add records that the derivative with contentKey is cached under cacheKey.
+func (x *originIndex) add(contentKey, cacheKey string) {
+	x.keys.Set(contentKey, cacheKey)
+}
+
+// alias returns a copy of the successful entry cached for contentKey under another
+// key, or nil if there is none.
+func (x *originIndex) alias(cache Cache, contentKey, cacheKey string) *CacheEntry {
+	canonical, ok := x.keys.Get(contentKey)
+	if !ok || canonical == cacheKey {
+		return nil
+	}
+	src, ok := cache.Get(canonical)
+	if !ok || src.StatusCode != http.StatusOK {
+		x.keys.Delete(contentKey)
+		return nil
+	}
+	data, err := src.Bytes()
+	if err != nil {
+		return nil
+	}
+	return &CacheEntry{
+		ContentType: src.ContentType,
+		Data:        data,
+		StatusCode:  src.StatusCode,
+		ETag:        src.ETag,
+		Quality:     src.Quality,
+		AliasOf:     canonical,
+
+		OriginalBytes:  src.OriginalBytes,
+		OriginalFormat: src.OriginalFormat,
+	}
+}
+
+func (x *originIndex) close() {
+	x.keys.Close()
+}
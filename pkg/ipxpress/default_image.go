@@ -0,0 +1,104 @@
+package ipxpress
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// DefaultImageMode controls what happens when the url parameter is structurally invalid.
+type DefaultImageMode string
+
+const (
+	// DefaultImageOff answers 400 (the default).
+	DefaultImageOff DefaultImageMode = "off"
+
+	// DefaultImageRedirect answers 302 to the same request with url replaced by
+	// Config.DefaultImage, which must be an http(s) URL on an allowed host.
+	DefaultImageRedirect DefaultImageMode = "redirect"
+
+	// DefaultImageServe processes Config.DefaultImage (a URL or local file)
+	// with the requested parameters instead.
+	DefaultImageServe DefaultImageMode = "serve"
+)
+
+// isRemoteImage reports whether a DefaultImage value is a URL rather than a file path.
+func isRemoteImage(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// loadDefaultImage reads a local Config.DefaultImage once at startup.
+func (h *Handler) loadDefaultImage() {
+	if h.config.DefaultImageMode != DefaultImageServe || h.config.DefaultImage == "" || isRemoteImage(h.config.DefaultImage) {
+		return
+	}
+	data, err := os.ReadFile(h.config.DefaultImage)
+	if err != nil {
+		h.log().Error("failed to read default image", "path", h.config.DefaultImage, "error", err)
+		return
+	}
+	h.defaultImage = data
+}
+
+// signingSecret returns the secret among secrets that q is signed with, or the
+// first if none is.
+func signingSecret(q url.Values, secrets []string) string {
+	sig := q.Get(core.ParamSignature)
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(sig), []byte(core.Signature(secret, q))) {
+			return secret
+		}
+	}
+	return secrets[0]
+}
+
+// applyDefaultImage handles a structurally invalid source URL according to
+// Config.DefaultImageMode. It returns handled=true if a response was written, and
+// local=true if params.URL now refers to the in-memory local default image.
+// Origin failures (404, timeouts, ...) never reach here.
+func (h *Handler) applyDefaultImage(w http.ResponseWriter, r *http.Request, params *ProcessingParams) (handled, local bool) {
+	mode, target := h.config.DefaultImageMode, h.config.DefaultImage
+	if target == "" || params.URL == "" || params.URL == target {
+		return false, false
+	}
+	if _, err := validateImageURL(params.URL); err == nil {
+		return false, false
+	}
+
+	switch mode {
+	case DefaultImageRedirect:
+		u, err := validateImageURL(target)
+		if err != nil || !h.fetcher.HostAllowed(u.Hostname()) {
+			h.log().Warn("default image redirect target rejected", "target", target)
+			return false, false
+		}
+		// A query-only Location resolves against the path the client used,
+		// so it works wherever the handler is mounted.
+		q := r.URL.Query()
+		q.Set("url", target)
+		if secrets := h.config.SignatureSecrets; len(secrets) > 0 {
+			// The request's signature covered the broken url; the redirect carries
+			// one for the new query, with the secret that signed the request
+			q.Set(core.ParamSignature, core.Signature(signingSecret(r.URL.Query(), secrets), q))
+		}
+		w.Header().Set("Location", "?"+q.Encode())
+		w.WriteHeader(http.StatusFound)
+		return true, false
+
+	case DefaultImageServe:
+		if isRemoteImage(target) {
+			params.URL = target
+			return false, false
+		}
+		if h.defaultImage != nil {
+			params.URL = target
+			return false, true
+		}
+	}
+
+	return false, false
+}
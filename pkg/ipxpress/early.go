@@ -0,0 +1,206 @@
+package ipxpress
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errEarlyFailed is returned for writes of a response that failed after its
+// headers went out early.
+var errEarlyFailed = errors.New("response failed after its headers were sent")
+
+// sendEarlyHints sends Config.EarlyHints in a 103 Early Hints response. The Link
+// headers are repeated in the final response.
+func (h *Handler) sendEarlyHints(w http.ResponseWriter) {
+	if len(h.config.EarlyHints) == 0 {
+		return
+	}
+	for _, link := range h.config.EarlyHints {
+		w.Header().Add("Link", link)
+	}
+	w.WriteHeader(http.StatusEarlyHints)
+}
+
+// serveMissGuarded is serveMiss with Config.EarlyHeadersAfter and
+// ResponseHeaderDeadline: the miss is served from another goroutine while this
+// one sends early headers or a 504 if it takes too long.
+func (h *Handler) serveMissGuarded(w http.ResponseWriter, r *http.Request, params *ProcessingParams, cacheKey string, localDefault bool) {
+	g := &guardedWriter{w: w, header: w.Header().Clone()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if v := recover(); v != nil {
+				logPanic(h.log(), v, "method", r.Method, "url", r.URL.String())
+				http.Error(g, errPanic, http.StatusInternalServerError)
+			}
+		}()
+		h.serveMiss(g, r, params, cacheKey, localDefault)
+	}()
+
+	var early, deadline <-chan time.Time
+	if d := h.config.EarlyHeadersAfter; d > 0 && h.knownResult(r, params) {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		early = t.C
+	}
+	if d := h.config.ResponseHeaderDeadline; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		select {
+		case <-done:
+			if g.failedEarly() {
+				// The client has a 200 already; a broken connection is the only way left to say it failed
+				h.log().Warn("response failed after early headers", "url", params.URL)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		case <-early:
+			early = nil
+			g.sendEarly(params.Format.ContentType(), func(w http.ResponseWriter) {
+				w.Header().Set("Content-Disposition", "inline")
+				h.setCacheControl(w, nil)
+			})
+		case <-deadline:
+			deadline = nil
+			if g.timeout() {
+				h.log().Warn("response header deadline exceeded", "url", params.URL, "deadline", h.config.ResponseHeaderDeadline)
+				return
+			}
+		}
+	}
+}
+
+// knownResult reports whether the response to r is known to be a 200 in
+// params.Format if it succeeds, so its headers may be sent before it's ready.
+func (h *Handler) knownResult(r *http.Request, params *ProcessingParams) bool {
+	return params.Format != "" && !params.Info && params.Placeholder == "" &&
+		r.Header.Get("If-None-Match") == "" && r.Header.Get("Range") == "" &&
+		len(h.preProcessors) == 0 && len(h.encoders) == 0
+}
+
+// guardedWriter is the ResponseWriter of a miss served by one goroutine while
+// another may send early headers or a 504 in its place. Whichever writes the
+// status first wins: after a 504 the serving goroutine's writes are dropped,
+// and after early headers only its body goes through.
+type guardedWriter struct {
+	w      http.ResponseWriter
+	header http.Header // the serving goroutine's, copied to w when it writes the status
+
+	mu       sync.Mutex
+	wrote    bool   // the status went out
+	early    bool   // by sendEarly
+	final    bool   // the serving goroutine wrote its status
+	failed   bool   // which didn't match the early one
+	timedOut bool   // a 504 went out
+	earlyCT  string // the Content-Type sent early
+}
+
+// Header implements http.ResponseWriter.
+func (g *guardedWriter) Header() http.Header {
+	return g.header
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (g *guardedWriter) WriteHeader(code int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(code)
+}
+
+func (g *guardedWriter) writeHeader(code int) {
+	if g.timedOut || g.final {
+		return
+	}
+	if code >= 100 && code < 200 {
+		if !g.wrote {
+			copyHeader(g.w.Header(), g.header)
+			g.w.WriteHeader(code)
+		}
+		return
+	}
+	g.final = true
+	if g.wrote {
+		g.failed = code != http.StatusOK || g.header.Get("Content-Type") != g.earlyCT
+		return
+	}
+	copyHeader(g.w.Header(), g.header)
+	g.w.WriteHeader(code)
+	g.wrote = true
+}
+
+// Write implements http.ResponseWriter.
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !g.final {
+		g.writeHeader(http.StatusOK)
+	}
+	if g.failed {
+		return 0, errEarlyFailed
+	}
+	return g.w.Write(p)
+}
+
+// Flush implements http.Flusher.
+func (g *guardedWriter) Flush() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.timedOut || g.failed {
+		return
+	}
+	if !g.final {
+		g.writeHeader(http.StatusOK)
+	}
+	http.NewResponseController(g.w).Flush()
+}
+
+// sendEarly sends a 200 with contentType and the headers set by prepare, and
+// flushes it, unless a status went out already.
+func (g *guardedWriter) sendEarly(contentType string, prepare func(http.ResponseWriter)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.wrote || g.timedOut {
+		return
+	}
+	g.w.Header().Set("Content-Type", contentType)
+	prepare(g.w)
+	g.w.WriteHeader(http.StatusOK)
+	http.NewResponseController(g.w).Flush()
+	g.wrote, g.early, g.earlyCT = true, true, contentType
+}
+
+// timeout answers with 504 unless a status went out already, and reports
+// whether it did.
+func (g *guardedWriter) timeout() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.wrote {
+		return false
+	}
+	g.timedOut = true
+	http.Error(g.w, "timed out waiting for the image", http.StatusGatewayTimeout)
+	return true
+}
+
+// failedEarly reports whether the response failed after early headers.
+func (g *guardedWriter) failedEarly() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.early && (g.failed || !g.final)
+}
+
+// copyHeader replaces the values of dst with those of src.
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
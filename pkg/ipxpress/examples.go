@@ -2,24 +2,16 @@ package ipxpress
 
 import (
 	"net/http"
-	"strings"
 )
 
 // Example custom processors and middlewares for extending IPXpress
 
-// WatermarkProcessor adds a watermark to images.
-// Example usage:
-//
-//	handler.UseProcessor(WatermarkProcessor("watermark.png"))
-func WatermarkProcessor(watermarkPath string) ProcessorFunc {
-	return func(proc *Processor, params *ProcessingParams) *Processor {
-		// Check if watermark is requested via custom parameter
-		// You can add custom query params like ?watermark=true
-		return proc // Implement watermark logic here
-	}
-}
-
 // AutoOrientProcessor automatically orients images based on EXIF data.
+//
+// Deprecated: processors run after the built-in operations, so portrait photos
+// were resized in the wrong orientation before being turned. The Handler orients
+// images first unless Config.DisableAutoOrient is set, and then this processor
+// does nothing.
 func AutoOrientProcessor() ProcessorFunc {
 	return func(proc *Processor, params *ProcessingParams) *Processor {
 		if proc.img != nil {
@@ -29,10 +21,12 @@ func AutoOrientProcessor() ProcessorFunc {
 	}
 }
 
-// StripMetadataProcessor removes all metadata from images for privacy.
+// StripMetadataProcessor removes all metadata from images for privacy, unless
+// the request asks to keep some with keep=.
 func StripMetadataProcessor() ProcessorFunc {
 	return func(proc *Processor, params *ProcessingParams) *Processor {
-		if proc.img != nil {
+		keep := params.KeepMetadata("")
+		if proc.img != nil && (keep == "" || keep == KeepNone) {
 			_ = proc.img.RemoveMetadata()
 		}
 		return proc
@@ -55,27 +49,6 @@ func CompressionOptimizer() ProcessorFunc {
 	}
 }
 
-// CORSMiddleware adds CORS headers to responses.
-func CORSMiddleware(allowedOrigins []string) MiddlewareFunc {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			origin := r.Header.Get("Origin")
-			if origin != "" && contains(allowedOrigins, origin) {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-			}
-
-			if r.Method == "OPTIONS" {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
 // LoggingMiddleware logs all requests.
 func LoggingMiddleware(logger func(string, ...interface{})) MiddlewareFunc {
 	return func(next http.Handler) http.Handler {
@@ -86,45 +59,8 @@ func LoggingMiddleware(logger func(string, ...interface{})) MiddlewareFunc {
 	}
 }
 
-// RateLimitMiddleware limits requests per client.
-func RateLimitMiddleware(maxRequests int) MiddlewareFunc {
-	// Simple rate limiter - in production use a proper rate limiting library
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Implement rate limiting logic here
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
-// AuthMiddleware validates API keys or tokens.
-func AuthMiddleware(validTokens []string) MiddlewareFunc {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			token := r.Header.Get("Authorization")
-			token = strings.TrimPrefix(token, "Bearer ")
-
-			if !contains(validTokens, token) {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
 // Helper functions
 
-func contains(slice []string, item string) bool {
-	for _, s := range slice {
-		if s == item || s == "*" {
-			return true
-		}
-	}
-	return false
-}
-
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,135 @@
+package ipxpress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// FetchErrorKind classifies why fetching a source failed, see FetchError.
+type FetchErrorKind string
+
+// Kinds of FetchError. Each has a sentinel error for errors.Is, e.g.
+// errors.Is(err, ErrFetchTimeout) for ErrKindTimeout.
+const (
+	ErrKindInvalidURL  FetchErrorKind = "invalid_url"  // missing, malformed or not http(s)
+	ErrKindBlockedHost FetchErrorKind = "blocked_host" // host not in AllowedHosts
+	ErrKindDNS         FetchErrorKind = "dns"          // the host name didn't resolve
+	ErrKindNetwork     FetchErrorKind = "network"      // connection refused, reset or broken mid-body
+	ErrKindTimeout     FetchErrorKind = "timeout"      // the origin didn't answer in time
+	ErrKindCanceled    FetchErrorKind = "canceled"     // the request's context was canceled
+	ErrKindStatus      FetchErrorKind = "status"       // the origin answered with an error status
+	ErrKindTooLarge    FetchErrorKind = "too_large"    // the body alone exceeds the memory budget
+	ErrKindBusy        FetchErrorKind = "busy"         // gave up waiting for a fetch slot, the host's limits or memory
+	ErrKindRange       FetchErrorKind = "range"        // a Range the source can't be served in
+)
+
+// Sentinel errors matching the FetchErrors of each kind with errors.Is.
+var (
+	ErrFetchInvalidURL  = errors.New("invalid image URL")
+	ErrFetchBlockedHost = errors.New("host not allowed")
+	ErrFetchDNS         = errors.New("origin host not found")
+	ErrFetchNetwork     = errors.New("origin connection failed")
+	ErrFetchTimeout     = errors.New("origin timed out")
+	ErrFetchCanceled    = errors.New("fetch canceled")
+	ErrFetchStatus      = errors.New("origin returned an error status")
+	ErrFetchTooLarge    = errors.New("source too large")
+	ErrFetchBusy        = errors.New("fetch capacity exhausted")
+	ErrFetchRange       = errors.New("range not satisfiable")
+)
+
+var fetchSentinels = map[FetchErrorKind]error{
+	ErrKindInvalidURL:  ErrFetchInvalidURL,
+	ErrKindBlockedHost: ErrFetchBlockedHost,
+	ErrKindDNS:         ErrFetchDNS,
+	ErrKindNetwork:     ErrFetchNetwork,
+	ErrKindTimeout:     ErrFetchTimeout,
+	ErrKindCanceled:    ErrFetchCanceled,
+	ErrKindStatus:      ErrFetchStatus,
+	ErrKindTooLarge:    ErrFetchTooLarge,
+	ErrKindBusy:        ErrFetchBusy,
+	ErrKindRange:       ErrFetchRange,
+}
+
+// FetchError represents an error during image fetching.
+type FetchError struct {
+	// Kind classifies the failure. Fetchers other than the built-in one may
+	// leave it empty, in which case StatusCode is answered as is.
+	Kind FetchErrorKind
+
+	// StatusCode is the origin's status for ErrKindStatus, otherwise the
+	// status to answer with; see ResponseStatus.
+	StatusCode int
+	Message    string
+
+	// RetryAfter is the Retry-After header of the origin's response, for
+	// ErrKindStatus. The handler forwards it with a 429.
+	RetryAfter string
+
+	// Err is the underlying error, if any, e.g. a *net.DNSError or
+	// context.DeadlineExceeded.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *FetchError) Error() string {
+	return e.Message
+}
+
+// Unwrap returns the underlying error.
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error of e's kind.
+func (e *FetchError) Is(target error) bool {
+	sentinel, ok := fetchSentinels[e.Kind]
+	return ok && target == sentinel
+}
+
+// ResponseStatus returns the status a Handler answers with: an origin's 4xx is
+// passed on and any other status it failed with becomes 502 Bad Gateway, while
+// the other kinds carry theirs in StatusCode (504 for timeouts, 502 for DNS
+// and network failures).
+func (e *FetchError) ResponseStatus() int {
+	if e.Kind == ErrKindStatus && (e.StatusCode < 400 || e.StatusCode >= 500) {
+		return http.StatusBadGateway
+	}
+	return e.StatusCode
+}
+
+// originFailure reports whether e is a failure of the origin or the way to it
+// that may recover, rather than of the request or this server's limits.
+func (e *FetchError) originFailure() bool {
+	switch e.Kind {
+	case ErrKindStatus:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode < 400 || e.StatusCode >= 500
+	case ErrKindTimeout, ErrKindDNS, ErrKindNetwork:
+		return true
+	}
+	return false
+}
+
+// transportError classifies err, which sending a request or reading its body
+// failed with, as a timeout, cancellation, DNS or network failure.
+func transportError(err error, format string, args ...any) *FetchError {
+	fetchErr := &FetchError{
+		Kind:       ErrKindNetwork,
+		StatusCode: http.StatusBadGateway,
+		Message:    fmt.Sprintf(format, args...),
+		Err:        err,
+	}
+	var ne net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout():
+		fetchErr.Kind, fetchErr.StatusCode = ErrKindTimeout, http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		fetchErr.Kind, fetchErr.StatusCode = ErrKindCanceled, http.StatusServiceUnavailable
+	case errors.As(err, &dnsErr):
+		fetchErr.Kind = ErrKindDNS
+	}
+	return fetchErr
+}
@@ -0,0 +1,62 @@
+package ipxpress
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fetchLimiter bounds concurrent origin fetches, see Config.FetchLimit.
+type fetchLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+
+	waiting, rejected atomic.Int64
+}
+
+// newFetchLimiter applies the defaults of Config.FetchLimit and FetchQueueTimeout.
+func newFetchLimiter(config *Config) *fetchLimiter {
+	limit := config.FetchLimit
+	if limit <= 0 {
+		limit = 2 * config.ProcessingLimit
+	}
+	timeout := config.FetchQueueTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &fetchLimiter{slots: make(chan struct{}, limit), timeout: timeout}
+}
+
+// acquire waits for a fetch slot until the queue timeout or ctx is done, which
+// fails with a 503 FetchError. release may be called more than once.
+func (l *fetchLimiter) acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		l.waiting.Add(1)
+		defer l.waiting.Add(-1)
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			l.rejected.Add(1)
+			return func() {}, &FetchError{
+				Kind:       ErrKindBusy,
+				StatusCode: http.StatusServiceUnavailable,
+				Message:    fmt.Sprintf("too many origin fetches in flight, waited %s", l.timeout),
+			}
+		case <-ctx.Done():
+			return func() {}, &FetchError{
+				Kind:       ErrKindBusy,
+				StatusCode: http.StatusServiceUnavailable,
+				Message:    fmt.Sprintf("waiting for an origin fetch slot: %v", ctx.Err()),
+				Err:        ctx.Err(),
+			}
+		}
+	}
+	return sync.OnceFunc(func() { <-l.slots }), nil
+}
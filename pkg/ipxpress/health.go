@@ -0,0 +1,204 @@
+package ipxpress
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyTimeout bounds the checks of the /ready endpoint.
+const readyTimeout = 5 * time.Second
+
+// Pinger is implemented by caches whose backend can be unavailable, such as a
+// network store, for Handler.Ready. Like Enumerable it's optional; caches
+// without it are taken to be always available.
+type Pinger interface {
+	// Ping returns an error if the backend can't serve requests.
+	Ping(ctx context.Context) error
+}
+
+// ReadinessError reports the checks of Handler.Ready that failed, by name:
+// "vips", "cache", "canary" or "shutdown".
+type ReadinessError struct {
+	Failed map[string]error
+}
+
+// Error implements the error interface.
+func (e *ReadinessError) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + ": " + e.Failed[name].Error()
+	}
+	return "not ready: " + strings.Join(parts, "; ")
+}
+
+// Unwrap returns the errors of the failed checks.
+func (e *ReadinessError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, err := range e.Failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// readyChecks are the checks of Handler.Ready, by name.
+func (h *Handler) readyChecks() map[string]func(context.Context) error {
+	checks := map[string]func(context.Context) error{
+		"vips":     checkVips,
+		"shutdown": h.checkShutdown,
+	}
+	if pinger, ok := h.cache.(Pinger); ok {
+		checks["cache"] = pinger.Ping
+	}
+	if h.config.ReadinessCanaryURL != "" {
+		checks["canary"] = h.checkCanary
+	}
+	return checks
+}
+
+// Ready reports whether the handler can serve images: libvips encodes a 1x1
+// image, the cache backend answers if the cache is a Pinger, the source at
+// Config.ReadinessCanaryURL can be fetched if set, and Shutdown hasn't been
+// called. The checks run concurrently; if any fails, the error is a
+// *ReadinessError. Health serves it as /ready; to wire your own endpoint:
+//
+//	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+//		if err := handler.Ready(r.Context()); err != nil {
+//			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+//		}
+//	})
+func (h *Handler) Ready(ctx context.Context) error {
+	checks := h.readyChecks()
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed = make(map[string]error)
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runCheck(ctx, check); err != nil {
+				mu.Lock()
+				failed[name] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return &ReadinessError{Failed: failed}
+	}
+	return nil
+}
+
+// runCheck runs check, turning a panic, such as libvips failing to start, into
+// an error.
+func runCheck(ctx context.Context, check func(context.Context) error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return check(ctx)
+}
+
+// readyImage is the 1x1 PNG libvips decodes and encodes to show it works.
+var readyImage = func() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	return buf.Bytes()
+}()
+
+func checkVips(ctx context.Context) error {
+	out, err := New().WithContext(ctx).FromBytes(readyImage).ToBytes(FormatPNG, 85)
+	if err != nil {
+		return err
+	}
+	if len(out) == 0 {
+		return errors.New("encoded an empty image")
+	}
+	return nil
+}
+
+func (h *Handler) checkShutdown(context.Context) error {
+	if h.shuttingDown.Load() {
+		return errors.New("handler is shutting down")
+	}
+	return nil
+}
+
+func (h *Handler) checkCanary(ctx context.Context) error {
+	data, release, err := h.fetcher.FetchReserved(ctx, h.config.ReadinessCanaryURL)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if DetectFormat(data) == "" {
+		return errors.New("canary source is not an image")
+	}
+	return nil
+}
+
+// Health returns a handler for load balancer and orchestrator probes:
+//
+//	GET /live   200 while the process runs
+//	GET /ready  200 if Ready passes, else 503; both with the result of each check as JSON
+//
+// Mount it under a prefix with http.StripPrefix:
+//
+//	mux.Handle("/health/", http.StripPrefix("/health", handler.Health()))
+func (h *Handler) Health() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /live", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("GET /ready", h.serveReady)
+	return mux
+}
+
+// readyReport is the JSON body of /ready.
+type readyReport struct {
+	Status string            `json:"status"` // "ready" or "not ready"
+	Checks map[string]string `json:"checks"` // "ok" or the error, by check
+}
+
+func (h *Handler) serveReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	err := h.Ready(ctx)
+
+	report := readyReport{Status: "ready", Checks: make(map[string]string)}
+	for name := range h.readyChecks() {
+		report.Checks[name] = "ok"
+	}
+	status := http.StatusOK
+	var notReady *ReadinessError
+	if errors.As(err, &notReady) {
+		report.Status = "not ready"
+		for name, err := range notReady.Failed {
+			report.Checks[name] = err.Error()
+		}
+		status = http.StatusServiceUnavailable
+		h.log().Warn("not ready", "error", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,214 @@
+package ipxpress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// maxIdleHosts is how many origin hosts hostLimits remembers before it forgets
+// the idle ones.
+const maxIdleHosts = 256
+
+// hostLimits keeps a Fetcher polite to each origin host, see
+// FetcherConfig.MaxConcurrentPerHost and RateLimitPerHost. It counts the
+// requests in flight per host with or without limits.
+type hostLimits struct {
+	concurrent int64
+	rate       float64 // requests per second, 0 for no limit
+	burst      float64
+	timeout    time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostLimit
+}
+
+// hostLimit is the state of one origin host.
+type hostLimit struct {
+	slots    *semaphore.Weighted // nil without MaxConcurrentPerHost
+	refs     int                 // requests holding or waiting for this entry
+	inFlight int
+
+	// The token bucket of RateLimitPerHost
+	tokens float64
+	last   time.Time
+}
+
+// newHostLimits applies the defaults of FetcherConfig's per-host limits.
+func newHostLimits(config *FetcherConfig) *hostLimits {
+	return &hostLimits{
+		concurrent: int64(max(config.MaxConcurrentPerHost, 0)),
+		rate:       max(config.RateLimitPerHost, 0),
+		burst:      max(math.Floor(config.RateLimitPerHost), 1),
+		timeout:    config.HostQueueTimeout,
+		hosts:      make(map[string]*hostLimit),
+	}
+}
+
+// entry returns the state of host, counting a reference to it. The caller
+// holds l.mu and must call unref.
+func (l *hostLimits) entry(host string) *hostLimit {
+	e, ok := l.hosts[host]
+	if !ok {
+		if len(l.hosts) >= maxIdleHosts {
+			l.forgetIdle(time.Now())
+		}
+		e = &hostLimit{tokens: l.burst, last: time.Now()}
+		if l.concurrent > 0 {
+			e.slots = semaphore.NewWeighted(l.concurrent)
+		}
+		l.hosts[host] = e
+	}
+	e.refs++
+	return e
+}
+
+// unref drops a reference to the state of host, forgetting it once unused
+// unless its rate limit still has to be remembered. The caller holds l.mu.
+func (l *hostLimits) unref(host string, e *hostLimit) {
+	e.refs--
+	if e.refs == 0 && l.rate == 0 {
+		delete(l.hosts, host)
+	}
+}
+
+// forgetIdle forgets hosts nobody is using whose token bucket is full again,
+// so they'd start over the same. The caller holds l.mu.
+func (l *hostLimits) forgetIdle(now time.Time) {
+	maps.DeleteFunc(l.hosts, func(_ string, e *hostLimit) bool {
+		return e.refs == 0 && e.tokens+now.Sub(e.last).Seconds()*l.rate >= l.burst
+	})
+}
+
+// waitContext bounds ctx by the queue timeout, if any.
+func (l *hostLimits) waitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.timeout > 0 {
+		return context.WithTimeout(ctx, l.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// hostBusy is the error of a request that gave up waiting for host's limit,
+// because of the queue timeout unless ctx is done.
+func (l *hostLimits) hostBusy(ctx context.Context, host, limit string) *FetchError {
+	busy := &FetchError{
+		Kind:       ErrKindBusy,
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    fmt.Sprintf("%s of %s reached, waited %s", limit, host, l.timeout),
+	}
+	if err := ctx.Err(); err != nil {
+		busy.Message = fmt.Sprintf("waiting for the %s of %s: %v", limit, host, err)
+		busy.Err = err
+	}
+	return busy
+}
+
+// acquire waits for one of host's MaxConcurrentPerHost slots until the queue
+// timeout or ctx is done, which fails with a 503 FetchError, and counts the
+// request in flight until release. release may be called more than once.
+func (l *hostLimits) acquire(ctx context.Context, host string) (release func(), err error) {
+	l.mu.Lock()
+	e := l.entry(host)
+	l.mu.Unlock()
+	if e.slots != nil && !e.slots.TryAcquire(1) {
+		wait, cancel := l.waitContext(ctx)
+		err := e.slots.Acquire(wait, 1)
+		cancel()
+		if err != nil {
+			l.mu.Lock()
+			l.unref(host, e)
+			l.mu.Unlock()
+			return func() {}, l.hostBusy(ctx, host, "concurrency limit")
+		}
+	}
+	l.mu.Lock()
+	e.inFlight++
+	l.mu.Unlock()
+	return sync.OnceFunc(func() {
+		if e.slots != nil {
+			e.slots.Release(1)
+		}
+		l.mu.Lock()
+		e.inFlight--
+		l.unref(host, e)
+		l.mu.Unlock()
+	}), nil
+}
+
+// throttle waits for host's RateLimitPerHost to allow another request, until
+// the queue timeout or ctx is done, which fails with a 503 FetchError.
+func (l *hostLimits) throttle(ctx context.Context, host string) error {
+	if l.rate == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	e := l.entry(host)
+	defer func() {
+		l.mu.Lock()
+		l.unref(host, e)
+		l.mu.Unlock()
+	}()
+	now := time.Now()
+	e.tokens = math.Min(e.tokens+now.Sub(e.last).Seconds()*l.rate, l.burst)
+	e.last = now
+	// Take the token now; a request that has to wait for it is next in line
+	e.tokens--
+	delay := time.Duration(-e.tokens / l.rate * float64(time.Second))
+	if delay > 0 && l.timeout > 0 && delay > l.timeout {
+		// No point waiting for a turn past the timeout
+		e.tokens++
+		l.mu.Unlock()
+		return l.hostBusy(ctx, host, "rate limit")
+	}
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	wait, cancel := l.waitContext(ctx)
+	defer cancel()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-wait.Done():
+		// Give the token back for the requests queued after this one
+		l.mu.Lock()
+		e.tokens++
+		l.mu.Unlock()
+		return l.hostBusy(ctx, host, "rate limit")
+	}
+}
+
+// inFlight returns the requests in flight per host, for hosts with any.
+func (l *hostLimits) inFlight() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := make(map[string]int)
+	for host, e := range l.hosts {
+		if e.inFlight > 0 {
+			counts[host] = e.inFlight
+		}
+	}
+	return counts
+}
+
+// releaseOnClose is a response body that releases the host's slot once closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
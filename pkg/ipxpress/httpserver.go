@@ -0,0 +1,99 @@
+package ipxpress
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ServerOptions configures the http.Server returned by NewServer. Zero
+// durations and sizes keep net/http's defaults, which don't time out at all.
+type ServerOptions struct {
+	// Addr is the address to listen on, e.g. ":8443".
+	Addr string
+
+	// TLSCertFile and TLSKeyFile are PEM files of the certificate (with any
+	// intermediates) and its key. Set both to serve HTTPS, where HTTP/2 is
+	// negotiated automatically, or neither for plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// ReadTimeout bounds reading a whole request, headers included.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing a response, counted from the end of reading
+	// the request headers, so it has to cover fetching and processing too.
+	WriteTimeout time.Duration
+	// IdleTimeout bounds waiting for the next request on a keep-alive connection.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes limits the size of request headers.
+	MaxHeaderBytes int
+}
+
+// NewServer returns a server for handler. With TLS, the certificate is loaded
+// here, so a bad pair fails at startup rather than on the first connection.
+// Start it with ListenAndServeTLS("", "") when TLSConfig is set, and with
+// ListenAndServe otherwise.
+func NewServer(handler http.Handler, opts ServerOptions) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              opts.Addr,
+		Handler:           handler,
+		ReadTimeout:       opts.ReadTimeout,
+		ReadHeaderTimeout: opts.ReadTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, errors.New("TLS certificate and key must be set together")
+	}
+	if opts.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		// Leaving NextProtos empty lets net/http offer h2 and http/1.1
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	return srv, nil
+}
+
+// ListenUnix listens on a Unix domain socket at path, e.g. for a proxy on the
+// same host, and sets the socket file's permissions to mode. A socket file left
+// behind by a previous run is removed first, but not one still being served or
+// a file that isn't a socket. Closing the listener removes the socket file.
+//
+//	ln, err := ipxpress.ListenUnix("/run/ipxpress.sock", 0o660)
+//	...
+//	srv.Serve(ln)
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,74 @@
+package ipxpress
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// ImageInfo is the header-level metadata of a source image, served as JSON by
+// info=true and the /info path.
+type ImageInfo struct {
+	Width       int    `json:"width"`
+	Height      int    `json:"height"` // of one page
+	Format      Format `json:"format"`
+	Bytes       int    `json:"bytes"`
+	HasAlpha    bool   `json:"hasAlpha"`
+	Orientation int    `json:"orientation"` // EXIF orientation 1-8, 0 if absent
+	Pages       int    `json:"pages"`
+}
+
+// ReadImageInfo reads the metadata of image data from its header, without
+// decoding any pixels.
+func ReadImageInfo(data []byte) (*ImageInfo, error) {
+	initVips()
+
+	img, err := vips.NewImageFromBuffer(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	defer img.Close()
+
+	format := DetectFormat(data)
+	if format == "" {
+		format = Format(loaderName(data))
+	}
+	return &ImageInfo{
+		Width:       img.Width(),
+		Height:      img.Height(),
+		Format:      format,
+		Bytes:       len(data),
+		HasAlpha:    img.HasAlpha(),
+		Orientation: img.Orientation(),
+		Pages:       max(img.Pages(), 1),
+	}, nil
+}
+
+// infoEntry returns the ImageInfo of the source as a JSON entry.
+func (h *Handler) infoEntry(imageData []byte) *CacheEntry {
+	if err := h.checkLoad(imageData); err != nil {
+		return h.createErrorEntry(err)
+	}
+	info, err := ReadImageInfo(imageData)
+	if err != nil {
+		return h.createErrorEntry(err)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return h.createErrorEntry(err)
+	}
+
+	entry := &CacheEntry{
+		ContentType: "application/json",
+		Data:        data,
+		StatusCode:  http.StatusOK,
+	}
+	if h.config != nil && h.config.EnableETag {
+		sum := md5.Sum(entry.Data)
+		entry.ETag = fmt.Sprintf("\"%x\"", sum)
+	}
+	return entry
+}
@@ -1,9 +1,14 @@
 package ipxpress
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
+	"os"
+	"strings"
 	"sync"
 
 	"github.com/davidbyttow/govips/v2/vips"
@@ -11,7 +16,8 @@ import (
 
 var (
 	vipsInitOnce sync.Once
-	vipsInitErr  error
+	vipsMu       sync.Mutex
+	vipsSettings *VipsConfig // in effect since libvips started, nil before
 )
 
 // initVips initializes vips library with default settings.
@@ -20,20 +26,39 @@ func initVips() {
 	initVipsWithSettings(nil)
 }
 
-// initVipsWithSettings initializes vips with custom or default settings.
-func initVipsWithSettings(cfg *VipsConfig) {
+// initVipsWithSettings initializes vips with custom or default settings. libvips
+// starts once per process: if it's already started with settings other than
+// cfg, cfg is ignored and an error says which settings differ.
+func initVipsWithSettings(cfg *VipsConfig) error {
+	started := false
 	vipsInitOnce.Do(func() {
 		if cfg == nil {
 			cfg = DefaultVipsConfig()
 		}
+		startVips(*cfg)
+		started = true
+	})
+	if started || cfg == nil {
+		return nil
+	}
+	if fields := VipsSettings().differences(cfg); len(fields) > 0 {
+		return fmt.Errorf("libvips already started with other settings, ignoring %s; see ReconfigureVips", strings.Join(fields, ", "))
+	}
+	return nil
+}
 
-		vips.Startup(&vips.Config{
-			MaxCacheMem:   cfg.MaxCacheMem,
-			MaxCacheSize:  cfg.MaxCacheSize,
-			MaxCacheFiles: cfg.MaxCacheFiles,
-		})
-		vips.LoggingSettings(nil, cfg.LogLevel)
+// startVips starts libvips with cfg and records it as the settings in effect.
+func startVips(cfg VipsConfig) {
+	vips.Startup(&vips.Config{
+		ConcurrencyLevel: cfg.Concurrency,
+		MaxCacheMem:      cfg.MaxCacheMem,
+		MaxCacheSize:     cfg.MaxCacheSize,
+		MaxCacheFiles:    cfg.MaxCacheFiles,
 	})
+	vips.LoggingSettings(nil, cfg.LogLevel)
+	vipsMu.Lock()
+	vipsSettings = &cfg
+	vipsMu.Unlock()
 }
 
 // InitVipsWithConfig allows manual initialization of vips with custom configuration.
@@ -41,18 +66,99 @@ func initVipsWithSettings(cfg *VipsConfig) {
 // If not called, default settings will be used automatically.
 func InitVipsWithConfig(config *vips.Config, logLevel vips.LogLevel) {
 	vipsInitOnce.Do(func() {
+		cfg := VipsConfig{LogLevel: logLevel}
+		if config != nil {
+			cfg.Concurrency = config.ConcurrencyLevel
+			cfg.MaxCacheMem = config.MaxCacheMem
+			cfg.MaxCacheSize = config.MaxCacheSize
+			cfg.MaxCacheFiles = config.MaxCacheFiles
+		}
 		vips.Startup(config)
 		vips.LoggingSettings(nil, logLevel)
+		vipsMu.Lock()
+		vipsSettings = &cfg
+		vipsMu.Unlock()
+	})
+}
+
+// VipsStarted reports whether ipxpress has started libvips.
+func VipsStarted() bool {
+	return VipsSettings() != nil
+}
+
+// VipsSettings returns a copy of the settings libvips runs with, nil before
+// it's started.
+func VipsSettings() *VipsConfig {
+	vipsMu.Lock()
+	defer vipsMu.Unlock()
+	if vipsSettings == nil {
+		return nil
+	}
+	cfg := *vipsSettings
+	return &cfg
+}
+
+// ReconfigureVips applies cfg to a running libvips as far as it can, starting
+// libvips with cfg if it isn't yet. govips can only change the log level of a
+// running libvips; the settings it can't change are left as they are and
+// named in the error.
+func ReconfigureVips(cfg *VipsConfig) error {
+	if cfg == nil {
+		cfg = DefaultVipsConfig()
+	}
+	started := false
+	vipsInitOnce.Do(func() {
+		startVips(*cfg)
+		started = true
 	})
+	if started {
+		return nil
+	}
+
+	vipsMu.Lock()
+	defer vipsMu.Unlock()
+	if vipsSettings.LogLevel != cfg.LogLevel {
+		vips.LoggingSettings(nil, cfg.LogLevel)
+		vipsSettings.LogLevel = cfg.LogLevel
+	}
+	if fields := vipsSettings.differences(cfg); len(fields) > 0 {
+		return fmt.Errorf("%s can't change while libvips is running", strings.Join(fields, ", "))
+	}
+	return nil
 }
 
-// Processor is a chainable image processor using libvips backend.
+// Errors of a Processor with no image to work on, see Processor.Err.
+var (
+	ErrNoImage = errors.New("no image loaded")
+	ErrClosed  = errors.New("processor closed")
+)
+
+// Processor is a chainable image processor using libvips backend. Once an
+// operation fails the error sticks, and no later operation calls into libvips.
+// A Processor isn't safe for concurrent use unless made by NewSafe; goroutines
+// working on the same decode should each take a Clone.
 type Processor struct {
 	img            *vips.ImageRef
 	err            error
 	originalFormat Format
 	originalSize   int
-	originalData   []byte
+	originalData   []byte // only with keepOriginal
+	keepOriginal   bool
+	closed         bool
+	mu             *sync.Mutex // only from NewSafe
+	maxPixels      int
+	reserve        func(estimate int64) error
+	animated       bool
+	page           int
+	frame          int
+	density        int
+	rasterWidth    int
+	rasterHeight   int
+	shrinkWidth    int
+	shrinkHeight   int
+	fullWidth      int // size before shrink-on-load, 0 if decoded in full
+	fullHeight     int
+	ctx            context.Context
 }
 
 // New creates a new Processor instance.
@@ -62,28 +168,441 @@ func New() *Processor {
 	return &Processor{}
 }
 
+// NewSafe is like New, but the processor's methods lock it, so sharing it between
+// goroutines serializes them instead of crashing libvips. Each goroutine still
+// sees the image the others left, so it's for processors shared by accident
+// more than by design: to derive several outputs concurrently, give each
+// goroutine its own Clone. Clones of a safe processor are safe too. ApplyCustom
+// operations and images taken with ImageRef aren't covered by the lock.
+func NewSafe() *Processor {
+	p := New()
+	p.mu = &sync.Mutex{}
+	return p
+}
+
+// lock locks a processor from NewSafe and returns the unlock function, for
+// "defer p.lock()()" at the top of every exported method that doesn't call
+// another one. For other processors it does nothing.
+func (p *Processor) lock() func() {
+	if p.mu == nil {
+		return func() {}
+	}
+	p.mu.Lock()
+	return p.mu.Unlock
+}
+
+// WithContext makes FromBytes, ApplyFunc and the encoders check ctx before doing
+// any work, and fail the processor with an error wrapping ctx.Err() once it is
+// done, so an abandoned pipeline stops at the next of those steps. A single
+// libvips operation can't be interrupted.
+func (p *Processor) WithContext(ctx context.Context) *Processor {
+	defer p.lock()()
+	p.ctx = ctx
+	return p
+}
+
+// canceled fails the processor if its context is done, and reports whether it did.
+func (p *Processor) canceled() bool {
+	if p.ctx == nil {
+		return false
+	}
+	if err := p.ctx.Err(); err != nil {
+		p.err = fmt.Errorf("processing abandoned: %w", err)
+		return true
+	}
+	return false
+}
+
+// MaxPixels makes FromBytes and FromReader reject images whose width*height*frames
+// exceeds n with a *PixelLimitError, before decoding any pixels. 0 means no limit.
+func (p *Processor) MaxPixels(n int) *Processor {
+	defer p.lock()()
+	p.maxPixels = n
+	return p
+}
+
+// Animated makes FromBytes load every frame of animated GIF and WebP sources instead
+// of only the first. libvips stacks the frames vertically into one tall image; Resize
+// and ResizeWithOptions scale each frame, and GIF and WebP output keep the frames,
+// their delays and the loop count. Other operations, including custom processors,
+// see the whole stack, so only use it for operations that don't move pixels across
+// frames.
+func (p *Processor) Animated(animated bool) *Processor {
+	defer p.lock()()
+	p.animated = animated
+	return p
+}
+
+// frames returns the height of one frame of img and the number of frames stacked
+// in it (1 for still images or when only the first frame was loaded).
+func frames(img *vips.ImageRef) (frameHeight, n int) {
+	frameHeight = img.PageHeight()
+	if frameHeight <= 0 || frameHeight >= img.Height() || img.Height()%frameHeight != 0 {
+		return img.Height(), 1
+	}
+	return frameHeight, img.Height() / frameHeight
+}
+
+// Page makes FromBytes and FromReader load page n (from 0) of multi-page sources
+// such as PDF, TIFF and animated GIF. A page beyond the source's last fails the
+// processor with a *PageRangeError.
+func (p *Processor) Page(n int) *Processor {
+	defer p.lock()()
+	p.page = n
+	return p
+}
+
+// Frame makes FromBytes and FromReader load only frame n (from 0) of animated
+// sources, or their last frame if they have fewer. Unlike Page it never fails
+// for being out of range; with Page set it's ignored.
+func (p *Processor) Frame(n int) *Processor {
+	defer p.lock()()
+	p.frame = n
+	return p
+}
+
+// Density sets the resolution, in DPI, at which FromBytes and FromReader rasterize
+// PDF and SVG sources. 0 uses libvips' default of 72. Other sources ignore it.
+func (p *Processor) Density(dpi int) *Processor {
+	defer p.lock()()
+	p.density = dpi
+	return p
+}
+
+// RasterSize makes FromBytes and FromReader rasterize PDF and SVG sources at a
+// density covering width x height (either may be 0), so that resizing them to that
+// size scales down a sharp render instead of enlarging the small default one.
+// An explicit Density takes precedence.
+func (p *Processor) RasterSize(width, height int) *Processor {
+	defer p.lock()()
+	p.rasterWidth, p.rasterHeight = width, height
+	return p
+}
+
+// ShrinkOnLoad lets FromBytes decode JPEG and WebP sources at a half, a
+// quarter or an eighth of their size (libvips' shrink-on-load) when the result
+// still covers width x height (either may be 0), for a following Resize or
+// ResizeWithOptions to that size. The resize computes its target from the full
+// size, so the output dimensions don't change, only the decoding cost. Only use
+// it when nothing before the resize works in source coordinates, as Extract
+// does. Animated sources and pages after the first are decoded in full.
+func (p *Processor) ShrinkOnLoad(width, height int) *Processor {
+	defer p.lock()()
+	p.shrinkWidth, p.shrinkHeight = width, height
+	return p
+}
+
+// KeepOriginal makes FromBytes keep a reference to the source bytes for
+// OriginalBytes. It's off by default so a Processor doesn't pin the source
+// buffer for its whole life; libvips still references it while decoding lazily.
+func (p *Processor) KeepOriginal() *Processor {
+	defer p.lock()()
+	p.keepOriginal = true
+	return p
+}
+
+// shrinkFactor returns the largest of 1, 2, 4 and 8 by which width x height can
+// be divided and still cover targetWidth x targetHeight (either may be 0).
+func shrinkFactor(width, height, targetWidth, targetHeight int) int {
+	factor := 1
+	for factor < 8 {
+		next := factor * 2
+		if targetWidth > 0 && width/next < targetWidth || targetHeight > 0 && height/next < targetHeight {
+			break
+		}
+		factor = next
+	}
+	return factor
+}
+
+// sourceSize returns the size resize targets are computed from: the full size
+// of a source decoded smaller by ShrinkOnLoad, otherwise that of a frame.
+func (p *Processor) sourceSize() (width, height int) {
+	if p.fullWidth > 0 {
+		return p.fullWidth, p.fullHeight
+	}
+	height, _ = frames(p.img)
+	return p.img.Width(), height
+}
+
+// ReserveDecode makes FromBytes and FromReader call fn with an estimate of the
+// memory decoding and processing the image will take (in bytes), from its header
+// and before decoding any pixels. An error from fn fails the processor.
+func (p *Processor) ReserveDecode(fn func(estimate int64) error) *Processor {
+	defer p.lock()()
+	p.reserve = fn
+	return p
+}
+
+// sampleSize returns the bytes per band of a pixel in format.
+func sampleSize(format vips.BandFormat) int {
+	switch format {
+	case vips.BandFormatUshort, vips.BandFormatShort:
+		return 2
+	case vips.BandFormatUint, vips.BandFormatInt, vips.BandFormatFloat:
+		return 4
+	case vips.BandFormatDouble, vips.BandFormatComplex:
+		return 8
+	case vips.BandFormatDpComplex:
+		return 16
+	}
+	return 1
+}
+
+// PixelLimitError reports a source image larger than the configured pixel budget,
+// such as a decompression bomb.
+type PixelLimitError struct {
+	Width, Height, Frames int
+	Limit                 int
+}
+
+// Error implements the error interface.
+func (e *PixelLimitError) Error() string {
+	return fmt.Sprintf("image is %dx%d with %d frame(s), above the limit of %d pixels", e.Width, e.Height, e.Frames, e.Limit)
+}
+
+// PageRangeError reports a page beyond the last page of the source.
+type PageRangeError struct {
+	Page, Pages int
+}
+
+// Error implements the error interface.
+func (e *PageRangeError) Error() string {
+	return fmt.Sprintf("page %d is out of range, the image has %d page(s)", e.Page, e.Pages)
+}
+
+// checkPixels returns a PixelLimitError if img has more than limit pixels over all frames.
+func checkPixels(img *vips.ImageRef, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+	frames := max(img.Pages(), 1)
+	if pixels := int64(img.Width()) * int64(img.Height()) * int64(frames); pixels > int64(limit) {
+		return &PixelLimitError{Width: img.Width(), Height: img.Height(), Frames: frames, Limit: limit}
+	}
+	return nil
+}
+
 // FromBytes decodes an image from a byte slice.
 func (p *Processor) FromBytes(b []byte) *Processor {
-	if p.err != nil {
+	defer p.lock()()
+	if p.err != nil || p.canceled() {
+		return p
+	}
+	if p.closed {
+		p.err = ErrClosed
 		return p
 	}
 
-	img, err := vips.NewImageFromBuffer(b)
+	params, err := p.importParams(b)
+	if err != nil {
+		p.err = err
+		return p
+	}
+	var img *vips.ImageRef
+	if params != nil {
+		img, err = vips.LoadImageFromBuffer(b, params)
+	} else {
+		img, err = vips.NewImageFromBuffer(b)
+	}
 	if err != nil {
 		p.err = fmt.Errorf("failed to decode image: %w", err)
 		return p
 	}
 
+	// libvips has only read the header so far; refuse before any pixel is decoded
+	if err := checkPixels(img, p.maxPixels); err != nil {
+		img.Close()
+		p.err = err
+		return p
+	}
+	if p.reserve != nil {
+		estimate := decodeEstimate(img.Width(), img.Height(), img.Pages(), img.Bands(), sampleSize(img.BandFormat()))
+		if err := p.reserve(estimate); err != nil {
+			img.Close()
+			p.err = err
+			return p
+		}
+	}
+
 	p.img = img
 
 	// Detect original format and store size
 	p.originalFormat = DetectFormat(b)
 	p.originalSize = len(b)
-	p.originalData = b
+	if p.keepOriginal {
+		p.originalData = b
+	}
 
 	return p
 }
 
+// importParams returns the load options for the animated, page and density
+// settings, or nil if the defaults do.
+func (p *Processor) importParams(b []byte) (*vips.ImportParams, error) {
+	loader := loaderName(b)
+	vector := loader == "pdf" || loader == "svg"
+	density := p.density
+	if !vector {
+		density = 0
+	}
+	frame := 0
+	if p.page == 0 && p.frame > 0 && DetectFormat(b).SupportsAnimation() {
+		frame = p.frame
+	}
+	shrinkable := (loader == "jpeg" || loader == "webp") && (p.shrinkWidth > 0 || p.shrinkHeight > 0) && p.page == 0 && frame == 0 && !p.animated
+
+	shrink := 1
+	if p.page > 0 || frame > 0 || shrinkable || (vector && density == 0 && (p.rasterWidth > 0 || p.rasterHeight > 0)) {
+		// Only the header is read, to count the pages, measure vector sources at
+		// 72 DPI and choose the shrink
+		header, err := vips.NewImageFromBuffer(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+		pages, width, height, orientation := max(header.Pages(), 1), header.Width(), header.Height(), header.Orientation()
+		// The decoded size no longer tells how large the source is
+		err = checkPixels(header, p.maxPixels)
+		header.Close()
+		if shrinkable && err != nil {
+			return nil, err
+		}
+		if p.page >= pages {
+			return nil, &PageRangeError{Page: p.page, Pages: pages}
+		}
+		frame = min(frame, pages-1)
+		if vector && density == 0 {
+			density = rasterDensity(width, height, p.rasterWidth, p.rasterHeight)
+		}
+		if shrinkable {
+			shrink = shrinkFactor(width, height, p.shrinkWidth, p.shrinkHeight)
+			if orientationSwapsAxes(orientation) {
+				// The resize may come after AutoOrient, with width and height swapped
+				shrink = min(shrink, shrinkFactor(width, height, p.shrinkHeight, p.shrinkWidth))
+			}
+			if shrink > 1 {
+				p.fullWidth, p.fullHeight = width, height
+			}
+		}
+	}
+
+	params := &vips.ImportParams{}
+	set := false
+	if p.page > 0 {
+		params.Page.Set(p.page)
+		set = true
+	} else if frame > 0 {
+		params.Page.Set(frame)
+		set = true
+	} else if p.animated && DetectFormat(b).SupportsAnimation() {
+		params.NumPages.Set(-1) // all frames
+		set = true
+	}
+	if density > 0 {
+		params.Density.Set(density)
+		set = true
+	}
+	if shrink > 1 {
+		if loader == "jpeg" {
+			params.JpegShrinkFactor.Set(shrink)
+		} else {
+			params.WebpScaleFactor.Set(1 / float64(shrink))
+		}
+		set = true
+	}
+	if !set {
+		return nil, nil
+	}
+	return params, nil
+}
+
+// maxRasterDensity caps the DPI chosen by RasterSize, like the density parameter.
+const maxRasterDensity = 1200
+
+// rasterDensity returns the DPI at which a vector source measuring width x height
+// at 72 DPI covers targetWidth x targetHeight (either may be 0), or 0 if the
+// default already does.
+func rasterDensity(width, height, targetWidth, targetHeight int) int {
+	scale := 0.0
+	if targetWidth > 0 && width > 0 {
+		scale = float64(targetWidth) / float64(width)
+	}
+	if targetHeight > 0 && height > 0 {
+		scale = max(scale, float64(targetHeight)/float64(height))
+	}
+	if scale <= 1 {
+		return 0
+	}
+	return min(int(math.Ceil(72*scale)), maxRasterDensity)
+}
+
+// Clone returns an independent Processor over a copy of the image, so several
+// outputs can be derived from one decode. The copy shares the source pixels;
+// the base and its clones may be closed in any order. Clone only reads the
+// base, so several goroutines may clone it at once while nothing changes it.
+func (p *Processor) Clone() *Processor {
+	defer p.lock()()
+	c := &Processor{
+		err:            p.err,
+		originalFormat: p.originalFormat,
+		originalSize:   p.originalSize,
+		originalData:   p.originalData,
+		keepOriginal:   p.keepOriginal,
+		maxPixels:      p.maxPixels,
+		fullWidth:      p.fullWidth,
+		fullHeight:     p.fullHeight,
+		ctx:            p.ctx,
+	}
+	if p.mu != nil {
+		c.mu = &sync.Mutex{}
+	}
+	if c.err != nil {
+		return c
+	}
+	if p.img == nil {
+		c.err = p.noImage()
+		return c
+	}
+	img, err := p.img.Copy()
+	if err != nil {
+		c.err = fmt.Errorf("failed to copy image: %w", err)
+		return c
+	}
+	c.img = img
+	return c
+}
+
+// variantQuality is the encoding quality of Variants.
+const variantQuality = 85
+
+// Size is a bounding box for Variants; 0 leaves a side unconstrained, as in Resize.
+type Size struct {
+	Width  int
+	Height int
+}
+
+// Variants resizes a Clone of the image to fit each size, in order, and encodes
+// it at quality 85 in the original format, or JPEG for sources browsers can't
+// display. The source is decoded once and the processor is left unchanged.
+func (p *Processor) Variants(sizes []Size) ([][]byte, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	format := (&ProcessingParams{}).GetOutputFormat(p.originalFormat)
+
+	out := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		variant := p.Clone().Resize(size.Width, size.Height)
+		data, err := variant.ToBytes(format, variantQuality)
+		variant.Close()
+		if err != nil {
+			return nil, fmt.Errorf("variant %dx%d: %w", size.Width, size.Height, err)
+		}
+		out[i] = data
+	}
+	return out, nil
+}
+
 // FromReader decodes an image from an io.Reader.
 func (p *Processor) FromReader(r io.Reader) *Processor {
 	if p.err != nil {
@@ -102,11 +621,12 @@ func (p *Processor) FromReader(r io.Reader) *Processor {
 // Resize resizes the image to fit within maxWidth x maxHeight while preserving aspect ratio.
 // Uses high-quality Lanczos resampling from libvips.
 func (p *Processor) Resize(maxWidth, maxHeight int) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -114,8 +634,8 @@ func (p *Processor) Resize(maxWidth, maxHeight int) *Processor {
 		return p
 	}
 
-	srcW := p.img.Width()
-	srcH := p.img.Height()
+	srcW, srcH := p.sourceSize()
+	frameH, n := frames(p.img)
 
 	var tgtW, tgtH int
 	if maxWidth == 0 {
@@ -144,17 +664,13 @@ func (p *Processor) Resize(maxWidth, maxHeight int) *Processor {
 		tgtH = 1
 	}
 
-	// Compute scale factors
-	scaleX := float64(tgtW) / float64(srcW)
-	scaleY := float64(tgtH) / float64(srcH)
+	// Compute scale factors from the decoded size
+	scaleX := float64(tgtW) / float64(p.img.Width())
+	scaleY := float64(tgtH) / float64(frameH)
+	p.fullWidth, p.fullHeight = 0, 0
 
 	// Resize in-place (modifies the image reference)
-	if scaleX == scaleY {
-		p.err = p.img.Resize(scaleX, vips.KernelLanczos3)
-	} else {
-		p.err = p.img.ResizeWithVScale(scaleX, scaleY, vips.KernelLanczos3)
-	}
-
+	p.err = resizeFrames(p.img, scaleX, scaleY, tgtH, n, vips.KernelLanczos3)
 	if p.err != nil {
 		p.err = fmt.Errorf("failed to resize image: %w", p.err)
 	}
@@ -164,11 +680,12 @@ func (p *Processor) Resize(maxWidth, maxHeight int) *Processor {
 
 // ResizeWithOptions resizes with advanced options (fit, position, kernel, enlarge)
 func (p *Processor) ResizeWithOptions(width, height int, kernel vips.Kernel, enlarge bool) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -176,8 +693,8 @@ func (p *Processor) ResizeWithOptions(width, height int, kernel vips.Kernel, enl
 		return p
 	}
 
-	srcW := p.img.Width()
-	srcH := p.img.Height()
+	srcW, srcH := p.sourceSize()
+	frameH, n := frames(p.img)
 
 	var tgtW, tgtH int
 	if width == 0 {
@@ -216,17 +733,13 @@ func (p *Processor) ResizeWithOptions(width, height int, kernel vips.Kernel, enl
 		tgtH = 1
 	}
 
-	// Compute scale factors
-	scaleX := float64(tgtW) / float64(srcW)
-	scaleY := float64(tgtH) / float64(srcH)
+	// Compute scale factors from the decoded size
+	scaleX := float64(tgtW) / float64(p.img.Width())
+	scaleY := float64(tgtH) / float64(frameH)
+	p.fullWidth, p.fullHeight = 0, 0
 
 	// Resize in-place with specified kernel
-	if scaleX == scaleY {
-		p.err = p.img.Resize(scaleX, kernel)
-	} else {
-		p.err = p.img.ResizeWithVScale(scaleX, scaleY, kernel)
-	}
-
+	p.err = resizeFrames(p.img, scaleX, scaleY, tgtH, n, kernel)
 	if p.err != nil {
 		p.err = fmt.Errorf("failed to resize image: %w", p.err)
 	}
@@ -234,13 +747,85 @@ func (p *Processor) ResizeWithOptions(width, height int, kernel vips.Kernel, enl
 	return p
 }
 
+// resizeFrames scales img, whose n frames are stacked vertically, so each frame is
+// frameHeight pixels high. Animations always get an explicit vertical scale so the
+// rounded total height stays a multiple of the frame height.
+func resizeFrames(img *vips.ImageRef, scaleX, scaleY float64, frameHeight, n int, kernel vips.Kernel) error {
+	if n == 1 {
+		if scaleX == scaleY {
+			return img.Resize(scaleX, kernel)
+		}
+		return img.ResizeWithVScale(scaleX, scaleY, kernel)
+	}
+	if err := img.ResizeWithVScale(scaleX, scaleY, kernel); err != nil {
+		return err
+	}
+	return img.SetPageHeight(frameHeight)
+}
+
+// Zoom scales the image by factor with kernel and crops it back to its size,
+// keeping the part anchored by position: a gravity (north, southeast, ...) or
+// top, bottom, left, right and combinations such as "left top"; anything else
+// keeps the center. Factors up to 1 leave the image as it is.
+func (p *Processor) Zoom(factor float64, position string, kernel vips.Kernel) *Processor {
+	defer p.lock()()
+	if p.err != nil || factor <= 1 {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	w, h := p.img.Width(), p.img.Height()
+	p.fullWidth, p.fullHeight = 0, 0
+	if p.err = p.img.Resize(factor, kernel); p.err != nil {
+		p.err = fmt.Errorf("failed to zoom: %w", p.err)
+		return p
+	}
+	gravity, ok := positionGravity(position)
+	if !ok {
+		gravity = "centre"
+	}
+	left, top := gravityOffset(gravity, p.img.Width(), p.img.Height(), w, h, 0)
+	if p.err = p.img.ExtractArea(left, top, w, h); p.err != nil {
+		p.err = fmt.Errorf("failed to zoom: %w", p.err)
+	}
+	return p
+}
+
+// positionGravity turns a position naming a side or corner into the gravity
+// gravityOffset expects, reporting false for any other.
+func positionGravity(position string) (string, bool) {
+	var vertical, horizontal string
+	for _, word := range strings.Fields(strings.ToLower(strings.ReplaceAll(position, "_", " "))) {
+		switch word {
+		case "top":
+			vertical = "north"
+		case "bottom":
+			vertical = "south"
+		case "left":
+			horizontal = "west"
+		case "right":
+			horizontal = "east"
+		case "north", "south", "east", "west", "northeast", "northwest", "southeast", "southwest", "centre", "center":
+			return word, true
+		}
+	}
+	if vertical+horizontal == "" {
+		return "", false
+	}
+	return vertical + horizontal, true
+}
+
 // Thumbnail creates a thumbnail using SmartCrop (attention-based cropping)
 func (p *Processor) Thumbnail(width, height int, interesting vips.Interesting) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -258,11 +843,12 @@ func (p *Processor) Thumbnail(width, height int, interesting vips.Interesting) *
 
 // Blur applies Gaussian blur to the image
 func (p *Processor) Blur(sigma float64) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -280,11 +866,12 @@ func (p *Processor) Blur(sigma float64) *Processor {
 
 // Sharpen sharpens the image
 func (p *Processor) Sharpen(sigma, flat, jagged float64) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -296,13 +883,48 @@ func (p *Processor) Sharpen(sigma, flat, jagged float64) *Processor {
 	return p
 }
 
+// AutoOrient turns the image upright according to its EXIF orientation and
+// drops the tag, so viewers don't turn it again. It belongs before operations
+// working in image coordinates, such as Extract and Resize; the Handler runs it
+// first unless Config.DisableAutoOrient is set.
+func (p *Processor) AutoOrient() *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	orientation := p.img.Orientation()
+	if orientation <= 1 {
+		return p
+	}
+	if err := p.img.AutoRotate(); err != nil {
+		p.err = fmt.Errorf("failed to orient image: %w", err)
+		return p
+	}
+	if orientationSwapsAxes(orientation) {
+		p.fullWidth, p.fullHeight = p.fullHeight, p.fullWidth
+	}
+	return p
+}
+
+// orientationSwapsAxes reports whether EXIF orientation turns the image by 90
+// or 270 degrees (orientations 5 to 8).
+func orientationSwapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
 // Rotate rotates the image by the given angle
 func (p *Processor) Rotate(angle vips.Angle) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -316,11 +938,12 @@ func (p *Processor) Rotate(angle vips.Angle) *Processor {
 
 // Flip flips the image vertically
 func (p *Processor) Flip() *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -334,11 +957,12 @@ func (p *Processor) Flip() *Processor {
 
 // Flop flips the image horizontally
 func (p *Processor) Flop() *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -350,13 +974,51 @@ func (p *Processor) Flop() *Processor {
 	return p
 }
 
+// ToSRGB converts the image to sRGB using its embedded ICC profile, so CMYK and
+// wide-gamut (Display P3, Adobe RGB) sources keep their colors once the profile is
+// stripped. Without a usable profile, CMYK and other non-RGB images are converted
+// with libvips' built-in profiles; grayscale images are left as they are.
+func (p *Processor) ToSRGB() *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if p.img.HasICCProfile() {
+		err := p.img.TransformICCProfile(vips.SRGBIEC6196621ICCProfilePath)
+		if err == nil {
+			return p
+		}
+		// A corrupt profile shouldn't fail the image; convert as if it had none
+		slog.Warn("ICC transform failed, converting without the profile", "error", err)
+		if err := p.img.RemoveICCProfile(); err != nil {
+			p.err = fmt.Errorf("failed to remove ICC profile: %w", err)
+			return p
+		}
+	}
+
+	switch p.img.Interpretation() {
+	case vips.InterpretationSRGB, vips.InterpretationRGB16, vips.InterpretationBW, vips.InterpretationGrey16:
+		return p
+	}
+	if err := p.img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		p.err = fmt.Errorf("failed to convert to sRGB: %w", err)
+	}
+	return p
+}
+
 // Grayscale converts the image to grayscale
 func (p *Processor) Grayscale() *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -370,14 +1032,19 @@ func (p *Processor) Grayscale() *Processor {
 
 // Extract extracts a rectangular region from the image
 func (p *Processor) Extract(left, top, width, height int) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
+	if !regionInside(left, top, width, height, p.img.Width(), p.img.Height()) {
+		p.err = &RegionError{Left: left, Top: top, Width: width, Height: height, ImageWidth: p.img.Width(), ImageHeight: p.img.Height()}
+		return p
+	}
 	p.err = p.img.ExtractArea(left, top, width, height)
 	if p.err != nil {
 		p.err = fmt.Errorf("failed to extract region: %w", p.err)
@@ -386,113 +1053,235 @@ func (p *Processor) Extract(left, top, width, height int) *Processor {
 	return p
 }
 
-// Extend adds borders to the image
-func (p *Processor) Extend(top, right, bottom, left int, background []float64) *Processor {
-	if p.err != nil {
-		return p
-	}
-	if p.img == nil {
-		p.err = errors.New("no image loaded")
-		return p
-	}
+// ExtractRegion extracts a region given in pixels or percentages of the current
+// size, so after AutoOrient it is in upright coordinates. With clamp a region
+// reaching past the edges is cut to the image; otherwise it is a RegionError.
+func (p *Processor) ExtractRegion(left, top, width, height Length, clamp bool) *Processor {
+	w, h := p.Width(), p.Height()
+	return p.extractClamped(left.Pixels(w), top.Pixels(h), width.Pixels(w), height.Pixels(h), clamp)
+}
 
-	// Create background color if provided
-	if len(background) >= 3 {
-		bgColor := &vips.Color{
-			R: uint8(background[0]),
-			G: uint8(background[1]),
-			B: uint8(background[2]),
-		}
-		p.err = p.img.Embed(left, top, p.img.Width()+left+right, p.img.Height()+top+bottom, vips.ExtendBackground)
-		if p.err == nil {
-			// Apply background by flattening first if there's alpha
-			if p.img.HasAlpha() {
-				p.err = p.img.Flatten(bgColor)
-			}
+// CropCenter extracts a width x height region around the center. With clamp a
+// region larger than the image is cut to it; otherwise it is a RegionError.
+func (p *Processor) CropCenter(width, height int, clamp bool) *Processor {
+	return p.extractClamped((p.Width()-width)/2, (p.Height()-height)/2, width, height, clamp)
+}
+
+func (p *Processor) extractClamped(left, top, width, height int, clamp bool) *Processor {
+	if clamp {
+		right, bottom := min(left+width, p.Width()), min(top+height, p.Height())
+		left, top = max(left, 0), max(top, 0)
+		// Nothing left of the region is still an error
+		if right > left && bottom > top {
+			width, height = right-left, bottom-top
 		}
-	} else {
-		// Default extend with white background
-		p.err = p.img.Embed(left, top, p.img.Width()+left+right, p.img.Height()+top+bottom, vips.ExtendWhite)
 	}
+	return p.Extract(left, top, width, height)
+}
 
-	if p.err != nil {
-		p.err = fmt.Errorf("failed to extend image: %w", p.err)
-	}
+// RegionError reports an extract or crop region that isn't inside the image.
+type RegionError struct {
+	Left, Top, Width, Height int
+	ImageWidth, ImageHeight  int
+}
 
-	return p
+// Error implements the error interface.
+func (e *RegionError) Error() string {
+	return fmt.Sprintf("region %dx%d at %d,%d is outside the %dx%d image", e.Width, e.Height, e.Left, e.Top, e.ImageWidth, e.ImageHeight)
 }
 
-// Negate inverts the colors of the image
-func (p *Processor) Negate() *Processor {
+func regionInside(left, top, width, height, imageWidth, imageHeight int) bool {
+	return left >= 0 && top >= 0 && width > 0 && height > 0 && left+width <= imageWidth && top+height <= imageHeight
+}
+
+// Extend adds borders to the image.
+// background is RGB or RGBA (0-255); nil means white. The image's own alpha is kept,
+// and an alpha channel is added if the background is not opaque.
+func (p *Processor) Extend(top, right, bottom, left int, background []float64) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
-	p.err = p.img.Invert()
+	p.err = embedOnCanvas(p.img, left, top, p.img.Width()+left+right, p.img.Height()+top+bottom, background)
 	if p.err != nil {
-		p.err = fmt.Errorf("failed to negate image: %w", p.err)
+		p.err = fmt.Errorf("failed to extend image: %w", p.err)
 	}
 
 	return p
 }
 
-// Normalize normalizes the image
-func (p *Processor) Normalize() *Processor {
+// ExtendWithGravity is like Extend, but the image is placed on the larger canvas
+// by gravity (north, southeast, centre, ...): extend=100_0_100_0 with north adds
+// 200 pixels below the image.
+func (p *Processor) ExtendWithGravity(top, right, bottom, left int, gravity string, background []float64) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
-	p.err = p.img.HistogramNormalise()
+	w, h := p.img.Width(), p.img.Height()
+	width, height := w+left+right, h+top+bottom
+	x, y := gravityOffset(gravity, width, height, w, h, 0)
+	p.err = embedOnCanvas(p.img, x, y, width, height, background)
 	if p.err != nil {
-		p.err = fmt.Errorf("failed to normalize image: %w", p.err)
+		p.err = fmt.Errorf("failed to extend image: %w", p.err)
 	}
 
 	return p
 }
 
-// Gamma applies gamma correction
-func (p *Processor) Gamma(gamma float64) *Processor {
+// Pad centers the image on a canvas of exactly width x height filled with background
+// (see Extend). Resize first so the image fits; a larger image is not cropped.
+func (p *Processor) Pad(width, height int, background []float64) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
-	if gamma <= 0 {
+	w, h := p.img.Width(), p.img.Height()
+	canvasW, canvasH := max(width, w), max(height, h)
+	if canvasW == w && canvasH == h {
 		return p
 	}
 
-	p.err = p.img.Gamma(gamma)
+	p.err = embedOnCanvas(p.img, (canvasW-w)/2, (canvasH-h)/2, canvasW, canvasH, background)
 	if p.err != nil {
-		p.err = fmt.Errorf("failed to apply gamma: %w", p.err)
+		p.err = fmt.Errorf("failed to pad image: %w", p.err)
 	}
 
 	return p
 }
 
-// Modulate transforms the image using brightness, saturation, hue rotation
-func (p *Processor) Modulate(brightness, saturation, hue float64) *Processor {
-	if p.err != nil {
-		return p
+// embedOnCanvas places img at (left, top) on a width x height canvas of the given color.
+func embedOnCanvas(img *vips.ImageRef, left, top, width, height int, background []float64) error {
+	bg := &vips.ColorRGBA{R: 255, G: 255, B: 255, A: 255}
+	if len(background) >= 3 {
+		bg.R, bg.G, bg.B = uint8(background[0]), uint8(background[1]), uint8(background[2])
 	}
-	if p.img == nil {
-		p.err = errors.New("no image loaded")
-		return p
+	if len(background) >= 4 {
+		bg.A = uint8(background[3])
 	}
 
-	p.err = p.img.Modulate(brightness, saturation, hue)
-	if p.err != nil {
-		p.err = fmt.Errorf("failed to modulate image: %w", p.err)
+	if bg.A < 255 && !img.HasAlpha() {
+		if err := img.AddAlpha(); err != nil {
+			return err
+		}
+	}
+	return img.EmbedBackgroundRGBA(left, top, width, height, bg)
+}
+
+// Negate inverts the colors of the image
+func (p *Processor) Negate() *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	p.err = p.img.Invert()
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to negate image: %w", p.err)
+	}
+
+	return p
+}
+
+// Normalize normalizes the image
+func (p *Processor) Normalize() *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	p.err = p.img.HistogramNormalise()
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to normalize image: %w", p.err)
+	}
+
+	return p
+}
+
+// Gamma applies gamma correction
+func (p *Processor) Gamma(gamma float64) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if gamma <= 0 {
+		return p
+	}
+
+	p.err = p.img.Gamma(gamma)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to apply gamma: %w", p.err)
+	}
+
+	return p
+}
+
+// Modulate transforms the image using brightness, saturation, hue rotation
+func (p *Processor) Modulate(brightness, saturation, hue float64) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	p.err = p.img.Modulate(brightness, saturation, hue)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to modulate image: %w", p.err)
+	}
+
+	return p
+}
+
+// Contrast scales the distance of every color channel from mid-grey by factor;
+// values above 1 increase contrast and values below 1 flatten it. Alpha is preserved.
+func (p *Processor) Contrast(factor float64) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if factor <= 0 || factor == 1 {
+		return p
+	}
+
+	p.err = contrast(p.img, factor)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to apply contrast: %w", p.err)
 	}
 
 	return p
@@ -500,11 +1289,12 @@ func (p *Processor) Modulate(brightness, saturation, hue float64) *Processor {
 
 // Flatten removes alpha channel
 func (p *Processor) Flatten(background *vips.Color) *Processor {
+	defer p.lock()()
 	if p.err != nil {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -516,27 +1306,547 @@ func (p *Processor) Flatten(background *vips.Color) *Processor {
 	return p
 }
 
+// Duotone converts the image to grayscale and maps its tones onto a gradient from
+// darkHex (shadows) to lightHex (highlights). Colors are as ParseColor takes them,
+// like "1a2b3c"; others are an error. Alpha is preserved.
+func (p *Processor) Duotone(darkHex, lightHex string) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	dark, err := ParseColor(darkHex)
+	if err != nil {
+		p.err = fmt.Errorf("failed to apply duotone: %w", err)
+		return p
+	}
+	light, err := ParseColor(lightHex)
+	if err != nil {
+		p.err = fmt.Errorf("failed to apply duotone: %w", err)
+		return p
+	}
+	p.err = duotone(p.img, channels(dark), channels(light))
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to apply duotone: %w", p.err)
+	}
+
+	return p
+}
+
+// Posterize reduces every color channel to the given number of evenly spaced levels
+// (2-255). Alpha is preserved.
+func (p *Processor) Posterize(levels int) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if levels < 2 || levels > 255 {
+		return p
+	}
+
+	p.err = posterize(p.img, levels)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to posterize: %w", p.err)
+	}
+
+	return p
+}
+
+// duotone maps the luminance v of each pixel to dark + (light-dark) * v/255.
+func duotone(img *vips.ImageRef, dark, light []float64) error {
+	// Going through B_W and back to sRGB gives three equal bands (plus alpha)
+	if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
+		return err
+	}
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return err
+	}
+
+	a, b := identityLinear(img.Bands())
+	for i := 0; i < 3; i++ {
+		a[i] = (light[i] - dark[i]) / 255
+		b[i] = dark[i]
+	}
+	if err := img.Linear(a, b); err != nil {
+		return err
+	}
+	return img.Cast(vips.BandFormatUchar)
+}
+
+// posterize scales channels down to level indexes, truncates, and scales them back up.
+func posterize(img *vips.ImageRef, levels int) error {
+	a, b := identityLinear(img.Bands())
+	colorBands := img.Bands()
+	if img.HasAlpha() {
+		colorBands--
+	}
+
+	for i := 0; i < colorBands; i++ {
+		a[i] = float64(levels) / 256
+	}
+	if err := img.Linear(a, b); err != nil {
+		return err
+	}
+	if err := img.Cast(vips.BandFormatUchar); err != nil {
+		return err
+	}
+
+	for i := 0; i < colorBands; i++ {
+		a[i] = 255 / float64(levels-1)
+	}
+	if err := img.Linear(a, b); err != nil {
+		return err
+	}
+	return img.Cast(vips.BandFormatUchar)
+}
+
+// contrast maps each color channel v to 128 + (v-128) * factor.
+func contrast(img *vips.ImageRef, factor float64) error {
+	a, b := identityLinear(img.Bands())
+	colorBands := img.Bands()
+	if img.HasAlpha() {
+		colorBands--
+	}
+
+	for i := 0; i < colorBands; i++ {
+		a[i] = factor
+		b[i] = 128 * (1 - factor)
+	}
+	if err := img.Linear(a, b); err != nil {
+		return err
+	}
+	return img.Cast(vips.BandFormatUchar)
+}
+
+// identityLinear returns Linear coefficients that leave all bands unchanged.
+func identityLinear(bands int) (a, b []float64) {
+	a = make([]float64, bands)
+	b = make([]float64, bands)
+	for i := range a {
+		a[i] = 1
+	}
+	return a, b
+}
+
+// RoundCorners masks the image corners with the given radius (in pixels).
+// An alpha channel is added so the area outside the rounded rectangle becomes transparent.
+func (p *Processor) RoundCorners(radius int) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if radius <= 0 {
+		return p
+	}
+
+	p.err = roundCorners(p.img, radius)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to round corners: %w", p.err)
+	}
+
+	return p
+}
+
+// Circle crops the image to a centered square and masks it to a circle.
+// An alpha channel is added so the area outside the circle becomes transparent.
+func (p *Processor) Circle() *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	w, h := p.img.Width(), p.img.Height()
+	size := min(w, h)
+	if w != h {
+		p.err = p.img.ExtractArea((w-size)/2, (h-size)/2, size, size)
+	}
+	if p.err == nil {
+		p.err = roundCorners(p.img, size/2)
+	}
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to crop circle: %w", p.err)
+	}
+
+	return p
+}
+
+// roundCorners composites a rounded-rectangle SVG mask over img with DEST_IN,
+// so only pixels inside the shape keep their alpha.
+func roundCorners(img *vips.ImageRef, radius int) error {
+	w, h := img.Width(), img.Height()
+	if limit := min(w, h) / 2; radius > limit {
+		radius = limit
+	}
+
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d">`+
+		`<rect x="0" y="0" width="%d" height="%d" rx="%d" ry="%d" fill="#fff"/></svg>`,
+		w, h, w, h, radius, radius)
+	mask, err := vips.NewImageFromBuffer([]byte(svg))
+	if err != nil {
+		return fmt.Errorf("failed to render mask: %w", err)
+	}
+	defer mask.Close()
+
+	if err := img.AddAlpha(); err != nil {
+		return err
+	}
+	return img.Composite(mask, vips.BlendModeDestIn, 0, 0)
+}
+
+// Pixelate replaces the image with blocks of blockSize pixels by shrinking it
+// and scaling it back up with nearest-neighbor. Dimensions are preserved.
+func (p *Processor) Pixelate(blockSize int) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if blockSize <= 1 {
+		return p
+	}
+
+	p.err = pixelate(p.img, blockSize)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to pixelate: %w", p.err)
+	}
+
+	return p
+}
+
+// PixelateRegion pixelates only the given rectangle, leaving the rest untouched.
+// The region is clipped to the image bounds.
+func (p *Processor) PixelateRegion(left, top, width, height, blockSize int) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	// Clip the region to the image
+	right := min(left+width, p.img.Width())
+	bottom := min(top+height, p.img.Height())
+	left, top = max(left, 0), max(top, 0)
+	if blockSize <= 1 || right <= left || bottom <= top {
+		return p
+	}
+
+	p.err = pixelateRegion(p.img, left, top, right-left, bottom-top, blockSize)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to pixelate region: %w", p.err)
+	}
+
+	return p
+}
+
+// pixelate shrinks img to one pixel per block, zooms it back by blockSize
+// and trims or extends the result to the original size.
+func pixelate(img *vips.ImageRef, blockSize int) error {
+	w, h := img.Width(), img.Height()
+	cols := (w + blockSize - 1) / blockSize
+	rows := (h + blockSize - 1) / blockSize
+
+	if err := img.ResizeWithVScale(float64(cols)/float64(w), float64(rows)/float64(h), vips.KernelLinear); err != nil {
+		return err
+	}
+	if err := img.Zoom(blockSize, blockSize); err != nil {
+		return err
+	}
+
+	// Rounding in the shrink can leave us a few pixels short or long
+	if img.Width() < w || img.Height() < h {
+		if err := img.Embed(0, 0, max(w, img.Width()), max(h, img.Height()), vips.ExtendCopy); err != nil {
+			return err
+		}
+	}
+	return img.ExtractArea(0, 0, w, h)
+}
+
+// pixelateRegion pixelates a copy of the region and inserts it back into img.
+func pixelateRegion(img *vips.ImageRef, left, top, width, height, blockSize int) error {
+	region, err := img.Copy()
+	if err != nil {
+		return err
+	}
+	defer region.Close()
+
+	if err := region.ExtractArea(left, top, width, height); err != nil {
+		return err
+	}
+	if err := pixelate(region, blockSize); err != nil {
+		return err
+	}
+	return img.Insert(region, left, top, false, nil)
+}
+
+// EncodeOptions tunes encoding. Quality is required for lossy formats; the other
+// zero values keep the defaults used by ToBytes.
+type EncodeOptions struct {
+	// Quality is between 1 and 100; it is ignored by lossless formats.
+	Quality int
+
+	// Lossless encodes WebP, AVIF, HEIF and JXL without loss.
+	Lossless bool
+
+	// NearLossless encodes WebP losslessly after preprocessing whose strength
+	// is set by Quality (lower means smaller and less exact).
+	NearLossless bool
+
+	// Effort is the WebP reduction effort from 1 (fast) to 6 (small). 0 uses 4.
+	Effort int
+
+	// PNGCompression is the zlib level from 1 to 9. 0 uses libvips' default (6).
+	PNGCompression int
+
+	// PNGColors quantizes PNGs to a palette of at most this many colors (2-256).
+	// 0 keeps truecolor.
+	PNGColors int
+
+	// TIFFCompression is TIFFCompressionLZW, TIFFCompressionDeflate or
+	// TIFFCompressionNone. Empty means none.
+	TIFFCompression string
+
+	// Keep selects the metadata written to the output: KeepEXIF, KeepICC or KeepAll.
+	// Empty or KeepNone strips everything.
+	Keep string
+
+	// Progressive, if set, writes progressive JPEGs and interlaced PNGs (true) or
+	// baseline and plain ones (false), overriding JPEG.Progressive and PNG.Interlace.
+	Progressive *bool
+
+	// Subsample, if set, overrides JPEG.Subsample.
+	Subsample vips.SubsampleMode
+
+	// Per-format encoder defaults, overridden by Effort, PNGCompression,
+	// Progressive and Subsample.
+	// Nil uses the built-in defaults.
+	JPEG *JPEGOptions
+	WebP *WebPOptions
+	AVIF *AVIFOptions
+	PNG  *PNGOptions
+}
+
+// JPEGOptions are encoder defaults for JPEG output.
+type JPEGOptions struct {
+	// Progressive writes interlaced JPEGs, which render gradually while loading.
+	Progressive bool
+
+	// Subsample controls chroma subsampling. 0 lets libvips decide (it turns
+	// subsampling off at quality 90 and above).
+	Subsample vips.SubsampleMode
+}
+
+// WebPOptions are encoder defaults for WebP output.
+type WebPOptions struct {
+	// Effort is the reduction effort from 0 (fast) to 6 (small).
+	Effort int
+}
+
+// AVIFOptions are encoder defaults for AVIF output.
+type AVIFOptions struct {
+	// Speed is the encoder speed from 0 (slow, small) to 9 (fast).
+	Speed int
+}
+
+// PNGOptions are encoder defaults for PNG output.
+type PNGOptions struct {
+	// Compression is the zlib level from 0 (none) to 9.
+	Compression int
+
+	// Interlace writes Adam7-interlaced PNGs, which render gradually while
+	// loading but are larger.
+	Interlace bool
+}
+
+// Built-in encoder defaults, used when EncodeOptions leaves a format's options nil.
+var (
+	defaultJPEGOptions = JPEGOptions{Progressive: true}
+	defaultWebPOptions = WebPOptions{Effort: 4} // Optimal balance for speed
+	defaultAVIFOptions = AVIFOptions{Speed: 6}  // Fast encoding, good compression
+	defaultPNGOptions  = PNGOptions{Compression: 6}
+)
+
+// keepMetadata removes the metadata keep doesn't cover from the image and reports
+// whether the export should strip all of it.
+func (p *Processor) keepMetadata(keep string) (bool, error) {
+	switch keep {
+	case KeepAll:
+		return false, nil
+	case KeepEXIF:
+		// Without its profile the image is read as sRGB, so convert the pixels first
+		if p.img.HasICCProfile() {
+			if err := p.img.TransformICCProfile(vips.SRGBIEC6196621ICCProfilePath); err != nil {
+				return false, fmt.Errorf("failed to convert to sRGB: %w", err)
+			}
+			if err := p.img.RemoveICCProfile(); err != nil {
+				return false, fmt.Errorf("failed to remove ICC profile: %w", err)
+			}
+		}
+		return false, nil
+	case KeepICC:
+		if err := p.img.RemoveMetadata(); err != nil {
+			return false, fmt.Errorf("failed to remove metadata: %w", err)
+		}
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// animation is the layout and timing of an animated image.
+type animation struct {
+	frameHeight int
+	delays      []int // per frame, in milliseconds
+	loop        int   // 0 loops forever
+}
+
+// prepareFrames returns the animation of the image if format can keep it. For still
+// formats it reduces an animation to its first frame and returns nil.
+func (p *Processor) prepareFrames(format Format) (*animation, error) {
+	frameHeight, n := frames(p.img)
+	if n == 1 {
+		return nil, nil
+	}
+	if !format.SupportsAnimation() {
+		if err := p.img.ExtractArea(0, 0, p.img.Width(), frameHeight); err != nil {
+			return nil, fmt.Errorf("failed to extract first frame: %w", err)
+		}
+		return nil, nil
+	}
+	anim := &animation{frameHeight: frameHeight, loop: p.img.Loop()}
+	if delays, err := p.img.PageDelay(); err == nil && len(delays) == n {
+		anim.delays = delays
+	}
+	return anim, nil
+}
+
+// restore sets the animation's layout and timing on img again. It does nothing for
+// a nil animation.
+func (a *animation) restore(img *vips.ImageRef) error {
+	if a == nil {
+		return nil
+	}
+	if err := img.SetPageHeight(a.frameHeight); err != nil {
+		return fmt.Errorf("failed to set frame height: %w", err)
+	}
+	if a.delays != nil {
+		if err := img.SetPageDelay(a.delays); err != nil {
+			return fmt.Errorf("failed to set frame delays: %w", err)
+		}
+	}
+	if err := img.SetLoop(a.loop); err != nil {
+		return fmt.Errorf("failed to set loop count: %w", err)
+	}
+	return nil
+}
+
 // ToBytes encodes the image to bytes in the given format.
-// Supports: jpeg, png, gif, webp, avif
+// Supports: jpeg, png, gif, webp, avif, heif, tiff, jxl
+// Quality must be between 1 and 100; it is ignored by lossless formats.
 func (p *Processor) ToBytes(format Format, quality int) ([]byte, error) {
-	if p.err != nil {
+	return p.ToBytesWithOptions(format, EncodeOptions{Quality: quality})
+}
+
+// ToWriter encodes the image like ToBytes and writes it to w, returning the
+// number of bytes written. libvips encodes into memory either way; this saves
+// callers holding on to the buffer.
+func (p *Processor) ToWriter(w io.Writer, format Format, quality int) (int64, error) {
+	return p.ToWriterWithOptions(w, format, EncodeOptions{Quality: quality})
+}
+
+// ToWriterWithOptions is ToWriter with the given encoder options. Nothing is
+// written if encoding fails.
+func (p *Processor) ToWriterWithOptions(w io.Writer, format Format, opts EncodeOptions) (int64, error) {
+	buf, err := p.ToBytesWithOptions(format, opts)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ToFile encodes the image like ToBytes and writes it to path, which is created
+// or truncated. Nothing is written if encoding fails.
+func (p *Processor) ToFile(path string, format Format, quality int) error {
+	buf, err := p.ToBytes(format, quality)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf, 0o644)
+}
+
+// ToBytesWithOptions encodes the image to bytes in the given format with the
+// given encoder options.
+func (p *Processor) ToBytesWithOptions(format Format, opts EncodeOptions) ([]byte, error) {
+	defer p.lock()()
+	if p.err != nil || p.canceled() {
 		return nil, p.err
 	}
 	if p.img == nil {
-		return nil, errors.New("no image to encode")
+		return nil, fmt.Errorf("nothing to encode: %w", p.noImage())
 	}
 
-	if quality <= 0 || quality > 100 {
-		quality = 85
+	if opts.Quality < 1 || opts.Quality > 100 {
+		return nil, fmt.Errorf("quality must be between 1 and 100, got %d", opts.Quality)
+	}
+
+	anim, err := p.prepareFrames(format)
+	if err != nil {
+		return nil, err
+	}
+	strip, err := p.keepMetadata(opts.Keep)
+	if err != nil {
+		return nil, err
+	}
+	// Removing metadata mustn't take the animation timing with it
+	if err := anim.restore(p.img); err != nil {
+		return nil, err
 	}
 
 	switch format {
 	case FormatJPEG:
+		jpeg := defaultJPEGOptions
+		if opts.JPEG != nil {
+			jpeg = *opts.JPEG
+		}
 		params := vips.NewJpegExportParams()
-		params.Quality = quality
+		params.Quality = opts.Quality
 		params.OptimizeCoding = true
-		params.Interlace = true
-		params.StripMetadata = true
+		params.Interlace = jpeg.Progressive
+		if opts.Progressive != nil {
+			params.Interlace = *opts.Progressive
+		}
+		if opts.Subsample != 0 {
+			jpeg.Subsample = opts.Subsample
+		}
+		if jpeg.Subsample != 0 {
+			params.SubsampleMode = jpeg.Subsample
+		}
+		params.StripMetadata = strip
 		buf, _, err := p.img.ExportJpeg(params)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode JPEG: %w", err)
@@ -545,6 +1855,23 @@ func (p *Processor) ToBytes(format Format, quality int) ([]byte, error) {
 
 	case FormatPNG:
 		params := vips.NewPngExportParams()
+		params.Compression = defaultPNGOptions.Compression
+		params.Interlace = defaultPNGOptions.Interlace
+		if opts.PNG != nil {
+			params.Compression = opts.PNG.Compression
+			params.Interlace = opts.PNG.Interlace
+		}
+		if opts.Progressive != nil {
+			params.Interlace = *opts.Progressive
+		}
+		if opts.PNGCompression > 0 {
+			params.Compression = opts.PNGCompression
+		}
+		if opts.PNGColors > 0 {
+			params.Palette = true
+			params.Bitdepth = paletteBitdepth(opts.PNGColors)
+		}
+		params.StripMetadata = strip
 		buf, _, err := p.img.ExportPng(params)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode PNG: %w", err)
@@ -561,10 +1888,17 @@ func (p *Processor) ToBytes(format Format, quality int) ([]byte, error) {
 
 	case FormatWebP:
 		params := vips.NewWebpExportParams()
-		params.Quality = quality
-		params.Lossless = false
-		params.StripMetadata = true
-		params.ReductionEffort = 4 // Optimal balance for speed
+		params.Quality = opts.Quality
+		params.Lossless = opts.Lossless
+		params.NearLossless = opts.NearLossless
+		params.StripMetadata = strip
+		params.ReductionEffort = defaultWebPOptions.Effort
+		if opts.WebP != nil {
+			params.ReductionEffort = opts.WebP.Effort
+		}
+		if opts.Effort > 0 {
+			params.ReductionEffort = opts.Effort
+		}
 		buf, _, err := p.img.ExportWebp(params)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode WebP: %w", err)
@@ -573,24 +1907,155 @@ func (p *Processor) ToBytes(format Format, quality int) ([]byte, error) {
 
 	case FormatAVIF:
 		params := vips.NewAvifExportParams()
-		params.Quality = quality
-		params.Speed = 6 // Fast encoding, good compression
-		params.StripMetadata = true
-		params.Lossless = false
+		params.Quality = opts.Quality
+		params.Speed = defaultAVIFOptions.Speed
+		if opts.AVIF != nil {
+			params.Speed = opts.AVIF.Speed
+		}
+		params.StripMetadata = strip
+		params.Lossless = opts.Lossless
 		buf, _, err := p.img.ExportAvif(params)
 		if err != nil {
 			return nil, fmt.Errorf("failed to encode AVIF: %w", err)
 		}
 		return buf, nil
 
+	case FormatHEIF:
+		// The HEIF saver has no strip option
+		if strip {
+			if err := p.img.RemoveMetadata(); err != nil {
+				return nil, fmt.Errorf("failed to remove metadata: %w", err)
+			}
+		}
+		params := vips.NewHeifExportParams()
+		params.Quality = opts.Quality
+		params.Lossless = opts.Lossless
+		buf, _, err := p.img.ExportHeif(params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode HEIF: %w", err)
+		}
+		return buf, nil
+
+	case FormatTIFF:
+		params := vips.NewTiffExportParams()
+		params.Compression = vips.TiffCompressionNone
+		switch opts.TIFFCompression {
+		case TIFFCompressionLZW:
+			params.Compression = vips.TiffCompressionLzw
+		case TIFFCompressionDeflate:
+			params.Compression = vips.TiffCompressionDeflate
+		}
+		params.StripMetadata = strip
+		buf, _, err := p.img.ExportTiff(params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode TIFF: %w", err)
+		}
+		return buf, nil
+
+	case FormatJXL:
+		// The JXL saver has no strip option either
+		if strip {
+			if err := p.img.RemoveMetadata(); err != nil {
+				return nil, fmt.Errorf("failed to remove metadata: %w", err)
+			}
+		}
+		params := vips.NewJxlExportParams()
+		params.Quality = opts.Quality
+		params.Lossless = opts.Lossless
+		buf, _, err := p.img.ExportJxl(params)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode JXL: %w", err)
+		}
+		return buf, nil
+
 	default:
 		return nil, fmt.Errorf("unsupported format: %s", format)
 	}
 }
 
+// paletteBitdepth returns the smallest PNG palette bit depth holding the given colors.
+func paletteBitdepth(colors int) int {
+	switch {
+	case colors <= 2:
+		return 1
+	case colors <= 4:
+		return 2
+	case colors <= 16:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// maxBudgetAttempts caps the encodes ToBytesWithBudget spends searching for a quality.
+const maxBudgetAttempts = 5
+
+// ToBytesWithBudget encodes the image at the highest quality whose output is at most
+// maxBytes, binary searching over quality with up to maxBudgetAttempts encodes, and
+// returns the quality used. If no quality fits, it returns the smallest result
+// (trying quality 1 if the search didn't). Lossless formats (PNG, GIF) are encoded once.
+func (p *Processor) ToBytesWithBudget(format Format, maxBytes int) ([]byte, int, error) {
+	return p.toBytesWithBudget(format, EncodeOptions{}, maxBytes)
+}
+
+// toBytesWithBudget is ToBytesWithBudget with the other encoder options of opts.
+func (p *Processor) toBytesWithBudget(format Format, opts EncodeOptions, maxBytes int) ([]byte, int, error) {
+	if maxBytes <= 0 {
+		return nil, 0, fmt.Errorf("byte budget must be positive, got %d", maxBytes)
+	}
+	if !format.HasQuality() || (opts.Lossless && !opts.NearLossless) {
+		opts.Quality = 100
+		buf, err := p.ToBytesWithOptions(format, opts)
+		return buf, opts.Quality, err
+	}
+
+	var best, smallest []byte
+	bestQuality, smallestQuality := 0, 0
+	encode := func(quality int) error {
+		opts.Quality = quality
+		buf, err := p.ToBytesWithOptions(format, opts)
+		if err != nil {
+			return err
+		}
+		if smallest == nil || len(buf) < len(smallest) {
+			smallest, smallestQuality = buf, quality
+		}
+		if len(buf) <= maxBytes && quality > bestQuality {
+			best, bestQuality = buf, quality
+		}
+		return nil
+	}
+
+	lo, hi := 1, 100
+	for attempt := 0; attempt < maxBudgetAttempts && lo <= hi; attempt++ {
+		quality := (lo + hi + 1) / 2
+		if err := encode(quality); err != nil {
+			return nil, 0, err
+		}
+		if bestQuality == quality {
+			lo = quality + 1
+		} else {
+			hi = quality - 1
+		}
+	}
+
+	if best == nil && smallestQuality != 1 {
+		if err := encode(1); err != nil {
+			return nil, 0, err
+		}
+	}
+	if best != nil {
+		return best, bestQuality, nil
+	}
+	return smallest, smallestQuality, nil
+}
+
 // Close closes the internal image reference and frees memory.
 // It's recommended to call this method after you're done with the Processor.
+// Calling it again is harmless; any other use afterwards fails with ErrClosed.
 func (p *Processor) Close() {
+	defer p.lock()()
+	p.closed = true
 	if p.img != nil {
 		p.img.Close()
 		p.img = nil
@@ -599,8 +2064,20 @@ func (p *Processor) Close() {
 	p.originalData = nil
 }
 
+// noImage returns the error for an operation finding no image: ErrClosed after
+// Close, ErrNoImage before anything was loaded.
+func (p *Processor) noImage() error {
+	if p.closed {
+		return ErrClosed
+	}
+	return ErrNoImage
+}
+
 // Err returns the processor's error (if any).
-func (p *Processor) Err() error { return p.err }
+func (p *Processor) Err() error {
+	defer p.lock()()
+	return p.err
+}
 
 // OriginalFormat returns the detected original format of the image.
 func (p *Processor) OriginalFormat() Format { return p.originalFormat }
@@ -608,17 +2085,94 @@ func (p *Processor) OriginalFormat() Format { return p.originalFormat }
 // OriginalSize returns the size of the original image in bytes.
 func (p *Processor) OriginalSize() int { return p.originalSize }
 
-// OriginalBytes returns the original image bytes if available.
+// OriginalBytes returns the original image bytes if KeepOriginal was set before
+// FromBytes, nil otherwise.
 func (p *Processor) OriginalBytes() []byte { return p.originalData }
 
 // ImageRef returns the underlying vips.ImageRef for direct manipulation.
 // This allows users to apply any libvips function not directly exposed by IPXpress.
 // Important: The returned ImageRef is managed by the Processor and will be closed
-// when the Processor is closed. Do not manually close it.
+// when the Processor is closed. Do not manually close it. It's nil before an image
+// is loaded and after Close.
 func (p *Processor) ImageRef() *vips.ImageRef {
+	defer p.lock()()
 	return p.img
 }
 
+// The accessors below describe the image after the operations applied so far,
+// and return zero values if no image is loaded or an error is pending, so they
+// can be called mid-chain without checking Err first.
+
+// Width returns the current width of the image in pixels.
+func (p *Processor) Width() int {
+	defer p.lock()()
+	if p.err != nil || p.img == nil {
+		return 0
+	}
+	return p.img.Width()
+}
+
+// Height returns the current height of the image in pixels. For animations
+// loaded with Animated it is the height of one frame, not of the whole stack.
+func (p *Processor) Height() int {
+	defer p.lock()()
+	if p.err != nil || p.img == nil {
+		return 0
+	}
+	frameHeight, _ := frames(p.img)
+	return frameHeight
+}
+
+// HasAlpha reports whether the image currently has an alpha channel.
+func (p *Processor) HasAlpha() bool {
+	defer p.lock()()
+	return p.err == nil && p.img != nil && p.img.HasAlpha()
+}
+
+// Bands returns the current number of bands (channels), alpha included.
+func (p *Processor) Bands() int {
+	defer p.lock()()
+	if p.err != nil || p.img == nil {
+		return 0
+	}
+	return p.img.Bands()
+}
+
+// Pages returns the number of frames loaded into the image: 1 for still images,
+// and for animations unless Animated was set.
+func (p *Processor) Pages() int {
+	defer p.lock()()
+	if p.err != nil || p.img == nil {
+		return 0
+	}
+	_, n := frames(p.img)
+	return n
+}
+
+// ImageMetadata is a snapshot of the accessors of a Processor, see Processor.Metadata.
+type ImageMetadata struct {
+	Width    int
+	Height   int // of one frame
+	Bands    int
+	HasAlpha bool
+	Pages    int
+}
+
+// Metadata returns a snapshot of the image's current dimensions and channels,
+// or the zero ImageMetadata if no image is loaded or an error is pending.
+func (p *Processor) Metadata() ImageMetadata {
+	if p.err != nil || p.img == nil {
+		return ImageMetadata{}
+	}
+	return ImageMetadata{
+		Width:    p.Width(),
+		Height:   p.Height(),
+		Bands:    p.Bands(),
+		HasAlpha: p.HasAlpha(),
+		Pages:    p.Pages(),
+	}
+}
+
 // ApplyFunc applies a custom function to the image.
 // The function receives the current ImageRef and should return an error if the operation fails.
 // This is useful for applying libvips functions that IPXpress doesn't directly expose.
@@ -629,11 +2183,12 @@ func (p *Processor) ImageRef() *vips.ImageRef {
 //	    return img.Sharpen(1.5, 0.5)
 //	})
 func (p *Processor) ApplyFunc(fn func(*vips.ImageRef) error) *Processor {
-	if p.err != nil {
+	defer p.lock()()
+	if p.err != nil || p.canceled() {
 		return p
 	}
 	if p.img == nil {
-		p.err = errors.New("no image loaded")
+		p.err = p.noImage()
 		return p
 	}
 
@@ -0,0 +1,226 @@
+package ipxpress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrMemoryBudget is returned (wrapped) when a reservation doesn't fit the memory
+// budget within the queue timeout. The handler maps it to 503.
+var ErrMemoryBudget = errors.New("memory budget exceeded")
+
+// Memory reservation purposes, reported in MemoryStats.Usage.
+const (
+	MemoryFetch  = "fetch"  // origin bodies being read or held for processing
+	MemoryDecode = "decode" // estimated libvips working set of images being processed
+	MemoryCache  = "cache"  // bytes held by the cache
+)
+
+// memoryPoll is how often waiters re-check tracked usage (e.g. the cache shrinking
+// by eviction), which doesn't wake them like a release does.
+const memoryPoll = 25 * time.Millisecond
+
+// MemoryAccountant caps the bytes in flight across fetch buffers, decoding and the
+// cache (see Config.MemoryBudget). Transient buffers are reserved before they're
+// allocated and released when done; long-lived usage such as the cache is tracked
+// by polling its size. A reservation that doesn't fit waits for others to be
+// released, up to the queue timeout. It's safe for concurrent use.
+type MemoryAccountant struct {
+	budget  int64
+	timeout time.Duration
+
+	mu       sync.Mutex
+	reserved map[string]int64
+	total    int64
+	tracked  map[string]func() int64
+	wake     chan struct{} // closed and replaced on every release
+	peak     int64
+	waiting  int
+	waited   int64
+	rejected int64
+}
+
+// MemoryStats is a snapshot of a MemoryAccountant.
+type MemoryStats struct {
+	Budget   int64            `json:"budget"`
+	InUse    int64            `json:"in_use"`
+	Usage    map[string]int64 `json:"usage"` // by purpose: fetch, decode, cache
+	Peak     int64            `json:"peak"`
+	Waiting  int              `json:"waiting"`
+	Waited   int64            `json:"waited"`   // reservations that had to queue
+	Rejected int64            `json:"rejected"` // reservations that timed out or could never fit
+}
+
+// NewMemoryAccountant returns an accountant for budget bytes whose reservations
+// wait at most queueTimeout for room.
+func NewMemoryAccountant(budget int64, queueTimeout time.Duration) *MemoryAccountant {
+	return &MemoryAccountant{
+		budget:   budget,
+		timeout:  queueTimeout,
+		reserved: map[string]int64{},
+		tracked:  map[string]func() int64{},
+		wake:     make(chan struct{}),
+	}
+}
+
+// Track counts usage() against the budget under purpose, for memory the accountant
+// doesn't hand out itself, such as the cache.
+func (a *MemoryAccountant) Track(purpose string, usage func() int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tracked[purpose] = usage
+}
+
+// inUse returns the reserved and tracked bytes. a.mu must be held.
+func (a *MemoryAccountant) inUse() int64 {
+	used := a.total
+	for _, usage := range a.tracked {
+		used += usage()
+	}
+	return used
+}
+
+// Reserve charges n bytes to purpose, waiting until they fit the budget, ctx is done
+// or the queue timeout passes. It fails at once if n alone exceeds the budget. The
+// returned release must be called when the memory is no longer used; calling it
+// more than once is harmless.
+func (a *MemoryAccountant) Reserve(ctx context.Context, purpose string, n int64) (release func(), err error) {
+	if n <= 0 {
+		return func() {}, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if n > a.budget {
+		a.rejected++
+		return nil, fmt.Errorf("%w: %d bytes requested, budget is %d", ErrMemoryBudget, n, a.budget)
+	}
+
+	var deadline <-chan time.Time
+	if a.timeout > 0 {
+		timer := time.NewTimer(a.timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	queued := false
+	for a.inUse()+n > a.budget {
+		if !queued {
+			queued = true
+			a.waited++
+		}
+		a.waiting++
+		wake := a.wake
+		a.mu.Unlock()
+		var expired bool
+		select {
+		case <-wake:
+		case <-time.After(memoryPoll):
+		case <-deadline:
+			expired = true
+		case <-ctx.Done():
+			expired = true
+		}
+		a.mu.Lock()
+		a.waiting--
+		if expired {
+			a.rejected++
+			return nil, fmt.Errorf("%w: %d bytes requested, %d of %d in use", ErrMemoryBudget, n, a.inUse(), a.budget)
+		}
+	}
+
+	a.reserved[purpose] += n
+	a.total += n
+	a.peak = max(a.peak, a.inUse())
+	return sync.OnceFunc(func() { a.release(purpose, n) }), nil
+}
+
+// release returns n bytes of purpose and wakes the waiters.
+func (a *MemoryAccountant) release(purpose string, n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reserved[purpose] -= n
+	a.total -= n
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+// Stats returns the current usage and the totals since the accountant was created.
+func (a *MemoryAccountant) Stats() MemoryStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage := make(map[string]int64, len(a.reserved)+len(a.tracked))
+	for purpose, n := range a.reserved {
+		usage[purpose] = n
+	}
+	for purpose, fn := range a.tracked {
+		usage[purpose] += fn()
+	}
+	return MemoryStats{
+		Budget:   a.budget,
+		InUse:    a.inUse(),
+		Usage:    usage,
+		Peak:     a.peak,
+		Waiting:  a.waiting,
+		Waited:   a.waited,
+		Rejected: a.rejected,
+	}
+}
+
+// newMemoryAccountant builds the accountant for Config.MemoryBudget, tracking the
+// cache if it reports its usage.
+func newMemoryAccountant(config *Config, cache Cache) *MemoryAccountant {
+	a := NewMemoryAccountant(config.MemoryBudget, memoryQueueTimeout(config))
+	if usage, ok := cache.(interface{ MemoryUsage() int64 }); ok {
+		a.Track(MemoryCache, usage.MemoryUsage)
+		if config.Cache == nil && int64(config.CacheMaxCost) >= config.MemoryBudget {
+			slog.Warn("cache may fill the whole memory budget", "cache_max_cost", config.CacheMaxCost, "memory_budget", config.MemoryBudget)
+		}
+	}
+	return a
+}
+
+// memoryQueueTimeout applies the default of Config.MemoryQueueTimeout.
+func memoryQueueTimeout(config *Config) time.Duration {
+	if config.MemoryQueueTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return config.MemoryQueueTimeout
+}
+
+// MemoryStats returns the memory accountant's state, or zero stats if
+// Config.MemoryBudget is unset.
+func (h *Handler) MemoryStats() MemoryStats {
+	if h.memory == nil {
+		return MemoryStats{}
+	}
+	return h.memory.Stats()
+}
+
+// decodeEstimate is the working set charged for decoding an image: the decoded
+// pixels twice over, for the intermediate images of the pipeline.
+func decodeEstimate(width, height, frames, bands, sampleSize int) int64 {
+	return 2 * int64(width) * int64(height) * int64(max(frames, 1)) * int64(bands) * int64(sampleSize)
+}
+
+// reserveDecode returns a Processor.ReserveDecode hook charging the decode estimate
+// to the memory budget, and the function releasing it once the image is encoded.
+// Both are no-ops without a budget.
+func (h *Handler) reserveDecode() (func(int64) error, func()) {
+	if h.memory == nil {
+		return nil, func() {}
+	}
+	var release func()
+	reserve := func(n int64) error {
+		var err error
+		release, err = h.memory.Reserve(context.Background(), MemoryDecode, n)
+		return err
+	}
+	return reserve, func() {
+		if release != nil {
+			release()
+		}
+	}
+}
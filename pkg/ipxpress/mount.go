@@ -0,0 +1,57 @@
+package ipxpress
+
+import (
+	"net/http"
+	"strings"
+)
+
+// allowedMethods is the Allow header of OPTIONS requests to image handlers.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// Mount registers h on mux at prefix, e.g. "/ipx". The prefix is stripped from
+// the path and served with and without a trailing slash; "" and "/" mount h at
+// the root. Only GET, HEAD (which http.ServeMux routes to GET patterns) and
+// OPTIONS reach h, other methods get 405 from mux. It panics like mux.Handle if
+// the patterns conflict with ones already registered.
+func Mount(mux *http.ServeMux, prefix string, h *Handler) {
+	prefix = strings.Trim(prefix, "/")
+	var handler http.Handler = h
+	patterns := []string{"/"}
+	if prefix != "" {
+		handler = http.StripPrefix("/"+prefix, handler)
+		patterns = []string{"/" + prefix, "/" + prefix + "/"}
+	}
+	for _, pattern := range patterns {
+		mux.Handle("GET "+pattern, handler)
+		mux.Handle("OPTIONS "+pattern, handler)
+	}
+}
+
+// route returns the path of r relative to where the handler is mounted, without
+// slashes around it: "info" for /ipx/info. Behind http.StripPrefix that's the
+// path itself; mounted on an http.ServeMux without it, the literal part of the
+// matched pattern (r.Pattern) is removed first.
+func route(r *http.Request) string {
+	path := r.URL.Path
+	if prefix := patternPrefix(r.Pattern); strings.HasPrefix(path, prefix) {
+		path = path[len(prefix):]
+	}
+	return strings.Trim(path, "/")
+}
+
+// patternPrefix returns the path of an http.ServeMux pattern up to its first
+// wildcard, without method or host: "/ipx/" for "GET example.com/ipx/{rest...}".
+func patternPrefix(pattern string) string {
+	if _, rest, ok := strings.Cut(pattern, " "); ok {
+		pattern = strings.TrimLeft(rest, " \t")
+	}
+	i := strings.IndexByte(pattern, '/')
+	if i < 0 {
+		return ""
+	}
+	pattern = pattern[i:]
+	if j := strings.IndexByte(pattern, '{'); j >= 0 {
+		pattern = pattern[:j]
+	}
+	return pattern
+}
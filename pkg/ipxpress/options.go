@@ -0,0 +1,73 @@
+package ipxpress
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// SourceFetcher retrieves source images (and overlays) for a Handler. Fetcher
+// implements it over HTTP; WithFetcher replaces it, e.g. with a fake in tests
+// or one reading from object storage.
+type SourceFetcher interface {
+	// FetchReserved returns the whole body of imageURL. release frees what the
+	// body was charged to a memory budget, if anything, and is never nil.
+	// Errors should be *FetchError to choose the response status.
+	FetchReserved(ctx context.Context, imageURL string) (data []byte, release func(), err error)
+
+	// Open returns the response for imageURL with its body unread, for
+	// streaming large passthroughs. header is merged into the request (e.g. Range).
+	Open(ctx context.Context, imageURL string, header http.Header) (*http.Response, error)
+
+	// HostAllowed reports whether images may be fetched from host; it vets
+	// DefaultImageRedirect targets.
+	HostAllowed(host string) bool
+}
+
+var _ SourceFetcher = (*Fetcher)(nil)
+
+// HandlerOption replaces one of a Handler's collaborators, see NewHandler.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	cache   Cache
+	fetcher SourceFetcher
+	logger  *slog.Logger
+	now     func() time.Time
+
+	// Set by NewTenantHandler for the handlers of its tenants
+	tenant *tenantShare
+}
+
+// WithCache makes the handler store responses in c, taking precedence over
+// Config.Cache.
+func WithCache(c Cache) HandlerOption {
+	return func(o *handlerOptions) { o.cache = c }
+}
+
+// WithFetcher makes the handler get source images from f instead of a Fetcher
+// built from Config.Fetcher. Config.AllowedHosts and Config.MemoryBudget are
+// only applied to the built-in Fetcher, so f has to enforce its own limits.
+func WithFetcher(f SourceFetcher) HandlerOption {
+	return func(o *handlerOptions) { o.fetcher = f }
+}
+
+// WithLogger makes the handler log to l instead of slog.Default().
+func WithLogger(l *slog.Logger) HandlerOption {
+	return func(o *handlerOptions) { o.logger = l }
+}
+
+// WithClock makes the handler read the time from now, for cache timestamps,
+// TTL schedules and signature expiry; it takes precedence over Config.Now.
+func WithClock(now func() time.Time) HandlerOption {
+	return func(o *handlerOptions) { o.now = now }
+}
+
+// log returns the handler's logger.
+func (h *Handler) log() *slog.Logger {
+	if h.logger != nil {
+		return h.logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,125 @@
+package ipxpress
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OriginPolicy is how long an origin allows a source to be cached, from the
+// Cache-Control and Expires headers it was served with.
+type OriginPolicy struct {
+	// NoStore is set when the origin forbids caching the source: no-store,
+	// private, no-cache, or a freshness lifetime already over.
+	NoStore bool
+
+	// MaxAge is the source's remaining freshness lifetime, 0 if the origin
+	// didn't give one.
+	MaxAge time.Duration
+}
+
+// PolicyFetcher is implemented by fetchers that report the origin's caching
+// policy, used with Config.HonorOriginCacheControl. Fetcher implements it.
+type PolicyFetcher interface {
+	// FetchWithPolicy is FetchReserved also returning the source's OriginPolicy.
+	FetchWithPolicy(ctx context.Context, imageURL string) (data []byte, policy OriginPolicy, release func(), err error)
+}
+
+var _ PolicyFetcher = (*Fetcher)(nil)
+
+// ParseOriginPolicy reads the caching policy of a response with header,
+// received at now. As for a shared cache, s-maxage takes precedence over
+// max-age, which takes precedence over Expires; Age is subtracted.
+func ParseOriginPolicy(header http.Header, now time.Time) OriginPolicy {
+	var policy OriginPolicy
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(strings.Join(header.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "private", "no-cache":
+			policy.NoStore = true
+		case "max-age":
+			maxAge = parseDeltaSeconds(value)
+		case "s-maxage":
+			sMaxAge = parseDeltaSeconds(value)
+		}
+	}
+	if policy.NoStore {
+		return policy
+	}
+
+	var lifetime time.Duration
+	switch {
+	case sMaxAge >= 0:
+		lifetime = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		lifetime = time.Duration(maxAge) * time.Second
+	case header.Get("Expires") != "":
+		// An invalid Expires, such as "0", means already expired
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return OriginPolicy{NoStore: true}
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expires.Sub(date)
+	default:
+		return policy
+	}
+	if age := parseDeltaSeconds(header.Get("Age")); age > 0 {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	if lifetime < time.Second {
+		return OriginPolicy{NoStore: true}
+	}
+	policy.MaxAge = lifetime
+	return policy
+}
+
+// parseDeltaSeconds parses a delta-seconds value, -1 if it's invalid.
+func parseDeltaSeconds(value string) int {
+	n, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// fetchSource fetches a source image for processing, with the origin's policy
+// when Config.HonorOriginCacheControl is set and the fetcher reports it.
+func (h *Handler) fetchSource(ctx context.Context, imageURL string) ([]byte, OriginPolicy, func(), error) {
+	if pf, ok := h.fetcher.(PolicyFetcher); ok && h.config.HonorOriginCacheControl {
+		return pf.FetchWithPolicy(ctx, imageURL)
+	}
+	data, release, err := h.fetcher.FetchReserved(ctx, imageURL)
+	return data, OriginPolicy{}, release, err
+}
+
+// applyOriginPolicy records the policy of the source an entry was made from at
+// now, for storeEntry and the Cache-Control sent to clients.
+func (e *CacheEntry) applyOriginPolicy(policy OriginPolicy, now time.Time) {
+	if policy.MaxAge > 0 {
+		e.originExpires = now.Add(policy.MaxAge)
+	}
+	e.noStore = e.noStore || policy.NoStore // a processor's Response may forbid it too
+}
+
+// clientPolicy returns the origin's policy for an entry as it stands now, for
+// the Cache-Control sent to clients, or nil if the origin didn't restrict it.
+func (h *Handler) clientPolicy(entry *CacheEntry) *OriginPolicy {
+	if entry.noStore {
+		return &OriginPolicy{NoStore: true}
+	}
+	if entry.originExpires.IsZero() {
+		return nil
+	}
+	left := entry.originExpires.Sub(h.now())
+	if left < 0 {
+		left = 0 // served stale
+	}
+	return &OriginPolicy{MaxAge: left}
+}
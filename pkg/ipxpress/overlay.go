@@ -0,0 +1,82 @@
+package ipxpress
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// Composite draws the encoded overlay image over the current image with its top-left
+// corner at (x, y). Parts of the overlay outside the image are clipped.
+// Opaque images stay opaque, so the result can still be saved as JPEG.
+func (p *Processor) Composite(overlay []byte, x, y int, blendMode vips.BlendMode) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	p.err = compositeOverlay(p.img, overlay, p.maxPixels, 0, func(int, int) (int, int) { return x, y }, blendMode)
+	if p.err != nil {
+		p.err = fmt.Errorf("failed to composite overlay: %w", p.err)
+	}
+
+	return p
+}
+
+// compositeOverlay decodes the overlay, refusing one over maxPixels like a
+// source, scales it to width pixels (if > 0) and draws it over img at the offset
+// returned by place for the scaled overlay size.
+func compositeOverlay(img *vips.ImageRef, overlay []byte, maxPixels, width int, place func(w, h int) (int, int), mode vips.BlendMode) error {
+	ov, err := vips.NewImageFromBuffer(overlay)
+	if err != nil {
+		return fmt.Errorf("failed to decode overlay: %w", err)
+	}
+	defer ov.Close()
+	// Only the header is read so far
+	if err := checkPixels(ov, maxPixels); err != nil {
+		return err
+	}
+
+	if width > 0 && width != ov.Width() {
+		if err := ov.Resize(float64(width)/float64(ov.Width()), vips.KernelLanczos3); err != nil {
+			return err
+		}
+	}
+	if err := ov.AddAlpha(); err != nil {
+		return err
+	}
+
+	hadAlpha := img.HasAlpha()
+	x, y := place(ov.Width(), ov.Height())
+	if err := img.Composite(ov, mode, x, y); err != nil {
+		return err
+	}
+
+	// Compositing an alpha overlay adds an alpha band; drop it again for opaque images
+	if !hadAlpha && img.HasAlpha() {
+		return img.Flatten(nil)
+	}
+	return nil
+}
+
+// overlayOffset resolves an overlay_pos value: either "X_Y" in pixels or a gravity
+// name as accepted by WatermarkOptions.Gravity. Empty defaults to centre.
+func overlayOffset(pos string, outerW, outerH, innerW, innerH int) (int, int) {
+	if pos == "" {
+		pos = "centre"
+	}
+	if parts := strings.SplitN(pos, "_", 3); len(parts) == 2 {
+		x, errX := strconv.Atoi(parts[0])
+		y, errY := strconv.Atoi(parts[1])
+		if errX == nil && errY == nil {
+			return x, y
+		}
+	}
+	return gravityOffset(pos, outerW, outerH, innerW, innerH, 0)
+}
@@ -1,164 +1,192 @@
 package ipxpress
 
 import (
+	"cmp"
 	"net/http"
-	"strconv"
+	"net/url"
 	"strings"
 
 	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
 )
 
 // ProcessingParams contains all parameters for image processing.
-type ProcessingParams struct {
-	URL     string
-	Width   int
-	Height  int
-	Quality int
-	Format  Format
-
-	// Resize options
-	Fit      string // contain, cover, fill, inside, outside
-	Position string // top, bottom, left, right, centre, etc.
-	Kernel   string // nearest, cubic, mitchell, lanczos2, lanczos3
-	Enlarge  bool   // allow upscaling
-
-	// Operations
-	Blur      float64 // blur sigma
-	Sharpen   string  // sigma_flat_jagged (e.g., "1.5_1_2")
-	Rotate    int     // rotation angle
-	Flip      bool    // flip vertically
-	Flop      bool    // flip horizontally
-	Grayscale bool    // convert to grayscale
-
-	// Cropping and extending
-	Extract string // left_top_width_height
-	Trim    int    // trim threshold
-	Extend  string // top_right_bottom_left
-
-	// Color operations
-	Background string  // background color (hex)
-	Negate     bool    // invert colors
-	Normalize  bool    // normalize image
-	Threshold  int     // threshold value
-	Tint       string  // tint color (hex)
-	Gamma      float64 // gamma correction
-	Median     int     // median filter size
-	Modulate   string  // brightness_saturation_hue
-	Flatten    bool    // remove alpha channel
-}
+// It has the same fields as core.ProcessingParams and converts to it freely;
+// this package adds the libvips-specific accessors.
+type ProcessingParams core.ProcessingParams
 
-// ParseProcessingParams extracts processing parameters from HTTP request.
-// Supports both long and short parameter names (compatible with ipx v2):
-// - w/width, h/height, f/format, q/quality, s/resize, b/background, pos/position
-func ParseProcessingParams(r *http.Request) *ProcessingParams {
-	q := r.URL.Query()
-
-	// Helper to get parameter with fallback to short alias
-	getParam := func(long, short string) string {
-		if val := q.Get(short); val != "" {
-			return val
-		}
-		return q.Get(long)
-	}
+// ParamError describes a query parameter whose value was rejected.
+type ParamError = core.ParamError
 
-	// Parse resize parameter (s=WIDTHxHEIGHT format)
-	var width, height int
-	if resize := getParam("resize", "s"); resize != "" {
-		parts := strings.Split(resize, "x")
-		if len(parts) == 2 {
-			width = parseInt(parts[0])
-			height = parseInt(parts[1])
-		}
-	}
-	// Override with explicit w/h if provided
-	if w := getParam("width", "w"); w != "" {
-		width = parseInt(w)
-	}
-	if h := getParam("height", "h"); h != "" {
-		height = parseInt(h)
-	}
+// Length is a size or coordinate in pixels or percent, see core.ParseLength.
+type Length = core.Length
 
-	params := &ProcessingParams{
-		URL:     q.Get("url"),
-		Width:   width,
-		Height:  height,
-		Quality: parseInt(getParam("quality", "q")),
-		Format:  ParseFormat(getParam("format", "f")),
-
-		// Resize options
-		Fit:      q.Get("fit"),
-		Position: getParam("position", "pos"),
-		Kernel:   q.Get("kernel"),
-		Enlarge:  parseBool(q.Get("enlarge")),
-
-		// Operations
-		Blur:      parseFloat(q.Get("blur")),
-		Sharpen:   q.Get("sharpen"),
-		Rotate:    parseInt(q.Get("rotate")),
-		Flip:      parseBool(q.Get("flip")),
-		Flop:      parseBool(q.Get("flop")),
-		Grayscale: parseBool(q.Get("grayscale")),
-
-		// Cropping and extending
-		Extract: q.Get("extract"),
-		Trim:    parseInt(q.Get("trim")),
-		Extend:  q.Get("extend"),
-
-		// Color operations
-		Background: getParam("background", "b"),
-		Negate:     parseBool(q.Get("negate")),
-		Normalize:  parseBool(q.Get("normalize")),
-		Threshold:  parseInt(q.Get("threshold")),
-		Tint:       q.Get("tint"),
-		Gamma:      parseFloat(q.Get("gamma")),
-		Median:     parseInt(q.Get("median")),
-		Modulate:   q.Get("modulate"),
-		Flatten:    parseBool(q.Get("flatten")),
-	}
+// RGBA is a color with 8-bit channels, see ParseColor.
+type RGBA = core.RGBA
 
-	// Set default quality if not specified or invalid
-	if params.Quality <= 0 || params.Quality > 100 {
-		params.Quality = 85
-	}
+// ParseColor parses a color parameter: hex rgb, rrggbb or rrggbbaa with or
+// without #, transparent, or a CSS basic color name such as navy.
+func ParseColor(s string) (RGBA, error) { return core.ParseColor(s) }
 
-	// Normalize background color
-	if params.Background != "" {
-		params.Background = normalizeHexColor(params.Background)
-	}
+// ConflictRule describes parameters that contradict each other, see core.ConflictRule.
+type ConflictRule = core.ConflictRule
 
-	// Normalize tint color
-	if params.Tint != "" {
-		params.Tint = normalizeHexColor(params.Tint)
-	}
+// RegisterConflict adds a conflict rule checked after the built-in ones.
+func RegisterConflict(rule ConflictRule) { core.RegisterConflict(rule) }
+
+// Metadata kept on output, see ProcessingParams.KeepMetadata.
+const (
+	KeepNone = core.KeepNone
+	KeepEXIF = core.KeepEXIF
+	KeepICC  = core.KeepICC
+	KeepAll  = core.KeepAll
+)
+
+// PlaceholderBlurHash is the BlurHash placeholder, see ProcessingParams.Placeholder.
+const PlaceholderBlurHash = core.PlaceholderBlurHash
+
+// TIFF compressions, see EncodeOptions.TIFFCompression.
+const (
+	TIFFCompressionLZW     = core.TIFFCompressionLZW
+	TIFFCompressionDeflate = core.TIFFCompressionDeflate
+	TIFFCompressionNone    = core.TIFFCompressionNone
+)
+
+// JPEG chroma subsampling, see ProcessingParams.Subsample.
+const (
+	Subsample444 = core.Subsample444
+	Subsample420 = core.Subsample420
+)
+
+// ParamSpec describes a query parameter, see core.ParamSpec. The parameter name
+// constants (core.ParamWidth, core.AliasWidth, ...) live in core, which clients
+// can import without libvips.
+type ParamSpec = core.ParamSpec
+
+// ListParams returns the specs of every query parameter, as served by /ipx/params.
+func ListParams() []ParamSpec { return core.ListParams() }
 
-	return params
+// LookupParam returns the spec of a parameter by name or alias.
+func LookupParam(name string) (ParamSpec, bool) { return core.LookupParam(name) }
+
+// Output format sources reported by ResolveOutputFormat.
+const (
+	FormatSourceRequested = core.FormatSourceRequested
+	FormatSourceOriginal  = core.FormatSourceOriginal
+	FormatSourceDefault   = core.FormatSourceDefault
+	FormatSourceRaster    = core.FormatSourceRaster
+	FormatSourceCompat    = core.FormatSourceCompat
+)
+
+// ParseProcessingParams extracts processing parameters from HTTP request.
+// See core.ParseProcessingParams for the supported parameters.
+func ParseProcessingParams(r *http.Request) *ProcessingParams {
+	return (*ProcessingParams)(core.ParseProcessingParams(r))
+}
+
+// toCore returns p as its core representation.
+func (p *ProcessingParams) toCore() *core.ProcessingParams {
+	return (*core.ProcessingParams)(p)
+}
+
+// ResolveConflicts drops contradictory parameters, returning an error for each.
+func (p *ProcessingParams) ResolveConflicts() []*ParamError {
+	return p.toCore().ResolveConflicts()
 }
 
 // NeedsProcessing returns true if any transformation is requested.
 func (p *ProcessingParams) NeedsProcessing(originalFormat Format) bool {
-	// Check if only format and/or quality change is requested (no actual image processing)
-	hasTransformations := p.Width > 0 || p.Height > 0 ||
-		p.Blur > 0 || p.Sharpen != "" || p.Rotate != 0 ||
-		p.Flip || p.Flop || p.Grayscale ||
-		p.Extract != "" || p.Trim > 0 || p.Extend != "" ||
-		p.Background != "" || p.Negate || p.Normalize ||
-		p.Threshold > 0 || p.Tint != "" || p.Gamma > 0 ||
-		p.Median > 0 || p.Modulate != "" || p.Flatten ||
-		p.Fit != "" || p.Position != "" || p.Kernel != "" || p.Enlarge
+	return p.toCore().NeedsProcessing(originalFormat)
+}
+
+// HasTransformations returns true if any pixel operation is requested.
+// A format or quality change alone is not a transformation.
+func (p *ProcessingParams) HasTransformations() bool {
+	return p.toCore().HasTransformations()
+}
+
+// KeepsAnimation reports whether every frame of an animated source can be kept.
+func (p *ProcessingParams) KeepsAnimation() bool {
+	return p.toCore().KeepsAnimation()
+}
 
-	// Only process if there are actual transformations, or format change requested
-	return hasTransformations || (p.Format != "" && p.Format != originalFormat)
+// Err returns the rejected parameters as a single error, or nil if there were none.
+func (p *ProcessingParams) Err() error {
+	return p.toCore().Err()
+}
+
+// CheckDimensions returns a ParamError if the requested width or height is negative
+// or larger than maxDimension. A maxDimension of 0 disables the upper bound.
+func (p *ProcessingParams) CheckDimensions(maxDimension int) error {
+	return p.toCore().CheckDimensions(maxDimension)
 }
 
 // GetOutputFormat returns the output format, using original format if not specified.
 func (p *ProcessingParams) GetOutputFormat(originalFormat Format) Format {
-	if p.Format == "" {
-		if originalFormat != "" {
-			return originalFormat
-		}
-		return FormatJPEG
+	return p.toCore().GetOutputFormat(originalFormat)
+}
+
+// ResolveOutputFormat is like GetOutputFormat but also reports which rule chose the
+// format (one of the FormatSource constants), so the JPEG fallback is visible.
+func (p *ProcessingParams) ResolveOutputFormat(originalFormat Format) (Format, string) {
+	return p.toCore().ResolveOutputFormat(originalFormat)
+}
+
+// EffectiveQuery returns the values actually used for parameters that have implicit
+// defaults (output format and its source, quality), encoded as a query string.
+func (p *ProcessingParams) EffectiveQuery(originalFormat Format) string {
+	return p.toCore().EffectiveQuery(originalFormat)
+}
+
+// Query encodes p as the query parameters that parse back to it, see core.ProcessingParams.Query.
+func (p *ProcessingParams) Query() url.Values {
+	return p.toCore().Query()
+}
+
+// defaultQuality gives params built in code without a quality the default a
+// query without q gets.
+func (p *ProcessingParams) defaultQuality() {
+	if p.Quality == 0 && !p.QualityAuto {
+		p.Quality = core.DefaultQuality
 	}
-	return p.Format
+}
+
+// EncodeOptions returns the encoder settings requested by the params. A zero
+// Quality, as params built in code often leave it, gets the default a query
+// without q does.
+func (p *ProcessingParams) EncodeOptions() EncodeOptions {
+	opts := EncodeOptions{
+		Quality:         cmp.Or(p.Quality, core.DefaultQuality),
+		Lossless:        p.Lossless,
+		NearLossless:    p.NearLossless,
+		Effort:          p.Effort,
+		PNGCompression:  p.PNGCompression,
+		PNGColors:       p.PNGColors,
+		TIFFCompression: p.TIFFCompression,
+		Keep:            p.KeepMetadata(""),
+	}
+	if p.Progressive != "" {
+		progressive := p.Progressive == "true"
+		opts.Progressive = &progressive
+	}
+	switch p.Subsample {
+	case Subsample444:
+		opts.Subsample = vips.VipsForeignSubsampleOff
+	case Subsample420:
+		opts.Subsample = vips.VipsForeignSubsampleOn
+	}
+	return opts
+}
+
+// HasEncodeOptions returns true if any encoder setting besides quality is requested.
+func (p *ProcessingParams) HasEncodeOptions() bool {
+	return p.toCore().HasEncodeOptions()
+}
+
+// KeepMetadata returns the metadata to keep on output: strip=true wins, then keep=,
+// then serverDefault. An empty result means none.
+func (p *ProcessingParams) KeepMetadata(serverDefault string) string {
+	return p.toCore().KeepMetadata(serverDefault)
 }
 
 // GetVipsKernel converts kernel string to vips.Kernel
@@ -196,52 +224,3 @@ func (p *ProcessingParams) GetVipsInteresting() vips.Interesting {
 		return vips.InterestingNone
 	}
 }
-
-// parseInt is a helper function to parse integer from string.
-func parseInt(s string) int {
-	if s == "" {
-		return 0
-	}
-	v, err := strconv.Atoi(s)
-	if err != nil {
-		return 0
-	}
-	return v
-}
-
-// parseFloat is a helper function to parse float from string.
-func parseFloat(s string) float64 {
-	if s == "" {
-		return 0
-	}
-	v, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		return 0
-	}
-	return v
-}
-
-// parseBool is a helper function to parse boolean from string.
-func parseBool(s string) bool {
-	if s == "" {
-		return false
-	}
-	v, err := strconv.ParseBool(s)
-	if err != nil {
-		return s == "1" || strings.ToLower(s) == "true"
-	}
-	return v
-}
-
-// normalizeHexColor normalizes hex color string
-func normalizeHexColor(color string) string {
-	// Remove # if present
-	color = strings.TrimPrefix(color, "#")
-
-	// Validate hex format
-	if len(color) == 3 || len(color) == 6 {
-		return "#" + color
-	}
-
-	return color
-}
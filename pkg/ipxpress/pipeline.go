@@ -0,0 +1,288 @@
+package ipxpress
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// Pipeline is a transformation compiled once from ProcessingParams, e.g. a
+// "thumb" preset, and run on any number of images. Packed values such as
+// extract or sharpen are parsed when it is built rather than per image. A
+// Pipeline is immutable and safe for concurrent use.
+type Pipeline struct {
+	handler *Handler
+	params  *ProcessingParams
+	steps   []func(*Processor) *Processor
+}
+
+// NewPipeline compiles params under the default configuration. It fails with a
+// *ProcessError if params are invalid or ask for an overlay, which a pipeline
+// can't fetch. Later changes to params don't affect the pipeline.
+//
+//	thumb, err := ipxpress.NewPipeline(&ipxpress.ProcessingParams{
+//		Width: 200, Height: 200, Fit: "cover", Format: ipxpress.FormatWebP, Quality: 75, Strip: true,
+//	})
+func NewPipeline(params *ProcessingParams) (*Pipeline, error) {
+	return defaultHandler().NewPipeline(params)
+}
+
+// NewPipeline is like the top-level NewPipeline but under the handler's
+// configuration and custom processors.
+func (h *Handler) NewPipeline(params *ProcessingParams) (*Pipeline, error) {
+	if params == nil {
+		params = &ProcessingParams{}
+	}
+	if err := params.CheckDimensions(h.config.MaxDimension); err != nil {
+		return nil, &ProcessError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if err := params.Err(); err != nil && h.config.StrictParams {
+		return nil, &ProcessError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	if params.Overlay != "" {
+		return nil, &ProcessError{StatusCode: http.StatusBadRequest, Message: "overlay is not supported by pipelines"}
+	}
+	copied := *params
+	copied.defaultQuality()
+	return h.compile(&copied), nil
+}
+
+// Params returns a copy of the parameters the pipeline was built from.
+func (pl *Pipeline) Params() *ProcessingParams {
+	copied := *pl.params
+	return &copied
+}
+
+// Run processes input and returns the encoded result and its format. With info
+// or placeholder set the result is JSON and the format is empty. Failures are
+// *ProcessError values carrying the status the HTTP handler would have sent.
+func (pl *Pipeline) Run(input []byte) ([]byte, Format, error) {
+	return pl.RunContext(context.Background(), input)
+}
+
+// RunContext is like Run but stops at the next stage once ctx is done, returning
+// an error that wraps ctx.Err().
+func (pl *Pipeline) RunContext(ctx context.Context, input []byte) ([]byte, Format, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", fmt.Errorf("processing abandoned: %w", err)
+	}
+	entry := pl.handler.processImage(ctx, input, nil, pl)
+	if entry.StatusCode != http.StatusOK {
+		if err := ctx.Err(); err != nil {
+			return nil, "", fmt.Errorf("processing abandoned: %w", err)
+		}
+		return nil, "", &ProcessError{StatusCode: entry.StatusCode, Message: entry.errorMessage()}
+	}
+	return entry.Data, DetectFormat(entry.Data), nil
+}
+
+// compile builds the pipeline of params without validating them. params must
+// not change afterwards.
+func (h *Handler) compile(params *ProcessingParams) *Pipeline {
+	pl := &Pipeline{handler: h, params: params}
+	add := func(step func(*Processor) *Processor) {
+		pl.steps = append(pl.steps, step)
+	}
+
+	// Turn upright first, so every coordinate and size below is as the image is viewed
+	if !h.config.DisableAutoOrient && !params.DisableOrient {
+		add(func(p *Processor) *Processor { return p.AutoOrient() })
+	}
+
+	// 0. Pixelate (first, so the region is in source image coordinates). Without
+	// a usable region everything is pixelated, so a redaction never fails open.
+	if params.Pixelate > 1 {
+		if r, ok := packedInts(params.PixelateRegion, 4); ok {
+			add(func(p *Processor) *Processor { return p.PixelateRegion(r[0], r[1], r[2], r[3], params.Pixelate) })
+		} else {
+			add(func(p *Processor) *Processor { return p.Pixelate(params.Pixelate) })
+		}
+	}
+
+	// 1. Extract/Crop (do this first to reduce data to process). Regions past
+	// the edges are cut to the image unless params must be exact.
+	clamp := !h.config.StrictParams
+	if params.Extract != "" {
+		if r, ok := packedLengths(params.Extract, 4); ok {
+			add(func(p *Processor) *Processor { return p.ExtractRegion(r[0], r[1], r[2], r[3], clamp) })
+		}
+	}
+	if params.CropWidth > 0 && params.CropHeight > 0 {
+		add(func(p *Processor) *Processor { return p.CropCenter(params.CropWidth, params.CropHeight, clamp) })
+	}
+
+	// 2. Resize
+	kernel := params.GetVipsKernel()
+	if params.Width > 0 || params.Height > 0 {
+		add(func(p *Processor) *Processor {
+			return p.ResizeWithOptions(params.Width, params.Height, kernel, params.Enlarge)
+		})
+	}
+
+	// Zoom into the resized image, keeping its size
+	if zoom := math.Min(params.Zoom, h.config.MaxZoom); zoom > 1 {
+		add(func(p *Processor) *Processor { return p.Zoom(zoom, params.Position, kernel) })
+	}
+
+	// Letterbox onto the exact requested canvas
+	if (params.Pad || strings.EqualFold(params.Fit, "contain")) && params.Width > 0 && params.Height > 0 {
+		add(func(p *Processor) *Processor { return p.Pad(params.Width, params.Height, canvasColor(params, p)) })
+	}
+
+	// 3. Extend (add borders), placed by position when it names a side
+	if params.Extend != "" {
+		if e, ok := packedInts(params.Extend, 4); ok {
+			if gravity, ok := positionGravity(params.Position); ok {
+				add(func(p *Processor) *Processor {
+					return p.ExtendWithGravity(e[0], e[1], e[2], e[3], gravity, canvasColor(params, p))
+				})
+			} else {
+				add(func(p *Processor) *Processor { return p.Extend(e[0], e[1], e[2], e[3], canvasColor(params, p)) })
+			}
+		}
+	}
+
+	if params.Padding > 0 {
+		n := params.Padding
+		add(func(p *Processor) *Processor { return p.Extend(n, n, n, n, canvasColor(params, p)) })
+	}
+
+	// The border goes outside any padding
+	if params.BorderWidth > 0 {
+		n, color := params.BorderWidth, params.BorderColor
+		if color == "" {
+			color = params.Background
+		}
+		add(func(p *Processor) *Processor { return p.Extend(n, n, n, n, fillColor(color, params, p)) })
+	}
+
+	// 4. Rotate
+	if params.Rotate != 0 {
+		angle := angleToVips(params.Rotate)
+		add(func(p *Processor) *Processor { return p.Rotate(angle) })
+	}
+
+	// 5. Flip/Flop
+	if params.Flip {
+		add((*Processor).Flip)
+	}
+	if params.Flop {
+		add((*Processor).Flop)
+	}
+
+	// 6. Blur
+	if params.Blur > 0 {
+		add(func(p *Processor) *Processor { return p.Blur(params.Blur) })
+	}
+
+	// 7. Sharpen
+	if params.Sharpen != "" {
+		parts := core.SplitPacked(params.Sharpen, 3)
+		sharpen := []float64{1.0, 1.0, 2.0} // sigma, flat, jagged
+		for i, part := range parts {
+			if v, err := strconv.ParseFloat(part, 64); err == nil {
+				sharpen[i] = v
+			}
+		}
+		add(func(p *Processor) *Processor { return p.Sharpen(sharpen[0], sharpen[1], sharpen[2]) })
+	}
+
+	// 8. Color operations
+	if params.Grayscale {
+		add((*Processor).Grayscale)
+	}
+
+	if params.Negate {
+		add((*Processor).Negate)
+	}
+
+	if params.Normalize {
+		add((*Processor).Normalize)
+	}
+
+	if params.Gamma > 0 {
+		add(func(p *Processor) *Processor { return p.Gamma(params.Gamma) })
+	}
+
+	if brightness, saturation, hue, ok := modulation(params); ok {
+		add(func(p *Processor) *Processor { return p.Modulate(brightness, saturation, hue) })
+	}
+
+	if params.Contrast > 0 {
+		add(func(p *Processor) *Processor { return p.Contrast(params.Contrast) })
+	}
+
+	if params.Duotone != "" {
+		if parts := core.SplitPacked(params.Duotone, 2); len(parts) == 2 {
+			add(func(p *Processor) *Processor { return p.Duotone(parts[0], parts[1]) })
+		}
+	}
+
+	if params.Posterize > 1 {
+		add(func(p *Processor) *Processor { return p.Posterize(params.Posterize) })
+	}
+
+	// 9. Rounded corners / circle (after resize so the radius is in output pixels)
+	if params.Radius != "" {
+		if strings.EqualFold(params.Radius, "max") {
+			add((*Processor).Circle)
+		} else if radius, err := strconv.Atoi(params.Radius); err == nil && radius > 0 {
+			add(func(p *Processor) *Processor { return p.RoundCorners(radius) })
+		}
+	}
+
+	// 10. Flatten (remove alpha) on request, and for formats without alpha, which
+	// would drop it and expose whatever transparent pixels hold, such as the corners
+	// cut by radius: against the background color, white by default
+	background := flattenColor(params.Background)
+	add(func(p *Processor) *Processor {
+		if params.Flatten || p.HasAlpha() && !params.GetOutputFormat(p.OriginalFormat()).SupportsAlpha() {
+			return p.Flatten(background)
+		}
+		return p
+	})
+
+	return pl
+}
+
+// apply runs the built-in operations of the pipeline, in order (order matters
+// for image processing).
+func (pl *Pipeline) apply(proc *Processor) *Processor {
+	for _, step := range pl.steps {
+		proc = step(proc)
+	}
+	return proc
+}
+
+// packedLengths parses a packed value of exactly n lengths, e.g. extract's
+// "10p_10p_50p_50p". Unparseable parts are 0.
+func packedLengths(value string, n int) ([]Length, bool) {
+	parts := core.SplitPacked(value, n)
+	if len(parts) != n {
+		return nil, false
+	}
+	lengths := make([]Length, n)
+	for i, part := range parts {
+		lengths[i], _ = core.ParseLength(part)
+	}
+	return lengths, true
+}
+
+// packedInts parses a packed value of exactly n integers, e.g. extract's
+// "left_top_width_height". Unparseable parts are 0.
+func packedInts(value string, n int) ([]int, bool) {
+	parts := core.SplitPacked(value, n)
+	if len(parts) != n {
+		return nil, false
+	}
+	ints := make([]int, n)
+	for i, part := range parts {
+		ints[i], _ = strconv.Atoi(part)
+	}
+	return ints, true
+}
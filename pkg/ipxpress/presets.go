@@ -0,0 +1,83 @@
+package ipxpress
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// RegisterPreset makes params available as ?preset=name, replacing any preset of
+// that name. A request naming a preset is processed with exactly these params:
+// combining it with other parameters is rejected with 400. Use Config.PresetsOnly
+// to allow presets only. Later changes to params don't affect the preset.
+//
+//	handler.RegisterPreset("thumbnail", &ipxpress.ProcessingParams{
+//		Width: 200, Height: 200, Fit: "cover", Format: ipxpress.FormatWebP, Quality: 75,
+//	})
+func (h *Handler) RegisterPreset(name string, params *ProcessingParams) {
+	preset := *params
+	preset.URL, preset.Preset, preset.Profile, preset.Errors = "", name, "", nil
+	if preset.Quality == 0 && !preset.QualityAuto {
+		// The default a query without q gets
+		preset.Quality = core.DefaultQuality
+	}
+
+	h.presetsMu.Lock()
+	defer h.presetsMu.Unlock()
+	if h.presets == nil {
+		h.presets = make(map[string]ProcessingParams)
+	}
+	h.presets[name] = preset
+}
+
+// Presets returns the names of the registered presets, sorted.
+func (h *Handler) Presets() []string {
+	h.presetsMu.RLock()
+	defer h.presetsMu.RUnlock()
+	return slices.Sorted(maps.Keys(h.presets))
+}
+
+// applyPreset replaces params with the preset named in the query, if any. It
+// rejects unknown presets, other parameters next to a preset, and, with
+// Config.PresetsOnly, any parameter but url (signing parameters aside).
+func (h *Handler) applyPreset(q url.Values, params *ProcessingParams) error {
+	var others []string
+	for name := range q {
+		switch name {
+		case core.ParamURL, core.ParamPreset, core.ParamSignature, core.ParamExpires:
+		default:
+			others = append(others, name)
+		}
+	}
+	slices.Sort(others)
+
+	if params.Preset == "" {
+		if h.config.PresetsOnly && len(others) > 0 {
+			return fmt.Errorf("only presets are allowed, got %s", strings.Join(others, ", "))
+		}
+		return nil
+	}
+	if len(others) > 0 {
+		return fmt.Errorf("preset %s can't be combined with %s", params.Preset, strings.Join(others, ", "))
+	}
+
+	h.presetsMu.RLock()
+	preset, ok := h.presets[params.Preset]
+	h.presetsMu.RUnlock()
+	if !ok {
+		msg := fmt.Sprintf("unknown preset %q", params.Preset)
+		// Listing them tells clients what exists, so only when debugging
+		if h.config.DebugHeaders {
+			msg += "; available: " + strings.Join(h.Presets(), ", ")
+		}
+		return errors.New(msg)
+	}
+	preset.URL = params.URL
+	*params = preset
+	return nil
+}
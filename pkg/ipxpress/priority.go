@@ -0,0 +1,226 @@
+package ipxpress
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// formatCost weighs the encoding cost of an output format per pixel, relative
+// to JPEG. AVIF and HEIF encoders are an order of magnitude slower than JPEG's.
+var formatCost = map[Format]float64{
+	FormatJPEG: 1,
+	FormatTIFF: 1,
+	FormatPNG:  2,
+	FormatGIF:  2,
+	FormatWebP: 3,
+	FormatJXL:  4,
+	FormatAVIF: 8,
+	FormatHEIF: 8,
+}
+
+// bytesPerPixel guesses a source's pixels from its size when the request
+// doesn't give the output's; compressed photos take a byte for about four pixels.
+const bytesPerPixel = 0.25
+
+// EstimateCost scores how expensive processing params on source is without
+// decoding it: the output megapixels (the source's, guessed from its size, when
+// neither width nor height is given) times the output format's weight, AVIF
+// being eight times JPEG, plus a quarter for each operation besides resizing.
+// A megapixel JPEG costs about 1. Requests up to Config.CheapCostThreshold are
+// cheap, see Config.CheapReservedSlots.
+func EstimateCost(params *ProcessingParams, source []byte) float64 {
+	var pixels float64
+	switch w, h := float64(params.Width), float64(params.Height); {
+	case w > 0 && h > 0:
+		pixels = w * h
+	case w > 0:
+		pixels = w * w
+	case h > 0:
+		pixels = h * h
+	default:
+		pixels = float64(len(source)) / bytesPerPixel
+	}
+
+	format := params.Format
+	if format == "" {
+		format = DetectFormat(source)
+	}
+	weight, ok := formatCost[format]
+	if !ok {
+		weight = formatCost[FormatJPEG]
+	}
+	return pixels / 1e6 * weight * (1 + 0.25*float64(operationCount(params)))
+}
+
+// operationCount counts the operations of params other than resizing and encoding.
+func operationCount(p *ProcessingParams) int {
+	n := 0
+	for _, op := range []bool{
+		p.Blur > 0, p.Sharpen != "", p.Rotate != 0, p.Flip, p.Flop, p.Grayscale,
+		p.Extract != "", p.CropWidth > 0 || p.CropHeight > 0, p.Trim > 0, p.Extend != "", p.BorderWidth > 0,
+		p.Background != "", p.Negate, p.Normalize, p.Threshold > 0, p.Tint != "", p.Gamma > 0,
+		p.Median > 0, p.Modulate != "" || p.Brightness > 0 || p.Saturation > 0 || p.Hue != 0, p.Contrast > 0,
+		p.Flatten, p.Duotone != "", p.Posterize > 1, p.Zoom > 1, p.Pad || p.Padding > 0,
+		p.Radius != "", p.Pixelate > 1, p.Overlay != "",
+	} {
+		if op {
+			n++
+		}
+	}
+	return n
+}
+
+// cheap reports whether params on source is within Config.CheapCostThreshold.
+func (h *Handler) cheap(params *ProcessingParams, source []byte) bool {
+	threshold := h.config.CheapCostThreshold
+	return threshold > 0 && EstimateCost(params, source) <= threshold
+}
+
+// processingQueue bounds concurrent processing, see Config.ProcessingLimit. Of
+// its slots, reserved can only be taken by cheap requests, and when a slot frees
+// waiting cheap requests get it before expensive ones, each in arrival order.
+type processingQueue struct {
+	limit    int
+	reserved int
+
+	mu               sync.Mutex
+	active           int
+	activeExpensive  int
+	cheap, expensive []chan struct{} // waiters, closed when given a slot
+}
+
+// newProcessingQueue applies the defaults of Config.CheapReservedSlots.
+func newProcessingQueue(config *Config) *processingQueue {
+	limit := max(config.ProcessingLimit, 1)
+	reserved := 0
+	if config.CheapCostThreshold > 0 {
+		reserved = config.CheapReservedSlots
+		if reserved == 0 {
+			reserved = max(limit/4, 1)
+		}
+		reserved = min(reserved, limit-1)
+	}
+	return &processingQueue{limit: limit, reserved: reserved}
+}
+
+// free reports whether a slot can be taken by a cheap or expensive request.
+// The caller holds q.mu.
+func (q *processingQueue) free(cheap bool) bool {
+	return q.active < q.limit && (cheap || q.activeExpensive < q.limit-q.reserved)
+}
+
+// take charges a slot. The caller holds q.mu.
+func (q *processingQueue) take(cheap bool) func() {
+	q.active++
+	if !cheap {
+		q.activeExpensive++
+	}
+	return sync.OnceFunc(func() { q.release(cheap) })
+}
+
+// acquire waits for a processing slot and returns the func releasing it, which
+// may be called more than once.
+func (q *processingQueue) acquire(cheap bool) (release func()) {
+	release, _ = q.acquireContext(context.Background(), cheap)
+	return release
+}
+
+// acquireContext is acquire giving up once ctx is done, with an error wrapping
+// ctx.Err().
+func (q *processingQueue) acquireContext(ctx context.Context, cheap bool) (release func(), err error) {
+	q.mu.Lock()
+	// Waiters of either kind mean no slot is free for the other
+	if q.free(cheap) && len(q.cheap) == 0 && (cheap || len(q.expensive) == 0) {
+		defer q.mu.Unlock()
+		return q.take(cheap), nil
+	}
+	waiters := &q.expensive
+	if cheap {
+		waiters = &q.cheap
+	}
+	ready := make(chan struct{})
+	*waiters = append(*waiters, ready)
+	q.mu.Unlock()
+
+	// The slot was charged by release when it handed it over
+	release = sync.OnceFunc(func() { q.release(cheap) })
+	select {
+	case <-ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	i := slices.Index(*waiters, ready)
+	if i >= 0 {
+		*waiters = slices.Delete(*waiters, i, i+1)
+	}
+	q.mu.Unlock()
+	if i < 0 {
+		// Handed a slot as ctx ended: pass it on
+		release()
+	}
+	return nil, fmt.Errorf("waiting for a processing slot: %w", ctx.Err())
+}
+
+// tryAcquire takes a slot only if one is free without waiting.
+func (q *processingQueue) tryAcquire(cheap bool) (release func(), ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.free(cheap) || len(q.cheap) > 0 || (!cheap && len(q.expensive) > 0) {
+		return nil, false
+	}
+	return q.take(cheap), true
+}
+
+// release frees a slot and hands the freed capacity to waiters, cheap first.
+func (q *processingQueue) release(cheap bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	if !cheap {
+		q.activeExpensive--
+	}
+	for len(q.cheap) > 0 && q.free(true) {
+		q.active++
+		close(q.cheap[0])
+		q.cheap = q.cheap[1:]
+	}
+	for len(q.expensive) > 0 && q.free(false) {
+		q.active++
+		q.activeExpensive++
+		close(q.expensive[0])
+		q.expensive = q.expensive[1:]
+	}
+}
+
+// ProcessingStats is the occupancy of Config.ProcessingLimit, see Handler.ProcessingStats.
+type ProcessingStats struct {
+	Active           int `json:"active"`            // slots in use
+	ActiveExpensive  int `json:"active_expensive"`  // of which by requests over Config.CheapCostThreshold
+	Limit            int `json:"limit"`             // Config.ProcessingLimit
+	Reserved         int `json:"reserved"`          // slots only cheap requests may take
+	WaitingCheap     int `json:"waiting_cheap"`     // cheap requests queued for a slot
+	WaitingExpensive int `json:"waiting_expensive"` // expensive requests queued for a slot
+}
+
+// stats returns the queue's occupancy.
+func (q *processingQueue) stats() ProcessingStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return ProcessingStats{
+		Active:           q.active,
+		ActiveExpensive:  q.activeExpensive,
+		Limit:            q.limit,
+		Reserved:         q.reserved,
+		WaitingCheap:     len(q.cheap),
+		WaitingExpensive: len(q.expensive),
+	}
+}
+
+// ProcessingStats returns the occupancy of the processing slots, shared by the
+// handlers of a TenantRouter.
+func (h *Handler) ProcessingStats() ProcessingStats {
+	return h.processing.stats()
+}
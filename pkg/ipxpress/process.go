@@ -0,0 +1,51 @@
+package ipxpress
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ProcessError reports a pipeline failure and the HTTP status the handler
+// would have answered with, e.g. 413 for a source over the pixel limit.
+type ProcessError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error implements the error interface.
+func (e *ProcessError) Error() string {
+	return e.Message
+}
+
+// defaultHandler runs Process, NewPipeline and BatchProcess with the default
+// configuration and no cache.
+var defaultHandler = sync.OnceValue(func() *Handler {
+	initVips()
+	return &Handler{config: DefaultConfig(), capabilities: DetectCapabilities(), fetcher: NewFetcher()}
+})
+
+// Process runs input through the same pipeline the HTTP handler uses, under the
+// default configuration, and returns the encoded result and its format. Nothing
+// is cached. params.URL is only used in logs; overlays aren't supported. With
+// info or placeholder set the result is JSON and the format is empty. To apply
+// the same params to many images, build a Pipeline once instead.
+//
+// If ctx is done before or during processing, the returned error wraps ctx.Err(),
+// so errors.Is(err, context.Canceled) holds. Other failures are *ProcessError.
+func Process(ctx context.Context, input []byte, params *ProcessingParams) ([]byte, Format, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", fmt.Errorf("processing abandoned: %w", err)
+	}
+	return defaultHandler().Process(ctx, input, params)
+}
+
+// Process is like the top-level Process but under the handler's configuration.
+// It neither reads nor fills the handler's cache.
+func (h *Handler) Process(ctx context.Context, input []byte, params *ProcessingParams) ([]byte, Format, error) {
+	pl, err := h.NewPipeline(params)
+	if err != nil {
+		return nil, "", err
+	}
+	return pl.RunContext(ctx, input)
+}
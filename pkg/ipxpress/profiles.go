@@ -0,0 +1,148 @@
+package ipxpress
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ProfileMode selects how a PathProfile's params combine with the client's.
+type ProfileMode string
+
+const (
+	// ProfileDefault fills in params the client didn't set.
+	ProfileDefault ProfileMode = "default"
+	// ProfileForce overrides the client's params with every param the profile sets.
+	ProfileForce ProfileMode = "force"
+	// ProfileClamp caps numeric params (width, height, quality, ...) at the profile's
+	// values, using them when the client sets none; other params behave like default.
+	ProfileClamp ProfileMode = "clamp"
+)
+
+// PathProfile applies a parameter template to source URLs matching a pattern,
+// e.g. every image under /avatars/ is served as a 256x256 WebP.
+type PathProfile struct {
+	// Name identifies the profile in debug headers and the effective-params echo.
+	Name string
+
+	// Match is a glob matched against the source URL path, where * matches any
+	// characters including "/" (e.g. "/avatars/*"). Ignored if Regexp is set.
+	Match string
+
+	// Regexp is matched against the full source URL.
+	Regexp string
+
+	// Params is the template; zero-valued fields are not part of it.
+	Params ProcessingParams
+
+	// Mode defaults to ProfileDefault.
+	Mode ProfileMode
+
+	re *regexp.Regexp
+}
+
+// compilePathProfiles validates profiles and prepares their patterns.
+func compilePathProfiles(profiles []PathProfile) ([]PathProfile, error) {
+	compiled := make([]PathProfile, len(profiles))
+	for i, p := range profiles {
+		pattern := p.Regexp
+		if pattern == "" {
+			if p.Match == "" {
+				return nil, fmt.Errorf("path profile %d (%s): match or regexp is required", i, p.Name)
+			}
+			pattern = globToRegexp(p.Match)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("path profile %d (%s): %w", i, p.Name, err)
+		}
+		switch p.Mode {
+		case "":
+			p.Mode = ProfileDefault
+		case ProfileDefault, ProfileForce, ProfileClamp:
+		default:
+			return nil, fmt.Errorf("path profile %d (%s): unknown mode %q", i, p.Name, p.Mode)
+		}
+		p.re = re
+		compiled[i] = p
+	}
+	return compiled, nil
+}
+
+// globToRegexp converts a glob where * matches anything and ? one character.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// matches reports whether the profile applies to the source URL.
+func (p *PathProfile) matches(sourceURL string) bool {
+	if p.Regexp != "" {
+		return p.re.MatchString(sourceURL)
+	}
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return false
+	}
+	return p.re.MatchString(u.Path)
+}
+
+// applyPathProfile applies the first profile matching params.URL and records its name.
+// qualitySet tells whether the client chose the quality, since parsing fills in a default.
+func applyPathProfile(profiles []PathProfile, params *ProcessingParams, qualitySet bool) *PathProfile {
+	for i := range profiles {
+		p := &profiles[i]
+		if !p.matches(params.URL) {
+			continue
+		}
+		p.apply(params, qualitySet)
+		params.Profile = p.Name
+		return p
+	}
+	return nil
+}
+
+// apply merges the template into params according to the profile's mode.
+func (p *PathProfile) apply(params *ProcessingParams, qualitySet bool) {
+	dst := reflect.ValueOf(params).Elem()
+	src := reflect.ValueOf(&p.Params).Elem()
+
+	for i := 0; i < src.NumField(); i++ {
+		switch src.Type().Field(i).Name {
+		case "URL", "Profile", "Errors":
+			continue
+		}
+		tmpl, field := src.Field(i), dst.Field(i)
+		if tmpl.IsZero() {
+			continue
+		}
+
+		unset := field.IsZero()
+		if src.Type().Field(i).Name == "Quality" {
+			unset = !qualitySet
+		}
+
+		switch {
+		case unset || p.Mode == ProfileForce:
+			field.Set(tmpl)
+		case p.Mode == ProfileClamp && field.CanInt() && field.Int() > tmpl.Int():
+			field.Set(tmpl)
+		case p.Mode == ProfileClamp && field.CanFloat() && field.Float() > tmpl.Float():
+			field.Set(tmpl)
+		}
+	}
+}
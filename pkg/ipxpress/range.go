@@ -0,0 +1,105 @@
+package ipxpress
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// byteRange is a satisfiable range of an entry's data.
+type byteRange struct {
+	start, length int64
+}
+
+// parseRange parses a Range header against data of size bytes. Only a single
+// range is supported: ok is false for headers to ignore (no header, another
+// unit, several ranges or a malformed spec), which get the full body. err is
+// set when the range can't be satisfied.
+func parseRange(header string, size int64) (rng byteRange, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, true, fmt.Errorf("unsatisfiable range %q", header)
+		}
+		n = min64(n, size)
+		return byteRange{start: size - n, length: n}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		end = min64(end, size-1)
+	}
+	if start >= size {
+		return byteRange{}, true, fmt.Errorf("unsatisfiable range %q", header)
+	}
+	return byteRange{start: start, length: end - start + 1}, true, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// writeRange answers a Range request for an entry's body of size bytes with a
+// 206 or a 416, and reports whether it did. Requests without a usable Range,
+// or whose If-Range doesn't match etag, are left to get the full body.
+func (h *Handler) writeRange(w http.ResponseWriter, r *http.Request, body io.Reader, size int64, etag string) bool {
+	header := r.Header.Get("Range")
+	if header == "" || r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// If-Range must be the current strong ETag; dates can't match as entries
+	// have no Last-Modified
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (etag == "" || ifRange != etag || strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	rng, ok, err := parseRange(header, size)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	if seeker, ok := body.(io.Seeker); ok {
+		if _, err := seeker.Seek(rng.start, io.SeekStart); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+	} else if _, err := io.CopyN(io.Discard, body, rng.start); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.start, rng.start+rng.length-1, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(rng.length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	io.CopyN(w, body, rng.length)
+	return true
+}
@@ -0,0 +1,224 @@
+package ipxpress
+
+import (
+	"hash/maphash"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitShards spreads clients over independently locked maps, so concurrent
+// requests from different clients rarely contend.
+const rateLimitShards = 32
+
+// defaultRateLimitIdle is how long a client's bucket is kept after its last request.
+const defaultRateLimitIdle = 10 * time.Minute
+
+// RateLimitConfig configures a RateLimiter.
+type RateLimitConfig struct {
+	// Rate is the number of requests per second each client may sustain.
+	Rate float64
+
+	// Burst is how many requests a client may make at once after being idle.
+	// Defaults to Rate rounded up, and at least 1.
+	Burst int
+
+	// TrustedHeader names a header holding the client IP set by a proxy in front
+	// of the server: X-Real-IP, or X-Forwarded-For, whose last address (the one
+	// the nearest proxy saw) is used. Clients can forge it, so set it only behind
+	// such a proxy. Empty uses the connection's remote address.
+	TrustedHeader string
+
+	// Exempt lists request paths, as the middleware sees them, that aren't
+	// limited, e.g. "/health".
+	Exempt []string
+
+	// IdleTimeout drops the bucket of a client idle this long, so the set of
+	// tracked clients doesn't grow forever. Defaults to 10 minutes, and is never
+	// shorter than an empty bucket takes to refill.
+	IdleTimeout time.Duration
+
+	// Now is the clock, for tests. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// RateLimiter is a per-client token bucket: each client gets Burst tokens,
+// refilled at Rate per second, and every request takes one. It is safe for
+// concurrent use.
+type RateLimiter struct {
+	rate          float64
+	burst         float64
+	idle          time.Duration
+	trustedHeader string
+	exempt        []string
+	now           func() time.Time
+
+	seed   maphash.Seed
+	shards [rateLimitShards]rateLimitShard
+
+	reaper    sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type rateLimitShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter for cfg. Its reaper starts with the first
+// client; call Close to stop it.
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	rate := cfg.Rate
+	if rate <= 0 {
+		rate = 1
+	}
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = max(int(math.Ceil(rate)), 1)
+	}
+	idle := cfg.IdleTimeout
+	if idle <= 0 {
+		idle = defaultRateLimitIdle
+	}
+	// A bucket dropped before it refilled would hand its client a full one
+	idle = max(idle, time.Duration(float64(burst)/rate*float64(time.Second)))
+	now := cfg.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	l := &RateLimiter{
+		rate:          rate,
+		burst:         float64(burst),
+		idle:          idle,
+		trustedHeader: cfg.TrustedHeader,
+		exempt:        slices.Clone(cfg.Exempt),
+		now:           now,
+		seed:          maphash.MakeSeed(),
+		done:          make(chan struct{}),
+	}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return l
+}
+
+// Allow takes a token from the client's bucket. If there is none, it returns
+// false and how long until there will be.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	l.reaper.Do(func() { go l.reap() })
+	now := l.now()
+	s := &l.shards[maphash.String(l.seed, client)%rateLimitShards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		s.buckets[client] = b
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Clients returns the number of clients currently tracked.
+func (l *RateLimiter) Clients() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		n += len(s.buckets)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// Close stops the reaper. The limiter keeps working, but no longer forgets clients.
+func (l *RateLimiter) Close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
+// reap drops idle buckets until Close.
+func (l *RateLimiter) reap() {
+	ticker := time.NewTicker(l.idle)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		now := l.now()
+		for i := range l.shards {
+			s := &l.shards[i]
+			s.mu.Lock()
+			for client, b := range s.buckets {
+				if now.Sub(b.last) >= l.idle {
+					delete(s.buckets, client)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// clientIP returns the address requests from r are counted against.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.trustedHeader != "" {
+		if v := r.Header.Get(l.trustedHeader); v != "" {
+			if i := strings.LastIndexByte(v, ','); i >= 0 {
+				v = v[i+1:]
+			}
+			if v = strings.TrimSpace(v); v != "" {
+				return v
+			}
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Middleware rejects requests over the client's limit with 429 and a
+// Retry-After header in whole seconds.
+func (l *RateLimiter) Middleware() MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(l.exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, wait := l.Allow(l.clientIP(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimitMiddleware limits each client, by remote address, to maxRequests per
+// second with bursts of as many. Use NewRateLimiter for a proxy header, exempt
+// paths or a limiter that can be stopped.
+func RateLimitMiddleware(maxRequests int) MiddlewareFunc {
+	return NewRateLimiter(RateLimitConfig{Rate: float64(maxRequests), Burst: maxRequests}).Middleware()
+}
@@ -0,0 +1,64 @@
+package ipxpress
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// errPanic is the message of responses whose processing panicked; the panic
+// value goes to the log only.
+const errPanic = "internal error while processing the image"
+
+// RecoverMiddleware answers requests whose handler panics with 500, logging the
+// panic and its stack to logger (slog.Default() if nil), so one bad request
+// doesn't take the server down. Handler.ServeHTTP already recovers on its own;
+// this is for handlers mounted next to it, like Transform or Admin.
+// http.ErrAbortHandler is passed on, as net/http expects.
+func RecoverMiddleware(logger *slog.Logger) MiddlewareFunc {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer recoverRequest(logger, w, r)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// recoverRequest is deferred by handlers to turn a panic into a 500. If the
+// response was already started the status can't change, and the client gets a
+// truncated body.
+func recoverRequest(logger *slog.Logger, w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+		panic(v)
+	}
+	logPanic(logger, v, "method", r.Method, "url", r.URL.String())
+	http.Error(w, errPanic, http.StatusInternalServerError)
+}
+
+// recoverEntry is deferred around fetching and processing a cache miss: a
+// panic becomes an uncached 500 entry in *result, shared with the requests
+// waiting on the same key. The deferred calls inside, such as releasing the
+// processing slot, have run by then.
+func (h *Handler) recoverEntry(result *any, url string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	logPanic(h.log(), v, "url", url)
+	*result = &CacheEntry{StatusCode: http.StatusInternalServerError, ErrorMsg: errPanic, uncached: true}
+}
+
+// logPanic logs a recovered panic value with the stack that raised it.
+func logPanic(logger *slog.Logger, v any, args ...any) {
+	args = append(args, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+	logger.Error("recovered from panic", args...)
+}
@@ -0,0 +1,246 @@
+package ipxpress
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RefreshConfig configures the background refresher, which re-processes popular
+// entries shortly before they expire while the server is idle, so traffic peaks
+// after a quiet period are served from the cache.
+type RefreshConfig struct {
+	// Interval between refresh cycles. Defaults to one minute.
+	Interval time.Duration
+
+	// Lookahead selects entries expiring within this window. Defaults to 5 minutes.
+	Lookahead time.Duration
+
+	// TopN bounds the entries refreshed per cycle, the most popular first. Defaults to 50.
+	TopN int
+
+	// MinHits is the number of cache hits an entry needs to count as popular.
+	// Defaults to 1.
+	MinHits int64
+
+	// MaxLoad is the load above which refreshing pauses, checked before each entry.
+	// Defaults to 0.25.
+	MaxLoad float64
+
+	// Load returns the current load from 0 (idle) to 1 (saturated). Defaults to the
+	// share of Config.ProcessingLimit slots in use.
+	Load func() float64
+}
+
+// RefreshStats counts the refresher's work since the handler started.
+type RefreshStats struct {
+	Cycles      int64 `json:"cycles"`
+	Refreshed   int64 `json:"refreshed"`
+	SkippedLoad int64 `json:"skipped_load"` // candidates left for a later cycle because of load
+	Failed      int64 `json:"failed"`       // refetch or processing failed; the entry was kept
+}
+
+// refresher holds the state of the background refresher.
+type refresher struct {
+	config RefreshConfig
+	stop   chan struct{}
+	done   chan struct{}
+	halt   sync.Once
+
+	cycles, refreshed, skippedLoad, failed atomic.Int64
+}
+
+// newRefresher applies the defaults of config.
+func newRefresher(config RefreshConfig) *refresher {
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	if config.Lookahead <= 0 {
+		config.Lookahead = 5 * time.Minute
+	}
+	if config.TopN <= 0 {
+		config.TopN = 50
+	}
+	if config.MinHits <= 0 {
+		config.MinHits = 1
+	}
+	if config.MaxLoad <= 0 {
+		config.MaxLoad = 0.25
+	}
+	return &refresher{config: config, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// run calls h.Refresh every interval until stopped.
+func (r *refresher) run(h *Handler) {
+	defer close(r.done)
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.Refresh()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// refreshCandidate is a cached entry due for refresh.
+type refreshCandidate struct {
+	key   string
+	entry *CacheEntry
+	hits  int64
+}
+
+// Refresh runs one refresh cycle now and returns the counts of that cycle.
+// It's called every RefreshConfig.Interval when Config.Refresh is set, and does
+// nothing otherwise or when the cache isn't an InMemoryCache.
+func (h *Handler) Refresh() RefreshStats {
+	r := h.refresher
+	mem, ok := h.cache.(*InMemoryCache)
+	if r == nil || !ok {
+		return RefreshStats{}
+	}
+	var stats RefreshStats
+	stats.Cycles = 1
+
+	// Popular successful entries expiring within the lookahead, most hits first
+	now := h.now()
+	var candidates []refreshCandidate
+	mem.cache.Range(func(key string, entry *CacheEntry) bool {
+		hits := entry.hits.Load()
+		if entry.params == nil || entry.StatusCode != http.StatusOK || hits < r.config.MinHits {
+			return true
+		}
+		if left := entry.expires.Sub(now); left > 0 && left <= r.config.Lookahead {
+			candidates = append(candidates, refreshCandidate{key: key, entry: entry, hits: hits})
+		}
+		return true
+	})
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].hits > candidates[j].hits })
+	candidates = candidates[:min(len(candidates), r.config.TopN)]
+
+	for i, c := range candidates {
+		if h.refreshLoad() > r.config.MaxLoad {
+			stats.SkippedLoad = int64(len(candidates) - i)
+			break
+		}
+		if h.refreshEntry(c) {
+			stats.Refreshed++
+		} else {
+			stats.Failed++
+		}
+	}
+
+	r.cycles.Add(stats.Cycles)
+	r.refreshed.Add(stats.Refreshed)
+	r.skippedLoad.Add(stats.SkippedLoad)
+	r.failed.Add(stats.Failed)
+	if len(candidates) > 0 {
+		h.log().Info("refresh cycle", "candidates", len(candidates), "refreshed", stats.Refreshed, "skipped_load", stats.SkippedLoad, "failed", stats.Failed)
+	}
+	return stats
+}
+
+// RefreshStats returns the refresher's totals since the handler started.
+func (h *Handler) RefreshStats() RefreshStats {
+	r := h.refresher
+	if r == nil {
+		return RefreshStats{}
+	}
+	return RefreshStats{
+		Cycles:      r.cycles.Load(),
+		Refreshed:   r.refreshed.Load(),
+		SkippedLoad: r.skippedLoad.Load(),
+		Failed:      r.failed.Load(),
+	}
+}
+
+// refreshLoad returns the current load from the configured signal or the processing slots in use.
+func (h *Handler) refreshLoad() float64 {
+	if load := h.refresher.config.Load; load != nil {
+		return load()
+	}
+	stats := h.processing.stats()
+	return float64(stats.Active) / float64(stats.Limit)
+}
+
+// refreshEntry refetches and reprocesses an entry, replacing it if that succeeds.
+// It takes a processing slot only if one is free, yielding to client requests.
+func (h *Handler) refreshEntry(c refreshCandidate) bool {
+	release, ok := h.processing.tryAcquire(false)
+	if !ok {
+		return false
+	}
+	defer release()
+	return h.reprocess(c.key, c.entry.params, c.hits)
+}
+
+// reprocess refetches and reprocesses params into the entry at key, keeping it
+// if that fails, and reports whether it was replaced. The caller holds a
+// processing slot; a fetch slot is taken for the refetch. Concurrent requests for
+// key share the work.
+func (h *Handler) reprocess(key string, params *ProcessingParams, hits int64) bool {
+	result, _, _ := h.sf.Do(key, func() (interface{}, error) {
+		releaseFetch, err := h.fetchLimit.acquire(context.Background())
+		if err != nil {
+			h.log().Warn("refresh fetch failed", "url", params.URL, "error", err)
+			return nil, nil
+		}
+		defer releaseFetch()
+		data, policy, releaseData, err := h.fetchSource(context.Background(), params.URL)
+		defer releaseData()
+		if err != nil {
+			h.log().Warn("refresh fetch failed", "url", params.URL, "error", err)
+			return nil, nil
+		}
+		var overlay []byte
+		if params.Overlay != "" {
+			var releaseOverlay func()
+			overlay, releaseOverlay, err = h.fetcher.FetchReserved(context.Background(), params.Overlay)
+			defer releaseOverlay()
+			if err != nil {
+				h.log().Warn("refresh overlay fetch failed", "url", params.Overlay, "error", err)
+				return nil, nil
+			}
+		}
+
+		releaseFetch()
+
+		entry := h.processImage(context.Background(), data, overlay, h.compile(params))
+		if entry.StatusCode != http.StatusOK {
+			return nil, nil
+		}
+		entry.params = params
+		entry.hits.Store(hits) // keep the entry's popularity
+		if entry.applyOriginPolicy(policy, h.now()); entry.noStore {
+			// The origin no longer allows caching the source
+			if purger, ok := h.cache.(Purger); ok {
+				purger.Delete(key)
+			}
+			return nil, nil
+		}
+		h.storeEntry(key, entry)
+		return entry, nil
+	})
+	return result != nil
+}
+
+// stopRefresher stops the refresher, if any, waiting for a running cycle to
+// finish until ctx is done.
+func (h *Handler) stopRefresher(ctx context.Context) error {
+	r := h.refresher
+	if r == nil {
+		return nil
+	}
+	r.halt.Do(func() { close(r.stop) })
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,71 @@
+package ipxpress
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+)
+
+// Response is a result a processor gives instead of the image, e.g. a 422 for
+// sources a policy rejects or a licensed placeholder for blocked domains. See
+// Processor.Respond.
+type Response struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+
+	// NoStore keeps the response out of the cache, and clients from caching it,
+	// e.g. when it depends on something other than the source and the params.
+	NoStore bool
+}
+
+// Error implements error, so that a Response stops the processor like one.
+func (r *Response) Error() string {
+	return fmt.Sprintf("processor responded with %d %s", r.StatusCode, http.StatusText(r.StatusCode))
+}
+
+// Respond ends processing with resp in place of the image: later operations are
+// skipped, as after an error, and the handler answers with resp, caching it like
+// any response unless resp.NoStore is set. A zero StatusCode means 200. Like
+// other operations it does nothing if an error is pending.
+//
+//	handler.UsePreProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+//		if proc.Width() < 10 || proc.Height() < 10 {
+//			return proc.Respond(&ipxpress.Response{StatusCode: http.StatusUnprocessableEntity, ContentType: "text/plain", Body: []byte("image too small")})
+//		}
+//		return proc
+//	})
+func (p *Processor) Respond(resp *Response) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+	p.err = resp
+	return p
+}
+
+// errorMessage returns the message of an entry that isn't a 200: its ErrorMsg,
+// or the body of a processor's Response.
+func (e *CacheEntry) errorMessage() string {
+	if e.ErrorMsg != "" {
+		return e.ErrorMsg
+	}
+	return string(e.Data)
+}
+
+// responseEntry is the cache entry answering with resp.
+func (h *Handler) responseEntry(resp *Response) *CacheEntry {
+	entry := &CacheEntry{
+		ContentType: resp.ContentType,
+		Data:        resp.Body,
+		StatusCode:  resp.StatusCode,
+		noStore:     resp.NoStore,
+	}
+	if h.config.EnableETag {
+		entry.ETag = fmt.Sprintf("\"%x\"", md5.Sum(entry.Data))
+	}
+	return entry
+}
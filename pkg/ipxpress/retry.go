@@ -0,0 +1,130 @@
+package ipxpress
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// retryPolicy is when and how long a Fetcher waits to retry, see FetcherConfig.
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	statuses  []int
+}
+
+// newRetryPolicy takes the retry settings of config.
+func newRetryPolicy(config *FetcherConfig) retryPolicy {
+	return retryPolicy{
+		attempts:  max(config.MaxAttempts, 1),
+		baseDelay: config.RetryBaseDelay,
+		maxDelay:  config.RetryMaxDelay,
+		statuses:  slices.Clone(config.RetryStatuses),
+	}
+}
+
+// backoff returns the delay before attempt n+1 (n >= 1): baseDelay doubled for
+// each earlier retry, capped at maxDelay, less a random share of up to half.
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := p.baseDelay
+	for i := 1; i < n && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if p.maxDelay > 0 && d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int64N(int64(d)/2+1))
+}
+
+// retryAfter parses a Retry-After header, in seconds or as an HTTP date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// transient reports whether a request error is worth retrying: timeouts,
+// refused or reset connections, and temporary DNS failures.
+func transient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do sends requests built by newRequest with client until one succeeds, fails
+// for good or the attempts run out. A response with a status it gave up
+// retrying is returned as is, for the caller to report.
+func (f *Fetcher) do(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		if err := f.hosts.throttle(ctx, req.URL.Host); err != nil {
+			return nil, err
+		}
+		f.requests.Add(1)
+		resp, err := client.Do(req)
+
+		var delay time.Duration
+		switch {
+		case err != nil:
+			// A redirect checkRedirect refused fails with its own error
+			var refused *FetchError
+			if errors.As(err, &refused) {
+				return nil, refused
+			}
+			if ctx.Err() != nil || attempt >= f.retry.attempts || !transient(err) {
+				return nil, transportError(err, "failed to fetch image: %v", err)
+			}
+			delay = f.retry.backoff(attempt)
+		case slices.Contains(f.retry.statuses, resp.StatusCode) && attempt < f.retry.attempts:
+			delay = f.retry.backoff(attempt)
+			if after, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if f.retry.maxDelay > 0 && after > f.retry.maxDelay {
+					return resp, nil
+				}
+				delay = after
+			}
+			// Drain a little so the connection can be reused
+			io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, transportError(ctx.Err(), "failed to fetch image: %v", ctx.Err())
+		case <-timer.C:
+		}
+		f.retries.Add(1)
+	}
+}
@@ -0,0 +1,116 @@
+package ipxpress
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// TTLRule assigns a cache TTL to entries stored during a daily time window.
+type TTLRule struct {
+	// Name identifies the rule in debug headers (e.g. "business-hours").
+	Name string
+
+	// From and To bound the window as "HH:MM" in the schedule's timezone.
+	// From is inclusive, To is exclusive; windows may wrap past midnight ("20:00"-"08:00").
+	From string
+	To   string
+
+	// Days restricts the rule to specific weekdays. Empty means every day.
+	Days []time.Weekday
+
+	// TTL is the cache TTL for entries stored while the rule is active.
+	TTL time.Duration
+}
+
+// TTLSchedule picks cache entry TTLs based on the time they are stored.
+// Rules are evaluated in order and the first match wins; if none matches,
+// the handler's default CacheTTL is used.
+type TTLSchedule struct {
+	Rules []TTLRule
+
+	// Location is the timezone rules are evaluated in. Defaults to time.Local.
+	Location *time.Location
+}
+
+// Active returns the first rule matching t, or nil if none does.
+func (s *TTLSchedule) Active(t time.Time) *TTLRule {
+	if s == nil {
+		return nil
+	}
+
+	loc := s.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	minute := t.Hour()*60 + t.Minute()
+
+	for i := range s.Rules {
+		if s.Rules[i].matches(t.Weekday(), minute) {
+			return &s.Rules[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks that every rule has a parseable, non-empty window, valid
+// weekdays and a positive TTL, since a rule that can never match is a mistake.
+// Config.Validate and Handler.SetTTLSchedule call it.
+func (s *TTLSchedule) Validate() error {
+	if s == nil {
+		return nil
+	}
+	for i, r := range s.Rules {
+		from, err := parseClock(r.From)
+		if err != nil {
+			return fmt.Errorf("ttl rule %d (%s): invalid from: %w", i, r.Name, err)
+		}
+		to, err := parseClock(r.To)
+		if err != nil {
+			return fmt.Errorf("ttl rule %d (%s): invalid to: %w", i, r.Name, err)
+		}
+		if from == to {
+			return fmt.Errorf("ttl rule %d (%s): from and to are both %s, an empty window", i, r.Name, r.From)
+		}
+		for _, day := range r.Days {
+			if day < time.Sunday || day > time.Saturday {
+				return fmt.Errorf("ttl rule %d (%s): invalid weekday %d", i, r.Name, day)
+			}
+		}
+		if r.TTL <= 0 {
+			return fmt.Errorf("ttl rule %d (%s): ttl must be positive", i, r.Name)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule covers the given weekday and minute of day.
+func (r *TTLRule) matches(day time.Weekday, minute int) bool {
+	from, err := parseClock(r.From)
+	if err != nil {
+		return false
+	}
+	to, err := parseClock(r.To)
+	if err != nil {
+		return false
+	}
+	if len(r.Days) > 0 && !slices.Contains(r.Days, day) {
+		return false
+	}
+
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	// Window wraps past midnight
+	return minute >= from || minute < to
+}
+
+// parseClock converts "HH:MM" to minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
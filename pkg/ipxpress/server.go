@@ -1,14 +1,22 @@
 package ipxpress
 
 import (
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -16,44 +24,247 @@ import (
 // It receives the processor and params, and can apply custom transformations.
 type ProcessorFunc func(*Processor, *ProcessingParams) *Processor
 
+// EncoderFunc runs just before an image is encoded and may change its output
+// format and encoder options, e.g. the quality. Like a ProcessorFunc it may
+// record an error on the processor, which fails the request.
+type EncoderFunc func(*Processor, *ProcessingParams, *Encoding) *Processor
+
+// Encoding is the output format and encoder options of an image, see EncoderFunc.
+type Encoding struct {
+	Format  Format
+	Options EncodeOptions
+}
+
 // MiddlewareFunc is a function that wraps the handler with additional functionality.
 type MiddlewareFunc func(http.Handler) http.Handler
 
 // Handler handles image processing requests.
 type Handler struct {
-	cache           *InMemoryCache
-	fetcher         *Fetcher
-	config          *Config
-	processingLimit chan struct{}
-	processors      []ProcessorFunc
-	middlewares     []MiddlewareFunc
-	sf              *singleflight.Group
+	cache         Cache
+	fetcher       SourceFetcher
+	config        *Config
+	capabilities  *Capabilities
+	processing    *processingQueue
+	fetchLimit    *fetchLimiter
+	preProcessors []ProcessorFunc
+	processors    []ProcessorFunc
+	watermark     *WatermarkOptions // set by UseWatermark
+	encoders      []EncoderFunc
+	middlewares   []MiddlewareFunc
+	chain         atomic.Pointer[http.Handler] // serve wrapped in middlewares, built on first use
+	sf            *singleflight.Group
+	ttlSchedule   atomic.Pointer[TTLSchedule]
+	pathProfiles  []PathProfile
+	presetsMu     sync.RWMutex
+	presets       map[string]ProcessingParams
+	allowed       operationAllowlist
+	defaultImage  []byte            // local Config.DefaultImage, loaded once
+	origins       *originIndex      // derivatives by source content, if Config.DedupOriginals
+	refresher     *refresher        // if Config.Refresh
+	watchdog      *watchdog         // if Config.VipsWatchdog
+	memory        *MemoryAccountant // if Config.MemoryBudget
+	bodies        *MemoryAccountant // if Config.MaxConcurrentBytes
+	logger        *slog.Logger      // WithLogger, or nil for slog.Default()
+	clock         func() time.Time  // WithClock, or nil for Config.Now
+	revalidating  sync.Map          // keys of stale entries being refreshed, see Config.StaleGrace
+	revalidations sync.WaitGroup    // revalidating goroutines, awaited by Shutdown
+	misses        sync.WaitGroup    // cache misses being fetched or processed, awaited by Shutdown
+	keyVersion    string            // mixed into cache keys, see encoderVersion
+	keyPrefix     string            // namespace of a TenantRouter tenant's cache keys
+	sharedCache   bool              // cache closed by the TenantRouter, not Close
+	started       time.Time         // for Stats.Uptime
+	inFlight      atomic.Int64      // image requests being served
+	unsupported   atomic.Int64      // entries made for an UnsupportedError, see Stats.Unsupported
+	shuttingDown  atomic.Bool       // set by Shutdown, fails Ready
 }
 
 // NewHandler creates a new Handler with the given configuration.
 // Automatically initializes vips if not already initialized.
-// If config.VipsConfig is provided, vips will be initialized with those settings.
-func NewHandler(config *Config) *Handler {
+// If config.VipsConfig is provided, vips will be initialized with those settings;
+// when libvips already runs with other settings they're ignored with an error
+// logged, since libvips is shared by every handler in the process.
+// Options replace collaborators the handler would otherwise build itself:
+//
+//	h := ipxpress.NewHandler(config, ipxpress.WithFetcher(s3Fetcher), ipxpress.WithLogger(logger))
+func NewHandler(config *Config, opts ...HandlerOption) *Handler {
+	var options handlerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
 	if config == nil {
 		config = DefaultConfig()
 	}
+	if err := config.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid ipxpress config: %v", err))
+	}
 
 	// Initialize vips with custom config if provided
-	if config.VipsConfig != nil {
-		initVipsWithSettings(config.VipsConfig)
-	} else {
-		initVips()
+	vipsErr := initVipsWithSettings(config.VipsConfig)
+
+	capabilities := config.Capabilities
+	if capabilities == nil {
+		capabilities = DetectCapabilities()
+	}
+
+	logger := options.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if vipsErr != nil {
+		logger.Error("VipsConfig not applied", "error", vipsErr)
+	}
+
+	cache := options.cache
+	if cache == nil {
+		cache = config.Cache
+	}
+	if cache == nil {
+		mem := NewInMemoryCache(config.CacheTTL, config.CacheMaxCost)
+		mem.CompressEntries(config.CacheCompression, config.CacheCompressMinBytes)
+		if config.LargeEntryThreshold > 0 {
+			if err := mem.SpillLargeEntries(config.LargeEntryDir, config.LargeEntryThreshold); err != nil {
+				logger.Error("large cache entries stay in memory", "error", err)
+			}
+		}
+		cache = mem
+	}
+
+	// Only the built-in fetcher is bound to AllowedHosts and the memory budget
+	var fetcher *Fetcher
+	if options.fetcher == nil {
+		fetcherConfig := config.Fetcher
+		if fetcherConfig == nil {
+			fetcherConfig = DefaultFetcherConfig()
+		}
+		fetcher = NewFetcherWithConfig(fetcherConfig)
+		fetcher.AllowedHosts = config.AllowedHosts
+		options.fetcher = fetcher
+	}
+
+	h := &Handler{
+		cache:        cache,
+		fetcher:      options.fetcher,
+		config:       config,
+		capabilities: capabilities,
+		processing:   newProcessingQueue(config),
+		fetchLimit:   newFetchLimiter(config),
+		processors:   []ProcessorFunc{},
+		middlewares:  []MiddlewareFunc{},
+		sf:           &singleflight.Group{},
+		logger:       options.logger,
+		clock:        options.now,
+	}
+	h.started = h.now()
+	h.keyVersion = encoderVersion(config)
+	if share := options.tenant; share != nil {
+		h.processing, h.fetchLimit = share.processing, share.fetchLimit
+		h.keyPrefix, h.sharedCache = share.keyPrefix, share.cache
+	}
+	h.allowed = compileAllowedOperations(config.AllowedOperations)
+	h.ttlSchedule.Store(config.TTLSchedule)
+	h.loadDefaultImage()
+	if config.DedupOriginals {
+		h.origins = newOriginIndex()
+	}
+	if config.MemoryBudget > 0 {
+		h.memory = newMemoryAccountant(config, cache)
+		if fetcher != nil {
+			fetcher.Memory = h.memory
+		}
+	}
+	if config.MaxConcurrentBytes > 0 {
+		h.bodies = NewMemoryAccountant(config.MaxConcurrentBytes, memoryQueueTimeout(config))
+		if fetcher != nil {
+			fetcher.Bodies = h.bodies
+		}
+	}
+	if config.Refresh != nil {
+		h.refresher = newRefresher(*config.Refresh)
+		go h.refresher.run(h)
+	}
+	if config.VipsWatchdog != nil {
+		h.watchdog = newWatchdog(*config.VipsWatchdog)
+		go h.watchdog.run(h)
+	}
+	for name, params := range config.Presets {
+		h.RegisterPreset(name, &params)
+	}
+	h.pathProfiles, _ = compilePathProfiles(config.PathProfiles) // checked by Validate
+
+	return h
+}
+
+// encoderVersion describes the configured encoder defaults and color management,
+// or returns "" if all are the defaults, so the cache keys of a default
+// configuration don't change.
+func encoderVersion(config *Config) string {
+	if config.JPEGOptions == nil && config.WebPOptions == nil && config.AVIFOptions == nil && config.PNGOptions == nil &&
+		config.KeepMetadata == "" && !config.DisableColorManagement && !config.DisableAutoOrient {
+		return ""
+	}
+	deref := func(v any) string {
+		if s := fmt.Sprintf("%+v", v); s != "<nil>" {
+			return strings.TrimPrefix(s, "&")
+		}
+		return "default"
+	}
+	return fmt.Sprintf("jpeg=%s|webp=%s|avif=%s|png=%s|keep=%s|color=%t|orient=%t",
+		deref(config.JPEGOptions), deref(config.WebPOptions), deref(config.AVIFOptions), deref(config.PNGOptions),
+		config.KeepMetadata, !config.DisableColorManagement, !config.DisableAutoOrient)
+}
+
+// cacheKey returns the cache key of params under the configured encoder defaults.
+func (h *Handler) cacheKey(params *ProcessingParams) string {
+	key := GenerateCacheKey(params)
+	if h.keyVersion != "" {
+		key = fmt.Sprintf("%x", md5.Sum([]byte(h.keyVersion+"|"+key)))
+	}
+	return h.keyPrefix + key
+}
+
+// encodeOptions returns the encoder settings for params, on top of the configured defaults.
+func (h *Handler) encodeOptions(params *ProcessingParams) EncodeOptions {
+	opts := params.EncodeOptions()
+	opts.JPEG = h.config.JPEGOptions
+	opts.WebP = h.config.WebPOptions
+	opts.AVIF = h.config.AVIFOptions
+	opts.PNG = h.config.PNGOptions
+	opts.Keep = params.KeepMetadata(h.config.KeepMetadata)
+	return opts
+}
+
+// SetTTLSchedule replaces the cache TTL schedule at runtime. Entries already cached keep
+// their TTL; nil restores the default CacheTTL for new entries. An invalid schedule
+// is returned as an error and the current one kept.
+func (h *Handler) SetTTLSchedule(schedule *TTLSchedule) error {
+	if err := schedule.Validate(); err != nil {
+		return err
 	}
+	h.ttlSchedule.Store(schedule)
+	return nil
+}
 
-	return &Handler{
-		cache:           NewInMemoryCache(config.CacheTTL, config.CacheMaxCost),
-		fetcher:         NewFetcher(),
-		config:          config,
-		processingLimit: make(chan struct{}, config.ProcessingLimit),
-		processors:      []ProcessorFunc{},
-		middlewares:     []MiddlewareFunc{},
-		sf:              &singleflight.Group{},
+// now returns the current time from the configured clock.
+func (h *Handler) now() time.Time {
+	if h.clock != nil {
+		return h.clock()
 	}
+	if h.config.Now != nil {
+		return h.config.Now()
+	}
+	return time.Now()
+}
+
+// UsePreProcessor adds a processor run right after decoding, before the
+// built-in transformations (auto-orientation included), e.g. to adapt params to
+// the source's size. It gets a copy of the request's params; changes to it
+// apply to the rest of the processing but not to the cache key, so they must
+// depend on nothing but the source and the params. Sources are decoded at full
+// size when pre-processors are set. Like other processors they don't run for
+// sources served as they are, without transformation params.
+func (h *Handler) UsePreProcessor(processor ProcessorFunc) *Handler {
+	h.preProcessors = append(h.preProcessors, processor)
+	return h
 }
 
 // UseProcessor adds a custom processor function to the processing pipeline.
@@ -63,9 +274,19 @@ func (h *Handler) UseProcessor(processor ProcessorFunc) *Handler {
 	return h
 }
 
-// UseMiddleware adds a middleware to wrap the handler.
+// UseEncoder adds a hook run before encoding, after every processor, that may
+// change the output format and encoder options. Hooks run in the order they were
+// added, each seeing the Encoding the previous one left.
+func (h *Handler) UseEncoder(encoder EncoderFunc) *Handler {
+	h.encoders = append(h.encoders, encoder)
+	return h
+}
+
+// UseMiddleware adds a middleware to wrap the handler; ServeHTTP runs the
+// middlewares in the order they were added. Add them before serving.
 func (h *Handler) UseMiddleware(middleware MiddlewareFunc) *Handler {
 	h.middlewares = append(h.middlewares, middleware)
+	h.chain.Store(nil)
 	return h
 }
 
@@ -78,57 +299,258 @@ func (h *Handler) applyMiddlewares(handler http.Handler) http.Handler {
 	return handler
 }
 
-// ServeHTTP handles HTTP requests for image processing.
+// ServeHTTP handles HTTP requests for image processing, through the middlewares
+// added with UseMiddleware. Images are named by the query alone, so h may be
+// mounted at any path, with or without http.StripPrefix; see Mount. A panic,
+// e.g. in a ProcessorFunc, is answered with 500 and logged instead of crashing
+// the server.
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer recoverRequest(h.log(), w, r)
+	h.inFlight.Add(1)
+	defer h.inFlight.Add(-1)
+	chain := h.chain.Load()
+	if chain == nil {
+		wrapped := h.applyMiddlewares(http.HandlerFunc(h.serve))
+		chain = &wrapped
+		h.chain.Store(chain)
+	}
+	(*chain).ServeHTTP(w, r)
+}
+
+// serve answers a request that went through the middlewares.
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Allow", allowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	switch route(r) {
+	case "capabilities", "formats":
+		h.serveFormats(w)
+		return
+	case "params":
+		serveParams(w)
+		return
+	}
+	if enabled, _ := strconv.ParseBool(r.URL.Query().Get("capabilities")); enabled {
+		h.serveFormats(w)
+		return
+	}
+
+	// Signed deployments refuse everything else before parsing or fetching
+	if len(h.config.SignatureSecrets) > 0 {
+		if err := VerifySignature(r.URL.Query(), h.config.SignatureSecrets, h.now()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	h.serveImage(w, r)
+}
+
+// serveImage answers an image request whose signature, if required, was checked.
+func (h *Handler) serveImage(w http.ResponseWriter, r *http.Request) {
 	// Parse request parameters
 	params := ParseProcessingParams(r)
+	if err := h.allowed.check(r.URL.Query()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.applyPreset(r.URL.Query(), params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if route(r) == "info" {
+		params.Info = true
+	}
+	if err := params.CheckDimensions(h.config.MaxDimension); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := params.Err(); err != nil {
+		if h.config.StrictParams {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.log().Warn("invalid parameters ignored", "url", params.URL, "error", err)
+		w.Header().Set("X-IPX-Warning", err.Error())
+	}
+
+	// Operator profiles for the source path complete or override the query
+	if len(h.pathProfiles) > 0 {
+		q := r.URL.Query()
+		profile := applyPathProfile(h.pathProfiles, params, q.Get("q") != "" || q.Get("quality") != "")
+		if profile != nil && h.debugging(r) {
+			w.Header().Set("X-IPX-Profile", profile.Name+"; mode="+string(profile.Mode))
+		}
+		// A profile may combine with the query into a new conflict; it's resolved
+		// silently since the client can't fix it
+		params.ResolveConflicts()
+	}
+
+	// Broken source URLs may fall back to a configured default image
+	handled, localDefault := h.applyDefaultImage(w, r, params)
+	if handled {
+		return
+	}
 
 	// Generate cache key using all parameters to avoid collisions
-	cacheKey := GenerateCacheKey(params)
+	cacheKey := h.cacheKey(params)
 
 	// Check cache first
-	if entry, found := h.cache.Get(cacheKey); found {
-		slog.Info("served from cache", "url", params.URL)
-		h.writeResponse(w, r, entry)
+	if entry, found, stale := h.lookup(cacheKey); found {
+		h.log().Info("served from cache", "url", params.URL, "stale", stale)
+		if stale {
+			h.serveStale(w, r, cacheKey, entry)
+		} else {
+			h.writeResponse(w, r, entry, cacheHit)
+		}
 		return
 	}
 
+	h.sendEarlyHints(w)
+	if h.config.EarlyHeadersAfter > 0 || h.config.ResponseHeaderDeadline > 0 {
+		h.serveMissGuarded(w, r, params, cacheKey, localDefault)
+		return
+	}
+	h.serveMiss(w, r, params, cacheKey, localDefault)
+}
+
+// serveMiss fetches, processes and caches an image that isn't in the cache, and
+// answers with it.
+func (h *Handler) serveMiss(w http.ResponseWriter, r *http.Request, params *ProcessingParams, cacheKey string, localDefault bool) {
+	// Large passthroughs are piped straight from the origin without buffering or caching
+	stream := h.config.StreamThreshold > 0 && !params.HasTransformations() && !params.Info && !localDefault && !h.watermarked(params)
+	led, hit := false, false
+
 	// Use singleflight to group concurrent requests for the same image/parameters.
 	// This prevents "Thundering Herd" problem where multiple concurrent requests
 	// for the same missing cache entry all fetch and process the image independently.
-	entryInterface, err, _ := h.sf.Do(cacheKey, func() (interface{}, error) {
-		// Cache miss - acquire semaphore first to limit total concurrent active requests (including fetching)
-		// This prevents memory exhaustion from too many pending fetches
-		h.processingLimit <- struct{}{}
-		defer func() { <-h.processingLimit }()
+	entryInterface, err, _ := h.sf.Do(cacheKey, func() (result interface{}, _ error) {
+		defer h.recoverEntry(&result, params.URL)
+		led = true
+		h.misses.Add(1)
+		defer h.misses.Done()
+
+		// Cache miss - a fetch slot bounds concurrent upstream requests. It's
+		// released before waiting for a processing slot, so neither stage
+		// holds a slot of the other idle.
+		releaseFetch := func() {}
+		if !localDefault {
+			var err error
+			if releaseFetch, err = h.fetchLimit.acquire(context.Background()); err != nil {
+				h.log().Warn("fetch queue full", "url", params.URL, "error", err)
+				entry := h.createErrorEntry(err)
+				entry.uncached = true
+				return entry, nil
+			}
+		}
+		defer releaseFetch()
 
 		// Re-check cache inside singleflight just in case another request filled it
-		if entry, found := h.cache.Get(cacheKey); found {
-			slog.Info("served from cache", "url", params.URL)
+		if entry, found, stale := h.lookup(cacheKey); found && !stale {
+			h.log().Info("served from cache", "url", params.URL)
+			hit = true
 			return entry, nil
 		}
 
 		// STAGE 1: Fetch image
-		imageData, err := h.fetcher.Fetch(params.URL)
+		var imageData []byte
+		var policy OriginPolicy
+		var err error
+		releaseData := func() {}
+		fetchStart := time.Now()
+		if localDefault {
+			imageData = h.defaultImage
+		} else if stream {
+			var streamed bool
+			imageData, policy, releaseData, streamed, err = h.streamPassthrough(w, r, params, releaseFetch)
+			if streamed {
+				return streamedEntry, nil
+			}
+		} else {
+			imageData, policy, releaseData, err = h.fetchSource(context.Background(), params.URL)
+		}
+		defer releaseData()
 		if err != nil {
-			slog.Error("fetch failed", "url", params.URL, "error", err)
+			h.log().Error("fetch failed", "url", params.URL, "error", err)
 			entry := h.createErrorEntry(err)
-			// Only cache permanent errors (4xx). Transient errors (5xx, network)
-			// should not be cached so clients can retry successfully.
-			if entry.StatusCode < 500 {
-				h.cache.Set(cacheKey, entry)
+			entry.FetchTime = time.Since(fetchStart)
+			entry.params = params // lets PurgeSource find it
+			h.storeError(cacheKey, entry, err)
+			return entry, nil
+		}
+
+		// The overlay goes through the same fetcher (and its restrictions) as the source
+		var overlay []byte
+		if params.Overlay != "" {
+			var releaseOverlay func()
+			overlay, releaseOverlay, err = h.fetcher.FetchReserved(context.Background(), params.Overlay)
+			defer releaseOverlay()
+			if err != nil {
+				h.log().Error("overlay fetch failed", "url", params.Overlay, "error", err)
+				entry := h.createErrorEntry(err)
+				entry.FetchTime = time.Since(fetchStart)
+				entry.params = params
+				h.storeError(cacheKey, entry, err)
+				return entry, nil
 			}
+		}
+		fetchTime := time.Since(fetchStart)
+		releaseFetch()
+
+		// STAGE 2: Process with libvips, limited by ProcessingLimit. Cheap
+		// requests queue ahead of expensive ones, see CheapCostThreshold.
+		defer h.processing.acquire(h.cheap(params, imageData))()
+
+		// Responses the origin forbids caching are encoded straight to the client
+		if policy.NoStore && !localDefault {
+			entry, streamed := h.encodeToClient(w, r, imageData, overlay, params, fetchTime)
+			if streamed {
+				return streamedEntry, nil
+			}
+			entry.FetchTime = fetchTime
+			entry.params = params
+			entry.applyOriginPolicy(policy, h.now())
+			entry.uncached = true
 			return entry, nil
 		}
 
-		// STAGE 2: Process with libvips (now protected by the same semaphore).
+		// Identical bytes from another URL may already have been processed with these params
+		var originKey string
+		if h.origins != nil {
+			originKey = contentKey(imageData, params)
+			if entry := h.origins.alias(h.cache, originKey, cacheKey); entry != nil {
+				h.log().Info("reused result of identical source", "url", params.URL, "alias_of", entry.AliasOf)
+				entry.FetchTime = fetchTime
+				entry.EffectiveParams = params.EffectiveQuery(DetectFormat(imageData))
+				if !localDefault {
+					entry.params = params // lets the refresher redo it
+				}
+				entry.applyOriginPolicy(policy, h.now())
+				h.storeEntry(cacheKey, entry)
+				return entry, nil
+			}
+		}
+
 		// Logged right before the cgo call so the last line on stdout before a
 		// native crash (e.g. a libvips segfault) identifies the offending request.
-		slog.Info("processing image", "url", params.URL, "width", params.Width, "height", params.Height, "format", string(params.Format))
-		entry := h.processImage(imageData, params)
+		h.log().Info("processing image", "url", params.URL, "width", params.Width, "height", params.Height, "format", string(params.Format))
+		entry := h.processImage(context.Background(), imageData, overlay, h.compile(params))
+		entry.FetchTime = fetchTime
+		if !localDefault {
+			entry.params = params // lets the refresher redo it
+		}
+		entry.applyOriginPolicy(policy, h.now())
 
-		// Cache the result
-		h.cache.Set(cacheKey, entry)
+		// Cache the result, unless it only lacked memory this time
+		if entry.StatusCode != http.StatusServiceUnavailable {
+			h.storeEntry(cacheKey, entry)
+		} else {
+			entry.uncached = true
+		}
+		if originKey != "" && entry.StatusCode == http.StatusOK && !entry.noStore {
+			h.origins.add(originKey, cacheKey)
+		}
 
 		return entry, nil
 	})
@@ -139,14 +561,76 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	entry := entryInterface.(*CacheEntry)
-	h.writeResponse(w, r, entry)
+	if entry == streamedEntry {
+		if led {
+			return
+		}
+		// The leader wrote its own response (a large passthrough or an uncacheable
+		// encode), which isn't shared, so make ours too
+		releaseFetch, err := h.fetchLimit.acquire(r.Context())
+		if err != nil {
+			h.writeResponse(w, r, h.createErrorEntry(err), cacheBypass)
+			return
+		}
+		data, policy, releaseData, streamed, err := h.streamPassthrough(w, r, params, releaseFetch)
+		if streamed {
+			return
+		}
+		defer releaseData()
+		var overlay []byte
+		if err == nil && params.Overlay != "" {
+			var releaseOverlay func()
+			overlay, releaseOverlay, err = h.fetcher.FetchReserved(context.Background(), params.Overlay)
+			defer releaseOverlay()
+		}
+		releaseFetch()
+		if err != nil {
+			entry = h.createErrorEntry(err)
+		} else {
+			defer h.processing.acquire(h.cheap(params, data))()
+			entry = h.processImage(context.Background(), data, overlay, h.compile(params))
+			entry.applyOriginPolicy(policy, h.now())
+		}
+		entry.uncached = true
+	}
+	status := cacheMiss
+	if hit {
+		status = cacheHit
+	}
+	h.writeResponse(w, r, entry, status)
+}
+
+// Shutdown stops background work (the refresher and watchdog) and waits for stale
+// revalidations and requests being fetched or processed to finish, until ctx is
+// done. It doesn't refuse new requests, so stop the server in front first, e.g.
+// with http.Server.Shutdown. It doesn't close the cache; call Close afterwards.
+// From the call on, Ready fails, so probes take the instance out of rotation.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.shuttingDown.Store(true)
+	if err := h.stopRefresher(ctx); err != nil {
+		return err
+	}
+	if err := h.stopWatchdog(ctx); err != nil {
+		return err
+	}
+	if err := h.waitRevalidations(ctx); err != nil {
+		return err
+	}
+
+	return waitGroup(ctx, &h.misses)
 }
 
-// Close closes the handler and releases resources (like cache).
+// Close closes the handler and releases resources (like cache). Unlike
+// Shutdown, it doesn't wait for requests in flight.
 func (h *Handler) Close() {
-	if h.cache != nil {
+	h.stopRefresher(context.Background())
+	h.stopWatchdog(context.Background())
+	if h.cache != nil && !h.sharedCache {
 		h.cache.Close()
 	}
+	if h.origins != nil {
+		h.origins.close()
+	}
 }
 
 // Server returns an http.Handler that processes images from URLs.
@@ -165,13 +649,86 @@ func ServerWithConfig(config *Config) http.Handler {
 	return NewHandler(config)
 }
 
-// createErrorEntry creates a cache entry from an error.
+// storeEntry caches an entry, choosing its TTL. Unsupported-capability responses won't
+// change until redeploy, so they are kept for UnsupportedCacheTTL; otherwise the active
+// TTL schedule rule applies, falling back to the default CacheTTL. A shorter
+// lifetime from the origin (see Config.HonorOriginCacheControl) caps the TTL.
+// The cache keeps the entry for Config.StaleGrace longer, to be served stale.
+// Entries over Config.CacheMaxEntryBytes, or whose origin forbade caching, aren't
+// stored.
+func (h *Handler) storeEntry(key string, entry *CacheEntry) {
+	if entry.noStore {
+		entry.uncached = true
+		return
+	}
+	if limit := h.config.CacheMaxEntryBytes; limit > 0 && entry.Size() > limit {
+		entry.uncached = true
+		return
+	}
+	ttl := h.config.CacheTTL
+	if entry.unsupported && h.config.UnsupportedCacheTTL > 0 {
+		ttl = h.config.UnsupportedCacheTTL
+	} else if rule := h.ttlSchedule.Load().Active(h.now()); rule != nil {
+		ttl = rule.TTL
+		entry.TTLRule = rule.Name
+	}
+	if !entry.originExpires.IsZero() {
+		if left := entry.originExpires.Sub(h.now()); left < ttl {
+			ttl = left
+			entry.TTLRule = ""
+		}
+	}
+
+	entry.TTL = ttl
+	entry.expires = h.now().Add(ttl)
+	h.cache.SetWithTTL(key, entry, ttl+h.config.StaleGrace)
+}
+
+// storeError caches the entry of a fetch that failed with err. Only permanent
+// errors (4xx) are cached like images; failures of the origin that may recover
+// (429, 5xx, network) only for Config.ErrorCacheTTL, so clients can retry
+// successfully, and those of this server's limits not at all. Neither is a
+// refused Range, since the cache key doesn't include it.
+func (h *Handler) storeError(key string, entry *CacheEntry, err error) {
+	var fetchErr *FetchError
+	switch {
+	case errors.As(err, &fetchErr) && fetchErr.Kind == ErrKindRange:
+		entry.uncached = true
+	case errors.As(err, &fetchErr) && fetchErr.originFailure():
+		ttl := h.config.ErrorCacheTTL
+		if ttl <= 0 {
+			entry.uncached = true
+			return
+		}
+		// Without StaleGrace: a failure is never worth serving stale
+		entry.TTL = ttl
+		entry.expires = h.now().Add(ttl)
+		h.cache.SetWithTTL(key, entry, ttl)
+	case entry.StatusCode < 500:
+		h.storeEntry(key, entry)
+	default:
+		entry.uncached = true
+	}
+}
+
+// createErrorEntry creates a cache entry from an error. Fetch errors are
+// answered with their FetchError.ResponseStatus, an origin's 429 with its
+// Retry-After.
 func (h *Handler) createErrorEntry(err error) *CacheEntry {
-	if fetchErr, ok := err.(*FetchError); ok {
-		return &CacheEntry{
-			StatusCode: fetchErr.StatusCode,
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		entry := &CacheEntry{
+			StatusCode: fetchErr.ResponseStatus(),
 			ErrorMsg:   fetchErr.Message,
 		}
+		if entry.StatusCode == http.StatusTooManyRequests {
+			entry.RetryAfter = fetchErr.RetryAfter
+		}
+		return entry
+	}
+	var unsupported *UnsupportedError
+	if errors.As(err, &unsupported) {
+		return h.unsupportedEntry(unsupported)
 	}
 	return &CacheEntry{
 		StatusCode: http.StatusInternalServerError,
@@ -179,53 +736,241 @@ func (h *Handler) createErrorEntry(err error) *CacheEntry {
 	}
 }
 
-// processImage processes fetched image data with libvips transformations.
-func (h *Handler) processImage(imageData []byte, params *ProcessingParams) *CacheEntry {
-	proc := New().FromBytes(imageData)
-	origFormat := proc.OriginalFormat()
+// unsupportedEntry creates the entry answering err, counted in Stats.Unsupported.
+func (h *Handler) unsupportedEntry(err *UnsupportedError) *CacheEntry {
+	h.unsupported.Add(1)
+	return &CacheEntry{
+		StatusCode:  err.StatusCode(),
+		ErrorMsg:    err.Error(),
+		unsupported: true,
+	}
+}
+
+// processImage processes fetched image data with the transformations of pl.
+// overlay holds the fetched params.Overlay image, if any. Once ctx is done the
+// processor fails at its next stage. The entry records the source's size and
+// format and the processing time.
+func (h *Handler) processImage(ctx context.Context, imageData, overlay []byte, pl *Pipeline) (entry *CacheEntry) {
+	origFormat := DetectFormat(imageData)
+	origSize := len(imageData) // the deferred func mustn't keep imageData alive through encoding
+	start := time.Now()
+	defer func() {
+		if entry != nil { // nil while a panic unwinds
+			entry.OriginalBytes = origSize
+			entry.OriginalFormat = origFormat
+			entry.ProcessTime = time.Since(start)
+		}
+	}()
+	proc, params, enc, release, entry := h.prepare(ctx, imageData, overlay, pl)
+	defer release()
+	if entry != nil {
+		return entry
+	}
+	return h.encode(proc, params, origFormat, enc)
+}
+
+// prepare decodes and transforms imageData for pl, returning the processor to
+// encode with enc, the params as pre-processors left them and a function
+// releasing its decode reservation once encoded. Requests answered without
+// encoding (errors, passthroughs, info and placeholders) get their entry
+// instead, and a nil processor.
+func (h *Handler) prepare(ctx context.Context, imageData, overlay []byte, pl *Pipeline) (proc *Processor, params *ProcessingParams, enc Encoding, release func(), entry *CacheEntry) {
+	params = pl.params
+	origFormat := DetectFormat(imageData)
+	release = func() {}
+	if origFormat == FormatSVG && !h.config.AllowSVG {
+		return nil, params, Encoding{}, release, &CacheEntry{
+			StatusCode: http.StatusUnsupportedMediaType,
+			ErrorMsg:   ErrSVGDisabled.Error(),
+		}
+	}
+	if params.Info {
+		return nil, params, Encoding{}, release, h.infoEntry(imageData)
+	}
 
 	// If no transformation parameters are specified, return original image
-	if !params.NeedsProcessing(origFormat) {
-		proc.Close() // Free resources before returning
+	if !params.NeedsProcessing(origFormat) && !h.watermarked(params) {
 		entry := &CacheEntry{
-			ContentType: origFormat.ContentType(),
-			Data:        imageData,
-			StatusCode:  http.StatusOK,
+			ContentType:     origFormat.ContentType(),
+			Data:            imageData,
+			StatusCode:      http.StatusOK,
+			EffectiveParams: params.EffectiveQuery(origFormat),
 		}
 		// Compute ETag for original data
 		if h.config != nil && h.config.EnableETag {
 			sum := md5.Sum(entry.Data)
 			entry.ETag = fmt.Sprintf("\"%x\"", sum)
 		}
-		return entry
+		return nil, params, Encoding{}, release, entry
 	}
 
 	// Determine output format
-	outputFormat := params.GetOutputFormat(origFormat)
+	outputFormat, source := params.ResolveOutputFormat(origFormat)
+	if source == FormatSourceDefault {
+		h.log().Warn("unknown source format, falling back to jpeg", "url", params.URL)
+	}
+
+	// Reject formats this libvips build can't handle before doing any work
+	if err := h.checkCapabilities(imageData, outputFormat); err != nil {
+		h.log().Warn("capability unsupported", "url", params.URL, "capability", err.Capability)
+		return nil, params, Encoding{}, release, h.createErrorEntry(err)
+	}
+
+	reserve, release := h.reserveDecode()
+	// Animations survive only into animated formats, and only operations that keep frames apart
+	animated := outputFormat.SupportsAnimation() && params.KeepsAnimation()
+	shrinkWidth, shrinkHeight := shrinkOnLoadSize(params)
+	if len(h.preProcessors) > 0 {
+		shrinkWidth, shrinkHeight = 0, 0
+	}
+	proc = New().WithContext(ctx).MaxPixels(h.config.MaxInputPixels).ReserveDecode(reserve).Animated(animated).
+		Page(params.Page).Frame(params.Frame).Density(params.Density).RasterSize(params.Width, params.Height).
+		ShrinkOnLoad(shrinkWidth, shrinkHeight).FromBytes(imageData)
+	var pageErr *PageRangeError
+	if errors.As(proc.Err(), &pageErr) {
+		return nil, params, Encoding{}, release, &CacheEntry{
+			StatusCode: http.StatusBadRequest,
+			ErrorMsg:   pageErr.Error(),
+		}
+	}
+	var tooLarge *PixelLimitError
+	if errors.As(proc.Err(), &tooLarge) {
+		h.log().Warn("source image over pixel limit", "url", params.URL, "width", tooLarge.Width, "height", tooLarge.Height, "frames", tooLarge.Frames)
+		return nil, params, Encoding{}, release, &CacheEntry{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			ErrorMsg:   tooLarge.Error(),
+		}
+	}
+	if errors.Is(proc.Err(), ErrMemoryBudget) {
+		h.log().Warn("no memory to decode image", "url", params.URL, "error", proc.Err())
+		return nil, params, Encoding{}, release, &CacheEntry{
+			StatusCode: http.StatusServiceUnavailable,
+			ErrorMsg:   proc.Err().Error(),
+		}
+	}
+
+	if len(h.preProcessors) > 0 {
+		proc, params = h.preProcess(proc, params)
+		pl = h.compile(params)
+		outputFormat, _ = params.ResolveOutputFormat(origFormat)
+	}
+	proc = h.transform(proc, overlay, pl)
+	if params.Placeholder != "" {
+		return nil, params, Encoding{}, release, h.placeholderEntry(proc, params)
+	}
+	proc, enc = h.encoding(proc, params, outputFormat)
+	return proc, params, enc, release, nil
+}
+
+// preProcess runs the pre-processors on proc with a copy of params, see
+// UsePreProcessor.
+func (h *Handler) preProcess(proc *Processor, params *ProcessingParams) (*Processor, *ProcessingParams) {
+	copied := *params
+	for _, processor := range h.preProcessors {
+		proc = processor(proc, &copied)
+	}
+	return proc, &copied
+}
+
+// encoding returns how proc is to be encoded in outputFormat for params, as
+// the encoder hooks leave it.
+func (h *Handler) encoding(proc *Processor, params *ProcessingParams, outputFormat Format) (*Processor, Encoding) {
+	enc := Encoding{Format: outputFormat, Options: h.encodeOptions(params)}
+	for _, encoder := range h.encoders {
+		proc = encoder(proc, params, &enc)
+	}
+	return proc, enc
+}
+
+// shrinkOnLoadSize returns the size a source may be decoded down to for params
+// (see Processor.ShrinkOnLoad), 0x0 if a step before the resize needs it at
+// full resolution.
+func shrinkOnLoadSize(params *ProcessingParams) (width, height int) {
+	if params.Extract != "" || params.CropWidth > 0 || params.Pixelate > 1 {
+		return 0, 0
+	}
+	// Zooming scales past the requested size; keep the pixels it needs
+	if params.Zoom > 1 {
+		return int(float64(params.Width) * params.Zoom), int(float64(params.Height) * params.Zoom)
+	}
+	return params.Width, params.Height
+}
+
+// transform applies the built-in operations of pl, the overlay and custom processors.
+func (h *Handler) transform(proc *Processor, overlay []byte, pl *Pipeline) *Processor {
+	params := pl.params
+	// Color operations and encoders assume sRGB
+	if !h.config.DisableColorManagement {
+		proc = proc.ToSRGB()
+	}
 
 	// Apply built-in operations in order (order matters for image processing)
-	proc = h.applyBuiltInTransformations(proc, params)
+	proc = pl.apply(proc)
+	if overlay != nil {
+		proc = proc.ApplyFunc(func(img *vips.ImageRef) error {
+			place := func(w, h int) (int, int) {
+				return overlayOffset(params.OverlayPos, img.Width(), img.Height(), w, h)
+			}
+			return compositeOverlay(img, overlay, h.config.MaxInputPixels, params.OverlayWidth, place, vips.BlendModeOver)
+		})
+	}
 
 	// Apply custom processors
 	for _, processor := range h.processors {
 		proc = processor(proc, params)
 	}
+	return proc
+}
 
+// encode encodes a transformed image with enc into a cache entry and closes proc.
+func (h *Handler) encode(proc *Processor, params *ProcessingParams, origFormat Format, enc Encoding) *CacheEntry {
 	// Check for errors
 	if err := proc.Err(); err != nil {
 		proc.Close()
-		slog.Error("image processing failed", "url", params.URL, "error", err)
+		var resp *Response
+		if errors.As(err, &resp) {
+			return h.responseEntry(resp)
+		}
+		var region *RegionError
+		if errors.As(err, &region) {
+			return &CacheEntry{
+				StatusCode: http.StatusBadRequest,
+				ErrorMsg:   region.Error(),
+			}
+		}
+		var tooLarge *PixelLimitError
+		if errors.As(err, &tooLarge) { // an overlay; sources are refused in prepare
+			return &CacheEntry{
+				StatusCode: http.StatusRequestEntityTooLarge,
+				ErrorMsg:   "overlay: " + tooLarge.Error(),
+			}
+		}
+		h.log().Error("image processing failed", "url", params.URL, "error", err)
 		return &CacheEntry{
 			StatusCode: http.StatusInternalServerError,
 			ErrorMsg:   fmt.Sprintf("processing: %v", err),
 		}
 	}
 
-	// Encode to output format
-	out, err := proc.ToBytes(outputFormat, params.Quality)
+	// Encoder hooks may have picked a format this libvips build can't write
+	outputFormat := enc.Format
+	if err := h.checkSave(outputFormat); err != nil {
+		proc.Close()
+		return h.createErrorEntry(err)
+	}
+
+	// Encode to output format, searching for a quality that fits the budget with q=auto
+	var out []byte
+	var err error
+	quality := 0
+	if params.QualityAuto && params.MaxBytes > 0 {
+		out, quality, err = proc.toBytesWithBudget(outputFormat, enc.Options, params.MaxBytes)
+	} else {
+		out, err = proc.ToBytesWithOptions(outputFormat, enc.Options)
+	}
 	proc.Close() // Free memory immediately after processing
 	if err != nil {
-		slog.Error("image encode failed", "url", params.URL, "format", string(outputFormat), "error", err)
+		h.log().Error("image encode failed", "url", params.URL, "format", string(outputFormat), "error", err)
 		return &CacheEntry{
 			StatusCode: http.StatusInternalServerError,
 			ErrorMsg:   fmt.Sprintf("encode: %v", err),
@@ -233,9 +978,14 @@ func (h *Handler) processImage(imageData []byte, params *ProcessingParams) *Cach
 	}
 
 	entry := &CacheEntry{
-		ContentType: outputFormat.ContentType(),
-		Data:        out,
-		StatusCode:  http.StatusOK,
+		ContentType:     outputFormat.ContentType(),
+		Data:            out,
+		StatusCode:      http.StatusOK,
+		EffectiveParams: params.EffectiveQuery(origFormat),
+		Quality:         quality,
+	}
+	if quality > 0 && len(out) > params.MaxBytes {
+		h.log().Warn("output over byte budget at lowest quality", "url", params.URL, "size", len(out), "maxbytes", params.MaxBytes)
 	}
 
 	// Compute ETag once and store it
@@ -247,157 +997,115 @@ func (h *Handler) processImage(imageData []byte, params *ProcessingParams) *Cach
 	return entry
 }
 
-// applyBuiltInTransformations applies the standard image transformations.
-func (h *Handler) applyBuiltInTransformations(proc *Processor, params *ProcessingParams) *Processor {
-
-	// 1. Extract/Crop (do this first to reduce data to process)
-	if params.Extract != "" {
-		parts := strings.Split(params.Extract, "_")
-		if len(parts) == 4 {
-			left, _ := strconv.Atoi(parts[0])
-			top, _ := strconv.Atoi(parts[1])
-			width, _ := strconv.Atoi(parts[2])
-			height, _ := strconv.Atoi(parts[3])
-			proc = proc.Extract(left, top, width, height)
-		}
-	}
-
-	// 2. Resize
-	if params.Width > 0 || params.Height > 0 {
-		kernel := params.GetVipsKernel()
-		proc = proc.ResizeWithOptions(params.Width, params.Height, kernel, params.Enlarge)
-	}
-
-	// 3. Extend (add borders)
-	if params.Extend != "" {
-		parts := strings.Split(params.Extend, "_")
-		if len(parts) == 4 {
-			top, _ := strconv.Atoi(parts[0])
-			right, _ := strconv.Atoi(parts[1])
-			bottom, _ := strconv.Atoi(parts[2])
-			left, _ := strconv.Atoi(parts[3])
-
-			var bgColor []float64
-			if params.Background != "" {
-				bgColor = hexToRGB(params.Background)
-			}
-			proc = proc.Extend(top, right, bottom, left, bgColor)
-		}
-	}
-
-	// 4. Rotate
-	if params.Rotate != 0 {
-		angle := angleToVips(params.Rotate)
-		proc = proc.Rotate(angle)
-	}
-
-	// 5. Flip/Flop
-	if params.Flip {
-		proc = proc.Flip()
-	}
-	if params.Flop {
-		proc = proc.Flop()
+// checkCapabilities returns an UnsupportedError if the source can't be decoded
+// or the output format can't be encoded by the current libvips build.
+func (h *Handler) checkCapabilities(imageData []byte, outputFormat Format) *UnsupportedError {
+	if err := h.checkLoad(imageData); err != nil {
+		return err
 	}
+	return h.checkSave(outputFormat)
+}
 
-	// 6. Blur
-	if params.Blur > 0 {
-		proc = proc.Blur(params.Blur)
+// checkLoad returns an UnsupportedError, answered with 501, if the source can't
+// be decoded by the current libvips build.
+func (h *Handler) checkLoad(imageData []byte) *UnsupportedError {
+	if name := loaderName(imageData); name != "" && !h.capabilities.CanLoad(name) {
+		return &UnsupportedError{Capability: name + " input", Supported: h.capabilities.LoadFormats()}
 	}
+	return nil
+}
 
-	// 7. Sharpen
-	if params.Sharpen != "" {
-		parts := strings.Split(params.Sharpen, "_")
-		sigma, flat, jagged := 1.0, 1.0, 2.0
-		if len(parts) >= 1 {
-			if v, err := strconv.ParseFloat(parts[0], 64); err == nil {
-				sigma = v
-			}
+// checkSave returns an UnsupportedError if outputFormat can't be encoded by the
+// current libvips build. Builds often lack AVIF, HEIF (libheif without an HEVC
+// encoder) or JPEG XL; 415 with the formats it can encode tells clients to ask
+// for another one rather than that the server is broken.
+func (h *Handler) checkSave(outputFormat Format) *UnsupportedError {
+	if !h.capabilities.CanSave(outputFormat) {
+		return &UnsupportedError{
+			Capability: string(outputFormat) + " output",
+			Supported:  h.capabilities.SaveFormats(),
+			Status:     http.StatusUnsupportedMediaType,
 		}
-		if len(parts) >= 2 {
-			if v, err := strconv.ParseFloat(parts[1], 64); err == nil {
-				flat = v
-			}
-		}
-		if len(parts) >= 3 {
-			if v, err := strconv.ParseFloat(parts[2], 64); err == nil {
-				jagged = v
-			}
-		}
-		proc = proc.Sharpen(sigma, flat, jagged)
 	}
+	return nil
+}
 
-	// 8. Color operations
-	if params.Grayscale {
-		proc = proc.Grayscale()
-	}
+// Capabilities returns the formats the handler can decode and encode:
+// Config.Capabilities if set, otherwise those DetectCapabilities probed.
+func (h *Handler) Capabilities() *Capabilities {
+	return h.capabilities
+}
 
-	if params.Negate {
-		proc = proc.Negate()
-	}
+// serveFormats writes the formats supported by the current libvips build as
+// JSON, for /capabilities, ?capabilities=1 and the older /formats.
+func (h *Handler) serveFormats(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"load": h.capabilities.LoadFormats(),
+		"save": h.capabilities.SaveFormats(),
+	})
+}
 
-	if params.Normalize {
-		proc = proc.Normalize()
-	}
+// serveParams lists the query parameters (see ListParams) for client introspection.
+func serveParams(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]ParamSpec{"params": ListParams()})
+}
 
-	if params.Gamma > 0 {
-		proc = proc.Gamma(params.Gamma)
-	}
+// Values of the X-IPX-Cache debug header.
+const (
+	cacheHit    = "HIT"
+	cacheMiss   = "MISS"
+	cacheStale  = "STALE"  // a hit past its TTL, see Config.StaleGrace
+	cacheBypass = "BYPASS" // a response that isn't cached
+)
 
-	if params.Modulate != "" {
-		parts := strings.Split(params.Modulate, "_")
-		brightness, saturation, hue := 1.0, 1.0, 0.0
-		if len(parts) >= 1 {
-			if v, err := strconv.ParseFloat(parts[0], 64); err == nil {
-				brightness = v
-			}
-		}
-		if len(parts) >= 2 {
-			if v, err := strconv.ParseFloat(parts[1], 64); err == nil {
-				saturation = v
-			}
-		}
-		if len(parts) >= 3 {
-			if v, err := strconv.ParseFloat(parts[2], 64); err == nil {
-				hue = v
-			}
+// writeResponse writes a cache entry to the HTTP response writer. cacheStatus
+// tells whether the entry came from the cache, for the debug headers.
+func (h *Handler) writeResponse(w http.ResponseWriter, r *http.Request, entry *CacheEntry, cacheStatus string) {
+	if h.debugging(r) {
+		if cacheStatus == cacheHit && !entry.expires.IsZero() && h.now().After(entry.expires) {
+			cacheStatus = cacheStale
 		}
-		proc = proc.Modulate(brightness, saturation, hue)
-	}
-
-	// 9. Flatten (remove alpha)
-	if params.Flatten {
-		var bgColor *vips.Color
-		if params.Background != "" {
-			rgb := hexToRGB(params.Background)
-			if len(rgb) >= 3 {
-				bgColor = &vips.Color{
-					R: uint8(rgb[0]),
-					G: uint8(rgb[1]),
-					B: uint8(rgb[2]),
-				}
-			}
+		if cacheStatus == cacheMiss && entry.uncached {
+			cacheStatus = cacheBypass
 		}
-		proc = proc.Flatten(bgColor)
+		w.Header().Set("X-IPX-Cache", cacheStatus)
+		h.writeDebugHeaders(w, entry)
 	}
 
-	return proc
-}
-
-// writeResponse writes a cache entry to the HTTP response writer.
-func (h *Handler) writeResponse(w http.ResponseWriter, r *http.Request, entry *CacheEntry) {
 	if entry.ErrorMsg != "" {
+		if entry.RetryAfter != "" {
+			w.Header().Set("Retry-After", entry.RetryAfter)
+		}
+		if entry.StatusCode >= 500 || entry.StatusCode == http.StatusTooManyRequests {
+			// Failures that may recover are kept by no cache but ours, see Config.ErrorCacheTTL
+			w.Header().Set("Cache-Control", "no-store")
+		}
 		w.WriteHeader(entry.StatusCode)
 		w.Write([]byte(entry.ErrorMsg))
 		return
 	}
 
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(entry.Data)))
+	// Open the body first: a spilled entry evicted since lookup has nothing left to send
+	body, done, err := entry.body()
+	if err != nil {
+		h.log().Warn("cached entry unavailable", "error", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", entry.Size()))
 
 	// Use cached ContentType, but fall back to detection only if not set
 	ct := entry.ContentType
 	if ct == "" {
 		// Only detect format if ContentType was not explicitly set
-		detected := DetectFormat(entry.Data)
+		var detected Format
+		if !entry.Compressed {
+			detected = DetectFormat(entry.Data)
+		}
 		if detected != "" {
 			ct = detected.ContentType()
 		}
@@ -409,9 +1117,14 @@ func (h *Handler) writeResponse(w http.ResponseWriter, r *http.Request, entry *C
 	w.Header().Set("Content-Type", ct)
 	// Prefer inline display universally to avoid forced downloads
 	w.Header().Set("Content-Disposition", "inline")
+	if entry.Quality > 0 {
+		w.Header().Set("X-IPX-Quality", strconv.Itoa(entry.Quality))
+	}
 
 	// Use precomputed ETag if enabled
+	var etag string
 	if h.config != nil && h.config.EnableETag && entry.ETag != "" {
+		etag = entry.ETag
 		w.Header().Set("ETag", entry.ETag)
 
 		// If client sent If-None-Match and matches, return 304
@@ -419,10 +1132,10 @@ func (h *Handler) writeResponse(w http.ResponseWriter, r *http.Request, entry *C
 			w.WriteHeader(http.StatusNotModified)
 			return
 		}
-	} else if h.config != nil && h.config.EnableETag {
+	} else if h.config != nil && h.config.EnableETag && entry.spill == nil && !entry.Compressed {
 		// Fallback for entries without precomputed ETag
 		sum := md5.Sum(entry.Data)
-		etag := fmt.Sprintf("\"%x\"", sum)
+		etag = fmt.Sprintf("\"%x\"", sum)
 		w.Header().Set("ETag", etag)
 
 		if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag {
@@ -431,7 +1144,23 @@ func (h *Handler) writeResponse(w http.ResponseWriter, r *http.Request, entry *C
 		}
 	}
 
-	// Cache-Control headers: use config
+	h.setCacheControl(w, h.clientPolicy(entry))
+
+	if entry.StatusCode == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if h.writeRange(w, r, body, int64(entry.Size()), etag) {
+			return
+		}
+	}
+
+	w.WriteHeader(entry.StatusCode)
+	io.Copy(w, body)
+}
+
+// setCacheControl sets the Cache-Control header from the client/shared max-age
+// config. origin, if not nil, is the source's policy, which may only shorten
+// the max-ages or forbid caching.
+func (h *Handler) setCacheControl(w http.ResponseWriter, origin *OriginPolicy) {
 	maxAge := 604800
 	sMaxAge := 0
 	if h.config != nil {
@@ -440,38 +1169,135 @@ func (h *Handler) writeResponse(w http.ResponseWriter, r *http.Request, entry *C
 		}
 		sMaxAge = h.config.SMaxAge
 	}
+	if origin != nil {
+		if origin.NoStore {
+			w.Header().Set("Cache-Control", "private, no-store")
+			return
+		}
+		limit := int(origin.MaxAge / time.Second)
+		maxAge = min(maxAge, limit)
+		if sMaxAge > 0 {
+			sMaxAge = min(sMaxAge, limit)
+		}
+	}
 	if sMaxAge > 0 {
 		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, s-maxage=%d", maxAge, sMaxAge))
 	} else {
 		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
 	}
-
-	w.WriteHeader(entry.StatusCode)
-	w.Write(entry.Data)
 }
 
-// hexToRGB converts hex color string to RGB values
-func hexToRGB(hex string) []float64 {
-	hex = strings.TrimPrefix(hex, "#")
+// debugging reports whether the response to r gets debug headers.
+func (h *Handler) debugging(r *http.Request) bool {
+	if h.config == nil {
+		return false
+	}
+	return h.config.DebugHeaders || h.config.DebugRequests && r.Header.Get("X-IPX-Debug") == "1"
+}
 
-	// Handle 3-digit hex
-	if len(hex) == 3 {
-		hex = string(hex[0]) + string(hex[0]) + string(hex[1]) + string(hex[1]) + string(hex[2]) + string(hex[2])
+// writeDebugHeaders exposes cache decisions, sizes and timings for an entry as X-IPX-* headers.
+func (h *Handler) writeDebugHeaders(w http.ResponseWriter, entry *CacheEntry) {
+	if entry.FetchTime > 0 {
+		w.Header().Set("X-IPX-Fetch-Ms", formatMillis(entry.FetchTime))
+	}
+	if entry.ProcessTime > 0 {
+		w.Header().Set("X-IPX-Process-Ms", formatMillis(entry.ProcessTime))
+	}
+	if entry.OriginalBytes > 0 {
+		w.Header().Set("X-IPX-Original-Bytes", strconv.Itoa(entry.OriginalBytes))
+	}
+	if entry.OriginalFormat != "" {
+		w.Header().Set("X-IPX-Original-Format", string(entry.OriginalFormat))
+	}
+	if entry.ErrorMsg == "" {
+		w.Header().Set("X-IPX-Output-Bytes", strconv.Itoa(entry.Size()))
+	}
+	if entry.TTL > 0 {
+		w.Header().Set("X-IPX-Cache-TTL", entry.TTL.String())
+	}
+	if entry.TTLRule != "" {
+		w.Header().Set("X-IPX-TTL-Rule", entry.TTLRule)
 	}
+	if entry.EffectiveParams != "" {
+		w.Header().Set("X-IPX-Params", entry.EffectiveParams)
+	}
+	if entry.AliasOf != "" {
+		w.Header().Set("X-IPX-Alias-Of", entry.AliasOf)
+	}
+}
+
+// formatMillis formats d in milliseconds with microsecond precision, e.g. "12.345".
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 3, 64)
+}
 
-	if len(hex) != 6 {
-		return []float64{255, 255, 255} // default to white
+// modulation combines modulate= with the brightness, saturation and hue parameters:
+// multipliers are multiplied and hue rotations added. ok is false if none were given.
+func modulation(params *ProcessingParams) (brightness, saturation, hue float64, ok bool) {
+	brightness, saturation = 1.0, 1.0
+	if params.Modulate != "" {
+		ok = true
+		parts := core.SplitPacked(params.Modulate, 3)
+		if len(parts) >= 1 {
+			if v, err := strconv.ParseFloat(parts[0], 64); err == nil {
+				brightness = v
+			}
+		}
+		if len(parts) >= 2 {
+			if v, err := strconv.ParseFloat(parts[1], 64); err == nil {
+				saturation = v
+			}
+		}
+		if len(parts) >= 3 {
+			if v, err := strconv.ParseFloat(parts[2], 64); err == nil {
+				hue = v
+			}
+		}
+	}
+	if params.Brightness > 0 {
+		brightness *= params.Brightness
+		ok = true
+	}
+	if params.Saturation > 0 {
+		saturation *= params.Saturation
+		ok = true
 	}
+	if params.Hue != 0 {
+		hue += params.Hue
+		ok = true
+	}
+	return brightness, saturation, hue, ok
+}
 
-	r, err1 := strconv.ParseUint(hex[0:2], 16, 8)
-	g, err2 := strconv.ParseUint(hex[2:4], 16, 8)
-	b, err3 := strconv.ParseUint(hex[4:6], 16, 8)
+// channels returns c as the channel values embedOnCanvas and duotone take.
+func channels(c RGBA) []float64 {
+	return []float64{float64(c.R), float64(c.G), float64(c.B), float64(c.A)}
+}
+
+// canvasColor returns the fill for new canvas areas (pad, padding, extend): the
+// background color, which may be translucent, or nil (white) when there is none
+// or it is fully transparent and the output format has no alpha channel.
+func canvasColor(params *ProcessingParams, proc *Processor) []float64 {
+	return fillColor(params.Background, params, proc)
+}
 
-	if err1 != nil || err2 != nil || err3 != nil {
-		return []float64{255, 255, 255} // default to white
+// fillColor is canvasColor for another color, such as the border's.
+func fillColor(color string, params *ProcessingParams, proc *Processor) []float64 {
+	c, err := ParseColor(color)
+	if err != nil || c.A == 0 && !params.GetOutputFormat(proc.OriginalFormat()).SupportsAlpha() {
+		return nil
 	}
+	return channels(c)
+}
 
-	return []float64{float64(r), float64(g), float64(b)}
+// flattenColor converts a color to the opaque vips.Color to flatten onto: white
+// if it is unset, invalid or fully transparent, its alpha ignored otherwise.
+func flattenColor(color string) *vips.Color {
+	c, err := ParseColor(color)
+	if err != nil || c.A == 0 {
+		return &vips.Color{R: 255, G: 255, B: 255}
+	}
+	return &vips.Color{R: c.R, G: c.G, B: c.B}
 }
 
 // angleToVips converts rotation angle to vips.Angle
@@ -0,0 +1,31 @@
+package ipxpress
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// Signature errors, see Config.SignatureSecrets. The handler maps both to 403.
+var (
+	ErrSignatureInvalid = core.ErrSignatureInvalid
+	ErrSignatureExpired = core.ErrSignatureExpired
+)
+
+// SignURL returns baseURL with the signed query for params, including params.URL,
+// for a handler with secret among its Config.SignatureSecrets. See core.SignURL.
+func SignURL(secret, baseURL string, params *ProcessingParams) string {
+	return core.SignURL(secret, baseURL, params.toCore())
+}
+
+// SignURLUntil is like SignURL but the signature is refused after expires.
+func SignURLUntil(secret, baseURL string, params *ProcessingParams, expires time.Time) string {
+	return core.SignURLUntil(secret, baseURL, params.toCore(), expires)
+}
+
+// VerifySignature checks the sig parameter of a query against each secret. See
+// core.VerifySignature.
+func VerifySignature(q url.Values, secrets []string, now time.Time) error {
+	return core.VerifySignature(q, secrets, now)
+}
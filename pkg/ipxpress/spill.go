@@ -0,0 +1,154 @@
+package ipxpress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// spillPattern names the files holding spilled entries; startup removes any left
+// behind by a crash.
+const spillPattern = "ipx-*.entry"
+
+// errEntryEvicted is returned when a spilled entry's file is gone before it was read.
+var errEntryEvicted = errors.New("cache entry was evicted")
+
+// spillFile holds the data of a large cache entry in a temp file, keeping it out of
+// the Go heap. The file is unlinked on eviction and closed once no reader uses it,
+// so responses being written while the entry is evicted still complete.
+type spillFile struct {
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	readers int
+	evicted bool
+}
+
+// newSpillFile writes data to a new file in dir.
+func newSpillFile(dir string, data []byte) (*spillFile, error) {
+	f, err := os.CreateTemp(dir, spillPattern)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spillFile{f: f, size: int64(len(data))}, nil
+}
+
+// open returns a reader over the data and a function to call when done with it.
+func (s *spillFile) open() (io.Reader, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return nil, nil, errEntryEvicted
+	}
+	s.readers++
+	return io.NewSectionReader(s.f, 0, s.size), s.release, nil
+}
+
+func (s *spillFile) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readers--
+	if s.readers == 0 && s.evicted {
+		s.close()
+	}
+}
+
+// evict deletes the file; its descriptor stays open until the last reader is done.
+func (s *spillFile) evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.evicted {
+		return
+	}
+	s.evicted = true
+	os.Remove(s.f.Name())
+	if s.readers == 0 {
+		s.close()
+	}
+}
+
+func (s *spillFile) close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+}
+
+// removeSpillFiles deletes spilled entries left in dir by a previous process.
+func removeSpillFiles(dir string) error {
+	orphans, err := filepath.Glob(filepath.Join(dir, spillPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range orphans {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the entry's data, wherever and however it's stored.
+func (e *CacheEntry) Size() int {
+	if e.Compressed {
+		return e.uncompressedSize()
+	}
+	return e.storedSize()
+}
+
+// storedSize returns the bytes the entry's data takes in the cache.
+func (e *CacheEntry) storedSize() int {
+	if e.spill != nil {
+		return int(e.spill.size)
+	}
+	return len(e.Data)
+}
+
+// Bytes returns the entry's data. For entries moved out of the heap by
+// InMemoryCache.SpillLargeEntries, Data is nil and Bytes reads the data back;
+// compressed entries are decompressed.
+func (e *CacheEntry) Bytes() ([]byte, error) {
+	if e.spill == nil && !e.Compressed {
+		return e.Data, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(e.Size())
+	err := e.WriteData(&buf)
+	return buf.Bytes(), err
+}
+
+// WriteData writes the entry's data to w, streaming spilled entries from disk.
+func (e *CacheEntry) WriteData(w io.Writer) error {
+	r, done, err := e.body()
+	if err != nil {
+		return err
+	}
+	defer done()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to write cached entry: %w", err)
+	}
+	return nil
+}
+
+// body returns a reader over the entry's data and a function to call when done.
+func (e *CacheEntry) body() (io.Reader, func(), error) {
+	r, done, err := io.Reader(bytes.NewReader(e.Data)), func() {}, error(nil)
+	if e.spill != nil {
+		if r, done, err = e.spill.open(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if e.Compressed {
+		return gunzip(r, done)
+	}
+	return r, done, nil
+}
@@ -0,0 +1,78 @@
+package ipxpress
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// staleWarning is the Warning header of responses served stale (RFC 9111 section 5.5).
+const staleWarning = `110 - "Response is Stale"`
+
+// lookup returns the cached entry for key. With Config.StaleGrace, stale is true
+// for an entry past its TTL but within the grace, and entries past the grace
+// count as missing even if the cache still has them.
+func (h *Handler) lookup(key string) (entry *CacheEntry, found, stale bool) {
+	entry, found = h.cache.Get(key)
+	if !found || h.config.StaleGrace <= 0 || entry.expires.IsZero() {
+		return entry, found, false
+	}
+	now := h.now()
+	if !now.After(entry.expires) {
+		return entry, true, false
+	}
+	if now.After(entry.expires.Add(h.config.StaleGrace)) {
+		return nil, false, false
+	}
+	return entry, true, true
+}
+
+// serveStale writes a stale entry and starts refreshing it in the background.
+func (h *Handler) serveStale(w http.ResponseWriter, r *http.Request, key string, entry *CacheEntry) {
+	h.revalidate(key, entry)
+	w.Header().Set("Warning", staleWarning)
+	h.writeResponse(w, r, entry, cacheStale)
+}
+
+// revalidate reprocesses a stale entry in the background, once per key at a
+// time. If that fails the stale entry keeps being served until its grace ends.
+// Entries that can't be redone (e.g. the default image) are left to expire.
+func (h *Handler) revalidate(key string, entry *CacheEntry) {
+	if entry.params == nil {
+		return
+	}
+	if _, running := h.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	h.revalidations.Add(1)
+	go func() {
+		defer h.revalidations.Done()
+		defer h.revalidating.Delete(key)
+
+		// Queue for a slot like a client request, so revalidation counts against ProcessingLimit
+		defer h.processing.acquire(h.cheap(entry.params, nil))()
+		if !h.reprocess(key, entry.params, entry.hits.Load()) {
+			h.log().Warn("revalidation failed, serving stale", "url", entry.params.URL)
+		}
+	}()
+}
+
+// waitRevalidations waits for background revalidations to finish until ctx is done.
+func (h *Handler) waitRevalidations(ctx context.Context) error {
+	return waitGroup(ctx, &h.revalidations)
+}
+
+// waitGroup waits for wg until ctx is done.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
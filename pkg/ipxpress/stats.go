@@ -0,0 +1,190 @@
+package ipxpress
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// VipsStats is libvips' accounting of its own memory.
+type VipsStats struct {
+	Mem          int64 `json:"mem"`           // bytes allocated now
+	MemHighwater int64 `json:"mem_highwater"` // most bytes allocated at once
+	Allocs       int64 `json:"allocs"`        // live allocations
+	Files        int64 `json:"files"`         // open files
+}
+
+// Stats is a snapshot of a Handler's health, see Handler.Stats.
+type Stats struct {
+	Uptime      time.Duration   `json:"uptime"`
+	InFlight    int64           `json:"in_flight"`   // image requests being served
+	Unsupported int64           `json:"unsupported"` // responses made for formats the libvips build lacks, see UnsupportedError
+	Processing  ProcessingStats `json:"processing"`
+	Origins     map[string]int  `json:"origins,omitempty"` // origin requests in flight per host, see Fetcher.HostsInFlight
+	Vips        VipsStats       `json:"vips"`
+	Cache       *CacheStats     `json:"cache,omitempty"` // if the cache is a StatsReporter
+}
+
+// readVipsStats returns libvips' memory accounting.
+func readVipsStats() VipsStats {
+	var m vips.MemoryStats
+	vips.ReadVipsMemStats(&m)
+	return VipsStats{Mem: m.Mem, MemHighwater: m.MemHigh, Allocs: m.Allocs, Files: m.Files}
+}
+
+// Stats returns the handler's uptime, requests in flight, unsupported-format
+// responses, processing slots, origin requests in flight per host, libvips'
+// memory and the cache's stats. libvips' numbers are process-wide, shared by
+// every handler.
+func (h *Handler) Stats() Stats {
+	stats := Stats{
+		Uptime:      h.now().Sub(h.started),
+		InFlight:    h.inFlight.Load(),
+		Unsupported: h.unsupported.Load(),
+		Processing:  h.processing.stats(),
+		Vips:        readVipsStats(),
+	}
+	if f := h.builtinFetcher(); f != nil {
+		stats.Origins = f.HostsInFlight()
+	}
+	if reporter, ok := h.cache.(StatsReporter); ok {
+		cache := reporter.Stats()
+		stats.Cache = &cache
+	}
+	return stats
+}
+
+// serveStats reports Handler.Stats.
+func (h *Handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Stats())
+}
+
+// Reasons of a VipsAlert.
+const (
+	VipsAlertMem    = "mem"    // VipsWatchdogConfig.MaxMem exceeded
+	VipsAlertAllocs = "allocs" // VipsWatchdogConfig.MaxAllocs exceeded
+	VipsAlertGrowth = "growth" // memory grew for VipsWatchdogConfig.GrowthChecks checks in a row
+)
+
+// VipsAlert is raised by the libvips watchdog, see Config.VipsWatchdog.
+type VipsAlert struct {
+	Reason string // one of the VipsAlert constants
+	Stats  VipsStats
+}
+
+// VipsWatchdogConfig configures the watchdog that checks libvips' memory for
+// leaks. Each check raises an alert per limit exceeded.
+type VipsWatchdogConfig struct {
+	// Interval between checks. Defaults to one minute.
+	Interval time.Duration
+
+	// MaxMem is the most bytes libvips may hold. 0 disables the check.
+	MaxMem int64
+
+	// MaxAllocs is the most live libvips allocations. 0 disables the check.
+	MaxAllocs int64
+
+	// GrowthChecks raises an alert when libvips' memory grew at this many checks
+	// in a row, then starts counting again. 0 disables it.
+	GrowthChecks int
+
+	// OnAlert is called with each alert. Defaults to logging a warning.
+	OnAlert func(VipsAlert)
+}
+
+// watchdog holds the state of the libvips watchdog.
+type watchdog struct {
+	config VipsWatchdogConfig
+	stop   chan struct{}
+	done   chan struct{}
+	halt   sync.Once
+
+	mu      sync.Mutex
+	lastMem int64
+	growing int
+}
+
+// newWatchdog applies the defaults of config.
+func newWatchdog(config VipsWatchdogConfig) *watchdog {
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	return &watchdog{config: config, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// run calls h.CheckVips every interval until stopped.
+func (d *watchdog) run(h *Handler) {
+	defer close(d.done)
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.CheckVips()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// CheckVips runs one watchdog check now and returns its alerts, after passing
+// them to VipsWatchdogConfig.OnAlert. It's called every interval when
+// Config.VipsWatchdog is set, and does nothing otherwise.
+func (h *Handler) CheckVips() []VipsAlert {
+	d := h.watchdog
+	if d == nil {
+		return nil
+	}
+	stats := readVipsStats()
+
+	var alerts []VipsAlert
+	if d.config.MaxMem > 0 && stats.Mem > d.config.MaxMem {
+		alerts = append(alerts, VipsAlert{Reason: VipsAlertMem, Stats: stats})
+	}
+	if d.config.MaxAllocs > 0 && stats.Allocs > d.config.MaxAllocs {
+		alerts = append(alerts, VipsAlert{Reason: VipsAlertAllocs, Stats: stats})
+	}
+	d.mu.Lock()
+	if stats.Mem > d.lastMem {
+		d.growing++
+	} else {
+		d.growing = 0
+	}
+	d.lastMem = stats.Mem
+	if d.config.GrowthChecks > 0 && d.growing >= d.config.GrowthChecks {
+		alerts = append(alerts, VipsAlert{Reason: VipsAlertGrowth, Stats: stats})
+		d.growing = 0
+	}
+	d.mu.Unlock()
+
+	for _, alert := range alerts {
+		if d.config.OnAlert != nil {
+			d.config.OnAlert(alert)
+			continue
+		}
+		h.log().Warn("libvips memory alert", "reason", alert.Reason, "mem", stats.Mem, "mem_highwater", stats.MemHighwater,
+			"allocs", stats.Allocs, "files", stats.Files)
+	}
+	return alerts
+}
+
+// stopWatchdog stops the watchdog, if any, waiting for a running check to
+// finish until ctx is done.
+func (h *Handler) stopWatchdog(ctx context.Context) error {
+	d := h.watchdog
+	if d == nil {
+		return nil
+	}
+	d.halt.Do(func() { close(d.stop) })
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
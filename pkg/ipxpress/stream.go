@@ -0,0 +1,197 @@
+package ipxpress
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// streamedEntry is returned from the singleflight group when the leader streamed its
+// response directly. Large bodies can't be shared, so waiting requests stream their own.
+var streamedEntry = &CacheEntry{}
+
+// streamPassthrough handles passthrough requests (no transformations) whose origin body
+// exceeds Config.StreamThreshold by piping it straight to the client, bypassing both the
+// byte buffer and the cache. Range headers are forwarded upstream for pure passthroughs.
+// release is called before copying so a long stream doesn't hold a fetch slot.
+//
+// It returns streamed=true if a response was written. Otherwise the body was small
+// enough (or needs a format conversion) and is returned fully read with the
+// origin's policy, charged to the memory budget until releaseData is called.
+func (h *Handler) streamPassthrough(w http.ResponseWriter, r *http.Request, params *ProcessingParams, release func()) (data []byte, policy OriginPolicy, releaseData func(), streamed bool, err error) {
+	releaseData = func() {}
+
+	// A partial body can't be converted, so only forward Range for pure passthroughs
+	var header http.Header
+	if rng := r.Header.Get("Range"); rng != "" && params.Format == "" {
+		header = http.Header{"Range": {rng}}
+	}
+
+	// A fully read body is shared with the requests waiting on this one, so the
+	// client disconnecting only cancels the upstream read once it's streamed
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	resp, err := h.fetcher.Open(ctx, params.URL, header)
+	if err != nil {
+		return nil, policy, releaseData, false, err
+	}
+	defer resp.Body.Close()
+	if h.config.HonorOriginCacheControl {
+		policy = ParseOriginPolicy(resp.Header, h.now())
+	}
+
+	body := bufio.NewReader(resp.Body)
+	magic, _ := body.Peek(core.SniffLen)
+	origFormat := DetectFormat(magic)
+
+	partial := resp.StatusCode == http.StatusPartialContent
+	if partial && origFormat == FormatSVG {
+		// SVG is only served rasterized, which needs the whole body
+		return nil, policy, releaseData, false, &FetchError{
+			Kind:       ErrKindRange,
+			StatusCode: http.StatusRequestedRangeNotSatisfiable,
+			Message:    "SVG sources can't be requested in ranges",
+		}
+	}
+	if !partial && (resp.ContentLength <= h.config.StreamThreshold || params.NeedsProcessing(origFormat)) {
+		if resp.ContentLength > 0 {
+			if releaseData, err = reserveBody(ctx, resp.ContentLength, h.memory, h.bodies); err != nil {
+				return nil, policy, releaseData, false, err
+			}
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			releaseData()
+			return nil, policy, func() {}, false, transportError(err, "failed to read image data: %v", err)
+		}
+		if resp.ContentLength <= 0 {
+			if releaseData, err = reserveBody(ctx, int64(len(data)), h.memory, h.bodies); err != nil {
+				return nil, policy, releaseData, false, err
+			}
+		}
+		return data, policy, releaseData, false, nil
+	}
+
+	release()
+	defer context.AfterFunc(r.Context(), cancel)()
+	h.log().Info("streaming passthrough", "url", params.URL, "size", resp.ContentLength)
+
+	ct := origFormat.ContentType()
+	if origFormat == "" && resp.Header.Get("Content-Type") != "" {
+		ct = resp.Header.Get("Content-Type")
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", "inline")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+	for _, name := range []string{"Accept-Ranges", "Content-Range", "ETag", "Last-Modified"} {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	var origin *OriginPolicy
+	if policy.NoStore || policy.MaxAge > 0 {
+		origin = &policy
+	}
+	h.setCacheControl(w, origin)
+	if h.debugging(r) {
+		// Streamed bodies are never cached
+		w.Header().Set("X-IPX-Cache", cacheBypass)
+		if origFormat != "" {
+			w.Header().Set("X-IPX-Original-Format", string(origFormat))
+		}
+		if resp.ContentLength >= 0 {
+			w.Header().Set("X-IPX-Original-Bytes", fmt.Sprintf("%d", resp.ContentLength))
+			w.Header().Set("X-IPX-Output-Bytes", fmt.Sprintf("%d", resp.ContentLength))
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, body); err != nil {
+		h.log().Warn("stream aborted", "url", params.URL, "error", err)
+	}
+	return nil, policy, releaseData, true, nil
+}
+
+// encodeToClient answers a miss whose response won't be cached, e.g. because
+// the origin forbids it, by encoding straight to w rather than into a cache
+// entry the response would be copied from. The length isn't known until the
+// encoder writes, so the response has no Content-Length.
+//
+// It returns streamed=true if a response was written. Otherwise the request is
+// answered without encoding (an error, a passthrough, info or a placeholder) or
+// needs the output in memory (q=auto with a byte budget), and the entry to
+// write is returned.
+func (h *Handler) encodeToClient(w http.ResponseWriter, r *http.Request, imageData, overlay []byte, params *ProcessingParams, fetchTime time.Duration) (entry *CacheEntry, streamed bool) {
+	origFormat := DetectFormat(imageData)
+	start := time.Now()
+	defer func() {
+		if entry != nil {
+			entry.OriginalBytes = len(imageData)
+			entry.OriginalFormat = origFormat
+			entry.ProcessTime = time.Since(start)
+		}
+	}()
+	proc, params, enc, release, entry := h.prepare(context.Background(), imageData, overlay, h.compile(params))
+	defer release()
+	if entry != nil {
+		return entry, false
+	}
+	outputFormat := enc.Format
+	if proc.Err() != nil || (params.QualityAuto && params.MaxBytes > 0) || h.checkSave(outputFormat) != nil {
+		return h.encode(proc, params, origFormat, enc), false
+	}
+
+	out := &headerWriter{w: w, header: func() {
+		w.Header().Set("Content-Type", outputFormat.ContentType())
+		w.Header().Set("Content-Disposition", "inline")
+		h.setCacheControl(w, &OriginPolicy{NoStore: true})
+		if h.debugging(r) {
+			w.Header().Set("X-IPX-Cache", cacheBypass)
+			w.Header().Set("X-IPX-Fetch-Ms", formatMillis(fetchTime))
+			w.Header().Set("X-IPX-Process-Ms", formatMillis(time.Since(start)))
+			w.Header().Set("X-IPX-Original-Bytes", strconv.Itoa(len(imageData)))
+			if origFormat != "" {
+				w.Header().Set("X-IPX-Original-Format", string(origFormat))
+			}
+			w.Header().Set("X-IPX-Params", params.EffectiveQuery(origFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+	}}
+	_, err := proc.ToWriterWithOptions(out, outputFormat, enc.Options)
+	proc.Close()
+	if err != nil && !out.wrote {
+		h.log().Error("image encode failed", "url", params.URL, "format", string(outputFormat), "error", err)
+		return &CacheEntry{
+			StatusCode: http.StatusInternalServerError,
+			ErrorMsg:   fmt.Sprintf("encode: %v", err),
+		}, false
+	}
+	if err != nil {
+		h.log().Warn("response aborted", "url", params.URL, "error", err)
+	}
+	return nil, true
+}
+
+// headerWriter writes the response headers on the first write, so that a
+// failure before any output can still be answered with an error status.
+type headerWriter struct {
+	w      http.ResponseWriter
+	header func()
+	wrote  bool
+}
+
+func (hw *headerWriter) Write(p []byte) (int, error) {
+	if !hw.wrote {
+		hw.wrote = true
+		hw.header()
+	}
+	return hw.w.Write(p)
+}
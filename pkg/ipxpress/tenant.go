@@ -0,0 +1,218 @@
+package ipxpress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TenantRouter serves several tenants (brands, customers, ...) from one process,
+// each with its own Config: allowlists, presets, signing keys and so on. The
+// tenant is named by the first path segment (/tenant-a/?url=...) or, when
+// Header is set and present, by that request header. Unknown tenants get 404.
+//
+// Tenants share the source fetcher, the processing and fetch limits and
+// libvips; their cache keys are prefixed with the tenant name, so they may also
+// share a cache without seeing each other's entries.
+type TenantRouter struct {
+	// Header names the request header selecting the tenant, e.g. "X-IPX-Tenant".
+	// When empty or absent the first path segment does. Set it before serving.
+	Header string
+
+	tenants map[string]*Handler
+	cache   Cache // shared with WithCache, closed once by Close
+}
+
+// tenantShare is what the handlers of a TenantRouter have in common.
+type tenantShare struct {
+	processing *processingQueue
+	fetchLimit *fetchLimiter
+	keyPrefix  string
+	cache      bool // the cache is the router's
+}
+
+// NewTenantHandler creates a handler for every tenant in configs, keyed by
+// tenant name, which must be non-empty and without "/". A nil Config means
+// DefaultConfig. Options apply to every tenant: WithFetcher and WithCache are
+// shared by all of them. Without WithFetcher the tenants share a Fetcher built
+// from DefaultFetcherConfig, restricted per tenant to its Config.AllowedHosts;
+// Config.Fetcher, MemoryBudget and MaxConcurrentBytes don't bind it. The shared
+// limits are the largest ProcessingLimit, CheapReservedSlots, FetchLimit and
+// FetchQueueTimeout of the tenants; each tenant tells cheap requests apart by
+// its own CheapCostThreshold. It panics on an invalid name or Config, like NewHandler.
+func NewTenantHandler(configs map[string]*Config, opts ...HandlerOption) *TenantRouter {
+	var options handlerOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	limits := &Config{}
+	resolved := make(map[string]*Config, len(configs))
+	for name, config := range configs {
+		if name == "" || strings.Contains(name, "/") {
+			panic(fmt.Sprintf("invalid ipxpress tenant name %q", name))
+		}
+		if config == nil {
+			config = DefaultConfig()
+		}
+		resolved[name] = config
+		limits.ProcessingLimit = max(limits.ProcessingLimit, config.ProcessingLimit)
+		limits.CheapCostThreshold = max(limits.CheapCostThreshold, config.CheapCostThreshold)
+		limits.CheapReservedSlots = max(limits.CheapReservedSlots, config.CheapReservedSlots)
+		limits.FetchLimit = max(limits.FetchLimit, config.FetchLimit)
+		limits.FetchQueueTimeout = max(limits.FetchQueueTimeout, config.FetchQueueTimeout)
+	}
+	processing := newProcessingQueue(limits)
+	fetchLimit := newFetchLimiter(limits)
+
+	fetcher := options.fetcher
+	if fetcher == nil {
+		fetcher = NewFetcherWithConfig(DefaultFetcherConfig())
+	}
+
+	router := &TenantRouter{tenants: make(map[string]*Handler, len(configs)), cache: options.cache}
+	for name, config := range resolved {
+		tenantOpts := append([]HandlerOption{}, opts...)
+		tenantOpts = append(tenantOpts,
+			WithFetcher(&tenantFetcher{SourceFetcher: fetcher, allowed: config.AllowedHosts}),
+			func(o *handlerOptions) {
+				o.tenant = &tenantShare{
+					processing: processing,
+					fetchLimit: fetchLimit,
+					keyPrefix:  name + ":",
+					cache:      options.cache != nil,
+				}
+			})
+		router.tenants[name] = NewHandler(config, tenantOpts...)
+	}
+	return router
+}
+
+// Tenant returns the handler of a tenant, e.g. to add processors or
+// middlewares, or nil if there is no such tenant.
+func (t *TenantRouter) Tenant(name string) *Handler {
+	return t.tenants[name]
+}
+
+// Tenants returns the tenant names in order.
+func (t *TenantRouter) Tenants() []string {
+	names := make([]string, 0, len(t.tenants))
+	for name := range t.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ServeHTTP hands the request to the tenant's handler, with the tenant's path
+// segment removed. Like Handler, t may be mounted with or without
+// http.StripPrefix.
+func (t *TenantRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if t.Header != "" {
+		if name := r.Header.Get(t.Header); name != "" {
+			if h, ok := t.tenants[name]; ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+			http.Error(w, fmt.Sprintf("unknown tenant %q", name), http.StatusNotFound)
+			return
+		}
+	}
+
+	name, rest, _ := strings.Cut(route(r), "/")
+	h, ok := t.tenants[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown tenant %q", name), http.StatusNotFound)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + rest
+	r2.URL.RawPath = ""
+	r2.Pattern = ""
+	h.ServeHTTP(w, r2)
+}
+
+// Shutdown waits for the requests in flight of every tenant, see Handler.Shutdown.
+func (t *TenantRouter) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, name := range t.Tenants() {
+		errs = append(errs, t.tenants[name].Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every tenant's handler and the shared cache.
+func (t *TenantRouter) Close() {
+	for _, h := range t.tenants {
+		h.Close()
+	}
+	if t.cache != nil {
+		t.cache.Close()
+	}
+}
+
+// tenantFetcher restricts a fetcher shared by tenants to one tenant's
+// AllowedHosts, on top of the fetcher's own.
+type tenantFetcher struct {
+	SourceFetcher
+	allowed []string
+}
+
+var _ PolicyFetcher = (*tenantFetcher)(nil)
+
+// HostAllowed implements SourceFetcher.
+func (f *tenantFetcher) HostAllowed(host string) bool {
+	return hostAllowed(f.allowed, host) && f.SourceFetcher.HostAllowed(host)
+}
+
+// check returns a FetchError if imageURL's host isn't allowed for the tenant.
+// Malformed URLs are left to the shared fetcher. The returned context holds the
+// tenant's hosts for the built-in fetcher to vet redirects with.
+func (f *tenantFetcher) check(ctx context.Context, imageURL string) (context.Context, error) {
+	if u, err := url.Parse(imageURL); err == nil && !hostAllowed(f.allowed, u.Hostname()) {
+		return ctx, hostForbidden(u.Hostname())
+	}
+	if len(f.allowed) > 0 {
+		ctx = context.WithValue(ctx, allowedHostsKey{}, f.allowed)
+	}
+	return ctx, nil
+}
+
+// FetchReserved implements SourceFetcher.
+func (f *tenantFetcher) FetchReserved(ctx context.Context, imageURL string) ([]byte, func(), error) {
+	ctx, err := f.check(ctx, imageURL)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return f.SourceFetcher.FetchReserved(ctx, imageURL)
+}
+
+// FetchWithPolicy implements PolicyFetcher, without a policy if the shared
+// fetcher doesn't report one.
+func (f *tenantFetcher) FetchWithPolicy(ctx context.Context, imageURL string) ([]byte, OriginPolicy, func(), error) {
+	ctx, err := f.check(ctx, imageURL)
+	if err != nil {
+		return nil, OriginPolicy{}, func() {}, err
+	}
+	if pf, ok := f.SourceFetcher.(PolicyFetcher); ok {
+		return pf.FetchWithPolicy(ctx, imageURL)
+	}
+	data, release, err := f.SourceFetcher.FetchReserved(ctx, imageURL)
+	return data, OriginPolicy{}, release, err
+}
+
+// Open implements SourceFetcher.
+func (f *tenantFetcher) Open(ctx context.Context, imageURL string, header http.Header) (*http.Response, error) {
+	ctx, err := f.check(ctx, imageURL)
+	if err != nil {
+		return nil, err
+	}
+	return f.SourceFetcher.Open(ctx, imageURL, header)
+}
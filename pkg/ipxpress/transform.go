@@ -0,0 +1,326 @@
+package ipxpress
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// maxTransformSpecs caps the variants one transform request may ask for.
+const maxTransformSpecs = 16
+
+// VariantSpec names a derivative and the query parameters that produce it,
+// e.g. {"name": "avatar", "query": "w=128&h=128&fit=cover&f=webp"}.
+type VariantSpec struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+// Variant is a rendered VariantSpec.
+type Variant struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Data        []byte `json:"data"` // base64 in JSON
+}
+
+// VariantError reports a spec that couldn't be rendered and the status it maps to.
+type VariantError struct {
+	Name       string
+	StatusCode int
+	Message    string
+}
+
+// Error implements the error interface.
+func (e *VariantError) Error() string {
+	return fmt.Sprintf("variant %s: %s", e.Name, e.Message)
+}
+
+// Transform returns a handler for one-shot uploads: POST a multipart body with an
+// "image" part and a "specs" part holding a JSON array of VariantSpecs, and get every
+// variant back from a single decode, as multipart/mixed parts named after the specs
+// or, with "Accept: application/json", as a JSON envelope with base64 data.
+//
+// Uploads are limited by Config.MaxUploadSize and Config.MaxInputPixels, and charged
+// to Config.TransformQuota. Like Admin, it has no authentication of its own:
+//
+//	mux.Handle("/ipx/transform", AuthMiddleware(tokens)(handler.Transform()))
+func (h *Handler) Transform() http.Handler {
+	return http.HandlerFunc(h.serveTransform)
+}
+
+func (h *Handler) serveTransform(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.config.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.config.MaxUploadSize)
+	}
+
+	imageData, specs, err := readTransformRequest(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.config.TransformQuota != nil {
+		if err := h.config.TransformQuota(r, len(specs)); err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	variants, err := h.RenderSetContext(r.Context(), imageData, specs)
+	if err != nil {
+		status := http.StatusInternalServerError
+		var variantErr *VariantError
+		var pixelErr *PixelLimitError
+		switch {
+		case errors.As(err, &variantErr):
+			status = variantErr.StatusCode
+		case errors.As(err, &pixelErr):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, ErrMemoryBudget), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, ErrSVGDisabled):
+			status = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]Variant{"variants": variants})
+		return
+	}
+	writeVariantsMultipart(w, variants)
+}
+
+// readTransformRequest reads the image and specs parts of a transform request.
+func readTransformRequest(r *http.Request) ([]byte, []VariantSpec, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, fmt.Errorf("expected a multipart body: %w", err)
+	}
+
+	var imageData []byte
+	var specs []VariantSpec
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read multipart body: %w", err)
+		}
+		switch part.FormName() {
+		case "image":
+			imageData, err = io.ReadAll(part)
+		case "specs":
+			err = json.NewDecoder(part).Decode(&specs)
+			if err != nil {
+				err = fmt.Errorf("invalid specs: %w", err)
+			}
+		}
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(imageData) == 0 {
+		return nil, nil, errors.New("missing image part")
+	}
+	if len(specs) == 0 {
+		return nil, nil, errors.New("missing specs part")
+	}
+	if len(specs) > maxTransformSpecs {
+		return nil, nil, fmt.Errorf("at most %d specs are allowed", maxTransformSpecs)
+	}
+	return imageData, specs, nil
+}
+
+// RenderSet renders every spec from one decode of imageData, in order. Specs use
+// the query syntax of the image endpoint, except that url, overlay, page,
+// density, info and placeholder are not allowed. It fails with a *VariantError naming the first spec that can't be
+// rendered, a *PixelLimitError if the image is over Config.MaxInputPixels,
+// ErrMemoryBudget if decoding it doesn't fit Config.MemoryBudget, or ErrSVGDisabled.
+func (h *Handler) RenderSet(imageData []byte, specs []VariantSpec) ([]Variant, error) {
+	return h.RenderSetContext(context.Background(), imageData, specs)
+}
+
+// RenderSetContext is RenderSet waiting for an expensive processing slot (see
+// Config.ProcessingLimit) and rendering until ctx is done, which fails with an
+// error wrapping ctx.Err().
+func (h *Handler) RenderSetContext(ctx context.Context, imageData []byte, specs []VariantSpec) ([]Variant, error) {
+	params := make([]*ProcessingParams, len(specs))
+	seen := make(map[string]bool, len(specs))
+	for i, spec := range specs {
+		if spec.Name == "" || seen[spec.Name] {
+			return nil, &VariantError{Name: spec.Name, StatusCode: http.StatusBadRequest, Message: "spec names must be unique and non-empty"}
+		}
+		seen[spec.Name] = true
+
+		p, err := h.variantParams(spec)
+		if err != nil {
+			return nil, &VariantError{Name: spec.Name, StatusCode: http.StatusBadRequest, Message: err.Error()}
+		}
+		params[i] = p
+	}
+
+	origFormat := DetectFormat(imageData)
+	if origFormat == FormatSVG && !h.config.AllowSVG {
+		return nil, ErrSVGDisabled
+	}
+	for i, p := range params {
+		if err := h.checkCapabilities(imageData, p.GetOutputFormat(origFormat)); err != nil {
+			h.unsupported.Add(1)
+			return nil, &VariantError{Name: specs[i].Name, StatusCode: err.StatusCode(), Message: err.Error()}
+		}
+	}
+
+	// Every variant is encoded from one decode of an upload, so the set counts as expensive
+	release, err := h.processing.acquireContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	variants := make([]Variant, len(specs))
+	var failed error
+	err = h.renderFrom(ctx, imageData, params, func(i int, entry *CacheEntry, width, height int) bool {
+		if entry.StatusCode != http.StatusOK {
+			failed = &VariantError{Name: specs[i].Name, StatusCode: entry.StatusCode, Message: entry.errorMessage()}
+			return false
+		}
+		variants[i] = Variant{
+			Name:        specs[i].Name,
+			ContentType: entry.ContentType,
+			Width:       width,
+			Height:      height,
+			Data:        entry.Data,
+		}
+		return true
+	})
+	if err == nil {
+		err = failed
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.log().Info("rendered variants", "variants", len(variants), "size", len(imageData))
+	return variants, nil
+}
+
+// renderFrom decodes imageData once and renders each of params from a clone of
+// it, in order, passing the results to yield until it returns false. A variant
+// that fails gets an entry with its status; the error is for a source that
+// can't be decoded: a *PixelLimitError, ErrMemoryBudget, ErrSVGDisabled or one
+// wrapping ctx.Err().
+func (h *Handler) renderFrom(ctx context.Context, imageData []byte, params []*ProcessingParams, yield func(i int, entry *CacheEntry, width, height int) bool) error {
+	origFormat := DetectFormat(imageData)
+	if origFormat == FormatSVG && !h.config.AllowSVG {
+		return ErrSVGDisabled
+	}
+	reserve, releaseDecode := h.reserveDecode()
+	defer releaseDecode()
+	// Vector sources are rendered once, large enough for the largest variant
+	var rasterWidth, rasterHeight int
+	for _, p := range params {
+		rasterWidth, rasterHeight = max(rasterWidth, p.Width), max(rasterHeight, p.Height)
+	}
+	base := New().WithContext(ctx).MaxPixels(h.config.MaxInputPixels).ReserveDecode(reserve).RasterSize(rasterWidth, rasterHeight).FromBytes(imageData)
+	defer base.Close()
+	if err := base.Err(); err != nil {
+		return err
+	}
+
+	for i, p := range params {
+		outputFormat := p.GetOutputFormat(origFormat)
+		if err := h.checkCapabilities(imageData, outputFormat); err != nil {
+			if !yield(i, h.unsupportedEntry(err), 0, 0) {
+				return nil
+			}
+			continue
+		}
+		proc := base.Clone()
+		if len(h.preProcessors) > 0 {
+			proc, p = h.preProcess(proc, p)
+		}
+		proc = h.transform(proc, nil, h.compile(p))
+		width, height := proc.Width(), proc.Height()
+
+		proc, enc := h.encoding(proc, p, outputFormat)
+		if !yield(i, h.encode(proc, p, origFormat, enc), width, height) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// variantParams parses and validates the query of a spec.
+func (h *Handler) variantParams(spec VariantSpec) (*ProcessingParams, error) {
+	q, err := url.ParseQuery(spec.Query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	if q.Has("url") || q.Has("overlay") {
+		return nil, errors.New("url and overlay are not allowed in specs")
+	}
+	if q.Has("info") || q.Has("placeholder") || q.Has("preset") {
+		return nil, errors.New("info, placeholder and preset are not allowed in specs")
+	}
+	// Every spec shares one decode, so nothing may change how the source is loaded
+	if q.Has("page") || q.Has("density") {
+		return nil, errors.New("page and density are not allowed in specs")
+	}
+
+	if err := h.allowed.check(q); err != nil {
+		return nil, err
+	}
+
+	params := ParseProcessingParams(&http.Request{URL: &url.URL{RawQuery: spec.Query}})
+	if err := params.CheckDimensions(h.config.MaxDimension); err != nil {
+		return nil, err
+	}
+	if err := params.Err(); err != nil && h.config.StrictParams {
+		return nil, err
+	}
+	return params, nil
+}
+
+// writeVariantsMultipart writes variants as multipart/mixed, one part per variant.
+func writeVariantsMultipart(w http.ResponseWriter, variants []Variant) {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	for _, v := range variants {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", v.ContentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"name": v.Name}))
+		header.Set("X-IPX-Width", fmt.Sprint(v.Width))
+		header.Set("X-IPX-Height", fmt.Sprint(v.Height))
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return
+		}
+		part.Write(v.Data)
+	}
+	mw.Close()
+}
@@ -0,0 +1,159 @@
+package ipxpress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// WarmSpec names a variant for Handler.Warm to put in the cache: a source URL
+// with either processing params or the name of a registered preset.
+type WarmSpec struct {
+	URL string
+
+	// Params of the variant; nil serves the source unmodified. Ignored with Preset.
+	Params *ProcessingParams
+
+	// Preset names a preset registered with Handler.RegisterPreset.
+	Preset string
+
+	// Accept is the Accept header to negotiate f=auto with, e.g. "image/avif,image/webp".
+	Accept string
+}
+
+// query returns the image request query selecting the spec's variant.
+func (s WarmSpec) query() string {
+	q := url.Values{}
+	if s.Preset != "" {
+		q.Set(core.ParamPreset, s.Preset)
+	} else if s.Params != nil {
+		q = s.Params.Query()
+	}
+	q.Set(core.ParamURL, s.URL)
+	return q.Encode()
+}
+
+// Warm processes specs as image requests would, so the variants are cached
+// before clients ask for them, e.g. at startup. Specs are processed
+// concurrently within Config.ProcessingLimit. It returns the error of each spec
+// at its index, nil for those now cached; specs not started before ctx is done
+// get ctx's error.
+//
+// Signing isn't required: Warm is called by the operator, not clients.
+func (h *Handler) Warm(ctx context.Context, specs []WarmSpec) []error {
+	errs := make([]error, len(specs))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range min(h.processing.limit, len(specs)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				errs[i] = h.warm(ctx, specs[i])
+			}
+		}()
+	}
+
+	for i := range specs {
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+		}
+	}
+	close(work)
+	wg.Wait()
+	return errs
+}
+
+// warm runs the image request for spec, discarding the response.
+func (h *Handler) warm(ctx context.Context, spec WarmSpec) error {
+	if spec.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/?"+spec.query(), nil)
+	if err != nil {
+		return err
+	}
+	if spec.Accept != "" {
+		r.Header.Set("Accept", spec.Accept)
+	}
+	w := &warmWriter{header: make(http.Header), status: http.StatusOK}
+	h.serveImage(w, r)
+	if w.status >= 400 {
+		return &ProcessError{StatusCode: w.status, Message: strings.TrimSpace(w.body.String())}
+	}
+	return nil
+}
+
+// warmWriter is the ResponseWriter of warm requests. It keeps the status and
+// the start of the body, enough for error messages.
+type warmWriter struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   strings.Builder
+}
+
+func (w *warmWriter) Header() http.Header { return w.header }
+
+func (w *warmWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.status, w.wrote = status, true
+	}
+}
+
+func (w *warmWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status >= 400 && w.body.Len() < 512 {
+		w.body.Write(p[:min(len(p), 512-w.body.Len())])
+	}
+	return len(p), nil
+}
+
+// warmFileSpec is a spec in a warm file, params written as a query.
+type warmFileSpec struct {
+	URL    string `json:"url"`
+	Params string `json:"params"`
+	Preset string `json:"preset"`
+	Accept string `json:"accept"`
+}
+
+// LoadWarmSpecs reads a JSON list of specs for Handler.Warm, params given as a
+// query like in presets:
+//
+//	[
+//		{"url": "https://cdn.example.com/hero.jpg", "params": "w=1200&f=webp"},
+//		{"url": "https://cdn.example.com/logo.png", "preset": "thumbnail"}
+//	]
+func LoadWarmSpecs(path string) ([]WarmSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []warmFileSpec
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	specs := make([]WarmSpec, len(list))
+	for i, s := range list {
+		if s.URL == "" {
+			return nil, fmt.Errorf("%s: spec %d: missing url", path, i)
+		}
+		spec := WarmSpec{URL: s.URL, Preset: s.Preset, Accept: s.Accept}
+		if s.Params != "" {
+			if spec.Params, err = parseParamsQuery(s.Params); err != nil {
+				return nil, fmt.Errorf("%s: spec %d: %v", path, i, err)
+			}
+		}
+		specs[i] = spec
+	}
+	return specs, nil
+}
@@ -0,0 +1,213 @@
+package ipxpress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// WatermarkOptions configures how a watermark is placed on processed images.
+type WatermarkOptions struct {
+	// Gravity anchors the watermark: north, south, east, west, northeast,
+	// northwest, southeast, southwest or centre. Defaults to southeast.
+	Gravity string
+
+	// Margin is the distance in pixels between the watermark and the image edges.
+	Margin int
+
+	// Opacity scales the watermark alpha, from 0 (invisible) to 1. 0 is treated as 1.
+	Opacity float64
+
+	// Scale is the watermark width relative to the output width (e.g. 0.15 for 15%).
+	Scale float64
+
+	// MinSize skips outputs whose width or height is below this many pixels.
+	MinSize int
+
+	// AllowDisable lets clients turn the watermark off per request with watermark=false.
+	AllowDisable bool
+}
+
+// DefaultWatermarkOptions returns the default watermark placement.
+func DefaultWatermarkOptions() WatermarkOptions {
+	return WatermarkOptions{
+		Gravity: "southeast",
+		Margin:  10,
+		Opacity: 1,
+		Scale:   0.15,
+		MinSize: 100,
+	}
+}
+
+// Watermark composites the encoded watermark image over the current image.
+// The watermark is scaled relative to the current width, so call it after resizing.
+// Outputs smaller than opts.MinSize in either dimension are left untouched.
+func (p *Processor) Watermark(mark []byte, opts WatermarkOptions) *Processor {
+	return p.watermark(opts, func() (*vips.ImageRef, error) {
+		wm, err := vips.NewImageFromBuffer(mark)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode watermark: %w", err)
+		}
+		return wm, nil
+	})
+}
+
+// watermark composites the watermark load returns, which it closes, over the
+// current image; load isn't called for outputs under opts.MinSize.
+func (p *Processor) watermark(opts WatermarkOptions, load func() (*vips.ImageRef, error)) *Processor {
+	defer p.lock()()
+	if p.err != nil {
+		return p
+	}
+	if p.img == nil {
+		p.err = p.noImage()
+		return p
+	}
+
+	if p.img.Width() < opts.MinSize || p.img.Height() < opts.MinSize {
+		return p
+	}
+
+	wm, err := load()
+	if err == nil {
+		err = compositeWatermark(p.img, wm, opts)
+	}
+	if err != nil {
+		p.err = fmt.Errorf("failed to apply watermark: %w", err)
+	}
+
+	return p
+}
+
+// compositeWatermark scales and fades wm, then draws it over img. It closes wm.
+func compositeWatermark(img, wm *vips.ImageRef, opts WatermarkOptions) error {
+	defer wm.Close()
+
+	if opts.Scale > 0 {
+		targetW := int(float64(img.Width()) * opts.Scale)
+		if targetW < 1 {
+			targetW = 1
+		}
+		if err := wm.Resize(float64(targetW)/float64(wm.Width()), vips.KernelLanczos3); err != nil {
+			return err
+		}
+	}
+
+	if err := wm.AddAlpha(); err != nil {
+		return err
+	}
+	if opts.Opacity > 0 && opts.Opacity < 1 {
+		// Scale only the alpha band (always the last one)
+		bands := wm.Bands()
+		a := make([]float64, bands)
+		b := make([]float64, bands)
+		for i := range a {
+			a[i] = 1
+		}
+		a[bands-1] = opts.Opacity
+		if err := wm.Linear(a, b); err != nil {
+			return err
+		}
+		if err := wm.Cast(vips.BandFormatUchar); err != nil {
+			return err
+		}
+	}
+
+	x, y := gravityOffset(opts.Gravity, img.Width(), img.Height(), wm.Width(), wm.Height(), opts.Margin)
+	return img.Composite(wm, vips.BlendModeOver, x, y)
+}
+
+// gravityOffset returns the top-left position of an inner box placed inside an
+// outer box according to gravity, keeping margin pixels away from the anchored edges.
+// Unknown gravity values fall back to southeast.
+func gravityOffset(gravity string, outerW, outerH, innerW, innerH, margin int) (int, int) {
+	left, top := margin, margin
+	right, bottom := outerW-innerW-margin, outerH-innerH-margin
+	centerX, centerY := (outerW-innerW)/2, (outerH-innerH)/2
+
+	switch strings.ToLower(gravity) {
+	case "north":
+		return centerX, top
+	case "south":
+		return centerX, bottom
+	case "east":
+		return right, centerY
+	case "west":
+		return left, centerY
+	case "northeast":
+		return right, top
+	case "northwest":
+		return left, top
+	case "southwest":
+		return left, bottom
+	case "centre", "center":
+		return centerX, centerY
+	default:
+		return right, bottom
+	}
+}
+
+// NewWatermarkProcessor returns a processor that composites the watermark image
+// (encoded bytes) over every processed image. The watermark is decoded once here
+// and each request composites a copy. Like any processor it doesn't run for
+// sources served as they are; Handler.UseWatermark applies it to those too.
+func NewWatermarkProcessor(mark []byte, opts WatermarkOptions) (ProcessorFunc, error) {
+	initVips()
+	img, err := vips.NewImageFromBuffer(mark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark: %w", err)
+	}
+
+	return func(proc *Processor, params *ProcessingParams) *Processor {
+		if opts.AllowDisable && params.DisableWatermark {
+			return proc
+		}
+		return proc.watermark(opts, img.Copy)
+	}, nil
+}
+
+// UseWatermark composites mark (encoded bytes) over every image the handler
+// serves, see NewWatermarkProcessor. Unlike a processor added with UseProcessor,
+// it also applies to requests without transformation params: no source is
+// passed through or streamed as is, unless the request turns the watermark off
+// and opts.AllowDisable lets it.
+func (h *Handler) UseWatermark(mark []byte, opts WatermarkOptions) error {
+	fn, err := NewWatermarkProcessor(mark, opts)
+	if err != nil {
+		return err
+	}
+	h.UseProcessor(fn)
+	h.watermark = &opts
+	return nil
+}
+
+// watermarked reports whether the watermark of UseWatermark applies to params.
+func (h *Handler) watermarked(params *ProcessingParams) bool {
+	return h.watermark != nil && !(h.watermark.AllowDisable && params.DisableWatermark)
+}
+
+// NewWatermarkProcessorFromFile is like NewWatermarkProcessor but reads the watermark from disk once.
+func NewWatermarkProcessorFromFile(path string, opts WatermarkOptions) (ProcessorFunc, error) {
+	mark, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermark: %w", err)
+	}
+	return NewWatermarkProcessor(mark, opts)
+}
+
+// WatermarkProcessor adds a watermark to images using DefaultWatermarkOptions.
+// If the watermark can't be loaded, every processed request fails with that error.
+// Example usage:
+//
+//	handler.UseProcessor(WatermarkProcessor("watermark.png"))
+func WatermarkProcessor(watermarkPath string) ProcessorFunc {
+	fn, err := NewWatermarkProcessorFromFile(watermarkPath, DefaultWatermarkOptions())
+	if err != nil {
+		return func(proc *Processor, params *ProcessingParams) *Processor {
+			return proc.ApplyFunc(func(*vips.ImageRef) error { return err })
+		}
+	}
+	return fn
+}
@@ -0,0 +1,403 @@
+// Package replay re-issues recorded image requests against one or two ipxpress
+// deployments and reports how the responses differ, e.g. before upgrading libvips
+// or changing encoder defaults.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // decoders for dimensions and Compare
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultThreshold is the mean per-channel difference (0-255) above which two
+// decoded images are reported as different. Re-encoding noise stays below it.
+const DefaultThreshold = 1.0
+
+// Options configures a replay run.
+type Options struct {
+	// Targets are the base URLs requests are sent to. Each request URI is appended
+	// to the base, so a log of "/ipx/?url=..." lines needs the server root as target.
+	// With two targets their responses are compared.
+	Targets []string
+
+	// Concurrency bounds the number of requests in flight. Defaults to 8.
+	Concurrency int
+
+	// Threshold overrides DefaultThreshold.
+	Threshold float64
+
+	// Client is used for all requests. Defaults to a client with a 60s timeout.
+	Client *http.Client
+}
+
+// Response describes what one target returned for a request.
+type Response struct {
+	Status      int           `json:"status"`
+	ContentType string        `json:"content_type,omitempty"`
+	Size        int           `json:"size"`
+	Width       int           `json:"width,omitempty"`
+	Height      int           `json:"height,omitempty"`
+	Duration    time.Duration `json:"duration_ns"`
+	Error       string        `json:"error,omitempty"`
+
+	body []byte
+}
+
+// Diff compares the responses of two targets for a request.
+type Diff struct {
+	Status     bool `json:"status"`
+	Size       bool `json:"size"`
+	Dimensions bool `json:"dimensions"`
+
+	// Pixel is the mean per-channel difference of the decoded images (0-255),
+	// or -1 if they couldn't be compared (undecodable format or different sizes).
+	Pixel float64 `json:"pixel"`
+
+	// Differs is set when status, dimensions or pixels differ.
+	// A size change alone is expected after re-encoding and doesn't count.
+	Differs bool `json:"differs"`
+}
+
+// Result is the outcome of one replayed request.
+type Result struct {
+	Request   string     `json:"request"`
+	Responses []Response `json:"responses"`
+	Diff      *Diff      `json:"diff,omitempty"`
+}
+
+// Summary aggregates the results of a run.
+type Summary struct {
+	Requests       int       `json:"requests"`
+	Errors         int       `json:"errors"`
+	Differing      int       `json:"differing"`
+	StatusDiffs    int       `json:"status_diffs"`
+	DimensionDiffs int       `json:"dimension_diffs"`
+	PixelDiffs     int       `json:"pixel_diffs"`
+	MaxPixelDiff   float64   `json:"max_pixel_diff"`
+	Bytes          []int64   `json:"bytes"`         // total body size per target
+	MeanDuration   []float64 `json:"mean_duration"` // seconds per target
+}
+
+// Report is the full output of Run.
+type Report struct {
+	Targets []string `json:"targets"`
+	Results []Result `json:"results"`
+	Summary Summary  `json:"summary"`
+}
+
+// ReadRequests reads request URIs from r, one per line. Lines may be plain URIs
+// ("/?url=...&w=200"), absolute URLs, or Common/Combined Log Format entries;
+// blank lines, comments (#) and non-GET log entries are skipped.
+func ReadRequests(r io.Reader) ([]string, error) {
+	var requests []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if uri, ok := ParseLine(scanner.Text()); ok {
+			requests = append(requests, uri)
+		}
+	}
+	return requests, scanner.Err()
+}
+
+// ParseLine extracts the request URI from a single input line.
+func ParseLine(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	// Access log: ... "GET /ipx/?url=... HTTP/1.1" 200 ...
+	if _, request, ok := strings.Cut(line, `"`); ok {
+		request, _, _ = strings.Cut(request, `"`)
+		method, rest, _ := strings.Cut(request, " ")
+		if method != http.MethodGet {
+			return "", false
+		}
+		uri, _, _ := strings.Cut(rest, " ")
+		return uri, uri != ""
+	}
+
+	if strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://") {
+		u, err := url.Parse(line)
+		if err != nil {
+			return "", false
+		}
+		return u.RequestURI(), true
+	}
+
+	if strings.HasPrefix(line, "/") || strings.HasPrefix(line, "?") {
+		return line, true
+	}
+	return "", false
+}
+
+// Run replays requests against opts.Targets and returns the report.
+// Results keep the order of requests.
+func Run(ctx context.Context, requests []string, opts Options) (*Report, error) {
+	if len(opts.Targets) == 0 || len(opts.Targets) > 2 {
+		return nil, errors.New("replay needs one or two targets")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+	if opts.Threshold <= 0 {
+		opts.Threshold = DefaultThreshold
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 60 * time.Second}
+	}
+
+	results := make([]Result, len(requests))
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	for i, uri := range requests {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = replayOne(ctx, opts, uri)
+		}()
+	}
+	wg.Wait()
+
+	report := &Report{Targets: opts.Targets, Results: results}
+	report.Summary = summarize(results, len(opts.Targets))
+	return report, nil
+}
+
+// replayOne sends uri to every target and compares the responses.
+func replayOne(ctx context.Context, opts Options, uri string) Result {
+	result := Result{Request: uri, Responses: make([]Response, len(opts.Targets))}
+	for i, target := range opts.Targets {
+		result.Responses[i] = fetch(ctx, opts.Client, target, uri)
+	}
+	if len(result.Responses) == 2 {
+		result.Diff = compareResponses(&result.Responses[0], &result.Responses[1], opts.Threshold)
+	}
+	for i := range result.Responses {
+		result.Responses[i].body = nil
+	}
+	return result
+}
+
+// fetch requests target+uri and records the response and image dimensions.
+func fetch(ctx context.Context, client *http.Client, target, uri string) Response {
+	start := time.Now()
+	var resp Response
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, joinURL(target, uri), nil)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		resp.Error = err.Error()
+		resp.Duration = time.Since(start)
+		return resp
+	}
+	defer r.Body.Close()
+
+	resp.body, err = io.ReadAll(r.Body)
+	resp.Duration = time.Since(start)
+	resp.Status = r.StatusCode
+	resp.ContentType = r.Header.Get("Content-Type")
+	resp.Size = len(resp.body)
+	if err != nil {
+		resp.Error = fmt.Sprintf("read body: %v", err)
+		return resp
+	}
+
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(resp.body)); err == nil {
+		resp.Width, resp.Height = cfg.Width, cfg.Height
+	}
+	return resp
+}
+
+// joinURL appends a request URI to a target base URL.
+func joinURL(target, uri string) string {
+	if strings.HasPrefix(uri, "?") {
+		return target + uri
+	}
+	return strings.TrimSuffix(target, "/") + uri
+}
+
+// compareResponses diffs the responses of two targets for the same request.
+func compareResponses(a, b *Response, threshold float64) *Diff {
+	d := &Diff{
+		Status:     a.Status != b.Status,
+		Size:       a.Size != b.Size,
+		Dimensions: a.Width != b.Width || a.Height != b.Height,
+		Pixel:      -1,
+	}
+
+	if !d.Status && !d.Dimensions && a.Status == http.StatusOK {
+		if bytes.Equal(a.body, b.body) {
+			d.Pixel = 0
+		} else if imgA, _, err := image.Decode(bytes.NewReader(a.body)); err == nil {
+			if imgB, _, err := image.Decode(bytes.NewReader(b.body)); err == nil {
+				d.Pixel = Compare(imgA, imgB)
+			}
+		}
+	}
+
+	d.Differs = d.Status || d.Dimensions || d.Pixel > threshold ||
+		(d.Pixel < 0 && d.Size) // undecodable bodies can only be compared byte-wise
+	return d
+}
+
+// Compare returns the mean absolute difference per color channel of two images,
+// on a 0-255 scale, or -1 if their sizes differ. Alpha is ignored.
+func Compare(a, b image.Image) float64 {
+	ba, bb := a.Bounds(), b.Bounds()
+	if ba.Dx() != bb.Dx() || ba.Dy() != bb.Dy() {
+		return -1
+	}
+	if ba.Empty() {
+		return 0
+	}
+
+	var total uint64
+	for y := 0; y < ba.Dy(); y++ {
+		for x := 0; x < ba.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ba.Min.X+x, ba.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			total += absDiff(r1>>8, r2>>8) + absDiff(g1>>8, g2>>8) + absDiff(b1>>8, b2>>8)
+		}
+	}
+	return float64(total) / float64(3*ba.Dx()*ba.Dy())
+}
+
+// Hash returns a 64-bit perceptual (difference) hash of img: the image is averaged
+// down to 9x8 grey cells and each bit records whether a cell is brighter than its
+// right neighbour. Re-encoding and small resampling changes flip few bits, so
+// compare hashes with HashDistance rather than for equality. Alpha is ignored.
+func Hash(img image.Image) uint64 {
+	const cols, rows = 9, 8
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	var cells [rows][cols]float64
+	for cy := 0; cy < rows; cy++ {
+		y0, y1 := b.Min.Y+cy*b.Dy()/rows, b.Min.Y+max((cy+1)*b.Dy()/rows, cy*b.Dy()/rows+1)
+		for cx := 0; cx < cols; cx++ {
+			x0, x1 := b.Min.X+cx*b.Dx()/cols, b.Min.X+max((cx+1)*b.Dx()/cols, cx*b.Dx()/cols+1)
+			var sum float64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					r, g, bl, _ := img.At(x, y).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+				}
+			}
+			cells[cy][cx] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	var hash uint64
+	for cy := 0; cy < rows; cy++ {
+		for cx := 0; cx < cols-1; cx++ {
+			hash <<= 1
+			if cells[cy][cx] > cells[cy][cx+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HashDistance returns the number of differing bits of two hashes from Hash, from
+// 0 (perceptually identical) to 64.
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func absDiff(a, b uint32) uint64 {
+	if a > b {
+		return uint64(a - b)
+	}
+	return uint64(b - a)
+}
+
+// summarize computes the aggregate statistics of a run.
+func summarize(results []Result, targets int) Summary {
+	s := Summary{
+		Requests:     len(results),
+		Bytes:        make([]int64, targets),
+		MeanDuration: make([]float64, targets),
+	}
+	for _, r := range results {
+		failed := false
+		for i, resp := range r.Responses {
+			s.Bytes[i] += int64(resp.Size)
+			s.MeanDuration[i] += resp.Duration.Seconds()
+			failed = failed || resp.Error != ""
+		}
+		if failed {
+			s.Errors++
+		}
+		if d := r.Diff; d != nil {
+			if d.Differs {
+				s.Differing++
+			}
+			if d.Status {
+				s.StatusDiffs++
+			}
+			if d.Dimensions {
+				s.DimensionDiffs++
+			}
+			if d.Pixel > 0 {
+				s.PixelDiffs++
+				s.MaxPixelDiff = max(s.MaxPixelDiff, d.Pixel)
+			}
+		}
+	}
+	if len(results) > 0 {
+		for i := range s.MeanDuration {
+			s.MeanDuration[i] /= float64(len(results))
+		}
+	}
+	return s
+}
+
+// WriteSummary writes a human-readable summary, listing the differing requests.
+func (r *Report) WriteSummary(w io.Writer) {
+	s := r.Summary
+	fmt.Fprintf(w, "requests: %d, errors: %d\n", s.Requests, s.Errors)
+	for i, target := range r.Targets {
+		fmt.Fprintf(w, "target %s: %d bytes, mean %.1fms\n", target, s.Bytes[i], s.MeanDuration[i]*1000)
+	}
+	if len(r.Targets) < 2 {
+		return
+	}
+
+	fmt.Fprintf(w, "differing: %d (status %d, dimensions %d, pixels %d, max pixel diff %.2f)\n",
+		s.Differing, s.StatusDiffs, s.DimensionDiffs, s.PixelDiffs, s.MaxPixelDiff)
+	for _, res := range r.Results {
+		if res.Diff == nil || !res.Diff.Differs {
+			continue
+		}
+		a, b := res.Responses[0], res.Responses[1]
+		fmt.Fprintf(w, "  %s: status %d/%d, size %d/%d, %dx%d/%dx%d, pixel %.2f\n",
+			res.Request, a.Status, b.Status, a.Size, b.Size, a.Width, a.Height, b.Width, b.Height, res.Diff.Pixel)
+	}
+}
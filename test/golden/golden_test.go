@@ -0,0 +1,223 @@
+package golden_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/replay"
+)
+
+var update = flag.Bool("update", false, "rewrite "+goldenFile+" from the current output")
+
+// goldenFile holds the expected description of every matrix entry.
+const goldenFile = "testdata/golden.json"
+
+// Tolerances for drift between libvips versions.
+const (
+	sizeTolerance   = 0.15 // relative change of the encoded size
+	minSizeSlack    = 256  // bytes, so tiny outputs aren't held to a few bytes
+	maxHashDistance = 8    // of 64 bits of replay.Hash
+)
+
+// fixtures are the sources in testdata/fixtures, served by a stub origin.
+var fixtures = []string{
+	"photo.jpg",    // 96x64 baseline JPEG
+	"rotated.jpg",  // the same with EXIF orientation 6
+	"opaque.png",   // 96x64 RGB
+	"alpha.png",    // 96x64 RGBA with a horizontal alpha ramp
+	"palette.gif",  // 96x64 dithered
+	"animated.gif", // 48x32, 4 frames of 100ms
+	"alpha.webp",   // 64x48 lossless with alpha
+}
+
+// queries are the parameter combinations applied to every fixture.
+var queries = []string{
+	"",
+	"w=48",
+	"h=32",
+	"w=200",
+	"w=200&enlarge=true",
+	"s=48x48&fit=cover",
+	"s=48x48&fit=contain&b=ff0000",
+	"s=48x48&fit=fill&kernel=nearest",
+	"f=jpeg&q=60",
+	"f=png",
+	"f=webp",
+	"f=webp&lossless=true",
+	"f=avif",
+	"f=gif",
+	"f=png&png_colors=16",
+	"q=auto&maxbytes=2000&f=jpeg",
+	"blur=2",
+	"sharpen=1_1_2",
+	"rotate=90",
+	"flip=true&flop=true",
+	"extract=10_10_30_20",
+	"extend=5_5_5_5&b=00ff00",
+	"padding=4",
+	"trim=10",
+	"grayscale=true",
+	"negate=true",
+	"normalize=true",
+	"threshold=128",
+	"tint=ff0000",
+	"gamma=2.2",
+	"median=3",
+	"modulate=1.2_0.8_90",
+	"contrast=1.5",
+	"duotone=000000_ff8800",
+	"posterize=4",
+	"flatten=true&b=0000ff",
+	"radius=10",
+	"radius=max&f=png",
+	"pixelate=8",
+	"pixelate=4&pixelate_region=0_0_24_24",
+	"keep=exif",
+	"animated=false",
+}
+
+// golden describes an output without its bytes, so that libvips versions that
+// encode slightly differently still match.
+type golden struct {
+	Status int    `json:"status"`
+	Format string `json:"format,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"` // of one frame
+	Frames int    `json:"frames,omitempty"`
+	Size   int    `json:"size,omitempty"`
+	Hash   string `json:"hash,omitempty"` // replay.Hash of the first frame
+}
+
+// describe decodes an output with libvips, which reads every format the handler writes.
+func describe(t *testing.T, status int, body []byte) golden {
+	t.Helper()
+	g := golden{Status: status}
+	if status != http.StatusOK {
+		return g
+	}
+	g.Format = string(ipxpress.DetectFormat(body))
+	g.Size = len(body)
+
+	proc := ipxpress.New().FromBytes(body)
+	defer proc.Close()
+	if err := proc.Err(); err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	img := proc.ImageRef()
+	g.Width, g.Height, g.Frames = img.Width(), img.Height(), max(img.Pages(), 1)
+
+	flat, err := proc.ToBytes(ipxpress.FormatPNG, 100)
+	if err != nil {
+		t.Fatalf("failed to convert output: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(flat))
+	if err != nil {
+		t.Fatalf("failed to decode converted output: %v", err)
+	}
+	g.Hash = fmt.Sprintf("%016x", replay.Hash(decoded))
+	return g
+}
+
+// compare reports the differences between want and got beyond the tolerances.
+func compare(t *testing.T, want, got golden) {
+	t.Helper()
+	if want.Status != got.Status || want.Format != got.Format {
+		t.Fatalf("got status %d %s, want %d %s", got.Status, got.Format, want.Status, want.Format)
+	}
+	if want.Width != got.Width || want.Height != got.Height || want.Frames != got.Frames {
+		t.Errorf("got %dx%d with %d frame(s), want %dx%d with %d", got.Width, got.Height, got.Frames, want.Width, want.Height, want.Frames)
+	}
+	if slack := max(float64(minSizeSlack), sizeTolerance*float64(want.Size)); math.Abs(float64(got.Size-want.Size)) > slack {
+		t.Errorf("got %d bytes, want %d ± %.0f", got.Size, want.Size, slack)
+	}
+	if want.Hash != "" {
+		w, _ := strconv.ParseUint(want.Hash, 16, 64)
+		g, _ := strconv.ParseUint(got.Hash, 16, 64)
+		if d := replay.HashDistance(w, g); d > maxHashDistance {
+			t.Errorf("perceptual hash %s is %d bits from %s", got.Hash, d, want.Hash)
+		}
+	}
+}
+
+// TestGolden renders every fixture with every query through the real Handler and
+// compares the outputs with testdata/golden.json. Run with -update to accept the
+// current outputs, e.g. after an intended change, and review the diff.
+func TestGolden(t *testing.T) {
+	want := map[string]golden{}
+	if !*update {
+		data, err := os.ReadFile(goldenFile)
+		if os.IsNotExist(err) {
+			t.Skipf("%s is missing; generate it with go test ./test/golden -update", goldenFile)
+		}
+		if err != nil {
+			t.Fatalf("failed to read golden file: %v", err)
+		}
+		if err := json.Unmarshal(data, &want); err != nil {
+			t.Fatalf("failed to parse golden file: %v", err)
+		}
+	}
+
+	origin := httptest.NewServer(http.FileServer(http.Dir("testdata/fixtures")))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	got := map[string]golden{}
+	for _, fixture := range fixtures {
+		for _, query := range queries {
+			name := fixture + "?" + query
+			t.Run(name, func(t *testing.T) {
+				resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/"+fixture) + "&" + query)
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("failed to read response: %v", err)
+				}
+				g := describe(t, resp.StatusCode, body)
+				got[name] = g
+				if *update {
+					return
+				}
+				expected, ok := want[name]
+				if !ok {
+					t.Fatalf("no golden entry; run with -update")
+				}
+				compare(t, expected, g)
+			})
+		}
+	}
+
+	if *update {
+		data, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatalf("failed to encode golden file: %v", err)
+		}
+		if err := os.WriteFile(goldenFile, append(data, '\n'), 0o644); err != nil {
+			t.Fatalf("failed to write golden file: %v", err)
+		}
+		t.Logf("wrote %d entries to %s", len(got), goldenFile)
+		return
+	}
+	for name := range want {
+		if _, ok := got[name]; !ok {
+			t.Errorf("%s: golden entry is no longer in the matrix; run with -update", name)
+		}
+	}
+}
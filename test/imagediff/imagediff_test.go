@@ -0,0 +1,162 @@
+package imagediff_test
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/imagediff"
+)
+
+func gradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// noisy returns img with every channel moved by up to amount at random
+func noisy(img *image.RGBA, amount int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+	out := image.NewRGBA(img.Rect)
+	for i, v := range img.Pix {
+		if i%4 == 3 {
+			out.Pix[i] = v
+			continue
+		}
+		out.Pix[i] = uint8(max(0, min(255, int(v)+rng.Intn(2*amount+1)-amount)))
+	}
+	return out
+}
+
+// boxBlur returns img averaged over radius pixels around each one
+func boxBlur(img *image.RGBA, radius int) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var sum [3]int
+			var n int
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					if p := (image.Point{X: x + dx, Y: y + dy}); p.In(b) {
+						c := img.RGBAAt(p.X, p.Y)
+						sum[0], sum[1], sum[2] = sum[0]+int(c.R), sum[1]+int(c.G), sum[2]+int(c.B)
+						n++
+					}
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{R: uint8(sum[0] / n), G: uint8(sum[1] / n), B: uint8(sum[2] / n), A: 255})
+		}
+	}
+	return out
+}
+
+// TestIdentical verifies identical images score a perfect SSIM and an infinite PSNR
+func TestIdentical(t *testing.T) {
+	img := gradient(64, 48)
+	if s, err := imagediff.SSIM(img, img); err != nil || math.Abs(s-1) > 1e-9 {
+		t.Errorf("expected SSIM 1, got %v, %v", s, err)
+	}
+	if p, err := imagediff.PSNR(img, img); err != nil || !math.IsInf(p, 1) {
+		t.Errorf("expected PSNR +Inf, got %v, %v", p, err)
+	}
+}
+
+// TestDegradationOrder verifies more noise or blur scores lower
+func TestDegradationOrder(t *testing.T) {
+	ref := gradient(96, 64)
+	var prevSSIM, prevPSNR = 1.0, math.Inf(1)
+	for _, amount := range []int{2, 8, 32} {
+		img := noisy(ref, amount)
+		s, _ := imagediff.SSIM(ref, img)
+		p, _ := imagediff.PSNR(ref, img)
+		if s >= prevSSIM || p >= prevPSNR {
+			t.Errorf("noise %d: expected lower scores than %.4f / %.2f dB, got %.4f / %.2f dB", amount, prevSSIM, prevPSNR, s, p)
+		}
+		prevSSIM, prevPSNR = s, p
+	}
+	if s, _ := imagediff.SSIM(ref, noisy(ref, 2)); s < 0.95 {
+		t.Errorf("expected slight noise to stay above 0.95, got %.4f", s)
+	}
+
+	// A checkerboard loses its structure when blurred while keeping its mean
+	checker := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(40)
+			if (x/2+y/2)%2 == 0 {
+				v = 215
+			}
+			checker.SetRGBA(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	if s, _ := imagediff.SSIM(checker, boxBlur(checker, 2)); s > 0.5 {
+		t.Errorf("expected a blurred checkerboard far below 1, got %.4f", s)
+	}
+}
+
+// TestSizes verifies mismatched sizes fail and images smaller than a window work
+func TestSizes(t *testing.T) {
+	if _, err := imagediff.SSIM(gradient(10, 10), gradient(10, 11)); !errors.Is(err, imagediff.ErrSizeMismatch) {
+		t.Errorf("SSIM: expected ErrSizeMismatch, got %v", err)
+	}
+	if _, err := imagediff.PSNR(gradient(10, 10), gradient(11, 10)); !errors.Is(err, imagediff.ErrSizeMismatch) {
+		t.Errorf("PSNR: expected ErrSizeMismatch, got %v", err)
+	}
+	for _, size := range []image.Point{{1, 1}, {3, 20}, {9, 9}} {
+		img := gradient(size.X, size.Y)
+		if s, err := imagediff.SSIM(img, img); err != nil || math.Abs(s-1) > 1e-9 {
+			t.Errorf("%v: expected SSIM 1, got %v, %v", size, s, err)
+		}
+	}
+}
+
+// TestImageTypes verifies the RGBA fast path and other image types agree
+func TestImageTypes(t *testing.T) {
+	ref := gradient(40, 30)
+	img := noisy(ref, 10)
+	nrgba := image.NewNRGBA(img.Rect)
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			nrgba.Set(x, y, img.At(x, y))
+		}
+	}
+	fast, _ := imagediff.SSIM(ref, img)
+	slow, _ := imagediff.SSIM(ref, nrgba)
+	if math.Abs(fast-slow) > 1e-6 {
+		t.Errorf("expected the same SSIM for RGBA and NRGBA, got %.6f and %.6f", fast, slow)
+	}
+
+	sub := ref.SubImage(image.Rect(10, 10, 30, 30))
+	if s, err := imagediff.SSIM(sub, gradient(40, 30).SubImage(image.Rect(10, 10, 30, 30))); err != nil || math.Abs(s-1) > 1e-9 {
+		t.Errorf("expected sub-images to compare by position in their bounds, got %v, %v", s, err)
+	}
+}
+
+func BenchmarkSSIM(b *testing.B) {
+	for _, size := range []int{256, 1024} {
+		ref := gradient(size, size)
+		img := noisy(ref, 8)
+		b.Run(fmt.Sprintf("%dx%d", size, size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				imagediff.SSIM(ref, img)
+			}
+		})
+	}
+}
+
+func BenchmarkPSNR(b *testing.B) {
+	ref := gradient(1024, 1024)
+	img := noisy(ref, 8)
+	for i := 0; i < b.N; i++ {
+		imagediff.PSNR(ref, img)
+	}
+}
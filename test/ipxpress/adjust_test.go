@@ -0,0 +1,122 @@
+package ipxpress_test
+
+import (
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestAdjustmentParams verifies parsing and clamping of brightness, saturation, hue and contrast
+func TestAdjustmentParams(t *testing.T) {
+	tests := []struct {
+		query string
+		get   func(*ipxpress.ProcessingParams) float64
+		want  float64
+	}{
+		{"brightness=1.2", func(p *ipxpress.ProcessingParams) float64 { return p.Brightness }, 1.2},
+		{"brightness=10", func(p *ipxpress.ProcessingParams) float64 { return p.Brightness }, 3},
+		{"brightness=-1", func(p *ipxpress.ProcessingParams) float64 { return p.Brightness }, 0},
+		{"brightness=NaN", func(p *ipxpress.ProcessingParams) float64 { return p.Brightness }, 0},
+		{"saturation=0.8", func(p *ipxpress.ProcessingParams) float64 { return p.Saturation }, 0.8},
+		{"saturation=4", func(p *ipxpress.ProcessingParams) float64 { return p.Saturation }, 3},
+		{"hue=30", func(p *ipxpress.ProcessingParams) float64 { return p.Hue }, 30},
+		{"hue=390", func(p *ipxpress.ProcessingParams) float64 { return p.Hue }, 30},
+		{"hue=-90", func(p *ipxpress.ProcessingParams) float64 { return p.Hue }, -90},
+		{"hue=Inf", func(p *ipxpress.ProcessingParams) float64 { return p.Hue }, 0},
+		{"contrast=1.1", func(p *ipxpress.ProcessingParams) float64 { return p.Contrast }, 1.1},
+		{"contrast=99", func(p *ipxpress.ProcessingParams) float64 { return p.Contrast }, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			p := parseQuery(t, "/?url=http://x/a.png&"+tt.query)
+			if got := tt.get(p); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.want != 0 && !p.HasTransformations() {
+				t.Error("expected a transformation")
+			}
+		})
+	}
+
+	base := parseQuery(t, "/?url=http://x/a.png")
+	keys := map[string]bool{ipxpress.GenerateCacheKey(base): true}
+	for _, q := range []string{"brightness=1.2", "saturation=1.2", "hue=12", "contrast=1.2"} {
+		key := ipxpress.GenerateCacheKey(parseQuery(t, "/?url=http://x/a.png&"+q))
+		if keys[key] {
+			t.Errorf("%s must change the cache key", q)
+		}
+		keys[key] = true
+	}
+}
+
+// fetchAdjusted requests a solid-color PNG through the handler with extra query params
+func fetchAdjusted(t *testing.T, c color.RGBA, query string) color.Color {
+	t.Helper()
+	src := createSolidPNG(16, 16, c)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?f=png&" + query + "&url=" + url.QueryEscape(imgServer.URL+"/s.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	return decodePNG(t, body).At(8, 8)
+}
+
+// TestAdjustmentPipeline verifies each parameter changes pixels in the expected direction
+func TestAdjustmentPipeline(t *testing.T) {
+	grey := color.RGBA{R: 100, G: 100, B: 100, A: 255}
+	red := color.RGBA{R: 200, G: 60, B: 60, A: 255}
+
+	t.Run("brightness", func(t *testing.T) {
+		r, _, _, _ := fetchAdjusted(t, grey, "brightness=1.5").RGBA()
+		if r>>8 <= 110 {
+			t.Errorf("expected brighter output, got %d", r>>8)
+		}
+	})
+
+	t.Run("saturation", func(t *testing.T) {
+		r, g, _, _ := fetchAdjusted(t, red, "saturation=0.2").RGBA()
+		if int(r>>8)-int(g>>8) >= 140 {
+			t.Errorf("expected less saturated output, got r=%d g=%d", r>>8, g>>8)
+		}
+	})
+
+	t.Run("hue", func(t *testing.T) {
+		r, g, _, _ := fetchAdjusted(t, red, "hue=120").RGBA()
+		if g>>8 <= r>>8 {
+			t.Errorf("expected red rotated towards green, got r=%d g=%d", r>>8, g>>8)
+		}
+	})
+
+	t.Run("contrast", func(t *testing.T) {
+		assertNear(t, fetchAdjusted(t, grey, "contrast=2"), color.RGBA{R: 72, G: 72, B: 72, A: 255})
+	})
+
+	t.Run("composes with modulate", func(t *testing.T) {
+		// modulate=2 and brightness=0.5 multiply back to the original lightness
+		r, _, _, _ := fetchAdjusted(t, grey, "modulate=2_1_0&brightness=0.5").RGBA()
+		if d := int(r>>8) - 100; d < -4 || d > 4 {
+			t.Errorf("expected about 100, got %d", r>>8)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestAllowedOperations verifies the allowlist resolves aliases and packed parameters
+func TestAllowedOperations(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		query   string
+		blocked string // offending parameter, "" if the request is allowed
+	}{
+		{"everything by default", nil, "w=100&blur=5&modulate=1_1_90", ""},
+		{"resize by alias", []string{"w", "h", "f"}, "w=100&h=50&f=webp", ""},
+		{"resize by name", []string{"width", "height"}, "w=100&height=50", ""},
+		{"format conversion", []string{"w", "h", "f", "q"}, "format=png&q=70", ""},
+		{"blur blocked", []string{"w", "h", "f"}, "w=100&blur=5", "blur"},
+		{"extract blocked", []string{"w", "h", "f"}, "extract=0_0_10_10", "extract"},
+		{"alias named as sent", []string{"w", "f"}, "w=100&h=50", "h"},
+		{"resize needs width and height", []string{"w"}, "s=100x50", "s"},
+		{"resize from its parts", []string{"width", "height"}, "s=100x50", ""},
+		{"resize allows its parts", []string{"resize"}, "w=100&h=50", ""},
+		{"modulate needs every part", []string{"brightness", "saturation"}, "modulate=1_1_90", "modulate"},
+		{"modulate from its parts", []string{"brightness", "saturation", "hue"}, "modulate=1_1_90", ""},
+		{"modulate allows its parts", []string{"modulate"}, "hue=90&brightness=1.2", ""},
+		{"color ops blocked", []string{"modulate"}, "hue=90&grayscale=true", "grayscale"},
+		{"unknown params pass", []string{"w"}, "w=100&v=3", ""},
+		{"unknown allowlist entries ignored", []string{"w", "sepia"}, "w=100&blur=1", "blur"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := sourceQuery(presetSource, tt.query)
+			cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+			cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?"+query)), &ipxpress.CacheEntry{
+				ContentType: "image/webp",
+				Data:        []byte("seeded"),
+				StatusCode:  http.StatusOK,
+			})
+			config := ipxpress.DefaultConfig()
+			config.Capabilities = limitedCapabilities()
+			config.Cache = cache
+			config.AllowedOperations = tt.allowed
+			handler := ipxpress.NewHandler(config)
+			defer handler.Close()
+			server := httptest.NewServer(handler)
+			defer server.Close()
+
+			status, body := getBody(t, server.URL+"/?"+query)
+			if tt.blocked == "" {
+				if status != http.StatusOK || body != "seeded" {
+					t.Errorf("expected the request to be allowed, got %d %q", status, body)
+				}
+				return
+			}
+			if status != http.StatusBadRequest || !strings.Contains(body, "invalid "+tt.blocked+"=") {
+				t.Errorf("expected 400 naming %s, got %d %q", tt.blocked, status, body)
+			}
+		})
+	}
+}
+
+// TestAllowedOperationsPresets verifies presets may use operations clients can't
+func TestAllowedOperationsPresets(t *testing.T) {
+	server := presetServer(t, func(c *ipxpress.Config) { c.AllowedOperations = []string{"w"} },
+		sourceQuery(presetSource, "w=200&h=200&fit=cover&f=webp&q=75"))
+
+	if status, body := getBody(t, server.URL+"/?"+sourceQuery(presetSource, "preset=thumbnail")); status != http.StatusOK || body != "seeded" {
+		t.Errorf("expected the preset to be served, got %d %q", status, body)
+	}
+	if status, _ := getBody(t, server.URL+"/?"+sourceQuery(presetSource, "w=200&fit=cover")); status != http.StatusBadRequest {
+		t.Errorf("expected fit to be rejected, got %d", status)
+	}
+}
@@ -0,0 +1,239 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// createAnimatedGIF creates a looping GIF of frames solid frames of width x height,
+// each shown for delay hundredths of a second
+func createAnimatedGIF(width, height, frames, delay int) []byte {
+	colors := []color.Color{color.RGBA{R: 255, A: 255}, color.RGBA{G: 255, A: 255}, color.RGBA{B: 255, A: 255}, color.RGBA{R: 255, G: 255, A: 255}}
+	anim := &gif.GIF{LoopCount: 0}
+	for i := 0; i < frames; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+		c := uint8(img.Palette.Index(colors[i%len(colors)]))
+		for j := range img.Pix {
+			img.Pix[j] = c
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, anim)
+	return buf.Bytes()
+}
+
+// webpAnimation counts the frames of an animated WebP and sums their durations in milliseconds
+func webpAnimation(t *testing.T, data []byte) (frames, duration int) {
+	t.Helper()
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatal("output is not a WebP file")
+	}
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		payload := data[pos+8 : min(pos+8+size, len(data))]
+		if id == "ANMF" && len(payload) >= 15 {
+			frames++
+			duration += int(payload[12]) | int(payload[13])<<8 | int(payload[14])<<16
+		}
+		pos += 8 + size + size%2
+	}
+	return frames, duration
+}
+
+// gifDuration sums the frame delays of a GIF in hundredths of a second
+func gifDuration(anim *gif.GIF) int {
+	total := 0
+	for _, d := range anim.Delay {
+		total += d
+	}
+	return total
+}
+
+// TestAnimatedFixture verifies the animated GIF fixture decodes with its frames and delays
+func TestAnimatedFixture(t *testing.T) {
+	anim, err := gif.DecodeAll(bytes.NewReader(createAnimatedGIF(40, 30, 4, 10)))
+	if err != nil {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+	if len(anim.Image) != 4 || gifDuration(anim) != 40 {
+		t.Errorf("expected 4 frames over 40cs, got %d over %dcs", len(anim.Image), gifDuration(anim))
+	}
+}
+
+// TestAnimatedGIFResize verifies every frame of an animated GIF is resized and the timing kept
+func TestAnimatedGIFResize(t *testing.T) {
+	out := encodeGet(t, createAnimatedGIF(40, 30, 4, 10), "w=20")
+
+	anim, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output is not a GIF: %v", err)
+	}
+	if len(anim.Image) != 4 {
+		t.Fatalf("expected 4 frames, got %d", len(anim.Image))
+	}
+	if anim.Config.Width != 20 || anim.Config.Height != 15 {
+		t.Errorf("expected 20x15 frames, got %dx%d", anim.Config.Width, anim.Config.Height)
+	}
+	if d := gifDuration(anim); d < 36 || d > 44 {
+		t.Errorf("expected a duration of about 40cs, got %dcs", d)
+	}
+	if anim.LoopCount != 0 {
+		t.Errorf("expected an endless loop, got loop count %d", anim.LoopCount)
+	}
+}
+
+// TestAnimatedGIFToWebP verifies converting an animated GIF to WebP keeps the frames and duration
+func TestAnimatedGIFToWebP(t *testing.T) {
+	out := encodeGet(t, createAnimatedGIF(40, 30, 4, 10), "w=20&f=webp")
+
+	frames, duration := webpAnimation(t, out)
+	if frames != 4 {
+		t.Fatalf("expected 4 frames, got %d", frames)
+	}
+	if duration < 360 || duration > 440 {
+		t.Errorf("expected a duration of about 400ms, got %dms", duration)
+	}
+}
+
+// TestAnimatedFalseTakesFirstFrame verifies animated=false outputs a single frame
+func TestAnimatedFalseTakesFirstFrame(t *testing.T) {
+	out := encodeGet(t, createAnimatedGIF(40, 30, 4, 10), "animated=false")
+
+	anim, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output is not a GIF: %v", err)
+	}
+	if len(anim.Image) != 1 || anim.Config.Height != 30 {
+		t.Errorf("expected one 40x30 frame, got %d frame(s) of %dx%d", len(anim.Image), anim.Config.Width, anim.Config.Height)
+	}
+}
+
+// TestAnimatedToStillFormat verifies converting an animation to PNG gives the first frame at frame size
+func TestAnimatedToStillFormat(t *testing.T) {
+	out := encodeGet(t, createAnimatedGIF(40, 30, 4, 10), "w=20&f=png")
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output is not a PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 15 {
+		t.Errorf("expected a 20x15 frame, got %dx%d", b.Dx(), b.Dy())
+	}
+}
+
+// TestAnimatedPassthrough verifies an animated GIF without parameters is served unchanged
+func TestAnimatedPassthrough(t *testing.T) {
+	src := createAnimatedGIF(40, 30, 4, 10)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.StreamThreshold = 0
+	out := encodeGetWith(t, config, src, "")
+	if !bytes.Equal(out, src) {
+		t.Error("expected the original GIF bytes")
+	}
+}
+
+// TestAnimatedParam verifies animated=false is parsed, keyed and ends the animation
+func TestAnimatedParam(t *testing.T) {
+	first := parseQuery(t, "/?url=https://example.com/a.gif&animated=false")
+	if !first.FirstFrame || first.KeepsAnimation() || !first.HasTransformations() {
+		t.Errorf("animated=false should take the first frame: %+v", first)
+	}
+	all := parseQuery(t, "/?url=https://example.com/a.gif&animated=true")
+	if all.FirstFrame || !all.KeepsAnimation() || all.HasTransformations() {
+		t.Errorf("animated=true should keep the animation: %+v", all)
+	}
+	if ipxpress.GenerateCacheKey(first) == ipxpress.GenerateCacheKey(all) {
+		t.Error("animated=false should change the cache key")
+	}
+
+	for _, query := range []string{"w=20&grayscale=true&f=webp", "s=20x20&fit=cover"} {
+		if p := parseQuery(t, "/?url=https://example.com/a.gif&"+query); !p.KeepsAnimation() {
+			t.Errorf("%s should keep the animation", query)
+		}
+	}
+	for _, query := range []string{"rotate=90", "extract=0_0_10_10", "blur=2", "radius=4", "s=20x20&fit=contain", "flip=true"} {
+		if p := parseQuery(t, "/?url=https://example.com/a.gif&"+query); p.KeepsAnimation() {
+			t.Errorf("%s should take the first frame", query)
+		}
+	}
+
+	if !core.FormatGIF.SupportsAnimation() || !core.FormatWebP.SupportsAnimation() || core.FormatPNG.SupportsAnimation() {
+		t.Error("only GIF and WebP support animation")
+	}
+}
+
+// TestAnimatedParamListed verifies the animated parameter is in the registry
+func TestAnimatedParamListed(t *testing.T) {
+	spec, ok := ipxpress.LookupParam(core.ParamAnimated)
+	if !ok || spec.Default != "true" {
+		t.Errorf("expected the animated param defaulting to true, got %+v", spec)
+	}
+}
+
+// TestFrameParam verifies frame=N takes that frame of an animation, clamped to the last
+func TestFrameParam(t *testing.T) {
+	src := createAnimatedGIF(40, 30, 3, 10) // red, green, blue
+	for _, tc := range []struct {
+		query string
+		want  color.RGBA
+	}{
+		{"frame=2&f=png", color.RGBA{B: 255, A: 255}},
+		{"frame=1&w=20&f=png", color.RGBA{G: 255, A: 255}},
+		{"frame=0&f=png", color.RGBA{R: 255, A: 255}},
+		{"frame=9&f=png", color.RGBA{B: 255, A: 255}}, // past the end: the last frame
+	} {
+		img, err := png.Decode(bytes.NewReader(encodeGet(t, src, tc.query)))
+		if err != nil {
+			t.Fatalf("%s: output is not a PNG: %v", tc.query, err)
+		}
+		b := img.Bounds()
+		if b.Dy() != b.Dx()*3/4 {
+			t.Errorf("%s: expected a single frame, got %dx%d", tc.query, b.Dx(), b.Dy())
+		}
+		r, g, bl, _ := img.At(b.Dx()/2, b.Dy()/2).RGBA()
+		if got := (color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(bl >> 8), A: 255}); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.want, got)
+		}
+	}
+
+	// Kept as GIF, the frame is a still image
+	anim, err := gif.DecodeAll(bytes.NewReader(encodeGet(t, src, "frame=1")))
+	if err != nil {
+		t.Fatalf("output is not a GIF: %v", err)
+	}
+	if len(anim.Image) != 1 {
+		t.Errorf("expected one frame, got %d", len(anim.Image))
+	}
+}
+
+// TestFrameParamParsing verifies frame ends the animation, frame=0 like animated=false
+func TestFrameParamParsing(t *testing.T) {
+	second := parseQuery(t, "/?url=https://example.com/a.gif&frame=1")
+	if second.Frame != 1 || second.KeepsAnimation() || !second.HasTransformations() {
+		t.Errorf("frame=1 should take a single frame: %+v", second)
+	}
+	first := parseQuery(t, "/?url=https://example.com/a.gif&frame=0")
+	animatedFalse := parseQuery(t, "/?url=https://example.com/a.gif&animated=false")
+	if ipxpress.GenerateCacheKey(first) != ipxpress.GenerateCacheKey(animatedFalse) {
+		t.Error("expected frame=0 to be animated=false")
+	}
+	if ipxpress.GenerateCacheKey(first) == ipxpress.GenerateCacheKey(second) {
+		t.Error("expected each frame to have its own cache key")
+	}
+	if p := parseQuery(t, "/?url=https://example.com/a.gif&frame=-1"); p.Err() == nil || p.Frame != 0 || p.FirstFrame {
+		t.Errorf("expected a negative frame rejected, got %+v", p)
+	}
+}
@@ -0,0 +1,130 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// authServe runs a request through mw and returns the status, the key name the
+// next handler saw and the query it got
+func authServe(mw ipxpress.MiddlewareFunc, target string, header http.Header) (int, string, string) {
+	var name, query string
+	handler := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ = ipxpress.APIKeyName(r.Context())
+		query = r.URL.RawQuery
+	}))
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code, name, query
+}
+
+// TestAPIKeyLocations verifies each place a key can be presented
+func TestAPIKeyLocations(t *testing.T) {
+	mw := ipxpress.NewAPIKeys(map[string]string{"mobile": "s3cret-mobile", "web": "s3cret-web"}).Middleware()
+
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+		want   string
+	}{
+		{"bearer", "/?w=100", http.Header{"Authorization": {"Bearer s3cret-web"}}, "web"},
+		{"header", "/?w=100", http.Header{"X-Api-Key": {"s3cret-mobile"}}, "mobile"},
+		{"query", "/?w=100&apikey=s3cret-web", nil, "web"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, name, query := authServe(mw, tt.target, tt.header)
+			if code != http.StatusOK || name != tt.want {
+				t.Fatalf("expected 200 as %q, got %d as %q", tt.want, code, name)
+			}
+			if query != "w=100" {
+				t.Errorf("expected the key removed from the query, got %q", query)
+			}
+		})
+	}
+}
+
+// TestAPIKeyRejections verifies missing, unknown and near-miss keys are refused
+func TestAPIKeyRejections(t *testing.T) {
+	mw := ipxpress.AuthMiddleware([]string{"s3cret-token"})
+
+	for name, header := range map[string]http.Header{
+		"missing":   nil,
+		"empty":     {"Authorization": {"Bearer "}},
+		"prefix":    {"Authorization": {"Bearer s3cret-toke"}},
+		"extended":  {"Authorization": {"Bearer s3cret-token2"}},
+		"case":      {"X-Api-Key": {"S3cret-token"}},
+		"last byte": {"X-Api-Key": {"s3cret-tokeN"}},
+	} {
+		if code, _, _ := authServe(mw, "/", header); code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, code)
+		}
+	}
+	if code, _, _ := authServe(mw, "/?apikey=s3cret-tokem", nil); code != http.StatusUnauthorized {
+		t.Errorf("query near-miss: expected 401, got %d", code)
+	}
+	if code, name, _ := authServe(mw, "/", http.Header{"Authorization": {"Bearer s3cret-token"}}); code != http.StatusOK || name != "key 1" {
+		t.Errorf("expected the exact token through as key 1, got %d as %q", code, name)
+	}
+}
+
+// TestAPIKeysFromFile verifies loading a key file and reloading it on SIGHUP
+func TestAPIKeysFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# rotated monthly\nci old-key\n\nbare-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ipxpress.LoadAPIKeys(path)
+	if err != nil {
+		t.Fatalf("LoadAPIKeys: %v", err)
+	}
+	defer keys.Close()
+
+	if name, ok := keys.Lookup("old-key"); !ok || name != "ci" {
+		t.Errorf("expected old-key as ci, got %q %v", name, ok)
+	}
+	if name, ok := keys.Lookup("bare-key"); !ok || name != "line 4" {
+		t.Errorf("expected bare-key as line 4, got %q %v", name, ok)
+	}
+
+	if err := os.WriteFile(path, []byte("ci new-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	proc, _ := os.FindProcess(os.Getpid())
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		t.Skipf("can't send SIGHUP here: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for _, ok := keys.Lookup("new-key"); !ok && time.Now().Before(deadline); _, ok = keys.Lookup("new-key") {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := keys.Lookup("new-key"); !ok {
+		t.Fatal("expected new-key after SIGHUP")
+	}
+	if _, ok := keys.Lookup("old-key"); ok {
+		t.Error("expected old-key to be gone after SIGHUP")
+	}
+
+	// A broken file keeps the keys that worked
+	if err := os.WriteFile(path, []byte("too many fields here\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Reload(); err == nil {
+		t.Error("expected a reload error for a malformed file")
+	}
+	if _, ok := keys.Lookup("new-key"); !ok {
+		t.Error("expected the previous keys kept after a failed reload")
+	}
+}
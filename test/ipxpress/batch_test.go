@@ -0,0 +1,182 @@
+package ipxpress_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// batchHandler returns a handler that needs no libvips until something is decoded
+func batchHandler(t *testing.T) *ipxpress.Handler {
+	t.Helper()
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// feed sends items on a channel until they're all sent or ctx is done, then closes it
+func feed(ctx context.Context, items []ipxpress.BatchItem) <-chan ipxpress.BatchItem {
+	inputs := make(chan ipxpress.BatchItem)
+	go func() {
+		defer close(inputs)
+		for _, item := range items {
+			select {
+			case inputs <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return inputs
+}
+
+// TestBatchProcess verifies every item gets a result with a variant per params, from any kind of source
+func TestBatchProcess(t *testing.T) {
+	src := createGradientPNG(300, 200)
+	path := filepath.Join(t.TempDir(), "a.png")
+	if err := os.WriteFile(path, src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+
+	sizes := []*ipxpress.ProcessingParams{
+		{Width: 40, Format: ipxpress.FormatPNG},
+		{Width: 80, Format: ipxpress.FormatJPEG},
+		{Width: 120, Format: ipxpress.FormatWebP},
+	}
+	var items []ipxpress.BatchItem
+	for i := 0; i < 6; i++ {
+		item := ipxpress.BatchItem{ID: fmt.Sprintf("item-%d", i), Params: sizes}
+		switch i % 3 {
+		case 0:
+			item.Data = src
+		case 1:
+			item.Path = path
+		case 2:
+			item.URL = origin.URL + "/a.png"
+		}
+		items = append(items, item)
+	}
+
+	seen := make(map[int]bool)
+	for res := range handler.BatchProcess(context.Background(), feed(context.Background(), items), ipxpress.BatchOptions{Concurrency: 3}) {
+		if res.Err != nil {
+			t.Fatalf("%s: %v", res.ID, res.Err)
+		}
+		if seen[res.Index] || res.ID != items[res.Index].ID {
+			t.Errorf("unexpected result %d for %q", res.Index, res.ID)
+		}
+		seen[res.Index] = true
+		if len(res.Variants) != len(sizes) {
+			t.Fatalf("%s: expected %d variants, got %d", res.ID, len(sizes), len(res.Variants))
+		}
+		for i, v := range res.Variants {
+			if v.Err != nil || v.Width != sizes[i].Width || v.Format != sizes[i].Format || len(v.Data) == 0 {
+				t.Errorf("%s/%d: expected %d wide %s, got %d wide %s (%d bytes, %v)", res.ID, i, sizes[i].Width, sizes[i].Format, v.Width, v.Format, len(v.Data), v.Err)
+			}
+		}
+	}
+	if len(seen) != len(items) {
+		t.Errorf("expected %d results, got %d", len(items), len(seen))
+	}
+}
+
+// TestBatchItemErrors verifies bad sources and params fail their item or variant only
+func TestBatchItemErrors(t *testing.T) {
+	handler := batchHandler(t)
+	items := []ipxpress.BatchItem{
+		{ID: "missing", Path: filepath.Join(t.TempDir(), "missing.png"), Params: []*ipxpress.ProcessingParams{{Width: 10}}},
+		{ID: "empty", Params: []*ipxpress.ProcessingParams{{Width: 10}}},
+		{ID: "params", Path: "unread.png", Params: []*ipxpress.ProcessingParams{{Page: 2}, {Info: true}}},
+	}
+
+	results := make(map[string]ipxpress.BatchResult)
+	for res := range handler.BatchProcess(context.Background(), feed(context.Background(), items), ipxpress.BatchOptions{}) {
+		results[res.ID] = res
+	}
+	if len(results) != len(items) {
+		t.Fatalf("expected %d results, got %d", len(items), len(results))
+	}
+	if res := results["missing"]; !errors.Is(res.Err, os.ErrNotExist) || res.Index != 0 {
+		t.Errorf("missing: expected a not-exist error at 0, got %v at %d", res.Err, res.Index)
+	}
+	if res := results["empty"]; res.Err == nil || res.Index != 1 {
+		t.Errorf("empty: expected an error at 1, got %v at %d", res.Err, res.Index)
+	}
+	res := results["params"]
+	if res.Err != nil || len(res.Variants) != 2 {
+		t.Fatalf("params: expected 2 variants, got %v, %v", res.Variants, res.Err)
+	}
+	for i, v := range res.Variants {
+		var perr *ipxpress.ProcessError
+		if !errors.As(v.Err, &perr) || perr.StatusCode != http.StatusBadRequest {
+			t.Errorf("params/%d: expected a 400 ProcessError, got %v", i, v.Err)
+		}
+	}
+}
+
+// TestBatchMaxErrors verifies a batch stops reading items after MaxErrors failures
+func TestBatchMaxErrors(t *testing.T) {
+	handler := batchHandler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	items := make([]ipxpress.BatchItem, 20)
+	for i := range items {
+		items[i] = ipxpress.BatchItem{ID: fmt.Sprint(i), Path: filepath.Join(t.TempDir(), "missing.png"), Params: []*ipxpress.ProcessingParams{{}}}
+	}
+
+	var failed int
+	var last ipxpress.BatchResult
+	for res := range handler.BatchProcess(ctx, feed(ctx, items), ipxpress.BatchOptions{Concurrency: 1, MaxErrors: 3}) {
+		if res.Index >= 0 {
+			failed++
+		}
+		last = res
+	}
+	if failed != 3 {
+		t.Errorf("expected 3 failed items before aborting, got %d", failed)
+	}
+	if !errors.Is(last.Err, ipxpress.ErrBatchAborted) || last.Index != -1 {
+		t.Errorf("expected ErrBatchAborted last, got %v at %d", last.Err, last.Index)
+	}
+}
+
+// TestBatchCancel verifies canceling the context ends a batch whose inputs are still open
+func TestBatchCancel(t *testing.T) {
+	handler := batchHandler(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	inputs := make(chan ipxpress.BatchItem)
+	results := handler.BatchProcess(ctx, inputs, ipxpress.BatchOptions{Concurrency: 2})
+
+	for i := 0; i < 2; i++ {
+		inputs <- ipxpress.BatchItem{ID: fmt.Sprint(i), Params: []*ipxpress.ProcessingParams{{Page: 1}}}
+		if res := <-results; res.Index != i {
+			t.Errorf("expected result %d, got %d", i, res.Index)
+		}
+	}
+	cancel()
+	select {
+	case _, ok := <-results:
+		if ok {
+			t.Error("expected no more results after canceling")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the results to be closed after canceling")
+	}
+}
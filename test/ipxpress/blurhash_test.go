@@ -0,0 +1,131 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// gradient returns a fixture with a horizontal red and a vertical blue gradient
+func gradient(width, height int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(255 * x / width), G: 80, B: uint8(255 * y / height), A: 255})
+		}
+	}
+	return img
+}
+
+// TestEncodeBlurHashSolid verifies the hash of a solid white image
+func TestEncodeBlurHashSolid(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	hash, err := ipxpress.EncodeBlurHash(img, 4, 3)
+	if err != nil {
+		t.Fatalf("EncodeBlurHash: %v", err)
+	}
+	// 4x3 components and DC #ffffff ("TSUA"); as in the reference implementation the
+	// cosines are sampled at whole pixels, so odd components aren't quite zero
+	if want := "LKTSUA~qfQ~q~qoffQoffQfQfQfQ"; hash != want {
+		t.Errorf("got %q, want %q", hash, want)
+	}
+}
+
+// TestEncodeBlurHashDeterministic verifies the hash of a fixture is stable and sized by the components
+func TestEncodeBlurHashDeterministic(t *testing.T) {
+	img := gradient(32, 24)
+	for _, c := range []struct{ x, y int }{{1, 1}, {4, 3}, {3, 4}, {9, 9}} {
+		first, err := ipxpress.EncodeBlurHash(img, c.x, c.y)
+		if err != nil {
+			t.Fatalf("%dx%d: %v", c.x, c.y, err)
+		}
+		if want := 4 + 2*c.x*c.y; len(first) != want {
+			t.Errorf("%dx%d: expected %d characters, got %d (%q)", c.x, c.y, want, len(first), first)
+		}
+		if again, _ := ipxpress.EncodeBlurHash(img, c.x, c.y); again != first {
+			t.Errorf("%dx%d: hash changed from %q to %q", c.x, c.y, first, again)
+		}
+	}
+
+	a, _ := ipxpress.EncodeBlurHash(img, 4, 3)
+	b, _ := ipxpress.EncodeBlurHash(gradient(24, 32), 4, 3)
+	if a == b {
+		t.Error("different images should hash differently")
+	}
+	for _, c := range []struct{ x, y int }{{0, 3}, {4, 10}} {
+		if _, err := ipxpress.EncodeBlurHash(img, c.x, c.y); err == nil {
+			t.Errorf("%dx%d components should be rejected", c.x, c.y)
+		}
+	}
+}
+
+// TestPlaceholderParam verifies placeholder is validated, keyed and forces processing
+func TestPlaceholderParam(t *testing.T) {
+	p := parseQuery(t, "/?url=https://example.com/a.jpg&placeholder=blurhash")
+	if p.Placeholder != ipxpress.PlaceholderBlurHash {
+		t.Fatalf("expected blurhash, got %q", p.Placeholder)
+	}
+	if !p.NeedsProcessing(ipxpress.FormatJPEG) {
+		t.Error("a placeholder needs the image decoded")
+	}
+	if ipxpress.GenerateCacheKey(p) == ipxpress.GenerateCacheKey(parseQuery(t, "/?url=https://example.com/a.jpg")) {
+		t.Error("placeholder should change the cache key")
+	}
+	if p := parseQuery(t, "/?url=https://example.com/a.jpg&placeholder=thumbhash"); p.Err() == nil || p.Placeholder != "" {
+		t.Errorf("expected thumbhash to be rejected, got %q", p.Placeholder)
+	}
+}
+
+// TestPlaceholderBlurHash verifies placeholder=blurhash returns the hash of the processed image
+func TestPlaceholderBlurHash(t *testing.T) {
+	src := createTestImage(200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(query string) (hash string, width, height int) {
+		resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/a.jpg") + "&placeholder=blurhash" + query)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("expected 200 JSON, got %d %q: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		var got struct {
+			BlurHash string `json:"blurhash"`
+			Width    int    `json:"width"`
+			Height   int    `json:"height"`
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("invalid JSON %q: %v", body, err)
+		}
+		return got.BlurHash, got.Width, got.Height
+	}
+
+	hash, w, h := get("")
+	if len(hash) != 4+2*4*3 || w != 200 || h != 100 {
+		t.Errorf("expected a 4x3 hash of a 200x100 image, got %q for %dx%d", hash, w, h)
+	}
+	portrait, w, h := get("&w=50&h=100&fit=cover")
+	if len(portrait) != 4+2*3*4 || w != 50 || h != 100 {
+		t.Errorf("expected a 3x4 hash of a 50x100 image, got %q for %dx%d", portrait, w, h)
+	}
+}
@@ -0,0 +1,173 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// repeated returns part joined n times with "_"
+func repeated(part string, n int) string {
+	return strings.TrimSuffix(strings.Repeat(part+"_", n), "_")
+}
+
+// worstCaseQuery packs thousands of parts into every packed parameter
+func worstCaseQuery() string {
+	v := url.Values{}
+	v.Set("url", "http://x/a.jpg")
+	for _, name := range []string{"extract", "extend", "sharpen", "modulate", "duotone", "pixelate_region"} {
+		v.Set(name, repeated("1", 10000))
+	}
+	v.Set("background", strings.Repeat("f", 10000))
+	v.Set("tint", strings.Repeat("a", 10000))
+	v.Set("s", repeated("1", 5000))
+	return "/?" + v.Encode()
+}
+
+// TestPackedParamsBounded verifies over-long packed values are truncated and reported
+func TestPackedParamsBounded(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		field func(*ipxpress.ProcessingParams) string
+		parts int
+	}{
+		{"extract", "extract=" + repeated("1", 10000), func(p *ipxpress.ProcessingParams) string { return p.Extract }, 4},
+		{"extend", "extend=" + repeated("2", 10000), func(p *ipxpress.ProcessingParams) string { return p.Extend }, 4},
+		{"sharpen", "sharpen=" + repeated("1.5", 10000), func(p *ipxpress.ProcessingParams) string { return p.Sharpen }, 3},
+		{"modulate", "modulate=" + repeated("1", 5), func(p *ipxpress.ProcessingParams) string { return p.Modulate }, 3},
+		{"duotone", "duotone=" + repeated("ffffff", 50), func(p *ipxpress.ProcessingParams) string { return p.Duotone }, 2},
+		{"pixelate_region", "pixelate_region=" + repeated("9", 10000), func(p *ipxpress.ProcessingParams) string { return p.PixelateRegion }, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := parseQuery(t, "/?url=http://x/a.jpg&"+tt.query)
+			if got := strings.Count(tt.field(params), "_") + 1; got > tt.parts {
+				t.Errorf("expected at most %d parts, got %d", tt.parts, got)
+			}
+			if params.Err() == nil {
+				t.Error("expected the truncation to be reported")
+			}
+		})
+	}
+}
+
+// TestHexColorBounded verifies color values can't grow without bound
+func TestHexColorBounded(t *testing.T) {
+	params := parseQuery(t, "/?url=http://x/a.jpg&b="+strings.Repeat("f", 100000)+"&tint="+strings.Repeat("0", 100000))
+	if len(params.Background) > 16 || len(params.Tint) > 16 {
+		t.Errorf("expected colors capped, got %d/%d bytes", len(params.Background), len(params.Tint))
+	}
+	if len(params.Errors) != 2 {
+		t.Errorf("expected 2 errors, got %d", len(params.Errors))
+	}
+
+	if params := parseQuery(t, "/?url=http://x/a.jpg&b=ff0000"); params.Err() != nil {
+		t.Errorf("valid color rejected: %v", params.Err())
+	}
+}
+
+// TestParamErrorsStaySmall verifies error messages don't echo attacker-sized input
+func TestParamErrorsStaySmall(t *testing.T) {
+	v := url.Values{}
+	v.Set("url", "http://x/a.jpg")
+	for i := 0; i < 50; i++ {
+		v.Set("junk"+strings.Repeat("k", i), strings.Repeat("z", 1000))
+	}
+	params := parseQuery(t, "/?"+v.Encode())
+
+	if len(params.Errors) != 50 {
+		t.Fatalf("expected 50 errors, got %d", len(params.Errors))
+	}
+	if msg := params.Err().Error(); len(msg) > 1024 || !strings.Contains(msg, "and 45 more") {
+		t.Errorf("expected a short summarized message, got %d bytes: %q", len(msg), msg)
+	}
+}
+
+// TestPathologicalParamsStrict verifies strict mode rejects oversized params with 400
+func TestPathologicalParamsStrict(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.StrictParams = true
+	config.Capabilities = limitedCapabilities()
+	server := httptest.NewServer(ipxpress.NewHandler(config))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + worstCaseQuery())
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+// TestPathologicalParamsAllocations verifies parsing allocations don't scale with repetition
+func TestPathologicalParamsAllocations(t *testing.T) {
+	normal, _ := http.NewRequest("GET", "http://localhost/?url=http://x/a.jpg&extract=1_1_1_1&extend=1_1_1_1&sharpen=1_1_1&modulate=1_1_1&duotone=000000_ffffff&pixelate_region=1_1_1_1&background=fff&tint=000&s=1x1", nil)
+	worst, _ := http.NewRequest("GET", "http://localhost"+worstCaseQuery(), nil)
+
+	base := testing.AllocsPerRun(20, func() { ipxpress.ParseProcessingParams(normal) })
+	bad := testing.AllocsPerRun(20, func() { ipxpress.ParseProcessingParams(worst) })
+
+	// Each rejected parameter costs a handful of allocations for its error, independent of size
+	if bad > base+100 {
+		t.Errorf("worst-case parse made %.0f allocations vs %.0f for a normal query", bad, base)
+	}
+}
+
+// FuzzParseProcessingParams checks parsing never panics and always respects the bounds
+func FuzzParseProcessingParams(f *testing.F) {
+	seeds := []string{
+		"extract=1_2_3_4",
+		"extract=" + repeated("1", 1000),
+		"extract=_____",
+		"extend=-1_-1_-1_-1",
+		"extend=" + repeated("99999999999999999999", 100),
+		"sharpen=NaN_Inf_-Inf",
+		"sharpen=" + repeated("1e308", 200),
+		"modulate=1_1_1_1_1",
+		"modulate=__",
+		"duotone=zzz_",
+		"duotone=" + repeated("#", 500),
+		"pixelate=10&pixelate_region=" + repeated("0", 500),
+		"b=" + strings.Repeat("f", 500),
+		"b=%23%23%23",
+		"tint=" + strings.Repeat("\x00", 50),
+		"s=" + repeated("x", 300),
+		"s=1x2x3",
+		"f=" + strings.Repeat("jpeg", 100),
+		"overlay_pos=1_2_3",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		req := httptest.NewRequest("GET", "http://localhost/", nil)
+		req.URL.RawQuery = query
+		params := ipxpress.ParseProcessingParams(req)
+
+		limits := map[string]int{
+			params.Extract: 4, params.Extend: 4, params.Sharpen: 3,
+			params.Modulate: 3, params.Duotone: 2, params.PixelateRegion: 4,
+		}
+		for value, parts := range limits {
+			if strings.Count(value, "_")+1 > parts || len(value) > 256 {
+				t.Fatalf("unbounded packed value %q", value)
+			}
+		}
+		if len(params.Background) > 16 || len(params.Tint) > 16 {
+			t.Fatalf("unbounded color %q / %q", params.Background, params.Tint)
+		}
+		if err := params.Err(); err != nil && len(err.Error()) > 2048 {
+			t.Fatalf("error message too long: %d bytes", len(err.Error()))
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// createDetailedPNG creates a gradient overlaid with fine noise, which compresses poorly
+func createDetailedPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	seed := uint32(1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			seed = seed*1664525 + 1013904223
+			noise := uint8(seed >> 27)
+			img.Set(x, y, color.RGBA{R: uint8(x) + noise, G: uint8(y) + noise, B: uint8(x^y) + noise, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// TestToBytesWithBudget verifies the chosen quality fits and is the highest that does
+func TestToBytesWithBudget(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createDetailedPNG(600, 400))
+	defer proc.Close()
+
+	full, err := proc.ToBytes(ipxpress.FormatJPEG, 100)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	budget := len(full) / 3
+
+	out, quality, err := proc.ToBytesWithBudget(ipxpress.FormatJPEG, budget)
+	if err != nil {
+		t.Fatalf("encode with budget: %v", err)
+	}
+	if len(out) > budget {
+		t.Errorf("output of %d bytes exceeds the budget of %d", len(out), budget)
+	}
+	if quality < 1 || quality >= 100 {
+		t.Errorf("unexpected quality %d", quality)
+	}
+	// Five halvings of 1-100 leave the chosen quality within 3 of the best that fits
+	if quality+4 <= 100 {
+		if above, _ := proc.ToBytes(ipxpress.FormatJPEG, quality+4); len(above) <= budget {
+			t.Errorf("quality %d also fits, search stopped too low at %d", quality+4, quality)
+		}
+	}
+
+	if out, _, _ := proc.ToBytesWithBudget(ipxpress.FormatJPEG, len(full)+1); !bytes.Equal(out, full) {
+		t.Error("expected quality 100 when it fits")
+	}
+}
+
+// TestToBytesWithBudgetUnreachable verifies the smallest result is returned when nothing fits
+func TestToBytesWithBudgetUnreachable(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createDetailedPNG(600, 400))
+	defer proc.Close()
+
+	out, quality, err := proc.ToBytesWithBudget(ipxpress.FormatJPEG, 100)
+	if err != nil {
+		t.Fatalf("encode with budget: %v", err)
+	}
+	lowest, _ := proc.ToBytes(ipxpress.FormatJPEG, 1)
+	if quality != 1 || len(out) != len(lowest) {
+		t.Errorf("expected the quality 1 result (%d bytes), got quality %d with %d bytes", len(lowest), quality, len(out))
+	}
+
+	if _, _, err := proc.ToBytesWithBudget(ipxpress.FormatJPEG, 0); err == nil {
+		t.Error("expected an error for a zero budget")
+	}
+}
+
+// TestAutoQualityHandler verifies q=auto&maxbytes= keeps responses under the budget
+func TestAutoQualityHandler(t *testing.T) {
+	src := createDetailedPNG(800, 600)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		format string
+		budget int
+	}{
+		{"jpeg", 150000},
+		{"jpeg", 40000},
+		{"webp", 30000},
+	} {
+		resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.png") +
+			"&f=" + tt.format + "&q=auto&maxbytes=" + strconv.Itoa(tt.budget))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s/%d: expected 200, got %d", tt.format, tt.budget, resp.StatusCode)
+		}
+		if len(body) > tt.budget {
+			t.Errorf("%s/%d: response of %d bytes exceeds the budget", tt.format, tt.budget, len(body))
+		}
+		if q, err := strconv.Atoi(resp.Header.Get("X-IPX-Quality")); err != nil || q < 1 || q > 100 {
+			t.Errorf("%s/%d: expected X-IPX-Quality, got %q", tt.format, tt.budget, resp.Header.Get("X-IPX-Quality"))
+		}
+	}
+}
+
+// TestAutoQualityParams verifies parsing of q=auto and maxbytes
+func TestAutoQualityParams(t *testing.T) {
+	params := parseQuery(t, "/?url=http://x/a.png&q=auto&maxbytes=150000")
+	if !params.QualityAuto || params.MaxBytes != 150000 || params.Err() != nil {
+		t.Errorf("unexpected params auto=%t maxbytes=%d err=%v", params.QualityAuto, params.MaxBytes, params.Err())
+	}
+	if !params.NeedsProcessing(ipxpress.FormatPNG) {
+		t.Error("a byte budget should force re-encoding")
+	}
+	fixed := parseQuery(t, "/?url=http://x/a.png&q=80")
+	if ipxpress.GenerateCacheKey(params) == ipxpress.GenerateCacheKey(fixed) {
+		t.Error("auto quality must not share the cache key of a fixed quality")
+	}
+
+	for query, param := range map[string]string{
+		"q=auto":              "quality",
+		"maxbytes=1000":       "maxbytes",
+		"q=auto&maxbytes=-5":  "maxbytes",
+		"q=auto&maxbytes=big": "maxbytes",
+	} {
+		params := parseQuery(t, "/?url=http://x/a.png&"+query)
+		if len(params.Errors) == 0 || params.Errors[0].Param != param {
+			t.Errorf("%s: expected an error for %q, got %v", query, param, params.Errors)
+		}
+		if params.QualityAuto && params.MaxBytes > 0 {
+			t.Errorf("%s: expected the budget to be dropped", query)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestCompressEntries verifies which entries are stored compressed and that they read back whole
+func TestCompressEntries(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg">` + strings.Repeat(`<rect width="10" height="10"/>`, 2000) + `</svg>`)
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+
+	tests := []struct {
+		name        string
+		mode        ipxpress.CacheCompression
+		contentType string
+		data        []byte
+		compressed  bool
+	}{
+		{"text mode compresses svg", ipxpress.CompressText, "image/svg+xml", svg, true},
+		{"text mode skips images", ipxpress.CompressText, "image/png", patterned(64 * 1024), false},
+		{"all mode compresses images", ipxpress.CompressAll, "image/png", patterned(64 * 1024), true},
+		{"incompressible data is kept", ipxpress.CompressAll, "image/png", random, false},
+		{"small entries are kept", ipxpress.CompressAll, "image/svg+xml", svg[:512], false},
+		{"off", ipxpress.CompressOff, "image/svg+xml", svg, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := ipxpress.NewInMemoryCache(time.Minute, 1<<24)
+			defer cache.Close()
+			cache.CompressEntries(tt.mode, 1024)
+			cache.Set("k", &ipxpress.CacheEntry{ContentType: tt.contentType, Data: bytes.Clone(tt.data), StatusCode: http.StatusOK})
+
+			entry, ok := cache.Get("k")
+			if !ok {
+				t.Fatal("entry not stored")
+			}
+			if entry.Compressed != tt.compressed {
+				t.Fatalf("expected compressed=%t", tt.compressed)
+			}
+			stored, served := len(entry.Data), entry.Size()
+			if tt.compressed && stored*4 > served {
+				t.Errorf("expected the stored data well below %d bytes, got %d", served, stored)
+			}
+			if served != len(tt.data) {
+				t.Errorf("expected Size %d, got %d", len(tt.data), served)
+			}
+			if data, err := entry.Bytes(); err != nil || !bytes.Equal(data, tt.data) {
+				t.Errorf("expected the original data back, got %d bytes (%v)", len(data), err)
+			}
+			if usage := cache.MemoryUsage(); tt.compressed && usage > int64(served/2) {
+				t.Errorf("expected memory usage to count the stored size, got %d for %d bytes", usage, served)
+			}
+		})
+	}
+}
+
+// TestCompressSpilledEntries verifies compression applies before spilling to disk
+func TestCompressSpilledEntries(t *testing.T) {
+	cache, dir := newSpillCache(t, 1<<26)
+	cache.CompressEntries(ipxpress.CompressAll, 0)
+	data := patterned(2 << 20)
+	cache.Set("big", &ipxpress.CacheEntry{ContentType: "image/png", Data: bytes.Clone(data), StatusCode: http.StatusOK})
+
+	entry, ok := cache.Get("big")
+	if !ok || !entry.Compressed || entry.Size() != len(data) {
+		t.Fatalf("expected a compressed entry of %d bytes", len(data))
+	}
+	for _, f := range spillFiles(t, dir) {
+		if info, err := os.Stat(f); err == nil && info.Size() >= int64(len(data)) {
+			t.Errorf("expected the spilled file to hold compressed data, got %d bytes", info.Size())
+		}
+	}
+	var buf bytes.Buffer
+	if err := entry.WriteData(&buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("expected the original data back (%v)", err)
+	}
+}
+
+// sizedOrigin serves a PNG signature followed by size-8 compressible bytes and counts requests
+func sizedOrigin(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, size-8)...))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestCacheMaxEntryBytes verifies oversized responses are served but not cached
+func TestCacheMaxEntryBytes(t *testing.T) {
+	var hits atomic.Int32
+	origin := sizedOrigin(t, &hits)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.CacheMaxEntryBytes = 4096
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	get := func(size int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png?size="+strconv.Itoa(size))
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	for i, want := range []string{"MISS", "HIT"} {
+		if rec := get(1024); rec.Header().Get("X-IPX-Cache") != want || rec.Body.Len() != 1024 {
+			t.Errorf("small request %d: expected %s with 1024 bytes, got %q with %d", i, want, rec.Header().Get("X-IPX-Cache"), rec.Body.Len())
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if rec := get(8192); rec.Code != http.StatusOK || rec.Header().Get("X-IPX-Cache") != "BYPASS" || rec.Body.Len() != 8192 {
+			t.Errorf("large request %d: expected BYPASS with 8192 bytes, got %d %q with %d", i, rec.Code, rec.Header().Get("X-IPX-Cache"), rec.Body.Len())
+		}
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("expected the large response fetched every time (3 origin hits), got %d", n)
+	}
+}
+
+// TestHandlerServesCompressedEntries verifies compressed entries are served decompressed
+func TestHandlerServesCompressedEntries(t *testing.T) {
+	var hits atomic.Int32
+	origin := sizedOrigin(t, &hits)
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<24)
+	cache.CompressEntries(ipxpress.CompressAll, 1024)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config, ipxpress.WithCache(cache))
+	defer handler.Close()
+
+	const size = 256 * 1024
+	target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png?size="+strconv.Itoa(size))
+	var bodies [][]byte
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != strconv.Itoa(size) || rec.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("request %d: expected %d bytes of png, got %d %q %q", i, size, rec.Code,
+				rec.Header().Get("Content-Length"), rec.Header().Get("Content-Type"))
+		}
+		bodies = append(bodies, rec.Body.Bytes())
+	}
+	if len(bodies[0]) != size || !bytes.Equal(bodies[0], bodies[1]) {
+		t.Errorf("expected the same %d bytes served from the cache", size)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the second request served from the cache, origin hit %d times", hits.Load())
+	}
+	if usage := cache.MemoryUsage(); usage > size/10 {
+		t.Errorf("expected the stored entry compressed, memory usage %d for %d served bytes", usage, size)
+	}
+}
@@ -0,0 +1,176 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// limitedCapabilities simulates a libvips build without AVIF/HEIF support
+func limitedCapabilities() *ipxpress.Capabilities {
+	return &ipxpress.Capabilities{
+		Load: map[string]bool{"jpeg": true, "png": true},
+		Save: map[string]bool{"jpeg": true, "png": true},
+	}
+}
+
+// TestUnsupportedOutputReturns415 verifies a missing saver maps to 415 listing the formats to use instead, and is cached for UnsupportedCacheTTL
+func TestUnsupportedOutputReturns415(t *testing.T) {
+	var backendRequests int32
+	src := createSolidPNG(20, 20, color.RGBA{R: 255, A: 255})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.CacheTTL = time.Minute
+	config.DebugHeaders = true
+	srv := httptest.NewServer(ipxpress.NewHandler(config))
+	defer srv.Close()
+
+	testURL := srv.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.png") + "&f=avif"
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(testURL)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Fatalf("expected 415, got %d", resp.StatusCode)
+		}
+		if ttl := resp.Header.Get("X-IPX-Cache-TTL"); ttl != config.UnsupportedCacheTTL.String() {
+			t.Errorf("expected 415 cached for UnsupportedCacheTTL %s, got %q", config.UnsupportedCacheTTL, ttl)
+		}
+		if !strings.Contains(string(body), "avif") || !strings.Contains(string(body), "jpeg, png") || !strings.Contains(string(body), "/ipx/capabilities") {
+			t.Errorf("body should name the capability, the supported formats and point to /ipx/capabilities: %q", body)
+		}
+	}
+
+	if n := atomic.LoadInt32(&backendRequests); n != 1 {
+		t.Errorf("expected 415 to be cached (1 backend request), got %d", n)
+	}
+}
+
+// TestUnsupportedInputReturns501 verifies a missing loader maps to 501
+func TestUnsupportedInputReturns501(t *testing.T) {
+	// Minimal HEIF signature; never decoded because the loader is reported missing
+	heif := append([]byte{0, 0, 0, 24}, []byte("ftypheic\x00\x00\x00\x00mif1heic")...)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(heif)
+	}))
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	srv := httptest.NewServer(ipxpress.NewHandler(config))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.heic") + "&w=10&f=jpeg")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "heif") {
+		t.Errorf("body should name the missing heif loader: %q", body)
+	}
+}
+
+// TestUnsupportedCounted verifies Stats.Unsupported counts each 501 made, but not a cached one served again
+func TestUnsupportedCounted(t *testing.T) {
+	heif := append([]byte{0, 0, 0, 24}, []byte("ftypheic\x00\x00\x00\x00mif1heic")...)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(heif)
+	}))
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	for _, query := range []string{"w=10", "w=10", "w=20"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(imgServer.URL+"/a.heic")+"&"+query, nil))
+		if rec.Code != http.StatusNotImplemented {
+			t.Fatalf("%s: expected 501, got %d", query, rec.Code)
+		}
+	}
+	if got := handler.Stats().Unsupported; got != 2 {
+		t.Errorf("expected 2 unsupported responses counted, got %d", got)
+	}
+}
+
+// TestFormatsEndpoint verifies the capability listing
+func TestFormatsEndpoint(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	srv := httptest.NewServer(ipxpress.NewHandler(config))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/formats")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var formats map[string][]string
+	if err := json.NewDecoder(resp.Body).Decode(&formats); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if strings.Join(formats["save"], ",") != "jpeg,png" {
+		t.Errorf("unexpected save formats: %v", formats["save"])
+	}
+}
+
+// TestCapabilitiesEndpoint verifies /capabilities and ?capabilities=1 report a build without AVIF, mounted or not
+func TestCapabilitiesEndpoint(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = &ipxpress.Capabilities{
+		Load: map[string]bool{"jpeg": true, "png": true, "webp": true},
+		Save: map[string]bool{"jpeg": true, "png": true, "webp": true},
+	}
+	config.SignatureSecrets = []string{"secret"}
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	if handler.Capabilities().CanSave(ipxpress.FormatAVIF) || !handler.Capabilities().CanSave(ipxpress.FormatWebP) {
+		t.Errorf("expected the handler to use the configured capabilities, got %v", handler.Capabilities().SaveFormats())
+	}
+	mux := http.NewServeMux()
+	ipxpress.Mount(mux, "/ipx", handler)
+
+	// Public like /formats even when image requests must be signed
+	for _, target := range []string{"/ipx/capabilities", "/ipx/?capabilities=1", "/ipx/formats"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var formats map[string][]string
+		if err := json.NewDecoder(rec.Body).Decode(&formats); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected JSON, got %d: %v", target, rec.Code, err)
+		}
+		if got := strings.Join(formats["save"], ","); got != "jpeg,png,webp" {
+			t.Errorf("%s: unexpected save formats %q", target, got)
+		}
+		if got := strings.Join(formats["load"], ","); got != "jpeg,png,webp" {
+			t.Errorf("%s: unexpected load formats %q", target, got)
+		}
+	}
+}
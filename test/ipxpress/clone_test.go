@@ -0,0 +1,153 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"sync"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestCloneCloseOrder verifies clones and their base can be closed in any order
+func TestCloneCloseOrder(t *testing.T) {
+	src := createSolidPNG(120, 80, color.RGBA{R: 40, G: 120, B: 220, A: 255})
+
+	orders := [][]string{
+		{"small", "medium", "base"},
+		{"base", "small", "medium"},
+		{"medium", "base", "small"},
+	}
+	for _, order := range orders {
+		base := ipxpress.New().FromBytes(src)
+		procs := map[string]*ipxpress.Processor{
+			"base":   base,
+			"small":  base.Clone().Resize(30, 0),
+			"medium": base.Clone().Resize(60, 0),
+		}
+		widths := map[string]int{"base": 120, "small": 30, "medium": 60}
+
+		for i, name := range order {
+			procs[name].Close()
+			procs[name].Close() // closing twice is harmless
+			// Everything not closed yet still encodes at its own size
+			for _, other := range order[i+1:] {
+				out, err := procs[other].ToBytes(ipxpress.FormatPNG, 85)
+				if err != nil {
+					t.Fatalf("%v: %s failed after closing %s: %v", order, other, name, err)
+				}
+				cfg, err := png.DecodeConfig(bytes.NewReader(out))
+				if err != nil || cfg.Width != widths[other] {
+					t.Errorf("%v: expected %s %d wide after closing %s, got %d (%v)", order, other, widths[other], name, cfg.Width, err)
+				}
+			}
+		}
+	}
+}
+
+// TestCloneWithoutImage verifies cloning nothing or a closed processor fails instead of panicking
+func TestCloneWithoutImage(t *testing.T) {
+	if err := ipxpress.New().Clone().Err(); err == nil {
+		t.Error("expected cloning an empty processor to fail")
+	}
+	closed := ipxpress.New()
+	closed.Close()
+	clone := closed.Clone()
+	if clone.Err() == nil {
+		t.Error("expected cloning a closed processor to fail")
+	}
+	clone.Close()
+
+	if _, err := ipxpress.New().Resize(10, 0).Variants([]ipxpress.Size{{Width: 5}}); err == nil {
+		t.Error("expected Variants to return the pending error")
+	}
+}
+
+// TestVariants verifies each size is rendered from one decode in the original format
+func TestVariants(t *testing.T) {
+	base := ipxpress.New().FromBytes(createSolidPNG(200, 100, color.RGBA{G: 200, A: 255}))
+	defer base.Close()
+
+	sizes := []ipxpress.Size{{Width: 150}, {Height: 40}, {Width: 60, Height: 60}}
+	variants, err := base.Variants(sizes)
+	if err != nil {
+		t.Fatalf("Variants: %v", err)
+	}
+	if len(variants) != len(sizes) {
+		t.Fatalf("expected %d variants, got %d", len(sizes), len(variants))
+	}
+	want := []string{"150x75", "80x40", "60x30"}
+	for i, data := range variants {
+		cfg, err := png.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("variant %d is not a PNG: %v", i, err)
+		}
+		if got := fmt.Sprintf("%dx%d", cfg.Width, cfg.Height); got != want[i] {
+			t.Errorf("variant %d: expected %s, got %s", i, want[i], got)
+		}
+	}
+	if base.Width() != 200 || base.Height() != 100 {
+		t.Errorf("the base should be unchanged, got %dx%d", base.Width(), base.Height())
+	}
+}
+
+// TestCloneConcurrent verifies goroutines can clone one base at once and work on their clones
+func TestCloneConcurrent(t *testing.T) {
+	base := ipxpress.New().FromBytes(createTestImage(200, 100))
+	defer base.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(width int) {
+			defer wg.Done()
+			clone := base.Clone()
+			defer clone.Close()
+			out, err := clone.Resize(width, 0).Blur(1).ToBytes(ipxpress.FormatPNG, 85)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if cfg, err := png.DecodeConfig(bytes.NewReader(out)); err != nil || cfg.Width != width {
+				errs <- fmt.Errorf("expected %d wide, got %d (%v)", width, cfg.Width, err)
+			}
+		}(20 + i*10)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestNewSafeShared verifies a safe processor shared by goroutines serializes them
+func TestNewSafeShared(t *testing.T) {
+	proc := ipxpress.NewSafe().FromBytes(createTestImage(120, 80))
+	defer proc.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proc.Flip().Blur(0.5)
+			if _, err := proc.ToBytes(ipxpress.FormatJPEG, 80); err != nil {
+				t.Error(err)
+			}
+			if proc.Width() != 120 || proc.Err() != nil {
+				t.Errorf("unexpected state %dx%d, %v", proc.Width(), proc.Height(), proc.Err())
+			}
+		}()
+	}
+	wg.Wait()
+
+	clone := proc.Clone()
+	defer clone.Close()
+	go clone.Resize(60, 0)
+	if _, err := clone.ToBytes(ipxpress.FormatPNG, 85); err != nil {
+		t.Errorf("expected clones of a safe processor to be safe too, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package ipxpress_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestProcessorUseAfterClose verifies a closed processor fails with ErrClosed instead of calling libvips
+func TestProcessorUseAfterClose(t *testing.T) {
+	src := createTestImage(64, 48)
+	proc := ipxpress.New().FromBytes(src)
+	proc.Close()
+	proc.Close() // harmless
+
+	if _, err := proc.ToBytes(ipxpress.FormatJPEG, 80); !errors.Is(err, ipxpress.ErrClosed) {
+		t.Fatalf("expected ErrClosed from ToBytes, got %v", err)
+	}
+	if err := proc.Resize(10, 10).Err(); !errors.Is(err, ipxpress.ErrClosed) {
+		t.Errorf("expected ErrClosed from Resize, got %v", err)
+	}
+
+	reloaded := ipxpress.New().FromBytes(src)
+	reloaded.Close()
+	if err := reloaded.FromBytes(src).Err(); !errors.Is(err, ipxpress.ErrClosed) {
+		t.Errorf("expected a closed processor not to load again, got %v", err)
+	}
+	if clone := reloaded.Clone(); !errors.Is(clone.Err(), ipxpress.ErrClosed) {
+		t.Errorf("expected the clone of a closed processor to fail, got %v", clone.Err())
+	}
+}
+
+// TestProcessorErrorsStick verifies the first failure is the one reported
+func TestProcessorErrorsStick(t *testing.T) {
+	if _, err := ipxpress.New().ToBytes(ipxpress.FormatPNG, 80); !errors.Is(err, ipxpress.ErrNoImage) {
+		t.Errorf("expected ErrNoImage with nothing loaded, got %v", err)
+	}
+
+	proc := ipxpress.New().FromBytes([]byte("not an image"))
+	first := proc.Err()
+	if first == nil {
+		t.Fatal("expected garbage to fail decoding")
+	}
+	proc.Resize(10, 10).Blur(2)
+	proc.Close()
+	if _, err := proc.ToBytes(ipxpress.FormatPNG, 80); err != first {
+		t.Errorf("expected the decode error after close, got %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// decodePNG decodes PNG bytes or fails the test
+func decodePNG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return img
+}
+
+// TestPosterizePalette verifies only the expected channel levels appear
+func TestPosterizePalette(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createGradientPNG(128, 128)).Posterize(4)
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("posterize: %v", err)
+	}
+
+	allowed := map[uint32]bool{0: true, 85: true, 170: true, 255: true}
+	seen := map[uint32]bool{}
+	img := decodePNG(t, out)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			for _, v := range []uint32{r >> 8, g >> 8, bl >> 8} {
+				if !allowed[v] {
+					t.Fatalf("unexpected channel value %d at (%d,%d)", v, x, y)
+				}
+				seen[v] = true
+			}
+		}
+	}
+	if len(seen) != 4 {
+		t.Errorf("expected all 4 levels in a full gradient, saw %v", seen)
+	}
+}
+
+// TestDuotoneEndpoints verifies black maps to the dark color and white to the light one
+func TestDuotoneEndpoints(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 20; x++ {
+			c := color.RGBA{A: 255}
+			if x >= 10 {
+				c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+
+	proc := ipxpress.New().FromBytes(buf.Bytes()).Duotone("1a2b3c", "ffcc00")
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("duotone: %v", err)
+	}
+
+	img := decodePNG(t, out)
+	assertNear(t, img.At(2, 5), color.RGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 255})
+	assertNear(t, img.At(15, 5), color.RGBA{R: 0xff, G: 0xcc, B: 0x00, A: 255})
+}
+
+// assertNear fails if any channel differs from want by more than 2
+func assertNear(t *testing.T, got color.Color, want color.RGBA) {
+	t.Helper()
+	r, g, b, _ := got.RGBA()
+	diff := func(a uint32, b uint8) int {
+		d := int(a>>8) - int(b)
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	if diff(r, want.R) > 2 || diff(g, want.G) > 2 || diff(b, want.B) > 2 {
+		t.Errorf("got %v, want about %v", got, want)
+	}
+}
+
+// TestColorEffectsHTTP verifies duotone and posterize are wired to query parameters
+func TestColorEffectsHTTP(t *testing.T) {
+	src := createGradientPNG(64, 64)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?posterize=2&url=" + url.QueryEscape(imgServer.URL+"/g.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	r, g, b, _ := decodePNG(t, body).At(40, 40).RGBA()
+	for _, v := range []uint32{r >> 8, g >> 8, b >> 8} {
+		if v != 0 && v != 255 {
+			t.Errorf("expected 2-level output, got channel %d", v)
+		}
+	}
+}
+
+// TestColorEffectParams verifies parsing and cache key separation
+func TestColorEffectParams(t *testing.T) {
+	a := parseQuery(t, "/?url=http://x/a.png&duotone=1a2b3c_ffcc00")
+	b := parseQuery(t, "/?url=http://x/a.png&duotone=000000_ffffff")
+	c := parseQuery(t, "/?url=http://x/a.png&posterize=4")
+
+	if a.Duotone != "1a2b3c_ffcc00" || c.Posterize != 4 {
+		t.Errorf("unexpected parse: %q %d", a.Duotone, c.Posterize)
+	}
+	if !a.HasTransformations() || !c.HasTransformations() {
+		t.Error("duotone and posterize should count as transformations")
+	}
+	if ipxpress.GenerateCacheKey(a) == ipxpress.GenerateCacheKey(b) {
+		t.Error("duotone colors must be part of the cache key")
+	}
+}
@@ -0,0 +1,182 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// cmykQuadrants are the 8x8 quadrants of createCMYKJPEG in reading order, with the
+// sRGB values a SWOP-like CMYK profile gives them
+var cmykQuadrants = []struct {
+	name string
+	cmyk [4]uint8
+	rgb  [3]int
+}{
+	{"white", [4]uint8{0, 0, 0, 0}, [3]int{255, 255, 255}},
+	{"cyan", [4]uint8{255, 0, 0, 0}, [3]int{0, 174, 239}},
+	{"magenta", [4]uint8{0, 255, 0, 0}, [3]int{236, 0, 140}},
+	{"black", [4]uint8{0, 0, 0, 255}, [3]int{35, 31, 32}},
+}
+
+// bitWriter writes JPEG entropy-coded data with 0xFF byte stuffing
+type bitWriter struct {
+	buf   bytes.Buffer
+	acc   uint32
+	nbits uint
+}
+
+func (w *bitWriter) write(code uint32, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.acc = w.acc<<1 | (code>>uint(i))&1
+		w.nbits++
+		if w.nbits == 8 {
+			w.buf.WriteByte(byte(w.acc))
+			if byte(w.acc) == 0xFF {
+				w.buf.WriteByte(0)
+			}
+			w.acc, w.nbits = 0, 0
+		}
+	}
+}
+
+func (w *bitWriter) flush() {
+	for w.nbits != 0 {
+		w.write(1, 1)
+	}
+}
+
+// createCMYKJPEG returns a 16x16 Adobe-style (inverted) CMYK baseline JPEG made of
+// four solid quadrants. The standard library can only write RGB JPEGs, and solid
+// 8x8 blocks only need DC coefficients, so it's encoded by hand.
+func createCMYKJPEG() []byte {
+	// Standard luminance DC table (JPEG Annex K.3), and an AC table holding only EOB
+	dcBits := []byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}
+	dcVals := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	acBits := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	acVals := []byte{0x00}
+
+	// Canonical codes of the DC table by category
+	type code struct {
+		bits uint32
+		n    uint
+	}
+	dcCodes := map[byte]code{}
+	c, k := uint32(0), 0
+	for length, count := range dcBits {
+		for range count {
+			dcCodes[dcVals[k]] = code{c, uint(length + 1)}
+			c++
+			k++
+		}
+		c <<= 1
+	}
+
+	segment := func(out *bytes.Buffer, marker byte, payload []byte) {
+		out.Write([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+		out.Write(payload)
+	}
+
+	var out bytes.Buffer
+	out.Write([]byte{0xFF, 0xD8})
+	segment(&out, 0xEE, []byte("Adobe\x00\x64\x00\x00\x00\x00\x00")) // APP14, transform 0: inverted CMYK
+	segment(&out, 0xDB, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...))
+	segment(&out, 0xC0, []byte{8, 0, 16, 0, 16, 4, 1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0, 4, 0x11, 0})
+	segment(&out, 0xC4, append(append([]byte{0x00}, dcBits...), dcVals...))
+	segment(&out, 0xC4, append(append([]byte{0x10}, acBits...), acVals...))
+	segment(&out, 0xDA, []byte{4, 1, 0x00, 2, 0x00, 3, 0x00, 4, 0x00, 0, 63, 0})
+
+	var w bitWriter
+	var pred [4]int
+	for _, q := range cmykQuadrants { // one MCU per quadrant, in reading order
+		for comp := range 4 {
+			// With quantization 1 the DC coefficient of a solid block is 8*(value-128)
+			dc := 8 * (int(255-q.cmyk[comp]) - 128)
+			diff := dc - pred[comp]
+			pred[comp] = dc
+
+			category, bits := 0, diff
+			for v := max(diff, -diff); v > 0; v >>= 1 {
+				category++
+			}
+			if diff < 0 {
+				bits = diff + (1 << category) - 1
+			}
+			w.write(dcCodes[byte(category)].bits, dcCodes[byte(category)].n)
+			w.write(uint32(bits), uint(category))
+			w.write(0, 1) // EOB
+		}
+	}
+	w.flush()
+	out.Write(w.buf.Bytes())
+	out.Write([]byte{0xFF, 0xD9})
+	return out.Bytes()
+}
+
+// TestCMYKFixture verifies the hand-written fixture decodes to the intended inks
+func TestCMYKFixture(t *testing.T) {
+	img, err := jpeg.Decode(bytes.NewReader(createCMYKJPEG()))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	cmyk, ok := img.(*image.CMYK)
+	if !ok {
+		t.Fatalf("expected a CMYK image, got %T", img)
+	}
+	for i, q := range cmykQuadrants {
+		got := cmyk.CMYKAt(4+8*(i%2), 4+8*(i/2))
+		want := q.cmyk
+		for c, v := range [4]uint8{got.C, got.M, got.Y, got.K} {
+			if d := int(v) - int(want[c]); d < -2 || d > 2 {
+				t.Errorf("%s: expected %v, got %v", q.name, want, got)
+				break
+			}
+		}
+	}
+}
+
+// TestCMYKConvertedToSRGB verifies CMYK sources are converted through a profile
+// rather than having their channels reinterpreted
+func TestCMYKConvertedToSRGB(t *testing.T) {
+	out := encodeGet(t, createCMYKJPEG(), "f=png&w=16")
+
+	img, _, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	const tolerance = 45
+	for i, q := range cmykQuadrants {
+		r, g, b, _ := img.At(4+8*(i%2), 4+8*(i/2)).RGBA()
+		got := [3]int{int(r >> 8), int(g >> 8), int(b >> 8)}
+		for c := range 3 {
+			if d := got[c] - q.rgb[c]; d < -tolerance || d > tolerance {
+				t.Errorf("%s: expected about %v, got %v", q.name, q.rgb, got)
+				break
+			}
+		}
+	}
+}
+
+// TestColorManagementEscapeHatch verifies the conversion can be turned off
+func TestColorManagementEscapeHatch(t *testing.T) {
+	src := createCMYKJPEG()
+	config := ipxpress.DefaultConfig()
+	config.DisableColorManagement = true
+	// Without conversion libvips keeps the CMYK bands, so a JPEG stays CMYK
+	out := encodeGetWith(t, config, src, "f=jpeg&w=16")
+	if img, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("decode: %v", err)
+	} else if _, ok := img.(*image.CMYK); !ok {
+		t.Errorf("expected CMYK output without color management, got %T", img)
+	}
+
+	out = encodeGet(t, src, "f=jpeg&w=16")
+	if img, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("decode: %v", err)
+	} else if _, ok := img.(*image.CMYK); ok {
+		t.Error("expected sRGB output with color management")
+	}
+}
@@ -0,0 +1,125 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestParseColor covers every accepted syntax and the usual mistakes
+func TestParseColor(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ipxpress.RGBA
+		ok   bool
+	}{
+		{"ff0000", ipxpress.RGBA{R: 255, A: 255}, true},
+		{"#00FF00", ipxpress.RGBA{G: 255, A: 255}, true},
+		{"fff", ipxpress.RGBA{R: 255, G: 255, B: 255, A: 255}, true},
+		{"#a1b", ipxpress.RGBA{R: 0xaa, G: 0x11, B: 0xbb, A: 255}, true},
+		{"ff000080", ipxpress.RGBA{R: 255, A: 0x80}, true},
+		{"#12345600", ipxpress.RGBA{R: 0x12, G: 0x34, B: 0x56}, true},
+		{"transparent", ipxpress.RGBA{}, true},
+		{"Transparent", ipxpress.RGBA{}, true},
+		{"navy", ipxpress.RGBA{B: 128, A: 255}, true},
+		{"ORANGE", ipxpress.RGBA{R: 255, G: 165, A: 255}, true},
+		{"grey", ipxpress.RGBA{R: 128, G: 128, B: 128, A: 255}, true},
+		{"", ipxpress.RGBA{}, false},
+		{"#", ipxpress.RGBA{}, false},
+		{"brand-blue", ipxpress.RGBA{}, false},
+		{"ff00", ipxpress.RGBA{}, false},
+		{"ff00000", ipxpress.RGBA{}, false},
+		{"gg0000", ipxpress.RGBA{}, false},
+		{"+ff000", ipxpress.RGBA{}, false},
+		{"##ff0000", ipxpress.RGBA{}, false},
+		{"ff0000ff00", ipxpress.RGBA{}, false},
+		{"rgb(1,2,3)", ipxpress.RGBA{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ipxpress.ParseColor(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: expected ok=%t, got error %v", tt.in, tt.ok, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: expected %+v, got %+v", tt.in, tt.want, got)
+		}
+	}
+
+	_, err := ipxpress.ParseColor(strings.Repeat("z", 1000))
+	if err == nil || len(err.Error()) > 200 {
+		t.Errorf("expected a short error, got %d bytes", len(err.Error()))
+	}
+}
+
+// TestColorParams verifies invalid color parameters are reported, not passed on
+func TestColorParams(t *testing.T) {
+	for _, query := range []string{"b=brand-blue", "background=12345", "tint=nope", "duotone=000000_brand", "border=4_brand"} {
+		params := parseQuery(t, "/?url=http://x/a.png&"+query)
+		if len(params.Errors) != 1 {
+			t.Errorf("%s: expected one error, got %v", query, params.Errors)
+			continue
+		}
+		if params.Background != "" || params.Tint != "" || params.BorderColor != "" {
+			t.Errorf("%s: expected the value dropped", query)
+		}
+	}
+	for _, query := range []string{"b=navy", "b=%23ff000080", "tint=fff", "duotone=black_ffffff"} {
+		if params := parseQuery(t, "/?url=http://x/a.png&"+query); len(params.Errors) != 0 {
+			t.Errorf("%s: unexpected errors %v", query, params.Errors)
+		}
+	}
+}
+
+// TestInvalidBackground verifies an invalid background is a 400 under
+// StrictParams, and otherwise logged and reported while padding stays white
+func TestInvalidBackground(t *testing.T) {
+	src := createSolidPNG(20, 10, color.RGBA{R: 255, A: 255})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	target := "/?padding=5&b=brand-blue&f=png&url=" + url.QueryEscape(origin.URL+"/a.png")
+
+	strict := ipxpress.DefaultConfig()
+	strict.StrictParams = true
+	handler := ipxpress.NewHandler(strict)
+	defer handler.Close()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "background") {
+		t.Errorf("expected 400 naming background, got %d: %s", rec.Code, rec.Body)
+	}
+
+	var logs bytes.Buffer
+	lenient := ipxpress.NewHandler(ipxpress.DefaultConfig(), ipxpress.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	defer lenient.Close()
+	rec = httptest.NewRecorder()
+	lenient.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Header().Get("X-IPX-Warning"), "background") {
+		t.Errorf("expected an X-IPX-Warning naming background, got %q", rec.Header().Get("X-IPX-Warning"))
+	}
+	if !strings.Contains(logs.String(), "invalid parameters ignored") || !strings.Contains(logs.String(), "brand-blue") {
+		t.Errorf("expected the invalid color logged, got %q", logs.String())
+	}
+	assertNear(t, decodePNG(t, rec.Body.Bytes()).At(0, 0), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+}
+
+// TestDuotoneInvalidColor verifies the processor reports invalid colors
+func TestDuotoneInvalidColor(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createSolidPNG(4, 4, color.RGBA{R: 255, A: 255})).Duotone("brand", "ffffff")
+	defer proc.Close()
+	if err := proc.Err(); err == nil || !strings.Contains(err.Error(), "brand") {
+		t.Errorf("expected an error naming the color, got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// trickleOrigin serves size-byte PNG bodies with a Content-Length, pausing halfway
+// so that several bodies are being read at once
+func trickleOrigin(t *testing.T, size int) *httptest.Server {
+	t.Helper()
+	body := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1}, size-8)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		w.Write(body[:size/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write(body[size/2:])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// heapPeak runs load while sampling the heap, returning the largest growth over
+// the heap before it started
+func heapPeak(load func()) uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	base := stats.HeapAlloc
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var s runtime.MemStats
+		for {
+			runtime.ReadMemStats(&s)
+			if s.HeapAlloc > base && s.HeapAlloc-base > peak.Load() {
+				peak.Store(s.HeapAlloc - base)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+		}
+	}()
+	load()
+	close(done)
+	<-sampled
+	return peak.Load()
+}
+
+// TestMaxConcurrentBytes verifies a burst of fetches never buffers more than
+// MaxConcurrentBytes of source bodies, and the heap grows accordingly
+func TestMaxConcurrentBytes(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	const size, requests = 1 << 20, 16
+	origin := trickleOrigin(t, size)
+
+	burst := func(limit int64) (ipxpress.FetcherStats, uint64) {
+		config := ipxpress.DefaultConfig()
+		config.Capabilities = limitedCapabilities()
+		config.FetchLimit = requests
+		config.CacheMaxEntryBytes = 1 // nothing cached, so only request buffers count
+		config.MaxConcurrentBytes = limit
+		handler := ipxpress.NewHandler(config)
+		defer handler.Close()
+
+		var failed atomic.Int32
+		peak := heapPeak(func() {
+			var wg sync.WaitGroup
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					target := "/?url=" + url.QueryEscape(fmt.Sprintf("%s/photo-%d.png", origin.URL, i))
+					handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+					if rec.Code != http.StatusOK || rec.Body.Len() != size {
+						failed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+		if n := failed.Load(); n != 0 {
+			t.Errorf("limit %d: expected every request served, %d failed", limit, n)
+		}
+		return handler.FetcherStats(), peak
+	}
+
+	const limit = 3 * size
+	stats, bounded := burst(limit)
+	if stats.BufferPeak > limit || stats.BufferPeak < size || stats.Buffered != 0 || stats.BufferLimit != limit {
+		t.Errorf("expected at most %d bytes buffered at once, got %+v", limit, stats)
+	}
+	_, unbounded := burst(0)
+	t.Logf("heap peak over %d requests of %d bytes: %d bytes bounded, %d unbounded", requests, size, bounded, unbounded)
+	// Reading a body and recording the response copy it, so allow for a second set
+	if !raceEnabled && bounded > 2*limit {
+		t.Errorf("expected the heap to grow by at most %d bytes, grew %d", 2*limit, bounded)
+	}
+}
+
+// TestMaxConcurrentBytesTooLarge verifies a body over the whole budget fails at once with 503
+func TestMaxConcurrentBytesTooLarge(t *testing.T) {
+	origin := trickleOrigin(t, 64<<10)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.MaxConcurrentBytes = 32 << 10
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/big.png"), nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", rec.Code)
+	}
+	if stats := handler.FetcherStats(); stats.BufferRejected != 1 || stats.Buffered != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	config, err := ipxpress.LoadConfig(writeConfig(t, `{"max_concurrent_bytes": 1048576}`))
+	if err != nil || config.MaxConcurrentBytes != 1<<20 {
+		t.Errorf("expected max_concurrent_bytes from the file, got %d, %v", config.MaxConcurrentBytes, err)
+	}
+}
+
+// TestKeepOriginal verifies the processor only holds on to the source when asked
+func TestKeepOriginal(t *testing.T) {
+	src := createTestImage(64, 48)
+	proc := ipxpress.New().FromBytes(src)
+	defer proc.Close()
+	if proc.OriginalBytes() != nil || proc.OriginalSize() != len(src) {
+		t.Errorf("expected no source kept by default, got %d bytes", len(proc.OriginalBytes()))
+	}
+
+	kept := ipxpress.New().KeepOriginal().FromBytes(src)
+	defer kept.Close()
+	if !bytes.Equal(kept.OriginalBytes(), src) {
+		t.Error("expected KeepOriginal to keep the source bytes")
+	}
+	clone := kept.Clone()
+	defer clone.Close()
+	if !bytes.Equal(clone.OriginalBytes(), src) {
+		t.Error("expected clones to share the kept source")
+	}
+}
@@ -0,0 +1,119 @@
+package ipxpress_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestValidateDefaultConfig verifies the defaults pass untouched
+func TestValidateDefaultConfig(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.OnWarning = func(msg string) { t.Errorf("unexpected warning: %s", msg) }
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+}
+
+// TestValidateFillsZeroValues verifies a literal Config gets working defaults with warnings
+func TestValidateFillsZeroValues(t *testing.T) {
+	var warnings []string
+	config := &ipxpress.Config{OnWarning: func(msg string) { warnings = append(warnings, msg) }}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected a zero Config to be valid, got %v", err)
+	}
+
+	defaults := ipxpress.DefaultConfig()
+	if config.ProcessingLimit != defaults.ProcessingLimit || config.CacheTTL != defaults.CacheTTL || config.CacheMaxCost != defaults.CacheMaxCost {
+		t.Errorf("expected defaults filled in, got limit %d, ttl %s, cost %d", config.ProcessingLimit, config.CacheTTL, config.CacheMaxCost)
+	}
+	for _, field := range []string{"ProcessingLimit", "CacheTTL", "CacheMaxCost"} {
+		found := false
+		for _, w := range warnings {
+			found = found || strings.Contains(w, field)
+		}
+		if !found {
+			t.Errorf("expected a warning about %s, got %q", field, warnings)
+		}
+	}
+
+	config = &ipxpress.Config{ProcessingLimit: -4, CacheTTL: time.Minute, CacheMaxCost: 1 << 20, OnWarning: func(string) {}}
+	if err := config.Validate(); err != nil || config.ProcessingLimit != defaults.ProcessingLimit {
+		t.Errorf("expected a negative ProcessingLimit replaced, got %d (%v)", config.ProcessingLimit, err)
+	}
+	if config.CacheTTL != time.Minute || config.CacheMaxCost != 1<<20 {
+		t.Error("expected set values kept")
+	}
+
+	// Safety features are on unless a literal turns them off
+	if defaults.DisableAutoOrient || defaults.DisableColorManagement {
+		t.Error("expected DefaultConfig to orient and manage color, as a Config literal does")
+	}
+}
+
+// TestValidateRejectsInvalid verifies each impossible value is named in the error
+func TestValidateRejectsInvalid(t *testing.T) {
+	tests := []struct {
+		field  string
+		mutate func(c *ipxpress.Config)
+		value  string
+	}{
+		{"CacheTTL", func(c *ipxpress.Config) { c.CacheTTL = -time.Minute }, "-1m0s"},
+		{"CleanupInterval", func(c *ipxpress.Config) { c.CleanupInterval = -time.Second }, "-1s"},
+		{"UnsupportedCacheTTL", func(c *ipxpress.Config) { c.UnsupportedCacheTTL = -time.Hour }, "-1h0m0s"},
+		{"ErrorCacheTTL", func(c *ipxpress.Config) { c.ErrorCacheTTL = -time.Second }, "-1s"},
+		{"MemoryQueueTimeout", func(c *ipxpress.Config) { c.MemoryQueueTimeout = -time.Second }, "-1s"},
+		{"CacheMaxCost", func(c *ipxpress.Config) { c.CacheMaxCost = -1 }, "-1"},
+		{"ClientMaxAge", func(c *ipxpress.Config) { c.ClientMaxAge = -60 }, "-60"},
+		{"SMaxAge", func(c *ipxpress.Config) { c.SMaxAge = -60 }, "-60"},
+		{"StreamThreshold", func(c *ipxpress.Config) { c.StreamThreshold = -1 }, "-1"},
+		{"MaxDimension", func(c *ipxpress.Config) { c.MaxDimension = -1 }, "-1"},
+		{"MaxInputPixels", func(c *ipxpress.Config) { c.MaxInputPixels = -1 }, "-1"},
+		{"MaxUploadSize", func(c *ipxpress.Config) { c.MaxUploadSize = -1 }, "-1"},
+		{"MemoryBudget", func(c *ipxpress.Config) { c.MemoryBudget = -1 }, "-1"},
+		{"LargeEntryThreshold", func(c *ipxpress.Config) { c.LargeEntryThreshold = -1 }, "-1"},
+		{"VipsConfig.MaxCacheMem", func(c *ipxpress.Config) { c.VipsConfig = &ipxpress.VipsConfig{MaxCacheMem: -1} }, "-1"},
+		{"KeepMetadata", func(c *ipxpress.Config) { c.KeepMetadata = "gps" }, `"gps"`},
+		{"DefaultImageMode", func(c *ipxpress.Config) { c.DefaultImageMode = "proxy" }, `"proxy"`},
+		{"DefaultImage", func(c *ipxpress.Config) { c.DefaultImageMode = ipxpress.DefaultImageServe }, "serve"},
+		{"PathProfiles", func(c *ipxpress.Config) { c.PathProfiles = []ipxpress.PathProfile{{Name: "avatars", Regexp: "("}} }, "avatars"},
+		{"TTLSchedule", func(c *ipxpress.Config) {
+			c.TTLSchedule = &ipxpress.TTLSchedule{Rules: []ipxpress.TTLRule{{Name: "night", From: "20:00", To: "20:00", TTL: time.Hour}}}
+		}, "night"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			config := ipxpress.DefaultConfig()
+			tt.mutate(config)
+			err := config.Validate()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tt.field) || !strings.Contains(err.Error(), tt.value) {
+				t.Errorf("expected %s and %s in %q", tt.field, tt.value, err)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	config := ipxpress.DefaultConfig()
+	config.ClientMaxAge, config.SMaxAge = -1, -1
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "ClientMaxAge") || !strings.Contains(err.Error(), "SMaxAge") {
+		t.Errorf("expected both fields reported, got %v", err)
+	}
+}
+
+// TestNewHandlerRejectsInvalidConfig verifies NewHandler fails fast instead of starting broken
+func TestNewHandlerRejectsInvalidConfig(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.CacheTTL = -time.Minute
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "CacheTTL") {
+			t.Errorf("expected a panic naming CacheTTL, got %v", r)
+		}
+	}()
+	ipxpress.NewHandler(config)
+}
@@ -0,0 +1,267 @@
+package ipxpress_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+const sampleConfig = `{
+  "cache_ttl": "1h",
+  "cache_max_cost": 1073741824,
+  "processing_limit": 64,
+  "cheap_cost_threshold": 0.5,
+  "cheap_reserved_slots": 16,
+  "client_max_age": 3600,
+  "s_maxage": 86400,
+  "enable_etag": false,
+  "stream_threshold": 8388608,
+  "unsupported_cache_ttl": "12h",
+  "error_cache_ttl": "5s",
+  "debug_headers": true,
+  "strict_params": true,
+  "max_dimension": 8000,
+  "max_input_pixels": 40000000,
+  "max_upload_size": 10485760,
+  "color_management": false,
+  "keep_metadata": "icc",
+  "dedup_originals": false,
+  "memory_budget": 2147483648,
+  "memory_queue_timeout": "2s",
+  "allow_svg": true,
+  "allowed_hosts": ["images.example.com", "*.cdn.example.com"],
+  "default_image": "/srv/placeholder.png",
+  "default_image_mode": "serve",
+  "presets_only": true,
+  "allowed_operations": ["w", "h", "f"],
+  "signature_secrets": ["new-secret", "old-secret"],
+  "large_entry_threshold": 1048576,
+  "large_entry_dir": "/var/cache/ipxpress",
+  "vips": {"max_cache_mem": 50, "max_cache_size": 100, "max_cache_files": 10, "log_level": "error"},
+  "fetcher": {
+    "timeout": "15s",
+    "connect_timeout": "2s",
+    "tls_handshake_timeout": "3s",
+    "response_header_timeout": "5s",
+    "max_conns_per_host": 32,
+    "max_idle_conns": 64,
+    "max_idle_conns_per_host": 8,
+    "user_agent": "ipxpress/1.0",
+    "max_attempts": 4,
+    "retry_base_delay": "100ms",
+    "retry_max_delay": "2s",
+    "retry_statuses": [503],
+    "max_concurrent_per_host": 8,
+    "rate_limit_per_host": 50,
+    "host_queue_timeout": "5s"
+  },
+  "presets": {"thumbnail": "w=200&h=200&fit=cover&f=webp&q=70"},
+  "path_profiles": [
+    {"name": "avatars", "match": "/avatars/*", "params": "w=256&h=256&f=webp", "mode": "force"}
+  ]
+}`
+
+// writeConfig writes data to a JSON file and returns its path
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ipxpress.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadConfigSample verifies every setting of a full file is applied
+func TestLoadConfigSample(t *testing.T) {
+	config, err := ipxpress.LoadConfig(writeConfig(t, sampleConfig))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"cache_ttl", config.CacheTTL, time.Hour},
+		{"cache_max_cost", config.CacheMaxCost, 1 << 30},
+		{"processing_limit", config.ProcessingLimit, 64},
+		{"cheap_cost_threshold", config.CheapCostThreshold, 0.5},
+		{"cheap_reserved_slots", config.CheapReservedSlots, 16},
+		{"client_max_age", config.ClientMaxAge, 3600},
+		{"s_maxage", config.SMaxAge, 86400},
+		{"enable_etag", config.EnableETag, false},
+		{"stream_threshold", config.StreamThreshold, int64(8 << 20)},
+		{"unsupported_cache_ttl", config.UnsupportedCacheTTL, 12 * time.Hour},
+		{"error_cache_ttl", config.ErrorCacheTTL, 5 * time.Second},
+		{"debug_headers", config.DebugHeaders, true},
+		{"strict_params", config.StrictParams, true},
+		{"max_dimension", config.MaxDimension, 8000},
+		{"max_input_pixels", config.MaxInputPixels, 40_000_000},
+		{"max_upload_size", config.MaxUploadSize, int64(10 << 20)},
+		{"color_management", !config.DisableColorManagement, false},
+		{"keep_metadata", config.KeepMetadata, ipxpress.KeepICC},
+		{"dedup_originals", config.DedupOriginals, false},
+		{"memory_budget", config.MemoryBudget, int64(2 << 30)},
+		{"memory_queue_timeout", config.MemoryQueueTimeout, 2 * time.Second},
+		{"allow_svg", config.AllowSVG, true},
+		{"allowed_hosts", config.AllowedHosts, []string{"images.example.com", "*.cdn.example.com"}},
+		{"default_image", config.DefaultImage, "/srv/placeholder.png"},
+		{"default_image_mode", config.DefaultImageMode, ipxpress.DefaultImageServe},
+		{"presets_only", config.PresetsOnly, true},
+		{"allowed_operations", config.AllowedOperations, []string{"w", "h", "f"}},
+		{"signature_secrets", config.SignatureSecrets, []string{"new-secret", "old-secret"}},
+		{"large_entry_threshold", config.LargeEntryThreshold, 1 << 20},
+		{"large_entry_dir", config.LargeEntryDir, "/var/cache/ipxpress"},
+		{"vips", *config.VipsConfig, ipxpress.VipsConfig{MaxCacheMem: 50, MaxCacheSize: 100, MaxCacheFiles: 10, LogLevel: vips.LogLevelError}},
+		{"fetcher", *config.Fetcher, ipxpress.FetcherConfig{
+			Timeout: 15 * time.Second, ConnectTimeout: 2 * time.Second, TLSHandshakeTimeout: 3 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second, MaxConnsPerHost: 32, MaxIdleConns: 64, MaxIdleConnsPerHost: 8,
+			UserAgent: "ipxpress/1.0", MaxAttempts: 4, RetryBaseDelay: 100 * time.Millisecond, RetryMaxDelay: 2 * time.Second,
+			RetryStatuses: []int{503}, MaxConcurrentPerHost: 8, RateLimitPerHost: 50, HostQueueTimeout: 5 * time.Second,
+		}},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+
+	thumb, ok := config.Presets["thumbnail"]
+	if !ok || thumb.Width != 200 || thumb.Height != 200 || thumb.Fit != "cover" || thumb.Format != ipxpress.FormatWebP || thumb.Quality != 70 {
+		t.Errorf("presets: got %+v", config.Presets)
+	}
+	if len(config.PathProfiles) != 1 {
+		t.Fatalf("path_profiles: got %+v", config.PathProfiles)
+	}
+	profile := config.PathProfiles[0]
+	if profile.Name != "avatars" || profile.Match != "/avatars/*" || profile.Mode != ipxpress.ProfileForce ||
+		profile.Params.Width != 256 || profile.Params.Height != 256 || profile.Params.Format != ipxpress.FormatWebP {
+		t.Errorf("path_profiles: got %+v", profile)
+	}
+	if profile.Params.Quality != 0 {
+		t.Errorf("path_profiles: expected no quality in the template, got %d", profile.Params.Quality)
+	}
+}
+
+// TestLoadConfigKeepsDefaults verifies settings not in the file keep their defaults
+func TestLoadConfigKeepsDefaults(t *testing.T) {
+	config, err := ipxpress.LoadConfig(writeConfig(t, `{"processing_limit": 8}`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	want := ipxpress.DefaultConfig()
+	want.ProcessingLimit = 8
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("got %+v, want %+v", config, want)
+	}
+}
+
+// TestApplyEnvOverridesFile verifies IPX_ variables take precedence over the file
+func TestApplyEnvOverridesFile(t *testing.T) {
+	t.Setenv("IPX_CACHE_TTL", "5m")
+	t.Setenv("IPX_ALLOWED_HOSTS", "a.example.com, b.example.com")
+	t.Setenv("IPX_STRICT_PARAMS", "false")
+	t.Setenv("IPX_FETCHER_TIMEOUT", "30s")
+	t.Setenv("IPX_FETCHER_RETRY_STATUSES", "502, 503")
+	t.Setenv("IPX_VIPS_LOG_LEVEL", "debug")
+
+	config, err := ipxpress.LoadConfig(writeConfig(t, sampleConfig))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if err := ipxpress.ApplyEnv(config); err != nil {
+		t.Fatalf("ApplyEnv: %v", err)
+	}
+
+	if config.CacheTTL != 5*time.Minute {
+		t.Errorf("cache_ttl: expected the environment's 5m, got %s", config.CacheTTL)
+	}
+	if !reflect.DeepEqual(config.AllowedHosts, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("allowed_hosts: got %v", config.AllowedHosts)
+	}
+	if config.StrictParams {
+		t.Error("strict_params: expected the environment's false")
+	}
+	if config.Fetcher.Timeout != 30*time.Second || config.Fetcher.UserAgent != "ipxpress/1.0" || !reflect.DeepEqual(config.Fetcher.RetryStatuses, []int{502, 503}) {
+		t.Errorf("fetcher: expected the timeout overridden and the rest of the file kept, got %+v", config.Fetcher)
+	}
+	if config.VipsConfig.LogLevel != vips.LogLevelDebug || config.VipsConfig.MaxCacheMem != 50 {
+		t.Errorf("vips: got %+v", config.VipsConfig)
+	}
+	if config.ProcessingLimit != 64 {
+		t.Errorf("processing_limit: expected the file's 64, got %d", config.ProcessingLimit)
+	}
+
+	fromEnv, err := ipxpress.LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv: %v", err)
+	}
+	if fromEnv.CacheTTL != 5*time.Minute || fromEnv.ProcessingLimit != ipxpress.DefaultConfig().ProcessingLimit {
+		t.Errorf("LoadConfigFromEnv: got cache_ttl %s, processing_limit %d", fromEnv.CacheTTL, fromEnv.ProcessingLimit)
+	}
+}
+
+// TestConfigValidationNamesField verifies errors name the setting and the value
+func TestConfigValidationNamesField(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want []string
+	}{
+		{"unknown key", `{"cache_tll": "1h"}`, []string{"cache_tll", "unknown setting"}},
+		{"bad duration", `{"cache_ttl": "soon"}`, []string{"cache_ttl", `"soon"`}},
+		{"wrong type", `{"processing_limit": "many"}`, []string{"processing_limit", `"many"`}},
+		{"out of range", `{"processing_limit": 0}`, []string{"processing_limit", "got 0"}},
+		{"negative", `{"max_upload_size": -1}`, []string{"max_upload_size", "-1"}},
+		{"enum", `{"default_image_mode": "proxy"}`, []string{"default_image_mode", `"proxy"`}},
+		{"nested", `{"fetcher": {"timeout": "-1s"}}`, []string{"fetcher.timeout", "-1s"}},
+		{"nested unknown", `{"vips": {"cache": 1}}`, []string{"vips.cache", "unknown setting"}},
+		{"log level", `{"vips": {"log_level": "loud"}}`, []string{"vips.log_level", `"loud"`}},
+		{"operation", `{"allowed_operations": ["w", "swirl"]}`, []string{"allowed_operations", `"swirl"`}},
+		{"preset param", `{"presets": {"x": "w=abc"}}`, []string{"presets.x", "abc"}},
+		{"preset unknown", `{"presets": {"x": "swirl=2"}}`, []string{"presets.x", `"swirl"`}},
+		{"profile mode", `{"path_profiles": [{"match": "/a/*", "params": "w=1", "mode": "strict"}]}`, []string{"path_profiles[0].mode", `"strict"`}},
+		{"profile pattern", `{"path_profiles": [{"params": "w=1"}]}`, []string{"path_profiles", "match or regexp"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ipxpress.LoadConfig(writeConfig(t, tt.file))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected %q in %q", want, err)
+				}
+			}
+		})
+	}
+
+	t.Setenv("IPX_PROCESSING_LIMIT", "lots")
+	if _, err := ipxpress.LoadConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "IPX_PROCESSING_LIMIT") || !strings.Contains(err.Error(), `"lots"`) {
+		t.Errorf("expected the variable and value named, got %v", err)
+	}
+	t.Setenv("IPX_PROCESSING_LIMIT", "-3")
+	if _, err := ipxpress.LoadConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "IPX_PROCESSING_LIMIT") {
+		t.Errorf("expected the variable named in a validation error, got %v", err)
+	}
+}
+
+// TestLoadConfigFormats verifies YAML and unknown extensions are refused clearly
+func TestLoadConfigFormats(t *testing.T) {
+	for _, name := range []string{"ipxpress.yaml", "ipxpress.toml"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte("cache_ttl: 1h\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ipxpress.LoadConfig(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package ipxpress_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// conflictingQueries maps contradictory queries to the parameter dropped and the
+// query they're resolved to
+var conflictingQueries = []struct {
+	query    string
+	param    string
+	resolved string
+}{
+	{"w=100&fit=fill", "fit", "w=100"},
+	{"h=100&fit=cover", "fit", "h=100"},
+	{"w=100&pad=1", "pad", "w=100"},
+	{"extract=0_0_50_50&trim=10", "trim", "extract=0_0_50_50"},
+	{"flatten=1&b=transparent", "background", "flatten=1"},
+	{"f=jpeg&b=transparent&w=100", "background", "f=jpeg&w=100"},
+	{"duotone=000000_ffffff&tint=ff0000", "tint", "duotone=000000_ffffff"},
+	{"duotone=000000_ffffff&grayscale=1", "grayscale", "duotone=000000_ffffff"},
+	{"grayscale=1&saturation=2", "saturation", "grayscale=1"},
+	{"pixelate_region=0_0_10_10&w=100", "pixelate_region", "w=100"},
+	{"overlay_pos=north&w=100", "overlay_pos", "w=100"},
+	{"overlay_w=50&w=100", "overlay_w", "w=100"},
+}
+
+// TestConflictsResolved verifies each conflict is reported and resolved to the same
+// params, and so the same cache key, as the equivalent query without it
+func TestConflictsResolved(t *testing.T) {
+	for _, tt := range conflictingQueries {
+		t.Run(tt.query, func(t *testing.T) {
+			params := parseQuery(t, "/?url=http://x/a.png&"+tt.query)
+			if len(params.Errors) != 1 || params.Errors[0].Param != tt.param {
+				t.Fatalf("expected one error for %q, got %v", tt.param, params.Errors)
+			}
+
+			resolved := parseQuery(t, "/?url=http://x/a.png&"+tt.resolved)
+			if got, want := ipxpress.GenerateCacheKey(params), ipxpress.GenerateCacheKey(resolved); got != want {
+				t.Errorf("expected the cache key of %q", tt.resolved)
+			}
+		})
+	}
+}
+
+// TestNonConflictingCombinations verifies compatible combinations aren't touched
+func TestNonConflictingCombinations(t *testing.T) {
+	queries := []string{
+		"w=100&h=100&fit=fill",
+		"w=100&h=100&pad=1",
+		"trim=10&w=100",
+		"b=transparent&f=png&pad=1&w=10&h=10",
+		"f=jpeg&b=ff0000",
+		"flatten=1&b=ffffff",
+		"duotone=000000_ffffff&saturation=2",
+		"pixelate=8&pixelate_region=0_0_10_10",
+		"overlay=http://x/logo.png&overlay_pos=north&overlay_w=50",
+	}
+	for _, q := range queries {
+		if err := parseQuery(t, "/?url=http://x/a.png&"+q).Err(); err != nil {
+			t.Errorf("%s: unexpected error %v", q, err)
+		}
+	}
+}
+
+// TestConflictResolutionIsStable verifies resolving again changes nothing
+func TestConflictResolutionIsStable(t *testing.T) {
+	params := parseQuery(t, "/?url=http://x/a.png&duotone=000000_ffffff&grayscale=1&saturation=2&tint=ff0000")
+	key := ipxpress.GenerateCacheKey(params)
+	if errs := params.ResolveConflicts(); len(errs) != 0 {
+		t.Errorf("expected resolved params to have no conflicts, got %v", errs)
+	}
+	if ipxpress.GenerateCacheKey(params) != key {
+		t.Error("resolving twice changed the params")
+	}
+}
+
+// TestConflictsByMode verifies strict mode rejects conflicts, and lenient mode warns
+// and serves the resolved request
+func TestConflictsByMode(t *testing.T) {
+	var hits int32
+	imgServer := newPNGOrigin(t, &hits)
+	defer imgServer.Close()
+	source := url.QueryEscape(imgServer.URL + "/a.png")
+
+	for _, strict := range []bool{true, false} {
+		for _, tt := range conflictingQueries {
+			// Seeding the resolved request's entry shows lenient mode maps onto it
+			cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+			cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?url="+source+"&"+tt.resolved)), &ipxpress.CacheEntry{
+				ContentType: "image/png",
+				Data:        []byte("resolved"),
+				StatusCode:  http.StatusOK,
+			})
+
+			config := ipxpress.DefaultConfig()
+			config.StrictParams = strict
+			config.Capabilities = limitedCapabilities()
+			config.Cache = cache
+			server := httptest.NewServer(ipxpress.NewHandler(config))
+
+			resp, err := http.Get(server.URL + "/?" + tt.query + "&url=" + source)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			server.Close()
+
+			if strict && resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("strict %s: expected 400, got %d", tt.query, resp.StatusCode)
+			}
+			if !strict {
+				if !strings.Contains(resp.Header.Get("X-IPX-Warning"), tt.param) {
+					t.Errorf("lenient %s: expected a warning for %q, got %q", tt.query, tt.param, resp.Header.Get("X-IPX-Warning"))
+				}
+				if string(body) != "resolved" {
+					t.Errorf("lenient %s: expected the response for %q", tt.query, tt.resolved)
+				}
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("expected no origin fetches, got %d", n)
+	}
+}
+
+// TestRegisterConflict verifies extensions can add their own rules
+func TestRegisterConflict(t *testing.T) {
+	ipxpress.RegisterConflict(ipxpress.ConflictRule{
+		Param:  "rotate",
+		Reason: "test rule",
+		Check: func(p *core.ProcessingParams) string {
+			if p.Rotate == 45 {
+				return "45"
+			}
+			return ""
+		},
+		Resolve: func(p *core.ProcessingParams) { p.Rotate = 0 },
+	})
+
+	params := parseQuery(t, "/?url=http://x/a.png&rotate=45")
+	if params.Rotate != 0 || len(params.Errors) != 1 || params.Errors[0].Reason != "test rule" {
+		t.Errorf("expected the registered rule to apply, got rotate=%d errors=%v", params.Rotate, params.Errors)
+	}
+}
@@ -0,0 +1,93 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestContextCanceledBeforeLoad verifies a done context stops the chain and Process before decoding
+func TestContextCanceledBeforeLoad(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	proc := ipxpress.New().WithContext(ctx).FromBytes(createTestImage(20, 20))
+	defer proc.Close()
+	if err := proc.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := proc.ToBytes(ipxpress.FormatPNG, 85); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected ToBytes to return context.Canceled, got %v", err)
+	}
+
+	if _, _, err := ipxpress.Process(ctx, createTestImage(20, 20), &ipxpress.ProcessingParams{Width: 10}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Process to return context.Canceled, got %v", err)
+	}
+
+	// Deadlines are reported the same way
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	if err := ipxpress.New().WithContext(expired).FromBytes(createTestImage(10, 10)).Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+// TestContextCanceledMidChain verifies cancelling after the decode fails the next stage
+func TestContextCanceledMidChain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	proc := ipxpress.New().WithContext(ctx).FromBytes(createSolidPNG(40, 30, color.RGBA{R: 200, A: 255}))
+	defer proc.Close()
+	if err := proc.Err(); err != nil {
+		t.Fatalf("FromBytes: %v", err)
+	}
+
+	applied := false
+	proc.Resize(20, 0).ApplyFunc(func(*vips.ImageRef) error {
+		applied = true
+		cancel()
+		return nil
+	}).ApplyFunc(func(*vips.ImageRef) error {
+		t.Error("ApplyFunc ran after the context was canceled")
+		return nil
+	})
+	if !applied {
+		t.Fatal("the first ApplyFunc should have run")
+	}
+	if _, err := proc.ToBytes(ipxpress.FormatPNG, 85); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestProcess verifies Process runs the handler pipeline and reports its failures
+func TestProcess(t *testing.T) {
+	out, format, err := ipxpress.Process(context.Background(), createTestImage(200, 100), &ipxpress.ProcessingParams{Width: 50, Format: ipxpress.FormatPNG})
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if format != ipxpress.FormatPNG {
+		t.Errorf("expected png, got %q", format)
+	}
+	if cfg, err := png.DecodeConfig(bytes.NewReader(out)); err != nil || cfg.Width != 50 || cfg.Height != 25 {
+		t.Errorf("expected a 50x25 PNG, got %dx%d (%v)", cfg.Width, cfg.Height, err)
+	}
+
+	var procErr *ipxpress.ProcessError
+	_, _, err = ipxpress.Process(context.Background(), []byte("not an image"), &ipxpress.ProcessingParams{Width: 50})
+	if !errors.As(err, &procErr) || procErr.StatusCode < http.StatusBadRequest {
+		t.Errorf("expected a ProcessError for garbage input, got %v", err)
+	}
+	_, _, err = ipxpress.Process(context.Background(), createTestImage(20, 20), &ipxpress.ProcessingParams{Width: -1})
+	if !errors.As(err, &procErr) || procErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for a negative width, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package ipxpress_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const corePackage = "github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+
+// goTool returns the path of the go command, skipping the test if it's unavailable.
+func goTool(t *testing.T) string {
+	t.Helper()
+	path, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not available")
+	}
+	return path
+}
+
+// TestCoreBuildsForWasm ensures the core package stays free of cgo so it can be
+// used outside the libvips server, e.g. compiled to WebAssembly.
+func TestCoreBuildsForWasm(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping cross-compilation in short mode")
+	}
+	gobin := goTool(t)
+
+	cmd := exec.Command(gobin, "build", "-o", filepath.Join(t.TempDir(), "core.wasm"), corePackage)
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("core does not build for js/wasm: %v\n%s", err, out)
+	}
+}
+
+// TestCoreHasNoVipsDependency ensures core doesn't pull in govips or cgo,
+// even on platforms where they would build.
+func TestCoreHasNoVipsDependency(t *testing.T) {
+	gobin := goTool(t)
+
+	out, err := exec.Command(gobin, "list", "-deps", corePackage).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go list failed: %v\n%s", err, out)
+	}
+	for _, dep := range strings.Fields(string(out)) {
+		if dep == "C" || strings.Contains(dep, "govips") {
+			t.Errorf("core depends on %s", dep)
+		}
+	}
+}
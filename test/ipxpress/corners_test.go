@@ -0,0 +1,115 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// createSolidPNG creates an opaque PNG filled with a single color
+func createSolidPNG(width, height int, c color.RGBA) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// TestRoundCornersTransparentPNG verifies corners become transparent in PNG output
+func TestRoundCornersTransparentPNG(t *testing.T) {
+	src := createSolidPNG(100, 100, color.RGBA{R: 0, G: 0, B: 255, A: 255})
+
+	proc := ipxpress.New().FromBytes(src).RoundCorners(20)
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("round corners: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("expected transparent corner, got alpha %d", a>>8)
+	}
+	if _, _, _, a := img.At(50, 50).RGBA(); a>>8 != 255 {
+		t.Errorf("expected opaque center, got alpha %d", a>>8)
+	}
+}
+
+// TestCircleCropsToSquare verifies Circle crops to a centered square with transparent corners
+func TestCircleCropsToSquare(t *testing.T) {
+	src := createSolidPNG(120, 80, color.RGBA{R: 0, G: 255, B: 0, A: 255})
+
+	proc := ipxpress.New().FromBytes(src).Circle()
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("circle: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	b := img.Bounds()
+	if b.Dx() != 80 || b.Dy() != 80 {
+		t.Fatalf("expected 80x80, got %dx%d", b.Dx(), b.Dy())
+	}
+	if _, _, _, a := img.At(2, 2).RGBA(); a != 0 {
+		t.Errorf("expected transparent corner, got alpha %d", a>>8)
+	}
+}
+
+// TestRadiusParamJPEGUsesBackground verifies corners are flattened against the background in JPEG output
+func TestRadiusParamJPEGUsesBackground(t *testing.T) {
+	src := createSolidPNG(200, 200, color.RGBA{R: 0, G: 0, B: 255, A: 255})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	srv := httptest.NewServer(ipxpress.NewHandler(nil))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.png") + "&w=100&radius=max&f=jpeg&b=ff0000")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: %d", resp.StatusCode)
+	}
+
+	img, _, err := image.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	r, g, b, _ := img.At(1, 1).RGBA()
+	if r>>8 < 200 || g>>8 > 60 || b>>8 > 60 {
+		t.Errorf("expected red corner, got rgb(%d,%d,%d)", r>>8, g>>8, b>>8)
+	}
+	r, g, b, _ = img.At(50, 50).RGBA()
+	if b>>8 < 200 || r>>8 > 60 {
+		t.Errorf("expected blue center, got rgb(%d,%d,%d)", r>>8, g>>8, b>>8)
+	}
+}
@@ -0,0 +1,153 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// corsHandler wraps a handler answering 200 "ok" with an ETag in the CORS middleware
+func corsHandler(config ipxpress.CORSConfig) http.Handler {
+	return ipxpress.CORSMiddlewareWithConfig(config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		w.Write([]byte("ok"))
+	}))
+}
+
+// TestCORSOrigins verifies exact, wildcard subdomain and "*" origins on simple requests
+func TestCORSOrigins(t *testing.T) {
+	allowed := []string{"https://app.example.com", "https://*.cdn.test", "http://localhost:3000"}
+	tests := []struct {
+		origins []string
+		origin  string
+		allowed bool
+	}{
+		{allowed, "https://app.example.com", true},
+		{allowed, "HTTPS://APP.EXAMPLE.COM", true},
+		{allowed, "http://app.example.com", false},
+		{allowed, "https://app.example.com.evil.test", false},
+		{allowed, "https://img.cdn.test", true},
+		{allowed, "https://a.b.cdn.test", true},
+		{allowed, "https://cdn.test", false},
+		{allowed, "https://evilcdn.test", false},
+		{allowed, "https://img.cdn.test:8443", false},
+		{allowed, "https://user@img.cdn.test", false},
+		{allowed, "http://img.cdn.test", false},
+		{allowed, "http://localhost:3000", true},
+		{allowed, "http://localhost:3001", false},
+		{allowed, "", false},
+		{[]string{"*"}, "https://anything.test", true},
+		{nil, "https://app.example.com", false},
+	}
+	for _, tt := range tests {
+		handler := corsHandler(ipxpress.CORSConfig{AllowedOrigins: tt.origins})
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+			t.Errorf("%q: expected the response served, got %d", tt.origin, rec.Code)
+		}
+		if rec.Header().Get("Vary") != "Origin" {
+			t.Errorf("%q: expected Vary: Origin, got %q", tt.origin, rec.Header().Get("Vary"))
+		}
+		got := rec.Header().Get("Access-Control-Allow-Origin")
+		if tt.allowed && got != tt.origin || !tt.allowed && got != "" {
+			t.Errorf("%q: expected allowed=%t, got Access-Control-Allow-Origin %q", tt.origin, tt.allowed, got)
+		}
+		if exposed := rec.Header().Get("Access-Control-Expose-Headers"); tt.allowed != strings.Contains(exposed, "ETag") || tt.allowed && !strings.Contains(exposed, "X-IPX-Cache") {
+			t.Errorf("%q: unexpected Access-Control-Expose-Headers %q", tt.origin, exposed)
+		}
+	}
+}
+
+// TestCORSPreflight verifies preflight answers for allowed and refused origins
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ipxpress.CORSConfig
+		origin string
+		want   int
+		header map[string]string
+	}{
+		{
+			name:   "allowed",
+			config: ipxpress.CORSConfig{AllowedOrigins: []string{"https://*.example.com"}},
+			origin: "https://app.example.com",
+			want:   http.StatusNoContent,
+			header: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Methods":     "GET, HEAD, OPTIONS",
+				"Access-Control-Allow-Headers":     "Content-Type",
+				"Access-Control-Max-Age":           "",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name: "max-age, headers and credentials",
+			config: ipxpress.CORSConfig{
+				AllowedOrigins:   []string{"https://app.example.com"},
+				AllowedHeaders:   []string{"Authorization", "X-Api-Key"},
+				MaxAge:           10 * time.Minute,
+				AllowCredentials: true,
+			},
+			origin: "https://app.example.com",
+			want:   http.StatusNoContent,
+			header: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Headers":     "Authorization, X-Api-Key",
+				"Access-Control-Max-Age":           "600",
+				"Access-Control-Allow-Credentials": "true",
+			},
+		},
+		{
+			name:   "refused",
+			config: ipxpress.CORSConfig{AllowedOrigins: []string{"https://app.example.com"}},
+			origin: "https://evil.test",
+			want:   http.StatusForbidden,
+			header: map[string]string{
+				"Access-Control-Allow-Origin":  "",
+				"Access-Control-Allow-Methods": "",
+				"Vary":                         "Origin",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			rec := httptest.NewRecorder()
+			corsHandler(tt.config).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+			for name, want := range tt.header {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s: expected %q, got %q", name, want, got)
+				}
+			}
+			if rec.Body.String() == "ok" {
+				t.Error("expected the preflight not to reach the handler")
+			}
+		})
+	}
+}
+
+// TestCORSCredentialsWildcard verifies credentials can't be allowed for any origin
+func TestCORSCredentialsWildcard(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	ipxpress.CORSMiddlewareWithConfig(ipxpress.CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+}
@@ -0,0 +1,111 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// debugSource is a PNG signature followed by filler; passthroughs never decode it
+var debugSource = append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 2040)...)
+
+// newDebugServer returns an origin that answers slowly and a handler in front of it
+func newDebugServer(t *testing.T, mutate func(*ipxpress.Config), opts ...ipxpress.HandlerOption) (origin *httptest.Server, handler *ipxpress.Handler) {
+	t.Helper()
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(debugSource)
+	}))
+	t.Cleanup(origin.Close)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	mutate(config)
+	handler = ipxpress.NewHandler(config, opts...)
+	t.Cleanup(handler.Close)
+	return origin, handler
+}
+
+func millis(t *testing.T, h http.Header, name string) float64 {
+	t.Helper()
+	ms, err := strconv.ParseFloat(h.Get(name), 64)
+	if err != nil || ms < 0 {
+		t.Fatalf("expected %s to be milliseconds, got %q", name, h.Get(name))
+	}
+	return ms
+}
+
+// TestDebugHeadersMissThenHit verifies sizes and timings on a miss, and that a hit still reports them
+func TestDebugHeadersMissThenHit(t *testing.T) {
+	origin, handler := newDebugServer(t, func(c *ipxpress.Config) { c.DebugHeaders = true })
+	target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png")
+	size := strconv.Itoa(len(debugSource))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	h := rec.Header()
+	if rec.Code != http.StatusOK || h.Get("X-IPX-Cache") != "MISS" {
+		t.Fatalf("expected a 200 miss, got %d %q", rec.Code, h.Get("X-IPX-Cache"))
+	}
+	if fetch := millis(t, h, "X-IPX-Fetch-Ms"); fetch < 5 || fetch > 10000 {
+		t.Errorf("expected the origin's delay in X-IPX-Fetch-Ms, got %v", fetch)
+	}
+	millis(t, h, "X-IPX-Process-Ms")
+	if h.Get("X-IPX-Original-Bytes") != size || h.Get("X-IPX-Output-Bytes") != size || h.Get("X-IPX-Original-Format") != "png" {
+		t.Errorf("expected %s bytes of png in and out, got %q %q %q", size,
+			h.Get("X-IPX-Original-Bytes"), h.Get("X-IPX-Output-Bytes"), h.Get("X-IPX-Original-Format"))
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	h = rec.Header()
+	if h.Get("X-IPX-Cache") != "HIT" {
+		t.Errorf("expected a hit, got %q", h.Get("X-IPX-Cache"))
+	}
+	if h.Get("X-IPX-Original-Bytes") != size || h.Get("X-IPX-Original-Format") != "png" || h.Get("X-IPX-Fetch-Ms") == "" {
+		t.Errorf("expected the hit to keep the original's details, got %v", h)
+	}
+}
+
+// TestDebugHeadersOnRequest verifies X-IPX-Debug only works when allowed
+func TestDebugHeadersOnRequest(t *testing.T) {
+	for _, allowed := range []bool{false, true} {
+		origin, handler := newDebugServer(t, func(c *ipxpress.Config) { c.DebugRequests = allowed })
+		target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Header().Get("X-IPX-Cache") != "" {
+			t.Errorf("allowed=%t: expected no debug headers without X-IPX-Debug", allowed)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("X-IPX-Debug", "1")
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-IPX-Cache") == "HIT"; got != allowed {
+			t.Errorf("allowed=%t: got X-IPX-Cache %q", allowed, rec.Header().Get("X-IPX-Cache"))
+		}
+	}
+}
+
+// TestDebugHeadersStale verifies a hit past its TTL by the handler's clock is reported as STALE
+func TestDebugHeadersStale(t *testing.T) {
+	now := time.Now()
+	origin, handler := newDebugServer(t, func(c *ipxpress.Config) { c.DebugHeaders = true },
+		ipxpress.WithClock(func() time.Time { return now }))
+	target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png")
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	now = now.Add(24 * time.Hour)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Header().Get("X-IPX-Cache") != "STALE" {
+		t.Errorf("expected STALE, got %q", rec.Header().Get("X-IPX-Cache"))
+	}
+}
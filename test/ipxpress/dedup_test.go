@@ -0,0 +1,233 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// mapCache is a minimal Cache with deletion, standing in for a purge
+type mapCache struct {
+	mu      sync.Mutex
+	entries map[string]*ipxpress.CacheEntry
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{entries: map[string]*ipxpress.CacheEntry{}}
+}
+
+func (c *mapCache) Get(key string) (*ipxpress.CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+func (c *mapCache) Set(key string, entry *ipxpress.CacheEntry) {
+	c.SetWithTTL(key, entry, 0)
+}
+
+func (c *mapCache) SetWithTTL(key string, entry *ipxpress.CacheEntry, _ time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+}
+
+func (c *mapCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *mapCache) Close() {}
+
+// newMirrorOrigin serves the body under every path, counting fetches
+func newMirrorOrigin(body *atomic.Pointer[[]byte], hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(*body.Load())
+	}))
+}
+
+// dedupGet requests source with the extra query, returning the body and alias header
+func dedupGet(t *testing.T, server *httptest.Server, source, extra string) ([]byte, string) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(source) + extra)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d", source, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return body, resp.Header.Get("X-IPX-Alias-Of")
+}
+
+// TestDedupIdenticalSources verifies two URLs with identical bytes are processed once
+// and both stay servable from the cache
+func TestDedupIdenticalSources(t *testing.T) {
+	var hits int32
+	var body atomic.Pointer[[]byte]
+	src := createTestImage(200, 150)
+	body.Store(&src)
+	origin := newMirrorOrigin(&body, &hits)
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	var runs int32
+	handler.UseProcessor(func(p *ipxpress.Processor, _ *ipxpress.ProcessingParams) *ipxpress.Processor {
+		atomic.AddInt32(&runs, 1)
+		return p
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	a, aliasA := dedupGet(t, server, origin.URL+"/a.png", "&w=50&f=png")
+	b, aliasB := dedupGet(t, server, origin.URL+"/mirror/b.png", "&w=50&f=png")
+
+	if n := atomic.LoadInt32(&runs); n != 1 {
+		t.Errorf("expected one processing run, got %d", n)
+	}
+	if !bytes.Equal(a, b) {
+		t.Error("expected identical results")
+	}
+	keyA := ipxpress.GenerateCacheKey(parseQuery(t, "/?url="+url.QueryEscape(origin.URL+"/a.png")+"&w=50&f=png"))
+	if aliasA != "" || aliasB != keyA {
+		t.Errorf("expected b to alias a's key %s, got %q and %q", keyA, aliasA, aliasB)
+	}
+
+	// Both keys are cached now
+	dedupGet(t, server, origin.URL+"/a.png", "&w=50&f=png")
+	dedupGet(t, server, origin.URL+"/mirror/b.png", "&w=50&f=png")
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected 2 origin fetches, got %d", n)
+	}
+
+	// Other params are processed separately
+	dedupGet(t, server, origin.URL+"/mirror/b.png", "&w=60&f=png")
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("expected a run for different params, got %d runs", n)
+	}
+}
+
+// TestDedupRespectsPurge verifies removing either URL's entry doesn't affect the other,
+// and a purged URL whose bytes changed isn't served the old result
+func TestDedupRespectsPurge(t *testing.T) {
+	var hits int32
+	var body atomic.Pointer[[]byte]
+	original := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{1}, 64)...)
+	body.Store(&original)
+	origin := newMirrorOrigin(&body, &hits)
+	defer origin.Close()
+
+	cache := newMapCache()
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.StreamThreshold = 0
+	config.DebugHeaders = true
+	config.Cache = cache
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	sourceA, sourceB := origin.URL+"/a.png", origin.URL+"/b.png"
+	keyA := ipxpress.GenerateCacheKey(parseQuery(t, "/?url="+url.QueryEscape(sourceA)))
+	keyB := ipxpress.GenerateCacheKey(parseQuery(t, "/?url="+url.QueryEscape(sourceB)))
+
+	dedupGet(t, server, sourceA, "")
+	if _, alias := dedupGet(t, server, sourceB, ""); alias != keyA {
+		t.Fatalf("expected b to alias a, got %q", alias)
+	}
+
+	// Purging a leaves b's copy servable without a fetch
+	cache.Delete(keyA)
+	if got, _ := dedupGet(t, server, sourceB, ""); !bytes.Equal(got, original) {
+		t.Error("b's entry changed after purging a")
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected b from the cache, got %d fetches", n)
+	}
+
+	// a's source changed: it gets its own bytes, not b's cached copy
+	changed := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{2}, 64)...)
+	body.Store(&changed)
+	got, alias := dedupGet(t, server, sourceA, "")
+	if !bytes.Equal(got, changed) || alias != "" {
+		t.Errorf("expected a's new bytes unaliased, got alias %q", alias)
+	}
+
+	// Purging b and fetching it again doesn't alias the purged entry either
+	cache.Delete(keyB)
+	if got, alias := dedupGet(t, server, sourceB, ""); !bytes.Equal(got, changed) || alias != keyA {
+		t.Errorf("expected b to alias a's new entry, got alias %q", alias)
+	}
+}
+
+// TestDedupDisabled verifies identical sources are handled separately when disabled
+func TestDedupDisabled(t *testing.T) {
+	var hits int32
+	var body atomic.Pointer[[]byte]
+	src := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	body.Store(&src)
+	origin := newMirrorOrigin(&body, &hits)
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.StreamThreshold = 0
+	config.DebugHeaders = true
+	config.DedupOriginals = false
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	dedupGet(t, server, origin.URL+"/a.png", "")
+	if _, alias := dedupGet(t, server, origin.URL+"/b.png", ""); alias != "" {
+		t.Errorf("expected no alias, got %q", alias)
+	}
+}
+
+// BenchmarkDedupIdenticalSources measures many mirrors of one image with and without dedup
+func BenchmarkDedupIdenticalSources(b *testing.B) {
+	var hits int32
+	var body atomic.Pointer[[]byte]
+	src := createTestImage(1200, 800)
+	body.Store(&src)
+	origin := newMirrorOrigin(&body, &hits)
+	defer origin.Close()
+
+	for _, dedup := range []bool{false, true} {
+		b.Run(fmt.Sprintf("dedup=%t", dedup), func(b *testing.B) {
+			config := ipxpress.DefaultConfig()
+			config.DedupOriginals = dedup
+			handler := ipxpress.NewHandler(config)
+			defer handler.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("GET", "/?w=300&f=webp&url="+url.QueryEscape(fmt.Sprintf("%s/mirror%d/a.png", origin.URL, i)), nil)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("status %d", rec.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"errors"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// noRedirectClient returns redirects to the test instead of following them
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// newDefaultImageServer starts a handler with the given default image settings
+func newDefaultImageServer(t *testing.T, mode ipxpress.DefaultImageMode, target string, allowed ...string) *httptest.Server {
+	t.Helper()
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.DefaultImageMode = mode
+	config.DefaultImage = target
+	config.AllowedHosts = allowed
+	return httptest.NewServer(ipxpress.NewHandler(config))
+}
+
+// TestDefaultImageRedirect verifies broken URLs redirect to the default with params kept
+func TestDefaultImageRedirect(t *testing.T) {
+	server := newDefaultImageServer(t, ipxpress.DefaultImageRedirect, "https://cdn.example.com/default.png", "cdn.example.com")
+	defer server.Close()
+
+	for _, broken := range []string{"ftp://cdn.example.com/a.png", "not a url", "://missing-scheme"} {
+		resp, err := noRedirectClient.Get(server.URL + "/?w=100&url=" + url.QueryEscape(broken))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusFound {
+			t.Errorf("%q: expected 302, got %d", broken, resp.StatusCode)
+			continue
+		}
+		loc := resp.Header.Get("Location")
+		if !strings.HasPrefix(loc, "?") {
+			t.Errorf("expected a query-relative Location, got %q", loc)
+		}
+		q, _ := url.ParseQuery(strings.TrimPrefix(loc, "?"))
+		if q.Get("url") != "https://cdn.example.com/default.png" || q.Get("w") != "100" {
+			t.Errorf("unexpected redirect target %q", loc)
+		}
+	}
+}
+
+// TestDefaultImageRedirectSigned verifies the redirect of a signed request carries a valid signature for its new query
+func TestDefaultImageRedirectSigned(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.DefaultImageMode = ipxpress.DefaultImageRedirect
+	config.DefaultImage = "https://cdn.example.com/default.png"
+	config.AllowedHosts = []string{"cdn.example.com"}
+	config.SignatureSecrets = []string{"new-secret", "old-secret"}
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	for _, secret := range config.SignatureSecrets {
+		signed := ipxpress.SignURL(secret, "/", &ipxpress.ProcessingParams{URL: "not a url", Width: 100})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, signed, nil))
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%s: expected 302, got %d: %s", secret, rec.Code, rec.Body)
+		}
+		q, _ := url.ParseQuery(strings.TrimPrefix(rec.Header().Get("Location"), "?"))
+		if q.Get("url") != config.DefaultImage {
+			t.Errorf("%s: unexpected redirect target %q", secret, rec.Header().Get("Location"))
+		}
+		if err := ipxpress.VerifySignature(q, []string{secret}, time.Now()); err != nil {
+			t.Errorf("%s: expected the redirect signed with the request's secret, got %v", secret, err)
+		}
+	}
+}
+
+// TestDefaultImageRedirectRespectsAllowlist verifies a redirect target outside AllowedHosts isn't used
+func TestDefaultImageRedirectRespectsAllowlist(t *testing.T) {
+	server := newDefaultImageServer(t, ipxpress.DefaultImageRedirect, "https://evil.example.net/default.png", "cdn.example.com")
+	defer server.Close()
+
+	resp, err := noRedirectClient.Get(server.URL + "/?url=" + url.QueryEscape("ftp://x/a.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+// TestDefaultImageNotUsedForOriginFailures verifies origin errors keep their status
+func TestDefaultImageNotUsedForOriginFailures(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	server := newDefaultImageServer(t, ipxpress.DefaultImageRedirect, origin.URL+"/default.png")
+	defer server.Close()
+
+	resp, err := noRedirectClient.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/missing.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+// TestDefaultImageServeLocal verifies a local default is served in place of a broken URL
+func TestDefaultImageServeLocal(t *testing.T) {
+	src := createSolidPNG(10, 10, color.RGBA{G: 255, A: 255})
+	path := filepath.Join(t.TempDir(), "default.png")
+	if err := os.WriteFile(path, src, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := newDefaultImageServer(t, ipxpress.DefaultImageServe, path)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape("javascript:alert(1)"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Equal(body, src) {
+		t.Error("expected the local default image")
+	}
+}
+
+// TestDefaultImageServeRemote verifies a remote default is fetched in place of a broken URL
+func TestDefaultImageServeRemote(t *testing.T) {
+	src := createSolidPNG(10, 10, color.RGBA{B: 255, A: 255})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	server := newDefaultImageServer(t, ipxpress.DefaultImageServe, origin.URL+"/default.png")
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape("ftp://x/a.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, src) {
+		t.Errorf("expected the remote default image, got %d", resp.StatusCode)
+	}
+}
+
+// TestDefaultImageServeResized verifies the default image is processed to the requested size
+func TestDefaultImageServeResized(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "default.png")
+	if err := os.WriteFile(path, createSolidPNG(100, 100, color.RGBA{R: 255, A: 255}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.DefaultImageMode = ipxpress.DefaultImageServe
+	config.DefaultImage = path
+	server := httptest.NewServer(ipxpress.NewHandler(config))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?w=20&url=" + url.QueryEscape("not a url"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	img, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if img.Bounds().Dx() != 20 {
+		t.Errorf("expected width 20, got %d", img.Bounds().Dx())
+	}
+}
+
+// TestAllowedHostsBlocksFetch verifies hosts outside the allowlist are refused
+func TestAllowedHostsBlocksFetch(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("origin must not be contacted")
+	}))
+	defer origin.Close()
+
+	server := newDefaultImageServer(t, ipxpress.DefaultImageOff, "", "*.example.com")
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/a.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+// TestHostAllowed verifies exact and wildcard allowlist matching
+func TestHostAllowed(t *testing.T) {
+	f := ipxpress.NewFetcher()
+	f.AllowedHosts = []string{"example.com", "*.cdn.example.org"}
+
+	tests := map[string]bool{
+		"example.com":          true,
+		"EXAMPLE.com":          true,
+		"www.example.com":      false,
+		"img.cdn.example.org":  true,
+		"cdn.example.org":      false,
+		"evil-cdn.example.org": false,
+	}
+	for host, want := range tests {
+		if got := f.HostAllowed(host); got != want {
+			t.Errorf("HostAllowed(%q) = %t, want %t", host, got, want)
+		}
+	}
+}
+
+// TestAllowedHostsFollowsRedirects verifies every redirect hop is checked against AllowedHosts
+func TestAllowedHostsFollowsRedirects(t *testing.T) {
+	src := createSolidPNG(4, 4, color.RGBA{B: 255, A: 255})
+	var elsewhereHits int
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhereHits++
+		w.Write(src)
+	}))
+	defer elsewhere.Close()
+	_, port, _ := strings.Cut(elsewhere.Listener.Addr().String(), ":")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same.png":
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+		case "/away.png":
+			// Same address, but a host name AllowedHosts doesn't list
+			http.Redirect(w, r, "http://localhost:"+port+"/image.png", http.StatusFound)
+		case "/ftp.png":
+			http.Redirect(w, r, "ftp://127.0.0.1/image.png", http.StatusFound)
+		default:
+			w.Write(src)
+		}
+	}))
+	defer origin.Close()
+	fetcher := ipxpress.NewFetcher()
+	fetcher.AllowedHosts = []string{"127.0.0.1"}
+
+	if data, err := fetcher.Fetch(origin.URL + "/same.png"); err != nil || !bytes.Equal(data, src) {
+		t.Errorf("expected a redirect within the allowed host followed, got %v", err)
+	}
+	var fetchErr *ipxpress.FetchError
+	if _, err := fetcher.Fetch(origin.URL + "/away.png"); !errors.As(err, &fetchErr) || fetchErr.Kind != ipxpress.ErrKindBlockedHost || fetchErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a redirect to another host, got %v", err)
+	}
+	if elsewhereHits != 0 {
+		t.Errorf("expected the disallowed host never requested, got %d requests", elsewhereHits)
+	}
+	if _, err := fetcher.Fetch(origin.URL + "/ftp.png"); !errors.As(err, &fetchErr) || fetchErr.Kind != ipxpress.ErrKindInvalidURL {
+		t.Errorf("expected a redirect to another scheme refused, got %v", err)
+	}
+
+	// The handler answers with the same status
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.AllowedHosts = []string{"127.0.0.1"}
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+sourceQuery(origin.URL+"/away.png", ""), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 from the handler, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,208 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// flushRecorder records when the status was written and first flushed
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	start    time.Time
+	headerAt time.Duration
+	flushAt  time.Duration
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{ResponseRecorder: httptest.NewRecorder(), start: time.Now()}
+}
+
+func (r *flushRecorder) WriteHeader(code int) {
+	if r.headerAt == 0 && code >= 200 {
+		r.headerAt = time.Since(r.start)
+	}
+	r.ResponseRecorder.WriteHeader(code)
+}
+
+func (r *flushRecorder) Flush() {
+	if r.flushAt == 0 {
+		r.flushAt = time.Since(r.start)
+	}
+	r.ResponseRecorder.Flush()
+}
+
+// delayedOrigin serves src after delay, or a 404 if fail is set
+func delayedOrigin(t *testing.T, src []byte, delay time.Duration, fail bool) (string, *atomic.Int32) {
+	t.Helper()
+	var fetches atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(delay)
+		if fail {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(src)
+	}))
+	t.Cleanup(origin.Close)
+	return "/?f=png&url=" + url.QueryEscape(origin.URL+"/a.png"), &fetches
+}
+
+func earlyHandler(t *testing.T, configure func(*ipxpress.Config)) *ipxpress.Handler {
+	t.Helper()
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	configure(config)
+	handler := ipxpress.NewHandler(config)
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// TestEarlyHeaders verifies headers of a slow miss are written and flushed before the image is ready
+func TestEarlyHeaders(t *testing.T) {
+	src := createSolidPNG(20, 20, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	target, _ := delayedOrigin(t, src, 200*time.Millisecond, false)
+	handler := earlyHandler(t, func(c *ipxpress.Config) { c.EarlyHeadersAfter = 20 * time.Millisecond })
+
+	rec := newFlushRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), src) {
+		t.Fatalf("expected 200 with the source, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if rec.headerAt == 0 || rec.headerAt >= 150*time.Millisecond {
+		t.Errorf("expected the status before the origin answered, got it after %v", rec.headerAt)
+	}
+	if rec.flushAt == 0 || rec.flushAt >= 150*time.Millisecond {
+		t.Errorf("expected a flush before the origin answered, got it after %v", rec.flushAt)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected image/png, got %q", ct)
+	}
+}
+
+// TestEarlyHeadersSkipped verifies conditional requests and misses that are fast enough aren't answered early
+func TestEarlyHeadersSkipped(t *testing.T) {
+	src := createSolidPNG(20, 20, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	target, _ := delayedOrigin(t, src, 150*time.Millisecond, false)
+	handler := earlyHandler(t, func(c *ipxpress.Config) { c.EarlyHeadersAfter = 20 * time.Millisecond })
+
+	rec := newFlushRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", `"abc"`)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec.headerAt < 150*time.Millisecond {
+		t.Errorf("expected no early status for a conditional request, got it after %v", rec.headerAt)
+	}
+
+	fast, _ := delayedOrigin(t, src, 0, false)
+	handler = earlyHandler(t, func(c *ipxpress.Config) { c.EarlyHeadersAfter = time.Second })
+	rec = newFlushRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fast, nil))
+	if rec.Code != http.StatusOK || rec.flushAt != 0 {
+		t.Errorf("expected a plain 200, got %d flushed after %v", rec.Code, rec.flushAt)
+	}
+}
+
+// TestEarlyHeadersFailure verifies a miss failing after early headers breaks the connection
+func TestEarlyHeadersFailure(t *testing.T) {
+	target, _ := delayedOrigin(t, nil, 100*time.Millisecond, true)
+	handler := earlyHandler(t, func(c *ipxpress.Config) { c.EarlyHeadersAfter = 20 * time.Millisecond })
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the early 200, got %d", resp.StatusCode)
+	}
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("expected reading the body to fail")
+	}
+}
+
+// TestResponseHeaderDeadline verifies a miss past the deadline gets 504 and is still cached
+func TestResponseHeaderDeadline(t *testing.T) {
+	src := createSolidPNG(20, 20, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	target, fetches := delayedOrigin(t, src, 150*time.Millisecond, false)
+	handler := earlyHandler(t, func(c *ipxpress.Config) { c.ResponseHeaderDeadline = 30 * time.Millisecond })
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed >= 150*time.Millisecond {
+		t.Errorf("expected the 504 at the deadline, got it after %v", elapsed)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), src) {
+		t.Fatalf("expected the cached image, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected 1 fetch, got %d", n)
+	}
+}
+
+// TestEarlyHints verifies configured Link headers are sent in a 103 before the image
+func TestEarlyHints(t *testing.T) {
+	src := createSolidPNG(20, 20, color.RGBA{R: 10, G: 20, B: 30, A: 255})
+	target, _ := delayedOrigin(t, src, 0, false)
+	link := "</fonts/a.woff2>; rel=preload; as=font; crossorigin"
+	handler := earlyHandler(t, func(c *ipxpress.Config) { c.EarlyHints = []string{link} })
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var hints []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				hints = append(hints, header["Link"]...)
+			}
+			return nil
+		},
+	}
+	get := func() int {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+target, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(hints) != 1 || hints[0] != link {
+		t.Errorf("expected a 103 with Link %q, got %q", link, hints)
+	}
+
+	// Cache hits are fast, so they get no hints
+	hints = nil
+	if code := get(); code != http.StatusOK || len(hints) != 0 {
+		t.Errorf("expected a plain 200 from the cache, got %d with hints %q", code, hints)
+	}
+}
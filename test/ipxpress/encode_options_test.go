@@ -0,0 +1,196 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// encodeGet requests src processed with the extra query and returns the body
+func encodeGet(t *testing.T, src []byte, extra string) []byte {
+	t.Helper()
+	return encodeGetWith(t, nil, src, extra)
+}
+
+// encodeGetWith is encodeGet with a handler built from config
+func encodeGetWith(t *testing.T, config *ipxpress.Config, src []byte, extra string) []byte {
+	t.Helper()
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.png") + "&" + extra)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d", extra, resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return body
+}
+
+// decodeViaPNG decodes any supported format by re-encoding it as PNG
+func decodeViaPNG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	proc := ipxpress.New().FromBytes(data)
+	defer proc.Close()
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 100)
+	if err != nil {
+		t.Fatalf("re-encode: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return img
+}
+
+// TestLosslessWebPIsExact verifies lossless WebP keeps every pixel of the source
+func TestLosslessWebPIsExact(t *testing.T) {
+	src := createGradientPNG(96, 64)
+	want, _ := png.Decode(bytes.NewReader(src))
+
+	for _, extra := range []string{"f=webp&lossless=true", "f=webp&lossless=1&effort=6"} {
+		got := decodeViaPNG(t, encodeGet(t, src, extra))
+		if got.Bounds() != want.Bounds() {
+			t.Fatalf("%s: size changed to %v", extra, got.Bounds())
+		}
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 96; x++ {
+				r1, g1, b1, _ := want.At(x, y).RGBA()
+				r2, g2, b2, _ := got.At(x, y).RGBA()
+				if r1>>8 != r2>>8 || g1>>8 != g2>>8 || b1>>8 != b2>>8 {
+					t.Fatalf("%s: pixel (%d,%d) differs", extra, x, y)
+				}
+			}
+		}
+	}
+
+	// The default is lossy, so the same image doesn't survive exactly
+	lossy := decodeViaPNG(t, encodeGet(t, src, "f=webp&q=50"))
+	if diff := meanDiff(want, lossy); diff == 0 {
+		t.Error("expected lossy WebP by default")
+	}
+}
+
+// TestPNGPaletteColors verifies png_colors quantizes to a palette
+func TestPNGPaletteColors(t *testing.T) {
+	src := createGradientPNG(128, 128)
+	full := encodeGet(t, src, "f=png&png_compression=9")
+	quantized := encodeGet(t, src, "f=png&png_colors=16")
+
+	img, err := png.Decode(bytes.NewReader(quantized))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if _, ok := img.(*image.Paletted); !ok {
+		t.Fatalf("expected a paletted PNG, got %T", img)
+	}
+	colors := map[[3]uint32]bool{}
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			colors[[3]uint32{r, g, b}] = true
+		}
+	}
+	if len(colors) > 16 {
+		t.Errorf("expected at most 16 colors, got %d", len(colors))
+	}
+	if len(quantized) >= len(full) {
+		t.Errorf("expected the palette PNG (%d bytes) to be smaller than truecolor (%d bytes)", len(quantized), len(full))
+	}
+}
+
+// meanDiff returns the mean absolute RGB difference of two same-sized images (0-255)
+func meanDiff(a, b image.Image) float64 {
+	var total, n uint64
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range [][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}} {
+				if d[0] > d[1] {
+					total += uint64(d[0]-d[1]) >> 8
+				} else {
+					total += uint64(d[1]-d[0]) >> 8
+				}
+				n++
+			}
+		}
+	}
+	return float64(total) / float64(n)
+}
+
+// TestEncodeOptionParams verifies parsing, validation and cache keys of encoder options
+func TestEncodeOptionParams(t *testing.T) {
+	params := parseQuery(t, "/?url=http://x/a.png&lossless=true&near_lossless=1&effort=6&png_compression=9&png_colors=256")
+	if err := params.Err(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	opts := params.EncodeOptions()
+	if !opts.Lossless || !opts.NearLossless || opts.Effort != 6 || opts.PNGCompression != 9 || opts.PNGColors != 256 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if !params.NeedsProcessing(ipxpress.FormatPNG) {
+		t.Error("encoder options should force re-encoding")
+	}
+
+	base := ipxpress.GenerateCacheKey(parseQuery(t, "/?url=http://x/a.png&f=webp"))
+	for _, extra := range []string{"lossless=1", "near_lossless=1", "effort=2", "png_compression=1", "png_colors=8"} {
+		if ipxpress.GenerateCacheKey(parseQuery(t, "/?url=http://x/a.png&f=webp&"+extra)) == base {
+			t.Errorf("%s: expected a distinct cache key", extra)
+		}
+	}
+
+	for query, param := range map[string]string{
+		"effort=7":           "effort",
+		"effort=0":           "effort",
+		"png_compression=10": "png_compression",
+		"png_colors=1":       "png_colors",
+		"png_colors=257":     "png_colors",
+		"lossless=maybe":     "lossless",
+	} {
+		params := parseQuery(t, "/?url=http://x/a.png&"+query)
+		if len(params.Errors) != 1 || params.Errors[0].Param != param {
+			t.Errorf("%s: expected an error for %q, got %v", query, param, params.Errors)
+		}
+		if params.HasEncodeOptions() {
+			t.Errorf("%s: expected the invalid option to be ignored", query)
+		}
+	}
+
+	auto := parseQuery(t, "/?url=http://x/a.png&f=webp&lossless=1&q=auto&maxbytes=1000")
+	if auto.QualityAuto || auto.MaxBytes != 0 || len(auto.Errors) == 0 || auto.Errors[0].Param != "quality" {
+		t.Errorf("expected q=auto to be dropped with lossless, got %v", auto.Errors)
+	}
+}
+
+// TestEncodeOptionsDefaultQuality verifies params built in code without a quality encode at the default one
+func TestEncodeOptionsDefaultQuality(t *testing.T) {
+	if got := (&ipxpress.ProcessingParams{Width: 50, Format: ipxpress.FormatPNG}).EncodeOptions().Quality; got != 85 {
+		t.Errorf("expected the default quality 85, got %d", got)
+	}
+	if got := parseQuery(t, "/?url=http://x/a.png").EncodeOptions().Quality; got != 85 {
+		t.Errorf("expected a query without q to get the same default, got %d", got)
+	}
+	if got := (&ipxpress.ProcessingParams{Quality: 60}).EncodeOptions().Quality; got != 60 {
+		t.Errorf("expected an explicit quality kept, got %d", got)
+	}
+}
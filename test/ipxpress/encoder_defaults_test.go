@@ -0,0 +1,120 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestConfigWebPEffort verifies the configured WebP effort trades CPU for size and
+// that the effort parameter still overrides it
+func TestConfigWebPEffort(t *testing.T) {
+	src := createDetailedPNG(256, 256)
+	withEffort := func(effort int) *ipxpress.Config {
+		config := ipxpress.DefaultConfig()
+		config.WebPOptions = &ipxpress.WebPOptions{Effort: effort}
+		return config
+	}
+
+	fast := encodeGetWith(t, withEffort(0), src, "f=webp&q=80")
+	small := encodeGetWith(t, withEffort(6), src, "f=webp&q=80")
+	if len(small) >= len(fast) {
+		t.Errorf("expected effort 6 to be smaller than effort 0, got %d and %d bytes", len(small), len(fast))
+	}
+
+	overridden := encodeGetWith(t, withEffort(0), src, "f=webp&q=80&effort=6")
+	if !bytes.Equal(overridden, small) {
+		t.Errorf("expected effort=6 to override the configured effort, got %d bytes", len(overridden))
+	}
+}
+
+// TestConfigPNGCompression verifies the configured PNG compression level is used
+func TestConfigPNGCompression(t *testing.T) {
+	src := createGradientPNG(256, 256)
+	withLevel := func(level int) *ipxpress.Config {
+		config := ipxpress.DefaultConfig()
+		config.PNGOptions = &ipxpress.PNGOptions{Compression: level}
+		return config
+	}
+
+	stored := encodeGetWith(t, withLevel(0), src, "f=png&w=200")
+	packed := encodeGetWith(t, withLevel(9), src, "f=png&w=200")
+	if len(packed) >= len(stored) {
+		t.Errorf("expected level 9 to be smaller than level 0, got %d and %d bytes", len(packed), len(stored))
+	}
+}
+
+// TestConfigJPEGBaseline verifies progressive encoding can be turned off
+func TestConfigJPEGBaseline(t *testing.T) {
+	src := createGradientPNG(64, 64)
+	config := ipxpress.DefaultConfig()
+	config.JPEGOptions = &ipxpress.JPEGOptions{Progressive: false}
+
+	// SOF2 (0xFFC2) marks a progressive JPEG, SOF0 (0xFFC0) a baseline one
+	if out := encodeGetWith(t, nil, src, "f=jpeg"); !bytes.Contains(out, []byte{0xFF, 0xC2}) {
+		t.Error("expected the default JPEG to be progressive")
+	}
+	if out := encodeGetWith(t, config, src, "f=jpeg"); bytes.Contains(out, []byte{0xFF, 0xC2}) || !bytes.Contains(out, []byte{0xFF, 0xC0}) {
+		t.Error("expected a baseline JPEG")
+	}
+}
+
+// TestEncoderDefaultsVersionCacheKeys verifies changing encoder defaults doesn't serve
+// variants cached under other settings, while the default configuration keeps its keys
+func TestEncoderDefaultsVersionCacheKeys(t *testing.T) {
+	var hits int32
+	origin := newPNGOrigin(t, &hits)
+	defer origin.Close()
+	source := origin.URL + "/a.png"
+
+	cache := newMapCache()
+	stale := []byte("encoded with other settings")
+	cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?url="+url.QueryEscape(source))), &ipxpress.CacheEntry{
+		ContentType: "image/png",
+		Data:        stale,
+		StatusCode:  http.StatusOK,
+		Timestamp:   time.Now(),
+	})
+
+	get := func(options *ipxpress.WebPOptions) []byte {
+		config := ipxpress.DefaultConfig()
+		config.Capabilities = limitedCapabilities()
+		config.StreamThreshold = 0
+		config.Cache = cache
+		config.WebPOptions = options
+		handler := ipxpress.NewHandler(config)
+		defer handler.Close()
+		server := httptest.NewServer(handler)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(source))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return body
+	}
+
+	if body := get(nil); !bytes.Equal(body, stale) || atomic.LoadInt32(&hits) != 0 {
+		t.Fatal("expected the default configuration to keep its cache keys")
+	}
+	if body := get(&ipxpress.WebPOptions{Effort: 6}); bytes.Equal(body, stale) || atomic.LoadInt32(&hits) != 1 {
+		t.Fatal("expected new encoder defaults to miss the old entry")
+	}
+	get(&ipxpress.WebPOptions{Effort: 6})
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("expected the same settings to share a key, got %d fetches", n)
+	}
+	get(&ipxpress.WebPOptions{Effort: 0})
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("expected other settings to use another key, got %d fetches", n)
+	}
+}
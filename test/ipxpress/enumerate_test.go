@@ -0,0 +1,216 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// collectKeys pages through the whole cache with the given page size
+func collectKeys(t *testing.T, c ipxpress.Enumerable, prefix string, limit int) []string {
+	t.Helper()
+	var all []string
+	cursor := ""
+	for {
+		keys, next := c.Keys(prefix, limit, cursor)
+		if len(keys) > limit {
+			t.Fatalf("page of %d exceeds limit %d", len(keys), limit)
+		}
+		all = append(all, keys...)
+		if next == "" {
+			return all
+		}
+		cursor = next
+	}
+}
+
+// TestCacheKeysPagination verifies every key is returned exactly once, in order
+func TestCacheKeysPagination(t *testing.T) {
+	cache := ipxpress.NewInMemoryCache(time.Minute, 10*1024*1024)
+	defer cache.Close()
+
+	for i := 0; i < 250; i++ {
+		cache.Set(fmt.Sprintf("a%03d", i), &ipxpress.CacheEntry{Data: []byte("x"), StatusCode: 200})
+	}
+	for i := 0; i < 30; i++ {
+		cache.Set(fmt.Sprintf("b%03d", i), &ipxpress.CacheEntry{Data: []byte("x"), StatusCode: 200})
+	}
+	time.Sleep(50 * time.Millisecond) // otter applies writes asynchronously
+
+	all := collectKeys(t, cache, "", 100)
+	if len(all) != 280 || !sort.StringsAreSorted(all) {
+		t.Fatalf("expected 280 sorted keys, got %d (sorted=%t)", len(all), sort.StringsAreSorted(all))
+	}
+
+	if b := collectKeys(t, cache, "b", 7); len(b) != 30 {
+		t.Errorf("expected 30 keys with prefix b, got %d", len(b))
+	}
+	if keys, next := cache.Keys("", 0, ""); keys != nil || next != "" {
+		t.Error("expected no keys for limit 0")
+	}
+}
+
+// TestCachePeek verifies metadata is reported without counting a hit
+func TestCachePeek(t *testing.T) {
+	cache := ipxpress.NewInMemoryCache(time.Minute, 10*1024*1024)
+	defer cache.Close()
+
+	cache.Set("k", &ipxpress.CacheEntry{Data: make([]byte, 1234), ContentType: "image/png", StatusCode: 200})
+	cache.Get("k")
+	cache.Get("k")
+
+	meta, ok := cache.Peek("k")
+	if !ok {
+		t.Fatal("expected entry")
+	}
+	if meta.Size != 1234 || meta.ContentType != "image/png" || meta.StatusCode != 200 || meta.Hits != 2 {
+		t.Errorf("unexpected meta %+v", meta)
+	}
+	if meta.TTL <= 0 || meta.TTL > time.Minute || meta.Age < 0 {
+		t.Errorf("unexpected ttl/age %v/%v", meta.TTL, meta.Age)
+	}
+
+	if again, _ := cache.Peek("k"); again.Hits != 2 {
+		t.Errorf("Peek must not count as a hit, got %d", again.Hits)
+	}
+	if _, ok := cache.Peek("missing"); ok {
+		t.Error("expected missing key")
+	}
+}
+
+// TestCacheEnumerationConcurrent races enumeration against writes and evictions
+func TestCacheEnumerationConcurrent(t *testing.T) {
+	// Small capacity so writers constantly evict
+	cache := ipxpress.NewInMemoryCache(time.Minute, 64*1024)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				cache.Set(fmt.Sprintf("w%d-%06d", w, i), &ipxpress.CacheEntry{Data: make([]byte, 512), StatusCode: 200})
+			}
+		}(w)
+	}
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		cursor := ""
+		for {
+			keys, next := cache.Keys("", 50, cursor)
+			if !sort.StringsAreSorted(keys) {
+				t.Fatal("page not sorted")
+			}
+			for _, k := range keys {
+				if k <= cursor {
+					t.Fatalf("key %q not after cursor %q", k, cursor)
+				}
+				cache.Peek(k) // may be gone already; must not panic
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// TestAdminEntries verifies the paginated admin listing
+func TestAdminEntries(t *testing.T) {
+	cache := ipxpress.NewInMemoryCache(time.Minute, 10*1024*1024)
+	for i := 0; i < 5; i++ {
+		cache.Set(fmt.Sprintf("key%d", i), &ipxpress.CacheEntry{Data: []byte("abc"), ContentType: "image/jpeg", StatusCode: 200})
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	config := ipxpress.DefaultConfig()
+	config.Cache = cache
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	admin := httptest.NewServer(handler.Admin())
+	defer admin.Close()
+
+	var seen []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		resp, err := http.Get(admin.URL + "/entries?limit=2&cursor=" + cursor)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		var page struct {
+			Entries []ipxpress.EntryMeta `json:"entries"`
+			Next    string               `json:"next_cursor"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		for _, e := range page.Entries {
+			if e.Size != 3 || e.ContentType != "image/jpeg" {
+				t.Errorf("unexpected entry %+v", e)
+			}
+			seen = append(seen, e.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+
+	if len(seen) != 5 {
+		t.Errorf("expected 5 entries, got %v", seen)
+	}
+
+	resp, _ := http.Get(admin.URL + "/entries?limit=abc")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad limit, got %d", resp.StatusCode)
+	}
+}
+
+// TestAdminEntriesNotEnumerable verifies custom caches without Enumerable get 501
+func TestAdminEntriesNotEnumerable(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Cache = nonEnumerable{ipxpress.NewInMemoryCache(time.Minute, 1024)}
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	rec := httptest.NewRecorder()
+	handler.Admin().ServeHTTP(rec, httptest.NewRequest("GET", "/entries", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501, got %d", rec.Code)
+	}
+}
+
+// nonEnumerable hides the Enumerable methods of the wrapped cache
+type nonEnumerable struct{ c *ipxpress.InMemoryCache }
+
+func (n nonEnumerable) Get(key string) (*ipxpress.CacheEntry, bool) { return n.c.Get(key) }
+func (n nonEnumerable) Set(key string, e *ipxpress.CacheEntry)      { n.c.Set(key, e) }
+func (n nonEnumerable) SetWithTTL(key string, e *ipxpress.CacheEntry, ttl time.Duration) {
+	n.c.SetWithTTL(key, e, ttl)
+}
+func (n nonEnumerable) Close() { n.c.Close() }
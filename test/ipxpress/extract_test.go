@@ -0,0 +1,139 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestExtractCropParsing verifies percentages and crop sizes parse, and bad ones are reported
+func TestExtractCropParsing(t *testing.T) {
+	parse := func(query string) *ipxpress.ProcessingParams {
+		return ipxpress.ParseProcessingParams(httptest.NewRequest(http.MethodGet, "/?url=http://a.test/x.jpg&"+query, nil))
+	}
+	if p := parse("extract=10p_12.5p_50p_50p"); len(p.Errors) != 0 || p.Extract != "10p_12.5p_50p_50p" {
+		t.Errorf("expected percentages accepted, got %q and %v", p.Extract, p.Errors)
+	}
+	if p := parse("extract=10_10p_200_50p"); len(p.Errors) != 0 {
+		t.Errorf("expected pixels and percentages mixed, got %v", p.Errors)
+	}
+	if p := parse("crop=400x300"); p.CropWidth != 400 || p.CropHeight != 300 || p.Query().Get("crop") != "400x300" {
+		t.Errorf("expected a 400x300 crop, got %dx%d", p.CropWidth, p.CropHeight)
+	}
+	for _, query := range []string{"extract=10x_0_5_5", "extract=p_0_5_5", "crop=400", "crop=0x300", "crop=ax3"} {
+		if p := parse(query); len(p.Errors) != 1 || p.CropWidth != 0 {
+			t.Errorf("%q: expected one error, got %v", query, p.Errors)
+		}
+	}
+	if ipxpress.GenerateCacheKey(parse("crop=400x300")) == ipxpress.GenerateCacheKey(parse("crop=300x400")) {
+		t.Error("expected crop sizes to get their own cache keys")
+	}
+
+	for _, tt := range []struct {
+		length ipxpress.Length
+		size   int
+		want   int
+	}{
+		{ipxpress.Length{Value: 25, Percent: true}, 200, 50},
+		{ipxpress.Length{Value: 12.5, Percent: true}, 99, 12},
+		{ipxpress.Length{Value: 30}, 200, 30},
+	} {
+		if got := tt.length.Pixels(tt.size); got != tt.want {
+			t.Errorf("%+v of %d: expected %d, got %d", tt.length, tt.size, tt.want, got)
+		}
+	}
+}
+
+// TestExtractPercentages verifies percentages and crop select the same pixels as
+// the absolute region
+func TestExtractPercentages(t *testing.T) {
+	src := createGradientPNG(200, 100)
+	decode := func(data []byte) image.Image {
+		t.Helper()
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	absolute := decode(encodeGet(t, src, "f=png&extract=50_25_100_50"))
+	if size := absolute.Bounds().Size(); size != image.Pt(100, 50) {
+		t.Fatalf("expected 100x50, got %v", size)
+	}
+	for _, query := range []string{"extract=25p_25p_50p_50p", "crop=100x50", "extract=50_25p_50p_50"} {
+		img := decode(encodeGet(t, src, "f=png&"+query))
+		if img.Bounds().Size() != absolute.Bounds().Size() {
+			t.Errorf("%s: expected %v, got %v", query, absolute.Bounds().Size(), img.Bounds().Size())
+			continue
+		}
+		if diff := meanDiff(img, absolute); diff != 0 {
+			t.Errorf("%s: differs from the absolute region by %.2f", query, diff)
+		}
+	}
+
+	// Past the edges is cut to the image
+	if size := decode(encodeGet(t, src, "f=png&extract=150_50_100_100")).Bounds().Size(); size != image.Pt(50, 50) {
+		t.Errorf("expected the region clamped to 50x50, got %v", size)
+	}
+	if size := decode(encodeGet(t, src, "f=png&crop=400x80")).Bounds().Size(); size != image.Pt(200, 80) {
+		t.Errorf("expected the crop clamped to 200x80, got %v", size)
+	}
+}
+
+// TestExtractBounds verifies regions outside the image are 400s under StrictParams
+// and when nothing of them is left
+func TestExtractBounds(t *testing.T) {
+	src := createGradientPNG(200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	status := func(config *ipxpress.Config, query string) int {
+		t.Helper()
+		handler := ipxpress.NewHandler(config)
+		defer handler.Close()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?f=png&"+query+"&url="+url.QueryEscape(origin.URL+"/a.png"), nil))
+		return rec.Code
+	}
+	strict := ipxpress.DefaultConfig()
+	strict.StrictParams = true
+	for _, tt := range []struct {
+		config *ipxpress.Config
+		query  string
+		want   int
+	}{
+		{strict, "extract=0_0_200_100", http.StatusOK},
+		{strict, "extract=150_50_100_100", http.StatusBadRequest},
+		{strict, "extract=0_0_101p_50p", http.StatusBadRequest},
+		{strict, "crop=100x101", http.StatusBadRequest},
+		{ipxpress.DefaultConfig(), "extract=300_0_10_10", http.StatusBadRequest},
+		{ipxpress.DefaultConfig(), "extract=0_0_0_10", http.StatusBadRequest},
+	} {
+		if got := status(tt.config, tt.query); got != tt.want {
+			t.Errorf("%s (strict %t): expected %d, got %d", tt.query, tt.config.StrictParams, tt.want, got)
+		}
+	}
+}
+
+// TestExtractAfterOrient verifies percentages are of the upright image
+func TestExtractAfterOrient(t *testing.T) {
+	src := createRotatedJPEG(t, 400, 200)
+	img, _, err := image.Decode(bytes.NewReader(encodeGet(t, src, "f=png&extract=0_0_100p_50p")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(200, 200) {
+		t.Fatalf("expected the top half of the 200x400 upright image, got %v", size)
+	}
+	if r, _, b, _ := img.At(100, 190).RGBA(); r < 0xC000 || b > 0x4000 {
+		t.Error("expected the top half all red")
+	}
+}
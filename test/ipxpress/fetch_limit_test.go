@@ -0,0 +1,116 @@
+package ipxpress_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// peakOrigin answers after delay, or once release is closed, tracking the peak of concurrent requests
+func peakOrigin(t *testing.T, delay time.Duration, release chan struct{}, active, peak *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-release:
+		}
+		w.Write([]byte("\x89PNG\r\n\x1a\nsource"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestFetchLimit verifies a burst of misses keeps at most FetchLimit upstream requests open
+func TestFetchLimit(t *testing.T) {
+	var active, peak atomic.Int32
+	origin := peakOrigin(t, 50*time.Millisecond, nil, &active, &peak)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.ProcessingLimit = 8
+	config.FetchLimit = 3
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for i := 0; i < 24; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			target := "/?url=" + url.QueryEscape(fmt.Sprintf("%s/photo-%d.png", origin.URL, i))
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK {
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := failed.Load(); n != 0 {
+		t.Errorf("expected every request served, %d failed", n)
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("expected at most 3 concurrent origin requests, saw %d", p)
+	}
+	if stats := handler.FetcherStats(); stats.Active != 0 || stats.Limit != 3 || stats.Requests != 24 {
+		t.Errorf("unexpected stats after the burst %+v", stats)
+	}
+}
+
+// TestFetchQueueTimeout verifies requests waiting too long for a fetch slot get 503
+func TestFetchQueueTimeout(t *testing.T) {
+	var active, peak atomic.Int32
+	release := make(chan struct{})
+	origin := peakOrigin(t, time.Minute, release, &active, &peak)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.FetchLimit = 1
+	config.FetchQueueTimeout = 50 * time.Millisecond
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	get := func(name string) int {
+		rec := httptest.NewRecorder()
+		target := "/?url=" + url.QueryEscape(origin.URL+"/"+name)
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+	first := make(chan int)
+	go func() { first <- get("slow.png") }()
+	for active.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if stats := handler.FetcherStats(); stats.Active != 1 || stats.Limit != 1 {
+		t.Errorf("expected the one slot in use, got %+v", stats)
+	}
+	if code := get("queued.png"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after the queue timeout, got %d", code)
+	}
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("expected the slow fetch served, got %d", code)
+	}
+	if stats := handler.FetcherStats(); stats.Rejected != 1 || stats.Active != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if code := get("queued.png"); code != http.StatusOK {
+		t.Errorf("expected the 503 not cached, got %d", code)
+	}
+}
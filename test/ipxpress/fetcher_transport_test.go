@@ -0,0 +1,129 @@
+package ipxpress_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// tlsOrigin serves a PNG over TLS with httptest's self-signed certificate
+func tlsOrigin(t *testing.T, maxVersion uint16) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\nsource"))
+	}))
+	server.TLS = &tls.Config{MaxVersion: maxVersion}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestFetcherTLSSettings verifies private CAs, skipped verification and the minimum version
+func TestFetcherTLSSettings(t *testing.T) {
+	origin := tlsOrigin(t, 0)
+	fetch := func(config *ipxpress.FetcherConfig) error {
+		config.MaxAttempts = 1
+		_, err := ipxpress.NewFetcherWithConfig(config).Fetch(origin.URL + "/photo.png")
+		return err
+	}
+
+	if err := fetch(ipxpress.DefaultFetcherConfig()); err == nil {
+		t.Error("expected the self-signed certificate rejected with the system roots")
+	}
+
+	trusted := ipxpress.DefaultFetcherConfig()
+	trusted.RootCAs = x509.NewCertPool()
+	trusted.RootCAs.AddCert(origin.Certificate())
+	if err := fetch(trusted); err != nil {
+		t.Errorf("expected the certificate trusted via RootCAs, got %v", err)
+	}
+
+	insecure := ipxpress.DefaultFetcherConfig()
+	insecure.InsecureSkipVerify = true
+	if err := fetch(insecure); err != nil {
+		t.Errorf("expected InsecureSkipVerify to accept the certificate, got %v", err)
+	}
+
+	legacy := tlsOrigin(t, tls.VersionTLS12)
+	strict := ipxpress.DefaultFetcherConfig()
+	strict.MaxAttempts = 1
+	strict.InsecureSkipVerify = true
+	strict.MinTLSVersion = tls.VersionTLS13
+	if _, err := ipxpress.NewFetcherWithConfig(strict).Fetch(legacy.URL + "/photo.png"); err == nil {
+		t.Error("expected a TLS 1.2 origin rejected with MinTLSVersion 1.3")
+	}
+}
+
+// TestFetcherProxy verifies origin requests go through an authenticated proxy
+func TestFetcherProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Basic " + base64.StdEncoding.EncodeToString([]byte("egress:secret"))
+		if r.Header.Get("Proxy-Authorization") != want {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		proxied = append(proxied, r.URL.String())
+		w.Write([]byte("\x89PNG\r\n\x1a\nvia proxy"))
+	}))
+	defer proxy.Close()
+
+	config := ipxpress.DefaultFetcherConfig()
+	config.ProxyURL = "http://egress:secret@" + strings.TrimPrefix(proxy.URL, "http://")
+	data, err := ipxpress.NewFetcherWithConfig(config).Fetch("http://origin.internal/photo.png")
+	if err != nil || !strings.HasSuffix(string(data), "via proxy") {
+		t.Fatalf("expected the response from the proxy, got %q, %v", data, err)
+	}
+	if len(proxied) != 1 || proxied[0] != "http://origin.internal/photo.png" {
+		t.Errorf("expected the origin URL requested from the proxy, got %v", proxied)
+	}
+
+	config.ProxyURL = "://bad"
+	config.MaxAttempts = 1
+	if _, err := ipxpress.NewFetcherWithConfig(config).Fetch("http://origin.internal/photo.png"); err == nil {
+		t.Error("expected an invalid proxy URL to fail the fetch")
+	}
+}
+
+// TestLoadConfigFetcherTLS verifies the file settings for proxies and TLS
+func TestLoadConfigFetcherTLS(t *testing.T) {
+	origin := tlsOrigin(t, 0)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: origin.Certificate().Raw}), 0o644)
+
+	config, err := ipxpress.LoadConfig(writeConfig(t, `{"fetcher": {
+		"proxy_url": "http://proxy.internal:3128",
+		"root_ca_file": "`+caFile+`",
+		"min_tls_version": "1.2"
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Fetcher.ProxyURL != "http://proxy.internal:3128" || config.Fetcher.MinTLSVersion != tls.VersionTLS12 || config.Fetcher.RootCAs == nil {
+		t.Fatalf("unexpected fetcher config %+v", config.Fetcher)
+	}
+	config.Fetcher.ProxyURL = ""
+	if _, err := ipxpress.NewFetcherWithConfig(config.Fetcher).Fetch(origin.URL + "/photo.png"); err != nil {
+		t.Errorf("expected the origin trusted via root_ca_file, got %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"fetcher": {"root_ca_file": "` + filepath.Join(dir, "missing.pem") + `"}}`,
+		`{"fetcher": {"min_tls_version": "1.4"}}`,
+		`{"fetcher": {"proxy_url": "proxy.internal"}}`,
+	} {
+		if _, err := ipxpress.LoadConfig(writeConfig(t, bad)); err == nil || !strings.Contains(err.Error(), "fetcher.") {
+			t.Errorf("%s: expected an error naming the setting, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package ipxpress_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestFetchErrorKinds verifies each failure is classified, matches its sentinel and keeps its cause
+func TestFetchErrorKinds(t *testing.T) {
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	config := ipxpress.DefaultFetcherConfig()
+	config.MaxAttempts = 1
+	config.Timeout = 50 * time.Millisecond
+	fetcher := ipxpress.NewFetcherWithConfig(config)
+	blocking := ipxpress.NewFetcherWithConfig(config)
+	blocking.AllowedHosts = []string{"cdn.example.com"}
+
+	tests := []struct {
+		name     string
+		fetcher  *ipxpress.Fetcher
+		url      string
+		kind     ipxpress.FetchErrorKind
+		sentinel error
+		status   int
+	}{
+		{"invalid URL", fetcher, "ftp://example.com/a.png", ipxpress.ErrKindInvalidURL, ipxpress.ErrFetchInvalidURL, http.StatusBadRequest},
+		{"blocked host", blocking, missing.URL + "/a.png", ipxpress.ErrKindBlockedHost, ipxpress.ErrFetchBlockedHost, http.StatusForbidden},
+		{"origin 404", fetcher, missing.URL + "/a.png", ipxpress.ErrKindStatus, ipxpress.ErrFetchStatus, http.StatusNotFound},
+		{"origin 500", fetcher, broken.URL + "/a.png", ipxpress.ErrKindStatus, ipxpress.ErrFetchStatus, http.StatusBadGateway},
+		{"timeout", fetcher, slow.URL + "/a.png", ipxpress.ErrKindTimeout, ipxpress.ErrFetchTimeout, http.StatusGatewayTimeout},
+		{"connection refused", fetcher, closed.URL + "/a.png", ipxpress.ErrKindNetwork, ipxpress.ErrFetchNetwork, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.fetcher.Fetch(tt.url)
+			var fetchErr *ipxpress.FetchError
+			if !errors.As(err, &fetchErr) {
+				t.Fatalf("expected a FetchError, got %v", err)
+			}
+			if fetchErr.Kind != tt.kind || !errors.Is(err, tt.sentinel) {
+				t.Errorf("expected kind %q, got %q: %v", tt.kind, fetchErr.Kind, err)
+			}
+			if errors.Is(err, ipxpress.ErrFetchDNS) {
+				t.Error("expected only the sentinel of its own kind to match")
+			}
+			if got := fetchErr.ResponseStatus(); got != tt.status {
+				t.Errorf("expected to answer %d, got %d", tt.status, got)
+			}
+		})
+	}
+
+	// The origin's own status is kept for callers
+	var fetchErr *ipxpress.FetchError
+	if _, err := fetcher.Fetch(broken.URL + "/a.png"); !errors.As(err, &fetchErr) || fetchErr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected the origin's 500 in StatusCode, got %v", err)
+	}
+	// The cause is wrapped
+	var opErr *net.OpError
+	if _, err := fetcher.Fetch(closed.URL + "/a.png"); !errors.As(err, &opErr) {
+		t.Errorf("expected the *net.OpError to be unwrapped, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := fetcher.FetchReserved(ctx, missing.URL+"/a.png")
+	if !errors.Is(err, ipxpress.ErrFetchCanceled) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled fetch wrapping context.Canceled, got %v", err)
+	}
+}
+
+// TestFetchErrorResponseStatus verifies the handler answers per kind and caches only lasting failures
+func TestFetchErrorResponseStatus(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/missing.png":
+			http.NotFound(w, r)
+		case "/down.png":
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+		case "/slow.png":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+	}))
+	defer origin.Close()
+	fetcherConfig := ipxpress.DefaultFetcherConfig()
+	fetcherConfig.MaxAttempts = 1
+	fetcherConfig.Timeout = 50 * time.Millisecond
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Fetcher = fetcherConfig
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		cached bool
+	}{
+		{"/missing.png", http.StatusNotFound, true},
+		{"/down.png", http.StatusBadGateway, false},
+		{"/slow.png", http.StatusGatewayTimeout, false},
+	} {
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+sourceQuery(origin.URL+tt.path, "w=10"), nil))
+			if rec.Code != tt.status {
+				t.Errorf("%s: expected %d, got %d: %s", tt.path, tt.status, rec.Code, rec.Body)
+			}
+		}
+		want := int32(2)
+		if tt.cached {
+			want = 1
+		}
+		if got := hits.Swap(0); got != want {
+			t.Errorf("%s: expected %d origin requests for two client requests, got %d", tt.path, want, got)
+		}
+	}
+}
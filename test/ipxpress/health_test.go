@@ -0,0 +1,138 @@
+package ipxpress_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// downCache is a cache whose backend doesn't answer
+type downCache struct {
+	*ipxpress.InMemoryCache
+}
+
+func (c downCache) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func healthHandler(t *testing.T, configure func(*ipxpress.Config), opts ...ipxpress.HandlerOption) *ipxpress.Handler {
+	t.Helper()
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	if configure != nil {
+		configure(config)
+	}
+	handler := ipxpress.NewHandler(config, opts...)
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// readiness returns the failed checks of Ready, failing the test if it passed
+func readiness(t *testing.T, handler *ipxpress.Handler) map[string]error {
+	t.Helper()
+	var notReady *ipxpress.ReadinessError
+	if err := handler.Ready(context.Background()); !errors.As(err, &notReady) {
+		t.Fatalf("expected a ReadinessError, got %v", err)
+	}
+	return notReady.Failed
+}
+
+// TestReady verifies a working handler is ready and /ready says so for every check
+func TestReady(t *testing.T) {
+	src := createSolidPNG(2, 2, color.RGBA{A: 255})
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer canary.Close()
+	handler := healthHandler(t, func(c *ipxpress.Config) { c.ReadinessCanaryURL = canary.URL + "/canary.png" })
+
+	if err := handler.Ready(context.Background()); err != nil {
+		t.Fatalf("expected ready, got %v", err)
+	}
+	rec := httptest.NewRecorder()
+	handler.Health().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var report struct {
+		Status string
+		Checks map[string]string
+	}
+	json.NewDecoder(rec.Body).Decode(&report)
+	if rec.Code != http.StatusOK || report.Status != "ready" {
+		t.Fatalf("expected 200 ready, got %d %q", rec.Code, report.Status)
+	}
+	for _, name := range []string{"vips", "canary", "shutdown"} {
+		if report.Checks[name] != "ok" {
+			t.Errorf("expected %s ok, got %q", name, report.Checks[name])
+		}
+	}
+}
+
+// TestReadyCacheDown verifies a cache backend that doesn't answer makes the handler unready
+func TestReadyCacheDown(t *testing.T) {
+	cache := downCache{ipxpress.NewInMemoryCache(time.Minute, 10)}
+	handler := healthHandler(t, nil, ipxpress.WithCache(cache))
+
+	failed := readiness(t, handler)
+	if err := failed["cache"]; err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected the cache check to fail, got %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.Health().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	var report struct {
+		Status string
+		Checks map[string]string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != "not ready" || report.Checks["cache"] != "connection refused" {
+		t.Errorf("expected the cache failure in the report, got %+v", report)
+	}
+	if _, ok := report.Checks["canary"]; ok {
+		t.Error("expected no canary check without ReadinessCanaryURL")
+	}
+}
+
+// TestReadyCanary verifies an unreachable or broken canary source makes the handler unready
+func TestReadyCanary(t *testing.T) {
+	handler := healthHandler(t, func(c *ipxpress.Config) { c.ReadinessCanaryURL = "http://origin.test/missing.png" },
+		ipxpress.WithFetcher(&stubFetcher{}))
+	var fetchErr *ipxpress.FetchError
+	if err := readiness(t, handler)["canary"]; !errors.As(err, &fetchErr) || fetchErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected the canary's 404, got %v", err)
+	}
+
+	handler = healthHandler(t, func(c *ipxpress.Config) { c.ReadinessCanaryURL = "http://origin.test/page.html" },
+		ipxpress.WithFetcher(&stubFetcher{data: []byte("<html></html>")}))
+	if err := readiness(t, handler)["canary"]; err == nil {
+		t.Error("expected a canary that isn't an image to fail")
+	}
+}
+
+// TestReadyShutdown verifies a handler stops being ready once shutting down while staying live
+func TestReadyShutdown(t *testing.T) {
+	handler := healthHandler(t, nil)
+	if err := handler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := readiness(t, handler)["shutdown"]; err == nil {
+		t.Error("expected the shutdown check to fail")
+	}
+
+	rec := httptest.NewRecorder()
+	handler.Health().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/live", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /live to answer 200, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,133 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// ftyp builds the start of an ISO-BMFF file with the given major and compatible brands
+func ftyp(major string, compatible ...string) []byte {
+	box := []byte{0, 0, 0, byte(16 + 4*len(compatible))}
+	box = append(box, "ftyp"+major+"\x00\x00\x00\x00"...)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, "\x00\x00\x00\x08meta"...)
+}
+
+// TestDetectHEIF verifies HEIF is told apart from AVIF by the ftyp brands
+func TestDetectHEIF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want ipxpress.Format
+	}{
+		{"heic major", ftyp("heic", "mif1", "heic"), ipxpress.FormatHEIF},
+		{"heix major", ftyp("heix", "mif1", "heix"), ipxpress.FormatHEIF},
+		{"mif1 with heic", ftyp("mif1", "mif1", "heic"), ipxpress.FormatHEIF},
+		{"mif1 with avif", ftyp("mif1", "mif1", "avif", "miaf"), ipxpress.FormatAVIF},
+		{"avif major", ftyp("avif", "mif1", "avif"), ipxpress.FormatAVIF},
+		{"mif1 alone", ftyp("mif1", "mif1"), ""},
+		{"mp4", ftyp("isom", "isom", "mp41"), ""},
+	}
+	for _, tt := range tests {
+		if got := ipxpress.DetectFormat(tt.data); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestHEIFFormat verifies heif and heic are accepted as output and HEIF sources default to JPEG
+func TestHEIFFormat(t *testing.T) {
+	for _, name := range []string{"heif", "heic", "HEIC"} {
+		if f, err := ipxpress.LookupFormat(name); err != nil || f != ipxpress.FormatHEIF {
+			t.Errorf("LookupFormat(%q) = %q, %v", name, f, err)
+		}
+	}
+	if ct := ipxpress.FormatHEIF.ContentType(); ct != "image/heif" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	p := parseQuery(t, "/?url=https://example.com/a.heic")
+	if !p.NeedsProcessing(ipxpress.FormatHEIF) {
+		t.Error("HEIF sources should be converted even without parameters")
+	}
+	if format, source := p.ResolveOutputFormat(ipxpress.FormatHEIF); format != ipxpress.FormatJPEG || source != ipxpress.FormatSourceCompat {
+		t.Errorf("expected jpeg from compat, got %s from %s", format, source)
+	}
+	if format := parseQuery(t, "/?url=https://example.com/a.heic&f=webp").GetOutputFormat(ipxpress.FormatHEIF); format != ipxpress.FormatWebP {
+		t.Errorf("expected the requested webp, got %s", format)
+	}
+	if parseQuery(t, "/?url=https://example.com/a.heic&f=heic").NeedsProcessing(ipxpress.FormatHEIF) {
+		t.Error("HEIF requested from a HEIF source needs no processing")
+	}
+}
+
+// TestHEIFOutputUnsupportedReturns415 verifies asking for HEIF from a build without the encoder gets 415
+func TestHEIFOutputUnsupportedReturns415(t *testing.T) {
+	src := createSolidPNG(20, 20, color.RGBA{R: 255, A: 255})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.png") + "&f=heic")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "heif output") {
+		t.Errorf("body should name the missing heif encoder: %q", body)
+	}
+
+	_, err = handler.RenderSet(src, []ipxpress.VariantSpec{{Name: "a", Query: "f=heif"}})
+	if variantErr, ok := err.(*ipxpress.VariantError); !ok || variantErr.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("expected a 415 VariantError, got %v", err)
+	}
+}
+
+// TestHEIFRoundTrip encodes HEIF and converts it back to JPEG, if the build has libheif with an encoder
+func TestHEIFRoundTrip(t *testing.T) {
+	caps := ipxpress.DetectCapabilities()
+	if !caps.CanSave(ipxpress.FormatHEIF) || !caps.CanLoad("heif") {
+		t.Skip("libvips was built without HEIF encoding")
+	}
+
+	heif := encodeGet(t, createTestImage(64, 48), "f=heif&q=70")
+	if f := ipxpress.DetectFormat(heif); f != ipxpress.FormatHEIF {
+		t.Fatalf("expected HEIF output, got %q", f)
+	}
+
+	// Without parameters the HEIF source is converted for browsers
+	out := encodeGet(t, heif, "w=32")
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("expected JPEG output, got %v", err)
+	}
+	if cfg.Width != 32 || cfg.Height != 24 {
+		t.Errorf("expected 32x24, got %dx%d", cfg.Width, cfg.Height)
+	}
+	if f := ipxpress.DetectFormat(encodeGet(t, heif, "")); f != ipxpress.FormatJPEG {
+		t.Errorf("expected an unparameterized HEIF source to be served as JPEG, got %q", f)
+	}
+}
@@ -0,0 +1,159 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestPreProcessorCapsWidth verifies a pre-processor sees the source and its
+// changes to params reach the built-in resize
+func TestPreProcessorCapsWidth(t *testing.T) {
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	var sourceWidth int
+	handler.UsePreProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		sourceWidth = proc.Width()
+		params.Width = min(params.Width, proc.Width()/2)
+		return proc
+	})
+
+	src := createGradientPNG(120, 80)
+	for _, tt := range []struct {
+		width int
+		want  image.Point
+	}{
+		{100, image.Pt(60, 40)},
+		{30, image.Pt(30, 20)},
+	} {
+		params := &ipxpress.ProcessingParams{Width: tt.width, Format: ipxpress.FormatPNG}
+		pl, err := handler.NewPipeline(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _, err := pl.Run(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != tt.want {
+			t.Errorf("w=%d: expected %v, got %v", tt.width, tt.want, size)
+		}
+		if sourceWidth != 120 {
+			t.Errorf("expected the pre-processor to see the 120px source, got %d", sourceWidth)
+		}
+		if pl.Params().Width != tt.width || params.Width != tt.width {
+			t.Error("expected the pipeline's params left alone")
+		}
+	}
+}
+
+// TestHookOrder verifies pre-processors, built-ins, processors and encoders run in that order
+func TestHookOrder(t *testing.T) {
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	var order []string
+	record := func(stage string) ipxpress.ProcessorFunc {
+		return func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+			order = append(order, stage+":"+strconv.Itoa(proc.Width()))
+			return proc
+		}
+	}
+	handler.UseProcessor(record("processor"))
+	handler.UsePreProcessor(record("pre"))
+	handler.UseEncoder(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams, enc *ipxpress.Encoding) *ipxpress.Processor {
+		order = append(order, "encoder:"+string(enc.Format))
+		return proc
+	})
+
+	pl, err := handler.NewPipeline(&ipxpress.ProcessingParams{Width: 50, Format: ipxpress.FormatPNG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pl.Run(createGradientPNG(90, 60)); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, ","); got != "pre:90,processor:50,encoder:png" {
+		t.Errorf("unexpected order %s", got)
+	}
+}
+
+// TestEncoderOverride verifies an encoder hook can change the format and quality
+func TestEncoderOverride(t *testing.T) {
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	handler.UseEncoder(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams, enc *ipxpress.Encoding) *ipxpress.Processor {
+		if enc.Format == ipxpress.FormatJPEG && enc.Options.Quality > 50 {
+			enc.Format = ipxpress.FormatPNG
+		}
+		return proc
+	})
+	src := createGradientPNG(64, 64)
+
+	for _, tt := range []struct {
+		quality int
+		want    ipxpress.Format
+	}{
+		{80, ipxpress.FormatPNG},
+		{40, ipxpress.FormatJPEG},
+	} {
+		pl, err := handler.NewPipeline(&ipxpress.ProcessingParams{Width: 32, Format: ipxpress.FormatJPEG, Quality: tt.quality})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, format, err := pl.Run(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != tt.want {
+			t.Errorf("q=%d: expected %s, got %s", tt.quality, tt.want, format)
+		}
+	}
+}
+
+// TestHookErrors verifies errors recorded by hooks fail the request like processing errors
+func TestHookErrors(t *testing.T) {
+	fail := func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		return proc.ApplyFunc(func(*vips.ImageRef) error { return errors.New("hook failed") })
+	}
+	for name, register := range map[string]func(*ipxpress.Handler){
+		"pre-processor": func(h *ipxpress.Handler) { h.UsePreProcessor(fail) },
+		"encoder": func(h *ipxpress.Handler) {
+			h.UseEncoder(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams, enc *ipxpress.Encoding) *ipxpress.Processor {
+				return fail(proc, params)
+			})
+		},
+	} {
+		handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+		register(handler)
+		var failed bool // seen by the processor after the built-ins
+		handler.UseProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+			failed = proc.Err() != nil
+			return proc
+		})
+		pl, err := handler.NewPipeline(&ipxpress.ProcessingParams{Width: 10, Format: ipxpress.FormatPNG})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = pl.Run(createGradientPNG(20, 20))
+		var perr *ipxpress.ProcessError
+		if !errors.As(err, &perr) || perr.StatusCode != http.StatusInternalServerError || !strings.Contains(perr.Message, "hook failed") {
+			t.Errorf("%s: expected a 500 naming the error, got %v", name, err)
+		}
+		if failed != (name == "pre-processor") {
+			t.Errorf("%s: processor saw error=%t", name, failed)
+		}
+		handler.Close()
+	}
+}
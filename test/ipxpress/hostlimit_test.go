@@ -0,0 +1,144 @@
+package ipxpress_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// countingOrigin serves src after delay, recording the most requests it had in flight at once
+func countingOrigin(t *testing.T, src []byte, delay time.Duration) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var inFlight, peak atomic.Int64
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	t.Cleanup(origin.Close)
+	return origin, &peak
+}
+
+// TestMaxConcurrentPerHost verifies 100 parallel client requests for distinct images never exceed the per-host ceiling
+func TestMaxConcurrentPerHost(t *testing.T) {
+	src := createSolidPNG(4, 4, color.RGBA{G: 200, A: 255})
+	origin, peak := countingOrigin(t, src, 20*time.Millisecond)
+	fetcherConfig := ipxpress.DefaultFetcherConfig()
+	fetcherConfig.MaxConcurrentPerHost = 4
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Fetcher = fetcherConfig
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			target := "/?url=" + url.QueryEscape(fmt.Sprintf("%s/%d.png", origin.URL, i))
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK {
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		t.Errorf("expected every request to be served, %d failed", n)
+	}
+	if got := peak.Load(); got > 4 || got < 2 {
+		t.Errorf("expected at most 4 requests at once at the origin, got %d", got)
+	}
+}
+
+// TestHostQueueTimeout verifies a request waiting too long for the host gets 503 while other hosts aren't held up
+func TestHostQueueTimeout(t *testing.T) {
+	src := createSolidPNG(2, 2, color.RGBA{A: 255})
+	slow, _ := countingOrigin(t, src, 300*time.Millisecond)
+	fast, _ := countingOrigin(t, src, 0)
+	config := ipxpress.DefaultFetcherConfig()
+	config.MaxConcurrentPerHost = 1
+	config.HostQueueTimeout = 50 * time.Millisecond
+	fetcher := ipxpress.NewFetcherWithConfig(config)
+
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		fetcher.Fetch(slow.URL + "/a.png")
+	}()
+	deadline := time.Now().Add(time.Second)
+	for len(fetcher.HostsInFlight()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := fetcher.HostsInFlight()[slow.Listener.Addr().String()]; got != 1 {
+		t.Fatalf("expected 1 request in flight to the slow origin, got %v", fetcher.HostsInFlight())
+	}
+
+	if _, err := fetcher.Fetch(fast.URL + "/b.png"); err != nil {
+		t.Errorf("expected another host to be fetched meanwhile, got %v", err)
+	}
+	var fetchErr *ipxpress.FetchError
+	if _, err := fetcher.Fetch(slow.URL + "/c.png"); !errors.As(err, &fetchErr) || fetchErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 past the host queue timeout, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := fetcher.FetchReserved(ctx, slow.URL+"/d.png"); !errors.As(err, &fetchErr) || fetchErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 for a canceled request, got %v", err)
+	}
+
+	<-held
+	if n := len(fetcher.HostsInFlight()); n != 0 {
+		t.Errorf("expected nothing in flight once done, got %v", fetcher.HostsInFlight())
+	}
+}
+
+// TestRateLimitPerHost verifies requests past the burst are spaced out by the rate
+func TestRateLimitPerHost(t *testing.T) {
+	src := createSolidPNG(2, 2, color.RGBA{A: 255})
+	origin, _ := countingOrigin(t, src, 0)
+	config := ipxpress.DefaultFetcherConfig()
+	config.RateLimitPerHost = 20
+	fetcher := ipxpress.NewFetcherWithConfig(config)
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		if _, err := fetcher.Fetch(fmt.Sprintf("%s/%d.png", origin.URL, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A burst of 20, then 10 more at 20 per second
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected 30 requests at 20/s with a burst of 20 to take about 500ms, took %s", elapsed)
+	}
+
+	config.HostQueueTimeout = 10 * time.Millisecond
+	fetcher = ipxpress.NewFetcherWithConfig(config)
+	var rejected int
+	for i := 0; i < 25; i++ {
+		var fetchErr *ipxpress.FetchError
+		if _, err := fetcher.Fetch(fmt.Sprintf("%s/%d.png", origin.URL, i)); errors.As(err, &fetchErr) && fetchErr.StatusCode == http.StatusServiceUnavailable {
+			rejected++
+		}
+	}
+	if rejected == 0 {
+		t.Error("expected requests that would wait past the host queue timeout to get 503")
+	}
+}
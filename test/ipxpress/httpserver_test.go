@@ -0,0 +1,210 @@
+package ipxpress_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// writeSelfSignedPair writes a certificate for 127.0.0.1 and its key to dir
+func writeSelfSignedPair(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ipxpress test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+// TestNewServerTLS verifies a server with a certificate answers HTTPS over HTTP/2
+func TestNewServerTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedPair(t, t.TempDir())
+	srv, err := ipxpress.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}), ipxpress.ServerOptions{
+		TLSCertFile:  certFile,
+		TLSKeyFile:   keyFile,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+}
+
+// TestNewServerOptions verifies timeouts are applied and bad TLS settings refused
+func TestNewServerOptions(t *testing.T) {
+	srv, err := ipxpress.NewServer(http.NotFoundHandler(), ipxpress.ServerOptions{
+		Addr: ":8080", ReadTimeout: time.Second, WriteTimeout: 2 * time.Second, IdleTimeout: 3 * time.Second, MaxHeaderBytes: 4096,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	if srv.TLSConfig != nil || srv.ReadTimeout != time.Second || srv.WriteTimeout != 2*time.Second ||
+		srv.IdleTimeout != 3*time.Second || srv.MaxHeaderBytes != 4096 {
+		t.Errorf("options not applied: %+v", srv)
+	}
+
+	certFile, keyFile, _ := writeSelfSignedPair(t, t.TempDir())
+	for name, opts := range map[string]ipxpress.ServerOptions{
+		"cert only":    {TLSCertFile: certFile},
+		"key only":     {TLSKeyFile: keyFile},
+		"missing file": {TLSCertFile: certFile, TLSKeyFile: keyFile + ".missing"},
+		"swapped":      {TLSCertFile: keyFile, TLSKeyFile: certFile},
+	} {
+		if _, err := ipxpress.NewServer(http.NotFoundHandler(), opts); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// shortTempDir returns a temporary directory short enough for a socket path
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets with file permissions are not supported here")
+	}
+	dir, err := os.MkdirTemp("", "ipx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// TestListenUnix verifies serving over a unix socket, its permissions and cleanup
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "ipx.sock")
+
+	// A socket left behind by a crashed run
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ipxpress.ListenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("ListenUnix over a stale socket: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o660 {
+		t.Errorf("expected mode 0660, got %o", perm)
+	}
+	if _, err := ipxpress.ListenUnix(path, 0o660); err == nil {
+		t.Error("expected a socket in use to be refused")
+	}
+
+	srv, err := ipxpress.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}), ipxpress.ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://ipxpress/health")
+	if err != nil {
+		t.Fatalf("request over the socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the socket removed on shutdown, got %v", err)
+	}
+}
+
+// TestListenUnixKeepsOtherFiles verifies a regular file at the path is left alone
+func TestListenUnixKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(shortTempDir(t), "ipx.sock")
+	if err := os.WriteFile(path, []byte("not a socket"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipxpress.ListenUnix(path, 0o660); err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "not a socket" {
+		t.Errorf("expected the file untouched, got %q %v", data, err)
+	}
+}
@@ -0,0 +1,78 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// TestInfoParam verifies info=true is parsed and keyed on the source alone
+func TestInfoParam(t *testing.T) {
+	info := parseQuery(t, "/?url=https://example.com/a.png&info=true")
+	if !info.Info {
+		t.Fatal("expected info mode")
+	}
+	image := parseQuery(t, "/?url=https://example.com/a.png")
+	if ipxpress.GenerateCacheKey(info) == ipxpress.GenerateCacheKey(image) {
+		t.Error("info should be cached apart from the image")
+	}
+	if ipxpress.GenerateCacheKey(info) != ipxpress.GenerateCacheKey(parseQuery(t, "/?url=https://example.com/a.png&info=1&w=100&f=webp")) {
+		t.Error("other parameters should not change the info key")
+	}
+	if ipxpress.GenerateCacheKey(info) == ipxpress.GenerateCacheKey(parseQuery(t, "/?url=https://example.com/b.png&info=true")) {
+		t.Error("the source should change the info key")
+	}
+	if _, ok := ipxpress.LookupParam(core.ParamInfo); !ok {
+		t.Error("info is not in the registry")
+	}
+}
+
+// TestInfoPNG verifies the JSON returned for a known PNG, by query and by path
+func TestInfoPNG(t *testing.T) {
+	src := createSolidPNG(60, 40, color.RGBA{R: 255, G: 128, A: 128})
+	fetches := 0
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	want := ipxpress.ImageInfo{Width: 60, Height: 40, Format: ipxpress.FormatPNG, Bytes: len(src), HasAlpha: true, Orientation: 0, Pages: 1}
+	source := url.QueryEscape(origin.URL + "/a.png")
+	for _, path := range []string{"/?info=true&url=" + source, "/info?url=" + source} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: unexpected content type %q", path, ct)
+		}
+		var got ipxpress.ImageInfo
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("%s: invalid JSON %q: %v", path, body, err)
+		}
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", path, got, want)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected the second request to be served from cache, got %d fetches", fetches)
+	}
+}
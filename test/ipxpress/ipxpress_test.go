@@ -2,9 +2,12 @@ package ipxpress_test
 
 import (
 	"bytes"
+	"errors"
 	"image"
 	"image/color"
 	"image/png"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
@@ -33,7 +36,7 @@ func TestResizePreservesAspect(t *testing.T) {
 	if err := proc.Err(); err != nil {
 		t.Fatalf("processor error: %v", err)
 	}
-	out, err := proc.ToBytes("png", 0)
+	out, err := proc.ToBytes("png", 85)
 	if err != nil {
 		t.Fatalf("to bytes: %v", err)
 	}
@@ -53,3 +56,96 @@ func TestResizePreservesAspect(t *testing.T) {
 		t.Fatalf("expected height 25, got %d", h)
 	}
 }
+
+// TestProcessorAccessors verifies the accessors follow the chain and are safe without an image
+func TestProcessorAccessors(t *testing.T) {
+	empty := ipxpress.New()
+	if empty.Width() != 0 || empty.Height() != 0 || empty.HasAlpha() || empty.Bands() != 0 || empty.Pages() != 0 {
+		t.Error("expected zero values without an image")
+	}
+	if (empty.Metadata() != ipxpress.ImageMetadata{}) {
+		t.Errorf("expected empty metadata, got %+v", empty.Metadata())
+	}
+
+	proc := ipxpress.New().FromBytes(createSolidPNG(100, 50, color.RGBA{R: 10, G: 20, B: 30, A: 128}))
+	defer proc.Close()
+	if err := proc.Err(); err != nil {
+		t.Fatalf("processor error: %v", err)
+	}
+	want := ipxpress.ImageMetadata{Width: 100, Height: 50, Bands: 4, HasAlpha: true, Pages: 1}
+	if got := proc.Metadata(); got != want {
+		t.Errorf("after load: got %+v, want %+v", got, want)
+	}
+
+	proc.Resize(50, 0)
+	if proc.Width() != 50 || proc.Height() != 25 {
+		t.Errorf("after Resize: expected 50x25, got %dx%d", proc.Width(), proc.Height())
+	}
+	proc.Extract(5, 5, 20, 10)
+	if proc.Width() != 20 || proc.Height() != 10 || !proc.HasAlpha() {
+		t.Errorf("after Extract: got %+v", proc.Metadata())
+	}
+
+	// A failed operation zeroes them rather than describing a stale image
+	proc.Extract(100, 100, 10, 10)
+	if proc.Err() == nil {
+		t.Fatal("expected an out-of-bounds extract to fail")
+	}
+	if proc.Width() != 0 || (proc.Metadata() != ipxpress.ImageMetadata{}) {
+		t.Errorf("expected zero values after an error, got %+v", proc.Metadata())
+	}
+}
+
+// TestToWriterAndToFile verifies both write what ToBytes returns
+func TestToWriterAndToFile(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createSolidPNG(40, 30, color.RGBA{R: 90, G: 160, B: 30, A: 255})).Resize(20, 0)
+	defer proc.Close()
+	want, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	if err != nil {
+		t.Fatalf("to bytes: %v", err)
+	}
+
+	var buf bytes.Buffer
+	n, err := proc.ToWriter(&buf, ipxpress.FormatPNG, 85)
+	if err != nil {
+		t.Fatalf("to writer: %v", err)
+	}
+	if n != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("ToWriter wrote %d bytes, differing from ToBytes' %d", n, len(want))
+	}
+
+	path := filepath.Join(t.TempDir(), "out.png")
+	if err := proc.ToFile(path, ipxpress.FormatPNG, 85); err != nil {
+		t.Fatalf("to file: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read file: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(got))
+	if err != nil || cfg.Width != 20 || cfg.Height != 15 {
+		t.Errorf("expected a 20x15 PNG, got %+v, %v", cfg, err)
+	}
+}
+
+// TestToWriterAndToFileChainError verifies an earlier error is returned and nothing is written
+func TestToWriterAndToFileChainError(t *testing.T) {
+	proc := ipxpress.New().Resize(10, 10)
+	chainErr := proc.Err()
+	if chainErr == nil {
+		t.Fatal("expected resizing without an image to fail")
+	}
+
+	var buf bytes.Buffer
+	if n, err := proc.ToWriter(&buf, ipxpress.FormatPNG, 85); !errors.Is(err, chainErr) || n != 0 || buf.Len() != 0 {
+		t.Errorf("ToWriter: expected the chain error and no output, got %d bytes, %v", n, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "out.png")
+	if err := proc.ToFile(path, ipxpress.FormatPNG, 85); !errors.Is(err, chainErr) {
+		t.Errorf("ToFile: expected the chain error, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("ToFile should not create the file, stat: %v", err)
+	}
+}
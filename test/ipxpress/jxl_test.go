@@ -0,0 +1,102 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestDetectJXL verifies both the bare codestream and the container are detected
+func TestDetectJXL(t *testing.T) {
+	codestream := []byte{0xFF, 0x0A, 0xFA, 0x7F, 0x01, 0x90, 0x08, 0x06, 0x01, 0x00, 0x48, 0x01}
+	container := []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A, 0x00, 0x00, 0x00, 0x14, 'f', 't', 'y', 'p'}
+	for name, data := range map[string][]byte{"codestream": codestream, "container": container} {
+		if f := ipxpress.DetectFormat(data); f != ipxpress.FormatJXL {
+			t.Errorf("%s: DetectFormat = %q, want jxl", name, f)
+		}
+	}
+	if f := ipxpress.DetectFormat([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10, 'J', 'F', 'I', 'F', 0, 1}); f != ipxpress.FormatJPEG {
+		t.Errorf("JPEG detected as %q", f)
+	}
+}
+
+// TestJXLFormat verifies jxl is accepted as output and JXL sources are converted for browsers
+func TestJXLFormat(t *testing.T) {
+	if f, err := ipxpress.LookupFormat("JXL"); err != nil || f != ipxpress.FormatJXL {
+		t.Errorf("LookupFormat(JXL) = %q, %v", f, err)
+	}
+	if ct := ipxpress.FormatJXL.ContentType(); ct != "image/jxl" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !ipxpress.FormatJXL.SupportsAlpha() || !ipxpress.FormatJXL.HasQuality() || ipxpress.FormatJXL.Displayable() {
+		t.Error("JXL keeps alpha and takes a quality, but most browsers can't display it")
+	}
+	if format := parseQuery(t, "/?url=https://example.com/a.jxl").GetOutputFormat(ipxpress.FormatJXL); format != ipxpress.FormatJPEG {
+		t.Errorf("expected JXL sources to default to jpeg, got %s", format)
+	}
+}
+
+// TestJXLOutputUnsupportedReturns415 verifies asking for JXL from a build without libjxl gets 415
+func TestJXLOutputUnsupportedReturns415(t *testing.T) {
+	src := createSolidPNG(20, 20, color.RGBA{G: 255, A: 255})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/a.png") + "&f=jxl")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "jxl output is not supported by this build") {
+		t.Errorf("body should name the missing jxl encoder: %q", body)
+	}
+}
+
+// TestJXLRoundTrip encodes JXL and converts it back to PNG, if the build has libjxl
+func TestJXLRoundTrip(t *testing.T) {
+	if !slices.Contains(ipxpress.SupportedSaveFormats(), ipxpress.FormatJXL) || !ipxpress.DetectCapabilities().CanLoad("jxl") {
+		t.Skip("libvips was built without JPEG XL")
+	}
+
+	src := createSolidPNG(64, 48, color.RGBA{R: 30, G: 90, B: 200, A: 128})
+	jxl := encodeGet(t, src, "f=jxl&q=80")
+	if f := ipxpress.DetectFormat(jxl); f != ipxpress.FormatJXL {
+		t.Fatalf("expected JXL output, got %q", f)
+	}
+	if lossless := encodeGet(t, src, "f=jxl&lossless=true"); ipxpress.DetectFormat(lossless) != ipxpress.FormatJXL {
+		t.Error("expected lossless JXL output")
+	}
+
+	back, err := png.Decode(bytes.NewReader(encodeGet(t, jxl, "f=png&w=32")))
+	if err != nil {
+		t.Fatalf("failed to convert JXL back to PNG: %v", err)
+	}
+	if b := back.Bounds(); b.Dx() != 32 || b.Dy() != 24 {
+		t.Errorf("expected 32x24, got %dx%d", b.Dx(), b.Dy())
+	}
+	if _, _, _, a := back.At(16, 12).RGBA(); a == 0xffff {
+		t.Error("expected the alpha channel to survive")
+	}
+}
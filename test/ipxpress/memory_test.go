@@ -0,0 +1,219 @@
+package ipxpress_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestMemoryAccountantRejectsAndRecovers verifies reservations over the budget time out and fit again after a release
+func TestMemoryAccountantRejectsAndRecovers(t *testing.T) {
+	a := ipxpress.NewMemoryAccountant(100, 30*time.Millisecond)
+
+	release, err := a.Reserve(context.Background(), ipxpress.MemoryFetch, 80)
+	if err != nil {
+		t.Fatalf("first reservation failed: %v", err)
+	}
+	if _, err := a.Reserve(context.Background(), ipxpress.MemoryDecode, 30); !errors.Is(err, ipxpress.ErrMemoryBudget) {
+		t.Fatalf("expected ErrMemoryBudget over the budget, got %v", err)
+	}
+
+	start := time.Now()
+	if _, err := a.Reserve(context.Background(), ipxpress.MemoryDecode, 101); !errors.Is(err, ipxpress.ErrMemoryBudget) {
+		t.Fatalf("expected ErrMemoryBudget above the whole budget, got %v", err)
+	}
+	if time.Since(start) >= 30*time.Millisecond {
+		t.Error("a reservation that can never fit should fail without queueing")
+	}
+
+	stats := a.Stats()
+	if stats.InUse != 80 || stats.Usage[ipxpress.MemoryFetch] != 80 || stats.Rejected != 2 || stats.Waited != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	release()
+	release() // harmless
+	second, err := a.Reserve(context.Background(), ipxpress.MemoryDecode, 30)
+	if err != nil {
+		t.Fatalf("reservation after release failed: %v", err)
+	}
+	second()
+	if stats := a.Stats(); stats.InUse != 0 || stats.Peak != 80 {
+		t.Errorf("expected nothing in use and a peak of 80, got %+v", stats)
+	}
+}
+
+// TestMemoryAccountantWaitsForRelease verifies a queued reservation proceeds once memory is released
+func TestMemoryAccountantWaitsForRelease(t *testing.T) {
+	a := ipxpress.NewMemoryAccountant(100, 2*time.Second)
+	release, err := a.Reserve(context.Background(), ipxpress.MemoryFetch, 80)
+	if err != nil {
+		t.Fatalf("first reservation failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		release, err := a.Reserve(context.Background(), ipxpress.MemoryFetch, 50)
+		if err == nil {
+			release()
+		}
+		done <- err
+	}()
+
+	waitFor(t, func() bool { return a.Stats().Waiting == 1 })
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("queued reservation failed: %v", err)
+	}
+	if stats := a.Stats(); stats.Waited != 1 || stats.Rejected != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// TestMemoryAccountantTracksUsage verifies tracked usage such as the cache counts against the budget
+func TestMemoryAccountantTracksUsage(t *testing.T) {
+	var cacheBytes atomic.Int64
+	cacheBytes.Store(90)
+	a := ipxpress.NewMemoryAccountant(100, 2*time.Second)
+	a.Track(ipxpress.MemoryCache, cacheBytes.Load)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := a.Reserve(ctx, ipxpress.MemoryFetch, 20); !errors.Is(err, ipxpress.ErrMemoryBudget) {
+		t.Fatalf("expected ErrMemoryBudget with a full cache, got %v", err)
+	}
+
+	// Evictions don't release anything; queued reservations notice by polling
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cacheBytes.Store(10)
+	}()
+	release, err := a.Reserve(context.Background(), ipxpress.MemoryFetch, 20)
+	if err != nil {
+		t.Fatalf("reservation after the cache shrank failed: %v", err)
+	}
+	defer release()
+	if stats := a.Stats(); stats.Usage[ipxpress.MemoryCache] != 10 || stats.InUse != 30 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+// TestInMemoryCacheMemoryUsage verifies the cache reports the bytes its entries hold
+func TestInMemoryCacheMemoryUsage(t *testing.T) {
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	defer cache.Close()
+
+	cache.Set("a", &ipxpress.CacheEntry{Data: make([]byte, 4000), StatusCode: http.StatusOK})
+	cache.Set("b", &ipxpress.CacheEntry{Data: make([]byte, 2000), StatusCode: http.StatusOK})
+	if usage := cache.MemoryUsage(); usage < 6000 || usage > 7000 {
+		t.Errorf("expected about 6000 bytes in use, got %d", usage)
+	}
+
+	// Replacing an entry counts only the new one
+	cache.Set("a", &ipxpress.CacheEntry{Data: make([]byte, 1000), StatusCode: http.StatusOK})
+	waitFor(t, func() bool { usage := cache.MemoryUsage(); return usage >= 3000 && usage < 4000 })
+}
+
+// TestMemoryBudgetHandler verifies requests over the budget get 503 while another body is held, and succeed afterwards
+func TestMemoryBudgetHandler(t *testing.T) {
+	const size = 8192
+	body := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, size-8)...)
+	gate := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		if r.URL.Path == "/slow.png" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-gate
+		}
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = newMapCache()
+	config.StreamThreshold = 0
+	config.MemoryBudget = 12000
+	config.MemoryQueueTimeout = 50 * time.Millisecond
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	get := func(path string) int {
+		resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+path))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	slow := make(chan int, 1)
+	go func() { slow <- get("/slow.png") }()
+	waitFor(t, func() bool { return handler.MemoryStats().Usage[ipxpress.MemoryFetch] == size })
+
+	if status := get("/fast.png"); status != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the budget is held, got %d", status)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.Admin().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/memory", nil))
+	var stats ipxpress.MemoryStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode memory stats: %v", err)
+	}
+	if stats.Budget != 12000 || stats.Rejected != 1 || stats.InUse != size {
+		t.Errorf("unexpected memory stats: %+v", stats)
+	}
+
+	close(gate)
+	if status := <-slow; status != http.StatusOK {
+		t.Fatalf("expected the held request to succeed, got %d", status)
+	}
+
+	// The 503 wasn't cached and the budget is free again
+	if status := get("/fast.png"); status != http.StatusOK {
+		t.Errorf("expected 200 after the budget was released, got %d", status)
+	}
+	if stats := handler.MemoryStats(); stats.InUse != 0 {
+		t.Errorf("expected nothing in use after the requests, got %+v", stats)
+	}
+}
+
+// TestMemoryBudgetDisabled verifies the memory endpoint is 404 without a budget
+func TestMemoryBudgetDisabled(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	rec := httptest.NewRecorder()
+	handler.Admin().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/memory", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+// waitFor polls cond for up to a second
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,185 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+const testCopyright = "(c) Test Photographer"
+
+// createEXIFJPEG returns a JPEG with an EXIF segment holding an orientation and a copyright
+func createEXIFJPEG(width, height int, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+		}
+	}
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, img, &jpeg.Options{Quality: 90})
+
+	// Little-endian TIFF with one IFD: Orientation (SHORT) and Copyright (ASCII)
+	text := append([]byte(testCopyright), 0)
+	tiff := new(bytes.Buffer)
+	le := binary.LittleEndian
+	tiff.WriteString("II")
+	binary.Write(tiff, le, uint16(42))
+	binary.Write(tiff, le, uint32(8))
+	binary.Write(tiff, le, uint16(2))
+	binary.Write(tiff, le, [6]uint16{0x0112, 3, 1, 0, orientation, 0}) // tag, type, count (2 words), value
+	binary.Write(tiff, le, [2]uint16{0x8298, 2})
+	binary.Write(tiff, le, uint32(len(text)))
+	binary.Write(tiff, le, uint32(8+2+2*12+4)) // value after the IFD
+	binary.Write(tiff, le, uint32(0))          // no next IFD
+	tiff.Write(text)
+
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := append([]byte{}, plain.Bytes()[:2]...) // SOI
+	out = append(out, 0xFF, 0xE1, byte((len(app1)+2)>>8), byte(len(app1)+2))
+	out = append(out, app1...)
+	return append(out, plain.Bytes()[2:]...)
+}
+
+// readEXIF returns the orientation and copyright from a JPEG's EXIF segment
+func readEXIF(t *testing.T, data []byte) (orientation int, copyright string, found bool) {
+	t.Helper()
+	i := bytes.Index(data, []byte("Exif\x00\x00"))
+	if i < 0 {
+		return 0, "", false
+	}
+	tiff := data[i+6:]
+	var order binary.ByteOrder = binary.LittleEndian
+	if string(tiff[:2]) == "MM" {
+		order = binary.BigEndian
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	n := int(order.Uint16(tiff[ifd:]))
+	for e := 0; e < n; e++ {
+		entry := tiff[ifd+2+12*e:]
+		switch order.Uint16(entry) {
+		case 0x0112:
+			orientation = int(order.Uint16(entry[8:]))
+		case 0x8298:
+			count := int(order.Uint32(entry[4:]))
+			value := entry[8 : 8+count]
+			if count > 4 {
+				off := int(order.Uint32(entry[8:]))
+				value = tiff[off : off+count]
+			}
+			copyright = string(bytes.TrimRight(value, "\x00"))
+		}
+	}
+	return orientation, copyright, true
+}
+
+// TestKeepEXIF verifies keep=exif keeps the orientation and copyright through processing
+func TestKeepEXIF(t *testing.T) {
+	src := createEXIFJPEG(120, 80, 6)
+	if o, c, ok := readEXIF(t, src); !ok || o != 6 || c != testCopyright {
+		t.Fatalf("bad fixture: %d %q %v", o, c, ok)
+	}
+
+	out := encodeGet(t, src, "w=60&keep=exif")
+	orientation, copyright, ok := readEXIF(t, out)
+	if !ok {
+		t.Fatal("expected an EXIF segment with keep=exif")
+	}
+	if orientation != 6 || copyright != testCopyright {
+		t.Errorf("expected orientation 6 and %q, got %d and %q", testCopyright, orientation, copyright)
+	}
+
+	if _, _, ok := readEXIF(t, encodeGet(t, src, "w=60&keep=all")); !ok {
+		t.Error("expected keep=all to keep EXIF")
+	}
+}
+
+// TestMetadataStrippedByDefault verifies processed images lose metadata unless kept
+func TestMetadataStrippedByDefault(t *testing.T) {
+	src := createEXIFJPEG(120, 80, 6)
+	for _, extra := range []string{"w=60", "w=60&keep=icc", "w=60&keep=none", "w=60&keep=exif&strip=true"} {
+		if _, _, ok := readEXIF(t, encodeGet(t, src, extra)); ok {
+			t.Errorf("%s: expected EXIF to be stripped", extra)
+		}
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.KeepMetadata = ipxpress.KeepEXIF
+	if _, _, ok := readEXIF(t, encodeGetWith(t, config, src, "w=60")); !ok {
+		t.Error("expected the server default to keep EXIF")
+	}
+	if _, _, ok := readEXIF(t, encodeGetWith(t, config, src, "w=60&strip=true")); ok {
+		t.Error("expected strip=true to override the server default")
+	}
+}
+
+// TestKeepParameter verifies parsing, conflicts and cache keys of keep and strip
+func TestKeepParameter(t *testing.T) {
+	source := "/?url=" + url.QueryEscape("http://example.com/a.jpg") + "&w=10"
+	keys := map[string]bool{}
+	for _, extra := range []string{"", "&keep=exif", "&keep=ICC", "&keep=all", "&strip=true"} {
+		params := parseQuery(t, source+extra)
+		if err := params.Err(); err != nil {
+			t.Errorf("%s: unexpected error %v", extra, err)
+		}
+		keys[ipxpress.GenerateCacheKey(params)] = true
+	}
+	if len(keys) != 5 {
+		t.Errorf("expected 5 distinct cache keys, got %d", len(keys))
+	}
+
+	if p := parseQuery(t, source+"&keep=icc"); p.Keep != ipxpress.KeepICC || p.KeepMetadata(ipxpress.KeepAll) != ipxpress.KeepICC {
+		t.Errorf("expected keep=icc, got %q", p.Keep)
+	}
+	if p := parseQuery(t, source); p.KeepMetadata(ipxpress.KeepAll) != ipxpress.KeepAll || p.KeepMetadata("") != "" {
+		t.Error("expected the server default without keep=")
+	}
+
+	p := parseQuery(t, source+"&keep=gps")
+	if len(p.Errors) != 1 || p.Errors[0].Param != "keep" || p.Keep != "" {
+		t.Errorf("expected keep=gps to be rejected, got %v", p.Err())
+	}
+
+	p = parseQuery(t, source+"&keep=exif&strip=1")
+	if len(p.Errors) != 1 || p.Errors[0].Param != "keep" || p.Keep != "" || p.KeepMetadata(ipxpress.KeepAll) != ipxpress.KeepNone {
+		t.Errorf("expected strip to win over keep, got %v", p.Err())
+	}
+
+	if parseQuery(t, "/?keep=all").NeedsProcessing(ipxpress.FormatJPEG) {
+		t.Error("expected keep=all alone to pass the original through")
+	}
+	if !parseQuery(t, "/?keep=icc").NeedsProcessing(ipxpress.FormatJPEG) {
+		t.Error("expected keep=icc to need processing")
+	}
+}
+
+// TestStripMetadataProcessorRespectsKeep verifies the example processor strips only what keep= doesn't ask for
+func TestStripMetadataProcessorRespectsKeep(t *testing.T) {
+	src := createEXIFJPEG(120, 80, 6)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+	handler.UseProcessor(ipxpress.StripMetadataProcessor())
+
+	for extra, kept := range map[string]bool{"w=60": false, "w=60&keep=exif": true, "w=60&keep=none": false} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/a.jpg")+"&"+extra, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", extra, rec.Code, rec.Body)
+		}
+		if _, _, ok := readEXIF(t, rec.Body.Bytes()); ok != kept {
+			t.Errorf("%s: expected EXIF kept %v, got %v", extra, kept, ok)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestCORSMiddleware verifies a registered middleware wraps ServeHTTP, on a
+// normal GET and on an OPTIONS preflight
+func TestCORSMiddleware(t *testing.T) {
+	handler := mountedHandler(t)
+	handler.UseMiddleware(ipxpress.CORSMiddleware([]string{"https://app.example.com"}))
+
+	tests := []struct {
+		method, origin string
+		status         int
+		allowOrigin    string
+	}{
+		{http.MethodGet, "https://app.example.com", http.StatusOK, "https://app.example.com"},
+		{http.MethodOptions, "https://app.example.com", http.StatusNoContent, "https://app.example.com"},
+		{http.MethodGet, "https://evil.example.com", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/?"+sourceQuery(presetSource, ""), nil)
+		req.Header.Set("Origin", tt.origin)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s from %s: expected %d, got %d", tt.method, tt.origin, tt.status, rec.Code)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+			t.Errorf("%s from %s: expected Access-Control-Allow-Origin %q, got %q", tt.method, tt.origin, tt.allowOrigin, got)
+		}
+	}
+
+	// Middlewares added later are picked up too
+	handler.UseMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Added-Later", "1")
+			next.ServeHTTP(w, r)
+		})
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/params", nil))
+	if rec.Header().Get("X-Added-Later") != "1" {
+		t.Error("expected the new middleware to run")
+	}
+}
+
+// TestMiddlewarePanic verifies a panicking middleware gets a 500, not a crash
+func TestMiddlewarePanic(t *testing.T) {
+	handler := mountedHandler(t)
+	handler.UseMiddleware(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("broken middleware")
+		})
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/params", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500, got %d", rec.Code)
+	}
+}
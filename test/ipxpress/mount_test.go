@@ -0,0 +1,129 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// mountedHandler returns a handler with a cache seeded for presetSource
+func mountedHandler(t *testing.T) *ipxpress.Handler {
+	t.Helper()
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?"+sourceQuery(presetSource, ""))), &ipxpress.CacheEntry{
+		ContentType: "image/webp",
+		Data:        []byte("seeded"),
+		StatusCode:  http.StatusOK,
+	})
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = cache
+	handler := ipxpress.NewHandler(config)
+	t.Cleanup(handler.Close)
+	return handler
+}
+
+// TestMount verifies images and endpoints are served under any prefix
+func TestMount(t *testing.T) {
+	for _, prefix := range []string{"/ipx", "/ipx/", "ipx", "/", ""} {
+		t.Run(prefix, func(t *testing.T) {
+			mux := http.NewServeMux()
+			ipxpress.Mount(mux, prefix, mountedHandler(t))
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			base := server.URL + "/" + strings.Trim(prefix, "/")
+			base = strings.TrimSuffix(base, "/")
+			query := "?" + sourceQuery(presetSource, "")
+			for _, target := range []string{base + "/" + query, base + query} {
+				if status, body := getBody(t, target); status != http.StatusOK || body != "seeded" {
+					t.Errorf("%s: expected the image, got %d %q", target, status, body)
+				}
+			}
+			if status, body := getBody(t, base+"/params"); status != http.StatusOK || !strings.Contains(body, `"width"`) {
+				t.Errorf("expected the params endpoint, got %d %q", status, body)
+			}
+
+			resp, err := http.Head(base + "/" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/webp" {
+				t.Errorf("expected HEAD answered like GET, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+
+			req, _ := http.NewRequest(http.MethodOptions, base+"/"+query, nil)
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+				t.Errorf("expected OPTIONS answered with 204 and Allow, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+			}
+
+			req, _ = http.NewRequest(http.MethodDelete, base+"/"+query, nil)
+			resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusMethodNotAllowed {
+				t.Errorf("expected DELETE refused with 405, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestMountMiddlewares verifies Mount applies the handler's middlewares in order
+func TestMountMiddlewares(t *testing.T) {
+	handler := mountedHandler(t)
+	var order []string
+	for _, name := range []string{"first", "second"} {
+		handler.UseMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	mux := http.NewServeMux()
+	ipxpress.Mount(mux, "/ipx", handler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipx/params", nil))
+	if rec.Code != http.StatusOK || strings.Join(order, ",") != "first,second" {
+		t.Errorf("expected both middlewares in order, got %d %v", rec.Code, order)
+	}
+}
+
+// TestMountWithoutStripPrefix verifies endpoints are found from the ServeMux
+// pattern when the handler is registered as is
+func TestMountWithoutStripPrefix(t *testing.T) {
+	for _, pattern := range []string{"/ipx/", "GET /ipx/", "/ipx/{rest...}"} {
+		mux := http.NewServeMux()
+		mux.Handle(pattern, mountedHandler(t))
+		for _, target := range []string{"/ipx/params", "/ipx/params/"} {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"width"`) {
+				t.Errorf("%s at %s: expected the params endpoint, got %d", target, pattern, rec.Code)
+			}
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipx/photos/a.jpg?"+sourceQuery(presetSource, ""), nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "seeded" {
+			t.Errorf("%s: expected the image whatever the path, got %d %q", pattern, rec.Code, rec.Body)
+		}
+	}
+
+	// The transform endpoint may share the prefix
+	mux := http.NewServeMux()
+	handler := mountedHandler(t)
+	ipxpress.Mount(mux, "/ipx", handler)
+	mux.Handle("POST /ipx/transform", handler.Transform())
+}
@@ -0,0 +1,89 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestNoOpPassthroughByteIdentical verifies requests changing nothing serve the original bytes
+func TestNoOpPassthroughByteIdentical(t *testing.T) {
+	src := createSolidPNG(40, 30, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	for _, query := range []string{"", "&f=png", "&q=85", "&format=png&quality=85", "&enforce=false"} {
+		rec := httptest.NewRecorder()
+		target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png") + query
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d: %s", query, rec.Code, rec.Body)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), src) {
+			t.Errorf("%q: expected the original bytes, got %d bytes", query, rec.Body.Len())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+			t.Errorf("%q: expected image/png, got %q", query, ct)
+		}
+	}
+}
+
+// TestQualityChangeReencodes verifies a quality other than the default, or enforce=true, re-encodes
+func TestQualityChangeReencodes(t *testing.T) {
+	for query, want := range map[string]bool{
+		"/?url=http://x/a.jpg":                    false,
+		"/?url=http://x/a.jpg&q=85":               false,
+		"/?url=http://x/a.jpg&f=jpeg&q=85":        false,
+		"/?url=http://x/a.jpg&q=50":               true,
+		"/?url=http://x/a.jpg&f=jpeg&quality=95":  true,
+		"/?url=http://x/a.jpg&enforce=true":       true,
+		"/?url=http://x/a.jpg&q=85&enforce=1":     true,
+		"/?url=http://x/a.jpg&q=auto&maxbytes=10": true,
+	} {
+		if got := parseQuery(t, query).NeedsProcessing(ipxpress.FormatJPEG); got != want {
+			t.Errorf("%s: expected NeedsProcessing %t, got %t", query, want, got)
+		}
+	}
+
+	base := ipxpress.GenerateCacheKey(parseQuery(t, "/?url=http://x/a.jpg"))
+	if ipxpress.GenerateCacheKey(parseQuery(t, "/?url=http://x/a.jpg&enforce=true")) == base {
+		t.Error("expected enforce=true to get its own cache key")
+	}
+}
+
+// TestQualityOnlyChangeEncodes verifies q alone reaches the encoder
+func TestQualityOnlyChangeEncodes(t *testing.T) {
+	src := createTestImage(200, 150)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+
+	for _, query := range []string{"&q=30", "&enforce=true"} {
+		rec := httptest.NewRecorder()
+		target := "/?url=" + url.QueryEscape(origin.URL+"/photo.jpg") + query
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d", query, rec.Code)
+		}
+		if bytes.Equal(rec.Body.Bytes(), src) {
+			t.Errorf("%q: expected a re-encoded image, got the original bytes", query)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("%q: expected image/jpeg, got %q", query, ct)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !race
+
+package ipxpress_test
+
+// raceEnabled is set when testing with -race, whose instrumentation makes heap
+// measurements meaningless
+const raceEnabled = false
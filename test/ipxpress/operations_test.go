@@ -222,7 +222,7 @@ func TestNoUpscaleEnsured(t *testing.T) {
 	}
 
 	// Encode to PNG and check dimensions
-	out, err := proc.ToBytes(ipxpress.FormatPNG, 0)
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
 	proc.Close()
 	if err != nil {
 		t.Fatalf("encode: %v", err)
@@ -0,0 +1,124 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// stubFetcher serves fixed bytes for every URL and counts the calls
+type stubFetcher struct {
+	data  []byte
+	calls atomic.Int32
+}
+
+func (f *stubFetcher) FetchReserved(ctx context.Context, imageURL string) ([]byte, func(), error) {
+	f.calls.Add(1)
+	if strings.HasSuffix(imageURL, "/missing.png") {
+		return nil, func() {}, &ipxpress.FetchError{StatusCode: http.StatusNotFound, Message: "not found"}
+	}
+	return f.data, func() {}, nil
+}
+
+func (f *stubFetcher) Open(ctx context.Context, imageURL string, header http.Header) (*http.Response, error) {
+	f.calls.Add(1)
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		ContentLength: int64(len(f.data)),
+		Body:          io.NopCloser(bytes.NewReader(f.data)),
+	}, nil
+}
+
+func (f *stubFetcher) HostAllowed(host string) bool { return true }
+
+// TestWithFetcher verifies source images come from the injected fetcher and never the network
+func TestWithFetcher(t *testing.T) {
+	var originHits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHits.Add(1)
+	}))
+	defer origin.Close()
+
+	fetcher := &stubFetcher{data: []byte("fixed source bytes")}
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.StreamThreshold = 4 // passthroughs stream, so no decoding is involved
+	handler := ipxpress.NewHandler(config, ipxpress.WithFetcher(fetcher))
+	defer handler.Close()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/photo.bin"), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "fixed source bytes" {
+		t.Errorf("expected the stub's bytes, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?w=100&url="+url.QueryEscape(origin.URL+"/missing.png"), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected the stub's 404, got %d", rec.Code)
+	}
+
+	if n := fetcher.calls.Load(); n != 2 {
+		t.Errorf("expected 2 fetcher calls, got %d", n)
+	}
+	if n := originHits.Load(); n != 0 {
+		t.Errorf("expected no network requests, origin was hit %d times", n)
+	}
+}
+
+// TestWithCacheAndClock verifies the injected cache and clock take precedence over Config
+func TestWithCacheAndClock(t *testing.T) {
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?"+sourceQuery(presetSource, "w=200&f=webp"))), &ipxpress.CacheEntry{
+		ContentType: "image/webp",
+		Data:        []byte("seeded"),
+		StatusCode:  http.StatusOK,
+	})
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = ipxpress.NewInMemoryCache(time.Minute, 1<<20) // ignored in favour of WithCache
+	config.SignatureSecrets = []string{"s3cret"}
+	config.Now = func() time.Time { return signClock.Add(24 * time.Hour) } // ignored in favour of WithClock
+	handler := ipxpress.NewHandler(config,
+		ipxpress.WithCache(cache),
+		ipxpress.WithClock(func() time.Time { return signClock }),
+		ipxpress.WithFetcher(&stubFetcher{}),
+	)
+	defer handler.Close()
+
+	target := ipxpress.SignURLUntil("s3cret", "/", signedParams, signClock.Add(time.Hour))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "seeded" {
+		t.Errorf("expected the seeded entry within expiry, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// TestWithLogger verifies the handler logs to the injected logger
+func TestWithLogger(t *testing.T) {
+	var buf bytes.Buffer
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config,
+		ipxpress.WithLogger(slog.New(slog.NewTextHandler(&buf, nil))),
+		ipxpress.WithFetcher(&stubFetcher{}),
+	)
+	defer handler.Close()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?w=100&url="+url.QueryEscape("https://example.com/missing.png"), nil))
+	if !strings.Contains(buf.String(), "fetch failed") || !strings.Contains(buf.String(), "missing.png") {
+		t.Errorf("expected the fetch failure in the injected log, got %q", buf.String())
+	}
+}
@@ -0,0 +1,149 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// createRotatedJPEG returns a width x height JPEG, red on its left half and blue
+// on its right, tagged with EXIF orientation 6: viewed upright it is height
+// wide and width high, red on top
+func createRotatedJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= width/2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// APP1 with a big-endian TIFF header and one IFD entry: Orientation (SHORT) = 6
+	var exif bytes.Buffer
+	exif.WriteString("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	binary.Write(&exif, binary.BigEndian, []uint16{1, 0x0112, 3})
+	binary.Write(&exif, binary.BigEndian, []uint32{1})
+	binary.Write(&exif, binary.BigEndian, []uint16{6, 0})
+	binary.Write(&exif, binary.BigEndian, uint32(0))
+
+	src := buf.Bytes()
+	out := append([]byte{}, src[:2]...) // SOI
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(exif.Len()+2))
+	out = append(out, exif.Bytes()...)
+	return append(out, src[2:]...)
+}
+
+// TestAutoOrient verifies rotated sources are turned upright before resizing
+func TestAutoOrient(t *testing.T) {
+	src := createRotatedJPEG(t, 400, 200)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	get := func(config *ipxpress.Config, query string) image.Image {
+		t.Helper()
+		handler := ipxpress.NewHandler(config)
+		defer handler.Close()
+		rec := httptest.NewRecorder()
+		target := "/?" + query + "&f=png&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", query, rec.Code, rec.Body)
+		}
+		img, _, err := image.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return img
+	}
+	isRed := func(c color.Color) bool {
+		r, _, b, _ := c.RGBA()
+		return r > 0xC000 && b < 0x4000
+	}
+
+	// Upright the source is 200x400, so w=100 is 100x200 with red on top
+	upright := get(ipxpress.DefaultConfig(), "w=100")
+	if size := upright.Bounds().Size(); size != image.Pt(100, 200) {
+		t.Fatalf("expected 100x200 upright, got %v", size)
+	}
+	if !isRed(upright.At(50, 20)) || isRed(upright.At(50, 180)) {
+		t.Error("expected red on top and blue below")
+	}
+
+	// A Config literal orients too
+	if size := get(&ipxpress.Config{}, "w=100").Bounds().Size(); size != image.Pt(100, 200) {
+		t.Errorf("expected 100x200 upright with a Config literal, got %v", size)
+	}
+
+	// A box fits the upright shape, and shrink-on-load mustn't shrink it too far
+	if size := get(ipxpress.DefaultConfig(), "w=100&h=100").Bounds().Size(); size != image.Pt(50, 100) {
+		t.Errorf("expected 50x100 in a 100x100 box, got %v", size)
+	}
+
+	// The crop is in upright coordinates: the top half is all red
+	cropped := get(ipxpress.DefaultConfig(), "extract=0_0_200_200")
+	if size := cropped.Bounds().Size(); size != image.Pt(200, 200) || !isRed(cropped.At(100, 190)) {
+		t.Errorf("expected a red 200x200 crop, got %v", size)
+	}
+
+	// Opting out keeps the stored pixels
+	if size := get(ipxpress.DefaultConfig(), "w=100&orient=false").Bounds().Size(); size != image.Pt(100, 50) {
+		t.Errorf("expected 100x50 with orient=false, got %v", size)
+	}
+	config := ipxpress.DefaultConfig()
+	config.DisableAutoOrient = true
+	if size := get(config, "w=100").Bounds().Size(); size != image.Pt(100, 50) {
+		t.Errorf("expected 100x50 with DisableAutoOrient, got %v", size)
+	}
+}
+
+// TestProcessorAutoOrient verifies the processor drops the tag so it isn't applied twice
+func TestProcessorAutoOrient(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createRotatedJPEG(t, 120, 60)).AutoOrient()
+	defer proc.Close()
+	if err := proc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if w, h := proc.Width(), proc.Height(); w != 60 || h != 120 {
+		t.Errorf("expected 60x120, got %dx%d", w, h)
+	}
+	proc.AutoOrient()
+	if w, h := proc.Width(), proc.Height(); w != 60 || h != 120 {
+		t.Errorf("expected a second AutoOrient to do nothing, got %dx%d", w, h)
+	}
+}
+
+// TestOrientParam verifies orient=false parses and gets its own cache key
+func TestOrientParam(t *testing.T) {
+	parse := func(query string) *ipxpress.ProcessingParams {
+		return ipxpress.ParseProcessingParams(httptest.NewRequest(http.MethodGet, "/?url=http://a.test/x.jpg&"+query, nil))
+	}
+	on, off := parse("orient=true"), parse("orient=false")
+	if on.DisableOrient || !off.DisableOrient {
+		t.Fatalf("expected orient=false to disable orientation, got %t and %t", on.DisableOrient, off.DisableOrient)
+	}
+	if ipxpress.GenerateCacheKey(on) == ipxpress.GenerateCacheKey(off) {
+		t.Error("expected orient=false to change the cache key")
+	}
+	if got := off.Query().Get("orient"); got != "false" {
+		t.Errorf("expected orient=false in the query, got %q", got)
+	}
+}
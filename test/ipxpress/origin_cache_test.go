@@ -0,0 +1,168 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestParseOriginPolicy verifies the lifetimes read from Cache-Control and Expires
+func TestParseOriginPolicy(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   ipxpress.OriginPolicy
+	}{
+		{"none", http.Header{}, ipxpress.OriginPolicy{}},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=300"}}, ipxpress.OriginPolicy{MaxAge: 5 * time.Minute}},
+		{"s-maxage first", http.Header{"Cache-Control": {"max-age=300, s-maxage=60"}}, ipxpress.OriginPolicy{MaxAge: time.Minute}},
+		{"age subtracted", http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}}, ipxpress.OriginPolicy{MaxAge: 200 * time.Second}},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, ipxpress.OriginPolicy{NoStore: true}},
+		{"private", http.Header{"Cache-Control": {"Private, max-age=600"}}, ipxpress.OriginPolicy{NoStore: true}},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, ipxpress.OriginPolicy{NoStore: true}},
+		{"max-age=0", http.Header{"Cache-Control": {"max-age=0"}}, ipxpress.OriginPolicy{NoStore: true}},
+		{"expires", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(2 * time.Hour).Format(http.TimeFormat)},
+		}, ipxpress.OriginPolicy{MaxAge: 2 * time.Hour}},
+		{"expires without date", http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, ipxpress.OriginPolicy{MaxAge: time.Hour}},
+		{"max-age over expires", http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, ipxpress.OriginPolicy{MaxAge: time.Minute}},
+		{"invalid expires", http.Header{"Expires": {"0"}}, ipxpress.OriginPolicy{NoStore: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ipxpress.ParseOriginPolicy(tt.header, now); got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestHonorOriginCacheControl verifies entry TTLs and client headers follow the origin
+func TestHonorOriginCacheControl(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("\x89PNG\r\n\x1a\nsource"))
+	}))
+	defer origin.Close()
+
+	var mu sync.Mutex
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.CacheTTL = 10 * time.Minute
+	config.ClientMaxAge = 3600
+	config.HonorOriginCacheControl = true
+	config.DebugHeaders = true
+	cache := ipxpress.NewInMemoryCache(config.CacheTTL, 1<<24)
+	handler := ipxpress.NewHandler(config, ipxpress.WithCache(cache), ipxpress.WithClock(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}))
+	defer handler.Close()
+
+	// storedTTL returns the remaining TTL the cache has for the entry of cc
+	seen := map[string]bool{}
+	ttls := map[string]time.Duration{}
+	storedTTL := func(cc string) time.Duration {
+		t.Helper()
+		time.Sleep(20 * time.Millisecond) // otter applies writes asynchronously
+		keys, _ := cache.Keys("", 100, "")
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				meta, _ := cache.Peek(key)
+				ttls[cc] = meta.TTL
+			}
+		}
+		return ttls[cc]
+	}
+	get := func(cc string) (cache, cacheControl string) {
+		rec := httptest.NewRecorder()
+		target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png?cc="+url.QueryEscape(cc))
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d", cc, rec.Code)
+		}
+		return rec.Header().Get("X-IPX-Cache"), rec.Header().Get("Cache-Control")
+	}
+	expect := func(cc, wantCache, wantCacheControl string) {
+		t.Helper()
+		if cache, cacheControl := get(cc); cache != wantCache || cacheControl != wantCacheControl {
+			t.Errorf("%s: expected %s with %q, got %s with %q", cc, wantCache, wantCacheControl, cache, cacheControl)
+		}
+	}
+
+	// A short max-age shortens the entry's TTL and what clients are told
+	expect("max-age=60", "MISS", "public, max-age=60")
+	if ttl := storedTTL("max-age=60"); ttl <= 50*time.Second || ttl > time.Minute {
+		t.Errorf("expected the entry kept for the origin's minute, got %s", ttl)
+	}
+	advance(20 * time.Second)
+	expect("max-age=60", "HIT", "public, max-age=40")
+
+	// CacheTTL and ClientMaxAge stay the ceilings
+	expect("max-age=86400", "MISS", "public, max-age=3600")
+	if ttl := storedTTL("max-age=86400"); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("expected the entry kept for CacheTTL, got %s", ttl)
+	}
+
+	// Sources the origin doesn't allow caching are fetched every time
+	hits.Store(0)
+	for _, cc := range []string{"no-store", "private, max-age=600"} {
+		expect(cc, "BYPASS", "private, no-store")
+		expect(cc, "BYPASS", "private, no-store")
+	}
+	if n := hits.Load(); n != 4 {
+		t.Errorf("expected uncacheable sources fetched every time, origin hit %d times", n)
+	}
+}
+
+// TestOriginCacheControlIgnoredByDefault verifies the fixed TTL applies without HonorOriginCacheControl
+func TestOriginCacheControlIgnoredByDefault(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("\x89PNG\r\n\x1a\nsource"))
+	}))
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png")
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if cc := rec.Header().Get("Cache-Control"); cc == "private, no-store" {
+			t.Errorf("unexpected Cache-Control %q", cc)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected the source cached, origin hit %d times", n)
+	}
+}
@@ -0,0 +1,217 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// newOverlayServer serves a red 100x100 base and a blue 20x20 overlay PNG
+func newOverlayServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	base := createSolidPNG(100, 100, color.RGBA{R: 255, A: 255})
+	badge := createSolidPNG(20, 20, color.RGBA{B: 255, A: 255})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/base.png":
+			w.Write(base)
+		case "/badge.png":
+			w.Write(badge)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+// fetchOverlay requests the base image with the given overlay query and decodes the PNG result
+func fetchOverlay(t *testing.T, imgServer *httptest.Server, query string) image.Image {
+	t.Helper()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	reqURL := server.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/base.png") +
+		"&overlay=" + url.QueryEscape(imgServer.URL+"/badge.png") + query
+	resp, err := http.Get(reqURL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to decode result: %v", err)
+	}
+	return img
+}
+
+// isBlue reports whether the pixel is (close to) pure blue
+func isBlue(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r>>8 < 30 && g>>8 < 30 && b>>8 > 225
+}
+
+// isRed reports whether the pixel is (close to) pure red
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r>>8 > 225 && g>>8 < 30 && b>>8 < 30
+}
+
+// TestOverlayAtPixelOffset verifies overlay_pos=X_Y and overlay_w resize the overlay before compositing
+func TestOverlayAtPixelOffset(t *testing.T) {
+	imgServer := newOverlayServer(t)
+	defer imgServer.Close()
+
+	img := fetchOverlay(t, imgServer, "&overlay_pos=10_10&overlay_w=40")
+
+	if !isBlue(img.At(30, 30)) {
+		t.Errorf("expected overlay at (30,30), got %v", img.At(30, 30))
+	}
+	if !isBlue(img.At(45, 45)) {
+		t.Errorf("expected resized overlay to reach (45,45), got %v", img.At(45, 45))
+	}
+	if !isRed(img.At(5, 5)) || !isRed(img.At(60, 60)) {
+		t.Error("expected base image outside the overlay")
+	}
+}
+
+// TestOverlayGravity verifies gravity names place the overlay
+func TestOverlayGravity(t *testing.T) {
+	imgServer := newOverlayServer(t)
+	defer imgServer.Close()
+
+	img := fetchOverlay(t, imgServer, "&overlay_pos=southeast")
+
+	if !isBlue(img.At(95, 95)) {
+		t.Errorf("expected overlay in the bottom-right corner, got %v", img.At(95, 95))
+	}
+	if !isRed(img.At(50, 50)) {
+		t.Errorf("expected base image in the centre, got %v", img.At(50, 50))
+	}
+}
+
+// TestOverlayMissingReturnsFetchStatus verifies a missing overlay surfaces the upstream status
+func TestOverlayMissingReturnsFetchStatus(t *testing.T) {
+	imgServer := newOverlayServer(t)
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/base.png") +
+		"&overlay=" + url.QueryEscape(imgServer.URL+"/missing.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+// TestProcessorComposite verifies the Composite method draws at the given offset
+func TestProcessorComposite(t *testing.T) {
+	base := createSolidPNG(50, 50, color.RGBA{R: 255, A: 255})
+	badge := createSolidPNG(10, 10, color.RGBA{B: 255, A: 255})
+
+	proc := ipxpress.New().FromBytes(base).Composite(badge, 5, 5, vips.BlendModeOver)
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("composite: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !isBlue(img.At(8, 8)) {
+		t.Errorf("expected overlay at (8,8), got %v", img.At(8, 8))
+	}
+	if !isRed(img.At(20, 20)) {
+		t.Errorf("expected base at (20,20), got %v", img.At(20, 20))
+	}
+}
+
+// TestOverlayParamsInCacheKey verifies overlay params produce distinct cache keys
+func TestOverlayParamsInCacheKey(t *testing.T) {
+	base := parseQuery(t, "/?url=http://x/a.png&overlay=http://x/b.png")
+	keys := map[string]bool{ipxpress.GenerateCacheKey(base): true}
+	for _, q := range []string{
+		"/?url=http://x/a.png&overlay=http://x/c.png",
+		"/?url=http://x/a.png&overlay=http://x/b.png&overlay_pos=10_10",
+		"/?url=http://x/a.png&overlay=http://x/b.png&overlay_w=40",
+	} {
+		key := ipxpress.GenerateCacheKey(parseQuery(t, q))
+		if keys[key] {
+			t.Errorf("cache key collision for %q", q)
+		}
+		keys[key] = true
+	}
+	if !base.HasTransformations() {
+		t.Error("overlay should count as a transformation")
+	}
+}
+
+// TestOverlayBounded verifies overlay_w is held to MaxDimension and overlays to MaxInputPixels
+func TestOverlayBounded(t *testing.T) {
+	imgServer := newOverlayServer(t)
+	defer imgServer.Close()
+	get := func(config *ipxpress.Config, query string) *httptest.ResponseRecorder {
+		handler := ipxpress.NewHandler(config)
+		defer handler.Close()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(imgServer.URL+"/base.png")+
+			"&overlay="+url.QueryEscape(imgServer.URL+"/badge.png")+query, nil))
+		return rec
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	for _, query := range []string{"&overlay_w=1000000", "&overlay_w=-5"} {
+		if rec := get(config, query); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "overlay_w") {
+			t.Errorf("%s: expected 400 naming overlay_w, got %d: %s", query, rec.Code, rec.Body)
+		}
+	}
+
+	// A 10x10 base within the limit with a 40x40 overlay past it
+	small := createSolidPNG(10, 10, color.RGBA{R: 255, A: 255})
+	large := createSolidPNG(40, 40, color.RGBA{B: 255, A: 255})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large.png" {
+			w.Write(large)
+			return
+		}
+		w.Write(small)
+	}))
+	defer origin.Close()
+	config = ipxpress.DefaultConfig()
+	config.MaxInputPixels = 1000
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/small.png")+
+		"&overlay="+url.QueryEscape(origin.URL+"/large.png")+"&overlay_w=5", nil))
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "overlay") {
+		t.Errorf("expected 413 for an overlay over MaxInputPixels, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,274 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// fetchImage requests the handler with query for the given source and decodes the result
+func fetchImage(t *testing.T, src []byte, query string) image.Image {
+	t.Helper()
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?" + query + "&url=" + url.QueryEscape(imgServer.URL+"/src"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return img
+}
+
+// assertSize fails unless img is exactly w x h
+func assertSize(t *testing.T, img image.Image, w, h int) {
+	t.Helper()
+	if b := img.Bounds(); b.Dx() != w || b.Dy() != h {
+		t.Fatalf("expected %dx%d, got %dx%d", w, h, b.Dx(), b.Dy())
+	}
+}
+
+// TestPadLetterbox verifies pad=true centers the image on an exact canvas
+func TestPadLetterbox(t *testing.T) {
+	src := createSolidPNG(200, 100, color.RGBA{R: 255, A: 255})
+
+	for _, query := range []string{"w=100&h=100&pad=true&b=00ff00&f=png", "w=100&h=100&fit=contain&b=00ff00&f=png"} {
+		img := fetchImage(t, src, query)
+		assertSize(t, img, 100, 100)
+		assertNear(t, img.At(0, 0), color.RGBA{G: 255, A: 255})
+		assertNear(t, img.At(99, 99), color.RGBA{G: 255, A: 255})
+		assertNear(t, img.At(50, 50), color.RGBA{R: 255, A: 255})
+	}
+}
+
+// TestPadTransparent verifies background=transparent leaves the canvas transparent in PNG
+func TestPadTransparent(t *testing.T) {
+	src := createSolidPNG(200, 100, color.RGBA{R: 255, A: 255})
+
+	img := fetchImage(t, src, "w=100&h=100&pad=1&b=transparent&f=png")
+	assertSize(t, img, 100, 100)
+	if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+		t.Errorf("expected transparent corner, got alpha %d", a>>8)
+	}
+	if _, _, _, a := img.At(50, 50).RGBA(); a>>8 != 255 {
+		t.Errorf("expected opaque image area, got alpha %d", a>>8)
+	}
+}
+
+// TestPadTransparentJPEG verifies formats without alpha fall back to white
+func TestPadTransparentJPEG(t *testing.T) {
+	src := createSolidPNG(200, 100, color.RGBA{R: 255, A: 255})
+
+	img := fetchImage(t, src, "w=100&h=100&pad=1&b=transparent&f=jpeg")
+	assertSize(t, img, 100, 100)
+	assertNear(t, img.At(0, 0), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+}
+
+// TestPaddingMargin verifies padding adds a uniform colored margin
+func TestPaddingMargin(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 60, 40)), &jpeg.Options{Quality: 95})
+
+	img := fetchImage(t, buf.Bytes(), "padding=20&b=0000ff&f=png")
+	assertSize(t, img, 100, 80)
+	assertNear(t, img.At(0, 0), color.RGBA{B: 255, A: 255})
+	assertNear(t, img.At(19, 40), color.RGBA{B: 255, A: 255})
+	assertNear(t, img.At(50, 40), color.RGBA{A: 255})
+}
+
+// TestExtendKeepsAlpha verifies Extend no longer flattens the image's own transparency
+func TestExtendKeepsAlpha(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 128})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, src)
+
+	proc := ipxpress.New().FromBytes(buf.Bytes()).Extend(5, 5, 5, 5, []float64{0, 255, 0})
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+
+	img := decodePNG(t, out)
+	assertSize(t, img, 30, 30)
+	if _, _, _, a := img.At(15, 15).RGBA(); a>>8 < 100 || a>>8 > 160 {
+		t.Errorf("expected the original semi-transparency, got alpha %d", a>>8)
+	}
+	assertNear(t, img.At(0, 0), color.RGBA{G: 255, A: 255})
+}
+
+// TestPadParams verifies parsing and cache key separation
+func TestPadParams(t *testing.T) {
+	a := parseQuery(t, "/?url=http://x/a.png&w=100&h=100")
+	b := parseQuery(t, "/?url=http://x/a.png&w=100&h=100&pad=true")
+	c := parseQuery(t, "/?url=http://x/a.png&w=100&h=100&padding=10")
+
+	if !b.Pad || c.Padding != 10 {
+		t.Errorf("unexpected parse: %t %d", b.Pad, c.Padding)
+	}
+	keys := map[string]bool{ipxpress.GenerateCacheKey(a): true, ipxpress.GenerateCacheKey(b): true, ipxpress.GenerateCacheKey(c): true}
+	if len(keys) != 3 {
+		t.Error("pad and padding must be part of the cache key")
+	}
+}
+
+// createLogoPNG returns a transparent size x size PNG with an opaque red square in the middle
+func createLogoPNG(size int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := size / 4; y < size*3/4; y++ {
+		for x := size / 4; x < size*3/4; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// TestPadTransparentLogo verifies a logo with alpha keeps it on a transparent
+// canvas, and is flattened onto the fallback color when converted to JPEG
+func TestPadTransparentLogo(t *testing.T) {
+	src := createLogoPNG(40)
+
+	img := fetchImage(t, src, "w=40&h=40&pad=1&padding=10&b=transparent&f=png")
+	assertSize(t, img, 60, 60)
+	for _, p := range []image.Point{{0, 0}, {59, 59}, {15, 15}} {
+		if _, _, _, a := img.At(p.X, p.Y).RGBA(); a != 0 {
+			t.Errorf("expected transparent at %v, got alpha %d", p, a>>8)
+		}
+	}
+	assertNear(t, img.At(30, 30), color.RGBA{R: 255, A: 255})
+
+	// The logo's own transparency is flattened too, not left black
+	img = fetchImage(t, src, "w=40&h=40&pad=1&padding=10&b=transparent&f=jpeg")
+	assertNear(t, img.At(0, 0), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	assertNear(t, img.At(15, 15), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	assertNear(t, img.At(30, 30), color.RGBA{R: 255, A: 255})
+	img = fetchImage(t, src, "padding=10&b=0000ff&f=jpeg")
+	assertNear(t, img.At(15, 15), color.RGBA{B: 255, A: 255})
+
+	// Without flatten PNG keeps the alpha; flatten=true removes it
+	if _, _, _, a := fetchImage(t, src, "padding=10&b=0000ff&f=png").At(15, 15).RGBA(); a != 0 {
+		t.Errorf("expected the logo's transparency kept, got alpha %d", a>>8)
+	}
+	assertNear(t, fetchImage(t, src, "flatten=true&b=0000ff&f=png").At(5, 5), color.RGBA{B: 255, A: 255})
+}
+
+// TestPadTranslucentBackground verifies 8-digit hex colors carry alpha (rrggbbaa)
+func TestPadTranslucentBackground(t *testing.T) {
+	src := createSolidPNG(200, 100, color.RGBA{R: 255, A: 255})
+
+	img := fetchImage(t, src, "w=100&h=100&pad=1&b=00ff0080&f=png")
+	r, g, b, a := img.At(0, 0).RGBA()
+	if a>>8 < 120 || a>>8 > 136 {
+		t.Errorf("expected a half-transparent canvas, got alpha %d", a>>8)
+	}
+	if r != 0 || b != 0 || g == 0 {
+		t.Errorf("expected a green canvas, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+	assertNear(t, img.At(50, 50), color.RGBA{R: 255, A: 255})
+}
+
+// TestExtendOffsets verifies the image sits exactly where extend's offsets or the
+// position gravity put it
+func TestExtendOffsets(t *testing.T) {
+	src := createSolidPNG(20, 10, color.RGBA{R: 255, A: 255})
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+
+	tests := []struct {
+		query     string
+		w, h      int
+		image, bg []image.Point
+	}{
+		// top_right_bottom_left offsets
+		{"extend=5_0_0_10", 30, 15, []image.Point{{10, 5}, {29, 14}}, []image.Point{{9, 5}, {10, 4}, {0, 14}}},
+		{"extend=0_3_4_0", 23, 14, []image.Point{{0, 0}, {19, 9}}, []image.Point{{20, 0}, {0, 10}}},
+		// position moves all the growth to the other side
+		{"extend=10_0_10_0&position=top", 20, 30, []image.Point{{0, 0}, {19, 9}}, []image.Point{{0, 10}, {19, 29}}},
+		{"extend=10_0_10_0&position=bottom", 20, 30, []image.Point{{0, 20}, {19, 29}}, []image.Point{{0, 0}, {0, 19}}},
+		{"extend=0_6_0_6&position=left", 32, 10, []image.Point{{0, 0}, {19, 9}}, []image.Point{{20, 0}, {31, 9}}},
+		{"extend=4_6_4_6&position=southeast", 32, 18, []image.Point{{12, 8}, {31, 17}}, []image.Point{{11, 8}, {12, 7}}},
+		{"extend=2_6_2_6&position=centre", 32, 14, []image.Point{{6, 2}, {25, 11}}, []image.Point{{5, 2}, {26, 11}}},
+	}
+	for _, tt := range tests {
+		img := fetchImage(t, src, tt.query+"&b=0000ff&f=png")
+		assertSize(t, img, tt.w, tt.h)
+		for _, p := range tt.image {
+			assertNear(t, img.At(p.X, p.Y), red)
+		}
+		for _, p := range tt.bg {
+			assertNear(t, img.At(p.X, p.Y), blue)
+		}
+	}
+}
+
+// TestBorder verifies border adds a uniform border outside any padding
+func TestBorder(t *testing.T) {
+	src := createSolidPNG(20, 10, color.RGBA{R: 255, A: 255})
+
+	img := fetchImage(t, src, "border=4_ff00ff&f=png")
+	assertSize(t, img, 28, 18)
+	assertNear(t, img.At(3, 3), color.RGBA{R: 255, B: 255, A: 255})
+	assertNear(t, img.At(27, 17), color.RGBA{R: 255, B: 255, A: 255})
+	assertNear(t, img.At(4, 4), color.RGBA{R: 255, A: 255})
+
+	// Without a color the border takes the background
+	assertNear(t, fetchImage(t, src, "border=4&b=0000ff&f=png").At(0, 0), color.RGBA{B: 255, A: 255})
+
+	img = fetchImage(t, src, "padding=2&border=3_000000&b=ffffff&f=png")
+	assertSize(t, img, 30, 20)
+	assertNear(t, img.At(2, 2), color.RGBA{A: 255})
+	assertNear(t, img.At(3, 3), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	assertNear(t, img.At(5, 5), color.RGBA{R: 255, A: 255})
+}
+
+// TestBorderParams verifies border parsing and its cache key
+func TestBorderParams(t *testing.T) {
+	p := parseQuery(t, "/?url=http://x/a.png&border=10_ff0000")
+	if p.BorderWidth != 10 || p.BorderColor != "#ff0000" || p.Query().Get("border") != "10_ff0000" {
+		t.Errorf("unexpected parse: %d %q", p.BorderWidth, p.BorderColor)
+	}
+	if p := parseQuery(t, "/?url=http://x/a.png&border=3"); p.BorderWidth != 3 || p.BorderColor != "" {
+		t.Errorf("unexpected parse: %d %q", p.BorderWidth, p.BorderColor)
+	}
+	for _, value := range []string{"-1", "x", "5_zz", "5_ff00"} {
+		if p := parseQuery(t, "/?url=http://x/a.png&border="+value); p.Err() == nil || p.BorderWidth != 0 {
+			t.Errorf("border=%s: expected an error", value)
+		}
+	}
+	a := parseQuery(t, "/?url=http://x/a.png&border=10_ff0000")
+	b := parseQuery(t, "/?url=http://x/a.png&border=10_00ff00")
+	if ipxpress.GenerateCacheKey(a) == ipxpress.GenerateCacheKey(b) {
+		t.Error("border color must be part of the cache key")
+	}
+}
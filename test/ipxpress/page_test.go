@@ -0,0 +1,202 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// createPDF creates a PDF with one 72x48pt page per color, each filled with it
+func createPDF(pages ...color.RGBA) []byte {
+	var buf bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	buf.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	for i, c := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 72 48] /Contents %d 0 R >>", 4+2*i))
+		content := fmt.Sprintf("%.3f %.3f %.3f rg 0 0 72 48 re f", float64(c.R)/255, float64(c.G)/255, float64(c.B)/255)
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return buf.Bytes()
+}
+
+// pageGet requests src from a default handler and returns the status and body
+func pageGet(t *testing.T, src []byte, query string) (int, []byte) {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/doc") + "&" + query)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+// TestPDFFixture verifies the PDF fixture is structurally sound
+func TestPDFFixture(t *testing.T) {
+	pdf := createPDF(color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255})
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("fixture is not a PDF")
+	}
+	if n := bytes.Count(pdf, []byte("/Type /Page ")); n != 2 {
+		t.Errorf("expected 2 pages, got %d", n)
+	}
+	start := bytes.LastIndex(pdf, []byte("startxref\n"))
+	var xref int
+	fmt.Sscanf(string(pdf[start+len("startxref\n"):]), "%d", &xref)
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Error("startxref doesn't point at the xref table")
+	}
+}
+
+// TestPDFPages verifies page selects the rendered page of a PDF
+func TestPDFPages(t *testing.T) {
+	pdf := createPDF(color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255})
+
+	center := func(query string) color.Color {
+		status, body := pageGet(t, pdf, query)
+		if status != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", query, status, body)
+		}
+		img, err := png.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: output is not a PNG: %v", query, err)
+		}
+		b := img.Bounds()
+		return img.At(b.Dx()/2, b.Dy()/2)
+	}
+
+	isRed := func(c color.Color) bool { r, g, b, _ := c.RGBA(); return r > 0xc000 && g < 0x4000 && b < 0x4000 }
+	isBlue := func(c color.Color) bool { r, g, b, _ := c.RGBA(); return b > 0xc000 && r < 0x4000 && g < 0x4000 }
+	if c := center("f=png"); !isRed(c) {
+		t.Errorf("expected the first page to be red, got %v", c)
+	}
+	if c := center("f=png&page=0"); !isRed(c) {
+		t.Errorf("expected page=0 to be red, got %v", c)
+	}
+	if c := center("f=png&page=1"); !isBlue(c) {
+		t.Errorf("expected page=1 to be blue, got %v", c)
+	}
+}
+
+// TestPDFPageOutOfRange verifies a page beyond the last gets 400 with the page count
+func TestPDFPageOutOfRange(t *testing.T) {
+	pdf := createPDF(color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255})
+	status, body := pageGet(t, pdf, "f=png&page=2")
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", status)
+	}
+	if !strings.Contains(string(body), "2 page(s)") {
+		t.Errorf("expected the page count in the message, got %q", body)
+	}
+
+	// Single-page images have one page
+	status, body = pageGet(t, createTestImage(20, 20), "page=1")
+	if status != http.StatusBadRequest || !strings.Contains(string(body), "1 page(s)") {
+		t.Errorf("expected 400 naming 1 page, got %d: %q", status, body)
+	}
+}
+
+// TestPDFDensity verifies density scales the rasterized size of a PDF
+func TestPDFDensity(t *testing.T) {
+	pdf := createPDF(color.RGBA{G: 255, A: 255})
+
+	size := func(query string) image.Point {
+		status, body := pageGet(t, pdf, query)
+		if status != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", query, status, body)
+		}
+		cfg, err := png.DecodeConfig(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: output is not a PNG: %v", query, err)
+		}
+		return image.Pt(cfg.Width, cfg.Height)
+	}
+
+	if got := size("f=png"); got != image.Pt(72, 48) {
+		t.Errorf("expected 72x48 at the default 72 DPI, got %v", got)
+	}
+	if got := size("f=png&density=144"); got != image.Pt(144, 96) {
+		t.Errorf("expected 144x96 at 144 DPI, got %v", got)
+	}
+}
+
+// TestPageParams verifies page and density are parsed, validated and keyed
+func TestPageParams(t *testing.T) {
+	p := parseQuery(t, "/?url=https://example.com/a.pdf&page=3&density=150")
+	if p.Page != 3 || p.Density != 150 || !p.HasTransformations() {
+		t.Errorf("unexpected params: %+v", p)
+	}
+	if p.KeepsAnimation() {
+		t.Error("a selected page should not keep the animation")
+	}
+	base := parseQuery(t, "/?url=https://example.com/a.pdf")
+	if base.HasTransformations() {
+		t.Error("no page or density should need no processing")
+	}
+	if ipxpress.GenerateCacheKey(p) == ipxpress.GenerateCacheKey(base) {
+		t.Error("page and density should change the cache key")
+	}
+
+	for _, query := range []string{"page=-1", "page=x", "density=0", "density=5000"} {
+		if p := parseQuery(t, "/?url=https://example.com/a.pdf&"+query); p.Err() == nil {
+			t.Errorf("%s should be rejected", query)
+		}
+	}
+	for _, name := range []string{core.ParamPage, core.ParamDensity} {
+		if _, ok := ipxpress.LookupParam(name); !ok {
+			t.Errorf("%s is not in the registry", name)
+		}
+	}
+}
+
+// TestPageNotAllowedInSpecs verifies transform specs can't select pages
+func TestPageNotAllowedInSpecs(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	_, err := handler.RenderSet(createTestImage(10, 10), []ipxpress.VariantSpec{{Name: "a", Query: "w=5&page=1"}})
+	var variantErr *ipxpress.VariantError
+	if !errors.As(err, &variantErr) || variantErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 VariantError, got %v", err)
+	}
+}
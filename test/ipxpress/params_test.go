@@ -188,3 +188,57 @@ func TestResizeParameter(t *testing.T) {
 		})
 	}
 }
+
+// TestAliasPrecedence tests which value wins when a parameter is given more than once
+func TestAliasPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		width  int
+		height int
+	}{
+		{"w overrides s width", "s=800x600&w=400", 400, 600},
+		{"h overrides s height", "s=800x600&h=300", 800, 300},
+		{"w and h override s", "s=800x600&w=400&h=300", 400, 300},
+		{"width overrides s", "resize=800x600&width=400", 400, 600},
+		{"short w beats width", "w=100&width=200", 100, 0},
+		{"short s beats resize", "s=10x20&resize=30x40", 10, 20},
+		{"malformed s keeps w", "s=800&w=400", 400, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := parseQuery(t, "/?url=test.jpg&"+tt.query)
+			if params.Width != tt.width || params.Height != tt.height {
+				t.Errorf("got %dx%d, want %dx%d", params.Width, params.Height, tt.width, tt.height)
+			}
+		})
+	}
+
+	if got := parseQuery(t, "/?url=test.jpg&f=png&format=webp&q=50&quality=90").Format; got != ipxpress.FormatPNG {
+		t.Errorf("Format: got %q, want png", got)
+	}
+	if got := parseQuery(t, "/?url=test.jpg&b=00ff00&background=ff0000").Background; got != "#00ff00" {
+		t.Errorf("Background: got %q, want #00ff00", got)
+	}
+}
+
+// TestMalformedResizeReported tests that malformed s= values are reported, not just ignored
+func TestMalformedResizeReported(t *testing.T) {
+	for _, value := range []string{"800", "800x600x400", "x600", "800x", "widthxheight"} {
+		params := parseQuery(t, "/?url=test.jpg&s="+value)
+		if len(params.Errors) != 1 || params.Errors[0].Param != "resize" {
+			t.Errorf("s=%s: expected a resize error, got %v", value, params.Errors)
+		}
+	}
+}
+
+// parseQuery parses processing params from a query string
+func parseQuery(t *testing.T, query string) *ipxpress.ProcessingParams {
+	t.Helper()
+	req, err := http.NewRequest("GET", "http://localhost"+query, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	return ipxpress.ParseProcessingParams(req)
+}
@@ -0,0 +1,115 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/png"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestPipelineConcurrent verifies one pipeline serves several images from many goroutines
+func TestPipelineConcurrent(t *testing.T) {
+	params := &ipxpress.ProcessingParams{Width: 40, Height: 40, Fit: "cover", Format: ipxpress.FormatPNG, Sharpen: "1.5_1_2", Extend: "2_2_2_2"}
+	thumb, err := ipxpress.NewPipeline(params)
+	if err != nil {
+		t.Fatalf("NewPipeline: %v", err)
+	}
+	params.Width = 10 // the pipeline keeps its own copy
+
+	sources := [][]byte{
+		createSolidPNG(200, 100, color.RGBA{R: 255, A: 255}),
+		createSolidPNG(100, 300, color.RGBA{G: 255, A: 255}),
+		createTestImage(120, 120),
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*len(sources))
+	for i := 0; i < 8; i++ {
+		for _, src := range sources {
+			wg.Add(1)
+			go func(src []byte) {
+				defer wg.Done()
+				out, format, err := thumb.Run(src)
+				if err != nil {
+					errs <- err
+					return
+				}
+				cfg, err := png.DecodeConfig(bytes.NewReader(out))
+				if format != ipxpress.FormatPNG || err != nil || cfg.Width != 44 || cfg.Height != 44 {
+					errs <- fmt.Errorf("expected a 44x44 png, got %s %dx%d (%v)", format, cfg.Width, cfg.Height, err)
+				}
+			}(src)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if thumb.Params().Width != 40 {
+		t.Errorf("expected the pipeline to keep width 40, got %d", thumb.Params().Width)
+	}
+}
+
+// TestPipelineMatchesHandler verifies a pipeline renders the same bytes as the HTTP handler
+func TestPipelineMatchesHandler(t *testing.T) {
+	src := createTestImage(160, 90)
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+
+	query := "w=64&f=png&grayscale=true&rotate=90"
+	params := parseQuery(t, "/?url=https://example.com/a.png&"+query)
+	pl, err := handler.NewPipeline(params)
+	if err != nil {
+		t.Fatalf("NewPipeline: %v", err)
+	}
+	fromPipeline, _, err := pl.Run(src)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	fromProcess, _, err := handler.Process(context.Background(), src, params)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if !bytes.Equal(fromPipeline, fromProcess) {
+		t.Error("the pipeline and Process should render identical bytes")
+	}
+}
+
+// TestPipelineRejectsInvalidParams verifies bad params fail when the pipeline is built
+func TestPipelineRejectsInvalidParams(t *testing.T) {
+	for _, params := range []*ipxpress.ProcessingParams{
+		{Width: -5},
+		{Width: 100, Overlay: "https://example.com/logo.png"},
+	} {
+		var procErr *ipxpress.ProcessError
+		if _, err := ipxpress.NewPipeline(params); !errors.As(err, &procErr) || procErr.StatusCode != http.StatusBadRequest {
+			t.Errorf("%+v: expected a 400 ProcessError, got %v", params, err)
+		}
+	}
+}
+
+// TestPipelineDefaultQuality verifies params built without a quality get the default before compiling
+func TestPipelineDefaultQuality(t *testing.T) {
+	handler := healthHandler(t, nil)
+	pl, err := handler.NewPipeline(&ipxpress.ProcessingParams{Width: 40, Format: ipxpress.FormatPNG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := pl.Params().Quality; q != 85 {
+		t.Errorf("expected the default quality 85, got %d", q)
+	}
+	pl, err = handler.NewPipeline(&ipxpress.ProcessingParams{Width: 40, Quality: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := pl.Params().Quality; q != 50 {
+		t.Errorf("expected an explicit quality kept, got %d", q)
+	}
+}
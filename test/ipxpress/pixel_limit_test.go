@@ -0,0 +1,106 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// createBombPNG builds a 1-bit grayscale PNG of the given size row by row, so a
+// huge canvas compresses to a few kilobytes without ever existing in memory.
+func createBombPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+
+	chunk := func(kind string, data []byte) {
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		crc := crc32.NewIEEE()
+		io.WriteString(crc, kind)
+		crc.Write(data)
+		buf.WriteString(kind)
+		buf.Write(data)
+		binary.Write(&buf, binary.BigEndian, crc.Sum32())
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 1 // bit depth; color type 0 (grayscale), default compression/filter/interlace
+	chunk("IHDR", ihdr)
+
+	var idat bytes.Buffer
+	zw, _ := zlib.NewWriterLevel(&idat, zlib.BestCompression)
+	row := make([]byte, 1+(width+7)/8) // filter byte + packed pixels, all zero
+	for y := 0; y < height; y++ {
+		zw.Write(row)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chunk("IDAT", idat.Bytes())
+	chunk("IEND", nil)
+	return buf.Bytes()
+}
+
+// TestProcessorMaxPixels verifies the limit is enforced from the header
+func TestProcessorMaxPixels(t *testing.T) {
+	proc := ipxpress.New().MaxPixels(50 * 50).FromBytes(createTestImage(100, 100))
+	defer proc.Close()
+
+	var tooLarge *ipxpress.PixelLimitError
+	if !errors.As(proc.Err(), &tooLarge) {
+		t.Fatalf("expected PixelLimitError, got %v", proc.Err())
+	}
+	if tooLarge.Width != 100 || tooLarge.Height != 100 || tooLarge.Frames != 1 {
+		t.Errorf("unexpected error details %+v", tooLarge)
+	}
+
+	ok := ipxpress.New().MaxPixels(100 * 100).FromBytes(createTestImage(100, 100))
+	defer ok.Close()
+	if ok.Err() != nil {
+		t.Errorf("image at the limit rejected: %v", ok.Err())
+	}
+}
+
+// TestDecompressionBombRejected verifies a small file with a huge canvas gets 413
+func TestDecompressionBombRejected(t *testing.T) {
+	bomb := createBombPNG(t, 20000, 20000)
+	if len(bomb) > 200*1024 {
+		t.Fatalf("bomb should be small, got %d bytes", len(bomb))
+	}
+
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bomb)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?w=100&url=" + url.QueryEscape(imgServer.URL+"/bomb.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Contains(body, []byte("20000x20000")) {
+		t.Errorf("expected the dimensions in the message, got %q", body)
+	}
+}
@@ -0,0 +1,163 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// createGradientPNG creates a lossless horizontal+vertical gradient where neighbouring pixels differ
+func createGradientPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 2), G: uint8(y * 2), B: 128, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// isUniformBlock reports whether every pixel in the block equals its top-left pixel
+func isUniformBlock(img image.Image, left, top, size int) bool {
+	want := img.At(left, top)
+	for y := top; y < top+size; y++ {
+		for x := left; x < left+size; x++ {
+			if img.At(x, y) != want {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// TestPixelatePreservesSize verifies dimensions survive block sizes that don't divide them
+func TestPixelatePreservesSize(t *testing.T) {
+	proc := ipxpress.New().FromBytes(createGradientPNG(95, 73)).Pixelate(10)
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("pixelate: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 95 || b.Dy() != 73 {
+		t.Errorf("expected 95x73, got %dx%d", b.Dx(), b.Dy())
+	}
+	if !isUniformBlock(img, 20, 20, 10) {
+		t.Error("expected uniform 10px blocks")
+	}
+}
+
+// TestPixelateRegionHTTP verifies only the requested region is pixelated
+func TestPixelateRegionHTTP(t *testing.T) {
+	src := createGradientPNG(100, 100)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?pixelate=10&pixelate_region=0_0_40_40&url=" + url.QueryEscape(imgServer.URL+"/g.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	for _, origin := range [][2]int{{0, 0}, {10, 10}, {30, 20}} {
+		if !isUniformBlock(img, origin[0], origin[1], 10) {
+			t.Errorf("expected uniform block at %v inside the region", origin)
+		}
+	}
+
+	// Outside the region the gradient must be untouched: every pixel differs from its neighbour
+	for x := 50; x < 60; x++ {
+		if img.At(x, 70) == img.At(x+1, 70) {
+			t.Errorf("expected smooth gradient outside the region at x=%d", x)
+		}
+	}
+}
+
+// TestPixelateMalformedRegion verifies a redaction with a bad region pixelates everything rather than nothing
+func TestPixelateMalformedRegion(t *testing.T) {
+	src := createGradientPNG(100, 100)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+
+	for _, region := range []string{"0_0_40", "0_0_40_x"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?pixelate=10&pixelate_region="+region+"&url="+url.QueryEscape(imgServer.URL+"/g.png"), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", region, rec.Code, rec.Body)
+		}
+		if rec.Header().Get("X-IPX-Warning") == "" {
+			t.Errorf("%s: expected the bad region reported", region)
+		}
+		img, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		for _, origin := range [][2]int{{0, 0}, {50, 60}, {80, 80}} {
+			if !isUniformBlock(img, origin[0], origin[1], 10) {
+				t.Errorf("%s: expected the whole image pixelated, block at %v isn't", region, origin)
+			}
+		}
+	}
+}
+
+// TestPixelateParams verifies parsing and cache key separation
+func TestPixelateParams(t *testing.T) {
+	a := parseQuery(t, "/?url=http://x/a.png&pixelate=12")
+	b := parseQuery(t, "/?url=http://x/a.png&pixelate=12&pixelate_region=0_0_10_10")
+
+	if a.Pixelate != 12 || b.PixelateRegion != "0_0_10_10" {
+		t.Errorf("unexpected parse: %d %q", a.Pixelate, b.PixelateRegion)
+	}
+	if !a.HasTransformations() {
+		t.Error("pixelate should count as a transformation")
+	}
+	if ipxpress.GenerateCacheKey(a) == ipxpress.GenerateCacheKey(b) {
+		t.Error("pixelate_region must be part of the cache key")
+	}
+
+	// A malformed region is reported and not kept
+	c := parseQuery(t, "/?url=http://x/a.png&pixelate=12&pixelate_region=0_0_10")
+	if c.PixelateRegion != "" || len(c.Errors) != 1 || c.Errors[0].Param != "pixelate_region" {
+		t.Errorf("expected the malformed region dropped with an error, got %q %v", c.PixelateRegion, c.Errors)
+	}
+}
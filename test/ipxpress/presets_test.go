@@ -0,0 +1,125 @@
+package ipxpress_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+const presetSource = "http://127.0.0.1:1/photos/a.jpg"
+
+// presetServer serves a handler with a thumbnail preset and a cache seeded under
+// the key of equivalent with the thumbnail preset applied
+func presetServer(t *testing.T, configure func(*ipxpress.Config), equivalent string) *httptest.Server {
+	t.Helper()
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	seeded := parseQuery(t, "/?"+equivalent)
+	seeded.Preset = "thumbnail"
+	cache.Set(ipxpress.GenerateCacheKey(seeded), &ipxpress.CacheEntry{
+		ContentType: "image/webp",
+		Data:        []byte("seeded"),
+		StatusCode:  http.StatusOK,
+	})
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = cache
+	if configure != nil {
+		configure(config)
+	}
+	handler := ipxpress.NewHandler(config)
+	t.Cleanup(handler.Close)
+	handler.RegisterPreset("thumbnail", &ipxpress.ProcessingParams{Width: 200, Height: 200, Fit: "cover", Format: ipxpress.FormatWebP, Quality: 75})
+	handler.RegisterPreset("avatar", &ipxpress.ProcessingParams{Width: 64, Height: 64, Fit: "cover", Format: ipxpress.FormatWebP})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getBody(t *testing.T, target string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// TestPresetResolution verifies preset=name is served with exactly the registered params
+func TestPresetResolution(t *testing.T) {
+	server := presetServer(t, nil, sourceQuery(presetSource, "w=200&h=200&fit=cover&f=webp&q=75"))
+
+	status, body := getBody(t, server.URL+"/?"+sourceQuery(presetSource, "preset=thumbnail"))
+	if status != http.StatusOK || body != "seeded" {
+		t.Errorf("expected the preset to resolve to the seeded params, got %d %q", status, body)
+	}
+}
+
+// TestPresetRejectsOverrides verifies presets can't be combined with raw params
+func TestPresetRejectsOverrides(t *testing.T) {
+	server := presetServer(t, nil, sourceQuery(presetSource, ""))
+
+	for _, extra := range []string{"preset=thumbnail&w=2000", "preset=thumbnail&q=100&blur=3", "f=png&preset=avatar"} {
+		status, body := getBody(t, server.URL+"/?"+sourceQuery(presetSource, extra))
+		if status != http.StatusBadRequest || !strings.Contains(body, "can't be combined") {
+			t.Errorf("%s: expected 400, got %d %q", extra, status, body)
+		}
+	}
+}
+
+// TestPresetUnknown verifies unknown presets are rejected, listing the known ones only when debugging
+func TestPresetUnknown(t *testing.T) {
+	quiet := presetServer(t, nil, sourceQuery(presetSource, ""))
+	status, body := getBody(t, quiet.URL+"/?"+sourceQuery(presetSource, "preset=hero"))
+	if status != http.StatusBadRequest || !strings.Contains(body, `unknown preset "hero"`) {
+		t.Errorf("expected 400 for an unknown preset, got %d %q", status, body)
+	}
+	if strings.Contains(body, "thumbnail") {
+		t.Errorf("presets should only be listed with DebugHeaders, got %q", body)
+	}
+
+	debug := presetServer(t, func(c *ipxpress.Config) { c.DebugHeaders = true }, sourceQuery(presetSource, ""))
+	_, body = getBody(t, debug.URL+"/?"+sourceQuery(presetSource, "preset=hero"))
+	if !strings.Contains(body, "available: avatar, thumbnail") {
+		t.Errorf("expected the presets to be listed, got %q", body)
+	}
+}
+
+// TestPresetsOnly verifies PresetsOnly rejects raw transformation params but serves presets
+func TestPresetsOnly(t *testing.T) {
+	server := presetServer(t, func(c *ipxpress.Config) { c.PresetsOnly = true }, sourceQuery(presetSource, "w=200&h=200&fit=cover&f=webp&q=75"))
+
+	status, body := getBody(t, server.URL+"/?"+sourceQuery(presetSource, "w=200"))
+	if status != http.StatusBadRequest || !strings.Contains(body, "only presets") {
+		t.Errorf("expected raw params to be rejected, got %d %q", status, body)
+	}
+	if status, body := getBody(t, server.URL+"/?"+sourceQuery(presetSource, "preset=thumbnail")); status != http.StatusOK || body != "seeded" {
+		t.Errorf("expected the preset to be served, got %d %q", status, body)
+	}
+}
+
+// TestPresetCacheKeys verifies the preset name is part of the cache key
+func TestPresetCacheKeys(t *testing.T) {
+	keys := map[string]bool{}
+	for _, query := range []string{"", "&preset=thumbnail", "&preset=avatar"} {
+		keys[ipxpress.GenerateCacheKey(parseQuery(t, "/?url=https://example.com/a.jpg"+query))] = true
+	}
+	if len(keys) != 3 {
+		t.Errorf("expected 3 distinct keys, got %d", len(keys))
+	}
+
+	// Presets with identical params still don't share entries
+	a := &ipxpress.ProcessingParams{URL: "https://example.com/a.jpg", Width: 100, Preset: "small"}
+	b := *a
+	b.Preset = "tiny"
+	if ipxpress.GenerateCacheKey(a) == ipxpress.GenerateCacheKey(&b) {
+		t.Error("presets with the same params should have distinct keys")
+	}
+}
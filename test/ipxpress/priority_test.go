@@ -0,0 +1,131 @@
+package ipxpress_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestEstimateCost verifies output size, format and operations raise the cost
+func TestEstimateCost(t *testing.T) {
+	src := createGradientPNG(400, 300)
+	cost := func(p ipxpress.ProcessingParams) float64 { return ipxpress.EstimateCost(&p, src) }
+
+	thumb := cost(ipxpress.ProcessingParams{Width: 256, Height: 256, Format: ipxpress.FormatJPEG})
+	large := cost(ipxpress.ProcessingParams{Width: 3840, Height: 2160, Format: ipxpress.FormatJPEG})
+	largeAVIF := cost(ipxpress.ProcessingParams{Width: 3840, Height: 2160, Format: ipxpress.FormatAVIF})
+	if thumb > 1 || large <= 1 {
+		t.Errorf("expected a thumbnail under the default threshold and 4K over it, got %g and %g", thumb, large)
+	}
+	if largeAVIF < 4*large {
+		t.Errorf("expected AVIF to weigh far more than JPEG, got %g vs %g", largeAVIF, large)
+	}
+	if blurred := cost(ipxpress.ProcessingParams{Width: 256, Height: 256, Format: ipxpress.FormatJPEG, Blur: 2, Grayscale: true}); blurred <= thumb {
+		t.Errorf("expected operations to add to the cost, got %g vs %g", blurred, thumb)
+	}
+	if square := cost(ipxpress.ProcessingParams{Width: 256, Format: ipxpress.FormatJPEG}); square != thumb {
+		t.Errorf("expected a width alone to be taken as a square, got %g vs %g", square, thumb)
+	}
+	// Without a size or format, the source's size and format stand in
+	if source := cost(ipxpress.ProcessingParams{}); source <= 0 || source != cost(ipxpress.ProcessingParams{Format: ipxpress.FormatPNG}) {
+		t.Errorf("expected the source to be estimated as PNG, got %g", source)
+	}
+}
+
+// TestProcessingSlots verifies the reserved slots default to a quarter of the limit and leave one for expensive requests
+func TestProcessingSlots(t *testing.T) {
+	for _, tc := range []struct {
+		limit, reserved int
+		threshold       float64
+		want            int
+	}{
+		{limit: 256, threshold: 1, want: 64},
+		{limit: 2, threshold: 1, want: 1},
+		{limit: 1, threshold: 1, want: 0},
+		{limit: 8, reserved: 20, threshold: 1, want: 7},
+		{limit: 8, reserved: 3, threshold: 1, want: 3},
+		{limit: 8, reserved: 3, threshold: 0, want: 0},
+	} {
+		handler := healthHandler(t, func(c *ipxpress.Config) {
+			c.ProcessingLimit, c.CheapReservedSlots, c.CheapCostThreshold = tc.limit, tc.reserved, tc.threshold
+		})
+		stats := handler.ProcessingStats()
+		if stats.Limit != tc.limit || stats.Reserved != tc.want || stats.Active != 0 {
+			t.Errorf("%+v: expected %d of %d slots reserved, got %+v", tc, tc.want, tc.limit, stats)
+		}
+	}
+}
+
+// p95 returns the 95th percentile of durations
+func p95(durations []time.Duration) time.Duration {
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	return sorted[(len(sorted)*95+99)/100-1]
+}
+
+// TestPriorityUnderLoad verifies thumbnails stay fast while large AVIF encodes
+// saturate every slot they may take: with the priority queue none of them
+// waits for a large encode to finish.
+func TestPriorityUnderLoad(t *testing.T) {
+	src := createGradientPNG(2400, 1600)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	config := ipxpress.DefaultConfig()
+	config.ProcessingLimit = 4
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	get := func(extra string) time.Duration {
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+sourceQuery(origin.URL+"/big.png", extra), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d: %s", extra, rec.Code, rec.Body)
+		}
+		return time.Since(start)
+	}
+
+	// Twice as many large encodes as slots, each a distinct cache entry
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var large []time.Duration
+	for i := 0; i < 2*config.ProcessingLimit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := get(fmt.Sprintf("w=%d&f=avif", 2000+i))
+			mu.Lock()
+			large = append(large, d)
+			mu.Unlock()
+		}()
+	}
+	// Let the large encodes take their slots and queue
+	deadline := time.Now().Add(10 * time.Second)
+	for handler.ProcessingStats().WaitingExpensive == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := handler.ProcessingStats(); stats.ActiveExpensive != stats.Limit-stats.Reserved {
+		t.Fatalf("expected the large encodes to hold every unreserved slot, got %+v", stats)
+	}
+
+	var small []time.Duration
+	for i := 0; i < 20; i++ {
+		small = append(small, get(fmt.Sprintf("w=%d&f=jpeg", 64+i)))
+	}
+	wg.Wait()
+
+	slices.Sort(large)
+	median := large[len(large)/2]
+	if got := p95(small); got >= median {
+		t.Errorf("expected thumbnails to beat a large encode, got p95 %s vs a median large encode of %s", got, median)
+	}
+	t.Logf("thumbnail p95 %s, large encode median %s", p95(small), median)
+}
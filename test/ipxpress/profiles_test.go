@@ -0,0 +1,173 @@
+package ipxpress_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+const profileSource = "http://127.0.0.1:1/avatars/u/42.png"
+
+var (
+	avatarProfile = ipxpress.PathProfile{
+		Name:   "avatars",
+		Match:  "/avatars/*",
+		Params: ipxpress.ProcessingParams{Width: 256, Height: 256, Fit: "cover", Format: ipxpress.FormatWebP},
+	}
+	bannerProfile = ipxpress.PathProfile{
+		Name:   "banners",
+		Match:  "/banners/*",
+		Mode:   ipxpress.ProfileClamp,
+		Params: ipxpress.ProcessingParams{Width: 1600, Quality: 80},
+	}
+)
+
+// servedAs reports whether a request for query is handled like a plain request for
+// equivalent: the cache is seeded under equivalent's key, so a hit means the
+// profile turned query into exactly those params.
+func servedAs(t *testing.T, profiles []ipxpress.PathProfile, query, equivalent string) (bool, http.Header) {
+	t.Helper()
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?"+equivalent)), &ipxpress.CacheEntry{
+		ContentType: "image/webp",
+		Data:        []byte("seeded"),
+		StatusCode:  http.StatusOK,
+	})
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = cache
+	config.DebugHeaders = true
+	config.PathProfiles = profiles
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?" + query)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body) == "seeded", resp.Header
+}
+
+func sourceQuery(source, extra string) string {
+	q := "url=" + url.QueryEscape(source)
+	if extra != "" {
+		q += "&" + extra
+	}
+	return q
+}
+
+// TestProfileModes verifies how each enforcement mode combines with client params
+func TestProfileModes(t *testing.T) {
+	force := avatarProfile
+	force.Mode = ipxpress.ProfileForce
+	banner := "http://127.0.0.1:1/banners/summer.jpg"
+
+	tests := []struct {
+		name       string
+		profile    ipxpress.PathProfile
+		source     string
+		query      string
+		equivalent string
+	}{
+		{"default fills unset params", avatarProfile, profileSource, "", "w=256&h=256&fit=cover&f=webp"},
+		{"default keeps client params", avatarProfile, profileSource, "w=100&f=png", "w=100&h=256&fit=cover&f=png"},
+		{"force overrides client params", force, profileSource, "w=100&f=png&blur=2", "w=256&h=256&fit=cover&f=webp&blur=2"},
+		{"clamp caps larger values", bannerProfile, banner, "w=3000&q=95", "w=1600&q=80"},
+		{"clamp keeps smaller values", bannerProfile, banner, "w=800&q=60", "w=800&q=60"},
+		{"clamp fills unset values", bannerProfile, banner, "", "w=1600&q=80"},
+		{"no match leaves params alone", avatarProfile, "http://127.0.0.1:1/photos/a.png", "w=100", "w=100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hit, _ := servedAs(t, []ipxpress.PathProfile{tt.profile},
+				sourceQuery(tt.source, tt.query), sourceQuery(tt.source, tt.equivalent))
+			if !hit {
+				t.Errorf("%q was not treated like %q", tt.query, tt.equivalent)
+			}
+		})
+	}
+}
+
+// TestProfileOrdering verifies the first matching profile wins
+func TestProfileOrdering(t *testing.T) {
+	catchAll := ipxpress.PathProfile{
+		Name:   "everything",
+		Match:  "*",
+		Params: ipxpress.ProcessingParams{Width: 1000},
+	}
+
+	hit, header := servedAs(t, []ipxpress.PathProfile{avatarProfile, catchAll},
+		sourceQuery(profileSource, ""), sourceQuery(profileSource, "w=256&h=256&fit=cover&f=webp"))
+	if !hit {
+		t.Error("expected the avatar profile to apply")
+	}
+	if got := header.Get("X-IPX-Profile"); got != "avatars; mode=default" {
+		t.Errorf("unexpected X-IPX-Profile %q", got)
+	}
+
+	hit, header = servedAs(t, []ipxpress.PathProfile{catchAll, avatarProfile},
+		sourceQuery(profileSource, ""), sourceQuery(profileSource, "w=1000"))
+	if !hit || header.Get("X-IPX-Profile") != "everything; mode=default" {
+		t.Errorf("expected the catch-all profile listed first to apply, got %q", header.Get("X-IPX-Profile"))
+	}
+}
+
+// TestProfileRegexp verifies regexps match the full source URL, including the host
+func TestProfileRegexp(t *testing.T) {
+	cdn := ipxpress.PathProfile{
+		Name:   "cdn",
+		Regexp: `^https?://cdn\.example\.com/`,
+		Mode:   ipxpress.ProfileForce,
+		Params: ipxpress.ProcessingParams{Grayscale: true},
+	}
+
+	for _, tt := range []struct {
+		source string
+		want   string
+	}{
+		{"http://cdn.example.com/a.png", "grayscale=true"},
+		{"http://other.example.com/cdn.example.com/a.png", ""},
+	} {
+		hit, _ := servedAs(t, []ipxpress.PathProfile{cdn}, sourceQuery(tt.source, ""), sourceQuery(tt.source, tt.want))
+		if !hit {
+			t.Errorf("%s: expected params %q", tt.source, tt.want)
+		}
+	}
+}
+
+// TestInvalidProfilesRejected verifies a bad profile fails the configuration instead of being dropped at startup
+func TestInvalidProfilesRejected(t *testing.T) {
+	for _, bad := range []ipxpress.PathProfile{
+		{Name: "pattern", Regexp: "(", Params: ipxpress.ProcessingParams{Width: 10}},
+		{Name: "nothing", Params: ipxpress.ProcessingParams{Width: 10}},
+		{Name: "mode", Match: "*", Mode: "sometimes"},
+	} {
+		config := ipxpress.DefaultConfig()
+		config.PathProfiles = []ipxpress.PathProfile{avatarProfile, bad}
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "PathProfiles") || !strings.Contains(err.Error(), bad.Name) {
+			t.Errorf("%s: expected Validate to name the profile, got %v", bad.Name, err)
+		}
+	}
+}
+
+// TestEffectiveQueryProfile verifies the applied profile is echoed with the effective params
+func TestEffectiveQueryProfile(t *testing.T) {
+	params := parseQuery(t, "/?w=10")
+	params.Profile = "avatars"
+	echo, _ := url.ParseQuery(params.EffectiveQuery(ipxpress.FormatPNG))
+	if echo.Get("profile") != "avatars" {
+		t.Errorf("expected profile in %v", echo)
+	}
+}
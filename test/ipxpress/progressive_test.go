@@ -0,0 +1,125 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// jpegFrame returns the start-of-frame marker of a JPEG (0xC0 baseline, 0xC2
+// progressive) and the sampling factors of its first component (0x11 for 4:4:4,
+// 0x22 for 4:2:0)
+func jpegFrame(t *testing.T, data []byte) (marker, sampling byte) {
+	t.Helper()
+	for i := 2; i+4 < len(data); {
+		if data[i] != 0xFF {
+			t.Fatalf("malformed JPEG at offset %d", i)
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker >= 0xC0 && marker <= 0xC3 {
+			return marker, data[i+2+8+1] // length, precision, height, width, count, then component id
+		}
+		i += 2 + length
+	}
+	t.Fatal("no start-of-frame marker")
+	return 0, 0
+}
+
+// pngInterlaced reports the interlace method in the IHDR chunk
+func pngInterlaced(t *testing.T, data []byte) bool {
+	t.Helper()
+	if len(data) < 29 || !bytes.Equal(data[12:16], []byte("IHDR")) {
+		t.Fatal("not a PNG")
+	}
+	return data[28] == 1
+}
+
+// TestProgressiveParam verifies progressive switches JPEG and PNG interlacing
+func TestProgressiveParam(t *testing.T) {
+	src := createGradientPNG(256, 192)
+
+	progressive := encodeGet(t, src, "f=jpeg")
+	baseline := encodeGet(t, src, "f=jpeg&progressive=false")
+	if marker, _ := jpegFrame(t, progressive); marker != 0xC2 {
+		t.Errorf("expected progressive JPEG by default, got SOF %#x", marker)
+	}
+	if marker, _ := jpegFrame(t, baseline); marker != 0xC0 {
+		t.Errorf("expected baseline JPEG with progressive=false, got SOF %#x", marker)
+	}
+	t.Logf("JPEG: %d bytes progressive, %d baseline", len(progressive), len(baseline))
+
+	plain := encodeGet(t, src, "f=png")
+	interlaced := encodeGet(t, src, "f=png&progressive=true")
+	if pngInterlaced(t, plain) || !pngInterlaced(t, interlaced) {
+		t.Error("expected plain PNG by default and interlaced with progressive=true")
+	}
+	if len(interlaced) <= len(plain) {
+		t.Errorf("expected interlacing to cost bytes, got %d interlaced vs %d plain", len(interlaced), len(plain))
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.JPEGOptions = &ipxpress.JPEGOptions{Progressive: false}
+	config.PNGOptions = &ipxpress.PNGOptions{Compression: 6, Interlace: true}
+	if marker, _ := jpegFrame(t, encodeGetWith(t, config, src, "f=jpeg")); marker != 0xC0 {
+		t.Errorf("expected the configured baseline default, got SOF %#x", marker)
+	}
+	if marker, _ := jpegFrame(t, encodeGetWith(t, config, src, "f=jpeg&progressive=1")); marker != 0xC2 {
+		t.Errorf("expected progressive=1 to override the default, got SOF %#x", marker)
+	}
+	if !pngInterlaced(t, encodeGetWith(t, config, src, "f=png")) {
+		t.Error("expected the configured interlaced PNG default")
+	}
+}
+
+// TestSubsampleParam verifies subsample picks JPEG chroma subsampling
+func TestSubsampleParam(t *testing.T) {
+	src := createGradientPNG(256, 192)
+	full := encodeGet(t, src, "f=jpeg&q=80&subsample=444")
+	half := encodeGet(t, src, "f=jpeg&q=80&subsample=420")
+	if _, sampling := jpegFrame(t, full); sampling != 0x11 {
+		t.Errorf("expected 4:4:4 sampling, got %#x", sampling)
+	}
+	if _, sampling := jpegFrame(t, half); sampling != 0x22 {
+		t.Errorf("expected 4:2:0 sampling, got %#x", sampling)
+	}
+	if len(half) >= len(full) {
+		t.Errorf("expected 4:2:0 (%d bytes) smaller than 4:4:4 (%d bytes)", len(half), len(full))
+	}
+	// Subsampling stays on at high quality when asked for
+	if _, sampling := jpegFrame(t, encodeGet(t, src, "f=jpeg&q=95&subsample=420")); sampling != 0x22 {
+		t.Errorf("expected 4:2:0 at q=95, got %#x", sampling)
+	}
+}
+
+// TestProgressiveSubsampleParsing verifies the values accepted and that each
+// variant gets its own cache key
+func TestProgressiveSubsampleParsing(t *testing.T) {
+	parse := func(query string) *ipxpress.ProcessingParams {
+		return ipxpress.ParseProcessingParams(httptest.NewRequest(http.MethodGet, "/?url=http://a.test/x.jpg&"+query, nil))
+	}
+	keys := map[string]string{}
+	for _, query := range []string{"", "progressive=true", "progressive=false", "subsample=444", "subsample=420"} {
+		params := parse(query)
+		if len(params.Errors) != 0 {
+			t.Errorf("%q: unexpected errors %v", query, params.Errors)
+		}
+		key := ipxpress.GenerateCacheKey(params)
+		if other, ok := keys[key]; ok {
+			t.Errorf("%q and %q share a cache key", query, other)
+		}
+		keys[key] = query
+	}
+	if p := parse("progressive=1"); p.Progressive != "true" || !p.NeedsProcessing(ipxpress.FormatJPEG) {
+		t.Errorf("expected progressive=1 parsed as true and to need encoding, got %q", p.Progressive)
+	}
+	for _, query := range []string{"progressive=maybe", "subsample=422"} {
+		if p := parse(query); len(p.Errors) != 1 || p.Progressive != "" || p.Subsample != "" {
+			t.Errorf("%q: expected one error and nothing set, got %+v", query, p.Errors)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// adminDo sends a request to the admin handler and decodes a JSON answer into v
+func adminDo(t *testing.T, handler *ipxpress.Handler, method, target string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.Admin().ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if v != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("decode %s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+// TestAdminPurgeVariant verifies a purged variant is a miss on the next request
+func TestAdminPurgeVariant(t *testing.T) {
+	var hits atomic.Int32
+	origin := sizedOrigin(t, &hits)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	query := "url=" + url.QueryEscape(origin.URL+"/photo.png?size=1024")
+	get := func() string {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		return rec.Header().Get("X-IPX-Cache")
+	}
+
+	if first, second := get(), get(); first != "MISS" || second != "HIT" {
+		t.Fatalf("expected a miss then a hit, got %s, %s", first, second)
+	}
+	var result struct{ Purged int }
+	if code := adminDo(t, handler, http.MethodDelete, "/cache?"+query, &result); code != http.StatusOK || result.Purged != 1 {
+		t.Fatalf("expected one entry purged, got %d %+v", code, result)
+	}
+	if status := get(); status != "MISS" {
+		t.Errorf("expected a miss after the purge, got %s", status)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected the source fetched again, origin hit %d times", hits.Load())
+	}
+
+	// The query is the image request's, so another variant isn't touched
+	result.Purged = -1
+	adminDo(t, handler, http.MethodDelete, "/cache?"+query+"&w=100", &result)
+	if result.Purged != 0 || get() != "HIT" {
+		t.Errorf("expected another variant's purge to leave the entry, purged %d", result.Purged)
+	}
+	if code := adminDo(t, handler, http.MethodDelete, "/cache", nil); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without url or source, got %d", code)
+	}
+}
+
+// TestAdminPurgeSource verifies every variant of a source is purged, and only those
+func TestAdminPurgeSource(t *testing.T) {
+	fetcher := &stubFetcher{data: []byte("\x89PNG\r\n\x1a\nstub")}
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config, ipxpress.WithFetcher(fetcher))
+	defer handler.Close()
+
+	missing := "https://images.example.com/missing.png"
+	targets := []string{
+		"/?w=100&url=" + url.QueryEscape(missing),
+		"/?w=200&url=" + url.QueryEscape(missing),
+		"/?url=" + url.QueryEscape("https://images.example.com/kept.png"),
+	}
+	for _, target := range targets {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	time.Sleep(50 * time.Millisecond) // otter applies writes asynchronously
+
+	var stats ipxpress.CacheStats
+	if adminDo(t, handler, http.MethodGet, "/cache/stats", &stats); stats.Entries != 3 {
+		t.Fatalf("expected 3 entries, got %+v", stats)
+	}
+	var result struct{ Purged int }
+	if code := adminDo(t, handler, http.MethodDelete, "/cache?source="+url.QueryEscape(missing), &result); code != http.StatusOK || result.Purged != 2 {
+		t.Fatalf("expected both variants purged, got %d %+v", code, result)
+	}
+
+	calls := fetcher.calls.Load()
+	for _, target := range targets {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	if n := fetcher.calls.Load() - calls; n != 2 {
+		t.Errorf("expected only the purged variants fetched again, got %d fetches", n)
+	}
+}
+
+// TestAdminCacheStatsAndFlush verifies the stats and that a flush empties the cache
+func TestAdminCacheStatsAndFlush(t *testing.T) {
+	var hits atomic.Int32
+	origin := sizedOrigin(t, &hits)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png?size=2048")
+	for i := 0; i < 3; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	var stats ipxpress.CacheStats
+	adminDo(t, handler, http.MethodGet, "/cache/stats", &stats)
+	if stats.Entries != 1 || stats.Bytes != 2048 || stats.Hits < 2 || stats.HitRate <= 0 || stats.HitRate > 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var result struct{ Purged int }
+	if code := adminDo(t, handler, http.MethodPost, "/cache/flush", &result); code != http.StatusOK || result.Purged != 1 {
+		t.Fatalf("expected the entry flushed, got %d %+v", code, result)
+	}
+	adminDo(t, handler, http.MethodGet, "/cache/stats", &stats)
+	if stats.Entries != 0 || stats.Bytes != 0 {
+		t.Errorf("expected an empty cache, got %+v", stats)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	if hits.Load() != 2 {
+		t.Errorf("expected a fetch after the flush, origin hit %d times", hits.Load())
+	}
+}
+
+// TestAdminPurgeUnsupported verifies caches without the optional interfaces get 501
+func TestAdminPurgeUnsupported(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Cache = nonEnumerable{ipxpress.NewInMemoryCache(time.Minute, 1024)}
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	for _, req := range []struct{ method, target string }{
+		{http.MethodDelete, "/cache?url=https://example.com/a.png"},
+		{http.MethodDelete, "/cache?source=https://example.com/a.png"},
+		{http.MethodPost, "/cache/flush"},
+		{http.MethodGet, "/cache/stats"},
+	} {
+		if code := adminDo(t, handler, req.method, req.target, nil); code != http.StatusNotImplemented {
+			t.Errorf("%s %s: expected 501, got %d", req.method, req.target, code)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/imagediff"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// qualityReference resizes src to width and encodes it losslessly
+func qualityReference(t *testing.T, src []byte, width int) image.Image {
+	t.Helper()
+	out, err := ipxpress.New().FromBytes(src).Resize(width, 0).ToBytes(ipxpress.FormatPNG, 85)
+	if err != nil {
+		t.Fatalf("reference: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("reference: %v", err)
+	}
+	return img
+}
+
+// assertQuality fails unless got scores at least minSSIM and minPSNR against want
+func assertQuality(t *testing.T, name string, want, got image.Image, minSSIM, minPSNR float64) {
+	t.Helper()
+	ssim, err := imagediff.SSIM(want, got)
+	if err != nil {
+		t.Fatalf("%s: %v (%v vs %v)", name, err, want.Bounds().Size(), got.Bounds().Size())
+	}
+	psnr, _ := imagediff.PSNR(want, got)
+	if ssim < minSSIM || psnr < minPSNR {
+		t.Errorf("%s: expected SSIM >= %.2f and PSNR >= %.0f dB, got %.4f and %.2f dB", name, minSSIM, minPSNR, ssim, psnr)
+	}
+}
+
+// TestEncoderQuality verifies lossy encodes of a resize stay close to a lossless one,
+// so encoder setting changes that wreck quality fail
+func TestEncoderQuality(t *testing.T) {
+	src := createGradientPNG(800, 600)
+	ref := qualityReference(t, src, 400)
+
+	for _, tc := range []struct {
+		format  ipxpress.Format
+		quality int
+		ssim    float64
+		psnr    float64
+	}{
+		{ipxpress.FormatWebP, 80, 0.95, 30},
+		{ipxpress.FormatJPEG, 85, 0.95, 30},
+		{ipxpress.FormatAVIF, 60, 0.93, 30},
+	} {
+		out, err := ipxpress.New().FromBytes(src).Resize(400, 0).ToBytes(tc.format, tc.quality)
+		if err != nil {
+			t.Logf("%s: skipped, %v", tc.format, err)
+			continue
+		}
+		assertQuality(t, string(tc.format), ref, decodeViaPNG(t, out), tc.ssim, tc.psnr)
+	}
+}
+
+// TestHandlerQuality verifies the handler's encoder defaults keep quality
+func TestHandlerQuality(t *testing.T) {
+	src := createGradientPNG(800, 600)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	ref := qualityReference(t, src, 400)
+
+	for _, format := range []string{"webp", "jpeg"} {
+		rec := httptest.NewRecorder()
+		target := "/?w=400&f=" + format + "&url=" + url.QueryEscape(origin.URL+"/a.png")
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", format, rec.Code, rec.Body)
+		}
+		assertQuality(t, format, ref, decodeViaPNG(t, rec.Body.Bytes()), 0.95, 30)
+	}
+}
@@ -0,0 +1,83 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// rangeSource is a PNG-signed source whose bytes differ by offset
+func rangeSource() []byte {
+	data := []byte("\x89PNG\r\n\x1a\n")
+	for i := 0; len(data) < 1000; i++ {
+		data = append(data, byte(i))
+	}
+	return data
+}
+
+// TestRangeRequests verifies single byte ranges of cached entries
+func TestRangeRequests(t *testing.T) {
+	src := rangeSource()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	target := "/?url=" + url.QueryEscape(origin.URL+"/poster.png")
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	full := get(nil)
+	if full.Code != http.StatusOK || full.Header().Get("Accept-Ranges") != "bytes" || !bytes.Equal(full.Body.Bytes(), src) {
+		t.Fatalf("expected the full body with Accept-Ranges, got %d %q", full.Code, full.Header().Get("Accept-Ranges"))
+	}
+	etag := full.Header().Get("ETag")
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		status    int
+		body      []byte
+		wantRange string
+	}{
+		{"mid-file", http.Header{"Range": {"bytes=100-199"}}, http.StatusPartialContent, src[100:200], "bytes 100-199/1000"},
+		{"open-ended", http.Header{"Range": {"bytes=990-"}}, http.StatusPartialContent, src[990:], "bytes 990-999/1000"},
+		{"suffix", http.Header{"Range": {"bytes=-10"}}, http.StatusPartialContent, src[990:], "bytes 990-999/1000"},
+		{"end clamped", http.Header{"Range": {"bytes=995-5000"}}, http.StatusPartialContent, src[995:], "bytes 995-999/1000"},
+		{"out of bounds", http.Header{"Range": {"bytes=1000-1100"}}, http.StatusRequestedRangeNotSatisfiable, nil, "bytes */1000"},
+		{"multiple ranges", http.Header{"Range": {"bytes=0-1,5-6"}}, http.StatusOK, src, ""},
+		{"matching If-Range", http.Header{"Range": {"bytes=0-9"}, "If-Range": {etag}}, http.StatusPartialContent, src[:10], "bytes 0-9/1000"},
+		{"stale If-Range", http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"other"`}}, http.StatusOK, src, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d", tt.status, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tt.wantRange {
+				t.Errorf("expected Content-Range %q, got %q", tt.wantRange, got)
+			}
+			if tt.body != nil && !bytes.Equal(rec.Body.Bytes(), tt.body) {
+				t.Errorf("unexpected body of %d bytes", rec.Body.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package ipxpress_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// fakeClock is a settable clock safe for concurrent use
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// TestRateLimiterBucket verifies bursts, refills and the wait reported when empty
+func TestRateLimiterBucket(t *testing.T) {
+	clock := newFakeClock()
+	limiter := ipxpress.NewRateLimiter(ipxpress.RateLimitConfig{Rate: 2, Burst: 3, Now: clock.Now})
+	defer limiter.Close()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d of the burst was refused", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected a refusal with a 500ms wait, got %v %v", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("clients should have their own buckets")
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("expected one token after 500ms at 2/s")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("expected the refilled token to be spent")
+	}
+
+	clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d after a long pause was refused", i+1)
+		}
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("the bucket should not fill beyond the burst")
+	}
+}
+
+// TestRateLimitMiddleware verifies 429 with Retry-After, proxy headers and exempt paths
+func TestRateLimitMiddleware(t *testing.T) {
+	clock := newFakeClock()
+	limiter := ipxpress.NewRateLimiter(ipxpress.RateLimitConfig{
+		Rate: 0.25, Burst: 1, TrustedHeader: "X-Forwarded-For", Exempt: []string{"/health"}, Now: clock.Now,
+	})
+	defer limiter.Close()
+	handler := limiter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(path, forwarded string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("/", "198.51.100.7"); rec.Code != http.StatusOK {
+		t.Fatalf("expected the first request through, got %d", rec.Code)
+	}
+	rec := serve("/", "198.51.100.7")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "4" {
+		t.Errorf("expected 429 with Retry-After 4, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	// The address the proxy saw is last; a forged first entry doesn't help
+	if rec := serve("/", "203.0.113.9, 198.51.100.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the forged entry to be ignored, got %d", rec.Code)
+	}
+	if rec := serve("/", "198.51.100.8"); rec.Code != http.StatusOK {
+		t.Errorf("expected another client through, got %d", rec.Code)
+	}
+	if rec := serve("/", ""); rec.Code != http.StatusOK {
+		t.Errorf("expected the remote address to be used without the header, got %d", rec.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if rec := serve("/health", "198.51.100.7"); rec.Code != http.StatusOK {
+			t.Fatalf("expected /health to be exempt, got %d", rec.Code)
+		}
+	}
+
+	clock.Advance(4 * time.Second)
+	if rec := serve("/", "198.51.100.7"); rec.Code != http.StatusOK {
+		t.Errorf("expected the client through after Retry-After, got %d", rec.Code)
+	}
+}
+
+// TestRateLimiterConcurrent verifies no more requests pass than the buckets hold
+func TestRateLimiterConcurrent(t *testing.T) {
+	clock := newFakeClock()
+	limiter := ipxpress.NewRateLimiter(ipxpress.RateLimitConfig{Rate: 1, Burst: 10, Now: clock.Now})
+	defer limiter.Close()
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if ok, _ := limiter.Allow(fmt.Sprintf("client-%d", (g+i)%20)); ok {
+					allowed.Add(1)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 20*10 {
+		t.Errorf("expected exactly 200 requests through, got %d", got)
+	}
+	if got := limiter.Clients(); got != 20 {
+		t.Errorf("expected 20 tracked clients, got %d", got)
+	}
+}
+
+// TestRateLimiterReapsIdleClients verifies buckets of idle clients are dropped
+func TestRateLimiterReapsIdleClients(t *testing.T) {
+	clock := newFakeClock()
+	limiter := ipxpress.NewRateLimiter(ipxpress.RateLimitConfig{Rate: 1000, Burst: 1, IdleTimeout: 5 * time.Millisecond, Now: clock.Now})
+	defer limiter.Close()
+
+	for i := 0; i < 50; i++ {
+		limiter.Allow(fmt.Sprintf("client-%d", i))
+	}
+	if got := limiter.Clients(); got != 50 {
+		t.Fatalf("expected 50 tracked clients, got %d", got)
+	}
+	clock.Advance(time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for limiter.Clients() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := limiter.Clients(); got != 0 {
+		t.Errorf("expected idle clients to be reaped, %d left", got)
+	}
+}
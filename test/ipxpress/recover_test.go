@@ -0,0 +1,129 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// panickyFetcher panics for URLs containing "panic" and serves a PNG otherwise
+type panickyFetcher struct {
+	stubFetcher
+}
+
+func (f *panickyFetcher) FetchReserved(ctx context.Context, imageURL string) ([]byte, func(), error) {
+	if strings.Contains(imageURL, "panic") {
+		panic("fetcher exploded")
+	}
+	return f.stubFetcher.FetchReserved(ctx, imageURL)
+}
+
+func (f *panickyFetcher) Open(ctx context.Context, imageURL string, header http.Header) (*http.Response, error) {
+	if strings.Contains(imageURL, "panic") {
+		panic("fetcher exploded")
+	}
+	return f.stubFetcher.Open(ctx, imageURL, header)
+}
+
+// TestHandlerRecoversFromPanics verifies a panic is answered with an uncached 500,
+// frees its slots and leaves the handler serving
+func TestHandlerRecoversFromPanics(t *testing.T) {
+	var logs bytes.Buffer
+	fetcher := &panickyFetcher{stubFetcher{data: []byte("\x89PNG\r\n\x1a\nsource")}}
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.ProcessingLimit = 1
+	config.FetchLimit = 1
+	handler := ipxpress.NewHandler(config, ipxpress.WithFetcher(fetcher),
+		ipxpress.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	defer handler.Close()
+
+	get := func(name string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		target := "/?url=" + url.QueryEscape("http://origin.test/"+name)
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("panic.png"); rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "exploded") {
+			t.Fatalf("expected a 500 without the panic value, got %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if !strings.Contains(logs.String(), "fetcher exploded") || !strings.Contains(logs.String(), "recover_test.go") {
+		t.Errorf("expected the panic logged with its stack, got %s", logs.String())
+	}
+	if stats := handler.FetcherStats(); stats.Active != 0 {
+		t.Errorf("expected the fetch slot released, got %+v", stats)
+	}
+	// With one slot of each kind, a leaked slot would block this request
+	if rec := get("photo.png"); rec.Code != http.StatusOK {
+		t.Errorf("expected the handler to keep serving, got %d", rec.Code)
+	}
+}
+
+// TestRecoverMiddleware verifies the middleware answers 500 and passes ErrAbortHandler on
+func TestRecoverMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	recoverer := ipxpress.RecoverMiddleware(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	rec := httptest.NewRecorder()
+	recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(errors.New("boom"))
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/transform", nil))
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(logs.String(), "boom") {
+		t.Errorf("expected a logged 500, got %d and %q", rec.Code, logs.String())
+	}
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("expected ErrAbortHandler to propagate, got %v", v)
+		}
+	}()
+	recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+// TestPanickingProcessor verifies a ProcessorFunc panic fails only its own request
+func TestPanickingProcessor(t *testing.T) {
+	src := createTestImage(100, 80)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	config := ipxpress.DefaultConfig()
+	config.ProcessingLimit = 1
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	handler.UseProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		if params.Width == 13 {
+			panic("unlucky width")
+		}
+		return proc
+	})
+
+	get := func(width string) int {
+		rec := httptest.NewRecorder()
+		target := "/?w=" + width + "&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec.Code
+	}
+	for _, width := range []string{"13", "20", "13", "40"} {
+		want := http.StatusOK
+		if width == "13" {
+			want = http.StatusInternalServerError
+		}
+		if code := get(width); code != want {
+			t.Errorf("w=%s: expected %d, got %d", width, want, code)
+		}
+	}
+}
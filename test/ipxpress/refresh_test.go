@@ -0,0 +1,190 @@
+package ipxpress_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// refreshFixture is a handler with a refresher, a fake clock and an injected load signal
+type refreshFixture struct {
+	server  *httptest.Server
+	handler *ipxpress.Handler
+	origin  *httptest.Server
+	fetches map[string]*int32
+	version atomic.Int32
+	offset  atomic.Int64
+	load    atomic.Value
+}
+
+func newRefreshFixture(t *testing.T) *refreshFixture {
+	t.Helper()
+	f := &refreshFixture{fetches: map[string]*int32{"/a.png": new(int32), "/b.png": new(int32), "/c.png": new(int32), "/d.png": new(int32)}}
+	f.load.Store(0.0)
+	f.origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(f.fetches[r.URL.Path], 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(append([]byte("\x89PNG\r\n\x1a\n"), byte(f.version.Load())))
+	}))
+	t.Cleanup(f.origin.Close)
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.StreamThreshold = 0
+	config.CacheTTL = 10 * time.Minute
+	config.Now = func() time.Time { return time.Now().Add(time.Duration(f.offset.Load())) }
+	config.Refresh = &ipxpress.RefreshConfig{
+		Interval:  time.Hour, // cycles are run by the tests
+		Lookahead: 2 * time.Minute,
+		TopN:      2,
+		MaxLoad:   0.5,
+		Load:      func() float64 { return f.load.Load().(float64) },
+	}
+	f.handler = ipxpress.NewHandler(config)
+	t.Cleanup(f.handler.Close)
+	f.server = httptest.NewServer(f.handler)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// get requests the source path n times, returning the last body
+func (f *refreshFixture) get(t *testing.T, path string, n int) []byte {
+	t.Helper()
+	var body []byte
+	for range n {
+		resp, err := http.Get(f.server.URL + "/?url=" + url.QueryEscape(f.origin.URL+path))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+	return body
+}
+
+func (f *refreshFixture) fetched(path string) int32 {
+	return atomic.LoadInt32(f.fetches[path])
+}
+
+// TestRefreshPopularWhenIdle verifies only the most popular entries close to expiry
+// are refetched, and only while load is low
+func TestRefreshPopularWhenIdle(t *testing.T) {
+	f := newRefreshFixture(t)
+	f.get(t, "/a.png", 5) // 4 hits
+	f.get(t, "/b.png", 3) // 2 hits
+	f.get(t, "/d.png", 2) // 1 hit, outside the top 2
+	f.get(t, "/c.png", 1) // never hit
+
+	// Nothing expires within the lookahead yet
+	if stats := f.handler.Refresh(); stats.Refreshed != 0 || stats.SkippedLoad != 0 {
+		t.Fatalf("expected no work before the lookahead, got %+v", stats)
+	}
+
+	// Close to expiry, but busy
+	f.offset.Store(int64(9 * time.Minute))
+	f.load.Store(0.9)
+	if stats := f.handler.Refresh(); stats.Refreshed != 0 || stats.SkippedLoad != 2 {
+		t.Fatalf("expected 2 candidates skipped under load, got %+v", stats)
+	}
+	if f.fetched("/a.png") != 1 || f.fetched("/b.png") != 1 {
+		t.Fatal("expected no refetch under load")
+	}
+
+	// Idle: the two most popular are refreshed in place
+	f.version.Store(1)
+	f.load.Store(0.1)
+	if stats := f.handler.Refresh(); stats.Refreshed != 2 || stats.Failed != 0 {
+		t.Fatalf("expected 2 refreshed, got %+v", stats)
+	}
+	for path, want := range map[string]int32{"/a.png": 2, "/b.png": 2, "/c.png": 1, "/d.png": 1} {
+		if got := f.fetched(path); got != want {
+			t.Errorf("%s: expected %d fetches, got %d", path, want, got)
+		}
+	}
+	if body := f.get(t, "/a.png", 1); body[len(body)-1] != 1 {
+		t.Error("expected the refreshed bytes to be served")
+	}
+	if f.fetched("/a.png") != 2 {
+		t.Error("expected the refreshed entry to be served from the cache")
+	}
+
+	// Refreshed entries have a full TTL again, making room for the next popular one
+	if stats := f.handler.Refresh(); stats.Refreshed != 1 {
+		t.Errorf("expected 1 refreshed, got %+v", stats)
+	}
+	if f.fetched("/a.png") != 2 || f.fetched("/d.png") != 2 || f.fetched("/c.png") != 1 {
+		t.Error("expected only d to be refetched")
+	}
+
+	total := f.handler.RefreshStats()
+	if total.Cycles != 4 || total.Refreshed != 3 || total.SkippedLoad != 2 {
+		t.Errorf("unexpected totals: %+v", total)
+	}
+
+	rec := httptest.NewRecorder()
+	f.handler.Admin().ServeHTTP(rec, httptest.NewRequest("GET", "/refresh", nil))
+	var reported ipxpress.RefreshStats
+	if err := json.NewDecoder(rec.Body).Decode(&reported); err != nil || reported != total {
+		t.Errorf("expected admin to report %+v, got %+v (%v)", total, reported, err)
+	}
+}
+
+// TestRefreshShutdown verifies Shutdown stops the background cycles
+func TestRefreshShutdown(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Refresh = &ipxpress.RefreshConfig{Interval: 5 * time.Millisecond}
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for handler.RefreshStats().Cycles == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if handler.RefreshStats().Cycles == 0 {
+		t.Fatal("expected background cycles")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	cycles := handler.RefreshStats().Cycles
+	time.Sleep(30 * time.Millisecond)
+	if got := handler.RefreshStats().Cycles; got != cycles {
+		t.Errorf("expected no cycles after shutdown, got %d more", got-cycles)
+	}
+	if err := handler.Shutdown(ctx); err != nil {
+		t.Errorf("expected a second shutdown to succeed, got %v", err)
+	}
+}
+
+// TestRefreshDisabled verifies the refresher is off by default
+func TestRefreshDisabled(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	if stats := handler.Refresh(); stats != (ipxpress.RefreshStats{}) {
+		t.Errorf("expected no work, got %+v", stats)
+	}
+	rec := httptest.NewRecorder()
+	handler.Admin().ServeHTTP(rec, httptest.NewRequest("GET", "/refresh", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "disabled") {
+		t.Errorf("expected 404, got %d %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,199 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// sampleValue returns a valid non-default value for a parameter
+func sampleValue(spec ipxpress.ParamSpec) string {
+	switch spec.Name {
+	case core.ParamURL:
+		return "http://example.com/other.png"
+	case core.ParamQuality:
+		return "50"
+	case core.ParamWatermark, core.ParamAnimated, core.ParamOrient:
+		return "false"
+	case core.ParamBackground, core.ParamTint:
+		return "ff0000"
+	case core.ParamDuotone:
+		return "000000_ffffff"
+	case core.ParamBorder:
+		return "10_ff0000"
+	}
+	switch spec.Type {
+	case core.ParamTypeInt:
+		if spec.Range != nil {
+			return "2"
+		}
+		return "3"
+	case core.ParamTypeFloat:
+		return "1.5"
+	case core.ParamTypeBool:
+		return "true"
+	case core.ParamTypeSize:
+		return "10x20"
+	case core.ParamTypePacked:
+		return strings.Repeat("1_", spec.Parts-1) + "1"
+	case core.ParamTypeFormat:
+		return "webp"
+	case core.ParamTypeURL:
+		return "http://example.com/overlay.png"
+	}
+	if len(spec.Values) > 0 {
+		return spec.Values[0]
+	}
+	return "top"
+}
+
+// prerequisites lists parameters that conflict away without another one
+var prerequisites = map[string]string{
+	core.ParamMaxBytes:       "&q=auto",
+	core.ParamPixelateRegion: "&pixelate=4",
+	core.ParamOverlayPos:     "&overlay=http%3A%2F%2Fexample.com%2Fo.png",
+	core.ParamOverlayWidth:   "&overlay=http%3A%2F%2Fexample.com%2Fo.png",
+}
+
+// TestRegistryNamesAreUnique verifies names and aliases resolve to exactly one spec
+func TestRegistryNamesAreUnique(t *testing.T) {
+	seen := map[string]string{}
+	for _, spec := range ipxpress.ListParams() {
+		if spec.Description == "" {
+			t.Errorf("%s: missing description", spec.Name)
+		}
+		for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+			if other, ok := seen[name]; ok {
+				t.Errorf("%s is used by both %s and %s", name, other, spec.Name)
+			}
+			seen[name] = spec.Name
+			if got, ok := ipxpress.LookupParam(name); !ok || got.Name != spec.Name {
+				t.Errorf("LookupParam(%q) = %q, %v; want %q", name, got.Name, ok, spec.Name)
+			}
+		}
+	}
+	if _, ok := ipxpress.LookupParam("greyscale"); ok {
+		t.Error("expected unknown names not to resolve")
+	}
+
+	for alias, name := range map[string]string{core.AliasWidth: core.ParamWidth, core.AliasHeight: core.ParamHeight,
+		core.AliasFormat: core.ParamFormat, core.AliasQuality: core.ParamQuality, core.AliasResize: core.ParamResize,
+		core.AliasBackground: core.ParamBackground, core.AliasPosition: core.ParamPosition} {
+		if seen[alias] != name {
+			t.Errorf("alias %s: expected %s, got %q", alias, name, seen[alias])
+		}
+	}
+}
+
+// TestRegistryDrivesParsing verifies every listed parameter is parsed under each of
+// its names and, if it says so, changes the cache key
+func TestRegistryDrivesParsing(t *testing.T) {
+	for _, spec := range ipxpress.ListParams() {
+		base := "/?url=" + url.QueryEscape("http://example.com/a.png") + "&w=100&h=100" + prerequisites[spec.Name]
+		switch spec.Name {
+		case core.ParamURL:
+			base = "/?w=100"
+		case core.ParamWidth, core.ParamHeight, core.ParamResize:
+			base = "/?url=" + url.QueryEscape("http://example.com/a.png")
+		}
+		baseKey := ipxpress.GenerateCacheKey(parseQuery(t, base))
+		value := sampleValue(spec)
+
+		var keys []string
+		for _, name := range append([]string{spec.Name}, spec.Aliases...) {
+			params := parseQuery(t, base+"&"+name+"="+url.QueryEscape(value))
+			if err := params.Err(); err != nil {
+				t.Errorf("%s=%s: unexpected error %v", name, value, err)
+			}
+			keys = append(keys, ipxpress.GenerateCacheKey(params))
+		}
+		for i, key := range keys {
+			if key != keys[0] {
+				t.Errorf("%s: alias %s parses differently", spec.Name, spec.Aliases[i-1])
+			}
+		}
+		if spec.AffectsCacheKey && keys[0] == baseKey {
+			t.Errorf("%s=%s: expected the cache key to change", spec.Name, value)
+		}
+	}
+}
+
+// TestQueryRoundTrip verifies Query encodes every parameter so that it parses back the same
+func TestQueryRoundTrip(t *testing.T) {
+	for _, spec := range ipxpress.ListParams() {
+		query := "/?url=" + url.QueryEscape("http://example.com/a.png") + "&w=100&h=100" + prerequisites[spec.Name] +
+			"&" + spec.Name + "=" + url.QueryEscape(sampleValue(spec))
+		params := parseQuery(t, query)
+		again := parseQuery(t, "/?"+params.Query().Encode())
+		if ipxpress.GenerateCacheKey(again) != ipxpress.GenerateCacheKey(params) {
+			t.Errorf("%s: %s parses differently from %s", spec.Name, params.Query().Encode(), query)
+		}
+	}
+	if q := (&ipxpress.ProcessingParams{Width: 100}).Query(); len(q) != 1 || q.Get(core.ParamWidth) != "100" {
+		t.Errorf("expected unset parameters to be left out, got %v", q)
+	}
+}
+
+// TestRegistryRangesEnforced verifies integer ranges from the specs are what the parser rejects
+func TestRegistryRangesEnforced(t *testing.T) {
+	for _, spec := range ipxpress.ListParams() {
+		if spec.Range == nil || spec.Type != core.ParamTypeInt {
+			continue
+		}
+		for _, v := range []int{int(spec.Range.Min) - 1, int(spec.Range.Max) + 1} {
+			params := parseQuery(t, "/?"+spec.Name+"="+strconv.Itoa(v))
+			if len(params.Errors) == 0 || params.Errors[0].Param != spec.Name {
+				t.Errorf("%s=%d: expected a range error, got %v", spec.Name, v, params.Err())
+			}
+		}
+	}
+}
+
+// TestParamsEndpoint verifies /params serves the registry as JSON
+func TestParamsEndpoint(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/params", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var body struct {
+		Params []struct {
+			Name            string   `json:"name"`
+			Aliases         []string `json:"aliases"`
+			Type            string   `json:"type"`
+			Range           *struct{ Min, Max float64 }
+			Default         string `json:"default"`
+			AffectsCacheKey bool   `json:"affects_cache_key"`
+		} `json:"params"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Params) != len(ipxpress.ListParams()) {
+		t.Errorf("expected %d params, got %d", len(ipxpress.ListParams()), len(body.Params))
+	}
+	for _, p := range body.Params {
+		if p.Name != core.ParamQuality {
+			continue
+		}
+		if len(p.Aliases) != 1 || p.Aliases[0] != "q" || p.Type != "int" || p.Default != "85" ||
+			p.Range == nil || p.Range.Min != 1 || p.Range.Max != 100 || !p.AffectsCacheKey {
+			t.Errorf("unexpected quality spec: %+v", p)
+		}
+		return
+	}
+	t.Error("quality not listed")
+}
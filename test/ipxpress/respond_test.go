@@ -0,0 +1,127 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// respondServer serves src from an origin through a handler set up by register,
+// with debug headers; it returns the handler's URL and the origin's request count
+func respondServer(t *testing.T, src []byte, register func(*ipxpress.Handler)) (string, *atomic.Int32) {
+	t.Helper()
+	var fetches atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(src)
+	}))
+	t.Cleanup(origin.Close)
+	config := ipxpress.DefaultConfig()
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config)
+	t.Cleanup(handler.Close)
+	register(handler)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server.URL + "/?f=png&w=50&url=" + url.QueryEscape(origin.URL+"/a.png"), &fetches
+}
+
+func getResponse(t *testing.T, target string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+// TestRespondReject verifies a pre-processor can reject a request with its own status and body
+func TestRespondReject(t *testing.T) {
+	var later bool
+	tooSmall := func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		if proc.Width() < 10 || proc.Height() < 10 {
+			return proc.Respond(&ipxpress.Response{StatusCode: http.StatusUnprocessableEntity, ContentType: "text/plain", Body: []byte("image too small")})
+		}
+		return proc
+	}
+	register := func(h *ipxpress.Handler) {
+		h.UsePreProcessor(tooSmall)
+		h.UseProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+			later = proc.Err() == nil
+			return proc
+		})
+	}
+
+	target, fetches := respondServer(t, createSolidPNG(5, 5, color.RGBA{R: 255, A: 255}), register)
+	for _, cache := range []string{"MISS", "HIT"} {
+		resp, body := getResponse(t, target)
+		if resp.StatusCode != http.StatusUnprocessableEntity || string(body) != "image too small" || resp.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("expected 422 image too small, got %d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		if got := resp.Header.Get("X-IPX-Cache"); got != cache {
+			t.Errorf("expected X-IPX-Cache %s, got %s", cache, got)
+		}
+	}
+	if fetches.Load() != 1 || later {
+		t.Errorf("expected one fetch and processing stopped, got %d fetches, later=%t", fetches.Load(), later)
+	}
+
+	target, _ = respondServer(t, createSolidPNG(40, 40, color.RGBA{R: 255, A: 255}), register)
+	if resp, _ := getResponse(t, target); resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("expected large images processed, got %d", resp.StatusCode)
+	}
+}
+
+// TestRespondReplace verifies a processor can serve another image, and keep it out of the cache
+func TestRespondReplace(t *testing.T) {
+	placeholder := createSolidPNG(8, 8, color.RGBA{B: 255, A: 255})
+	for _, noStore := range []bool{false, true} {
+		target, fetches := respondServer(t, createGradientPNG(100, 100), func(h *ipxpress.Handler) {
+			h.UseProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+				if strings.Contains(params.URL, "127.0.0.1") {
+					return proc.Respond(&ipxpress.Response{ContentType: "image/png", Body: placeholder, NoStore: noStore})
+				}
+				return proc
+			})
+		})
+		for range 2 {
+			resp, body := getResponse(t, target)
+			if resp.StatusCode != http.StatusOK || !bytes.Equal(body, placeholder) || resp.Header.Get("Content-Type") != "image/png" {
+				t.Errorf("no-store=%t: expected the placeholder, got %d %q", noStore, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			if noStore != strings.Contains(resp.Header.Get("Cache-Control"), "no-store") {
+				t.Errorf("no-store=%t: unexpected Cache-Control %q", noStore, resp.Header.Get("Cache-Control"))
+			}
+		}
+		if want := map[bool]int32{false: 1, true: 2}[noStore]; fetches.Load() != want {
+			t.Errorf("no-store=%t: expected %d fetches, got %d", noStore, want, fetches.Load())
+		}
+	}
+}
+
+// TestRespondPipeline verifies Pipeline.Run reports a rejecting Response as a ProcessError
+func TestRespondPipeline(t *testing.T) {
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+	handler.UseProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		return proc.Respond(&ipxpress.Response{StatusCode: http.StatusForbidden, Body: []byte("blocked")})
+	})
+	pl, err := handler.NewPipeline(&ipxpress.ProcessingParams{Width: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pl.Run(createGradientPNG(20, 20))
+	if perr, ok := err.(*ipxpress.ProcessError); !ok || perr.StatusCode != http.StatusForbidden || perr.Message != "blocked" {
+		t.Errorf("expected a 403 ProcessError, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package ipxpress_test
+
+import (
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// newNoStoreOrigin serves src with the given Cache-Control and counts requests
+func newNoStoreOrigin(tb testing.TB, src []byte, cacheControl string, hits *atomic.Int32) *httptest.Server {
+	tb.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(src)
+	}))
+	tb.Cleanup(server.Close)
+	return server
+}
+
+// TestUncacheableResponseEncodedDirectly verifies misses the origin forbids caching are encoded straight to the client
+func TestUncacheableResponseEncodedDirectly(t *testing.T) {
+	var hits atomic.Int32
+	origin := newNoStoreOrigin(t, createTestImage(800, 600), "no-store", &hits)
+	config := ipxpress.DefaultConfig()
+	config.HonorOriginCacheControl = true
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	target := "/?w=200&f=png&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("request %d: expected a png, got %d %q: %s", i, rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+		if cl := rec.Header().Get("Content-Length"); cl != "" {
+			t.Errorf("request %d: expected no Content-Length on a directly encoded response, got %s", i, cl)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "private, no-store" {
+			t.Errorf("request %d: expected Cache-Control private, no-store, got %q", i, cc)
+		}
+		if status := rec.Header().Get("X-IPX-Cache"); status != "BYPASS" {
+			t.Errorf("request %d: expected BYPASS, got %q", i, status)
+		}
+		img, err := png.Decode(rec.Body)
+		if err != nil || img.Bounds().Dx() != 200 {
+			t.Fatalf("request %d: expected a 200px wide png (%v)", i, err)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("expected the source fetched for every request, got %d fetches", n)
+	}
+}
+
+// TestUncacheableFollowersLimited verifies requests waiting on an uncacheable miss encode within ProcessingLimit
+func TestUncacheableFollowersLimited(t *testing.T) {
+	var hits atomic.Int32
+	origin := newNoStoreOrigin(t, createTestImage(400, 300), "no-store", &hits)
+	config := ipxpress.DefaultConfig()
+	config.HonorOriginCacheControl = true
+	config.ProcessingLimit = 1
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	var running, most atomic.Int32
+	handler.UseProcessor(func(proc *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		n := running.Add(1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		running.Add(-1)
+		return proc
+	})
+
+	target := "/?w=100&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("expected 200, got %d", rec.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if m := most.Load(); m > 1 {
+		t.Errorf("expected at most one encode at a time with ProcessingLimit 1, got %d", m)
+	}
+}
+
+// TestCachedResponseContentLength verifies responses written from the cache keep their Content-Length
+func TestCachedResponseContentLength(t *testing.T) {
+	var hits atomic.Int32
+	origin := sizedOrigin(t, &hits)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	target := "/?url=" + url.QueryEscape(origin.URL+"/photo.png?size=65536")
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(65536) || rec.Body.Len() != 65536 {
+			t.Errorf("request %d: expected Content-Length 65536 with as many bytes, got %q with %d", i, cl, rec.Body.Len())
+		}
+	}
+}
+
+// BenchmarkLargeUncachedResponse compares allocations for a 4K PNG that isn't
+// cached: buffered into an entry (over CacheMaxEntryBytes) against encoded
+// straight to the client (a no-store origin).
+func BenchmarkLargeUncachedResponse(b *testing.B) {
+	src := createTestImageData(3840, 2160)
+	for _, bc := range []struct {
+		name         string
+		cacheControl string
+		maxEntry     int
+	}{
+		{"buffered", "", 1},
+		{"direct", "no-store", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var hits atomic.Int32
+			origin := newNoStoreOrigin(b, src, bc.cacheControl, &hits)
+			config := ipxpress.DefaultConfig()
+			config.HonorOriginCacheControl = true
+			config.CacheMaxEntryBytes = bc.maxEntry
+			handler := ipxpress.NewHandler(config)
+			defer handler.Close()
+
+			target := "/?f=png&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := &discardResponse{header: make(http.Header)}
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+				if w.status != http.StatusOK {
+					b.Fatalf("unexpected status %d", w.status)
+				}
+			}
+		})
+	}
+}
+
+// discardResponse is a ResponseWriter that drops the body, unlike
+// httptest.ResponseRecorder, whose buffer would dominate the allocations.
+type discardResponse struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponse) Header() http.Header { return w.header }
+
+func (w *discardResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return io.Discard.Write(p)
+}
@@ -0,0 +1,124 @@
+package ipxpress_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// flakyOrigin answers the first failures requests with status and header, then the image
+func flakyOrigin(t *testing.T, failures int32, status int, header http.Header, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= failures {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			w.Write([]byte("try again"))
+			return
+		}
+		w.Write([]byte("\x89PNG\r\n\x1a\nsource"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// retryFetcher returns a fetcher retrying quickly
+func retryFetcher(attempts int) *ipxpress.Fetcher {
+	config := ipxpress.DefaultFetcherConfig()
+	config.MaxAttempts = attempts
+	config.RetryBaseDelay = time.Millisecond
+	config.RetryMaxDelay = 2 * time.Second
+	return ipxpress.NewFetcherWithConfig(config)
+}
+
+// TestFetcherRetriesStatuses verifies retryable statuses are retried until the origin recovers
+func TestFetcherRetriesStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		var hits atomic.Int32
+		origin := flakyOrigin(t, 2, status, nil, &hits)
+		fetcher := retryFetcher(3)
+
+		data, err := fetcher.Fetch(origin.URL + "/photo.png")
+		if err != nil || string(data) != "\x89PNG\r\n\x1a\nsource" {
+			t.Fatalf("%d: expected the source after two retries, got %q, %v", status, data, err)
+		}
+		if stats := fetcher.Stats(); stats != (ipxpress.FetcherStats{Requests: 3, Retries: 2}) {
+			t.Errorf("%d: unexpected stats %+v", status, stats)
+		}
+	}
+}
+
+// TestFetcherRetryLimits verifies attempts run out and other statuses fail at once
+func TestFetcherRetryLimits(t *testing.T) {
+	var hits atomic.Int32
+	origin := flakyOrigin(t, 5, http.StatusServiceUnavailable, nil, &hits)
+	fetcher := retryFetcher(3)
+	_, err := fetcher.Fetch(origin.URL + "/photo.png")
+	var ferr *ipxpress.FetchError
+	if !errors.As(err, &ferr) || ferr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the 503 once attempts ran out, got %v", err)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	if stats := fetcher.Stats(); stats.Retries != 2 || stats.Failed != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	hits.Store(0)
+	notFound := flakyOrigin(t, 5, http.StatusNotFound, nil, &hits)
+	if _, err := fetcher.Fetch(notFound.URL + "/photo.png"); !errors.As(err, &ferr) || ferr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a 404, got %v", err)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected a 404 not retried, got %d attempts", n)
+	}
+}
+
+// TestFetcherRetryAfter verifies Retry-After replaces the backoff, unless it's too long
+func TestFetcherRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	origin := flakyOrigin(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, &hits)
+	fetcher := retryFetcher(3)
+	start := time.Now()
+	if _, err := fetcher.Fetch(origin.URL + "/photo.png"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the retry to wait for Retry-After, took %s", elapsed)
+	}
+
+	hits.Store(0)
+	patient := flakyOrigin(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"3600"}}, &hits)
+	start = time.Now()
+	_, err := fetcher.Fetch(patient.URL + "/photo.png")
+	var ferr *ipxpress.FetchError
+	if !errors.As(err, &ferr) || ferr.StatusCode != http.StatusServiceUnavailable || time.Since(start) > time.Second {
+		t.Errorf("expected an immediate 503 for a Retry-After over RetryMaxDelay, got %v", err)
+	}
+}
+
+// TestFetcherRetryCancelled verifies a cancelled context stops the backoff
+func TestFetcherRetryCancelled(t *testing.T) {
+	var hits atomic.Int32
+	origin := flakyOrigin(t, 5, http.StatusServiceUnavailable, http.Header{"Retry-After": {"2"}}, &hits)
+	fetcher := retryFetcher(3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := fetcher.FetchReserved(ctx, origin.URL+"/photo.png"); err == nil {
+		t.Fatal("expected an error after cancellation")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the wait abandoned on cancellation, took %s", elapsed)
+	}
+}
@@ -0,0 +1,158 @@
+package ipxpress_test
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// businessHoursSchedule returns short TTLs during the day and long ones at night
+func businessHoursSchedule() *ipxpress.TTLSchedule {
+	return &ipxpress.TTLSchedule{
+		Location: time.UTC,
+		Rules: []ipxpress.TTLRule{
+			{Name: "business-hours", From: "08:00", To: "20:00", TTL: 60 * time.Second},
+			{Name: "night", From: "20:00", To: "08:00", TTL: 12 * time.Hour},
+		},
+	}
+}
+
+// TestTTLScheduleActive tests rule selection including windows that wrap midnight
+func TestTTLScheduleActive(t *testing.T) {
+	schedule := businessHoursSchedule()
+
+	tests := []struct {
+		clock string
+		want  string
+	}{
+		{"07:59", "night"},
+		{"08:00", "business-hours"},
+		{"19:59", "business-hours"},
+		{"20:00", "night"},
+		{"00:30", "night"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.clock, func(t *testing.T) {
+			now, _ := time.Parse("2006-01-02 15:04", "2026-03-02 "+tt.clock)
+			rule := schedule.Active(now)
+			if rule == nil || rule.Name != tt.want {
+				t.Errorf("expected rule %q, got %+v", tt.want, rule)
+			}
+		})
+	}
+
+	// Weekday-restricted rules don't match on other days
+	weekend := &ipxpress.TTLSchedule{Location: time.UTC, Rules: []ipxpress.TTLRule{
+		{Name: "weekend", From: "00:00", To: "23:59", Days: []time.Weekday{time.Saturday, time.Sunday}, TTL: time.Hour},
+	}}
+	monday, _ := time.Parse("2006-01-02 15:04", "2026-03-02 12:00")
+	if rule := weekend.Active(monday); rule != nil {
+		t.Errorf("expected no rule on Monday, got %q", rule.Name)
+	}
+}
+
+// TestTTLScheduleValidate tests schedule validation
+func TestTTLScheduleValidate(t *testing.T) {
+	if err := businessHoursSchedule().Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, rule := range []ipxpress.TTLRule{
+		{Name: "bad", From: "8am", To: "20:00", TTL: time.Minute},
+		{Name: "empty", From: "08:00", To: "08:00", TTL: time.Minute},
+		{Name: "day", From: "08:00", To: "20:00", Days: []time.Weekday{7}, TTL: time.Minute},
+		{Name: "ttl", From: "08:00", To: "20:00"},
+	} {
+		bad := &ipxpress.TTLSchedule{Rules: []ipxpress.TTLRule{rule}}
+		if err := bad.Validate(); err == nil {
+			t.Errorf("%s: expected an error", rule.Name)
+		}
+
+		// Neither a config nor a reload accepts it
+		config := ipxpress.DefaultConfig()
+		config.TTLSchedule = bad
+		if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "TTLSchedule") {
+			t.Errorf("%s: expected Config.Validate to reject the schedule, got %v", rule.Name, err)
+		}
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.TTLSchedule = businessHoursSchedule()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	bad := &ipxpress.TTLSchedule{Rules: []ipxpress.TTLRule{{Name: "typo", From: "8:00pm", To: "06:00", TTL: time.Hour}}}
+	if err := handler.SetTTLSchedule(bad); err == nil {
+		t.Error("expected SetTTLSchedule to reject an invalid schedule")
+	}
+}
+
+// TestTTLScheduleCrossesBoundary verifies entries stored on either side of a
+// schedule boundary get different TTLs, and that the schedule can be hot-swapped
+func TestTTLScheduleCrossesBoundary(t *testing.T) {
+	src := createSolidPNG(10, 10, color.RGBA{B: 255, A: 255})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer imgServer.Close()
+
+	var clock atomic.Value
+	setClock := func(s string) {
+		now, _ := time.Parse("2006-01-02 15:04", "2026-03-02 "+s)
+		clock.Store(now)
+	}
+	setClock("07:59")
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.TTLSchedule = businessHoursSchedule()
+	config.DebugHeaders = true
+	config.Now = func() time.Time { return clock.Load().(time.Time) }
+	handler := ipxpress.NewHandler(config)
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/?url=" + url.QueryEscape(imgServer.URL+path))
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/night.png")
+	if rule, ttl := resp.Header.Get("X-IPX-TTL-Rule"), resp.Header.Get("X-IPX-Cache-TTL"); rule != "night" || ttl != "12h0m0s" {
+		t.Errorf("before boundary: rule=%q ttl=%q", rule, ttl)
+	}
+
+	setClock("08:01")
+	resp = get("/day.png")
+	if rule, ttl := resp.Header.Get("X-IPX-TTL-Rule"), resp.Header.Get("X-IPX-Cache-TTL"); rule != "business-hours" || ttl != "1m0s" {
+		t.Errorf("after boundary: rule=%q ttl=%q", rule, ttl)
+	}
+
+	// Cached entries keep the TTL chosen when they were stored
+	resp = get("/night.png")
+	if rule := resp.Header.Get("X-IPX-TTL-Rule"); rule != "night" {
+		t.Errorf("cached entry: rule=%q", rule)
+	}
+
+	// Hot reload: removing the schedule falls back to CacheTTL
+	if err := handler.SetTTLSchedule(nil); err != nil {
+		t.Fatalf("SetTTLSchedule(nil): %v", err)
+	}
+	resp = get("/other.png")
+	if rule, ttl := resp.Header.Get("X-IPX-TTL-Rule"), resp.Header.Get("X-IPX-Cache-TTL"); rule != "" || ttl != config.CacheTTL.String() {
+		t.Errorf("after reload: rule=%q ttl=%q", rule, ttl)
+	}
+}
@@ -0,0 +1,78 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestShrinkOnLoadDimensions verifies downscales decoded at reduced resolution
+// match a full decode in size and, within tolerance, in content
+func TestShrinkOnLoadDimensions(t *testing.T) {
+	src := createTestImage(2400, 1600)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+
+	for _, size := range []struct{ w, h int }{{300, 0}, {0, 200}, {300, 300}, {1000, 0}, {2000, 0}} {
+		full, err := ipxpress.New().FromBytes(src).ResizeWithOptions(size.w, size.h, vips.KernelLanczos3, false).ToBytes(ipxpress.FormatPNG, 85)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := png.Decode(bytes.NewReader(full))
+
+		target := "/?f=png&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+		if size.w > 0 {
+			target += "&w=" + strconv.Itoa(size.w)
+		}
+		if size.h > 0 {
+			target += "&h=" + strconv.Itoa(size.h)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		got, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("%dx%d: %v", size.w, size.h, err)
+		}
+		if got.Bounds() != want.Bounds() {
+			t.Errorf("%dx%d: expected %v like a full decode, got %v", size.w, size.h, want.Bounds().Size(), got.Bounds().Size())
+			continue
+		}
+		if diff := meanDiff(got, want); diff > 3 {
+			t.Errorf("%dx%d: output differs from a full decode by %.2f on average", size.w, size.h, diff)
+		}
+	}
+}
+
+// BenchmarkShrinkOnLoad compares downscaling a 24 MP JPEG to 300px from a full
+// decode and with shrink-on-load.
+func BenchmarkShrinkOnLoad(b *testing.B) {
+	src := createTestImage(6000, 4000)
+	for _, bc := range []struct {
+		name   string
+		shrink bool
+	}{{"full", false}, {"shrink", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				proc := ipxpress.New()
+				if bc.shrink {
+					proc = proc.ShrinkOnLoad(300, 0)
+				}
+				if _, err := proc.FromBytes(src).ResizeWithOptions(300, 0, vips.KernelLanczos3, false).ToBytes(ipxpress.FormatJPEG, 80); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
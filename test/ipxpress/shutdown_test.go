@@ -0,0 +1,113 @@
+package ipxpress_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// slowOrigin answers 404 once release is closed, signalling arrivals on started
+func slowOrigin(started chan<- struct{}, release <-chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		http.NotFound(w, r)
+	}))
+}
+
+// TestShutdownDrainsInFlight verifies a request being fetched completes across a
+// graceful shutdown of the server and the handler
+func TestShutdownDrainsInFlight(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	origin := slowOrigin(started, release)
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	front := httptest.NewServer(handler)
+	defer front.Close()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(front.URL + "/?url=" + url.QueryEscape(origin.URL+"/slow.png"))
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		if err := front.Config.Shutdown(ctx); err != nil {
+			shutdown <- err
+			return
+		}
+		shutdown <- handler.Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	select {
+	case code := <-status:
+		if code != http.StatusNotFound {
+			t.Errorf("expected the in-flight request to complete with the origin's 404, got %d", code)
+		}
+	default:
+		t.Error("expected the in-flight request to have completed when shutdown returned")
+	}
+}
+
+// TestShutdownTimeout verifies Shutdown gives up when ctx is done first
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	origin := slowOrigin(started, release)
+	defer origin.Close()
+	defer close(release)
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/slow.png"), nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := handler.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+
+	// Slots taken while waiting are handed back, so the handler still serves
+	release <- struct{}{}
+	<-done
+	if err := handler.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected shutdown to succeed once idle, got %v", err)
+	}
+}
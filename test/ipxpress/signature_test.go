@@ -0,0 +1,103 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+var signClock = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// signedServer serves a handler accepting secrets, with a cache seeded for the thumbnail params
+func signedServer(t *testing.T, secrets ...string) *httptest.Server {
+	t.Helper()
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	cache.Set(ipxpress.GenerateCacheKey(parseQuery(t, "/?"+sourceQuery(presetSource, "w=200&f=webp"))), &ipxpress.CacheEntry{
+		ContentType: "image/webp",
+		Data:        []byte("seeded"),
+		StatusCode:  http.StatusOK,
+	})
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = cache
+	config.SignatureSecrets = secrets
+	config.Now = func() time.Time { return signClock }
+	handler := ipxpress.NewHandler(config)
+	t.Cleanup(handler.Close)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+var signedParams = &ipxpress.ProcessingParams{URL: presetSource, Width: 200, Format: ipxpress.FormatWebP}
+
+// TestSignedURLs verifies valid, tampered, unsigned and expired requests
+func TestSignedURLs(t *testing.T) {
+	server := signedServer(t, "s3cret")
+	base := server.URL + "/"
+
+	valid := ipxpress.SignURL("s3cret", base, signedParams)
+	tampered := strings.Replace(valid, "width=200", "width=2000", 1)
+	unsigned := base + "?" + signedParams.Query().Encode()
+	wrongKey := ipxpress.SignURL("guess", base, signedParams)
+	expired := ipxpress.SignURLUntil("s3cret", base, signedParams, signClock.Add(-time.Minute))
+	current := ipxpress.SignURLUntil("s3cret", base, signedParams, signClock.Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+		body   string
+	}{
+		{"valid", valid, http.StatusOK, "seeded"},
+		{"not yet expired", current, http.StatusOK, "seeded"},
+		{"tampered", tampered, http.StatusForbidden, "invalid signature"},
+		{"unsigned", unsigned, http.StatusForbidden, "invalid signature"},
+		{"wrong secret", wrongKey, http.StatusForbidden, "invalid signature"},
+		{"expired", expired, http.StatusForbidden, "signature expired"},
+		{"expiry changed", strings.Replace(expired, "expires=", "expires=9", 1), http.StatusForbidden, "invalid signature"},
+		{"formats stay public", server.URL + "/formats", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		status, body := getBody(t, tt.target)
+		if status != tt.status || !strings.Contains(body, tt.body) {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.name, tt.status, tt.body, status, body)
+		}
+	}
+}
+
+// TestSignatureRotation verifies every configured secret is accepted
+func TestSignatureRotation(t *testing.T) {
+	server := signedServer(t, "new", "old")
+	for _, secret := range []string{"new", "old"} {
+		if status, body := getBody(t, ipxpress.SignURL(secret, server.URL+"/", signedParams)); status != http.StatusOK || body != "seeded" {
+			t.Errorf("%s: expected the signature to be accepted, got %d %q", secret, status, body)
+		}
+	}
+	if status, _ := getBody(t, ipxpress.SignURL("older", server.URL+"/", signedParams)); status != http.StatusForbidden {
+		t.Errorf("expected a retired secret to be refused, got %d", status)
+	}
+}
+
+// TestSignatureCanonical verifies the signature doesn't depend on parameter order or escaping
+func TestSignatureCanonical(t *testing.T) {
+	a, _ := url.ParseQuery("w=200&url=http%3A%2F%2Fexample.com%2Fa%20b.jpg&f=webp")
+	b, _ := url.ParseQuery("f=webp&url=http://example.com/a+b.jpg&w=200")
+	if ipxpress.VerifySignature(a, []string{"k"}, signClock) == nil {
+		t.Fatal("an unsigned query should be refused")
+	}
+	a.Set(core.ParamSignature, core.Signature("k", a))
+	b.Set(core.ParamSignature, a.Get(core.ParamSignature))
+	if err := ipxpress.VerifySignature(b, []string{"k"}, signClock); err != nil {
+		t.Errorf("reordered query: %v", err)
+	}
+	if ipxpress.GenerateCacheKey(parseQuery(t, "/?"+a.Encode())) != ipxpress.GenerateCacheKey(parseQuery(t, "/?f=webp&url=http://example.com/a+b.jpg&w=200")) {
+		t.Error("the signature should not change the cache key")
+	}
+}
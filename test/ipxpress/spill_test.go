@@ -0,0 +1,245 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// patterned returns n bytes that differ from position to position
+func patterned(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	return data
+}
+
+// spillFiles lists the spilled entry files in dir
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "ipx-*.entry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// newSpillCache creates a cache spilling entries of 1 MB and more into a temp dir
+func newSpillCache(t *testing.T, capacity int) (*ipxpress.InMemoryCache, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cache := ipxpress.NewInMemoryCache(time.Minute, capacity)
+	if err := cache.SpillLargeEntries(dir, 1<<20); err != nil {
+		t.Fatalf("SpillLargeEntries: %v", err)
+	}
+	return cache, dir
+}
+
+// TestSpillLargeEntries verifies large entries leave the heap and read back intact
+func TestSpillLargeEntries(t *testing.T) {
+	cache, dir := newSpillCache(t, 64<<20)
+
+	data := patterned(2 << 20)
+	cache.Set("large", &ipxpress.CacheEntry{ContentType: "image/png", Data: data, StatusCode: 200})
+	cache.Set("small", &ipxpress.CacheEntry{ContentType: "image/png", Data: patterned(1024), StatusCode: 200})
+
+	large, ok := cache.Get("large")
+	if !ok {
+		t.Fatal("large entry missing")
+	}
+	if large.Data != nil || large.Size() != len(data) {
+		t.Errorf("expected spilled entry of %d bytes, got Data=%d Size=%d", len(data), len(large.Data), large.Size())
+	}
+	got, err := large.Bytes()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("spilled data differs (err %v)", err)
+	}
+	if meta, _ := cache.Peek("large"); meta.Size != len(data) {
+		t.Errorf("Peek size %d, want %d", meta.Size, len(data))
+	}
+
+	small, _ := cache.Get("small")
+	if len(small.Data) != 1024 {
+		t.Error("small entry should stay in memory")
+	}
+
+	if n := len(spillFiles(t, dir)); n != 1 {
+		t.Errorf("expected 1 spill file, got %d", n)
+	}
+	cache.Close()
+	if n := len(spillFiles(t, dir)); n != 0 {
+		t.Errorf("expected Close to remove spill files, %d left", n)
+	}
+}
+
+// TestSpillEvictionDeletesFiles verifies evicted entries don't leave files behind
+func TestSpillEvictionDeletesFiles(t *testing.T) {
+	cache, dir := newSpillCache(t, 12<<20)
+	defer cache.Close()
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		cache.Set(key, &ipxpress.CacheEntry{Data: patterned(3 << 20), StatusCode: 200})
+	}
+
+	// Eviction and deletion listeners run asynchronously
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		keys, _ := cache.Keys("", 100, "")
+		files := spillFiles(t, dir)
+		if len(files) == len(keys) && len(keys) <= 4 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one file per cached entry, got %d files for %d entries", len(files), len(keys))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSpillReaderSurvivesEviction verifies a response in progress completes after eviction
+func TestSpillReaderSurvivesEviction(t *testing.T) {
+	cache, dir := newSpillCache(t, 64<<20)
+
+	data := patterned(2 << 20)
+	cache.Set("large", &ipxpress.CacheEntry{Data: data, StatusCode: 200})
+	entry, _ := cache.Get("large")
+
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(entry.WriteData(pw)) }()
+
+	head := make([]byte, 1024)
+	if _, err := io.ReadFull(pr, head); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	cache.Close() // evicts and unlinks the file mid-read
+	if n := len(spillFiles(t, dir)); n != 0 {
+		t.Errorf("expected the file to be unlinked, %d left", n)
+	}
+
+	rest, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("read after eviction: %v", err)
+	}
+	if !bytes.Equal(append(head, rest...), data) {
+		t.Error("data changed after eviction")
+	}
+
+	if _, err := entry.Bytes(); err == nil {
+		t.Error("expected an error reading an evicted entry after its readers finished")
+	}
+}
+
+// TestSpillOrphansRemovedAtStartup verifies files left by a crashed process are cleaned up
+func TestSpillOrphansRemovedAtStartup(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ipx-1.entry", "ipx-2.entry", "unrelated.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("stale"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.LargeEntryThreshold = 1 << 20
+	config.LargeEntryDir = dir
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	if n := len(spillFiles(t, dir)); n != 0 {
+		t.Errorf("expected orphaned entries removed, %d left", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unrelated.txt")); err != nil {
+		t.Errorf("unrelated file removed: %v", err)
+	}
+}
+
+// TestSpilledEntryServed verifies the handler streams spilled entries to clients
+func TestSpilledEntryServed(t *testing.T) {
+	cache, _ := newSpillCache(t, 64<<20)
+
+	data := patterned(3 << 20)
+	key := ipxpress.GenerateCacheKey(parseQuery(t, "/?url=http://example.com/a.png&w=10"))
+	cache.Set(key, &ipxpress.CacheEntry{ContentType: "image/png", Data: data, StatusCode: 200, ETag: `"abc"`})
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.Cache = cache
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=http://example.com/a.png&w=10")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Fatalf("expected the spilled body, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp.ContentLength != int64(len(data)) || resp.Header.Get("ETag") != `"abc"` {
+		t.Errorf("unexpected headers: length %d, etag %q", resp.ContentLength, resp.Header.Get("ETag"))
+	}
+}
+
+// BenchmarkGCWithLargeEntries compares GC cost with 5 MB entries held in the heap
+// versus spilled to disk, while the program allocates pointer-rich garbage under a
+// fixed memory limit.
+func BenchmarkGCWithLargeEntries(b *testing.B) {
+	const entries, size = 40, 5 << 20
+
+	for _, spill := range []bool{false, true} {
+		name := "heap"
+		if spill {
+			name = "spilled"
+		}
+		b.Run(name, func(b *testing.B) {
+			cache := ipxpress.NewInMemoryCache(time.Hour, 2*entries*size)
+			defer cache.Close()
+			if spill {
+				if err := cache.SpillLargeEntries(b.TempDir(), 1<<20); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for i := 0; i < entries; i++ {
+				cache.Set(string(rune('a'+i)), &ipxpress.CacheEntry{Data: make([]byte, size), StatusCode: 200})
+			}
+			runtime.GC()
+
+			// Same memory budget for both runs, enforced by the GC as with GOGC=off and
+			// GOMEMLIMIT in a container: entries held in the heap use up the headroom
+			// for garbage, so collections come more often.
+			defer debug.SetGCPercent(debug.SetGCPercent(-1))
+			defer debug.SetMemoryLimit(debug.SetMemoryLimit(entries*size + 64<<20))
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			var sink []*[64]byte
+			for i := 0; i < b.N; i++ {
+				sink = make([]*[64]byte, 1024)
+				for j := range sink {
+					sink[j] = new([64]byte)
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			_ = sink
+
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+			b.ReportMetric(float64(after.NumGC-before.NumGC), "gcs")
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package ipxpress_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// versionedOrigin serves a PNG signature followed by the current version byte, or fails
+type versionedOrigin struct {
+	version atomic.Int32
+	failing atomic.Bool
+	hits    atomic.Int32
+}
+
+func (o *versionedOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.hits.Add(1)
+	if o.failing.Load() {
+		http.Error(w, "origin down", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(append([]byte("\x89PNG\r\n\x1a\n"), byte(o.version.Load())))
+}
+
+// TestStaleWhileRevalidate walks an entry through fresh, stale-served, refreshed and expired
+func TestStaleWhileRevalidate(t *testing.T) {
+	origin := &versionedOrigin{}
+	originServer := httptest.NewServer(origin)
+	defer originServer.Close()
+
+	var mu sync.Mutex
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.CacheTTL = time.Minute
+	config.StaleGrace = 10 * time.Minute
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config, ipxpress.WithClock(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}))
+	defer handler.Close()
+
+	target := "/?url=" + url.QueryEscape(originServer.URL+"/photo.png")
+	get := func() (cache string, version byte, rec *httptest.ResponseRecorder) {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if body := rec.Body.Bytes(); len(body) > 0 {
+			version = body[len(body)-1]
+		}
+		return rec.Header().Get("X-IPX-Cache"), version, rec
+	}
+	waitForHit := func(want byte) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if cache, version, _ := get(); cache == "HIT" && version == want {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("entry was not refreshed to version %d", want)
+	}
+
+	// Fresh
+	if cache, version, _ := get(); cache != "MISS" || version != 0 {
+		t.Fatalf("expected a miss of version 0, got %s %d", cache, version)
+	}
+	advance(30 * time.Second)
+	if cache, _, rec := get(); cache != "HIT" || rec.Header().Get("Warning") != "" {
+		t.Fatalf("expected a fresh hit, got %s", cache)
+	}
+
+	// Stale: the old version is served at once and replaced in the background
+	origin.version.Store(1)
+	advance(time.Minute)
+	cache, version, rec := get()
+	if cache != "STALE" || version != 0 || rec.Code != http.StatusOK {
+		t.Fatalf("expected version 0 served stale, got %d %s %d", rec.Code, cache, version)
+	}
+	if w := rec.Header().Get("Warning"); w != `110 - "Response is Stale"` {
+		t.Errorf("expected a stale Warning header, got %q", w)
+	}
+	waitForHit(1)
+	if err := handler.Shutdown(context.Background()); err != nil { // waits for revalidations
+		t.Fatal(err)
+	}
+	if n := origin.hits.Load(); n != 2 {
+		t.Errorf("expected a single revalidation fetch, origin hit %d times", n)
+	}
+
+	// A failing origin keeps the stale entry served until the grace ends
+	origin.failing.Store(true)
+	advance(5 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if cache, version, _ := get(); cache != "STALE" || version != 1 {
+			t.Fatalf("expected version 1 served stale while the origin fails, got %s %d", cache, version)
+		}
+		handler.Shutdown(context.Background())
+	}
+	advance(10 * time.Minute)
+	if _, _, rec := get(); rec.Code != http.StatusBadGateway {
+		t.Errorf("expected the origin's error once the grace ended, got %d", rec.Code)
+	}
+}
+
+// TestStaleGraceDisabled verifies entries aren't served stale without StaleGrace
+func TestStaleGraceDisabled(t *testing.T) {
+	origin := &versionedOrigin{}
+	originServer := httptest.NewServer(origin)
+	defer originServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	target := "/?url=" + url.QueryEscape(originServer.URL+"/photo.png")
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Header().Get("Warning") != "" {
+			t.Errorf("unexpected Warning %q", rec.Header().Get("Warning"))
+		}
+	}
+	if n := origin.hits.Load(); n != 1 {
+		t.Errorf("expected one fetch, got %d", n)
+	}
+}
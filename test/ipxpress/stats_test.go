@@ -0,0 +1,101 @@
+package ipxpress_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestHandlerStats verifies the stats are populated once images were processed
+func TestHandlerStats(t *testing.T) {
+	src := createTestImage(200, 150)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+	handler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer handler.Close()
+
+	for _, width := range []int{40, 80, 120} {
+		rec := httptest.NewRecorder()
+		target := "/?w=" + strconv.Itoa(width) + "&url=" + url.QueryEscape(origin.URL+"/photo.jpg")
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("w=%d: expected 200, got %d", width, rec.Code)
+		}
+	}
+
+	stats := handler.Stats()
+	if stats.Uptime <= 0 || stats.InFlight != 0 {
+		t.Errorf("unexpected uptime or requests in flight: %+v", stats)
+	}
+	if stats.Vips.MemHighwater <= 0 || stats.Vips.MemHighwater < stats.Vips.Mem {
+		t.Errorf("expected libvips memory accounted, got %+v", stats.Vips)
+	}
+	if stats.Cache == nil || stats.Cache.Entries != 3 || stats.Cache.Bytes <= 0 {
+		t.Errorf("expected three cached variants, got %+v", stats.Cache)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.Admin().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var served struct {
+		Uptime int64 `json:"uptime"`
+		Vips   struct {
+			MemHighwater int64 `json:"mem_highwater"`
+		} `json:"vips"`
+		Cache struct {
+			Entries int `json:"entries"`
+		} `json:"cache"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+	if served.Uptime <= 0 || served.Vips.MemHighwater <= 0 || served.Cache.Entries != 3 {
+		t.Errorf("unexpected /stats response %+v", served)
+	}
+}
+
+// TestVipsWatchdog verifies limits and steady growth raise alerts, passed to OnAlert
+func TestVipsWatchdog(t *testing.T) {
+	var alerts []ipxpress.VipsAlert
+	config := ipxpress.DefaultConfig()
+	config.VipsWatchdog = &ipxpress.VipsWatchdogConfig{
+		OnAlert: func(alert ipxpress.VipsAlert) { alerts = append(alerts, alert) },
+	}
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	proc := ipxpress.New().FromBytes(createTestImage(300, 200))
+	defer proc.Close()
+	if err := proc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got := handler.CheckVips()
+	if len(got) != 0 {
+		t.Errorf("expected no alerts without limits, got %+v", got)
+	}
+
+	config.VipsWatchdog.MaxMem = 1
+	config.VipsWatchdog.GrowthChecks = 1
+	handler = ipxpress.NewHandler(config)
+	defer handler.Close()
+	got = handler.CheckVips() // from nothing to something counts as growth
+	reasons := map[string]bool{}
+	for _, alert := range got {
+		reasons[alert.Reason] = true
+	}
+	if !reasons[ipxpress.VipsAlertMem] || !reasons[ipxpress.VipsAlertGrowth] || len(alerts) != len(got) {
+		t.Errorf("expected mem and growth alerts passed to OnAlert, got %+v (%d passed)", got, len(alerts))
+	}
+
+	unwatched := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer unwatched.Close()
+	if got := unwatched.CheckVips(); got != nil {
+		t.Errorf("expected no checks without a watchdog, got %+v", got)
+	}
+}
@@ -0,0 +1,222 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// countingReader lazily produces size bytes starting with a PNG signature and counts how
+// many bytes the origin has actually handed to the network
+type countingReader struct {
+	size     int64
+	produced *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	off := atomic.LoadInt64(r.produced)
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-off {
+		p = p[:r.size-off]
+	}
+	sig := []byte("\x89PNG\r\n\x1a\n")
+	for i := range p {
+		if pos := off + int64(i); pos < int64(len(sig)) {
+			p[i] = sig[pos]
+		} else {
+			p[i] = byte(pos)
+		}
+	}
+	atomic.AddInt64(r.produced, int64(len(p)))
+	return len(p), nil
+}
+
+// newStreamHandler returns a handler with a small streaming threshold
+func newStreamHandler() *ipxpress.Handler {
+	config := ipxpress.DefaultConfig()
+	config.StreamThreshold = 1024 * 1024
+	config.Capabilities = limitedCapabilities()
+	return ipxpress.NewHandler(config)
+}
+
+// TestStreamLargePassthrough verifies large passthroughs are piped with bounded memory
+// and the upstream read is aborted when the client goes away
+func TestStreamLargePassthrough(t *testing.T) {
+	const size = 64 * 1024 * 1024
+	var produced int64
+	originDone := make(chan struct{})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		io.Copy(w, &countingReader{size: size, produced: &produced})
+		<-r.Context().Done()
+		close(originDone)
+	}))
+	defer imgServer.Close()
+
+	server := httptest.NewServer(newStreamHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/big.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected image/png, got %q", ct)
+	}
+	if resp.ContentLength != size {
+		t.Errorf("expected Content-Length %d, got %d", size, resp.ContentLength)
+	}
+	if resp.Header.Get("Cache-Control") == "" {
+		t.Error("expected Cache-Control header on streamed response")
+	}
+
+	head := make([]byte, 1024*1024)
+	if _, err := io.ReadFull(resp.Body, head); err != nil {
+		t.Fatalf("failed to read head: %v", err)
+	}
+	if !bytes.HasPrefix(head, []byte("\x89PNG")) {
+		t.Error("streamed body does not start with the origin bytes")
+	}
+
+	// Give the pipe a moment to fill its buffers; backpressure must keep the origin
+	// far behind the full body
+	time.Sleep(200 * time.Millisecond)
+	if got := atomic.LoadInt64(&produced); got > size/2 {
+		t.Errorf("origin produced %d of %d bytes for a 1MB client read; body is being buffered", got, size)
+	}
+
+	// Disconnecting the client must cancel the upstream request
+	resp.Body.Close()
+	select {
+	case <-originDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled after client disconnect")
+	}
+}
+
+// TestStreamRangePassthrough verifies Range requests are forwarded and answered with 206
+func TestStreamRangePassthrough(t *testing.T) {
+	body := make([]byte, 4*1024*1024)
+	copy(body, "\x89PNG\r\n\x1a\n")
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "big.png", time.Time{}, bytes.NewReader(body))
+	}))
+	defer imgServer.Close()
+
+	server := httptest.NewServer(newStreamHandler())
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/?url="+url.QueryEscape(imgServer.URL+"/big.png"), nil)
+	req.Header.Set("Range", "bytes=100-199")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", resp.StatusCode)
+	}
+	want := fmt.Sprintf("bytes 100-199/%d", len(body))
+	if cr := resp.Header.Get("Content-Range"); cr != want {
+		t.Errorf("expected Content-Range %q, got %q", want, cr)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(got, body[100:200]) {
+		t.Error("range body mismatch")
+	}
+}
+
+// TestStreamSmallPassthroughIsCached verifies bodies under the threshold still go through the cache
+func TestStreamSmallPassthroughIsCached(t *testing.T) {
+	var backendRequests int32
+	body := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1024)...)
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backendRequests, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	defer imgServer.Close()
+
+	server := httptest.NewServer(newStreamHandler())
+	defer server.Close()
+
+	reqURL := server.URL + "/?url=" + url.QueryEscape(imgServer.URL+"/small.png")
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(reqURL)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		got, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+			t.Fatalf("request %d: unexpected response %d (%d bytes)", i, resp.StatusCode, len(got))
+		}
+	}
+
+	if n := atomic.LoadInt32(&backendRequests); n != 1 {
+		t.Errorf("expected 1 backend request, got %d", n)
+	}
+}
+
+// TestStreamLeaderDisconnect verifies requests waiting on a passthrough don't fail when the request reading it goes away
+func TestStreamLeaderDisconnect(t *testing.T) {
+	body := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 1024)...)
+	var backendRequests atomic.Int32
+	asked, answer := make(chan struct{}, 1), make(chan struct{})
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendRequests.Add(1)
+		asked <- struct{}{}
+		<-answer
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+	defer imgServer.Close()
+	handler := newStreamHandler()
+	defer handler.Close()
+	target := "/?url=" + url.QueryEscape(imgServer.URL+"/small.png")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil).WithContext(ctx))
+	}()
+	<-asked
+	follower := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		follower <- rec
+	}()
+	time.Sleep(50 * time.Millisecond) // the follower joins the leader's fetch
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(answer)
+	<-leaderDone
+
+	rec := <-follower
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Errorf("expected the waiting request served the image, got %d: %s", rec.Code, rec.Body)
+	}
+	if n := backendRequests.Load(); n != 1 {
+		t.Errorf("expected 1 backend request, got %d", n)
+	}
+}
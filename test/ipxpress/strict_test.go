@@ -0,0 +1,153 @@
+package ipxpress_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// malformedQueries maps invalid queries to the parameter each should be reported for
+var malformedQueries = []struct {
+	query string
+	param string
+}{
+	{"w=abc", "width"},
+	{"h=12px", "height"},
+	{"s=800", "resize"},
+	{"s=axb", "resize"},
+	{"q=0", "quality"},
+	{"q=101", "quality"},
+	{"quality=high", "quality"},
+	{"f=bmp", "format"},
+	{"blur=lots", "blur"},
+	{"gamma=NaN", "gamma"},
+	{"rotate=90deg", "rotate"},
+	{"flip=yes", "flip"},
+	{"extract=10_10_100", "extract"},
+	{"extract=a_b_c_d", "extract"},
+	{"extend=1_2_3_x", "extend"},
+	{"sharpen=sharp", "sharpen"},
+	{"sharpen=1_x", "sharpen"},
+	{"modulate=1.2_bright", "modulate"},
+	{"duotone=000000", "duotone"},
+	{"pixelate_region=0_0_10", "pixelate_region"},
+}
+
+// TestMalformedParamsRecorded verifies each malformed value is reported by name
+func TestMalformedParamsRecorded(t *testing.T) {
+	for _, tt := range malformedQueries {
+		t.Run(tt.query, func(t *testing.T) {
+			params := parseQuery(t, "/?url=http://x/a.png&"+tt.query)
+			if len(params.Errors) != 1 {
+				t.Fatalf("expected one error, got %v", params.Errors)
+			}
+			if params.Errors[0].Param != tt.param {
+				t.Errorf("expected error for %q, got %v", tt.param, params.Errors[0])
+			}
+		})
+	}
+}
+
+// TestValidParamsNotRecorded verifies well-formed values produce no errors
+func TestValidParamsNotRecorded(t *testing.T) {
+	queries := []string{
+		"w=800&h=600&q=90&f=webp",
+		"s=800x600&fit=cover&pos=top",
+		"blur=1.5&gamma=2.2&rotate=-90&flip=true&flop=1",
+		"extract=0_0_100_100&extend=1_2_3_4",
+		"sharpen=1.5&modulate=1.2_0.8",
+		"duotone=000000_ffffff&pixelate=8&pixelate_region=0_0_10_10",
+		"watermark=false",
+	}
+	for _, q := range queries {
+		if err := parseQuery(t, "/?url=http://x/a.png&"+q).Err(); err != nil {
+			t.Errorf("%s: unexpected error %v", q, err)
+		}
+	}
+}
+
+// TestStrictModeRejectsMalformed verifies strict mode answers 400 naming the parameter, without fetching
+func TestStrictModeRejectsMalformed(t *testing.T) {
+	var hits int32
+	imgServer := newPNGOrigin(t, &hits)
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.StrictParams = true
+	config.Capabilities = limitedCapabilities()
+	server := httptest.NewServer(ipxpress.NewHandler(config))
+	defer server.Close()
+
+	for _, tt := range malformedQueries {
+		resp, err := http.Get(server.URL + "/?" + tt.query + "&url=" + url.QueryEscape(imgServer.URL+"/a.png"))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.query, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), tt.param) {
+			t.Errorf("%s: expected message to name %q, got %q", tt.query, tt.param, body)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("expected no origin fetches, got %d", n)
+	}
+}
+
+// TestStrictModeListsEveryError verifies all invalid parameters are reported together
+func TestStrictModeListsEveryError(t *testing.T) {
+	params := parseQuery(t, "/?url=http://x/a.png&w=abc&q=500&f=bmp&extract=1_2")
+	msg := params.Err().Error()
+	for _, name := range []string{"width", "quality", "format", "extract"} {
+		if !strings.Contains(msg, name) {
+			t.Errorf("expected %q in %q", name, msg)
+		}
+	}
+}
+
+// TestDimensionLimits verifies negative and oversized dimensions are rejected in both modes
+func TestDimensionLimits(t *testing.T) {
+	var hits int32
+	imgServer := newPNGOrigin(t, &hits)
+	defer imgServer.Close()
+
+	for _, strict := range []bool{false, true} {
+		config := ipxpress.DefaultConfig()
+		config.StrictParams = strict
+		config.MaxDimension = 4000
+		config.Capabilities = limitedCapabilities()
+		server := httptest.NewServer(ipxpress.NewHandler(config))
+
+		for _, q := range []string{"w=-10", "h=-1", "w=4001", "s=100x99999"} {
+			resp, err := http.Get(server.URL + "/?" + q + "&url=" + url.QueryEscape(imgServer.URL+"/a.png"))
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("strict=%t %s: expected 400, got %d", strict, q, resp.StatusCode)
+			}
+		}
+		server.Close()
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("expected no origin fetches, got %d", n)
+	}
+
+	if err := parseQuery(t, "/?w=4000&h=4000").CheckDimensions(4000); err != nil {
+		t.Errorf("dimensions at the limit rejected: %v", err)
+	}
+	if err := parseQuery(t, "/?w=100000").CheckDimensions(0); err != nil {
+		t.Errorf("zero limit should disable the check: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// halfBlackSVG is a 16x16 SVG whose left half is black and right half white
+const halfBlackSVG = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- test fixture -->
+<svg xmlns="http://www.w3.org/2000/svg" width="16" height="16" viewBox="0 0 16 16">
+  <rect width="16" height="16" fill="#fff"/>
+  <rect width="8" height="16" fill="#000"/>
+</svg>
+`
+
+// svgConfig returns a config accepting SVG sources
+func svgConfig() *ipxpress.Config {
+	config := ipxpress.DefaultConfig()
+	config.AllowSVG = true
+	return config
+}
+
+// TestDetectSVG verifies SVG is recognized behind a prolog, comments and a doctype, and nothing else is
+func TestDetectSVG(t *testing.T) {
+	tests := []struct {
+		data string
+		svg  bool
+	}{
+		{halfBlackSVG, true},
+		{`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"/>`, true},
+		{"\xef\xbb\xbf  \n<svg\n  width=\"10\" height=\"10\"></svg>", true},
+		{`<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd"><svg width="1"/>`, true},
+		{`<?xml version="1.0"?><!DOCTYPE svg [ <!ENTITY a "b"> ]><svg width="1"/>`, true},
+		{`<?xml version="1.0"?><html><body><svg width="1"/></body></html>`, false},
+		{`<svgfoo width="1" height="1"/>`, false},
+		{`<!-- <svg width="1"/> -->`, false},
+		{strings.Repeat(" ", 2000) + `<svg width="1"/>`, false},
+	}
+	for _, tt := range tests {
+		if got := ipxpress.DetectFormat([]byte(tt.data)) == ipxpress.FormatSVG; got != tt.svg {
+			t.Errorf("DetectFormat(%.40q) svg = %v, want %v", tt.data, got, tt.svg)
+		}
+	}
+	if ipxpress.FormatSVG.ContentType() != "image/svg+xml" {
+		t.Errorf("unexpected content type %q", ipxpress.FormatSVG.ContentType())
+	}
+}
+
+// TestSVGOutputRejected verifies format=svg isn't accepted as output
+func TestSVGOutputRejected(t *testing.T) {
+	if _, err := ipxpress.LookupFormat("svg"); err == nil {
+		t.Error("expected svg to be rejected as output format")
+	}
+	if p := parseQuery(t, "/?url=https://example.com/a.svg&f=svg"); p.Err() == nil || p.Format != "" {
+		t.Errorf("expected f=svg to be rejected, got format %q", p.Format)
+	}
+}
+
+// TestSVGOutputFormat verifies SVG sources are always rasterized, to PNG by default
+func TestSVGOutputFormat(t *testing.T) {
+	p := parseQuery(t, "/?url=https://example.com/a.svg")
+	if !p.NeedsProcessing(ipxpress.FormatSVG) {
+		t.Error("SVG sources should always be processed")
+	}
+	if format, source := p.ResolveOutputFormat(ipxpress.FormatSVG); format != ipxpress.FormatPNG || source != ipxpress.FormatSourceRaster {
+		t.Errorf("expected png from raster, got %s from %s", format, source)
+	}
+	if format := parseQuery(t, "/?url=https://example.com/a.svg&f=webp").GetOutputFormat(ipxpress.FormatSVG); format != ipxpress.FormatWebP {
+		t.Errorf("expected the requested webp, got %s", format)
+	}
+}
+
+// TestSVGDisabledByDefault verifies SVG sources get 415 unless AllowSVG is set
+func TestSVGDisabledByDefault(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(halfBlackSVG))
+	}))
+	defer origin.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.StreamThreshold = 0
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, query := range []string{"", "&w=100"} {
+		resp, err := http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/a.svg") + query)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("%q: expected 415, got %d", query, resp.StatusCode)
+		}
+		if bytes.Contains(body, []byte("<svg")) {
+			t.Errorf("%q: the SVG source was served", query)
+		}
+	}
+
+	if _, err := handler.RenderSet([]byte(halfBlackSVG), []ipxpress.VariantSpec{{Name: "a", Query: "w=10"}}); !errors.Is(err, ipxpress.ErrSVGDisabled) {
+		t.Errorf("expected ErrSVGDisabled from RenderSet, got %v", err)
+	}
+}
+
+// TestSVGRangeRejected verifies a ranged response can't pass an SVG through unrasterized
+func TestSVGRangeRejected(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.ServeContent(w, r, "a.svg", time.Time{}, strings.NewReader(halfBlackSVG))
+	}))
+	defer origin.Close()
+
+	config := svgConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/a.svg"), nil)
+	req.Header.Set("Range", "bytes=0-99")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "<svg") {
+		t.Error("the SVG source was served")
+	}
+
+	// The 416 isn't cached for requests without a Range
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?url="+url.QueryEscape(origin.URL+"/a.svg"), nil))
+	if got := hits.Load(); got != 2 {
+		t.Errorf("expected the origin asked again without a Range, got %d requests", got)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 without a Range, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// edgeWidth counts the grey pixels across the middle row of a black|white image,
+// i.e. how blurry the edge is
+func edgeWidth(t *testing.T, data []byte) (width, height, grey int) {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("output is not a PNG: %v", err)
+	}
+	b := img.Bounds()
+	for x := b.Min.X; x < b.Max.X; x++ {
+		r, _, _, _ := img.At(x, b.Dy()/2).RGBA()
+		if r > 0x2000 && r < 0xe000 {
+			grey++
+		}
+	}
+	return b.Dx(), b.Dy(), grey
+}
+
+// TestSVGRasterizedAtRequestedSize verifies SVG is rendered at the requested width instead of enlarged
+func TestSVGRasterizedAtRequestedSize(t *testing.T) {
+	src := []byte(halfBlackSVG)
+
+	small := encodeGetWith(t, svgConfig(), src, "w=64")
+	if w, h, grey := edgeWidth(t, small); w != 64 || h != 64 || grey > 2 {
+		t.Errorf("w=64: expected a sharp 64x64 image, got %dx%d with %d grey pixels", w, h, grey)
+	}
+
+	large := encodeGetWith(t, svgConfig(), src, "w=512")
+	if w, h, grey := edgeWidth(t, large); w != 512 || h != 512 || grey > 2 {
+		t.Errorf("w=512: expected a sharp 512x512 image, got %dx%d with %d grey pixels", w, h, grey)
+	}
+
+	// Without a size the intrinsic one is used
+	if w, h, _ := edgeWidth(t, encodeGetWith(t, svgConfig(), src, "")); w != 16 || h != 16 {
+		t.Errorf("expected the intrinsic 16x16, got %dx%d", w, h)
+	}
+}
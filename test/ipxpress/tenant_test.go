@@ -0,0 +1,137 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// tenantServer serves brand-a, allowed to fetch from presetSource's host and with
+// a thumbnail preset, and brand-b, allowed only its own CDN. Both share a cache
+// seeded for brand-a under the keys of the plain source and of the preset.
+func tenantServer(t *testing.T, header string) *httptest.Server {
+	t.Helper()
+	cache := ipxpress.NewInMemoryCache(time.Minute, 1<<20)
+	seeded := parseQuery(t, "/?"+sourceQuery(presetSource, ""))
+	thumbnail := parseQuery(t, "/?"+sourceQuery(presetSource, "w=200&h=200&fit=cover&f=webp&q=75"))
+	thumbnail.Preset = "thumbnail"
+	for _, params := range []*ipxpress.ProcessingParams{seeded, thumbnail} {
+		cache.Set("brand-a:"+ipxpress.GenerateCacheKey(params), &ipxpress.CacheEntry{
+			ContentType: "image/webp",
+			Data:        []byte("seeded"),
+			StatusCode:  http.StatusOK,
+		})
+	}
+
+	brandA := ipxpress.DefaultConfig()
+	brandA.Capabilities = limitedCapabilities()
+	brandA.AllowedHosts = []string{"127.0.0.1"}
+	brandA.Presets = map[string]ipxpress.ProcessingParams{
+		"thumbnail": {Width: 200, Height: 200, Fit: "cover", Format: ipxpress.FormatWebP, Quality: 75},
+	}
+	brandB := ipxpress.DefaultConfig()
+	brandB.Capabilities = limitedCapabilities()
+	brandB.AllowedHosts = []string{"cdn.brand-b.test"}
+
+	router := ipxpress.NewTenantHandler(map[string]*ipxpress.Config{"brand-a": brandA, "brand-b": brandB}, ipxpress.WithCache(cache))
+	router.Header = header
+	t.Cleanup(router.Close)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestTenantAllowlists verifies two tenants with conflicting allowlists for the
+// same source host, and that neither is served the other's cache entries
+func TestTenantAllowlists(t *testing.T) {
+	server := tenantServer(t, "")
+	query := "/?" + sourceQuery(presetSource, "")
+
+	if status, body := getBody(t, server.URL+"/brand-a"+query); status != http.StatusOK || body != "seeded" {
+		t.Errorf("expected brand-a served from its cache, got %d %q", status, body)
+	}
+	if status, body := getBody(t, server.URL+"/brand-b"+query); status != http.StatusForbidden {
+		t.Errorf("expected brand-b forbidden the host, got %d %q", status, body)
+	}
+	if status, body := getBody(t, server.URL+"/brand-c"+query); status != http.StatusNotFound || !strings.Contains(body, "brand-c") {
+		t.Errorf("expected 404 for an unknown tenant, got %d %q", status, body)
+	}
+	if status, _ := getBody(t, server.URL+query); status != http.StatusNotFound {
+		t.Errorf("expected 404 without a tenant, got %d", status)
+	}
+}
+
+// TestTenantPresets verifies presets are per tenant
+func TestTenantPresets(t *testing.T) {
+	server := tenantServer(t, "")
+	query := "/?" + sourceQuery(presetSource, "preset=thumbnail")
+
+	if status, body := getBody(t, server.URL+"/brand-a"+query); status != http.StatusOK || body != "seeded" {
+		t.Errorf("expected brand-a's preset served, got %d %q", status, body)
+	}
+	if status, body := getBody(t, server.URL+"/brand-b"+query); status != http.StatusBadRequest || !strings.Contains(body, "unknown preset") {
+		t.Errorf("expected brand-b without the preset, got %d %q", status, body)
+	}
+}
+
+// TestTenantHeader verifies the header selects the tenant ahead of the path
+func TestTenantHeader(t *testing.T) {
+	server := tenantServer(t, "X-IPX-Tenant")
+	get := func(tenant, path string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path+"/?"+sourceQuery(presetSource, ""), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tenant != "" {
+			req.Header.Set("X-IPX-Tenant", tenant)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, tt := range []struct {
+		tenant, path string
+		want         int
+	}{
+		{"brand-a", "", http.StatusOK},
+		{"brand-b", "", http.StatusForbidden},
+		{"brand-c", "", http.StatusNotFound},
+		{"", "/brand-a", http.StatusOK},
+		{"", "/brand-b", http.StatusForbidden},
+	} {
+		if got := get(tt.tenant, tt.path); got != tt.want {
+			t.Errorf("tenant %q at %q: expected %d, got %d", tt.tenant, tt.path, tt.want, got)
+		}
+	}
+}
+
+// TestTenantHandlerInvalidName verifies tenant names must fit a path segment
+func TestTenantHandlerInvalidName(t *testing.T) {
+	for _, name := range []string{"", "a/b"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: expected a panic", name)
+				}
+			}()
+			ipxpress.NewTenantHandler(map[string]*ipxpress.Config{name: nil})
+		}()
+	}
+
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	router := ipxpress.NewTenantHandler(map[string]*ipxpress.Config{"b": config, "a": config})
+	defer router.Close()
+	if got := router.Tenants(); len(got) != 2 || got[0] != "a" || router.Tenant("b") == nil || router.Tenant("c") != nil {
+		t.Errorf("unexpected tenants %v", got)
+	}
+}
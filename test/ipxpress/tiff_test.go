@@ -0,0 +1,97 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress/core"
+)
+
+// TestDetectTIFF verifies both TIFF byte orders are detected
+func TestDetectTIFF(t *testing.T) {
+	for _, header := range []string{"II*\x00\x08\x00\x00\x00\x00\x00\x00\x00", "MM\x00*\x00\x00\x00\x08\x00\x00\x00\x00"} {
+		if f := ipxpress.DetectFormat([]byte(header)); f != ipxpress.FormatTIFF {
+			t.Errorf("DetectFormat(%q) = %q, want tiff", header, f)
+		}
+	}
+	if f := ipxpress.DetectFormat([]byte("II+\x00\x08\x00\x00\x00\x00\x00\x00\x00")); f != "" {
+		t.Errorf("BigTIFF-like header detected as %q", f)
+	}
+}
+
+// TestTIFFFormat verifies tif and tiff are accepted and TIFF sources aren't served as-is
+func TestTIFFFormat(t *testing.T) {
+	for _, name := range []string{"tif", "tiff", "TIFF"} {
+		if f, err := ipxpress.LookupFormat(name); err != nil || f != ipxpress.FormatTIFF {
+			t.Errorf("LookupFormat(%q) = %q, %v", name, f, err)
+		}
+	}
+	if ct := ipxpress.FormatTIFF.ContentType(); ct != "image/tiff" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+	if !ipxpress.FormatTIFF.SupportsAlpha() || ipxpress.FormatTIFF.Displayable() {
+		t.Error("TIFF keeps alpha but browsers can't display it")
+	}
+	if format := parseQuery(t, "/?url=https://example.com/a.tif").GetOutputFormat(ipxpress.FormatTIFF); format != ipxpress.FormatJPEG {
+		t.Errorf("expected TIFF sources to default to jpeg, got %s", format)
+	}
+}
+
+// TestTIFFCompressionParam verifies tiff_compression is validated and keyed
+func TestTIFFCompressionParam(t *testing.T) {
+	lzw := parseQuery(t, "/?url=https://example.com/a.png&f=tiff&tiff_compression=lzw")
+	if lzw.TIFFCompression != ipxpress.TIFFCompressionLZW || lzw.EncodeOptions().TIFFCompression != ipxpress.TIFFCompressionLZW {
+		t.Errorf("expected lzw, got %+v", lzw)
+	}
+	if !lzw.HasEncodeOptions() {
+		t.Error("tiff_compression should be an encode option")
+	}
+	deflate := parseQuery(t, "/?url=https://example.com/a.png&f=tiff&tiff_compression=deflate")
+	if ipxpress.GenerateCacheKey(lzw) == ipxpress.GenerateCacheKey(deflate) {
+		t.Error("tiff_compression should change the cache key")
+	}
+	if p := parseQuery(t, "/?url=https://example.com/a.png&f=tiff&tiff_compression=zip"); p.Err() == nil || p.TIFFCompression != "" {
+		t.Errorf("expected zip to be rejected, got %q", p.TIFFCompression)
+	}
+	if spec, ok := ipxpress.LookupParam(core.ParamTIFFCompression); !ok || spec.Default != "none" {
+		t.Errorf("expected tiff_compression defaulting to none, got %+v", spec)
+	}
+}
+
+// TestTIFFRoundTrip converts PNG to TIFF with each compression and decodes the result
+func TestTIFFRoundTrip(t *testing.T) {
+	src := createSolidPNG(60, 40, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+
+	sizes := map[string]int{}
+	for _, compression := range []string{"none", "lzw", "deflate"} {
+		out := encodeGet(t, src, "f=tif&tiff_compression="+compression)
+		if f := ipxpress.DetectFormat(out); f != ipxpress.FormatTIFF {
+			t.Fatalf("%s: expected TIFF output, got %q", compression, f)
+		}
+		sizes[compression] = len(out)
+
+		proc := ipxpress.New().FromBytes(out)
+		if err := proc.Err(); err != nil {
+			t.Fatalf("%s: failed to decode TIFF: %v", compression, err)
+		}
+		if w, h := proc.ImageRef().Width(), proc.ImageRef().Height(); w != 60 || h != 40 {
+			t.Errorf("%s: expected 60x40, got %dx%d", compression, w, h)
+		}
+		proc.Close()
+
+		// And back through the handler, as a TIFF source
+		back, err := png.Decode(bytes.NewReader(encodeGet(t, out, "f=png&w=30")))
+		if err != nil {
+			t.Fatalf("%s: failed to convert TIFF back to PNG: %v", compression, err)
+		}
+		if b := back.Bounds(); b.Dx() != 30 || b.Dy() != 20 {
+			t.Errorf("%s: expected 30x20, got %dx%d", compression, b.Dx(), b.Dy())
+		}
+	}
+	if sizes["lzw"] >= sizes["none"] || sizes["deflate"] >= sizes["none"] {
+		t.Errorf("compressed TIFFs should be smaller than uncompressed: %v", sizes)
+	}
+}
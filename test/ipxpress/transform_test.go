@@ -0,0 +1,246 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+var transformSpecs = []ipxpress.VariantSpec{
+	{Name: "avatar", Query: "w=64&h=64&fit=cover&f=png"},
+	{Name: "thumb", Query: "w=160&f=jpeg&q=70"},
+	{Name: "full", Query: "w=400&f=webp"},
+}
+
+// transformBody builds a multipart transform request body
+func transformBody(t *testing.T, img []byte, specs any) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if img != nil {
+		part, _ := mw.CreateFormFile("image", "photo.png")
+		part.Write(img)
+	}
+	if specs != nil {
+		part, _ := mw.CreateFormField("specs")
+		json.NewEncoder(part).Encode(specs)
+	}
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+// postTransform posts a transform request and returns the response
+func postTransform(t *testing.T, handler http.Handler, img []byte, specs any, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, contentType := transformBody(t, img, specs)
+	req := httptest.NewRequest(http.MethodPost, "/ipx/transform", body)
+	req.Header.Set("Content-Type", contentType)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// TestTransformMultipart verifies each named part has the requested size and type
+func TestTransformMultipart(t *testing.T) {
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+
+	rec := postTransform(t, handler.Transform(), createTestImage(800, 600), transformSpecs, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	mediaType, mediaParams, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %q", rec.Header().Get("Content-Type"))
+	}
+	reader := multipart.NewReader(rec.Body, mediaParams["boundary"])
+
+	want := []struct {
+		name, contentType string
+		width, height     int
+	}{
+		{"avatar", "image/png", 64, 64},
+		{"thumb", "image/jpeg", 160, 120},
+		{"full", "image/webp", 400, 300},
+	}
+	for _, w := range want {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("expected part %s: %v", w.name, err)
+		}
+		if part.FormName() != w.name {
+			t.Errorf("expected part %s, got %q", w.name, part.FormName())
+		}
+		if ct := part.Header.Get("Content-Type"); ct != w.contentType {
+			t.Errorf("%s: expected %s, got %s", w.name, w.contentType, ct)
+		}
+		data, _ := io.ReadAll(part)
+		if w.contentType != "image/webp" {
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: decode: %v", w.name, err)
+			}
+			if cfg.Width != w.width || cfg.Height != w.height {
+				t.Errorf("%s: expected %dx%d, got %dx%d", w.name, w.width, w.height, cfg.Width, cfg.Height)
+			}
+		}
+		if got := part.Header.Get("X-IPX-Width") + "x" + part.Header.Get("X-IPX-Height"); got != fmt.Sprintf("%dx%d", w.width, w.height) {
+			t.Errorf("%s: expected %dx%d in headers, got %s", w.name, w.width, w.height, got)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected exactly three parts, got error %v", err)
+	}
+}
+
+// TestTransformJSON verifies the JSON envelope carries every variant
+func TestTransformJSON(t *testing.T) {
+	handler := ipxpress.NewHandler(nil)
+	defer handler.Close()
+
+	rec := postTransform(t, handler.Transform(), createTestImage(800, 600), transformSpecs, "application/json")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var envelope struct {
+		Variants []ipxpress.Variant `json:"variants"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&envelope); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(envelope.Variants) != 3 {
+		t.Fatalf("expected 3 variants, got %d", len(envelope.Variants))
+	}
+	for i, v := range envelope.Variants {
+		if v.Name != transformSpecs[i].Name || len(v.Data) == 0 {
+			t.Errorf("unexpected variant %d: %s with %d bytes", i, v.Name, len(v.Data))
+		}
+	}
+	if avatar := envelope.Variants[0]; avatar.Width != 64 || avatar.Height != 64 || avatar.ContentType != "image/png" {
+		t.Errorf("unexpected avatar %dx%d %s", avatar.Width, avatar.Height, avatar.ContentType)
+	}
+}
+
+// TestTransformRejections verifies requests rejected before any decoding
+func TestTransformRejections(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.MaxUploadSize = 4096
+	config.StrictParams = true
+	var charged int
+	config.TransformQuota = func(r *http.Request, variants int) error {
+		if r.Header.Get("X-Tenant") == "exhausted" {
+			return errors.New("quota exhausted")
+		}
+		charged += variants
+		return nil
+	}
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	transform := handler.Transform()
+
+	small := createTestImage(10, 10)
+	tests := []struct {
+		name   string
+		img    []byte
+		specs  any
+		status int
+	}{
+		{"missing image", nil, transformSpecs, http.StatusBadRequest},
+		{"missing specs", small, nil, http.StatusBadRequest},
+		{"malformed specs", small, map[string]string{"name": "avatar"}, http.StatusBadRequest},
+		{"too many specs", small, make([]ipxpress.VariantSpec, 17), http.StatusBadRequest},
+		{"duplicate names", small, []ipxpress.VariantSpec{{Name: "a", Query: "w=1"}, {Name: "a", Query: "w=2"}}, http.StatusBadRequest},
+		{"url in spec", small, []ipxpress.VariantSpec{{Name: "a", Query: "url=http://x/a.png"}}, http.StatusBadRequest},
+		{"invalid param", small, []ipxpress.VariantSpec{{Name: "a", Query: "w=abc"}}, http.StatusBadRequest},
+		{"unsupported format", small, []ipxpress.VariantSpec{{Name: "a", Query: "f=avif"}}, http.StatusUnsupportedMediaType},
+		{"too large", bytes.Repeat([]byte{0}, 8192), transformSpecs, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		rec := postTransform(t, transform, tt.img, tt.specs, "")
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.status, rec.Code, rec.Body)
+		}
+	}
+
+	body, contentType := transformBody(t, small, transformSpecs)
+	req := httptest.NewRequest(http.MethodPost, "/ipx/transform", body)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Tenant", "exhausted")
+	rec := httptest.NewRecorder()
+	transform.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over quota, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	transform.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ipx/transform", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for GET, got %d", rec.Code)
+	}
+}
+
+// TestTransformTakesProcessingSlot verifies a transform waits for a processing slot and gives up with its request
+func TestTransformTakesProcessingSlot(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.ProcessingLimit = 1
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	entered, unblock := make(chan struct{}, 1), make(chan struct{})
+	handler.UseProcessor(func(p *ipxpress.Processor, params *ipxpress.ProcessingParams) *ipxpress.Processor {
+		if params.Width == 32 {
+			entered <- struct{}{}
+			<-unblock
+		}
+		return p
+	})
+	src := createTestImage(200, 100)
+	specs := []ipxpress.VariantSpec{{Name: "small", Query: "w=32&f=png"}}
+
+	done := make(chan int)
+	go func() { done <- postTransform(t, handler.Transform(), src, specs, "").Code }()
+	<-entered
+	if stats := handler.ProcessingStats(); stats.Active != 1 || stats.ActiveExpensive != 1 {
+		t.Errorf("expected the transform to hold the only slot as expensive, got %+v", stats)
+	}
+
+	body, contentType := transformBody(t, src, []ipxpress.VariantSpec{{Name: "other", Query: "w=48&f=png"}})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/ipx/transform", body).WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	handler.Transform().ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once the request gave up waiting, got %d: %s", rec.Code, rec.Body)
+	}
+	if stats := handler.ProcessingStats(); stats.WaitingExpensive != 0 {
+		t.Errorf("expected the abandoned waiter to leave the queue, got %+v", stats)
+	}
+
+	close(unblock)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected the first transform to succeed, got %d", code)
+	}
+	if stats := handler.ProcessingStats(); stats.Active != 0 {
+		t.Errorf("expected the slot released, got %+v", stats)
+	}
+}
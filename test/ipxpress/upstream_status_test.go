@@ -0,0 +1,122 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// statusOrigin answers /<status>.png with that status, and /slow.png late
+func statusOrigin(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/slow.png" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		status, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".png"))
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "120")
+		}
+		http.Error(w, http.StatusText(status), status)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// upstreamHandler returns a handler fetching once, with a short timeout
+func upstreamHandler(t *testing.T, errorTTL time.Duration) *ipxpress.Handler {
+	t.Helper()
+	fetcherConfig := ipxpress.DefaultFetcherConfig()
+	fetcherConfig.MaxAttempts = 1
+	fetcherConfig.Timeout = 50 * time.Millisecond
+	return healthHandler(t, func(c *ipxpress.Config) {
+		c.Fetcher = fetcherConfig
+		c.ErrorCacheTTL = errorTTL
+	})
+}
+
+// TestUpstreamStatusMapping verifies each origin status is answered with the right proxy status, and only lasting ones are cached
+func TestUpstreamStatusMapping(t *testing.T) {
+	var hits atomic.Int32
+	origin := statusOrigin(t, &hits)
+	handler := upstreamHandler(t, 0)
+
+	for _, tt := range []struct {
+		path       string
+		status     int
+		retryAfter string
+		cached     bool
+	}{
+		{"/404.png", http.StatusNotFound, "", true},
+		{"/403.png", http.StatusForbidden, "", true},
+		{"/410.png", http.StatusGone, "", true},
+		{"/429.png", http.StatusTooManyRequests, "120", false},
+		{"/500.png", http.StatusBadGateway, "", false},
+		{"/503.png", http.StatusBadGateway, "", false},
+		{"/slow.png", http.StatusGatewayTimeout, "", false},
+	} {
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+sourceQuery(origin.URL+tt.path, "w=10"), nil))
+			if rec.Code != tt.status {
+				t.Errorf("%s: expected %d, got %d: %s", tt.path, tt.status, rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("%s: expected Retry-After %q, got %q", tt.path, tt.retryAfter, got)
+			}
+			if got := rec.Header().Get("Cache-Control"); !tt.cached && got != "no-store" {
+				t.Errorf("%s: expected Cache-Control: no-store, got %q", tt.path, got)
+			}
+		}
+		want := int32(2)
+		if tt.cached {
+			want = 1
+		}
+		if got := hits.Swap(0); got != want {
+			t.Errorf("%s: expected %d origin requests for two client requests, got %d", tt.path, want, got)
+		}
+	}
+}
+
+// TestErrorCacheTTL verifies failures that may recover are cached only for ErrorCacheTTL
+func TestErrorCacheTTL(t *testing.T) {
+	var hits atomic.Int32
+	origin := statusOrigin(t, &hits)
+	handler := upstreamHandler(t, time.Second)
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+sourceQuery(origin.URL+path, "w=10"), nil))
+		return rec.Code
+	}
+
+	paths := []string{"/503.png", "/429.png", "/slow.png"}
+	for _, path := range paths {
+		first, second := get(path), get(path)
+		if first != second {
+			t.Errorf("%s: expected the same failure twice, got %d then %d", path, first, second)
+		}
+	}
+	if got := hits.Swap(0); got != int32(len(paths)) {
+		t.Errorf("expected each failure served from the cache the second time, got %d origin requests", got)
+	}
+
+	// The cache expires entries with a resolution of a second
+	time.Sleep(2 * time.Second)
+	for _, path := range paths {
+		get(path)
+	}
+	if got := hits.Load(); got != int32(len(paths)) {
+		t.Errorf("expected the origin asked again after ErrorCacheTTL, got %d requests", got)
+	}
+}
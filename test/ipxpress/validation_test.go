@@ -0,0 +1,193 @@
+package ipxpress_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestLookupFormat verifies known formats parse and unknown ones are reported
+func TestLookupFormat(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    ipxpress.Format
+		wantErr bool
+	}{
+		{"", "", false},
+		{"jpg", ipxpress.FormatJPEG, false},
+		{" WEBP ", ipxpress.FormatWebP, false},
+		{"avif", ipxpress.FormatAVIF, false},
+		{"bmp", "", true},
+		{"jpgg", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := ipxpress.LookupFormat(tt.input)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("LookupFormat(%q) = %q, %v; want %q, err=%t", tt.input, got, err, tt.want, tt.wantErr)
+		}
+		if ipxpress.ParseFormat(tt.input) != tt.want {
+			t.Errorf("ParseFormat(%q) disagrees with LookupFormat", tt.input)
+		}
+	}
+}
+
+// TestUnknownFormatRecorded verifies unknown format values end up in params.Errors
+func TestUnknownFormatRecorded(t *testing.T) {
+	params := parseQuery(t, "/?url=http://x/a.png&f=bmp")
+	if params.Format != "" {
+		t.Errorf("expected empty format, got %q", params.Format)
+	}
+	if len(params.Errors) != 1 || params.Errors[0].Param != "format" || params.Errors[0].Value != "bmp" {
+		t.Fatalf("expected one format error, got %v", params.Errors)
+	}
+	if err := params.Err(); err == nil || !strings.Contains(err.Error(), "bmp") {
+		t.Errorf("expected Err() to mention the value, got %v", err)
+	}
+
+	if err := parseQuery(t, "/?url=http://x/a.png&f=webp").Err(); err != nil {
+		t.Errorf("expected no error for a valid format, got %v", err)
+	}
+}
+
+// TestResolveOutputFormat verifies the format source is reported for each rule
+func TestResolveOutputFormat(t *testing.T) {
+	tests := []struct {
+		query      string
+		original   ipxpress.Format
+		wantFormat ipxpress.Format
+		wantSource string
+	}{
+		{"/?f=webp", ipxpress.FormatPNG, ipxpress.FormatWebP, ipxpress.FormatSourceRequested},
+		{"/?w=10", ipxpress.FormatPNG, ipxpress.FormatPNG, ipxpress.FormatSourceOriginal},
+		{"/?w=10", "", ipxpress.FormatJPEG, ipxpress.FormatSourceDefault},
+	}
+
+	for _, tt := range tests {
+		format, source := parseQuery(t, tt.query).ResolveOutputFormat(tt.original)
+		if format != tt.wantFormat || source != tt.wantSource {
+			t.Errorf("%s with original %q: got %q/%q, want %q/%q", tt.query, tt.original, format, source, tt.wantFormat, tt.wantSource)
+		}
+	}
+}
+
+// newPNGOrigin serves a small PNG and counts requests
+func newPNGOrigin(t *testing.T, hits *int32) *httptest.Server {
+	t.Helper()
+	body := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(body)
+	}))
+}
+
+// TestStrictUnknownFormat verifies strict mode rejects unknown formats before fetching
+func TestStrictUnknownFormat(t *testing.T) {
+	var hits int32
+	imgServer := newPNGOrigin(t, &hits)
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.StrictParams = true
+	config.Capabilities = limitedCapabilities()
+	server := httptest.NewServer(ipxpress.NewHandler(config))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?f=bmp&url=" + url.QueryEscape(imgServer.URL+"/a.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Errorf("expected no origin fetch, got %d", n)
+	}
+}
+
+// TestLenientUnknownFormat verifies lenient mode ignores unknown formats but reports them
+func TestLenientUnknownFormat(t *testing.T) {
+	var hits int32
+	imgServer := newPNGOrigin(t, &hits)
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.DebugHeaders = true
+	config.Capabilities = limitedCapabilities()
+	server := httptest.NewServer(ipxpress.NewHandler(config))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?f=bmp&url=" + url.QueryEscape(imgServer.URL+"/a.png"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if warn := resp.Header.Get("X-IPX-Warning"); !strings.Contains(warn, "format") {
+		t.Errorf("expected X-IPX-Warning about format, got %q", warn)
+	}
+	echo, _ := url.ParseQuery(resp.Header.Get("X-IPX-Params"))
+	if echo.Get("f") != "png" || echo.Get("f_source") != ipxpress.FormatSourceOriginal {
+		t.Errorf("expected effective format png from original, got %q", resp.Header.Get("X-IPX-Params"))
+	}
+}
+
+// TestEffectiveParamsEcho verifies the echo reports a requested conversion
+func TestEffectiveParamsEcho(t *testing.T) {
+	imgServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(createTestImage(50, 50))
+	}))
+	defer imgServer.Close()
+
+	config := ipxpress.DefaultConfig()
+	config.DebugHeaders = true
+	server := httptest.NewServer(ipxpress.NewHandler(config))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/?f=png&w=20&url=" + url.QueryEscape(imgServer.URL+"/a.jpg"))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	echo, _ := url.ParseQuery(resp.Header.Get("X-IPX-Params"))
+	if echo.Get("f") != "png" || echo.Get("f_source") != ipxpress.FormatSourceRequested || echo.Get("q") != "85" || echo.Get("w") != "20" {
+		t.Errorf("unexpected effective params %q", resp.Header.Get("X-IPX-Params"))
+	}
+	if resp.Header.Get("X-IPX-Warning") != "" {
+		t.Error("expected no warning for valid params")
+	}
+}
+
+// TestToBytesQualityRange verifies out-of-range quality is an error instead of a silent default
+func TestToBytesQualityRange(t *testing.T) {
+	src := createTestImage(20, 20)
+	for _, q := range []int{-1, 0, 101} {
+		proc := ipxpress.New().FromBytes(src)
+		_, err := proc.ToBytes(ipxpress.FormatJPEG, q)
+		proc.Close()
+		if err == nil {
+			t.Errorf("expected error for quality %d", q)
+		}
+	}
+	for _, q := range []int{1, 100} {
+		proc := ipxpress.New().FromBytes(src)
+		_, err := proc.ToBytes(ipxpress.FormatJPEG, q)
+		proc.Close()
+		if err != nil {
+			t.Errorf("quality %d: %v", q, err)
+		}
+	}
+}
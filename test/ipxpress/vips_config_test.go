@@ -0,0 +1,79 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/davidbyttow/govips/v2/vips"
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestVipsConfigAfterStart verifies a VipsConfig arriving after libvips started
+// with other settings is reported instead of silently ignored
+func TestVipsConfigAfterStart(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	first := ipxpress.NewHandler(config)
+	defer first.Close()
+	if !ipxpress.VipsStarted() {
+		t.Fatal("expected NewHandler to start libvips")
+	}
+	running := ipxpress.VipsSettings()
+
+	var logs bytes.Buffer
+	tuned := ipxpress.DefaultConfig()
+	tuned.Capabilities = limitedCapabilities()
+	tuned.VipsConfig = ipxpress.VipsSettings()
+	tuned.VipsConfig.MaxCacheMem = running.MaxCacheMem + 512
+	second := ipxpress.NewHandler(tuned, ipxpress.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	defer second.Close()
+	if !strings.Contains(logs.String(), "VipsConfig not applied") || !strings.Contains(logs.String(), "MaxCacheMem") {
+		t.Errorf("expected the ignored setting logged, got %q", logs.String())
+	}
+	if got := ipxpress.VipsSettings(); got.MaxCacheMem != running.MaxCacheMem {
+		t.Errorf("expected the running settings kept, got %+v", got)
+	}
+
+	logs.Reset()
+	same := ipxpress.DefaultConfig()
+	same.Capabilities = limitedCapabilities()
+	same.VipsConfig = ipxpress.VipsSettings()
+	third := ipxpress.NewHandler(same, ipxpress.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	defer third.Close()
+	if logs.Len() != 0 {
+		t.Errorf("expected nothing logged for the running settings, got %q", logs.String())
+	}
+}
+
+// TestReconfigureVips verifies the log level changes at runtime and the rest is reported
+func TestReconfigureVips(t *testing.T) {
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	ipxpress.NewHandler(config).Close()
+	running := ipxpress.VipsSettings()
+	defer ipxpress.ReconfigureVips(running)
+
+	quieter := *running
+	quieter.LogLevel = vips.LogLevelError
+	if err := ipxpress.ReconfigureVips(&quieter); err != nil {
+		t.Fatalf("expected the log level to change, got %v", err)
+	}
+	if got := ipxpress.VipsSettings(); got.LogLevel != vips.LogLevelError {
+		t.Errorf("expected log level %v in effect, got %v", vips.LogLevelError, got.LogLevel)
+	}
+
+	bigger := quieter
+	bigger.LogLevel = vips.LogLevelInfo
+	bigger.MaxCacheSize = running.MaxCacheSize + 100
+	bigger.Concurrency = running.Concurrency + 2
+	err := ipxpress.ReconfigureVips(&bigger)
+	if err == nil || !strings.Contains(err.Error(), "MaxCacheSize") || !strings.Contains(err.Error(), "Concurrency") {
+		t.Errorf("expected the fixed settings named, got %v", err)
+	}
+	got := ipxpress.VipsSettings()
+	if got.LogLevel != vips.LogLevelInfo || got.MaxCacheSize != running.MaxCacheSize {
+		t.Errorf("expected only the log level applied, got %+v", got)
+	}
+}
@@ -0,0 +1,126 @@
+package ipxpress_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// TestWarm verifies warmed variants are served from the cache without origin traffic
+func TestWarm(t *testing.T) {
+	var hits atomic.Int32
+	origin := sizedOrigin(t, &hits)
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	config.DebugHeaders = true
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	handler.RegisterPreset("original", &ipxpress.ProcessingParams{})
+
+	hero := origin.URL + "/hero.png?size=2048"
+	logo := origin.URL + "/logo.png?size=512"
+	errs := handler.Warm(context.Background(), []ipxpress.WarmSpec{
+		{URL: hero},
+		{URL: logo, Preset: "original"},
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("spec %d: %v", i, err)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("expected each source fetched once while warming, got %d", n)
+	}
+
+	hits.Store(0)
+	for _, target := range []string{
+		"/?url=" + url.QueryEscape(hero),
+		"/?preset=original&url=" + url.QueryEscape(logo),
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("X-IPX-Cache") != "HIT" {
+			t.Errorf("%s: expected a cache hit, got %d %q", target, rec.Code, rec.Header().Get("X-IPX-Cache"))
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("expected no origin traffic after warming, got %d requests", n)
+	}
+}
+
+// TestWarmErrors verifies failures are reported per spec
+func TestWarmErrors(t *testing.T) {
+	fetcher := &stubFetcher{data: []byte("\x89PNG\r\n\x1a\nstub")}
+	config := ipxpress.DefaultConfig()
+	config.Capabilities = limitedCapabilities()
+	handler := ipxpress.NewHandler(config, ipxpress.WithFetcher(fetcher))
+	defer handler.Close()
+
+	errs := handler.Warm(context.Background(), []ipxpress.WarmSpec{
+		{URL: "https://images.example.com/ok.png"},
+		{URL: "https://images.example.com/missing.png", Params: &ipxpress.ProcessingParams{Width: 100}},
+		{URL: "https://images.example.com/ok.png", Preset: "unknown"},
+		{},
+	})
+	if errs[0] != nil {
+		t.Errorf("expected the first spec warmed, got %v", errs[0])
+	}
+	var perr *ipxpress.ProcessError
+	if !errors.As(errs[1], &perr) || perr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a 404 for the missing source, got %v", errs[1])
+	}
+	if !errors.As(errs[2], &perr) || perr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a 400 for the unknown preset, got %v", errs[2])
+	}
+	if errs[3] == nil {
+		t.Error("expected an error for a spec without url")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i, err := range handler.Warm(ctx, []ipxpress.WarmSpec{{URL: "https://images.example.com/a.png"}}) {
+		if err == nil {
+			t.Errorf("spec %d: expected an error after cancellation", i)
+		}
+	}
+}
+
+// TestLoadWarmSpecs verifies warm files are parsed and invalid params rejected
+func TestLoadWarmSpecs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "warm.json")
+	os.WriteFile(path, []byte(`[
+		{"url": "https://cdn.example.com/hero.jpg", "params": "w=1200&f=webp"},
+		{"url": "https://cdn.example.com/logo.png", "preset": "thumbnail", "accept": "image/avif"}
+	]`), 0o644)
+
+	specs, err := ipxpress.LoadWarmSpecs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 2 || specs[0].Params == nil || specs[0].Params.Width != 1200 || specs[0].Params.Format != ipxpress.FormatWebP {
+		t.Fatalf("unexpected specs %+v", specs)
+	}
+	if specs[1].Preset != "thumbnail" || specs[1].Accept != "image/avif" || specs[1].Params != nil {
+		t.Errorf("unexpected preset spec %+v", specs[1])
+	}
+
+	for _, bad := range []string{
+		`[{"url": "https://cdn.example.com/a.jpg", "params": "bogus=1"}]`,
+		`[{"params": "w=100"}]`,
+		`{"url": "https://cdn.example.com/a.jpg"}`,
+	} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := ipxpress.LoadWarmSpecs(path); err == nil {
+			t.Errorf("expected %s rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// applyWatermark runs a watermark processor over a white 200x200 image and decodes the PNG result
+func applyWatermark(t *testing.T, opts ipxpress.WatermarkOptions, params *ipxpress.ProcessingParams) color.Color {
+	t.Helper()
+
+	mark := createSolidPNG(10, 10, color.RGBA{R: 255, A: 255})
+	fn, err := ipxpress.NewWatermarkProcessor(mark, opts)
+	if err != nil {
+		t.Fatalf("new watermark processor: %v", err)
+	}
+
+	proc := fn(ipxpress.New().FromBytes(createSolidPNG(200, 200, color.RGBA{R: 255, G: 255, B: 255, A: 255})), params)
+	out, err := proc.ToBytes(ipxpress.FormatPNG, 85)
+	proc.Close()
+	if err != nil {
+		t.Fatalf("watermark: %v", err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return img.At(195, 195)
+}
+
+// TestWatermarkSoutheastCorner verifies the watermark lands in the bottom-right corner
+func TestWatermarkSoutheastCorner(t *testing.T) {
+	opts := ipxpress.DefaultWatermarkOptions()
+	opts.Margin = 0
+	opts.Scale = 0.1
+
+	r, g, b, _ := applyWatermark(t, opts, &ipxpress.ProcessingParams{}).RGBA()
+	if r>>8 < 200 || g>>8 > 60 || b>>8 > 60 {
+		t.Errorf("expected red corner, got rgb(%d,%d,%d)", r>>8, g>>8, b>>8)
+	}
+}
+
+// TestWatermarkOpacity verifies opacity blends the watermark with the background
+func TestWatermarkOpacity(t *testing.T) {
+	opts := ipxpress.DefaultWatermarkOptions()
+	opts.Margin = 0
+	opts.Scale = 0.1
+	opts.Opacity = 0.5
+
+	r, g, _, _ := applyWatermark(t, opts, &ipxpress.ProcessingParams{}).RGBA()
+	if r>>8 < 200 || g>>8 < 100 || g>>8 > 160 {
+		t.Errorf("expected pink corner, got r=%d g=%d", r>>8, g>>8)
+	}
+}
+
+// TestWatermarkDisabledPerRequest verifies watermark=false is honoured when allowed
+func TestWatermarkDisabledPerRequest(t *testing.T) {
+	opts := ipxpress.DefaultWatermarkOptions()
+	opts.Margin = 0
+	opts.Scale = 0.1
+	opts.AllowDisable = true
+
+	_, g, _, _ := applyWatermark(t, opts, &ipxpress.ProcessingParams{DisableWatermark: true}).RGBA()
+	if g>>8 != 255 {
+		t.Errorf("expected untouched white corner, got g=%d", g>>8)
+	}
+
+	// Without AllowDisable the request flag is ignored
+	opts.AllowDisable = false
+	_, g, _, _ = applyWatermark(t, opts, &ipxpress.ProcessingParams{DisableWatermark: true}).RGBA()
+	if g>>8 > 60 {
+		t.Errorf("expected watermark to be applied, got g=%d", g>>8)
+	}
+}
+
+// TestWatermarkSkipsSmallOutputs verifies outputs below MinSize are left untouched
+func TestWatermarkSkipsSmallOutputs(t *testing.T) {
+	opts := ipxpress.DefaultWatermarkOptions()
+	opts.Margin = 0
+	opts.MinSize = 500
+
+	_, g, _, _ := applyWatermark(t, opts, &ipxpress.ProcessingParams{}).RGBA()
+	if g>>8 != 255 {
+		t.Errorf("expected untouched white corner, got g=%d", g>>8)
+	}
+}
+
+// TestWatermarkParam verifies watermark=false parsing
+func TestWatermarkParam(t *testing.T) {
+	for query, want := range map[string]bool{"": false, "&watermark=false": true, "&watermark=0": true, "&watermark=true": false} {
+		params := parseQuery(t, "?url=https://example.com/a.jpg"+query)
+		if params.DisableWatermark != want {
+			t.Errorf("%q: DisableWatermark=%v, want %v", query, params.DisableWatermark, want)
+		}
+	}
+}
+
+// TestUseWatermarkPassthrough verifies a plain URL is re-encoded with the watermark rather than passed through or streamed
+func TestUseWatermarkPassthrough(t *testing.T) {
+	src := createSolidPNG(200, 200, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer origin.Close()
+	config := ipxpress.DefaultConfig()
+	config.StreamThreshold = 1 // any source would be streamed
+	handler := ipxpress.NewHandler(config)
+	defer handler.Close()
+	opts := ipxpress.DefaultWatermarkOptions()
+	opts.Margin, opts.Scale, opts.AllowDisable = 0, 0.1, true
+	if err := handler.UseWatermark(createSolidPNG(10, 10, color.RGBA{R: 255, A: 255}), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	corner := func(query string) (color.Color, []byte) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?"+sourceQuery(origin.URL+"/a.png", query), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%q: expected 200, got %d: %s", query, rec.Code, rec.Body)
+		}
+		img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%q: decode: %v", query, err)
+		}
+		return img.At(195, 195), rec.Body.Bytes()
+	}
+	if c, _ := corner(""); color.RGBAModel.Convert(c).(color.RGBA).G > 60 {
+		t.Errorf("expected the watermark on a plain URL, got %v", c)
+	}
+	if _, body := corner("watermark=false"); !bytes.Equal(body, src) {
+		t.Error("expected the original passed through with watermark=false")
+	}
+}
@@ -0,0 +1,85 @@
+package ipxpress_test
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+)
+
+// redSpan returns the smallest and largest red value along the middle row; on
+// createGradientPNG red grows with x, so the span is the visible part of the source
+func redSpan(t *testing.T, data []byte) (lo, hi uint32) {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := img.Bounds()
+	lo = 0xFFFF
+	for x := b.Min.X; x < b.Max.X; x++ {
+		r, _, _, _ := img.At(x, b.Dy()/2).RGBA()
+		lo, hi = min(lo, r), max(hi, r)
+	}
+	return lo, hi
+}
+
+// TestZoom verifies the visible region shrinks as zoom grows while the size stays
+func TestZoom(t *testing.T) {
+	src := createGradientPNG(120, 80)
+
+	prev := uint32(0xFFFF + 1)
+	for _, query := range []string{"w=60", "w=60&zoom=1.5", "w=60&zoom=2", "w=60&zoom=3"} {
+		out := encodeGet(t, src, "f=png&"+query)
+		img, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(60, 40) {
+			t.Errorf("%s: expected 60x40, got %v", query, size)
+		}
+		lo, hi := redSpan(t, out)
+		if hi-lo >= prev {
+			t.Errorf("%s: expected a narrower region than before, got red %d-%d", query, lo, hi)
+		}
+		prev = hi - lo
+	}
+
+	// position anchors the crop: left keeps the darkest red, right the brightest
+	centerLo, centerHi := redSpan(t, encodeGet(t, src, "f=png&w=60&zoom=2"))
+	leftLo, _ := redSpan(t, encodeGet(t, src, "f=png&w=60&zoom=2&position=left"))
+	_, rightHi := redSpan(t, encodeGet(t, src, "f=png&w=60&zoom=2&position=right"))
+	if leftLo >= centerLo || rightHi <= centerHi {
+		t.Errorf("expected left and right to move the region, got left from %d and right to %d around %d-%d", leftLo, rightHi, centerLo, centerHi)
+	}
+
+	// Config.MaxZoom caps the factor
+	config := ipxpress.DefaultConfig()
+	config.MaxZoom = 2
+	if !bytes.Equal(encodeGetWith(t, config, src, "f=png&w=60&zoom=8"), encodeGetWith(t, config, src, "f=png&w=60&zoom=2")) {
+		t.Error("expected zoom=8 capped to MaxZoom 2")
+	}
+}
+
+// TestZoomParam verifies zoom parses, is bounded and gets its own cache key
+func TestZoomParam(t *testing.T) {
+	parse := func(query string) *ipxpress.ProcessingParams {
+		return ipxpress.ParseProcessingParams(httptest.NewRequest(http.MethodGet, "/?url=http://a.test/x.jpg&"+query, nil))
+	}
+	if p := parse("zoom=1.5"); p.Zoom != 1.5 || !p.HasTransformations() || p.KeepsAnimation() {
+		t.Errorf("expected zoom 1.5 as a single-frame transformation, got %v", p.Zoom)
+	}
+	if p := parse("zoom=0.5"); p.Zoom != 1 {
+		t.Errorf("expected zoom below 1 raised to 1, got %v", p.Zoom)
+	}
+	if p := parse("zoom=big"); len(p.Errors) != 1 {
+		t.Errorf("expected an error, got %v", p.Errors)
+	}
+	if ipxpress.GenerateCacheKey(parse("w=60&zoom=1.5")) == ipxpress.GenerateCacheKey(parse("w=60&zoom=2")) {
+		t.Error("expected each zoom to get its own cache key")
+	}
+}
@@ -0,0 +1,213 @@
+package replay_test
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vladislavsavi/ipxpress/pkg/ipxpress"
+	"github.com/vladislavsavi/ipxpress/pkg/replay"
+)
+
+// TestParseLine verifies plain URIs, absolute URLs and access log lines are accepted
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{"/?url=http://x/a.jpg&w=100", "/?url=http://x/a.jpg&w=100", true},
+		{"?w=10&url=http://x/a.jpg", "?w=10&url=http://x/a.jpg", true},
+		{"https://img.example.com/ipx/?url=http://x/a.jpg", "/ipx/?url=http://x/a.jpg", true},
+		{`127.0.0.1 - - [10/Oct/2024:13:55:36 +0000] "GET /ipx/?w=200&url=http%3A%2F%2Fx%2Fa.jpg HTTP/1.1" 200 2326 "-" "curl/8.0"`, "/ipx/?w=200&url=http%3A%2F%2Fx%2Fa.jpg", true},
+		{`127.0.0.1 - - [10/Oct/2024:13:55:36 +0000] "POST /ipx/ HTTP/1.1" 405 0`, "", false},
+		{"# comment", "", false},
+		{"", "", false},
+		{"not a request", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := replay.ParseLine(tt.line)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseLine(%q) = %q, %v; want %q, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	requests, err := replay.ReadRequests(strings.NewReader("/?a=1\n\n# skip\n/?b=2\n"))
+	if err != nil || len(requests) != 2 {
+		t.Errorf("ReadRequests = %v, %v", requests, err)
+	}
+}
+
+// TestCompare verifies the mean channel difference
+func TestCompare(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	b := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range a.Pix {
+		a.Pix[i] = 100
+		b.Pix[i] = 110
+	}
+
+	if got := replay.Compare(a, a); got != 0 {
+		t.Errorf("identical images: got %v", got)
+	}
+	if got := replay.Compare(a, b); got != 10 {
+		t.Errorf("expected 10, got %v", got)
+	}
+	if got := replay.Compare(a, image.NewRGBA(image.Rect(0, 0, 2, 2))); got != -1 {
+		t.Errorf("different sizes: got %v", got)
+	}
+}
+
+// TestHash verifies the perceptual hash survives scaling but not inversion
+func TestHash(t *testing.T) {
+	gradient := func(width, height int, invert bool) image.Image {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				v := uint8((x*255/width + y*128/height) % 256)
+				if invert {
+					v = 255 - v
+				}
+				img.SetGray(x, y, color.Gray{Y: v})
+			}
+		}
+		return img
+	}
+
+	a := replay.Hash(gradient(90, 80, false))
+	if d := replay.HashDistance(a, a); d != 0 {
+		t.Errorf("identical images: got distance %d", d)
+	}
+	if d := replay.HashDistance(a, replay.Hash(gradient(45, 40, false))); d > 4 {
+		t.Errorf("scaled image: got distance %d", d)
+	}
+	if d := replay.HashDistance(a, replay.Hash(gradient(90, 80, true))); d < 32 {
+		t.Errorf("inverted image: got distance %d", d)
+	}
+}
+
+// createNoisyPNG creates an image with enough detail for JPEG quality to matter
+func createNoisyPNG(width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x*7 ^ y*13), G: uint8(x*y + y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// withDefaultQuality sets q on requests that don't specify one, emulating a
+// deployment with a different default quality.
+func withDefaultQuality(h http.Handler, quality string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("q") == "" && q.Get("quality") == "" {
+			q.Set("q", quality)
+			r.URL.RawQuery = q.Encode()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TestReplayDetectsDiffs replays against two handlers with different default qualities
+func TestReplayDetectsDiffs(t *testing.T) {
+	src := createNoisyPNG(128, 128)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	oldHandler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer oldHandler.Close()
+	newHandler := ipxpress.NewHandler(ipxpress.DefaultConfig())
+	defer newHandler.Close()
+
+	oldServer := httptest.NewServer(withDefaultQuality(oldHandler, "90"))
+	defer oldServer.Close()
+	newServer := httptest.NewServer(withDefaultQuality(newHandler, "10"))
+	defer newServer.Close()
+
+	imageURL := url.QueryEscape(origin.URL + "/a.png")
+	requests := []string{
+		"/?f=jpeg&w=100&url=" + imageURL,      // quality default differs
+		"/?f=jpeg&w=100&q=80&url=" + imageURL, // explicit quality, identical
+		"/?f=png&w=64&url=" + imageURL,        // lossless, identical
+	}
+
+	report, err := replay.Run(context.Background(), requests, replay.Options{
+		Targets:     []string{oldServer.URL, newServer.URL},
+		Concurrency: 2,
+	})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+
+	if len(report.Results) != len(requests) {
+		t.Fatalf("expected %d results, got %d", len(requests), len(report.Results))
+	}
+	for i, res := range report.Results {
+		if res.Request != requests[i] {
+			t.Errorf("result %d is for %q, want %q", i, res.Request, requests[i])
+		}
+		for _, resp := range res.Responses {
+			if resp.Status != http.StatusOK || resp.Width != res.Responses[0].Width {
+				t.Errorf("%s: unexpected response %+v", res.Request, resp)
+			}
+		}
+	}
+
+	first := report.Results[0].Diff
+	if !first.Differs || !first.Size || first.Pixel <= replay.DefaultThreshold {
+		t.Errorf("expected a quality diff, got %+v", first)
+	}
+	for _, res := range report.Results[1:] {
+		if res.Diff.Differs {
+			t.Errorf("%s: expected no diff, got %+v", res.Request, res.Diff)
+		}
+	}
+	if report.Summary.Differing != 1 || report.Summary.Requests != 3 {
+		t.Errorf("unexpected summary %+v", report.Summary)
+	}
+
+	var out bytes.Buffer
+	report.WriteSummary(&out)
+	if !strings.Contains(out.String(), "differing: 1") || !strings.Contains(out.String(), requests[0]) {
+		t.Errorf("summary missing the diff:\n%s", out.String())
+	}
+}
+
+// TestReplayStatusDiff verifies status changes are reported without decoding
+func TestReplayStatusDiff(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	report, err := replay.Run(context.Background(), []string{"/a", "/b"}, replay.Options{
+		Targets: []string{ok.URL, missing.URL},
+	})
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if report.Summary.StatusDiffs != 2 || report.Summary.Differing != 2 {
+		t.Errorf("expected two status diffs, got %+v", report.Summary)
+	}
+
+	if _, err := replay.Run(context.Background(), nil, replay.Options{}); err == nil {
+		t.Error("expected an error without targets")
+	}
+}